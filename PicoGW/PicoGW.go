@@ -0,0 +1,393 @@
+// Package PicoGW drives the USB concentrator sticks of the Semtech picocell gateway reference
+// design, an SX1308 behind an STM32 MCU, with the serial protocol of the MCU firmware.
+//
+// Each command is a header of an ID, the length of the data and an address, followed by the
+// data, and the MCU answers with the ID, the length, a status and the data. The HAL structs
+// are sent as the MCU lays them out in memory, little endian with 32 bit ARM alignment.
+//
+// Only the configuration, receive and send commands of the MCU are used. The start-up of the
+// concentrator, the radio calibration and the upload of the AGC and arbiter firmwares, runs
+// on the host in the picoGW HAL and is not done here, so the concentrator must have been
+// started by the HAL, e.g. by its packet forwarder, since it was powered up.
+package PicoGW
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/serial"
+)
+
+const LogLevelNone = 0
+const LogLevelDebug = 5
+const LogLevelVerbose = 4
+const LogLevelNormal = 3
+const LogLevelWarning = 2
+const LogLevelError = 1
+
+var logLevel = []string{
+	"[     ] ",
+	"[ERR  ] ",
+	"[WARN ] ",
+	"[     ] ",
+	"[VERBO] ",
+	"[DEBUG] ",
+}
+
+var LogLevel = LogLevelNone
+var Logger *log.Logger = log.New(os.Stdout, "[LORA ] ", 0)
+
+// cmdTimeout is how long the MCU may take to answer a command.
+const cmdTimeout = time.Second
+
+type Concentrator struct {
+	port io.ReadWriteCloser
+
+	LogLevel int
+	Logger   *log.Logger
+
+	id      uint64       // unique ID of the MCU
+	public  bool         // LoRaWAN public sync word
+	rxCfg   *lora.Config // config of the last Receive call
+	txStart time.Time    // when the last transmission was started
+	txDone  time.Time    // when the last transmission was over, from its airtime
+}
+
+var _ lora.Radio = (*Concentrator)(nil)
+
+func New(port io.ReadWriteCloser) *Concentrator {
+	return &Concentrator{
+		port:     port,
+		public:   true,
+		LogLevel: LogLevel,
+		Logger:   Logger,
+	}
+}
+
+// Discover opens the stick on the serial device of the config and reads the ID of its MCU.
+func Discover(cfg *lora.Config) (*Concentrator, error) {
+	if cfg.SerialDevice == "" {
+		return nil, errors.New("no serialDevice, the stick is a USB serial device, e.g. /dev/ttyACM0")
+	}
+	// the USB CDC device ignores the baud rate
+	port, err := serial.Open(cfg.SerialDevice, 115200)
+	if err != nil {
+		return nil, err
+	}
+	c := New(port)
+	c.public = cfg.Lorawan_public
+	if err := c.Check(); err != nil {
+		port.Close()
+		return nil, err
+	}
+	c.Log(LogLevelVerbose, "MCU %016X", c.id)
+	return c, nil
+}
+
+func (c *Concentrator) Name() string {
+	return "SX1308"
+}
+
+func (c *Concentrator) Log(level int, format string, v ...interface{}) {
+	if level <= c.LogLevel && level >= 0 && level < 6 {
+		c.Logger.Printf(logLevel[level]+format, v...)
+	}
+}
+
+// Check reads the unique ID of the MCU to tell if it still answers.
+func (c *Concentrator) Check() error {
+	data, err := c.command(CMD_GET_UNIQUE_ID, 0, nil)
+	if err != nil {
+		return err
+	}
+	if len(data) < 8 {
+		return fmt.Errorf("unique ID of %d bytes", len(data))
+	}
+	c.id = binary.BigEndian.Uint64(data)
+	return nil
+}
+
+func (c *Concentrator) Close() error {
+	return c.port.Close()
+}
+
+// command sends a command with its address and data and returns the data of the answer.
+func (c *Concentrator) command(id, addr byte, data []byte) ([]byte, error) {
+	buf := make([]byte, HEADER_SIZE+len(data), HEADER_SIZE+len(data)+1)
+	buf[0] = id
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(data)))
+	buf[3] = addr
+	copy(buf[HEADER_SIZE:], data)
+	// a transfer of whole USB packets waits for the next one, so it is padded
+	if len(buf)%USB_PACKET == 0 {
+		buf = append(buf, 0)
+	}
+	c.Log(LogLevelDebug, "Command %c: % X", id, data)
+	if d, ok := c.port.(interface{ SetReadDeadline(time.Time) error }); ok {
+		if err := d.SetReadDeadline(time.Now().Add(cmdTimeout)); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := c.port.Write(buf); err != nil {
+		return nil, err
+	}
+	head := make([]byte, HEADER_SIZE)
+	if _, err := io.ReadFull(c.port, head); err != nil {
+		return nil, readError(id, err)
+	}
+	ans := make([]byte, binary.BigEndian.Uint16(head[1:]))
+	if _, err := io.ReadFull(c.port, ans); err != nil {
+		return nil, readError(id, err)
+	}
+	if head[0] != id {
+		return nil, fmt.Errorf("command %c: answer to %c", id, head[0])
+	}
+	if head[3] != ACK_OK {
+		return nil, fmt.Errorf("command %c: not acknowledged", id)
+	}
+	return ans, nil
+}
+
+// readError returns the error of reading the answer to a command, as lora.ErrRadioTimeout if
+// the MCU did not answer within cmdTimeout.
+func readError(id byte, err error) error {
+	if t, ok := err.(interface{ Timeout() bool }); ok && t.Timeout() {
+		return fmt.Errorf("command %c: %w", id, lora.ErrRadioTimeout)
+	}
+	return fmt.Errorf("command %c: %v", id, err)
+}
+
+func bandwidthCode(bw lora.Bandwidth) (byte, error) {
+	switch bw {
+	case lora.BW125K:
+		return BW_125KHZ, nil
+	case lora.BW250K:
+		return BW_250KHZ, nil
+	case lora.BW500K:
+		return BW_500KHZ, nil
+	}
+	return 0, fmt.Errorf("%w: bandwidth %s not supported by the concentrator", lora.ErrFrequency, bw)
+}
+
+func bandwidthOf(code byte) lora.Bandwidth {
+	switch code {
+	case BW_125KHZ:
+		return lora.BW125K
+	case BW_250KHZ:
+		return lora.BW250K
+	case BW_500KHZ:
+		return lora.BW500K
+	}
+	return 0
+}
+
+// datarateCode returns the bit of the spreading factor, from bit 1 for SF7 on.
+func datarateCode(sf lora.SpreadingFactor) (uint32, error) {
+	if sf < lora.SF7 {
+		return 0, fmt.Errorf("%w: %s not supported by the concentrator", lora.ErrBadDatarate, sf)
+	}
+	return 1 << (sf - 6), nil
+}
+
+func spreadingFactorOf(code uint32) lora.SpreadingFactor {
+	for sf := lora.SF7; sf <= lora.SF12; sf++ {
+		if code == 1<<(sf-6) {
+			return sf
+		}
+	}
+	return 0
+}
+
+var errNo2G4 = fmt.Errorf("%w: the concentrator does not support the 2.4 GHz band", lora.ErrFrequency)
+
+// Receive sends the board, radio and channel config to the MCU. Radio A is tuned to the
+// frequency of the config. With 125 kHz, the first multi-SF channel receives all spreading
+// factors, else the single-SF channel receives the spreading factor of the config.
+func (c *Concentrator) Receive(ctx context.Context, cfg *lora.Config) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.LoRaBW.Band2G4() {
+		return errNo2G4
+	}
+	bw, err := bandwidthCode(cfg.LoRaBW)
+	if err != nil {
+		return err
+	}
+	dr, err := datarateCode(cfg.Datarate)
+	if err != nil {
+		return err
+	}
+	c.rxCfg = cfg
+
+	board := []byte{0, 1} // lorawan_public, clksrc radio B
+	if c.public {
+		board[0] = 1
+	}
+	if _, err := c.command(CMD_BOARD_SETCONF, 0, board); err != nil {
+		return err
+	}
+
+	rf := make([]byte, RXRF_CONF_SIZE)
+	rf[0] = 1 // enable
+	binary.LittleEndian.PutUint32(rf[4:], uint32(float64(cfg.Freq)*(1+cfg.FreqCorrection/1e6)))
+	// the RSSI offset is added by the forwarder, so 0 here
+	binary.LittleEndian.PutUint32(rf[8:], math.Float32bits(0))
+	binary.LittleEndian.PutUint32(rf[12:], RADIO_SX1257)
+	rf[16] = 1 // tx_enable
+	if _, err := c.command(CMD_RXRF_SETCONF, 0, rf); err != nil {
+		return err
+	}
+
+	chain := byte(IF_LORA_STD)
+	if cfg.LoRaBW == lora.BW125K {
+		chain = IF_LORA_MULTI
+		dr = DR_LORA_MULTI
+	}
+	ifc := make([]byte, RXIF_CONF_SIZE)
+	ifc[0] = 1 // enable
+	ifc[1] = 0 // radio A, at offset 0
+	ifc[8] = bw
+	binary.LittleEndian.PutUint32(ifc[12:], dr)
+	if _, err := c.command(CMD_RXIF_SETCONF, chain, ifc); err != nil {
+		return err
+	}
+	c.Log(LogLevelDebug, "Receiving on %s, %s%s.", cfg.Freq, cfg.Datarate, cfg.LoRaBW)
+	return nil
+}
+
+// GetPacket returns the LoRa packets the concentrator received since the last call, or nil.
+// The packets must be released by the caller, see lora.Radio.
+func (c *Concentrator) GetPacket(ctx context.Context) ([]*lora.RxPacket, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	data, err := c.command(CMD_RECEIVE, 0, []byte{MAX_RX_PKTS})
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("receive: empty answer")
+	}
+	n := int(data[0])
+	data = data[1:]
+	var pkts []*lora.RxPacket
+	for i := 0; i < n; i++ {
+		if len(data) < RX_PKT_SIZE {
+			return pkts, errors.New("receive: short packet")
+		}
+		size := int(binary.LittleEndian.Uint16(data[42:]))
+		if len(data) < RX_PKT_SIZE+size || size > lora.MaxPayloadLength {
+			return pkts, errors.New("receive: short payload")
+		}
+		meta := data[:RX_PKT_SIZE]
+		payload := data[RX_PKT_SIZE : RX_PKT_SIZE+size]
+		data = data[RX_PKT_SIZE+size:]
+		if meta[13] != MOD_LORA {
+			continue
+		}
+		pkt := lora.NewRxPacket(size)
+		copy(pkt.Data, payload)
+		pkt.Freq = lora.Frequency(binary.LittleEndian.Uint32(meta[0:]))
+		pkt.ChainIF = meta[4]
+		switch meta[5] {
+		case STAT_CRC_OK:
+			pkt.StatCRC = 1
+		case STAT_CRC_BAD:
+			pkt.StatCRC = -1
+		}
+		pkt.Modulation = lora.ModulationLoRa
+		pkt.LoRaBW = bandwidthOf(meta[14])
+		pkt.Datarate = spreadingFactorOf(binary.LittleEndian.Uint32(meta[16:]))
+		// the coding rates of the HAL are 1 for 4/5 to 4 for 4/8
+		pkt.LoRaCR = lora.Coderate(meta[20] + 4)
+		pkt.RSSI = math.Float32frombits(binary.LittleEndian.Uint32(meta[24:]))
+		pkt.LoRaSNR = math.Float32frombits(binary.LittleEndian.Uint32(meta[28:]))
+		pkts = append(pkts, pkt)
+	}
+	return pkts, nil
+}
+
+// Send hands the packet to the concentrator to send immediately, as the forwarder schedules
+// the downlinks, and waits for its airtime. The transmission can not be aborted: if ctx is
+// done, Send returns while the concentrator may still be sending.
+func (c *Concentrator) Send(ctx context.Context, pkt *lora.TxPacket) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := pkt.Validate(nil); err != nil {
+		return err
+	}
+	if pkt.Modulation != lora.ModulationLoRa {
+		return errors.New("modulation must be \"LORA\"")
+	}
+	if pkt.LoRaBW.Band2G4() {
+		return errNo2G4
+	}
+	bw, err := bandwidthCode(pkt.LoRaBW)
+	if err != nil {
+		return err
+	}
+	dr, err := datarateCode(pkt.Datarate)
+	if err != nil {
+		return err
+	}
+	ppm := 0.0
+	if c.rxCfg != nil {
+		ppm = c.rxCfg.FreqCorrection
+	}
+	preamble := pkt.PreambleLength
+	if preamble == 0 {
+		preamble = 8
+	}
+
+	tx := make([]byte, TX_PKT_SIZE+len(pkt.Data))
+	binary.LittleEndian.PutUint32(tx[0:], uint32(float64(pkt.Freq)*(1+ppm/1e6)))
+	tx[4] = TX_IMMEDIATE
+	tx[12] = 0 // radio A
+	tx[13] = pkt.Power
+	tx[14] = MOD_LORA
+	tx[15] = bw
+	binary.LittleEndian.PutUint32(tx[16:], dr)
+	tx[20] = byte(pkt.LoRaCR) - 4
+	if pkt.InvertPolar {
+		tx[21] = 1
+	}
+	binary.LittleEndian.PutUint16(tx[24:], preamble)
+	if pkt.NoCRC {
+		tx[26] = 1
+	}
+	binary.LittleEndian.PutUint16(tx[28:], uint16(len(pkt.Data)))
+	copy(tx[TX_PKT_SIZE:], pkt.Data)
+	if _, err := c.command(CMD_SEND, 0, tx); err != nil {
+		return err
+	}
+	c.txStart = time.Now()
+
+	t := time.NewTimer(pkt.Airtime())
+	defer t.Stop()
+	select {
+	case <-t.C:
+		c.txDone = time.Now()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// LastTx returns when the last transmission was handed to the concentrator and when its
+// airtime was over. The concentrator does not report when it is done.
+func (c *Concentrator) LastTx() (start, done time.Time) {
+	return c.txStart, c.txDone
+}
@@ -0,0 +1,50 @@
+package PicoGW
+
+// Commands of the MCU of the picocell gateway, see loragw_mcu.c of the picoGW HAL.
+const (
+	CMD_RECEIVE       = 'b'
+	CMD_RXRF_SETCONF  = 'c'
+	CMD_RXIF_SETCONF  = 'd'
+	CMD_SEND          = 'f'
+	CMD_BOARD_SETCONF = 'i'
+	CMD_GET_UNIQUE_ID = 'l'
+)
+
+const (
+	ACK_OK = 1
+	ACK_KO = 0
+
+	HEADER_SIZE = 4 // id, length MSB, length LSB, address or status
+	USB_PACKET  = 64
+)
+
+// Constants of the concentrator HAL, as in the packet and config structs.
+const (
+	MOD_LORA = 0x10
+
+	BW_500KHZ = 0x01
+	BW_250KHZ = 0x02
+	BW_125KHZ = 0x03
+
+	DR_LORA_MULTI = 0x7E // SF7 to SF12, bit 1 for SF7 to bit 6 for SF12
+
+	STAT_NO_CRC  = 0x01
+	STAT_CRC_OK  = 0x10
+	STAT_CRC_BAD = 0x11
+
+	TX_IMMEDIATE = 0x00
+
+	RADIO_SX1257 = 2
+
+	IF_LORA_MULTI = 0 // first of the multi-SF LoRa channels, which receive 125 kHz only
+	IF_LORA_STD   = 8 // LoRa channel of a single spreading factor and any bandwidth
+)
+
+// Sizes of the structs of the HAL as laid out by the MCU, with the 32 bit ARM alignment.
+const (
+	RXRF_CONF_SIZE = 24
+	RXIF_CONF_SIZE = 32
+	RX_PKT_SIZE    = 44 // metadata of lgw_pkt_rx_s, followed by the payload
+	TX_PKT_SIZE    = 30 // metadata of lgw_pkt_tx_s, followed by the payload
+	MAX_RX_PKTS    = 16
+)
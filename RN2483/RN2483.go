@@ -0,0 +1,478 @@
+// Package RN2483 drives the Microchip RN2483 and RN2903 LoRa modules over their UART with
+// the radio commands of their firmware. The LoRaWAN stack of the modules is paused, so
+// they receive and send raw LoRa frames as the SPI radios do.
+package RN2483
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/serial"
+)
+
+const LogLevelNone = 0
+const LogLevelDebug = 5
+const LogLevelVerbose = 4
+const LogLevelNormal = 3
+const LogLevelWarning = 2
+const LogLevelError = 1
+
+var logLevel = []string{
+	"[     ] ",
+	"[ERR  ] ",
+	"[WARN ] ",
+	"[     ] ",
+	"[VERBO] ",
+	"[DEBUG] ",
+}
+
+var LogLevel = LogLevelNone
+var Logger *log.Logger = log.New(os.Stdout, "[LORA ] ", 0)
+
+// cmdTimeout is how long the module may take to answer a command.
+const cmdTimeout = time.Second
+
+const (
+	PrivateSyncWord = "12"
+	PublicSyncWord  = "34"
+)
+
+type Modem struct {
+	port  io.ReadWriteCloser
+	lines chan string // lines read from the port, closed on a read error
+	err   error       // the read error, set before lines is closed
+
+	LogLevel int
+	Logger   *log.Logger
+
+	name     string // "RN2483" or "RN2903"
+	syncWord string
+	settings map[string]string // radio settings as set, e.g. "sf": "sf7"
+	rxCfg    *lora.Config      // config of the last Receive call
+	freq     lora.Frequency
+	sf       lora.SpreadingFactor
+	bw       lora.Bandwidth
+	cr       lora.Coderate
+	rx       bool             // waiting for radio_rx
+	rxErr    bool             // the reception ended with radio_err
+	pending  []*lora.RxPacket // received while waiting for an answer
+	txStart  time.Time        // when the last transmission was started
+	txDone   time.Time        // when the last transmission was reported done
+}
+
+var _ lora.Radio = (*Modem)(nil)
+
+// New returns a Modem on the serial port, which is read from until it is closed.
+func New(port io.ReadWriteCloser) *Modem {
+	m := &Modem{
+		port:     port,
+		lines:    make(chan string, 16),
+		syncWord: PublicSyncWord,
+		LogLevel: LogLevel,
+		Logger:   Logger,
+	}
+	go m.read()
+	return m
+}
+
+// Discover opens the module on the serial device of the config and resets it.
+func Discover(cfg *lora.Config) (*Modem, error) {
+	if cfg.SerialDevice == "" {
+		return nil, errors.New("no serialDevice, the module is driven over its UART")
+	}
+	port, err := serial.Open(cfg.SerialDevice, 57600)
+	if err != nil {
+		return nil, err
+	}
+	m := New(port)
+	if !cfg.Lorawan_public {
+		m.syncWord = PrivateSyncWord
+	}
+	if err := m.Reset(); err != nil {
+		port.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Modem) read() {
+	s := bufio.NewScanner(m.port)
+	for s.Scan() {
+		m.lines <- strings.TrimSpace(s.Text())
+	}
+	m.err = s.Err()
+	if m.err == nil {
+		m.err = io.EOF
+	}
+	close(m.lines)
+}
+
+// Name returns the name of the module, as it reports it.
+func (m *Modem) Name() string {
+	return m.name
+}
+
+func (m *Modem) Log(level int, format string, v ...interface{}) {
+	if level <= m.LogLevel && level >= 0 && level < 6 {
+		m.Logger.Printf(logLevel[level]+format, v...)
+	}
+}
+
+// Reset resets the module, pauses its LoRaWAN stack and sets it up for LoRa.
+func (m *Modem) Reset() error {
+	m.rx, m.rxErr = false, false
+	m.settings = make(map[string]string)
+	m.sf, m.bw, m.cr, m.freq = 0, 0, 0, 0
+	ver, err := m.command("sys reset")
+	if err != nil {
+		return err
+	}
+	if err := m.setName(ver); err != nil {
+		return err
+	}
+	m.Log(LogLevelVerbose, "Module %s", ver)
+	// the pause is 2^32 ms at most, and renewed by each reset
+	if _, err := m.command("mac pause"); err != nil {
+		return err
+	}
+	for _, s := range [][2]string{{"mod", "lora"}, {"wdt", "0"}, {"sync", m.syncWord}} {
+		if err := m.set(s[0], s[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check reads the version of the module to tell if it still answers on the UART.
+func (m *Modem) Check() error {
+	ver, err := m.command("sys get ver")
+	if err != nil {
+		return err
+	}
+	return m.setName(ver)
+}
+
+func (m *Modem) setName(ver string) error {
+	name := strings.Fields(ver)
+	if len(name) == 0 || !strings.HasPrefix(name[0], "RN2") {
+		return fmt.Errorf("the module answers %q, not its version", ver)
+	}
+	m.name = name[0]
+	return nil
+}
+
+func (m *Modem) Close() error {
+	return m.port.Close()
+}
+
+// command sends a command and returns the answer of the module.
+func (m *Modem) command(cmd string) (string, error) {
+	m.Log(LogLevelDebug, "> %s", cmd)
+	if _, err := io.WriteString(m.port, cmd+"\r\n"); err != nil {
+		return "", err
+	}
+	timeout := time.NewTimer(cmdTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case line, ok := <-m.lines:
+			if !ok {
+				return "", m.err
+			}
+			m.Log(LogLevelDebug, "< %s", line)
+			if m.async(line) {
+				continue
+			}
+			switch line {
+			case "invalid_param", "busy", "radio_err":
+				return "", fmt.Errorf("%s: %s", cmd, line)
+			}
+			return line, nil
+		case <-timeout.C:
+			return "", fmt.Errorf("%s: no answer: %w", cmd, lora.ErrRadioTimeout)
+		}
+	}
+}
+
+// async handles the lines the module sends on its own, and tells if the line was one of them.
+func (m *Modem) async(line string) bool {
+	switch {
+	case strings.HasPrefix(line, "radio_rx "):
+		m.rx = false
+		data, err := hex.DecodeString(strings.TrimSpace(line[len("radio_rx "):]))
+		if err != nil {
+			m.Log(LogLevelWarning, "Bad frame: %q", line)
+			m.rxErr = true
+			return true
+		}
+		pkt := lora.NewRxPacket(len(data))
+		copy(pkt.Data, data)
+		pkt.StatCRC = 1
+		pkt.Freq = m.freq
+		pkt.Modulation = lora.ModulationLoRa
+		pkt.Datarate = m.sf
+		pkt.LoRaBW = m.bw
+		pkt.LoRaCR = m.cr
+		m.pending = append(m.pending, pkt)
+		return true
+	case line == "radio_err" && m.rx:
+		// a CRC or header error ends the reception
+		m.rx = false
+		m.rxErr = true
+		return true
+	case line == "radio_tx_ok":
+		// of a transmission that was given up
+		return true
+	}
+	return false
+}
+
+// set sets a radio setting, unless it is set already.
+func (m *Modem) set(name, value string) error {
+	if m.settings[name] == value {
+		return nil
+	}
+	if _, err := m.command("radio set " + name + " " + value); err != nil {
+		return err
+	}
+	m.settings[name] = value
+	return nil
+}
+
+// setChannel sets the frequency, shifted by ppm, and the modulation.
+func (m *Modem) setChannel(freq lora.Frequency, ppm float64, sf lora.SpreadingFactor, bw lora.Bandwidth, cr lora.Coderate) error {
+	switch bw {
+	case lora.BW125K, lora.BW250K, lora.BW500K:
+	default:
+		return fmt.Errorf("%w: bandwidth %s not supported by the module", lora.ErrFrequency, bw)
+	}
+	if sf < lora.SF7 {
+		return fmt.Errorf("%w: %s not supported by the module", lora.ErrBadDatarate, sf)
+	}
+	hz := uint32(float64(freq) * (1 + ppm/1e6))
+	settings := [][2]string{
+		{"freq", strconv.FormatUint(uint64(hz), 10)},
+		{"sf", "sf" + strconv.Itoa(int(sf))},
+		{"bw", strconv.Itoa(int(bw.Hz() / 1000))},
+		{"cr", cr.String()},
+	}
+	for _, s := range settings {
+		if err := m.set(s[0], s[1]); err != nil {
+			return err
+		}
+	}
+	m.freq, m.sf, m.bw, m.cr = freq, sf, bw, cr
+	return nil
+}
+
+// setPacket sets the preamble in symbols, 8 if 0, the CRC and the IQ inversion.
+func (m *Modem) setPacket(preamble uint16, crc, invertIQ bool) error {
+	if preamble == 0 {
+		preamble = 8
+	}
+	settings := [][2]string{
+		{"prlen", strconv.Itoa(int(preamble))},
+		{"crc", onOff(crc)},
+		{"iqi", onOff(invertIQ)},
+	}
+	for _, s := range settings {
+		if err := m.set(s[0], s[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// stopRx ends the reception, so that the radio can be set.
+func (m *Modem) stopRx() error {
+	if !m.rx {
+		return nil
+	}
+	m.rx = false
+	_, err := m.command("radio rxstop")
+	return err
+}
+
+// startRx starts a reception without timeout, which ends with the next frame.
+func (m *Modem) startRx() error {
+	if _, err := m.command("radio rx 0"); err != nil {
+		return err
+	}
+	m.rx, m.rxErr = true, false
+	return nil
+}
+
+var errNo2G4 = fmt.Errorf("%w: the module does not support the 2.4 GHz band", lora.ErrFrequency)
+
+// Receive configures the module and starts a reception.
+func (m *Modem) Receive(ctx context.Context, cfg *lora.Config) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.LoRaBW.Band2G4() {
+		return errNo2G4
+	}
+	if err := m.stopRx(); err != nil {
+		return err
+	}
+	m.rxCfg = cfg
+	if err := m.setChannel(cfg.Freq, cfg.FreqCorrection, cfg.Datarate, cfg.LoRaBW, cfg.LoRaCR); err != nil {
+		return err
+	}
+	if err := m.setPacket(cfg.PreambleLength, true, false); err != nil {
+		return err
+	}
+	if err := m.startRx(); err != nil {
+		return err
+	}
+	m.Log(LogLevelDebug, "Receiving on %s, %s%s.", cfg.Freq, cfg.Datarate, cfg.LoRaBW)
+	return nil
+}
+
+// GetPacket returns the packet received since the last call, or nil.
+// The module reports frames with CRC errors only as errors, so they are not returned.
+// The packet must be released by the caller, see lora.Radio.
+func (m *Modem) GetPacket(ctx context.Context) ([]*lora.RxPacket, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for m.pending == nil && !m.rxErr {
+		select {
+		case line, ok := <-m.lines:
+			if !ok {
+				return nil, m.err
+			}
+			m.Log(LogLevelDebug, "< %s", line)
+			if !m.async(line) {
+				m.Log(LogLevelWarning, "Unexpected %q", line)
+			}
+			continue
+		default:
+		}
+		return nil, nil
+	}
+	if m.pending == nil {
+		m.Log(LogLevelWarning, "Reception error.")
+		return nil, m.startRx()
+	}
+	pkts := m.pending
+	m.pending = nil
+	// the module keeps the RSSI and SNR of the last frame until the next one
+	if snr, err := m.command("radio get snr"); err == nil {
+		if n, err := strconv.Atoi(snr); err == nil {
+			pkts[len(pkts)-1].LoRaSNR = float32(n)
+		}
+	}
+	// firmware 1.0.5 on
+	if rssi, err := m.command("radio get rssi"); err == nil {
+		if n, err := strconv.Atoi(rssi); err == nil {
+			pkts[len(pkts)-1].RSSI = float32(n)
+		}
+	}
+	return pkts, nil
+}
+
+// maxPower returns the highest TX output power of the module in dBm.
+func (m *Modem) maxPower() uint8 {
+	if m.name == "RN2903" {
+		return 20
+	}
+	return 15
+}
+
+// Send transmits the packet and waits until the module reports it sent. The power is
+// limited to what the module supports. The transmission can not be aborted: if ctx is done,
+// Send returns while the module may still be sending.
+func (m *Modem) Send(ctx context.Context, pkt *lora.TxPacket) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := pkt.Validate(nil); err != nil {
+		return err
+	}
+	if pkt.Modulation != lora.ModulationLoRa {
+		return errors.New("modulation must be \"LORA\"")
+	}
+	if pkt.LoRaBW.Band2G4() {
+		return errNo2G4
+	}
+	if err := m.stopRx(); err != nil {
+		return err
+	}
+	ppm := 0.0
+	if m.rxCfg != nil {
+		ppm = m.rxCfg.FreqCorrection
+	}
+	if err := m.setChannel(pkt.Freq, ppm, pkt.Datarate, pkt.LoRaBW, pkt.LoRaCR); err != nil {
+		return err
+	}
+	if err := m.setPacket(pkt.PreambleLength, !pkt.NoCRC, pkt.InvertPolar); err != nil {
+		return err
+	}
+	power := pkt.Power
+	if power > m.maxPower() {
+		power = m.maxPower()
+	}
+	if m.name == "RN2903" && power < 2 {
+		power = 2
+	}
+	if err := m.set("pwr", strconv.Itoa(int(power))); err != nil {
+		return err
+	}
+	if _, err := m.command("radio tx " + hex.EncodeToString(pkt.Data)); err != nil {
+		return err
+	}
+	m.txStart = time.Now()
+
+	timeout := time.NewTimer(pkt.Airtime() + cmdTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case line, ok := <-m.lines:
+			if !ok {
+				return m.err
+			}
+			m.Log(LogLevelDebug, "< %s", line)
+			switch line {
+			case "radio_tx_ok":
+				m.txDone = time.Now()
+				return nil
+			case "radio_err":
+				return errors.New("tx failed")
+			}
+			if !m.async(line) {
+				m.Log(LogLevelWarning, "Unexpected %q", line)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			return fmt.Errorf("tx: %w", lora.ErrRadioTimeout)
+		}
+	}
+}
+
+// LastTx returns when the last transmission was started and when the module reported it done.
+// The answers of the module take some milliseconds over the UART.
+func (m *Modem) LastTx() (start, done time.Time) {
+	return m.txStart, m.txDone
+}
@@ -1,9 +1,11 @@
 package SX127X
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"time"
 
@@ -62,6 +64,17 @@ type Chip struct {
 	NeedPABOOST     bool
 	power           byte
 	channel         uint32
+	freq            lora.Frequency
+	lna             byte // REG_LNA value for receiving
+	agc             bool
+	ppm             float64          // frequency correction applied by SetFreq
+	ppmCfg          float64          // configured frequency correction, see Receive
+	afc             bool             // automatic frequency correction
+	txStart         time.Time        // when the last transmission was started
+	txDone          time.Time        // when the TX done flag of the last transmission was seen
+	sleeping        bool             // put to sleep by SetPowerMode, until the next Receive or Send
+	rxCfg           *lora.Config     // config of the last Receive call
+	meter           *lora.PowerMeter // estimates the power consumption
 }
 
 var logLevel = []string{
@@ -91,6 +104,9 @@ func New(dev spi.Conn, pinRst gpio.PinIO) *Chip {
 		NeedPABOOST:     true,
 		LogLevel:        LogLevel,
 		Logger:          Logger,
+		lna:             LNA_MAX_GAIN,
+		agc:             true,
+		meter:           lora.NewPowerMeter(lora.PowerStandby, standbyCurrent*supplyVoltage),
 	}
 }
 
@@ -145,42 +161,47 @@ func Discover(cfg *lora.Config) (*Chip, error) {
 	}
 	pinRST := gpioreg.ByName(cfg.PinRst)
 
-	if err := pinRST.Out(gpio.Low); err != nil {
+	// SX127X instance
+	c := New(conn, pinRST)
+	if !cfg.Lorawan_public {
+		c.defaultSyncWord = PrivateSyncWord
+	}
+	if err := c.Reset(); err != nil {
+		c.Close()
 		return nil, err
 	}
+	return c, nil
+}
+
+// Reset resets the chip with its reset pin and sets it up as Discover does.
+// The channel is lost, so Receive must be called again.
+func (c *Chip) Reset() error {
+	if err := c.pinRst.Out(gpio.Low); err != nil {
+		return err
+	}
 	delay(100)
-	if err := pinRST.Out(gpio.High); err != nil {
-		return nil, err
+	if err := c.pinRst.Out(gpio.High); err != nil {
+		return err
 	}
 	delay(100)
 
-	// Reset GIOP Pin
-	// pinRst, err := gpio.Output(17)
-	// if err != nil {
-	// 	return nil, err
-	// }
-
-	// SX127X instance
-	c := New(conn, pinRST)
-
-	// c.pinSS.Write(High)
-	// delay(100)
-
-	// c.pinRst.Write(Low)
-	// delay(100)
-	// c.pinRst.Write(High)
-	// delay(100)
-
 	version, err := c.readRegister(RegVersion)
 	if err != nil {
-		c.Close()
-		return nil, err
+		return err
 	}
-	c.version = version
 	if version != VersionSX1272 && version != VersionSX1276 {
-		c.Close()
-		return nil, fmt.Errorf("unknown chip version: 0x%x", version)
+		return fmt.Errorf("unknown chip version: 0x%x", version)
 	}
+	c.version = version
+
+	c.sleeping = false
+	c.meter.Set(lora.PowerStandby, standbyCurrent*supplyVoltage)
+
+	// the registers are back to their defaults, so Receive sets all of them
+	c.spreadingFactor = 0
+	c.codingRate = 0xFF
+	c.bandwidth = 0xFF
+	c.power = 0
 
 	// init
 	// c.writeRegister(0x1, 0x81)
@@ -193,16 +214,27 @@ func Discover(cfg *lora.Config) (*Chip, error) {
 	c.SetMaxCurrent(0x1B)
 	c.SetLORA()
 	c.SetCRC(true)
-	if cfg.Lorawan_public {
-		c.Log(LogLevelDebug, "Set PublicSyncWord 0x%x", PublicSyncWord)
-		c.SetSyncWord(PublicSyncWord)
-	} else{
-		c.Log(LogLevelDebug, "Set PublicSyncWord 0x%x", PrivateSyncWord)
-		c.SetSyncWord(PrivateSyncWord)
-	}
+	c.Log(LogLevelDebug, "Set sync word 0x%x", c.defaultSyncWord)
+	c.SetSyncWord(c.defaultSyncWord)
 	// c.SetIQInversion(true)
 
-	return c, nil
+	return nil
+}
+
+// Check reads the version register to tell if the chip still answers on the SPI bus.
+// A chip that lost power or a loose wire read as all zeros or all ones.
+func (c *Chip) Check() error {
+	version, err := c.readRegister(RegVersion)
+	if err != nil {
+		return err
+	}
+	switch version {
+	case c.version:
+		return nil
+	case 0x00, 0xFF:
+		return fmt.Errorf("spi reads 0x%02x, the chip does not answer", version)
+	}
+	return fmt.Errorf("chip version changed from 0x%x to 0x%x", c.version, version)
 }
 
 func (c *Chip) Name() string {
@@ -427,13 +459,19 @@ func (c *Chip) RxChainCalibration() (err error) {
 	return
 }
 
-func (c *Chip) SetFreq(freq uint32) (err error) {
-	var ch = uint32((uint64(freq) << 19) / 32000000)
-	return c.SetChannel(ch)
+func (c *Chip) SetFreq(freq lora.Frequency) (err error) {
+	hz := math.Round(float64(freq) * (1 + c.ppm/1e6))
+	var ch = uint32((uint64(hz) << 19) / 32000000)
+	if err = c.SetChannel(ch); err == nil {
+		c.freq = freq
+	}
+	return
 }
 
-func (c *Chip) GetFreq() uint32 {
-	return uint32((uint64(c.channel) * 32000000) >> 19)
+// GetFreq returns the frequency set with SetFreq, which is more exact than
+// the one derived from the channel register.
+func (c *Chip) GetFreq() lora.Frequency {
+	return c.freq
 }
 
 func (c *Chip) SetChannel(ch uint32) (err error) {
@@ -463,6 +501,7 @@ func (c *Chip) SetChannel(ch uint32) (err error) {
 		var freq = uint32((uint64(ch) * 32000000) >> 19)
 		c.Log(LogLevelVerbose, "Channel changed to 0x%06x: %.2f Mhz", ch, float64(freq)/1e6)
 		c.channel = ch
+		c.freq = lora.Frequency(freq)
 	}
 	c.writeRegister(REG_OP_MODE, st0) // Getting back to previous status
 	return
@@ -554,7 +593,7 @@ func (c *Chip) receive() (err error) {
 
 	// writeRegister(REG_LNA, 0x23)			// Important in reception
 	// modified by C. Pham
-	c.writeRegister(REG_LNA, LNA_MAX_GAIN)
+	c.writeRegister(REG_LNA, c.lna)
 	c.writeRegister(REG_FIFO_ADDR_PTR, 0x00) // Setting address pointer in FIFO data buffer
 	// change RegSymbTimeoutLsb
 	// comment by C. Pham
@@ -579,12 +618,15 @@ func (c *Chip) receive() (err error) {
 	if c.mode == ModeLoRa {
 		// LoRa mode
 		c.setPacketLength(MAX_LENGTH)              // With MAX_LENGTH gets all packets with length < MAX_LENGTH
+		c.setAGC()                                 // setPacketLength resets the modem config
 		c.writeRegister(REG_OP_MODE, LORA_RX_MODE) // LORA mode - Rx
+		c.meter.Set(lora.PowerRx, rxCurrent*supplyVoltage)
 		c.Log(LogLevelDebug, "Receiving LoRa mode activated with success.")
 	} else {
 		// FSK mode
 		c.setPacketLength(c.payloadLength)
 		c.writeRegister(REG_OP_MODE, FSK_RX_MODE) // FSK mode - Rx
+		c.meter.Set(lora.PowerRx, rxCurrent*supplyVoltage)
 		c.Log(LogLevelDebug, "Receiving FSK mode activated with succes.")
 	}
 	return nil
@@ -625,43 +667,29 @@ func (c *Chip) setPacketLength(length byte) (err error) {
 }
 
 var ErrIncorrectCRC = fmt.Errorf("incorrect CRC")
-var ErrTimeout = fmt.Errorf("timeout")
-
-var bandwidths = map[uint32]byte{
-	7800:   BW_7_8,
-	10400:  BW_10_4,
-	15600:  BW_15_6,
-	20800:  BW_20_8,
-	31250:  BW_31_25,
-	41700:  BW_41_7,
-	62500:  BW_62_5,
-	125000: BW_125,
-	250000: BW_250,
-	500000: BW_500,
-}
+var ErrTimeout = fmt.Errorf("tx: %w", lora.ErrRadioTimeout)
 
-var coderates = map[string]byte{
-	"4/5": CR_5,
-	"4/6": CR_6,
-	"2/3": CR_6,
-	"4/7": CR_7,
-	"4/8": CR_8,
-	"2/4": CR_8,
-	"1/2": CR_8,
-}
-
-func (c *Chip) Receive(cfg *lora.Config) error {
+func (c *Chip) Receive(ctx context.Context, cfg *lora.Config) error {
 
-	bw, ok := bandwidths[cfg.LoRaBW]
-	if !ok {
-		return fmt.Errorf("unknown bandwidth: %d", cfg.LoRaBW)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
 	}
-	cr, ok := coderates[cfg.LoRaCR]
-	if !ok {
-		return fmt.Errorf("unknown coderate: %s", cfg.LoRaCR)
+	if cfg.LoRaBW.Band2G4() {
+		return errNo2G4
 	}
+	if err := c.wake(); err != nil {
+		return err
+	}
+	c.rxCfg = cfg
+
+	// the chip codes are one (bandwidth) and four (coderate) below the lora package codes
+	bw := byte(cfg.LoRaBW) - 1
+	cr := byte(cfg.LoRaCR) - 4
 
-	sf := cfg.Datarate
+	sf := uint32(cfg.Datarate)
 
 	if c.codingRate != cr {
 		if err := c.SetCR(cr); err != nil {
@@ -679,12 +707,23 @@ func (c *Chip) Receive(cfg *lora.Config) error {
 		}
 	}
 
+	// the automatic correction keeps its estimate until the configured value changes
+	if !cfg.AutoFreqCorrection || cfg.FreqCorrection != c.ppmCfg {
+		c.ppm = cfg.FreqCorrection
+	}
+	c.ppmCfg = cfg.FreqCorrection
+	c.afc = cfg.AutoFreqCorrection
+
 	if err := c.SetFreq(cfg.Freq); err != nil {
 		return err
 	}
 
 	c.SetPowerDBM(14)
 
+	if err := c.SetRxGain(cfg.RxGain); err != nil {
+		return err
+	}
+
 	// from ReceiveAll()
 	if c.mode == ModemFSK { // FSK mode
 		c.writeRegister(REG_OP_MODE, FSK_STANDBY_MODE) // Setting standby FSK mode
@@ -696,6 +735,62 @@ func (c *Chip) Receive(cfg *lora.Config) error {
 	return c.receive()
 }
 
+// SetRxGain sets the LNA gain, AGC and LNA boost.
+func (c *Chip) SetRxGain(g lora.RxGain) error {
+	gain := g.LNAGain
+	if gain == 0 {
+		gain = 1
+	}
+	c.lna = gain << 5
+	if g.BoostOn() {
+		c.lna |= 0x03
+	}
+	c.agc = g.AGCOn()
+	if err := c.writeRegister(REG_LNA, c.lna); err != nil {
+		return err
+	}
+	return c.setAGC()
+}
+
+// agcRegister returns the register with the AgcAutoOn bit, which differs between the chips.
+func (c *Chip) agcRegister() byte {
+	if c.version == VersionSX1272 {
+		return REG_MODEM_CONFIG2
+	}
+	return REG_MODEM_CONFIG3
+}
+
+func (c *Chip) setAGC() error {
+	config, err := c.readRegister(c.agcRegister())
+	if err != nil {
+		return err
+	}
+	if c.agc {
+		config |= 0x04 // AgcAutoOn
+	} else {
+		config &^= 0x04
+	}
+	return c.writeRegister(c.agcRegister(), config)
+}
+
+// GetRxGain reads the applied LNA gain, AGC and LNA boost from the chip.
+func (c *Chip) GetRxGain() (g lora.RxGain, err error) {
+	lna, err := c.readRegister(REG_LNA)
+	if err != nil {
+		return g, err
+	}
+	config, err := c.readRegister(c.agcRegister())
+	if err != nil {
+		return g, err
+	}
+	agc := config&0x04 != 0
+	boost := lna&0x03 == 0x03
+	g.AGC = &agc
+	g.LNAGain = lna >> 5
+	g.Boost = &boost
+	return g, nil
+}
+
 func (c *Chip) Read() ([]byte, error) {
 	mode, _ := c.readRegister(REG_OP_MODE)
 	if (c.mode == ModeLoRa && mode != LORA_RX_MODE) || (c.mode == ModemFSK && mode != FSK_RX_MODE) {
@@ -703,32 +798,219 @@ func (c *Chip) Read() ([]byte, error) {
 			return nil, err
 		}
 	}
-	data, _, err := c.getPacket()
+	data, _, err := c.getPacket(make([]byte, lora.MaxPayloadSize))
 	return data, err
 }
 
-func (c *Chip) GetPacket() ([]*lora.RxPacket, error) {
-	data, crc, err := c.getPacket()
+var _ lora.Radio = (*Chip)(nil)
+
+// GetPacket returns the packet received since the last call, or nil.
+// The packet must be released by the caller, see lora.Radio.
+func (c *Chip) GetPacket(ctx context.Context) ([]*lora.RxPacket, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pkt := lora.NewRxPacket(lora.MaxPayloadSize)
+	data, crc, err := c.getPacket(pkt.Data)
 	if data == nil || err != nil {
+		pkt.Release()
 		return nil, err
 	}
 	rssi, _ := c.GetRSSIpacket()
 	snr, _ := c.getSNR()
-	pkt := &lora.RxPacket{
-		RSSI:       float32(rssi),
-		Data:       data,
-		StatCRC:    crc,
-		Freq:       c.GetFreq(),
-		Modulation: "LORA",
-		Datarate:   uint32(c.spreadingFactor),
-		LoRaCR:     c.codingRate + 4,
-		LoRaBW:     c.bandwidth + 1,
-		LoRaSNR:    float32(snr),
+	pkt.RSSI = float32(rssi)
+	pkt.Data = data
+	pkt.StatCRC = crc
+	pkt.Freq = c.GetFreq()
+	pkt.Modulation = lora.ModulationLoRa
+	pkt.Datarate = lora.SpreadingFactor(c.spreadingFactor)
+	pkt.LoRaCR = lora.Coderate(c.codingRate + 4)
+	pkt.LoRaBW = lora.Bandwidth(c.bandwidth + 1)
+	pkt.LoRaSNR = float32(snr)
+	if fe, err := c.GetFreqError(); err == nil {
+		pkt.FreqOffset = fe
+		if c.afc && crc == 1 {
+			c.trackFreqError(fe)
+		}
 	}
 	return []*lora.RxPacket{pkt}, err
 }
 
-func (c *Chip) getPacket() (data []byte, crc int8, err error) {
+// afcWeight is the weight of a single frame in the automatic frequency correction.
+// The devices have crystal offsets of their own, which average out over many frames.
+const afcWeight = 0.1
+
+// trackFreqError moves the frequency correction towards the frequency error fe in Hz.
+// The new correction applies with the next SetFreq.
+func (c *Chip) trackFreqError(fe int32) {
+	ppm := c.ppm + afcWeight*float64(fe)/float64(c.freq)*1e6
+	ppm = math.Max(-lora.MaxFreqCorrection, math.Min(lora.MaxFreqCorrection, ppm))
+	c.Log(LogLevelVerbose, "Frequency error %d Hz, correction %.2f ppm.", fe, ppm)
+	c.ppm = ppm
+}
+
+// GetFreqError returns the frequency error of the last received LoRa frame in Hz,
+// which is the frequency of the frame minus the frequency the radio listens on.
+func (c *Chip) GetFreqError() (int32, error) {
+	if c.mode != ModeLoRa {
+		return 0, errors.New("no frequency error in FSK mode")
+	}
+	var fei int32
+	for _, reg := range []byte{REG_FEI_MSB_LORA, REG_FEI_MID_LORA, REG_FEI_LSB_LORA} {
+		b, err := c.readRegister(reg)
+		if err != nil {
+			return 0, err
+		}
+		fei = fei<<8 | int32(b)
+	}
+	// 20 bit two's complement
+	fei = fei << 12 >> 12
+	bw := int64(lora.Bandwidth(c.bandwidth + 1).Hz())
+	return int32(int64(fei) * (1 << 24) * bw / (32000000 * 500000)), nil
+}
+
+// CurrentRSSI returns the current RSSI of the channel in dBm, see lora.RSSIReader.
+// The offset is the one of RegRssiValue in the datasheets: -157 dBm for the high frequency
+// port of the SX1276, -164 dBm below 779 MHz, and -139 dBm for the SX1272.
+func (c *Chip) CurrentRSSI() (float32, error) {
+	if c.mode != ModeLoRa {
+		return 0, errors.New("no RSSI in FSK mode")
+	}
+	v, err := c.readRegister(REG_RSSI_VALUE_LORA)
+	if err != nil {
+		return 0, err
+	}
+	offset := -OFFSET_RSSI
+	if c.version == VersionSX1276 {
+		offset = -157
+		if c.GetFreq().MHz() < 779 {
+			offset = -164
+		}
+	}
+	return float32(offset + int(v)), nil
+}
+
+// Typical currents of the SX1276 at 3.3 V in mA, from its datasheet, which the power
+// consumption is estimated with, see lora.PowerManager.
+const (
+	supplyVoltage  = 3.3
+	sleepCurrent   = 0.0002
+	standbyCurrent = 1.6
+	rxCurrent      = 11.5
+)
+
+// txCurrent returns the typical current when sending with the power in dBm.
+func txCurrent(dbm uint8) float64 {
+	switch {
+	case dbm >= 20:
+		return 120
+	case dbm >= 17:
+		return 87
+	case dbm >= 13:
+		return 29
+	}
+	return 20
+}
+
+// SetPowerMode puts the chip to sleep, in standby or back to receive, see lora.PowerManager.
+// Asleep, the chip draws about 1 µA and does not keep its FIFO.
+func (c *Chip) SetPowerMode(ctx context.Context, mode lora.PowerMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	switch mode {
+	case lora.PowerSleep:
+		op := byte(LORA_SLEEP_MODE)
+		if c.mode == ModemFSK {
+			op = FSK_SLEEP_MODE
+		}
+		if err := c.writeRegister(REG_OP_MODE, op); err != nil {
+			return err
+		}
+		c.sleeping = true
+		c.meter.Set(lora.PowerSleep, sleepCurrent*supplyVoltage)
+		c.Log(LogLevelDebug, "Sleeping.")
+		return nil
+	case lora.PowerStandby:
+		if c.sleeping {
+			return c.wake()
+		}
+		op := byte(LORA_STANDBY_MODE)
+		if c.mode == ModemFSK {
+			op = FSK_STANDBY_MODE
+		}
+		if err := c.writeRegister(REG_OP_MODE, op); err != nil {
+			return err
+		}
+		c.meter.Set(lora.PowerStandby, standbyCurrent*supplyVoltage)
+		return nil
+	case lora.PowerRx:
+		if c.rxCfg == nil {
+			return errors.New("can not receive before Receive is called")
+		}
+		return c.Receive(ctx, c.rxCfg)
+	}
+	return fmt.Errorf("can not set power mode %s", mode)
+}
+
+// PowerMode returns the current power mode of the chip.
+func (c *Chip) PowerMode() lora.PowerMode {
+	return c.meter.Mode()
+}
+
+// PowerUsage returns the time in each power mode and the estimated energy consumption.
+func (c *Chip) PowerUsage() lora.PowerUsage {
+	return c.meter.Usage()
+}
+
+var _ lora.PowerManager = (*Chip)(nil)
+
+// wake puts the chip from sleep in standby mode, where its registers and FIFO can be written.
+func (c *Chip) wake() error {
+	if !c.sleeping {
+		return nil
+	}
+	mode := byte(LORA_STANDBY_MODE)
+	if c.mode == ModemFSK {
+		mode = FSK_STANDBY_MODE
+	}
+	if err := c.writeRegister(REG_OP_MODE, mode); err != nil {
+		return err
+	}
+	c.sleeping = false
+	c.meter.Set(lora.PowerStandby, standbyCurrent*supplyVoltage)
+	// the oscillator starts in about 250 µs
+	time.Sleep(time.Millisecond)
+	return nil
+}
+
+// LastTx returns when the last transmission was started and when its TX done flag was seen.
+// The LoRa TX done flag is polled every millisecond.
+func (c *Chip) LastTx() (start, done time.Time) {
+	return c.txStart, c.txDone
+}
+
+// Receiving tells if the modem is receiving a LoRa frame, from the preamble on until RX done.
+func (c *Chip) Receiving() (bool, error) {
+	if c.mode != ModeLoRa {
+		return false, nil
+	}
+	stat, err := c.readRegister(REG_MODEM_STAT)
+	if err != nil {
+		return false, err
+	}
+	// signal detected, signal synchronized or header info valid
+	return stat&0x0B != 0, nil
+}
+
+// FreqCorrection returns the frequency correction in ppm, see lora.Config.FreqCorrection.
+func (c *Chip) FreqCorrection() float64 {
+	return c.ppm
+}
+
+// getPacket reads the received packet into buf, which must be lora.MaxPayloadSize bytes long.
+// It returns nil if no packet has been received.
+func (c *Chip) getPacket(buf []byte) (data []byte, crc int8, err error) {
 
 	c.Log(LogLevelDebug, "Starting 'getPacket'.")
 
@@ -809,7 +1091,7 @@ func (c *Chip) getPacket() (data []byte, crc int8, err error) {
 	}
 
 	length, _ := c.readRegister(REG_RX_NB_BYTES)
-	data = make([]byte, length)
+	data = buf[:length]
 	for i := 0; i < int(length); i++ {
 		data[i], _ = c.readRegister(REG_FIFO) // Storing payload
 	}
@@ -1786,11 +2068,30 @@ func (c *Chip) isSF(spr uint32) bool {
 
 var errOnlyLora = errors.New("modulation must be \"LORA\"")
 
-func (c *Chip) Send(pkt *lora.TxPacket) (err error) {
+// errNo2G4 is returned for the 2.4 GHz band, which the sx1280 backend serves.
+var errNo2G4 = fmt.Errorf("%w: the chip does not support the 2.4 GHz band", lora.ErrFrequency)
 
-	cr := pkt.LoRaCR - 4
-	bw := pkt.LoRaBW - 1
-	sf := pkt.Datarate
+func (c *Chip) Send(ctx context.Context, pkt *lora.TxPacket) (err error) {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := pkt.Validate(nil); err != nil {
+		return err
+	}
+	if pkt.Modulation != lora.ModulationLoRa {
+		return errOnlyLora
+	}
+	if pkt.LoRaBW.Band2G4() {
+		return errNo2G4
+	}
+	if err := c.wake(); err != nil {
+		return err
+	}
+
+	cr := byte(pkt.LoRaCR) - 4
+	bw := byte(pkt.LoRaBW) - 1
+	sf := uint32(pkt.Datarate)
 
 	if c.codingRate != cr {
 		if err := c.SetCR(cr); err != nil {
@@ -1820,7 +2121,10 @@ func (c *Chip) Send(pkt *lora.TxPacket) (err error) {
 		}
 	}
 
-	err = c.sendPacketTimeout(pkt.Data, 10000)
+	c.meter.Set(lora.PowerTx, txCurrent(pkt.Power)*supplyVoltage)
+	err = c.sendPacketTimeout(ctx, pkt.Data, 10000)
+	// the chip goes to standby once the packet is sent
+	c.meter.Set(lora.PowerStandby, standbyCurrent*supplyVoltage)
 
 	if pkt.InvertPolar {
 		c.SetIQInversion(false)
@@ -1831,10 +2135,10 @@ func (c *Chip) Send(pkt *lora.TxPacket) (err error) {
 
 func (c *Chip) Write(payload []byte) error {
 	//c.setPacketType(PKT_TYPE_DATA | PKT_FLAG_DATA_DOWNLINK)
-	return c.sendPacketTimeout(payload, 10000)
+	return c.sendPacketTimeout(context.Background(), payload, 10000)
 }
 
-func (c *Chip) sendPacketTimeout(payload []byte, timeout uint16) (err error) {
+func (c *Chip) sendPacketTimeout(ctx context.Context, payload []byte, timeout uint16) (err error) {
 	err = c.setPacket(payload)
 	if err != nil {
 		return
@@ -1842,7 +2146,7 @@ func (c *Chip) sendPacketTimeout(payload []byte, timeout uint16) (err error) {
 	// if err = c.setIQInversion(false); err != nil {
 	// 	return
 	// }
-	err = c.sendWithTimeout(timeout)
+	err = c.sendWithTimeout(ctx, timeout)
 	// c.setIQInversion(true)
 	return
 }
@@ -1921,7 +2225,9 @@ func (c *Chip) SetIQInversion(invert bool) (err error) {
 	return
 }
 
-func (c *Chip) sendWithTimeout(wait uint16) (err error) {
+// sendWithTimeout sends the packet set by setPacket and waits until it has been sent, for at most
+// wait ms or until the deadline of ctx. If ctx is done first, the transmission is aborted.
+func (c *Chip) sendWithTimeout(ctx context.Context, wait uint16) (err error) {
 
 	c.Log(LogLevelDebug, "Starting 'sendWithTimeout'.")
 
@@ -1929,17 +2235,22 @@ func (c *Chip) sendWithTimeout(wait uint16) (err error) {
 
 	var startTime = time.Now()
 	var exitTime = startTime.Add(time.Millisecond * time.Duration(wait))
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(exitTime) {
+		exitTime = deadline
+	}
 
 	if c.mode == ModeLoRa { // LoRa mode
 		c.clearFlags() // Initializing flags
 
 		c.writeRegister(REG_OP_MODE, LORA_TX_MODE) // LORA mode - Tx
+		c.txStart = time.Now()
 
 		value, _ = c.readRegister(REG_IRQ_FLAGS)
 		// Wait until the packet is sent (TX Done flag) or the timeout expires
 		//while ((bitRead(value, 3) == 0) && (millis() - previous < wait))
-		for value&Bit3 == 0 && exitTime.After(time.Now()) {
-			delay(100)
+		// Polling every millisecond keeps the TX done time precise, see LastTx.
+		for value&Bit3 == 0 && exitTime.After(time.Now()) && ctx.Err() == nil {
+			delay(1)
 			value, _ = c.readRegister(REG_IRQ_FLAGS)
 			// Condition to avoid an overflow (DO NOT REMOVE)
 			//if( millis() < previous )
@@ -1949,11 +2260,12 @@ func (c *Chip) sendWithTimeout(wait uint16) (err error) {
 		}
 	} else { // FSK mode
 		c.writeRegister(REG_OP_MODE, FSK_TX_MODE) // FSK mode - Tx
+		c.txStart = time.Now()
 
 		value, _ = c.readRegister(REG_IRQ_FLAGS2)
 		// Wait until the packet is sent (Packet Sent flag) or the timeout expires
 		//while ((bitRead(value, 3) == 0) && (millis() - previous < wait))
-		for value&Bit3 == 0 && exitTime.After(time.Now()) {
+		for value&Bit3 == 0 && exitTime.After(time.Now()) && ctx.Err() == nil {
 			delay(100)
 			value, _ = c.readRegister(REG_IRQ_FLAGS2)
 			// Condition to avoid an overflow (DO NOT REMOVE)
@@ -1964,12 +2276,23 @@ func (c *Chip) sendWithTimeout(wait uint16) (err error) {
 		}
 	}
 
-	duration := time.Now().Sub(startTime)
+	c.txDone = time.Now()
+	duration := c.txDone.Sub(startTime)
 	c.Log(LogLevelNormal, "tx: %s", duration)
 
-	if value&Bit3 != 0 {
+	switch {
+	case value&Bit3 != 0:
 		c.Log(LogLevelVerbose, "Packet successfully sent. %s", duration)
-	} else {
+	case ctx.Err() != nil:
+		// back to standby, which ends the transmission
+		if c.mode == ModeLoRa {
+			c.writeRegister(REG_OP_MODE, LORA_STANDBY_MODE)
+		} else {
+			c.writeRegister(REG_OP_MODE, FSK_STANDBY_MODE)
+		}
+		c.Log(LogLevelError, "Transmission aborted: %v", ctx.Err())
+		err = ctx.Err()
+	default:
 		c.Log(LogLevelError, "Timeout has expired.")
 		err = ErrTimeout
 	}
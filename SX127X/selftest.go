@@ -0,0 +1,71 @@
+package SX127X
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+)
+
+// TestReset tells if the reset pin resets the chip. The chip is in LoRa mode after Discover,
+// and in FSK mode, the default, after a reset. The chip is set up again as by Reset.
+func (c *Chip) TestReset() error {
+	mode, err := c.readRegister(REG_OP_MODE)
+	if err != nil {
+		return err
+	}
+	if mode&LORA_SLEEP_MODE == 0 {
+		return errors.New("the chip is not in LoRa mode")
+	}
+	if err := c.pinRst.Out(gpio.Low); err != nil {
+		return err
+	}
+	delay(10)
+	if err := c.pinRst.Out(gpio.High); err != nil {
+		return err
+	}
+	delay(10)
+	mode, err = c.readRegister(REG_OP_MODE)
+	if err != nil {
+		return err
+	}
+	if mode&LORA_SLEEP_MODE != 0 {
+		return fmt.Errorf("the chip did not reset, check the wiring of %s", c.pinRst)
+	}
+	return c.Reset()
+}
+
+// TestDIO0 tells if the pin, wired to DIO0, rises when the packet has been sent.
+// The chip maps DIO0 to RX done otherwise, which the forwarder does not use.
+func (c *Chip) TestDIO0(pin string, pkt *lora.TxPacket) error {
+	p := gpioreg.ByName(pin)
+	if p == nil {
+		return fmt.Errorf("unknown pin %q", pin)
+	}
+	if err := p.In(gpio.PullDown, gpio.RisingEdge); err != nil {
+		return err
+	}
+	defer p.In(gpio.PullDown, gpio.NoEdge)
+
+	// DIO0 mapping 01 is TX done
+	if err := c.writeRegister(REG_DIO_MAPPING1, 0x40); err != nil {
+		return err
+	}
+	defer c.writeRegister(REG_DIO_MAPPING1, 0x00)
+
+	edge := make(chan bool, 1)
+	go func() {
+		edge <- p.WaitForEdge(5 * time.Second)
+	}()
+	if err := c.Send(context.Background(), pkt); err != nil {
+		return err
+	}
+	if !<-edge {
+		return fmt.Errorf("no interrupt on %s, check the wiring of DIO0", pin)
+	}
+	return nil
+}
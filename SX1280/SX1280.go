@@ -0,0 +1,597 @@
+// Package SX1280 drives the Semtech SX1280 LoRa transceiver of the 2.4 GHz band over SPI.
+// Unlike the SX127X, the chip is driven by commands, and it signals with its BUSY pin
+// when it is ready for the next one.
+package SX1280
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/conn/v3/physic"
+	"periph.io/x/conn/v3/spi"
+	"periph.io/x/conn/v3/spi/spireg"
+)
+
+const LogLevelNone = 0
+const LogLevelDebug = 5
+const LogLevelVerbose = 4
+const LogLevelNormal = 3
+const LogLevelWarning = 2
+const LogLevelError = 1
+
+var logLevel = []string{
+	"[     ] ",
+	"[ERR  ] ",
+	"[WARN ] ",
+	"[     ] ",
+	"[VERBO] ",
+	"[DEBUG] ",
+}
+
+var LogLevel = LogLevelNone
+var Logger *log.Logger = log.New(os.Stdout, "[LORA ] ", 0)
+
+// busyTimeout is how long the chip may be busy with a command.
+const busyTimeout = 100 * time.Millisecond
+
+// Typical currents of the SX1280 at 3.3 V with the LDO in mA, from its datasheet,
+// which the power consumption is estimated with, see lora.PowerManager.
+const (
+	supplyVoltage  = 3.3
+	sleepCurrent   = 0.0012
+	standbyCurrent = 0.7
+	rxCurrent      = 6.2
+)
+
+// txCurrent returns the typical current when sending with the power in dBm.
+func txCurrent(dbm uint8) float64 {
+	if dbm >= 10 {
+		return 24
+	}
+	return 14
+}
+
+type Chip struct {
+	dev     spi.Conn
+	pinRst  gpio.PinIO
+	pinBusy gpio.PinIO
+
+	LogLevel int
+	Logger   *log.Logger
+
+	syncWord byte
+	rxCfg    *lora.Config   // config of the last Receive call
+	freq     lora.Frequency // programmed frequency, without the frequency correction
+	sf       lora.SpreadingFactor
+	bw       lora.Bandwidth
+	cr       lora.Coderate
+	sleeping bool      // put to sleep by SetPowerMode, until the next Receive or Send
+	txStart  time.Time // when the last transmission was started
+	txDone   time.Time // when the TX done flag of the last transmission was seen
+	meter    *lora.PowerMeter
+}
+
+var (
+	_ lora.Radio        = (*Chip)(nil)
+	_ lora.RSSIReader   = (*Chip)(nil)
+	_ lora.PowerManager = (*Chip)(nil)
+)
+
+func New(dev spi.Conn, pinRst, pinBusy gpio.PinIO) *Chip {
+	return &Chip{
+		dev:      dev,
+		pinRst:   pinRst,
+		pinBusy:  pinBusy,
+		syncWord: PublicSyncWord,
+		LogLevel: LogLevel,
+		Logger:   Logger,
+		meter:    lora.NewPowerMeter(lora.PowerStandby, standbyCurrent*supplyVoltage),
+	}
+}
+
+// Discover opens the chip on the SPI device of the config, with its reset and BUSY pins, and resets it.
+func Discover(cfg *lora.Config) (*Chip, error) {
+	if cfg.PinBusy == "" {
+		return nil, errors.New("no pinBusy, the SX1280 needs its BUSY pin")
+	}
+	p, err := spireg.Open(cfg.SpiDevice)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := p.Connect(physic.MegaHertz, spi.Mode0, 8)
+	if err != nil {
+		return nil, err
+	}
+	pinBusy := gpioreg.ByName(cfg.PinBusy)
+	if pinBusy == nil {
+		return nil, fmt.Errorf("unknown pin %q", cfg.PinBusy)
+	}
+	if err := pinBusy.In(gpio.Float, gpio.NoEdge); err != nil {
+		return nil, err
+	}
+	c := New(conn, gpioreg.ByName(cfg.PinRst), pinBusy)
+	if !cfg.Lorawan_public {
+		c.syncWord = PrivateSyncWord
+	}
+	if err := c.Reset(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Chip) Name() string {
+	return "SX1280"
+}
+
+func (c *Chip) Log(level int, format string, v ...interface{}) {
+	if level <= c.LogLevel && level >= 0 && level < 6 {
+		c.Logger.Printf(logLevel[level]+format, v...)
+	}
+}
+
+// Reset resets the chip with its reset pin and sets it up for LoRa.
+func (c *Chip) Reset() error {
+	if c.pinRst != nil {
+		if err := c.pinRst.Out(gpio.Low); err != nil {
+			return err
+		}
+		time.Sleep(time.Millisecond)
+		if err := c.pinRst.Out(gpio.High); err != nil {
+			return err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.sleeping = false
+	c.sf, c.bw, c.cr, c.freq = 0, 0, 0, 0
+	if err := c.Check(); err != nil {
+		return err
+	}
+	if err := c.command(CMD_SET_STANDBY, STDBY_RC); err != nil {
+		return err
+	}
+	c.meter.Set(lora.PowerStandby, standbyCurrent*supplyVoltage)
+	if err := c.command(CMD_SET_PACKET_TYPE, PACKET_TYPE_LORA); err != nil {
+		return err
+	}
+	if err := c.command(CMD_SET_BUFFER_BASE_ADDR, 0x00, 0x00); err != nil {
+		return err
+	}
+	if err := c.setSyncWord(c.syncWord); err != nil {
+		return err
+	}
+	// the interrupts are polled, so none is routed to the DIO pins
+	return c.command(CMD_SET_DIO_IRQ_PARAMS, IRQ_ALL>>8, IRQ_ALL&0xFF, 0, 0, 0, 0, 0, 0)
+}
+
+// Check reads the status of the chip to tell if it still answers on the SPI bus.
+func (c *Chip) Check() error {
+	if err := c.waitBusy(); err != nil {
+		return err
+	}
+	out := make([]byte, 1)
+	if err := c.dev.Tx([]byte{CMD_GET_STATUS}, out); err != nil {
+		return err
+	}
+	switch out[0] {
+	case 0x00, 0xFF:
+		return fmt.Errorf("spi reads 0x%02x, the chip does not answer", out[0])
+	}
+	return nil
+}
+
+func (c *Chip) Close() error {
+	return nil
+}
+
+// waitBusy waits until the chip is ready for a command.
+func (c *Chip) waitBusy() error {
+	deadline := time.Now().Add(busyTimeout)
+	for c.pinBusy.Read() == gpio.High {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: the chip is busy, check the BUSY pin", lora.ErrRadioTimeout)
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+	return nil
+}
+
+// command sends a command with its parameters.
+func (c *Chip) command(op byte, params ...byte) error {
+	if err := c.waitBusy(); err != nil {
+		return err
+	}
+	in := append([]byte{op}, params...)
+	c.Log(LogLevelDebug, "Command %02X: % X", op, params)
+	return c.dev.Tx(in, make([]byte, len(in)))
+}
+
+// read sends a command with its parameters and returns the n bytes it answers
+// after the status byte.
+func (c *Chip) read(op byte, params []byte, n int) ([]byte, error) {
+	if err := c.waitBusy(); err != nil {
+		return nil, err
+	}
+	in := make([]byte, 1+len(params)+1+n)
+	in[0] = op
+	copy(in[1:], params)
+	out := make([]byte, len(in))
+	if err := c.dev.Tx(in, out); err != nil {
+		return nil, err
+	}
+	return out[len(params)+2:], nil
+}
+
+func (c *Chip) writeRegister(addr uint16, data ...byte) error {
+	return c.command(CMD_WRITE_REGISTER, append([]byte{byte(addr >> 8), byte(addr)}, data...)...)
+}
+
+func (c *Chip) readRegister(addr uint16) (byte, error) {
+	out, err := c.read(CMD_READ_REGISTER, []byte{byte(addr >> 8), byte(addr)}, 1)
+	if err != nil {
+		return 0, err
+	}
+	return out[0], nil
+}
+
+func (c *Chip) setSyncWord(sw byte) error {
+	msb, err := c.readRegister(REG_LORA_SYNC_WORD_MSB)
+	if err != nil {
+		return err
+	}
+	lsb, err := c.readRegister(REG_LORA_SYNC_WORD_LSB)
+	if err != nil {
+		return err
+	}
+	return c.writeRegister(REG_LORA_SYNC_WORD_MSB, msb&0x0F|sw&0xF0, lsb&0x0F|sw<<4)
+}
+
+func (c *Chip) irqStatus() (uint16, error) {
+	out, err := c.read(CMD_GET_IRQ_STATUS, nil, 2)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(out[0])<<8 | uint16(out[1]), nil
+}
+
+func (c *Chip) clearIrq() error {
+	return c.command(CMD_CLR_IRQ_STATUS, IRQ_ALL>>8, IRQ_ALL&0xFF)
+}
+
+// setFreq programs the frequency in steps of 52 MHz / 2^18, shifted by ppm.
+func (c *Chip) setFreq(freq lora.Frequency, ppm float64) error {
+	hz := float64(freq) * (1 + ppm/1e6)
+	steps := uint32(hz * (1 << 18) / 52e6)
+	if err := c.command(CMD_SET_RF_FREQUENCY, byte(steps>>16), byte(steps>>8), byte(steps)); err != nil {
+		return err
+	}
+	c.freq = freq
+	return nil
+}
+
+func bandwidthCode(bw lora.Bandwidth) (byte, error) {
+	switch bw {
+	case lora.BW203K:
+		return BW_203, nil
+	case lora.BW406K:
+		return BW_406, nil
+	case lora.BW812K:
+		return BW_812, nil
+	case lora.BW1625K:
+		return BW_1625, nil
+	}
+	return 0, fmt.Errorf("%w: bandwidth %s not supported by the SX1280", lora.ErrFrequency, bw)
+}
+
+// setModulation sets the spreading factor, bandwidth and coding rate.
+func (c *Chip) setModulation(sf lora.SpreadingFactor, bw lora.Bandwidth, cr lora.Coderate) error {
+	if sf == c.sf && bw == c.bw && cr == c.cr {
+		return nil
+	}
+	code, err := bandwidthCode(bw)
+	if err != nil {
+		return err
+	}
+	if err := c.command(CMD_SET_MODULATION_PARAMS, byte(sf)<<4, code, byte(cr)-4); err != nil {
+		return err
+	}
+	// as required by the datasheet, section 14.4.1
+	sfConfig := byte(0x32)
+	switch {
+	case sf <= lora.SF6:
+		sfConfig = 0x1E
+	case sf <= lora.SF8:
+		sfConfig = 0x37
+	}
+	if err := c.writeRegister(REG_LORA_SF_CONFIG, sfConfig); err != nil {
+		return err
+	}
+	if err := c.writeRegister(REG_LORA_FREQ_COMP, 0x01); err != nil {
+		return err
+	}
+	c.sf, c.bw, c.cr = sf, bw, cr
+	return nil
+}
+
+// setPacket sets the preamble in symbols, 8 if 0, the payload length, the CRC and the IQ inversion.
+func (c *Chip) setPacket(preamble uint16, length byte, crc, invertIQ bool) error {
+	if preamble == 0 {
+		preamble = 8
+	}
+	// the preamble is mantissa * 2^exponent
+	var exp byte
+	for preamble > 15 {
+		preamble = (preamble + 1) / 2
+		exp++
+	}
+	crcOn := byte(CRC_OFF)
+	if crc {
+		crcOn = CRC_ON
+	}
+	iq := byte(IQ_STANDARD)
+	if invertIQ {
+		iq = IQ_INVERTED
+	}
+	return c.command(CMD_SET_PACKET_PARAMS, exp<<4|byte(preamble), HEADER_EXPLICIT, length, crcOn, iq, 0, 0)
+}
+
+// wake wakes the chip from sleep by selecting it, and waits until it is in standby.
+func (c *Chip) wake() error {
+	if !c.sleeping {
+		return nil
+	}
+	if err := c.dev.Tx([]byte{CMD_GET_STATUS}, make([]byte, 1)); err != nil {
+		return err
+	}
+	c.sleeping = false
+	c.meter.Set(lora.PowerStandby, standbyCurrent*supplyVoltage)
+	return c.waitBusy()
+}
+
+var errNoSubGHz = fmt.Errorf("%w: the SX1280 only supports the 2.4 GHz band", lora.ErrFrequency)
+
+// Receive configures the chip and puts it in continuous receive mode.
+func (c *Chip) Receive(ctx context.Context, cfg *lora.Config) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if !cfg.LoRaBW.Band2G4() {
+		return errNoSubGHz
+	}
+	if err := c.wake(); err != nil {
+		return err
+	}
+	c.rxCfg = cfg
+	if err := c.command(CMD_SET_STANDBY, STDBY_RC); err != nil {
+		return err
+	}
+	if err := c.setFreq(cfg.Freq, cfg.FreqCorrection); err != nil {
+		return err
+	}
+	if err := c.setModulation(cfg.Datarate, cfg.LoRaBW, cfg.LoRaCR); err != nil {
+		return err
+	}
+	if err := c.setPacket(cfg.PreambleLength, lora.MaxPayloadLength, true, false); err != nil {
+		return err
+	}
+	if err := c.clearIrq(); err != nil {
+		return err
+	}
+	if err := c.command(CMD_SET_RX, PERIOD_BASE_1MS, RX_CONTINUOUS>>8, RX_CONTINUOUS&0xFF); err != nil {
+		return err
+	}
+	c.meter.Set(lora.PowerRx, rxCurrent*supplyVoltage)
+	c.Log(LogLevelDebug, "Receiving on %s, %s%s.", cfg.Freq, cfg.Datarate, cfg.LoRaBW)
+	return nil
+}
+
+// GetPacket returns the packet received since the last call, or nil.
+// The packet must be released by the caller, see lora.Radio.
+func (c *Chip) GetPacket(ctx context.Context) ([]*lora.RxPacket, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	irq, err := c.irqStatus()
+	if err != nil {
+		return nil, err
+	}
+	if irq&IRQ_HEADER_ERROR != 0 {
+		c.Log(LogLevelWarning, "Header error.")
+		return nil, c.clearIrq()
+	}
+	if irq&IRQ_RX_DONE == 0 {
+		return nil, nil
+	}
+	status, err := c.read(CMD_GET_RX_BUFFER_STATUS, nil, 2)
+	if err != nil {
+		return nil, err
+	}
+	length, offset := status[0], status[1]
+	data, err := c.read(CMD_READ_BUFFER, []byte{offset}, int(length))
+	if err != nil {
+		return nil, err
+	}
+	pktStatus, err := c.read(CMD_GET_PACKET_STATUS, nil, 5)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.clearIrq(); err != nil {
+		return nil, err
+	}
+
+	pkt := lora.NewRxPacket(len(data))
+	copy(pkt.Data, data)
+	pkt.StatCRC = 1
+	if irq&IRQ_CRC_ERROR != 0 {
+		pkt.StatCRC = -1
+	}
+	pkt.RSSI = -float32(pktStatus[0]) / 2
+	pkt.LoRaSNR = float32(int8(pktStatus[1])) / 4
+	pkt.Freq = c.freq
+	pkt.Modulation = lora.ModulationLoRa
+	pkt.Datarate = c.sf
+	pkt.LoRaBW = c.bw
+	pkt.LoRaCR = c.cr
+	return []*lora.RxPacket{pkt}, nil
+}
+
+// Receiving tells if the modem is receiving a LoRa frame, from the preamble on until RX done.
+func (c *Chip) Receiving() (bool, error) {
+	irq, err := c.irqStatus()
+	if err != nil {
+		return false, err
+	}
+	return irq&(IRQ_PREAMBLE_DETECTED|IRQ_HEADER_VALID) != 0 && irq&IRQ_RX_DONE == 0, nil
+}
+
+// CurrentRSSI returns the current RSSI of the channel in dBm.
+func (c *Chip) CurrentRSSI() (float32, error) {
+	out, err := c.read(CMD_GET_RSSI_INST, nil, 1)
+	if err != nil {
+		return 0, err
+	}
+	return -float32(out[0]) / 2, nil
+}
+
+// Send transmits the packet and waits until it has been sent. The power is limited to MaxPower.
+func (c *Chip) Send(ctx context.Context, pkt *lora.TxPacket) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := pkt.Validate(nil); err != nil {
+		return err
+	}
+	if pkt.Modulation != lora.ModulationLoRa {
+		return errors.New("modulation must be \"LORA\"")
+	}
+	if !pkt.LoRaBW.Band2G4() {
+		return errNoSubGHz
+	}
+	if err := c.wake(); err != nil {
+		return err
+	}
+	if err := c.command(CMD_SET_STANDBY, STDBY_RC); err != nil {
+		return err
+	}
+	ppm := 0.0
+	if c.rxCfg != nil {
+		ppm = c.rxCfg.FreqCorrection
+	}
+	if err := c.setFreq(pkt.Freq, ppm); err != nil {
+		return err
+	}
+	if err := c.setModulation(pkt.Datarate, pkt.LoRaBW, pkt.LoRaCR); err != nil {
+		return err
+	}
+	if err := c.setPacket(pkt.PreambleLength, byte(len(pkt.Data)), !pkt.NoCRC, pkt.InvertPolar); err != nil {
+		return err
+	}
+	power := pkt.Power
+	if power > MaxPower {
+		power = MaxPower
+	}
+	// the power is coded from -18 dBm on
+	if err := c.command(CMD_SET_TX_PARAMS, power+18, RAMP_20_US); err != nil {
+		return err
+	}
+	if err := c.command(CMD_WRITE_BUFFER, append([]byte{0x00}, pkt.Data...)...); err != nil {
+		return err
+	}
+	if err := c.clearIrq(); err != nil {
+		return err
+	}
+	// no timeout, the TX done flag is polled until the packet is sent
+	if err := c.command(CMD_SET_TX, PERIOD_BASE_1MS, 0, 0); err != nil {
+		return err
+	}
+	c.txStart = time.Now()
+	c.meter.Set(lora.PowerTx, txCurrent(power)*supplyVoltage)
+	// the chip goes to standby once the packet is sent
+	defer c.meter.Set(lora.PowerStandby, standbyCurrent*supplyVoltage)
+
+	exit := c.txStart.Add(pkt.Airtime() + time.Second)
+	for {
+		irq, err := c.irqStatus()
+		if err != nil {
+			return err
+		}
+		if irq&IRQ_TX_DONE != 0 {
+			c.txDone = time.Now()
+			return c.clearIrq()
+		}
+		if err := ctx.Err(); err != nil {
+			c.command(CMD_SET_STANDBY, STDBY_RC)
+			return err
+		}
+		if time.Now().After(exit) {
+			c.command(CMD_SET_STANDBY, STDBY_RC)
+			return fmt.Errorf("tx: %w", lora.ErrRadioTimeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// LastTx returns when the last transmission was started and when its TX done flag was seen.
+// The TX done flag is polled every millisecond.
+func (c *Chip) LastTx() (start, done time.Time) {
+	return c.txStart, c.txDone
+}
+
+// SetPowerMode puts the chip to sleep, in standby or back to receive, see lora.PowerManager.
+// Asleep, the chip keeps its configuration.
+func (c *Chip) SetPowerMode(ctx context.Context, mode lora.PowerMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	switch mode {
+	case lora.PowerSleep:
+		if c.sleeping {
+			return nil
+		}
+		// the chip only goes to sleep from standby
+		if err := c.command(CMD_SET_STANDBY, STDBY_RC); err != nil {
+			return err
+		}
+		if err := c.command(CMD_SET_SLEEP, SLEEP_RETAIN_RAM); err != nil {
+			return err
+		}
+		c.sleeping = true
+		c.meter.Set(lora.PowerSleep, sleepCurrent*supplyVoltage)
+		return nil
+	case lora.PowerStandby:
+		if err := c.wake(); err != nil {
+			return err
+		}
+		if err := c.command(CMD_SET_STANDBY, STDBY_RC); err != nil {
+			return err
+		}
+		c.meter.Set(lora.PowerStandby, standbyCurrent*supplyVoltage)
+		return nil
+	case lora.PowerRx:
+		if c.rxCfg == nil {
+			return errors.New("can not receive before Receive is called")
+		}
+		return c.Receive(ctx, c.rxCfg)
+	}
+	return fmt.Errorf("can not set power mode %s", mode)
+}
+
+// PowerMode returns the current power mode of the chip.
+func (c *Chip) PowerMode() lora.PowerMode {
+	return c.meter.Mode()
+}
+
+// PowerUsage returns the time in each power mode and the estimated energy consumption.
+func (c *Chip) PowerUsage() lora.PowerUsage {
+	return c.meter.Usage()
+}
@@ -0,0 +1,83 @@
+package SX1280
+
+// Commands, see the SX1280 datasheet, section 11.
+const (
+	CMD_GET_STATUS            = 0xC0
+	CMD_WRITE_REGISTER        = 0x18
+	CMD_READ_REGISTER         = 0x19
+	CMD_WRITE_BUFFER          = 0x1A
+	CMD_READ_BUFFER           = 0x1B
+	CMD_SET_SLEEP             = 0x84
+	CMD_SET_STANDBY           = 0x80
+	CMD_SET_TX                = 0x83
+	CMD_SET_RX                = 0x82
+	CMD_SET_PACKET_TYPE       = 0x8A
+	CMD_SET_RF_FREQUENCY      = 0x86
+	CMD_SET_TX_PARAMS         = 0x8E
+	CMD_SET_BUFFER_BASE_ADDR  = 0x8F
+	CMD_SET_MODULATION_PARAMS = 0x8B
+	CMD_SET_PACKET_PARAMS     = 0x8C
+	CMD_GET_RX_BUFFER_STATUS  = 0x17
+	CMD_GET_PACKET_STATUS     = 0x1D
+	CMD_GET_RSSI_INST         = 0x1F
+	CMD_SET_DIO_IRQ_PARAMS    = 0x8D
+	CMD_GET_IRQ_STATUS        = 0x15
+	CMD_CLR_IRQ_STATUS        = 0x97
+	CMD_NOP                   = 0x00
+)
+
+// Registers.
+const (
+	REG_LORA_SYNC_WORD_MSB = 0x944
+	REG_LORA_SYNC_WORD_LSB = 0x945
+	REG_LORA_SF_CONFIG     = 0x925 // must be set for the spreading factor, see setModulation
+	REG_LORA_FREQ_COMP     = 0x93C
+)
+
+const (
+	PACKET_TYPE_LORA = 0x01
+
+	STDBY_RC   = 0x00
+	STDBY_XOSC = 0x01
+
+	SLEEP_RETAIN_RAM = 0x01 // keeps the configuration while asleep
+
+	PERIOD_BASE_1MS = 0x02
+	RX_CONTINUOUS   = 0xFFFF
+
+	HEADER_EXPLICIT = 0x00
+	CRC_ON          = 0x20
+	CRC_OFF         = 0x00
+	IQ_STANDARD     = 0x40
+	IQ_INVERTED     = 0x00
+
+	RAMP_20_US = 0xE0
+)
+
+// LoRa bandwidths.
+const (
+	BW_1625 = 0x0A
+	BW_812  = 0x18
+	BW_406  = 0x26
+	BW_203  = 0x34
+)
+
+// Interrupts.
+const (
+	IRQ_TX_DONE           = 0x0001
+	IRQ_RX_DONE           = 0x0002
+	IRQ_HEADER_VALID      = 0x0010
+	IRQ_HEADER_ERROR      = 0x0020
+	IRQ_CRC_ERROR         = 0x0040
+	IRQ_RX_TX_TIMEOUT     = 0x4000
+	IRQ_PREAMBLE_DETECTED = 0x8000
+	IRQ_ALL               = 0xFFFF
+)
+
+const (
+	PrivateSyncWord = 0x12
+	PublicSyncWord  = 0x34
+)
+
+// MaxPower is the highest TX output power in dBm.
+const MaxPower = 13
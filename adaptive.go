@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// The RSSI of each candidate is averaged over scanSamples samples, scanGap apart,
+// after scanSettle for the receiver to settle on the frequency.
+const (
+	scanSamples = 10
+	scanGap     = 10 * time.Millisecond
+	scanSettle  = 5 * time.Millisecond
+)
+
+// channelSelector moves a radio to the quietest of its candidate frequencies,
+// once in each period of quiet hours, see lora.AdaptiveChannel.
+type channelSelector struct {
+	candidates []lora.Frequency
+	start, end time.Duration // the quiet hours, as times of day
+	margin     float32
+	scanned    time.Time // start of the last quiet period the radio was scanned in
+	status     *channelStatus
+}
+
+// channelStatus is an item of the "channels" section of the API.
+type channelStatus struct {
+	Radio   int            `json:"radio"`
+	Freq    lora.Frequency `json:"freq"`
+	Scanned time.Time      `json:"scanned"`
+	Noise   []channelNoise `json:"noise"`
+}
+
+type channelNoise struct {
+	Freq lora.Frequency `json:"freq"`
+	RSSI float32        `json:"rssi"`
+}
+
+func newChannelSelector(cfg *lora.Config) *channelSelector {
+	start, end, _ := cfg.Adaptive.QuietHours() // checked by Validate
+	s := &channelSelector{
+		candidates: append([]lora.Frequency{cfg.Freq}, cfg.Adaptive.Candidates...),
+		start:      start,
+		end:        end,
+		margin:     3,
+	}
+	if cfg.Adaptive.Margin > 0 {
+		s.margin = cfg.Adaptive.Margin
+	}
+	return s
+}
+
+// quietPeriod returns the start of the quiet period now is in, or false if it is in none.
+func (s *channelSelector) quietPeriod(now time.Time) (time.Time, bool) {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	tod := now.Sub(midnight)
+	switch {
+	case s.start < s.end && tod >= s.start && tod < s.end:
+		return midnight.Add(s.start), true
+	case s.start > s.end && tod >= s.start:
+		return midnight.Add(s.start), true
+	case s.start > s.end && tod < s.end:
+		return midnight.AddDate(0, 0, -1).Add(s.start), true
+	}
+	return time.Time{}, false
+}
+
+// due tells if the radio is to be scanned: in quiet hours it was not scanned in yet,
+// with no downlink queued.
+func (s *channelSelector) due(now time.Time, queued int) bool {
+	period, ok := s.quietPeriod(now)
+	return ok && period.After(s.scanned) && queued == 0
+}
+
+// selectChannel scans the candidates of the radio and moves it to the quietest,
+// if it is quieter than the current frequency by the margin. The radio does not
+// receive while it scans, for about a tenth of a second per candidate. A radio that is
+// receiving a frame is scanned later.
+func selectChannel(ctx context.Context, radio *gatewayRadio, now time.Time) {
+	if rx, ok := radio.Radio.(interface{ Receiving() (bool, error) }); ok && radio.receiving {
+		if busy, err := rx.Receiving(); err != nil || busy {
+			return
+		}
+	}
+	s := radio.adaptive
+	s.scanned, _ = s.quietPeriod(now)
+	r, ok := radio.Radio.(lora.RSSIReader)
+	if !ok {
+		log(LogLevelWarning, "radio %d: adaptive: the radio can not read the RSSI", radio.index)
+		return
+	}
+
+	current := radio.cfg.Freq
+	radio.receiving = false
+	noise := make([]channelNoise, 0, len(s.candidates))
+	for _, freq := range s.candidates {
+		cfg := *radio.cfg
+		cfg.Freq = freq
+		rssi, err := scanChannel(ctx, radio, r, &cfg)
+		if err != nil {
+			log(LogLevelError, "radio %d: adaptive: can not scan %s: %v", radio.index, freq, err)
+			return
+		}
+		noise = append(noise, channelNoise{Freq: freq, RSSI: rssi})
+	}
+	sort.Slice(noise, func(i, j int) bool { return noise[i].RSSI < noise[j].RSSI })
+
+	var currentRSSI float32
+	for _, n := range noise {
+		if n.Freq == current {
+			currentRSSI = n.RSSI
+		}
+	}
+	best := noise[0]
+	if best.Freq != current && best.RSSI+s.margin <= currentRSSI {
+		log(LogLevelWarning, "radio %d: adaptive: moving from %s (%.1f dBm) to %s (%.1f dBm)", radio.index, current, currentRSSI, best.Freq, best.RSSI)
+		cfg := *radio.cfg
+		cfg.Freq = best.Freq
+		radio.cfg = &cfg
+	} else {
+		log(LogLevelNormal, "radio %d: adaptive: staying on %s (%.1f dBm), quietest %s (%.1f dBm)", radio.index, current, currentRSSI, best.Freq, best.RSSI)
+	}
+	s.status = &channelStatus{Radio: radio.index, Freq: radio.cfg.Freq, Scanned: now.UTC(), Noise: noise}
+}
+
+// scanChannel returns the average RSSI of the channel of cfg, with the RSSI offset of the board.
+func scanChannel(ctx context.Context, radio *gatewayRadio, r lora.RSSIReader, cfg *lora.Config) (float32, error) {
+	if err := radio.Receive(ctx, cfg); err != nil {
+		return 0, err
+	}
+	time.Sleep(scanSettle)
+	var sum float32
+	for i := 0; i < scanSamples; i++ {
+		rssi, err := r.CurrentRSSI()
+		if err != nil {
+			return 0, err
+		}
+		sum += rssi
+		time.Sleep(scanGap)
+	}
+	return sum/scanSamples + cfg.RSSIOffset, nil
+}
+
+// publishChannels publishes the last scans of the adaptive radios to the API.
+func (gw *Gateway) publishChannels(radios []*gatewayRadio) {
+	var status []*channelStatus
+	for _, radio := range radios {
+		if radio.adaptive != nil && radio.adaptive.status != nil {
+			status = append(status, radio.adaptive.status)
+		}
+	}
+	gw.apiServer.Publish("channels", status)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/api"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/store"
+)
+
+// recentPacketsMax is the number of last uplinks kept for the "packets" admin action.
+const recentPacketsMax = 100
+
+// adminTimeout is how long an admin action waits for the main loop, which may be busy sending.
+const adminTimeout = 10 * time.Second
+
+// adminRequest is an admin action for the main loop, which owns the radios.
+type adminRequest struct {
+	run    func(radios []*gatewayRadio) (interface{}, error)
+	result interface{}
+	err    error
+	done   chan struct{}
+}
+
+var errMainLoopBusy = fmt.Errorf("%w: the main loop is busy", api.ErrBusy)
+
+// startAdmin serves the admin actions of the API.
+func (gw *Gateway) startAdmin(cfg *api.AdminConfig) error {
+	admin, err := api.NewAdmin(cfg)
+	if err != nil {
+		return err
+	}
+	admin.Register("restart_radio", gw.adminRestartRadio)
+	admin.Register("log_level", gw.adminLogLevel)
+	admin.Register("selftest", gw.adminSelfTest)
+	admin.Register("packets", gw.adminPackets)
+	admin.Register("inject", gw.adminInject)
+	gw.adminRequests = make(chan *adminRequest)
+	gw.apiServer.Handle("/api/admin/", admin)
+	return nil
+}
+
+// inMainLoop runs an admin action in the main loop.
+func (gw *Gateway) inMainLoop(run func(radios []*gatewayRadio) (interface{}, error)) (interface{}, error) {
+	req := &adminRequest{run: run, done: make(chan struct{})}
+	select {
+	case gw.adminRequests <- req:
+	case <-time.After(adminTimeout):
+		return nil, errMainLoopBusy
+	}
+	<-req.done
+	return req.result, req.err
+}
+
+// runAdmin runs an admin action for inMainLoop.
+func runAdmin(req *adminRequest, radios []*gatewayRadio) {
+	req.result, req.err = req.run(radios)
+	close(req.done)
+}
+
+// adminRestartRadio resets the radio of the "radio" index, or all radios without.
+func (gw *Gateway) adminRestartRadio(params url.Values) (interface{}, error) {
+	index := -1
+	if s := params.Get("radio"); s != "" {
+		var err error
+		if index, err = strconv.Atoi(s); err != nil || index < 0 {
+			return nil, fmt.Errorf("%w: radio %q", api.ErrInvalidParam, s)
+		}
+	}
+	return gw.inMainLoop(func(radios []*gatewayRadio) (interface{}, error) {
+		if index >= len(radios) {
+			return nil, fmt.Errorf("%w: no radio %d", api.ErrInvalidParam, index)
+		}
+		reset := make(map[int]bool)
+		for _, radio := range radios {
+			if index == -1 || radio.index == index {
+				reset[radio.index] = resetRadio(radio)
+			}
+		}
+		return reset, nil
+	})
+}
+
+// adminLogLevel sets the log level to the "level", as for the -l flag, for all the gateways of
+// the process, see logLevel. The radio backends keep the log level they were opened with.
+func (gw *Gateway) adminLogLevel(params url.Values) (interface{}, error) {
+	level, err := parseLogLevel(params.Get("level"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", api.ErrInvalidParam, err)
+	}
+	return gw.inMainLoop(func(radios []*gatewayRadio) (interface{}, error) {
+		prev := int(atomic.SwapInt32(&logLevel, int32(level)))
+		log(LogLevelNormal, "admin: log level %d, was %d", level, prev)
+		return map[string]int{"log_level": level, "previous": prev}, nil
+	})
+}
+
+// adminSelfTestResult is a check of the "selftest" admin action.
+type adminSelfTestResult struct {
+	Radio  int    `json:"radio"`
+	Check  string `json:"check"`
+	Result string `json:"result"` // "ok", "FAIL" or "skip"
+	Error  string `json:"error,omitempty"`
+}
+
+// adminSelfTest runs the checks of the -selftest flag that leave the radios running: whether
+// the radios answer on their bus.
+func (gw *Gateway) adminSelfTest(params url.Values) (interface{}, error) {
+	return gw.inMainLoop(func(radios []*gatewayRadio) (interface{}, error) {
+		results := make([]adminSelfTestResult, 0, len(radios))
+		for _, radio := range radios {
+			r := adminSelfTestResult{Radio: radio.index, Check: "spi", Result: "ok"}
+			if c, ok := radio.Radio.(interface{ Check() error }); !ok {
+				r.Result, r.Error = "skip", "not supported by the backend"
+			} else if err := c.Check(); err != nil {
+				r.Result, r.Error = "FAIL", err.Error()
+			}
+			results = append(results, r)
+		}
+		return results, nil
+	})
+}
+
+// adminPackets returns the metadata of the last "n" uplinks, 100 at most and if not set.
+func (gw *Gateway) adminPackets(params url.Values) (interface{}, error) {
+	n := recentPacketsMax
+	if s := params.Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 0 {
+			return nil, fmt.Errorf("%w: n %q", api.ErrInvalidParam, s)
+		}
+	}
+	return gw.inMainLoop(func(radios []*gatewayRadio) (interface{}, error) {
+		if n > len(gw.recentPackets) {
+			n = len(gw.recentPackets)
+		}
+		records := make([]store.Record, n)
+		for i, r := range gw.recentPackets[len(gw.recentPackets)-n:] {
+			records[i] = *r
+		}
+		return records, nil
+	})
+}
+
+// recordRecent keeps the metadata of an uplink for the "packets" admin action.
+func (gw *Gateway) recordRecent(pkt *lora.RxPacket, rxTime time.Time) {
+	if gw.adminRequests == nil {
+		return
+	}
+	r := store.NewRecord(pkt, rxTime)
+	gw.privacy.record(r)
+	if len(gw.recentPackets) == recentPacketsMax {
+		gw.recentPackets = append(gw.recentPackets[:0], gw.recentPackets[1:]...)
+	}
+	gw.recentPackets = append(gw.recentPackets, r)
+}
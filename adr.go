@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+)
+
+// ADRAdviceConfig is the "adr_advice_conf" section of the gateway config.
+// It reports the devices that could use a faster datarate, from the SNR of their uplinks,
+// as the ADR of a network server would. It is informational only: nothing is sent to the devices.
+type ADRAdviceConfig struct {
+	// Uplinks is the number of last uplinks of a device that its best SNR is taken from, 20 if not set.
+	Uplinks int `json:"uplinks"`
+	// Margin is the installation margin kept above the SNR the datarate needs in dB, 10 if not set.
+	Margin float32 `json:"margin"`
+}
+
+// requiredSNR is the SNR that LoRa needs to demodulate each spreading factor, in dB.
+var requiredSNR = map[lora.SpreadingFactor]float32{
+	7:  -7.5,
+	8:  -10,
+	9:  -12.5,
+	10: -15,
+	11: -17.5,
+	12: -20,
+}
+
+type adrAdvice struct {
+	uplinks int
+	margin  float32
+	privacy *privacyFilter
+	devices map[lorawan.DevAddr]*adrDevice
+}
+
+// adrDevice holds the SNR of the last uplinks of a device.
+type adrDevice struct {
+	snr  []float32
+	next int
+	n    int
+	datr lora.Datarate // of the last uplink
+	best lora.Datarate // last advice, to log changes only
+}
+
+// adrAdviceStatus is an item of the "adr" section of the API.
+type adrAdviceStatus struct {
+	DevAddr lorawan.DevAddr `json:"dev_addr"`
+	Datr    lora.Datarate   `json:"datr"`
+	// MaxSNR is the best SNR of the last uplinks in dB.
+	MaxSNR float32 `json:"max_snr"`
+	// Margin is the SNR above what Datr needs, less the installation margin, in dB.
+	Margin float32 `json:"margin"`
+	// Advice is the fastest datarate that the margin allows.
+	Advice  lora.Datarate `json:"advice"`
+	Uplinks int           `json:"uplinks"`
+}
+
+func newADRAdvice(cfg *ADRAdviceConfig, privacy *privacyFilter) *adrAdvice {
+	a := &adrAdvice{
+		uplinks: 20,
+		margin:  10,
+		privacy: privacy,
+		devices: make(map[lorawan.DevAddr]*adrDevice),
+	}
+	if cfg.Uplinks > 0 {
+		a.uplinks = cfg.Uplinks
+	}
+	if cfg.Margin > 0 {
+		a.margin = cfg.Margin
+	}
+	return a
+}
+
+// add records the SNR of a LoRa data uplink with a valid CRC, and logs when the advice for its
+// device changes.
+func (a *adrAdvice) add(pkt *lora.RxPacket) {
+	if pkt.Modulation != lora.ModulationLoRa || pkt.StatCRC != 1 {
+		return
+	}
+	f, err := lorawan.Decode(pkt.Data)
+	if err != nil || !f.IsData() || !f.IsUplink() {
+		return
+	}
+	d := a.devices[f.DevAddr]
+	if d == nil {
+		if len(a.devices) >= maxAirtimeDevices {
+			return
+		}
+		d = &adrDevice{snr: make([]float32, a.uplinks)}
+		a.devices[f.DevAddr] = d
+	}
+	datr := lora.Datarate{SpreadingFactor: pkt.Datarate, Bandwidth: pkt.LoRaBW}
+	if datr != d.datr {
+		// the SNR of another datarate says nothing about this one
+		d.n, d.next = 0, 0
+		d.datr = datr
+	}
+	d.snr[d.next] = pkt.LoRaSNR
+	d.next = (d.next + 1) % len(d.snr)
+	if d.n < len(d.snr) {
+		d.n++
+	}
+
+	s, ok := a.advise(f.DevAddr, d)
+	if !ok || s.Advice == d.best {
+		return
+	}
+	d.best = s.Advice
+	if s.Advice != s.Datr {
+		log(LogLevelNormal, "adr: %s could use %s instead of %s, %.1f dB of margin over %d uplinks", a.privacy.id(f.DevAddr.String()), s.Advice, s.Datr, s.Margin, s.Uplinks)
+	}
+}
+
+// advise returns the advice for a device, or false until it sent enough uplinks.
+func (a *adrAdvice) advise(addr lorawan.DevAddr, d *adrDevice) (adrAdviceStatus, bool) {
+	required, ok := requiredSNR[d.datr.SpreadingFactor]
+	if !ok || d.n < len(d.snr) {
+		return adrAdviceStatus{}, false
+	}
+	max := d.snr[0]
+	for _, snr := range d.snr[1:] {
+		if snr > max {
+			max = snr
+		}
+	}
+	s := adrAdviceStatus{
+		DevAddr: addr,
+		Datr:    d.datr,
+		MaxSNR:  max,
+		Margin:  max - required - a.margin,
+		Advice:  d.datr,
+		Uplinks: d.n,
+	}
+	// each spreading factor less needs 2.5 dB more, rounded up to 3 dB as by the ADR of the servers
+	steps := int(math.Floor(float64(s.Margin) / 3))
+	for ; steps > 0 && s.Advice.SpreadingFactor > 7; steps-- {
+		s.Advice.SpreadingFactor--
+	}
+	return s, true
+}
+
+// report returns the advice for the devices that sent enough uplinks, by DevAddr.
+func (a *adrAdvice) report() []adrAdviceStatus {
+	var r []adrAdviceStatus
+	for addr, d := range a.devices {
+		s, ok := a.advise(addr, d)
+		if s.DevAddr, ok = a.privacy.devAddr(addr); ok {
+			r = append(r, s)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].DevAddr < r[j].DevAddr })
+	return r
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+)
+
+// maxAirtimeDevices limits the devices accounted for; the downlinks of more devices
+// are accounted to otherDevices.
+const maxAirtimeDevices = 4096
+
+const otherDevices = "other"
+
+// airtimeUsage is the airtime of the downlinks sent for a server or a device.
+type airtimeUsage struct {
+	Downlinks int     `json:"downlinks"`
+	AirtimeMs float64 `json:"airtime_ms"`
+}
+
+// accountAirtime adds the airtime of a sent downlink of the server, "" if it is not known.
+func (gw *Gateway) accountAirtime(server string, pkt *lora.TxPacket) {
+	airtime := pkt.Airtime()
+	if server == "" {
+		server = "unknown"
+	}
+	device := ""
+	if f, err := lorawan.Decode(pkt.Data); err == nil && f.IsData() {
+		device = f.DevAddr.String()
+	}
+
+	gw.txAirtime.Lock()
+	defer gw.txAirtime.Unlock()
+	add := func(m map[string]*airtimeUsage, key string) {
+		u := m[key]
+		if u == nil {
+			u = new(airtimeUsage)
+			m[key] = u
+		}
+		u.Downlinks++
+		u.AirtimeMs += float64(airtime) / float64(time.Millisecond)
+	}
+	add(gw.txAirtime.servers, server)
+	if device != "" {
+		if _, ok := gw.txAirtime.devices[device]; !ok && len(gw.txAirtime.devices) >= maxAirtimeDevices {
+			device = otherDevices
+		}
+		add(gw.txAirtime.devices, device)
+	}
+}
+
+// airtimeStatus is the "airtime" section of the API.
+type airtimeStatus struct {
+	Servers map[string]airtimeUsage `json:"servers"`
+	Devices map[string]airtimeUsage `json:"devices"`
+}
+
+// airtimeSnapshot returns a copy of the airtime accounts.
+func (gw *Gateway) airtimeSnapshot() *airtimeStatus {
+	gw.txAirtime.Lock()
+	defer gw.txAirtime.Unlock()
+	s := &airtimeStatus{
+		Servers: make(map[string]airtimeUsage, len(gw.txAirtime.servers)),
+		Devices: make(map[string]airtimeUsage, len(gw.txAirtime.devices)),
+	}
+	for k, u := range gw.txAirtime.servers {
+		s.Servers[k] = *u
+	}
+	for k, u := range gw.txAirtime.devices {
+		if k != otherDevices {
+			if k = gw.privacy.id(k); k == "" {
+				continue
+			}
+		}
+		s.Devices[k] = *u
+	}
+	return s
+}
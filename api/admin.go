@@ -0,0 +1,144 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// AdminConfig is the "admin" section of "api_conf". It enables POST /api/admin/<action>, which
+// runs an action on the gateway, as a radio reset, for the fleet operators that can not SSH onto
+// each gateway. Each request needs an API token with the action in its scopes.
+type AdminConfig struct {
+	Tokens []AdminToken `json:"tokens"`
+}
+
+// AdminToken is an API token of the admin endpoint, sent as "Authorization: Bearer <token>".
+type AdminToken struct {
+	// Name of the token, as its owner, for the log.
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	// Scopes are the actions that the token may run, or "*" for all.
+	Scopes []string `json:"scopes"`
+}
+
+// Action runs an admin action with the query parameters of the request, and returns its result,
+// which is answered as JSON. Errors wrapping ErrInvalidParam are answered 400 Bad Request, and
+// those wrapping ErrBusy 503 Service Unavailable.
+type Action func(params url.Values) (interface{}, error)
+
+// ErrInvalidParam is wrapped by the errors of Actions for parameters that are missing or invalid.
+var ErrInvalidParam = errors.New("invalid parameter")
+
+// ErrBusy is wrapped by the errors of Actions that may succeed if the request is sent again later.
+var ErrBusy = errors.New("busy, try again")
+
+// Admin serves the admin endpoint.
+type Admin struct {
+	// Logger logs each request, as an audit trail.
+	Logger *log.Logger
+
+	tokens  []AdminToken
+	actions map[string]Action
+}
+
+// NewAdmin returns the admin endpoint of the tokens, without actions, see Register.
+func NewAdmin(cfg *AdminConfig) (*Admin, error) {
+	if len(cfg.Tokens) == 0 {
+		return nil, errors.New("api: admin without tokens")
+	}
+	for i, t := range cfg.Tokens {
+		// short tokens can be guessed, and the endpoint has no rate limit
+		if len(t.Token) < 16 {
+			return nil, fmt.Errorf("api: admin token %d %q: shorter than 16 characters", i, t.Name)
+		}
+	}
+	return &Admin{
+		Logger:  log.New(os.Stdout, "[ADMIN] ", 0),
+		tokens:  cfg.Tokens,
+		actions: make(map[string]Action),
+	}, nil
+}
+
+// Register adds an action, which scopes name.
+func (a *Admin) Register(name string, action Action) {
+	a.actions[name] = action
+}
+
+// token returns the token of the request, or nil.
+func (a *Admin) token(r *http.Request) *AdminToken {
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if bearer == "" {
+		return nil
+	}
+	var found *AdminToken
+	for i := range a.tokens {
+		// all tokens are compared, so the time does not tell which one is close
+		if subtle.ConstantTimeCompare([]byte(a.tokens[i].Token), []byte(bearer)) == 1 {
+			found = &a.tokens[i]
+		}
+	}
+	return found
+}
+
+func (t *AdminToken) allows(action string) bool {
+	for _, s := range t.Scopes {
+		if s == "*" || s == action {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := path.Base(r.URL.Path)
+	t := a.token(r)
+	if t == nil {
+		a.Logger.Printf("%s: denied %s: no valid token", r.RemoteAddr, name)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	setCredentials(r, t.Name, RoleOperator)
+	action, ok := a.actions[name]
+	if !ok {
+		http.Error(w, "unknown action "+name, http.StatusNotFound)
+		return
+	}
+	if !t.allows(name) {
+		a.Logger.Printf("%s: denied %s to %q: out of scope", r.RemoteAddr, name, t.Name)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.Logger.Printf("%s: %q runs %s %s", r.RemoteAddr, t.Name, name, r.Form.Encode())
+	result, err := action(r.Form)
+	switch {
+	case errors.Is(err, ErrInvalidParam):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrBusy):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		a.Logger.Printf("%s: %s failed: %v", r.RemoteAddr, name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,133 @@
+// Package api is the local HTTP API of the forwarder.
+//
+// GET /api/status returns a JSON object with a member for each section published with Publish,
+// like the gateway identity and the applied radio settings.
+//
+// GET /api/stats/history returns the last status reports as a JSON list, oldest first,
+// and GET /api/stats/history.csv the same as a CSV download, see History.
+//
+// GET /api/stream pushes the received and sent packets to WebSocket clients, see Stream.
+//
+// POST /api/admin/<action> runs an action on the gateway with an API token, see Admin.
+//
+// The API is served over HTTPS with TLSConfig, and the requests need a token or a user and
+// password with AuthConfig. The requests that change the gateway are recorded with SetAudit.
+package api
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/Waziup/single_chan_pkt_fwd/audit"
+)
+
+// Config is the "api_conf" section of the gateway config.
+type Config struct {
+	// Address to listen on, as in "127.0.0.1:8080".
+	Address string `json:"address"`
+	// History is the number of status reports kept for /api/stats/history, DefaultHistory if not set.
+	History int `json:"history"`
+	// Admin enables the admin actions, which is optional.
+	Admin *AdminConfig `json:"admin"`
+	// Auth requires credentials for the requests, which is optional.
+	Auth *AuthConfig `json:"auth"`
+	// TLS serves the API over HTTPS, which is optional.
+	TLS *TLSConfig `json:"tls"`
+}
+
+// Server serves the API.
+type Server struct {
+	Logger *log.Logger
+
+	mux   *http.ServeMux
+	audit *audit.Log // or nil
+
+	mu     sync.RWMutex
+	status map[string]interface{}
+}
+
+// New returns a server with the status endpoint.
+func New() *Server {
+	s := &Server{
+		Logger: log.New(os.Stdout, "[API] ", 0),
+		mux:    http.NewServeMux(),
+		status: make(map[string]interface{}),
+	}
+	s.mux.HandleFunc("/api/status", s.serveStatus)
+	return s
+}
+
+// Publish sets a section of the status. v is marshaled on each request,
+// so it must not be modified afterwards: publish a new value instead.
+func (s *Server) Publish(section string, v interface{}) {
+	s.mu.Lock()
+	s.status[section] = v
+	s.mu.Unlock()
+}
+
+// Handle registers a handler for more endpoints.
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves the API on addr.
+func (s *Server) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, s)
+}
+
+// Serve serves the API as in the config, with its auth and TLS.
+func (s *Server) Serve(cfg *Config) error {
+	var h http.Handler = s
+	if cfg.Auth != nil {
+		a, err := newAuth(cfg.Auth, s)
+		if err != nil {
+			return err
+		}
+		h = a
+	}
+	h = &auditor{s: s, next: h}
+	if cfg.TLS == nil {
+		return http.ListenAndServe(cfg.Address, h)
+	}
+	cert, err := cfg.TLS.certificate(cfg.Address)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:    cfg.Address,
+		Handler: h,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+	return srv.ListenAndServeTLS("", "")
+}
+
+func (s *Server) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.RLock()
+	data, err := json.Marshal(s.status)
+	s.mu.RUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, data)
+}
+
+func writeJSON(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
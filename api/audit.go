@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/audit"
+)
+
+// credentials are who sent a request, as found by the auth or the admin tokens.
+type credentials struct {
+	principal string
+	role      Role
+}
+
+type credentialsKey struct{}
+
+// withCredentials returns the request with empty credentials, for setCredentials.
+func withCredentials(r *http.Request) (*http.Request, *credentials) {
+	c := &credentials{}
+	return r.WithContext(context.WithValue(r.Context(), credentialsKey{}, c)), c
+}
+
+// setCredentials records who sent a request, for the audit.
+func setCredentials(r *http.Request, principal string, role Role) {
+	if c, ok := r.Context().Value(credentialsKey{}).(*credentials); ok {
+		c.principal, c.role = principal, role
+	}
+}
+
+// roleOf returns the role of who sent a request, RoleOperator without auth.
+func roleOf(r *http.Request) Role {
+	if c, ok := r.Context().Value(credentialsKey{}).(*credentials); ok && c.role != "" {
+		return c.role
+	}
+	return RoleOperator
+}
+
+// SetAudit records the requests that may change the gateway, with other methods than GET and
+// HEAD, in the audit log, and serves its export on GET /api/audit to operators, as JSON lines.
+// The "since" query parameter, as "2024-05-01T00:00:00Z", leaves out the older entries.
+func (s *Server) SetAudit(l *audit.Log) {
+	s.audit = l
+	s.mux.HandleFunc("/api/audit", s.serveAudit)
+}
+
+// auditor records the requests of a handler in the audit log of the server.
+type auditor struct {
+	s    *Server
+	next http.Handler
+}
+
+func (a *auditor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r, c := withCredentials(r)
+	if a.s.audit == nil || r.Method == http.MethodGet || r.Method == http.MethodHead {
+		a.next.ServeHTTP(w, r)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	a.next.ServeHTTP(sw, r)
+	principal := c.principal
+	if principal == "" {
+		principal = "anonymous"
+	}
+	params := r.URL.RawQuery
+	if r.Form != nil {
+		// with the parameters of a form body, as of the admin actions
+		params = r.Form.Encode()
+	}
+	err := a.s.audit.Record(&audit.Entry{
+		Principal: principal,
+		Action:    r.Method + " " + r.URL.Path,
+		Params:    params,
+		Remote:    r.RemoteAddr,
+		Status:    sw.status,
+	})
+	if err != nil {
+		a.s.Logger.Printf("can not audit %s %s of %q: %v", r.Method, r.URL.Path, principal, err)
+	}
+}
+
+// statusWriter keeps the status of an answer.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (s *Server) serveAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if roleOf(r) != RoleOperator {
+		http.Error(w, "forbidden to viewers", http.StatusForbidden)
+		return
+	}
+	var since time.Time
+	if q := r.URL.Query().Get("since"); q != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, q); err != nil {
+			http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	if err := s.audit.Export(w, since); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AuthConfig is the "auth" section of "api_conf". With it, each request needs a bearer token or
+// a user and password, so the API can be served beyond localhost. The admin actions check their
+// own tokens, see AdminConfig.
+type AuthConfig struct {
+	// Tokens are sent as "Authorization: Bearer <token>", by operators.
+	Tokens []string `json:"tokens"`
+	// ViewerTokens are the tokens of viewers.
+	ViewerTokens []string `json:"viewer_tokens"`
+	// Users are the passwords of the users of basic auth, by name.
+	Users map[string]string `json:"users"`
+	// Roles are the roles of the users, by name. Users without are operators.
+	Roles map[string]Role `json:"roles"`
+}
+
+// Role is what a user or token may do.
+type Role string
+
+const (
+	// RoleViewer may only read, with GET and HEAD requests, as the status.
+	RoleViewer Role = "viewer"
+	// RoleOperator may also change the gateway, as by queuing downlinks.
+	RoleOperator Role = "operator"
+)
+
+// adminPrefix is the path of the admin actions, which are left to Admin.
+const adminPrefix = "/api/admin/"
+
+// auth checks the credentials of the requests of a handler.
+type auth struct {
+	cfg  *AuthConfig
+	next http.Handler
+}
+
+func newAuth(cfg *AuthConfig, next http.Handler) (*auth, error) {
+	if len(cfg.Tokens) == 0 && len(cfg.ViewerTokens) == 0 && len(cfg.Users) == 0 {
+		return nil, errors.New("api: auth without tokens or users")
+	}
+	for key, tokens := range map[string][]string{"tokens": cfg.Tokens, "viewer_tokens": cfg.ViewerTokens} {
+		for i, t := range tokens {
+			// short tokens can be guessed, and the API has no rate limit
+			if len(t) < 16 {
+				return nil, fmt.Errorf("api: auth %s %d: shorter than 16 characters", key, i)
+			}
+		}
+	}
+	for name, password := range cfg.Users {
+		if name == "" || strings.Contains(name, ":") {
+			return nil, fmt.Errorf("api: auth user %q: empty or with a colon", name)
+		}
+		if len(password) < 8 {
+			return nil, fmt.Errorf("api: auth user %q: password shorter than 8 characters", name)
+		}
+	}
+	for name, role := range cfg.Roles {
+		if _, ok := cfg.Users[name]; !ok {
+			return nil, fmt.Errorf("api: auth role of unknown user %q", name)
+		}
+		if role != RoleViewer && role != RoleOperator {
+			return nil, fmt.Errorf("api: auth user %q: unknown role %q, must be viewer or operator", name, role)
+		}
+	}
+	return &auth{cfg: cfg, next: next}, nil
+}
+
+// role returns the role of the token or user and password of the request, or "" if they are not
+// valid, and the principal: the user name, or the list and index of the token, as "tokens 0".
+// All credentials are compared, so the time does not tell which one is close.
+func (a *auth) role(r *http.Request) (role Role, principal string) {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		bearer := []byte(strings.TrimPrefix(h, "Bearer "))
+		for i, t := range a.cfg.ViewerTokens {
+			if subtle.ConstantTimeCompare([]byte(t), bearer) == 1 {
+				role, principal = RoleViewer, fmt.Sprintf("viewer_tokens %d", i)
+			}
+		}
+		for i, t := range a.cfg.Tokens {
+			if subtle.ConstantTimeCompare([]byte(t), bearer) == 1 {
+				role, principal = RoleOperator, fmt.Sprintf("tokens %d", i)
+			}
+		}
+	} else if name, password, found := r.BasicAuth(); found {
+		want, known := a.cfg.Users[name]
+		if subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1 && known {
+			role, principal = RoleOperator, name
+			if a.cfg.Roles[name] != "" {
+				role = a.cfg.Roles[name]
+			}
+		}
+	}
+	return role, principal
+}
+
+func (a *auth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, adminPrefix) {
+		a.next.ServeHTTP(w, r)
+		return
+	}
+	role, principal := a.role(r)
+	setCredentials(r, principal, role)
+	switch role {
+	case "":
+		if len(a.cfg.Tokens) != 0 || len(a.cfg.ViewerTokens) != 0 {
+			w.Header().Add("WWW-Authenticate", "Bearer")
+		}
+		if len(a.cfg.Users) != 0 {
+			w.Header().Add("WWW-Authenticate", `Basic realm="lora-pktfwd"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	case RoleViewer:
+		// the handlers only change the gateway on other methods, as POST
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "forbidden to viewers", http.StatusForbidden)
+			return
+		}
+		a.next.ServeHTTP(w, r)
+	default:
+		a.next.ServeHTTP(w, r)
+	}
+}
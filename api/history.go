@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+)
+
+// DefaultHistory is the number of status reports kept by a History if Config.History is not set.
+const DefaultHistory = 120
+
+// History keeps the last status reports in a ring buffer, to look at trends after an incident
+// without a metrics stack. It serves them oldest first as JSON, or as CSV for paths ending in
+// ".csv", see Config.History.
+type History struct {
+	mu    sync.Mutex
+	stats []fwd.Statistic
+	next  int
+	full  bool
+}
+
+// NewHistory returns a history of the last n status reports.
+func NewHistory(n int) *History {
+	if n <= 0 {
+		n = DefaultHistory
+	}
+	return &History{stats: make([]fwd.Statistic, n)}
+}
+
+// Add records a copy of a status report. The lists of the report must not be modified afterwards,
+// which holds for the forwarder as it replaces them for each report.
+func (h *History) Add(stat *fwd.Statistic) {
+	h.mu.Lock()
+	h.stats[h.next] = *stat
+	h.next = (h.next + 1) % len(h.stats)
+	if h.next == 0 {
+		h.full = true
+	}
+	h.mu.Unlock()
+}
+
+// Stats returns the recorded status reports, oldest first.
+func (h *History) Stats() []fwd.Statistic {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.full {
+		return append([]fwd.Statistic(nil), h.stats[:h.next]...)
+	}
+	return append(append([]fwd.Statistic(nil), h.stats[h.next:]...), h.stats[:h.next]...)
+}
+
+func (h *History) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats := h.Stats()
+	if strings.HasSuffix(r.URL.Path, ".csv") {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="stats.csv"`)
+		writeCSV(w, stats)
+		return
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, data)
+}
+
+// writeCSV writes a line for each status report with the counters and the noise floor of all
+// channels, which is empty if no noise was sampled.
+func writeCSV(w http.ResponseWriter, stats []fwd.Statistic) {
+	c := csv.NewWriter(w)
+	c.Write([]string{"time", "rxnb", "rxok", "rxfw", "ackr", "dwnb", "txnb", "noise_min", "noise_avg", "noise_max"})
+	for _, s := range stats {
+		line := []string{
+			s.TimeStamp.UTC().Format(time.RFC3339),
+			strconv.FormatInt(s.Rxnb, 10),
+			strconv.FormatInt(s.Rxok, 10),
+			strconv.FormatInt(s.Rxfw, 10),
+			strconv.FormatInt(s.Ackr, 10),
+			strconv.FormatInt(s.Dwnb, 10),
+			strconv.FormatInt(s.Txnb, 10),
+			"", "", "",
+		}
+		var min, max, sum float32
+		var n int64
+		for _, noise := range s.Noise {
+			if n == 0 || noise.Min < min {
+				min = noise.Min
+			}
+			if n == 0 || noise.Max > max {
+				max = noise.Max
+			}
+			sum += noise.Avg * float32(noise.N)
+			n += noise.N
+		}
+		if n > 0 {
+			line[7] = fmt.Sprintf("%.1f", min)
+			line[8] = fmt.Sprintf("%.1f", sum/float32(n))
+			line[9] = fmt.Sprintf("%.1f", max)
+		}
+		c.Write(line)
+	}
+	c.Flush()
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/eventbus"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+)
+
+// The limits of a Stream.
+const (
+	streamBuffer     = 64 // events queued for each client, dropped beyond
+	streamMaxClients = 16 // clients connected at once
+)
+
+// Stream pushes the received and sent packets to the WebSocket clients of GET /api/stream, in
+// real time, for visualizers. Each packet is a text message with the JSON of its rx or tx event,
+// as of the event bus, see eventbus.Event.
+//
+// The query filters the packets of a client: "sf" keeps the LoRa packets of the spreading
+// factors and "dev_addr" the data frames of the DevAddrs, as in "?sf=7,8&dev_addr=26011BDA".
+type Stream struct {
+	Logger *log.Logger
+
+	mu      sync.Mutex
+	clients map[*streamClient]bool
+}
+
+type streamClient struct {
+	ws      *wsConn
+	filter  *streamFilter
+	queue   chan []byte
+	dropped int // under Stream.mu
+}
+
+// streamFilter keeps the packets of a client, all if its sets are nil.
+type streamFilter struct {
+	sfs      map[lora.SpreadingFactor]bool
+	devAddrs map[lorawan.DevAddr]bool
+}
+
+// NewStream returns a stream without clients.
+func NewStream() *Stream {
+	return &Stream{
+		Logger:  log.New(os.Stdout, "[API] ", 0),
+		clients: make(map[*streamClient]bool),
+	}
+}
+
+// parseStreamFilter returns the filter of the query, with lists separated by commas.
+func parseStreamFilter(r *http.Request) (*streamFilter, error) {
+	f := &streamFilter{}
+	q := r.URL.Query()
+	for _, v := range q["sf"] {
+		for _, s := range strings.Split(v, ",") {
+			sf, err := lora.ParseSpreadingFactor(strings.TrimSpace(s))
+			if err != nil {
+				return nil, err
+			}
+			if f.sfs == nil {
+				f.sfs = make(map[lora.SpreadingFactor]bool)
+			}
+			f.sfs[sf] = true
+		}
+	}
+	for _, v := range q["dev_addr"] {
+		for _, s := range strings.Split(v, ",") {
+			var addr lorawan.DevAddr
+			if err := addr.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+				return nil, err
+			}
+			if f.devAddrs == nil {
+				f.devAddrs = make(map[lorawan.DevAddr]bool)
+			}
+			f.devAddrs[addr] = true
+		}
+	}
+	return f, nil
+}
+
+// streamPacket is what the filters look at in a packet.
+type streamPacket struct {
+	loRa    bool
+	sf      lora.SpreadingFactor
+	data    bool // a data frame, with a DevAddr
+	devAddr lorawan.DevAddr
+}
+
+func newStreamPacket(modulation lora.Modulation, sf lora.SpreadingFactor, data []byte) *streamPacket {
+	p := &streamPacket{
+		loRa: modulation == lora.ModulationLoRa,
+		sf:   sf,
+	}
+	if f, err := lorawan.Decode(data); err == nil && f.IsData() {
+		p.data, p.devAddr = true, f.DevAddr
+	}
+	return p
+}
+
+func (f *streamFilter) keeps(p *streamPacket) bool {
+	if f.sfs != nil && !(p.loRa && f.sfs[p.sf]) {
+		return false
+	}
+	if f.devAddrs != nil && !(p.data && f.devAddrs[p.devAddr]) {
+		return false
+	}
+	return true
+}
+
+// Publish sends a rx or tx event, at the current time if it has none, to the clients whose
+// filter keeps its packet. It does not wait for the clients, and the event is not referenced
+// after Publish returns.
+func (s *Stream) Publish(e *eventbus.Event) {
+	var p *streamPacket
+	switch {
+	case e.Rx != nil:
+		p = newStreamPacket(e.Rx.Modulation, e.Rx.Datarate, e.Rx.Data)
+	case e.Tx != nil:
+		p = newStreamPacket(e.Tx.Modulation, e.Tx.Datarate, e.Tx.Data)
+	default:
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.clients) == 0 {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		s.Logger.Printf("can not marshal %s event: %v", e.Type, err)
+		return
+	}
+	for c := range s.clients {
+		if !c.filter.keeps(p) {
+			continue
+		}
+		select {
+		case c.queue <- data:
+		default:
+			c.dropped++
+		}
+	}
+}
+
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseStreamFilter(r)
+	if err != nil {
+		http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	full := len(s.clients) >= streamMaxClients
+	s.mu.Unlock()
+	if full {
+		http.Error(w, fmt.Sprintf("%d clients connected", streamMaxClients), http.StatusServiceUnavailable)
+		return
+	}
+	ws, err := upgrade(w, r)
+	if err != nil {
+		return
+	}
+	c := &streamClient{ws: ws, filter: filter, queue: make(chan []byte, streamBuffer)}
+	s.mu.Lock()
+	s.clients[c] = true
+	s.mu.Unlock()
+	go func() {
+		ws.serveControl()
+		s.remove(c)
+	}()
+	for data := range c.queue {
+		if err := ws.writeFrame(wsText, data); err != nil {
+			break
+		}
+	}
+	s.remove(c)
+}
+
+// remove disconnects a client, once.
+func (s *Stream) remove(c *streamClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.clients[c] {
+		return
+	}
+	delete(s.clients, c)
+	close(c.queue)
+	c.ws.Close()
+	if c.dropped != 0 {
+		s.Logger.Printf("stream client disconnected, %d events dropped", c.dropped)
+	}
+}
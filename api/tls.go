@@ -0,0 +1,111 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// TLSConfig is the "tls" section of "api_conf", which serves the API over HTTPS.
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM files of the certificate, with its chain, and of its key.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// SelfSigned generates a self-signed certificate into CertFile and KeyFile on the first start,
+	// if they do not exist. Clients must then trust it, as with curl --cacert.
+	SelfSigned bool `json:"self_signed"`
+}
+
+// selfSignedValidity is the validity of the self-signed certificates.
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+// certificate loads the certificate of the config, after generating it if it is self-signed and
+// does not exist. The addr of the API is added to the names of generated certificates.
+func (c *TLSConfig) certificate(addr string) (tls.Certificate, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return tls.Certificate{}, errors.New("api: tls without cert_file or key_file")
+	}
+	if c.SelfSigned {
+		if _, err := os.Stat(c.CertFile); os.IsNotExist(err) {
+			if err := generateCertificate(c.CertFile, c.KeyFile, addr); err != nil {
+				return tls.Certificate{}, fmt.Errorf("api: can not generate certificate: %v", err)
+			}
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("api: %v", err)
+	}
+	return cert, nil
+}
+
+// generateCertificate writes a self-signed certificate for the host name, localhost and the
+// host of addr, and its key.
+func generateCertificate(certFile, keyFile, addr string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" {
+		tmpl.DNSNames = append(tmpl.DNSNames, hostname, hostname+".local")
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	// the key first, so a certificate is never left without it
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", der, 0644)
+}
+
+// writePEM replaces a file with a PEM block, so it is never left partial.
+func writePEM(file, typ string, der []byte, perm os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
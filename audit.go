@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/Waziup/single_chan_pkt_fwd/audit"
+)
+
+// openAudit opens the audit log and records the start of the forwarder, with the digest of its
+// config, so config changes show as a new digest.
+func (gw *Gateway) openAudit(cfg *audit.Config, config []byte) error {
+	var err error
+	if gw.auditLog, err = audit.Open(cfg); err != nil {
+		return err
+	}
+	gw.auditEvent("start", fmt.Sprintf("config sha256 %x", sha256.Sum256(config)))
+	return nil
+}
+
+// auditEvent records an action of the forwarder itself, if "audit_conf" is set.
+func (gw *Gateway) auditEvent(action, detail string) {
+	if gw.auditLog == nil {
+		return
+	}
+	if err := gw.auditLog.Record(&audit.Entry{Principal: "forwarder", Action: action, Detail: detail}); err != nil {
+		log(LogLevelError, "%v", err)
+	}
+}
@@ -0,0 +1,190 @@
+// Package audit records the control actions on the gateway, as the requests of the API that
+// change it and config changes, in an append-only file, with the time and who did them.
+//
+// The file holds one JSON entry per line. Once it reaches its maximum size it is renamed with
+// the suffix ".1", the older files are shifted to ".2" and so on, and a new file is started. The
+// file can also be rotated by an external tool, as logrotate, which renames it: a new file is
+// then started at the path on the next entry.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Config is the "audit_conf" section of the gateway config.
+type Config struct {
+	Path string `json:"path"`
+	// MaxSize of the file in KiB before it is rotated, 1024 if not set.
+	MaxSize int `json:"max_size"`
+	// MaxFiles is the number of rotated files kept, 5 if not set.
+	MaxFiles int `json:"max_files"`
+}
+
+// Entry is an action of the audit file.
+type Entry struct {
+	Time time.Time `json:"time"`
+	// Principal is who did it, as the user or token of the API, or the component of the gateway.
+	Principal string `json:"principal"`
+	// Action is what was done, as "POST /api/multicast/01FF0001" or "config_changed".
+	Action string `json:"action"`
+	Params string `json:"params,omitempty"`
+	Remote string `json:"remote,omitempty"` // address of the client
+	Status int    `json:"status,omitempty"` // HTTP status of the answer
+	Detail string `json:"detail,omitempty"`
+}
+
+// Log appends entries to the audit file.
+type Log struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Open opens or creates the audit file.
+func Open(cfg *Config) (*Log, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("audit: no path")
+	}
+	l := &Log{
+		path:     cfg.Path,
+		maxSize:  int64(cfg.MaxSize) << 10,
+		maxFiles: cfg.MaxFiles,
+	}
+	if l.maxSize <= 0 {
+		l.maxSize = 1024 << 10
+	}
+	if l.maxFiles <= 0 {
+		l.maxFiles = 5
+	}
+	if err := l.open(); err != nil {
+		return nil, fmt.Errorf("audit: %v", err)
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// Record appends an entry, at the current time if it has none, and syncs the file so it
+// survives a power loss.
+func (l *Log) Record(e *Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.reopen(int64(len(data))); err != nil {
+		return fmt.Errorf("audit: %v", err)
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("audit: %v", err)
+	}
+	return l.file.Sync()
+}
+
+// reopen starts a new file if the file was rotated by another tool, or rotates it if n more
+// bytes do not fit.
+func (l *Log) reopen(n int64) error {
+	if info, err := os.Stat(l.path); err != nil || !sameFile(l.file, info) {
+		l.file.Close()
+		return l.open()
+	}
+	if l.size == 0 || l.size+n <= l.maxSize {
+		return nil
+	}
+	l.file.Close()
+	os.Remove(l.rotated(l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		os.Rename(l.rotated(i), l.rotated(i+1))
+	}
+	if err := os.Rename(l.path, l.rotated(1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func sameFile(f *os.File, info os.FileInfo) bool {
+	open, err := f.Stat()
+	return err == nil && os.SameFile(open, info)
+}
+
+// rotated returns the path of the rotated file i, from 1 for the newest.
+func (l *Log) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
+
+// Export writes the entries since the time, of the rotated files and the file, oldest first,
+// as JSON lines. Entries of files rotated by other tools are not exported.
+func (l *Log) Export(w io.Writer, since time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := l.maxFiles; i >= 0; i-- {
+		path := l.path
+		if i > 0 {
+			path = l.rotated(i)
+		}
+		if err := export(w, path, since); err != nil {
+			return fmt.Errorf("audit: %v", err)
+		}
+	}
+	return nil
+}
+
+func export(w io.Writer, path string, since time.Time) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.Time.Before(since) {
+			continue
+		}
+		if _, err := w.Write(append(scanner.Bytes(), '\n')); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Close closes the audit file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+	"github.com/Waziup/single_chan_pkt_fwd/spool"
+)
+
+// BackhaulWindowsConfig is the "backhaul_windows_conf" section of the gateway config. For
+// backhauls that are only open at times, as a satellite link, the uplinks are held in the uplink
+// spool outside the windows and flushed in them, except for the urgent ones.
+type BackhaulWindowsConfig struct {
+	// Windows are the times of day the backhaul is open, in the local time, as "06:00-06:15".
+	Windows []string `json:"windows"`
+	// UrgentFPorts are the FPorts of the data uplinks that are forwarded at once, as alarms.
+	// Join requests are always forwarded at once.
+	UrgentFPorts []uint8 `json:"urgent_fports"`
+}
+
+// backhaulSchedule is the schedule of the backhaul windows.
+type backhaulSchedule struct {
+	windows [][2]time.Duration // the start and end, as times of day
+	urgent  map[uint8]bool     // FPorts
+	spool   *spool.Spool       // the uplinks are held in
+}
+
+func newBackhaulSchedule(cfg *BackhaulWindowsConfig, sp *spool.Spool) (*backhaulSchedule, error) {
+	if len(cfg.Windows) == 0 {
+		return nil, errors.New("no windows")
+	}
+	s := &backhaulSchedule{urgent: make(map[uint8]bool), spool: sp}
+	for _, w := range cfg.Windows {
+		start, end, err := parseWindow(w)
+		if err != nil {
+			return nil, err
+		}
+		s.windows = append(s.windows, [2]time.Duration{start, end})
+	}
+	for _, port := range cfg.UrgentFPorts {
+		s.urgent[port] = true
+	}
+	return s, nil
+}
+
+// parseWindow returns the start and end of a window as "06:00-06:15" as times of day.
+func parseWindow(w string) (start, end time.Duration, err error) {
+	parts := strings.Split(w, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid window %q, must be as \"06:00-06:15\"", w)
+	}
+	var tod [2]time.Duration
+	for i, p := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(p))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid window %q, must be as \"06:00-06:15\"", w)
+		}
+		tod[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if tod[0] == tod[1] {
+		return 0, 0, fmt.Errorf("invalid window %q: empty", w)
+	}
+	return tod[0], tod[1], nil
+}
+
+// open tells if now is in a window. Windows that end before they start span midnight.
+func (s *backhaulSchedule) open(now time.Time) bool {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	tod := now.Sub(midnight)
+	for _, w := range s.windows {
+		start, end := w[0], w[1]
+		if start < end && tod >= start && tod < end || start > end && (tod >= start || tod < end) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUrgent tells if an uplink is forwarded outside the windows: a join request, so devices can
+// join at any time, or a data uplink on an urgent FPort.
+func (s *backhaulSchedule) isUrgent(pkt *lora.RxPacket) bool {
+	f, err := lorawan.Decode(pkt.Data)
+	if err != nil {
+		return false
+	}
+	if f.MType() == lorawan.JoinRequest {
+		return true
+	}
+	return f.IsData() && f.FPort != nil && s.urgent[*f.FPort]
+}
+
+// hold spools the uplinks, received at t, that are not urgent while the backhaul is closed, and
+// returns the others.
+func (s *backhaulSchedule) hold(pkts []*lora.RxPacket, t time.Time) []*lora.RxPacket {
+	if s.open(t) {
+		return pkts
+	}
+	var records []*spool.Record
+	urgent := pkts[:0:0]
+	for _, pkt := range pkts {
+		if s.isUrgent(pkt) {
+			urgent = append(urgent, pkt)
+			continue
+		}
+		r, err := spool.NewRecord(pkt, t)
+		if err != nil {
+			log(LogLevelError, "spool: %v", err)
+			continue
+		}
+		s.spool.Classify(r, pkt)
+		records = append(records, r)
+	}
+	if len(records) != 0 {
+		dropped, err := s.spool.Push(records...)
+		if err != nil {
+			log(LogLevelError, "spool: %v", err)
+		}
+		log(LogLevelVerbose, "backhaul closed: holding %d uplinks, %d spooled", len(records), s.spool.Len())
+		if dropped != 0 {
+			log(LogLevelWarning, "spool: full, dropped the %d oldest uplinks", dropped)
+		}
+	}
+	return urgent
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// bindToDevice returns a socket control function that binds the socket to the network interface,
+// so its traffic can not leave by another route, e.g. when a VPN is down. It needs CAP_NET_RAW.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		}); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return &net.OpError{Op: "bind", Net: network, Err: err}
+		}
+		return nil
+	}
+}
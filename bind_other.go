@@ -0,0 +1,11 @@
+// +build !linux
+
+package main
+
+import "syscall"
+
+// bindToDevice returns nil, as sockets can only be bound to a network interface on Linux.
+// The socket is still bound to the address of the interface, see listenUDP.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/bridge"
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// bridgeUplinks is the number of recent uplinks of other forwarders that downlinks are matched with.
+const bridgeUplinks = 64
+
+// bridgeAckTimeout is how long the TX_ACK of another forwarder is waited for.
+const bridgeAckTimeout = time.Minute
+
+// bridgeUplink is an uplink of another forwarder, with its tmst on both gateways.
+type bridgeUplink struct {
+	gatewayID uint64
+	local     uint32
+	remote    uint32
+}
+
+type bridgeAckKey struct {
+	gatewayID uint64
+	token     fwd.Token
+}
+
+// bridgeAck is a downlink sent to another forwarder, whose TX_ACK goes to the server that sent it.
+type bridgeAck struct {
+	dl   *downlink
+	sent time.Time
+}
+
+// startBridge serves the other forwarders, and relays them to the servers in the relay mode.
+func (gw *Gateway) startBridge(cfg *bridge.Config) error {
+	addrs := make([]*net.UDPAddr, len(gw.servers))
+	for i, s := range gw.servers {
+		addrs[i] = s.addr
+	}
+	var err error
+	if gw.gwBridge, err = bridge.New(cfg, addrs); err != nil {
+		return err
+	}
+	gw.bridgeTxAcks = gw.gwBridge.TxAcks
+	return nil
+}
+
+// drainBridge returns the uplinks of other forwarders received since the last call.
+func (gw *Gateway) drainBridge() []*lora.RxPacket {
+	if gw.gwBridge == nil {
+		return nil
+	}
+	var pkts []*lora.RxPacket
+	for {
+		select {
+		case u := <-gw.gwBridge.Uplinks:
+			gw.bridged.pending[u.Pkt] = u
+			pkts = append(pkts, u.Pkt)
+		default:
+			return pkts
+		}
+	}
+}
+
+// recordBridgeUplink keeps the tmst of an uplink of another forwarder once it got a local one.
+func (gw *Gateway) recordBridgeUplink(pkt *lora.RxPacket) {
+	u := gw.bridged.pending[pkt]
+	if u == nil {
+		return
+	}
+	delete(gw.bridged.pending, pkt)
+	gw.bridged.uplinks[gw.bridged.next] = bridgeUplink{gatewayID: u.GatewayID, local: pkt.CountUs, remote: u.Pkt.CountUs}
+	gw.bridged.next = (gw.bridged.next + 1) % bridgeUplinks
+}
+
+// bridgeDownlink sends a Class A downlink to the other forwarder that received the uplink it
+// answers, with the tmst of that forwarder, and reports whether it did.
+// Otherwise the downlink is for the radios.
+func (gw *Gateway) bridgeDownlink(dl *downlink) bool {
+	if gw.gwBridge == nil || dl.tx.Immediate {
+		return false
+	}
+	var up *bridgeUplink
+	var delay time.Duration
+	for i := 1; i <= bridgeUplinks; i++ {
+		u := &gw.bridged.uplinks[(gw.bridged.next-i+bridgeUplinks)%bridgeUplinks]
+		if u.gatewayID == 0 {
+			break
+		}
+		d := time.Duration(dl.tx.CountUs-u.local) * time.Microsecond
+		s := d.Round(time.Second)
+		if s >= time.Second && s <= 16*time.Second && d-s <= rxWindowTolerance && s-d <= rxWindowTolerance {
+			up, delay = u, d
+			break
+		}
+	}
+	if up == nil {
+		return false
+	}
+	tx := *dl.tx
+	tx.CountUs = up.remote + uint32(delay/time.Microsecond)
+	if err := gw.gwBridge.Send(up.gatewayID, dl.token, &tx); err != nil {
+		log(LogLevelWarning, "bridge: can not pass downlink to %016X, sending it from the radios: %v", up.gatewayID, err)
+		return false
+	}
+	log(LogLevelNormal, "bridge: passed downlink to %016X, tmst %d", up.gatewayID, tx.CountUs)
+	now := gw.clock.Now()
+	for k, a := range gw.bridged.acks {
+		if now.Sub(a.sent) > bridgeAckTimeout {
+			delete(gw.bridged.acks, k)
+		}
+	}
+	gw.bridged.acks[bridgeAckKey{up.gatewayID, dl.token}] = &bridgeAck{dl: dl, sent: now}
+	return true
+}
+
+// forwardBridgeAck sends the TX_ACK of another forwarder to the server of the downlink.
+func (gw *Gateway) forwardBridgeAck(ack *bridge.TxAck) {
+	k := bridgeAckKey{ack.GatewayID, ack.Token}
+	a := gw.bridged.acks[k]
+	if a == nil {
+		return
+	}
+	delete(gw.bridged.acks, k)
+	err := ack.Error
+	if err == 0 {
+		err = fwd.NoError
+	}
+	if err != fwd.NoError {
+		log(LogLevelWarning, "bridge: %016X can not send downlink: %v", ack.GatewayID, err)
+	}
+	gw.upstreamTo(a.dl.ctx, &fwd.Packet{
+		Token: a.dl.token,
+		Ident: fwd.TxAck,
+		TxAck: err,
+	}, a.dl.server)
+}
@@ -0,0 +1,322 @@
+// Package bridge accepts the Semtech UDP protocol of other packet forwarders, as ESP32 based single
+// channel gateways, so the forwarder acts as a local concentrator proxy for them.
+//
+// In the "aggregate" mode their uplinks are received as those of the radios of this gateway and
+// forwarded under its gateway ID, and the Class A downlinks that answer them are passed back to them.
+// In the "relay" mode their packets are relayed to the servers under their own gateway IDs, each
+// forwarder through a socket of its own, so the answers of the servers find their way back.
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// Config is the "bridge_conf" section of the gateway config.
+type Config struct {
+	// Address to listen on for the other forwarders, ":1700" if not set.
+	Address string `json:"address"`
+	// Mode is "aggregate" or "relay", see the package doc, "aggregate" if not set.
+	Mode string `json:"mode"`
+	// Gateways are the IDs of the forwarders that are accepted, as 16 hex digits. All are if not set.
+	Gateways []string `json:"gateways"`
+	// Quirks fixes the PUSH_DATA of forwarders that do not follow the Semtech protocol to the
+	// letter, as many ESP32 based ones, before they are read or relayed. See normalize.
+	Quirks bool `json:"quirks"`
+}
+
+// Uplink is an uplink of another forwarder in the aggregate mode.
+type Uplink struct {
+	GatewayID uint64
+	Pkt       *lora.RxPacket // with the tmst of the other forwarder
+}
+
+// TxAck is the TX_ACK of another forwarder for a downlink passed to Send.
+type TxAck struct {
+	GatewayID uint64
+	Token     fwd.Token
+	Error     fwd.TxAckError // zero if the forwarder sent no error field
+}
+
+// Gateway is the status of another forwarder.
+type Gateway struct {
+	GatewayID string    `json:"gateway_id"`
+	Address   string    `json:"address"`
+	Seen      time.Time `json:"seen"`
+	Uplinks   int       `json:"uplinks"`
+	Downlinks int       `json:"downlinks"`
+	// Quirks counts the PUSH_DATA that had to be fixed, see Config.Quirks.
+	Quirks int `json:"quirks,omitempty"`
+}
+
+// Bridge serves the other forwarders.
+type Bridge struct {
+	Logger *log.Logger
+
+	// Uplinks and TxAcks are filled in the aggregate mode, without blocking, so they are
+	// dropped if nobody reads them.
+	Uplinks chan *Uplink
+	TxAcks  chan *TxAck
+
+	conn    *net.UDPConn
+	relay   bool
+	quirks  bool
+	servers []*net.UDPAddr
+	allowed map[uint64]bool // nil to accept all
+
+	mu       sync.Mutex
+	gateways map[uint64]*gateway
+}
+
+type gateway struct {
+	status   Gateway
+	version  byte
+	pushAddr *net.UDPAddr // where PUSH_ACKs go
+	pullAddr *net.UDPAddr // where PULL_ACKs and PULL_RESPs go, nil until the first PULL_DATA
+	upstream *net.UDPConn // to the servers in the relay mode
+}
+
+// ErrUnknownGateway is returned by Send for forwarders that did not send a PULL_DATA yet.
+var ErrUnknownGateway = errors.New("bridge: gateway has not pulled yet")
+
+// New listens for the other forwarders and serves them in the background. In the relay mode
+// their packets go to the servers.
+func New(cfg *Config, servers []*net.UDPAddr) (*Bridge, error) {
+	b := &Bridge{
+		Logger:   log.New(os.Stdout, "[BRIDG] ", 0),
+		Uplinks:  make(chan *Uplink, 64),
+		TxAcks:   make(chan *TxAck, 16),
+		servers:  servers,
+		quirks:   cfg.Quirks,
+		gateways: make(map[uint64]*gateway),
+	}
+	switch cfg.Mode {
+	case "", "aggregate":
+	case "relay":
+		b.relay = true
+	default:
+		return nil, fmt.Errorf("bridge: unknown mode %q, not aggregate or relay", cfg.Mode)
+	}
+	if len(cfg.Gateways) != 0 {
+		b.allowed = make(map[uint64]bool)
+		for _, id := range cfg.Gateways {
+			n, err := strconv.ParseUint(id, 16, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bridge: invalid gateway ID %q: %v", id, err)
+			}
+			b.allowed[n] = true
+		}
+	}
+	addr := cfg.Address
+	if addr == "" {
+		addr = ":1700"
+	}
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("bridge: %v", err)
+	}
+	if b.conn, err = net.ListenUDP("udp", laddr); err != nil {
+		return nil, fmt.Errorf("bridge: %v", err)
+	}
+	go b.serve()
+	return b, nil
+}
+
+// Send sends a downlink to another forwarder, with the token of the PULL_RESP of the server,
+// which the TX_ACK of the forwarder refers to.
+func (b *Bridge) Send(gatewayID uint64, token fwd.Token, tx *lora.TxPacket) error {
+	b.mu.Lock()
+	gw := b.gateways[gatewayID]
+	var addr *net.UDPAddr
+	var version byte
+	if gw != nil && gw.pullAddr != nil {
+		addr, version = gw.pullAddr, gw.version
+		gw.status.Downlinks++
+	}
+	b.mu.Unlock()
+	if addr == nil {
+		return fmt.Errorf("%w: %016X", ErrUnknownGateway, gatewayID)
+	}
+	return b.write(&fwd.Packet{Version: version, Token: token, Ident: fwd.PullResp, TxPacket: tx}, addr)
+}
+
+// Mode returns the mode of the bridge, "aggregate" or "relay".
+func (b *Bridge) Mode() string {
+	if b.relay {
+		return "relay"
+	}
+	return "aggregate"
+}
+
+// Gateways returns the status of the forwarders seen, by gateway ID.
+func (b *Bridge) Gateways() []Gateway {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	gws := make([]Gateway, 0, len(b.gateways))
+	for _, gw := range b.gateways {
+		gws = append(gws, gw.status)
+	}
+	sort.Slice(gws, func(i, j int) bool { return gws[i].GatewayID < gws[j].GatewayID })
+	return gws
+}
+
+func (b *Bridge) serve() {
+	var buf [65536]byte
+	for {
+		n, addr, err := b.conn.ReadFromUDP(buf[:])
+		if err != nil {
+			b.Logger.Printf("%v", err)
+			return
+		}
+		data := buf[:n]
+		fixed := false
+		if b.quirks && n > 12 && fwd.Ident(data[3]) == fwd.PushData {
+			payload, changed, err := normalize(data[12:])
+			if err != nil {
+				b.Logger.Printf("(<- %s) can not fix PUSH_DATA: %v", addr, err)
+				continue
+			}
+			if changed {
+				data = append(append(make([]byte, 0, 12+len(payload)), data[:12]...), payload...)
+				fixed = true
+			}
+		}
+		var pkt fwd.Packet
+		if err := pkt.UnmarshalBinary(data); err != nil {
+			b.Logger.Printf("(<- %s) %v", addr, err)
+			continue
+		}
+		switch pkt.Ident {
+		case fwd.PushData, fwd.PullData, fwd.TxAck:
+		default:
+			b.Logger.Printf("(<- %s) unexpected %s", addr, pkt.Ident)
+			continue
+		}
+		if b.allowed != nil && !b.allowed[pkt.GatewayID] {
+			b.Logger.Printf("(<- %s) dropping %s of unknown gateway %016X", addr, pkt.Ident, pkt.GatewayID)
+			continue
+		}
+		gw, err := b.gateway(&pkt, addr, fixed)
+		if err != nil {
+			b.Logger.Printf("(<- %s) %v", addr, err)
+			continue
+		}
+		if b.relay {
+			for _, server := range b.servers {
+				if _, err := gw.upstream.WriteToUDP(data, server); err != nil {
+					b.Logger.Printf("(-> %s) can not relay %s of %016X: %v", server, pkt.Ident, pkt.GatewayID, err)
+				}
+			}
+			continue
+		}
+		b.aggregate(gw, &pkt, addr)
+	}
+}
+
+// gateway returns the forwarder of a packet, and records where its answers go.
+// fixed tells whether the packet had quirks.
+func (b *Bridge) gateway(pkt *fwd.Packet, addr *net.UDPAddr, fixed bool) (*gateway, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	gw := b.gateways[pkt.GatewayID]
+	if gw == nil {
+		gw = &gateway{status: Gateway{GatewayID: fmt.Sprintf("%016X", pkt.GatewayID)}}
+		if b.relay {
+			var err error
+			if gw.upstream, err = net.ListenUDP("udp", nil); err != nil {
+				return nil, fmt.Errorf("can not open a socket for %016X: %v", pkt.GatewayID, err)
+			}
+			go b.answer(gw)
+		}
+		b.gateways[pkt.GatewayID] = gw
+		b.Logger.Printf("(<- %s) new gateway %016X", addr, pkt.GatewayID)
+	}
+	gw.version = pkt.Version
+	gw.status.Address = addr.String()
+	gw.status.Seen = time.Now().UTC()
+	gw.status.Uplinks += len(pkt.RxPackets)
+	if fixed {
+		if gw.status.Quirks == 0 {
+			b.Logger.Printf("(<- %s) fixing the quirks of gateway %016X", addr, pkt.GatewayID)
+		}
+		gw.status.Quirks++
+	}
+	switch pkt.Ident {
+	case fwd.PushData:
+		gw.pushAddr = addr
+	case fwd.PullData:
+		gw.pullAddr = addr
+	}
+	return gw, nil
+}
+
+// answer relays the answers of the servers to the forwarder in the relay mode.
+func (b *Bridge) answer(gw *gateway) {
+	var buf [65536]byte
+	for {
+		n, _, err := gw.upstream.ReadFromUDP(buf[:])
+		if err != nil {
+			b.Logger.Printf("%v", err)
+			return
+		}
+		if n < 4 {
+			continue
+		}
+		b.mu.Lock()
+		addr := gw.pullAddr
+		if fwd.Ident(buf[3]) == fwd.PushAck {
+			addr = gw.pushAddr
+		}
+		if fwd.Ident(buf[3]) == fwd.PullResp {
+			gw.status.Downlinks++
+		}
+		b.mu.Unlock()
+		if addr == nil {
+			continue
+		}
+		if _, err := b.conn.WriteToUDP(buf[:n], addr); err != nil {
+			b.Logger.Printf("(-> %s) can not relay: %v", addr, err)
+		}
+	}
+}
+
+// aggregate acknowledges a packet of a forwarder and passes its uplinks and TX_ACKs on.
+func (b *Bridge) aggregate(gw *gateway, pkt *fwd.Packet, addr *net.UDPAddr) {
+	switch pkt.Ident {
+	case fwd.PushData:
+		b.write(&fwd.Packet{Version: pkt.Version, Token: pkt.Token, Ident: fwd.PushAck}, addr)
+		for _, rx := range pkt.RxPackets {
+			select {
+			case b.Uplinks <- &Uplink{GatewayID: pkt.GatewayID, Pkt: rx}:
+			default:
+				b.Logger.Printf("(<- %s) dropping uplink of %016X: queue full", addr, pkt.GatewayID)
+			}
+		}
+	case fwd.PullData:
+		b.write(&fwd.Packet{Version: pkt.Version, Token: pkt.Token, Ident: fwd.PullAck}, addr)
+	case fwd.TxAck:
+		select {
+		case b.TxAcks <- &TxAck{GatewayID: pkt.GatewayID, Token: pkt.Token, Error: pkt.TxAck}:
+		default:
+		}
+	}
+}
+
+func (b *Bridge) write(pkt *fwd.Packet, addr *net.UDPAddr) error {
+	data, err := pkt.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = b.conn.WriteToUDP(data, addr)
+	return err
+}
@@ -0,0 +1,128 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// rxpkNumbers are the "rxpk" fields that some forwarders send as strings.
+var rxpkNumbers = []string{"tmst", "freq", "chan", "rfch", "stat", "rssi", "lsnr", "size"}
+
+// statFields are the "stat" fields that servers expect, with the value of those that are missing.
+var statFields = map[string]interface{}{
+	"rxnb": 0,
+	"rxok": 0,
+	"rxfw": 0,
+	"ackr": 0,
+	"dwnb": 0,
+	"txnb": 0,
+}
+
+// normalize rewrites the JSON payload of a PUSH_DATA as the Semtech protocol has it, for the
+// quirks of ESP32 forwarders: keys in upper or mixed case, numbers as strings, missing "rxpk" and
+// "stat" fields and trailing NUL bytes. It reports whether anything was changed.
+func normalize(payload []byte) ([]byte, bool, error) {
+	trimmed := bytes.TrimRight(payload, "\x00 \r\n\t")
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	dec.UseNumber()
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return nil, false, err
+	}
+	changed := len(trimmed) != len(bytes.TrimRight(payload, " \r\n\t"))
+	obj = lowerKeys(obj, &changed)
+	if rxpks, ok := obj["rxpk"].([]interface{}); ok {
+		for _, rxpk := range rxpks {
+			if rxpk, ok := rxpk.(map[string]interface{}); ok {
+				normalizeRxpk(rxpk, &changed)
+			}
+		}
+	}
+	if stat, ok := obj["stat"].(map[string]interface{}); ok {
+		for k, v := range statFields {
+			if _, ok := stat[k]; !ok {
+				stat[k] = v
+				changed = true
+			}
+		}
+		if _, ok := stat["time"]; !ok {
+			stat["time"] = time.Now().UTC().Format("2006-01-02 15:04:05 GMT")
+			changed = true
+		}
+	}
+	if !changed {
+		return payload, false, nil
+	}
+	data, err := json.Marshal(obj)
+	return data, true, err
+}
+
+// lowerKeys returns the object with its keys in lower case, and the nested objects of "rxpk" and
+// "stat" in place.
+func lowerKeys(obj map[string]interface{}, changed *bool) map[string]interface{} {
+	for k, v := range obj {
+		if l := strings.ToLower(k); l != k {
+			delete(obj, k)
+			obj[l] = v
+			*changed = true
+		}
+	}
+	if rxpks, ok := obj["rxpk"].([]interface{}); ok {
+		for i, rxpk := range rxpks {
+			if rxpk, ok := rxpk.(map[string]interface{}); ok {
+				rxpks[i] = lowerKeys(rxpk, changed)
+			}
+		}
+	}
+	if stat, ok := obj["stat"].(map[string]interface{}); ok {
+		obj["stat"] = lowerKeys(stat, changed)
+	}
+	return obj
+}
+
+// normalizeRxpk fills in the missing fields of a "rxpk" object and fixes the types of the others.
+// Forwarders that leave "stat" out only forward the frames with a valid CRC.
+func normalizeRxpk(rxpk map[string]interface{}, changed *bool) {
+	for _, k := range rxpkNumbers {
+		if s, ok := rxpk[k].(string); ok {
+			if n := json.Number(strings.TrimSpace(s)); isNumber(n) {
+				rxpk[k] = n
+				*changed = true
+			}
+		}
+	}
+	set := func(k string, v interface{}) {
+		if _, ok := rxpk[k]; !ok {
+			rxpk[k] = v
+			*changed = true
+		}
+	}
+	set("chan", 0)
+	set("rfch", 0)
+	set("stat", 1)
+	set("modu", "LORA")
+	if s, ok := rxpk["modu"].(string); ok && s != strings.ToUpper(s) {
+		rxpk["modu"] = strings.ToUpper(s)
+		*changed = true
+	}
+	if rxpk["modu"] == "LORA" {
+		set("codr", "4/5")
+		if s, ok := rxpk["datr"].(string); ok && s != strings.ToUpper(s) {
+			rxpk["datr"] = strings.ToUpper(s)
+			*changed = true
+		}
+	}
+	if s, ok := rxpk["data"].(string); ok {
+		if data, err := base64.StdEncoding.DecodeString(s); err == nil {
+			set("size", len(data))
+		}
+	}
+}
+
+func isNumber(n json.Number) bool {
+	_, err := n.Float64()
+	return err == nil
+}
@@ -0,0 +1,70 @@
+// Package capture writes received packets to pcap files with LoRaTap headers,
+// which Wireshark decodes down to the LoRaWAN MAC layer.
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// LinkTypeLoRaTap is the pcap link type of LoRaTap.
+const LinkTypeLoRaTap = 270
+
+// loraTapLength is the size of a version 0 LoRaTap header.
+const loraTapLength = 15
+
+// Writer writes a pcap file.
+type Writer struct {
+	w io.Writer
+	// SyncWord is written to the LoRaTap header of each packet.
+	SyncWord byte
+}
+
+// NewWriter writes the pcap file header to w and returns a Writer for the packets.
+func NewWriter(w io.Writer) (*Writer, error) {
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4) // magic, microsecond timestamps
+	binary.LittleEndian.PutUint16(hdr[4:], 2)          // version 2.4
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535) // snaplen
+	binary.LittleEndian.PutUint32(hdr[20:], LinkTypeLoRaTap)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, SyncWord: 0x34}, nil
+}
+
+// WritePacket writes the packet received at t.
+func (w *Writer) WritePacket(pkt *lora.RxPacket, t time.Time) error {
+	n := loraTapLength + len(pkt.Data)
+	buf := make([]byte, 16+n)
+	binary.LittleEndian.PutUint32(buf[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(n))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(n))
+
+	tap := buf[16:]
+	tap[0] = 0 // version
+	binary.BigEndian.PutUint16(tap[2:], loraTapLength)
+	binary.BigEndian.PutUint32(tap[4:], uint32(pkt.Freq))
+	tap[8] = byte(pkt.LoRaBW.Hz() / 125000) // in 125 kHz steps
+	tap[9] = byte(pkt.Datarate)
+	rssi := byte(clamp(math.Round(float64(pkt.RSSI))+139, 0, 255))
+	tap[10] = rssi // packet RSSI
+	tap[11] = rssi // max RSSI
+	tap[12] = rssi // current RSSI
+	tap[13] = byte(int8(clamp(math.Round(float64(pkt.LoRaSNR)*4), -128, 127)))
+	tap[14] = w.SyncWord
+	copy(tap[loraTapLength:], pkt.Data)
+
+	_, err := w.w.Write(buf)
+	return err
+}
+
+func clamp(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, v))
+}
@@ -0,0 +1,67 @@
+// Command compactdecode prints the CBOR batches of the "cbor" webhook encoding (see package
+// compact) as the JSON bodies of the "json" encoding, one per line.
+//
+// It reads the files given as arguments, or stdin, each with one or more batches.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/Waziup/single_chan_pkt_fwd/compact"
+	"github.com/Waziup/single_chan_pkt_fwd/webhook"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: compactdecode [file ...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		data, err := ioutil.ReadAll(os.Stdin)
+		must(err)
+		decode("stdin", data)
+		return
+	}
+	for _, path := range flag.Args() {
+		data, err := ioutil.ReadFile(path)
+		must(err)
+		decode(path, data)
+	}
+}
+
+func decode(name string, data []byte) {
+	enc := json.NewEncoder(os.Stdout)
+	for n := 0; len(data) != 0; n++ {
+		b, rest, err := compact.Unmarshal(data)
+		if err != nil {
+			fail("%s: batch %d: %v", name, n, err)
+		}
+		data = rest
+		out := webhook.Batch{GatewayID: fmt.Sprintf("%016X", b.GatewayID)}
+		for i, pkt := range b.Packets {
+			rxpk, err := json.Marshal(pkt)
+			if err != nil {
+				fail("%s: batch %d: uplink %d: %v", name, n, i, err)
+			}
+			out.RxPackets = append(out.RxPackets, rxpk)
+		}
+		must(enc.Encode(&out))
+	}
+}
+
+func must(err error) {
+	if err != nil {
+		fail("%v", err)
+	}
+}
+
+func fail(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "compactdecode: "+format+"\n", v...)
+	os.Exit(1)
+}
@@ -0,0 +1,63 @@
+// Command confsign creates the Ed25519 key pair for "remote_conf" and signs configs with it.
+//
+// It reads a config from stdin and writes the base64 signature to stdout, to be served in the
+// X-Signature header of the config. The config must have a "version" higher than the last one.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/Waziup/single_chan_pkt_fwd/remoteconf"
+)
+
+func main() {
+	keyFile := flag.String("key", "fleet.key", "private key file")
+	genKey := flag.Bool("genkey", false, "write a new private key to the key file and print the public key")
+	flag.Parse()
+
+	if *genKey {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			fail("%v", err)
+		}
+		f, err := os.OpenFile(*keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+		if err != nil {
+			fail("%v", err)
+		}
+		fmt.Fprintln(f, hex.EncodeToString(priv.Seed()))
+		if err := f.Close(); err != nil {
+			fail("%v", err)
+		}
+		fmt.Println(hex.EncodeToString(pub))
+		return
+	}
+
+	data, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		fail("%v", err)
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		fail("%s: not an Ed25519 key", *keyFile)
+	}
+	in, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fail("%v", err)
+	}
+	if _, err := remoteconf.Version(in); err != nil {
+		fail("%v", err)
+	}
+	fmt.Println(remoteconf.Sign(in, ed25519.NewKeyFromSeed(seed)))
+}
+
+func fail(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "confsign: "+format+"\n", v...)
+	os.Exit(1)
+}
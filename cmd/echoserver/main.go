@@ -0,0 +1,53 @@
+// Command echoserver is a minimal network server for bring-up: it acknowledges everything
+// the forwarder sends, prints the uplinks and can send each uplink back as downlink.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/internal/testserver"
+)
+
+func main() {
+	log.SetFlags(log.Ltime)
+
+	addr := flag.String("addr", ":1680", "UDP address to listen on")
+	echo := flag.Bool("echo", false, "send each uplink back as downlink")
+	delay := flag.Duration("delay", time.Second, "echo delay after the uplink (RX1)")
+	power := flag.Uint("power", 14, "echo output power in dBm")
+	verbose := flag.Bool("v", false, "log all protocol messages")
+	flag.Parse()
+
+	s := testserver.New()
+	if *verbose {
+		s.Logger = log.New(os.Stdout, "", log.Ltime)
+	}
+	if *echo {
+		s.Echo = testserver.EchoDownlink(*delay, uint8(*power))
+	}
+	if err := s.Listen(*addr); err != nil {
+		fmt.Fprintf(os.Stderr, "echoserver: %v\n", err)
+		os.Exit(1)
+	}
+	log.Printf("listening on %s", s.Addr())
+
+	for {
+		select {
+		case up := <-s.Uplinks:
+			log.Printf("gateway %016X: %s, RSSI %.0f dBm", up.GatewayID, up.RxPacket, up.RxPacket.RSSI)
+		case stat := <-s.Stats:
+			log.Printf("status: %d received, %d forwarded, %d downlinks", stat.Rxnb, stat.Rxfw, stat.Dwnb)
+		case ack := <-s.TxAcks:
+			if ack.Error > fwd.NoError {
+				log.Printf("gateway %016X: tx ack %s: %v", ack.GatewayID, ack.Token, ack.Error)
+			} else {
+				log.Printf("gateway %016X: tx ack %s", ack.GatewayID, ack.Token)
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Command inject reads uplinks as rxpk JSON lines from stdin and feeds them into a running
+// forwarder with the "inject" admin action of its API, as if its radios received them, for
+// test scenarios in shell scripts:
+//
+//	echo '{"freq":868.1,"stat":1,"modu":"LORA","datr":"SF7BW125","codr":"4/5","rssi":-57,"lsnr":9.5,"data":"QNobASYAAQABAQIDBA=="}' | inject
+//
+// Empty lines and lines starting with # are skipped.
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+func main() {
+	apiURL := flag.String("api", "http://127.0.0.1:8080", "URL of the API of the forwarder")
+	token := flag.String("token", "", "admin token with the inject scope, $ADMIN_TOKEN if not set")
+	cacert := flag.String("cacert", "", "PEM certificate to trust for an https API, as its self-signed one")
+	interval := flag.Duration("interval", 0, "wait between the uplinks")
+	flag.Parse()
+
+	if *token == "" {
+		*token = os.Getenv("ADMIN_TOKEN")
+	}
+	if *token == "" {
+		fail("no token, set -token or $ADMIN_TOKEN")
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	if *cacert != "" {
+		pem, err := ioutil.ReadFile(*cacert)
+		if err != nil {
+			fail("-cacert: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			fail("-cacert: no certificate in %s", *cacert)
+		}
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	endpoint := strings.TrimSuffix(*apiURL, "/") + "/api/admin/inject"
+
+	var n, line int
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line++
+		rxpk := strings.TrimSpace(scanner.Text())
+		if rxpk == "" || strings.HasPrefix(rxpk, "#") {
+			continue
+		}
+		// checked here too, for the line number
+		var pkt lora.RxPacket
+		if err := json.Unmarshal([]byte(rxpk), &pkt); err != nil {
+			fail("line %d: %v", line, err)
+		}
+		if n != 0 && *interval > 0 {
+			time.Sleep(*interval)
+		}
+		if err := inject(client, endpoint, *token, rxpk); err != nil {
+			fail("line %d: %v", line, err)
+		}
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		fail("stdin: %v", err)
+	}
+	fmt.Printf("%d uplinks injected\n", n)
+}
+
+// injectRetries is how many times an uplink is sent again while the forwarder is busy, as when
+// its queue of injected uplinks is full, waiting injectRetryWait each time.
+const (
+	injectRetries   = 20
+	injectRetryWait = 500 * time.Millisecond
+)
+
+// inject posts an rxpk to the inject action, again while the forwarder is busy.
+func inject(client *http.Client, endpoint, token, rxpk string) error {
+	for i := 0; ; i++ {
+		err := post(client, endpoint, token, rxpk)
+		if err != errBusy || i == injectRetries {
+			return err
+		}
+		time.Sleep(injectRetryWait)
+	}
+}
+
+var errBusy = errors.New("the forwarder is busy")
+
+// post posts an rxpk to the inject action once.
+func post(client *http.Client, endpoint, token, rxpk string) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(url.Values{"rxpk": {rxpk}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return errBusy
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func fail(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "inject: "+format+"\n", v...)
+	os.Exit(1)
+}
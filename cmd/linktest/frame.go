@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Test frames are proprietary LoRaWAN frames, so network servers ignore them:
+//
+//	MHDR (0xE0) | "LT" | kind | seq (4) | ping time (8) [| RSSI (2) | SNR (1)]
+//
+// A pong echoes seq and ping time, and adds RSSI (dBm * 10) and SNR (dB * 4) of the ping.
+const mhdrProprietary = 0xe0
+
+const (
+	kindPing = 'I'
+	kindPong = 'O'
+)
+
+var magic = []byte("LT")
+
+var errNoTestFrame = errors.New("no link test frame")
+
+type frame struct {
+	kind     byte
+	seq      uint32
+	pingTime int64 // UnixNano of the ping at the pinging side
+
+	// pong only
+	rssi float32
+	snr  float32
+}
+
+func (f *frame) marshal() []byte {
+	b := make([]byte, 16, 19)
+	b[0] = mhdrProprietary
+	copy(b[1:], magic)
+	b[3] = f.kind
+	binary.BigEndian.PutUint32(b[4:], f.seq)
+	binary.BigEndian.PutUint64(b[8:], uint64(f.pingTime))
+	if f.kind == kindPong {
+		var rssi [2]byte
+		binary.BigEndian.PutUint16(rssi[:], uint16(int16(math.Round(float64(f.rssi)*10))))
+		b = append(b, rssi[0], rssi[1], byte(int8(math.Round(float64(f.snr)*4))))
+	}
+	return b
+}
+
+func (f *frame) unmarshal(b []byte) error {
+	if len(b) < 16 || b[0] != mhdrProprietary || !bytes.Equal(b[1:3], magic) {
+		return errNoTestFrame
+	}
+	f.kind = b[3]
+	f.seq = binary.BigEndian.Uint32(b[4:])
+	f.pingTime = int64(binary.BigEndian.Uint64(b[8:]))
+	switch f.kind {
+	case kindPing:
+		return nil
+	case kindPong:
+		if len(b) < 19 {
+			return errNoTestFrame
+		}
+		f.rssi = float32(int16(binary.BigEndian.Uint16(b[16:]))) / 10
+		f.snr = float32(int8(b[18])) / 4
+		return nil
+	}
+	return errNoTestFrame
+}
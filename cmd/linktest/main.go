@@ -0,0 +1,208 @@
+// Command linktest characterizes a radio link between two gateways before deploying devices.
+// One side runs "-role pong" and answers the test frames that the "-role ping" side sends,
+// which reports round trip time, packet loss and RSSI/SNR in both directions.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/SX127X"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+
+	"periph.io/x/host/v3"
+	_ "periph.io/x/periph/host/rpi"
+)
+
+// pongDelay gives the pinging side time to switch from TX to RX.
+const pongDelay = 50 * time.Millisecond
+
+var radio *SX127X.Chip
+var cfg *lora.Config
+var power uint8
+
+func main() {
+	log.SetFlags(0)
+
+	role := flag.String("role", "", "ping or pong")
+	freq := flag.String("freq", "868.1", "frequency in MHz")
+	sf := flag.String("sf", "SF7", "spreading factor, SF7 to SF12")
+	bw := flag.String("bw", "BW125", "bandwidth, as in BW125 or 125000")
+	cr := flag.String("cr", "4/5", "coderate, 4/5 to 4/8")
+	pwr := flag.Uint("power", 14, "output power in dBm")
+	count := flag.Int("count", 20, "number of pings, 0 to ping forever")
+	interval := flag.Duration("interval", 2*time.Second, "time between pings")
+	timeout := flag.Duration("timeout", 3*time.Second, "time to wait for a pong")
+	spiDevice := flag.String("spi", "/dev/spidev0.1", "SPI device of the radio")
+	pinRst := flag.String("rst", "GPIO23", "reset pin of the radio")
+	flag.Parse()
+
+	cfg = &lora.Config{
+		Modulation: lora.ModulationLoRa,
+		SpiDevice:  *spiDevice,
+		PinRst:     *pinRst,
+	}
+	var err error
+	if cfg.Freq, err = lora.ParseFrequency(*freq); err != nil {
+		fail("-freq: %v", err)
+	}
+	if cfg.Datarate, err = lora.ParseSpreadingFactor(*sf); err != nil {
+		fail("-sf: %v", err)
+	}
+	if cfg.LoRaBW, err = lora.ParseBandwidth(*bw); err != nil {
+		fail("-bw: %v", err)
+	}
+	if cfg.LoRaCR, err = lora.ParseCoderate(*cr); err != nil {
+		fail("-cr: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		fail("%v", err)
+	}
+	if *pwr > lora.MaxPower {
+		fail("-power: max %d dBm", lora.MaxPower)
+	}
+	power = uint8(*pwr)
+	if *role != "ping" && *role != "pong" {
+		fail("-role must be ping or pong")
+	}
+
+	host.Init()
+	radio, err = SX127X.Discover(cfg)
+	if err != nil {
+		fail("can not activate radio: %v", err)
+	}
+	defer radio.Close()
+	log.Printf("radio %s on %s, %s", radio.Name(), cfg.Freq, lora.Datarate{SpreadingFactor: cfg.Datarate, Bandwidth: cfg.LoRaBW})
+
+	if *role == "ping" {
+		ping(*count, *interval, *timeout)
+	} else {
+		pong()
+	}
+}
+
+// ping sends count pings and prints a line per pong and a summary.
+func ping(count int, interval, timeout time.Duration) {
+	var sent, received int
+	var rtt time.Duration
+	var rssiUp, snrUp, rssiDown, snrDown float32
+
+	for seq := uint32(1); count == 0 || int(seq) <= count; seq++ {
+		start := time.Now()
+		if err := send(context.Background(), &frame{kind: kindPing, seq: seq, pingTime: start.UnixNano()}); err != nil {
+			log.Printf("ping %d: can not send: %v", seq, err)
+			continue
+		}
+		sent++
+
+		ctx, cancel := context.WithDeadline(context.Background(), start.Add(timeout))
+		pkt, f := receive(ctx, func(f *frame) bool {
+			return f.kind == kindPong && f.seq == seq
+		})
+		cancel()
+		if pkt == nil {
+			log.Printf("ping %d: timeout", seq)
+		} else {
+			d := time.Since(time.Unix(0, f.pingTime))
+			log.Printf("ping %d: rtt %s, there: RSSI %.1f dBm SNR %.1f dB, back: RSSI %.0f dBm SNR %.1f dB",
+				seq, d.Round(time.Millisecond), f.rssi, f.snr, pkt.RSSI, pkt.LoRaSNR)
+			received++
+			rtt += d
+			rssiUp += f.rssi
+			snrUp += f.snr
+			rssiDown += pkt.RSSI
+			snrDown += pkt.LoRaSNR
+			pkt.Release()
+		}
+		time.Sleep(time.Until(start.Add(interval)))
+	}
+
+	log.Printf("%d pings sent, %d pongs received, %.1f%% loss", sent, received, 100*float64(sent-received)/float64(sent))
+	if received != 0 {
+		n := float32(received)
+		log.Printf("avg rtt %s, there: RSSI %.1f dBm SNR %.1f dB, back: RSSI %.1f dBm SNR %.1f dB",
+			(rtt / time.Duration(received)).Round(time.Millisecond), rssiUp/n, snrUp/n, rssiDown/n, snrDown/n)
+	}
+}
+
+// pong answers pings forever.
+func pong() {
+	log.Printf("waiting for pings ...")
+	for {
+		pkt, f := receive(context.Background(), func(f *frame) bool {
+			return f.kind == kindPing
+		})
+		log.Printf("ping %d: RSSI %.0f dBm SNR %.1f dB", f.seq, pkt.RSSI, pkt.LoRaSNR)
+		reply := &frame{kind: kindPong, seq: f.seq, pingTime: f.pingTime, rssi: pkt.RSSI, snr: pkt.LoRaSNR}
+		pkt.Release()
+		time.Sleep(pongDelay)
+		if err := send(context.Background(), reply); err != nil {
+			log.Printf("pong %d: can not send: %v", f.seq, err)
+		}
+	}
+}
+
+func send(ctx context.Context, f *frame) error {
+	return radio.Send(ctx, &lora.TxPacket{
+		Modulation: lora.ModulationLoRa,
+		Freq:       cfg.Freq,
+		Datarate:   cfg.Datarate,
+		LoRaBW:     cfg.LoRaBW,
+		LoRaCR:     cfg.LoRaCR,
+		Power:      power,
+		Data:       f.marshal(),
+	})
+}
+
+// receive waits for a test frame that matches, until ctx is done.
+// Other packets are dropped. It returns a nil packet on timeout.
+func receive(ctx context.Context, match func(f *frame) bool) (*lora.RxPacket, *frame) {
+	if err := radio.Receive(ctx, cfg); err != nil {
+		fail("can not receive: %v", err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-time.After(20 * time.Millisecond):
+		}
+		pkts, err := radio.GetPacket(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil
+			}
+			fail("can not receive packets: %v", err)
+		}
+		if pkts == nil {
+			continue
+		}
+		var found *lora.RxPacket
+		var f frame
+		for _, pkt := range pkts {
+			if found == nil && pkt.StatCRC != -1 && f.unmarshal(pkt.Data) == nil && match(&f) {
+				found = pkt
+				continue
+			}
+			pkt.Release()
+		}
+		if found != nil {
+			return found, &f
+		}
+		// the radio leaves RX mode after a packet
+		if err := radio.Receive(ctx, cfg); err != nil {
+			if ctx.Err() != nil {
+				return nil, nil
+			}
+			fail("can not receive: %v", err)
+		}
+	}
+}
+
+func fail(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "linktest: "+format+"\n", v...)
+	os.Exit(1)
+}
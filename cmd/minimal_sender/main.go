@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"time"
 
@@ -34,7 +35,7 @@ func main() {
 
 	msg := []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7}
 	start := time.Now()
-	must("Send:", radio.Send(&lora.TxPacket{
+	must("Send:", radio.Send(context.Background(), &lora.TxPacket{
 		InvertPolar: true,
 		Modulation:  "LORA",
 		LoRaCR:      5,
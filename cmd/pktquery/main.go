@@ -0,0 +1,104 @@
+// Command pktquery prints the packets of a local packet store (see "store_conf"),
+// selected by DevAddr, time range or spreading factor.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+	"github.com/Waziup/single_chan_pkt_fwd/store"
+)
+
+func main() {
+	path := flag.String("db", "packets.jsonl", "packet store file")
+	dev := flag.String("dev", "", "DevAddr, as in 26011BDA")
+	from := flag.String("from", "", "first time, RFC 3339 or a duration ago as in 2h")
+	to := flag.String("to", "", "end time, RFC 3339 or a duration ago as in 30m")
+	sf := flag.String("sf", "", "spreading factor, as in SF7 or 7")
+	jsonOut := flag.Bool("json", false, "print JSON lines")
+	flag.Parse()
+
+	var q store.Query
+	var err error
+	if *dev != "" {
+		q.DevAddr = new(lorawan.DevAddr)
+		must(q.DevAddr.UnmarshalText([]byte(*dev)))
+	}
+	if q.From, err = parseTime(*from); err != nil {
+		fail("-from: %v", err)
+	}
+	if q.To, err = parseTime(*to); err != nil {
+		fail("-to: %v", err)
+	}
+	if *sf != "" {
+		if q.SF, err = lora.ParseSpreadingFactor(*sf); err != nil {
+			fail("-sf: %v", err)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if !*jsonOut {
+		fmt.Fprintln(w, "TIME\tDEVADDR\tFCNT\tFREQ\tDATR\tRSSI\tSNR\tSIZE")
+	}
+	var n int
+	var rssi, snr float64
+	err = store.Scan(*path, &q, func(r *store.Record) error {
+		n++
+		rssi += float64(r.RSSI)
+		snr += float64(r.SNR)
+		if *jsonOut {
+			return enc.Encode(r)
+		}
+		devAddr, fCnt, datr := "-", "-", "FSK"
+		if r.DevAddr != nil {
+			devAddr = r.DevAddr.String()
+			fCnt = fmt.Sprint(*r.FCnt)
+		}
+		if r.Modulation == lora.ModulationLoRa {
+			datr = lora.Datarate{SpreadingFactor: r.SF, Bandwidth: r.BW}.String()
+		}
+		_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%.0f\t%.1f\t%d\n",
+			r.Time.Local().Format("2006-01-02 15:04:05"), devAddr, fCnt, r.Freq, datr, r.RSSI, r.SNR, r.Size)
+		return err
+	})
+	if err != nil {
+		fail("%v", err)
+	}
+	if !*jsonOut {
+		w.Flush()
+		if n != 0 {
+			fmt.Printf("%d packets, avg RSSI %.1f dBm, avg SNR %.1f dB\n", n, rssi/float64(n), snr/float64(n))
+		} else {
+			fmt.Println("no packets")
+		}
+	}
+}
+
+// parseTime parses an RFC 3339 time or a duration before now.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func must(err error) {
+	if err != nil {
+		fail("%v", err)
+	}
+}
+
+func fail(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "pktquery: "+format+"\n", v...)
+	os.Exit(1)
+}
@@ -0,0 +1,71 @@
+// Command secrets creates the key and the encrypted secrets file for "secrets_conf".
+//
+// It reads the secrets as a JSON object of names and values from stdin, as in
+// {"mqtt_password":"..."}, and writes the encrypted file to stdout.
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/Waziup/single_chan_pkt_fwd/secrets"
+)
+
+func main() {
+	keyFile := flag.String("key", "secrets.key", "key file")
+	genKey := flag.Bool("genkey", false, "write a new key to the key file")
+	decrypt := flag.Bool("d", false, "decrypt the secrets file from stdin")
+	flag.Parse()
+
+	if *genKey {
+		key, err := secrets.NewKey()
+		if err != nil {
+			fail("%v", err)
+		}
+		f, err := os.OpenFile(*keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+		if err != nil {
+			fail("%v", err)
+		}
+		fmt.Fprintln(f, hex.EncodeToString(key))
+		if err := f.Close(); err != nil {
+			fail("%v", err)
+		}
+		return
+	}
+
+	key, err := secrets.ReadKey(*keyFile)
+	if err != nil {
+		fail("%v", err)
+	}
+	in, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fail("%v", err)
+	}
+	if *decrypt {
+		s, err := secrets.Unseal(in, key)
+		if err != nil {
+			fail("%v", err)
+		}
+		out, _ := json.MarshalIndent(s, "", "    ")
+		fmt.Println(string(out))
+		return
+	}
+	var s map[string]string
+	if err := json.Unmarshal(in, &s); err != nil {
+		fail("stdin: %v", err)
+	}
+	out, err := secrets.Seal(s, key)
+	if err != nil {
+		fail("%v", err)
+	}
+	os.Stdout.Write(out)
+}
+
+func fail(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "secrets: "+format+"\n", v...)
+	os.Exit(1)
+}
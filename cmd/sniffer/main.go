@@ -0,0 +1,196 @@
+// Command sniffer receives packets on one channel and prints them as a table or as
+// JSON lines, optionally writing a pcap file. For field surveys, no server needed.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/SX127X"
+	"github.com/Waziup/single_chan_pkt_fwd/capture"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+
+	"periph.io/x/host/v3"
+	_ "periph.io/x/periph/host/rpi"
+)
+
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorCyan   = "\x1b[36m"
+)
+
+// Line is a packet as printed with -json.
+type Line struct {
+	Time    time.Time        `json:"time"`
+	RxPk    *lora.RxPacket   `json:"rxpk"`
+	MType   string           `json:"mtype,omitempty"`
+	DevAddr *lorawan.DevAddr `json:"dev_addr,omitempty"`
+	FCnt    *uint16          `json:"fcnt,omitempty"`
+	FPort   *uint8           `json:"fport,omitempty"`
+}
+
+var color = true
+
+func main() {
+	log.SetFlags(0)
+
+	freq := flag.String("freq", "868.1", "frequency in MHz")
+	sf := flag.String("sf", "SF7", "spreading factor, SF7 to SF12")
+	bw := flag.String("bw", "BW125", "bandwidth, as in BW125 or 125000")
+	cr := flag.String("cr", "4/5", "coderate, 4/5 to 4/8")
+	public := flag.Bool("public", true, "use the LoRaWAN public sync word")
+	spiDevice := flag.String("spi", "/dev/spidev0.1", "SPI device of the radio")
+	pinRst := flag.String("rst", "GPIO23", "reset pin of the radio")
+	jsonOut := flag.Bool("json", false, "print JSON lines instead of a table")
+	noColor := flag.Bool("no-color", false, "print the table without colors")
+	pcapFile := flag.String("pcap", "", "also write the packets to this pcap file")
+	flag.Parse()
+
+	cfg := &lora.Config{
+		Lorawan_public: *public,
+		Modulation:     lora.ModulationLoRa,
+		SpiDevice:      *spiDevice,
+		PinRst:         *pinRst,
+	}
+	var err error
+	if cfg.Freq, err = lora.ParseFrequency(*freq); err != nil {
+		fail("-freq: %v", err)
+	}
+	if cfg.Datarate, err = lora.ParseSpreadingFactor(*sf); err != nil {
+		fail("-sf: %v", err)
+	}
+	if cfg.LoRaBW, err = lora.ParseBandwidth(*bw); err != nil {
+		fail("-bw: %v", err)
+	}
+	if cfg.LoRaCR, err = lora.ParseCoderate(*cr); err != nil {
+		fail("-cr: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		fail("%v", err)
+	}
+	color = !*noColor
+
+	var pcap *capture.Writer
+	if *pcapFile != "" {
+		f, err := os.Create(*pcapFile)
+		if err != nil {
+			fail("%v", err)
+		}
+		defer f.Close()
+		// one write per packet, so the file can be followed while capturing
+		if pcap, err = capture.NewWriter(f); err != nil {
+			fail("%v", err)
+		}
+		if !*public {
+			pcap.SyncWord = SX127X.PrivateSyncWord
+		}
+	}
+
+	host.Init()
+	radio, err := SX127X.Discover(cfg)
+	if err != nil {
+		fail("can not activate radio: %v", err)
+	}
+	defer radio.Close()
+	log.Printf("radio %s listening on %s, %s, %s", radio.Name(), cfg.Freq, lora.Datarate{SpreadingFactor: cfg.Datarate, Bandwidth: cfg.LoRaBW}, cfg.LoRaCR)
+
+	ctx := context.Background()
+	enc := json.NewEncoder(os.Stdout)
+	if !*jsonOut {
+		fmt.Printf("%-8s  %-21s  %6s  %5s  %-8s  %5s  %5s  %4s\n", "TIME", "MTYPE", "RSSI", "SNR", "DEVADDR", "FCNT", "FPORT", "SIZE")
+	}
+	for {
+		if err := radio.Receive(ctx, cfg); err != nil {
+			fail("can not receive: %v", err)
+		}
+		var pkts []*lora.RxPacket
+		for pkts == nil {
+			time.Sleep(100 * time.Millisecond)
+			if pkts, err = radio.GetPacket(ctx); err != nil {
+				fail("can not receive packets: %v", err)
+			}
+		}
+		now := time.Now()
+		for _, pkt := range pkts {
+			line := newLine(pkt, now)
+			if *jsonOut {
+				enc.Encode(line)
+			} else {
+				printRow(line)
+			}
+			if pcap != nil {
+				if err := pcap.WritePacket(pkt, now); err != nil {
+					fail("can not write pcap: %v", err)
+				}
+			}
+			pkt.Release()
+		}
+	}
+}
+
+func newLine(pkt *lora.RxPacket, t time.Time) *Line {
+	line := &Line{Time: t, RxPk: pkt}
+	if f, err := lorawan.Decode(pkt.Data); err == nil {
+		line.MType = f.MType().String()
+		if f.IsData() {
+			line.DevAddr = &f.DevAddr
+			line.FCnt = &f.FCnt
+			line.FPort = f.FPort
+		}
+	}
+	return line
+}
+
+func printRow(line *Line) {
+	pkt := line.RxPk
+	mType, devAddr, fCnt, fPort := "-", "-", "-", "-"
+	if line.MType != "" {
+		mType = line.MType
+	}
+	if line.DevAddr != nil {
+		devAddr = line.DevAddr.String()
+		fCnt = fmt.Sprint(*line.FCnt)
+	}
+	if line.FPort != nil {
+		fPort = fmt.Sprint(*line.FPort)
+	}
+	rssiColor := colorGreen
+	switch {
+	case pkt.RSSI < -110:
+		rssiColor = colorRed
+	case pkt.RSSI < -90:
+		rssiColor = colorYellow
+	}
+	if pkt.StatCRC == -1 {
+		mType = "CRC error"
+		rssiColor = colorRed
+	}
+	fmt.Printf("%s  %s  %s  %5.1f  %s  %5s  %5s  %4d\n",
+		line.Time.Format("15:04:05"),
+		paint(colorCyan, fmt.Sprintf("%-21s", mType)),
+		paint(rssiColor, fmt.Sprintf("%6.0f", pkt.RSSI)),
+		pkt.LoRaSNR,
+		fmt.Sprintf("%-8s", devAddr),
+		fCnt, fPort, len(pkt.Data))
+}
+
+func paint(c, s string) string {
+	if !color {
+		return s
+	}
+	return c + s + colorReset
+}
+
+func fail(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "sniffer: "+format+"\n", v...)
+	os.Exit(1)
+}
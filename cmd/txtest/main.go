@@ -0,0 +1,119 @@
+// Command txtest sends test packets through the radio, for antenna and range tests
+// without any server involved.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/SX127X"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+
+	"periph.io/x/host/v3"
+	_ "periph.io/x/periph/host/rpi"
+)
+
+func main() {
+	log.SetFlags(0)
+
+	freq := flag.String("freq", "868.1", "frequency in MHz")
+	sf := flag.String("sf", "SF7", "spreading factor, SF7 to SF12")
+	bw := flag.String("bw", "BW125", "bandwidth, as in BW125 or 125000")
+	cr := flag.String("cr", "4/5", "coderate, 4/5 to 4/8")
+	power := flag.Uint("power", 14, "output power in dBm")
+	regionName := flag.String("region", "", "check frequency and power against a region, as in EU868")
+	payloadHex := flag.String("hex", "", "payload, hex encoded")
+	payloadBase64 := flag.String("base64", "", "payload, base64 encoded")
+	count := flag.Int("count", 1, "number of packets, 0 to send forever")
+	interval := flag.Duration("interval", 5*time.Second, "time between packets")
+	invertIQ := flag.Bool("iq", false, "invert IQ, as for LoRaWAN downlinks")
+	public := flag.Bool("public", true, "use the LoRaWAN public sync word")
+	spiDevice := flag.String("spi", "/dev/spidev0.1", "SPI device of the radio")
+	pinRst := flag.String("rst", "GPIO23", "reset pin of the radio")
+	verbose := flag.Bool("v", false, "log radio registers")
+	flag.Parse()
+
+	pkt := &lora.TxPacket{
+		Immediate:   true,
+		Modulation:  lora.ModulationLoRa,
+		Power:       uint8(*power),
+		InvertPolar: *invertIQ,
+		Data:        []byte("txtest"),
+	}
+	var err error
+	if pkt.Freq, err = lora.ParseFrequency(*freq); err != nil {
+		fail("-freq: %v", err)
+	}
+	if pkt.Datarate, err = lora.ParseSpreadingFactor(*sf); err != nil {
+		fail("-sf: %v", err)
+	}
+	if pkt.LoRaBW, err = lora.ParseBandwidth(*bw); err != nil {
+		fail("-bw: %v", err)
+	}
+	if pkt.LoRaCR, err = lora.ParseCoderate(*cr); err != nil {
+		fail("-cr: %v", err)
+	}
+	switch {
+	case *payloadHex != "" && *payloadBase64 != "":
+		fail("use either -hex or -base64")
+	case *payloadHex != "":
+		if pkt.Data, err = hex.DecodeString(*payloadHex); err != nil {
+			fail("-hex: %v", err)
+		}
+	case *payloadBase64 != "":
+		if pkt.Data, err = base64.StdEncoding.DecodeString(*payloadBase64); err != nil {
+			fail("-base64: %v", err)
+		}
+	}
+
+	var region *lora.Region
+	if *regionName != "" {
+		if region = lora.Regions[*regionName]; region == nil {
+			fail("-region: unknown region %q", *regionName)
+		}
+	}
+	if err := pkt.Validate(region); err != nil {
+		fail("invalid packet: %v", err)
+	}
+	if pkt.ClampPower(region) {
+		log.Printf("-power: lowered to %d dBm, the max at %s", pkt.Power, pkt.Freq)
+	}
+
+	host.Init()
+	if *verbose {
+		SX127X.LogLevel = SX127X.LogLevelDebug
+	}
+	radio, err := SX127X.Discover(&lora.Config{
+		Lorawan_public: *public,
+		SpiDevice:      *spiDevice,
+		PinRst:         *pinRst,
+	})
+	if err != nil {
+		fail("can not activate radio: %v", err)
+	}
+	defer radio.Close()
+	log.Printf("radio %s activated", radio.Name())
+
+	for i := 1; *count == 0 || i <= *count; i++ {
+		if i != 1 {
+			time.Sleep(*interval)
+		}
+		start := time.Now()
+		if err := radio.Send(context.Background(), pkt); err != nil {
+			log.Printf("tx %d: can not send: %v", i, err)
+			continue
+		}
+		log.Printf("tx %d: %s (%s)", i, pkt, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+func fail(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "txtest: "+format+"\n", v...)
+	os.Exit(1)
+}
@@ -0,0 +1,186 @@
+package compact
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// The major types of CBOR (RFC 8949) that the batches use.
+const (
+	majorUint   = 0
+	majorNegint = 1
+	majorBytes  = 2
+	majorText   = 3
+	majorArray  = 4
+	majorMap    = 5
+	majorSimple = 7
+)
+
+// The simple values false and true.
+const (
+	simpleFalse = 20
+	simpleTrue  = 21
+)
+
+// encoder writes CBOR items in their shortest form.
+type encoder []byte
+
+func (e *encoder) head(major byte, n uint64) {
+	switch {
+	case n < 24:
+		*e = append(*e, major<<5|byte(n))
+	case n <= 0xff:
+		*e = append(*e, major<<5|24, byte(n))
+	case n <= 0xffff:
+		*e = append(*e, major<<5|25, byte(n>>8), byte(n))
+	case n <= 0xffffffff:
+		*e = append(*e, major<<5|26, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32((*e)[len(*e)-4:], uint32(n))
+	default:
+		*e = append(*e, major<<5|27, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64((*e)[len(*e)-8:], n)
+	}
+}
+
+func (e *encoder) uint(v uint64) {
+	e.head(majorUint, v)
+}
+
+func (e *encoder) int(v int64) {
+	if v < 0 {
+		e.head(majorNegint, uint64(-1-v))
+		return
+	}
+	e.head(majorUint, uint64(v))
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		*e = append(*e, majorSimple<<5|simpleTrue)
+	} else {
+		*e = append(*e, majorSimple<<5|simpleFalse)
+	}
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.head(majorBytes, uint64(len(v)))
+	*e = append(*e, v...)
+}
+
+func (e *encoder) text(v string) {
+	e.head(majorText, uint64(len(v)))
+	*e = append(*e, v...)
+}
+
+// textMap writes a map of text to text, in the order of the keys so the encoding is stable.
+func (e *encoder) textMap(m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	e.head(majorMap, uint64(len(keys)))
+	for _, k := range keys {
+		e.text(k)
+		e.text(m[k])
+	}
+}
+
+// errTruncated is returned for items that end before they should.
+var errTruncated = errors.New("truncated item")
+
+// decode reads an item: an uint64, an int64 for negative integers, a []byte, a string, a bool,
+// an []interface{} or a map[interface{}]interface{}. It returns the rest of the data.
+func decode(data []byte) (interface{}, []byte, error) {
+	return decodeDepth(data, 0)
+}
+
+// maxDepth limits the nesting of arrays and maps, so bad data can not exhaust the stack.
+const maxDepth = 16
+
+func decodeDepth(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxDepth {
+		return nil, nil, errors.New("too deeply nested")
+	}
+	if len(data) == 0 {
+		return nil, nil, errTruncated
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, errTruncated
+		}
+		for _, b := range data[:size] {
+			n = n<<8 | uint64(b)
+		}
+		data = data[size:]
+	default:
+		return nil, nil, fmt.Errorf("unsupported additional information %d", info)
+	}
+
+	switch major {
+	case majorUint:
+		return n, data, nil
+	case majorNegint:
+		if n > 1<<63-1 {
+			return nil, nil, errors.New("negative integer out of range")
+		}
+		return -1 - int64(n), data, nil
+	case majorBytes, majorText:
+		if uint64(len(data)) < n {
+			return nil, nil, errTruncated
+		}
+		if major == majorText {
+			return string(data[:n]), data[n:], nil
+		}
+		return append([]byte(nil), data[:n]...), data[n:], nil
+	case majorArray:
+		if uint64(len(data)) < n {
+			return nil, nil, errTruncated
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			var err error
+			if items[i], data, err = decodeDepth(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return items, data, nil
+	case majorMap:
+		if uint64(len(data))/2 < n { // 2*n would overflow
+			return nil, nil, errTruncated
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			k, rest, err := decodeDepth(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case uint64, int64, string:
+			default:
+				return nil, nil, fmt.Errorf("unsupported map key %T", k)
+			}
+			if m[k], data, err = decodeDepth(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return m, data, nil
+	case majorSimple:
+		switch n {
+		case simpleFalse:
+			return false, data, nil
+		case simpleTrue:
+			return true, data, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("unsupported item of major type %d", major)
+}
@@ -0,0 +1,430 @@
+// Package compact encodes batches of uplinks in CBOR (RFC 8949), for gateways on satellite or
+// LTE-M backhauls that pay for each byte. A batch is a fraction of the size of the same uplinks
+// in JSON: the keys are small integers, the payloads raw bytes instead of base64, the times and
+// counters are the deltas to the previous uplink, and fields with their usual value are left
+// out.
+//
+// A batch is a map with the keys:
+//
+//	0: the gateway ID
+//	1: the time of the first uplink with a time, in µs since the Unix epoch
+//	2: the array of the uplinks
+//
+// and each uplink a map with the keys, left out with the value in brackets:
+//
+//	0: the time, in µs after the time of the previous uplink with a time, or of the batch (none)
+//	1: the tmst, as the difference to the tmst of the previous uplink, from 0, modulo 2^32 (0)
+//	2: true for replayed uplinks, which have no tmst (false)
+//	3: the frequency in Hz, as the difference to that of the previous uplink, from 0 (0)
+//	4: the modulation, 1 for FSK and 2 for LR-FHSS (0 for LoRa)
+//	5: the spreading factor of LoRa, or the bit rate of FSK
+//	6: the bandwidth of LoRa, as the code of lora.Bandwidth (8 for 125 kHz)
+//	7: the coding rate of LoRa, 5 for 4/5 to 8 for 4/8 (5)
+//	8: the RSSI in dBm (0)
+//	9: the SNR in tenths of a dB (0)
+//	10: the IF channel (0)
+//	11: the RF chain (0)
+//	12: the CRC status, -1 for failed, 0 for none (1 for OK)
+//	13: the payload
+//	14: the "meta" object, as a map of text (none)
+//	15: the frequency offset in Hz (0)
+//	16: the LR-FHSS datarate, as "M0CW137"
+//	17: the LR-FHSS coding rate, as "2/3"
+//	18: the board metadata, as [brd, aesk] or [brd, aesk, ftime] (none)
+//	19: the gateway location, as [lati, long, alti] with the degrees in 1e-5 (none)
+package compact
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// ContentType is the media type of the batches.
+const ContentType = "application/cbor"
+
+// Batch is a batch of uplinks of a gateway.
+type Batch struct {
+	GatewayID uint64
+	Packets   []*lora.RxPacket
+}
+
+// The keys of the batch.
+const (
+	keyGatewayID = 0
+	keyTime      = 1
+	keyPackets   = 2
+)
+
+// The keys of the uplinks.
+const (
+	keyPktTime = iota
+	keyTmst
+	keyReplayed
+	keyFreq
+	keyModulation
+	keyDatarate
+	keyBandwidth
+	keyCoderate
+	keyRSSI
+	keySNR
+	keyChan
+	keyRFCh
+	keyStat
+	keyData
+	keyMeta
+	keyFreqOffset
+	keyLRFHSS
+	keyLRFHSSCR
+	keyBoard
+	keyLocation
+)
+
+// The modulations of keyModulation.
+const (
+	moduLoRa   = 0
+	moduFSK    = 1
+	moduLRFHSS = 2
+)
+
+// Marshal returns the CBOR of a batch.
+func Marshal(b *Batch) []byte {
+	var e encoder
+	var base *time.Time
+	for _, pkt := range b.Packets {
+		if pkt.Time != nil {
+			base = pkt.Time
+			break
+		}
+	}
+	var prev state
+	if base != nil {
+		e.head(majorMap, 3)
+	} else {
+		e.head(majorMap, 2)
+	}
+	e.uint(keyGatewayID)
+	e.uint(b.GatewayID)
+	if base != nil {
+		e.uint(keyTime)
+		prev.time = base.UnixNano() / 1000
+		e.int(prev.time)
+	}
+	e.uint(keyPackets)
+	e.head(majorArray, uint64(len(b.Packets)))
+	for _, pkt := range b.Packets {
+		marshalPacket(&e, pkt, &prev)
+	}
+	return e
+}
+
+// state is the previous uplink, which the deltas are relative to.
+type state struct {
+	time int64 // in µs since the Unix epoch
+	tmst uint32
+	freq lora.Frequency
+}
+
+// field is a key and a value of an uplink.
+type field struct {
+	key   uint64
+	write func(e *encoder)
+}
+
+func marshalPacket(e *encoder, pkt *lora.RxPacket, prev *state) {
+	var fields []field
+	add := func(key uint64, write func(e *encoder)) {
+		fields = append(fields, field{key, write})
+	}
+	addInt := func(key uint64, v int64) {
+		if v != 0 {
+			add(key, func(e *encoder) { e.int(v) })
+		}
+	}
+
+	if pkt.Time != nil {
+		// kept even if 0, as it tells the uplink has a time
+		t := pkt.Time.UnixNano() / 1000
+		delta := t - prev.time
+		add(keyPktTime, func(e *encoder) { e.int(delta) })
+		prev.time = t
+	}
+	if pkt.Replayed {
+		add(keyReplayed, func(e *encoder) { e.bool(true) })
+	} else {
+		addInt(keyTmst, int64(int32(pkt.CountUs-prev.tmst)))
+		prev.tmst = pkt.CountUs
+	}
+	addInt(keyFreq, int64(pkt.Freq)-int64(prev.freq))
+	prev.freq = pkt.Freq
+
+	switch pkt.Modulation {
+	case lora.ModulationLoRa:
+		addInt(keyDatarate, int64(pkt.Datarate))
+		if pkt.LoRaBW != lora.BW125K {
+			addInt(keyBandwidth, int64(pkt.LoRaBW))
+		}
+		if pkt.LoRaCR != lora.CR4_5 {
+			addInt(keyCoderate, int64(pkt.LoRaCR))
+		}
+		addInt(keySNR, int64(math.Round(float64(pkt.LoRaSNR)*10)))
+		addInt(keyFreqOffset, int64(pkt.FreqOffset))
+	case lora.ModulationLRFHSS:
+		addInt(keyModulation, moduLRFHSS)
+		dr, cr := pkt.LRFHSS.String(), string(pkt.LRFHSSCR)
+		add(keyLRFHSS, func(e *encoder) { e.text(dr) })
+		add(keyLRFHSSCR, func(e *encoder) { e.text(cr) })
+	default:
+		addInt(keyModulation, moduFSK)
+		addInt(keyDatarate, int64(pkt.Bitrate))
+	}
+	addInt(keyRSSI, int64(math.Round(float64(pkt.RSSI))))
+	addInt(keyChan, int64(pkt.ChainIF))
+	addInt(keyRFCh, int64(pkt.ChainRF))
+	if pkt.StatCRC != 1 {
+		stat := int64(pkt.StatCRC)
+		add(keyStat, func(e *encoder) { e.int(stat) })
+	}
+	data := pkt.Data
+	add(keyData, func(e *encoder) { e.bytes(data) })
+	if len(pkt.Meta) != 0 {
+		meta := pkt.Meta
+		add(keyMeta, func(e *encoder) { e.textMap(meta) })
+	}
+	if brd := pkt.Board; brd != nil {
+		add(keyBoard, func(e *encoder) {
+			if brd.FineTime == nil {
+				e.head(majorArray, 2)
+			} else {
+				e.head(majorArray, 3)
+			}
+			e.uint(uint64(brd.Board))
+			e.uint(uint64(brd.AESKey))
+			if brd.FineTime != nil {
+				e.uint(uint64(*brd.FineTime))
+			}
+		})
+	}
+	if loc := pkt.Location; loc != nil {
+		add(keyLocation, func(e *encoder) {
+			e.head(majorArray, 3)
+			e.int(int64(math.Round(loc.Latitude * 1e5)))
+			e.int(int64(math.Round(loc.Longitude * 1e5)))
+			e.int(int64(loc.Altitude))
+		})
+	}
+
+	e.head(majorMap, uint64(len(fields)))
+	for _, f := range fields {
+		e.uint(f.key)
+		f.write(e)
+	}
+}
+
+// Unmarshal reads a batch, and returns the rest of the data, as the next batch of a stream.
+func Unmarshal(data []byte) (*Batch, []byte, error) {
+	v, rest, err := decode(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("compact: %v", err)
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, errors.New("compact: batch is not a map")
+	}
+	var b Batch
+	var prev state
+	d := &decoder{m: m}
+	b.GatewayID = d.uint(keyGatewayID)
+	hasBase := m[uint64(keyTime)] != nil
+	prev.time = d.int(keyTime)
+	pkts, ok := m[uint64(keyPackets)].([]interface{})
+	if d.err == nil && !ok {
+		d.err = errors.New("no uplinks")
+	}
+	for i, p := range pkts {
+		pm, ok := p.(map[interface{}]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("compact: uplink %d is not a map", i)
+		}
+		pkt, err := unmarshalPacket(pm, &prev, hasBase)
+		if err != nil {
+			return nil, nil, fmt.Errorf("compact: uplink %d: %v", i, err)
+		}
+		b.Packets = append(b.Packets, pkt)
+	}
+	if d.err != nil {
+		return nil, nil, fmt.Errorf("compact: %v", d.err)
+	}
+	return &b, rest, nil
+}
+
+// decoder reads the fields of a map, and keeps the first error.
+type decoder struct {
+	m   map[interface{}]interface{}
+	err error
+}
+
+func (d *decoder) int(key uint64) int64 {
+	switch v := d.m[key].(type) {
+	case nil:
+		return 0
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v)
+		}
+	case int64:
+		return v
+	}
+	if d.err == nil {
+		d.err = fmt.Errorf("key %d: not an integer", key)
+	}
+	return 0
+}
+
+func (d *decoder) uint(key uint64) uint64 {
+	switch v := d.m[key].(type) {
+	case nil:
+		return 0
+	case uint64:
+		return v
+	}
+	if d.err == nil {
+		d.err = fmt.Errorf("key %d: not an unsigned integer", key)
+	}
+	return 0
+}
+
+func (d *decoder) text(key uint64) string {
+	v, ok := d.m[key].(string)
+	if !ok && d.err == nil {
+		d.err = fmt.Errorf("key %d: not a text", key)
+	}
+	return v
+}
+
+func (d *decoder) ints(key uint64) []int64 {
+	items, ok := d.m[key].([]interface{})
+	if !ok {
+		if d.err == nil {
+			d.err = fmt.Errorf("key %d: not an array", key)
+		}
+		return nil
+	}
+	ints := make([]int64, len(items))
+	for i, item := range items {
+		sub := &decoder{m: map[interface{}]interface{}{uint64(0): item}}
+		ints[i] = sub.int(0)
+		if sub.err != nil && d.err == nil {
+			d.err = fmt.Errorf("key %d: not an array of integers", key)
+		}
+	}
+	return ints
+}
+
+func unmarshalPacket(m map[interface{}]interface{}, prev *state, hasBase bool) (*lora.RxPacket, error) {
+	d := &decoder{m: m}
+	pkt := &lora.RxPacket{}
+	if _, ok := m[uint64(keyPktTime)]; ok {
+		if !hasBase {
+			return nil, errors.New("time without the time of the batch")
+		}
+		prev.time += d.int(keyPktTime)
+		t := time.Unix(0, prev.time*1000).UTC()
+		pkt.Time = &t
+	}
+	if replayed, _ := m[uint64(keyReplayed)].(bool); replayed {
+		pkt.Replayed = true
+	} else {
+		pkt.CountUs = prev.tmst + uint32(d.int(keyTmst))
+		prev.tmst = pkt.CountUs
+	}
+	pkt.Freq = lora.Frequency(int64(prev.freq) + d.int(keyFreq))
+	prev.freq = pkt.Freq
+
+	switch d.int(keyModulation) {
+	case moduLoRa:
+		pkt.Modulation = lora.ModulationLoRa
+		pkt.Datarate = lora.SpreadingFactor(d.uint(keyDatarate))
+		pkt.LoRaBW = lora.BW125K
+		if _, ok := m[uint64(keyBandwidth)]; ok {
+			pkt.LoRaBW = lora.Bandwidth(d.uint(keyBandwidth))
+		}
+		pkt.LoRaCR = lora.CR4_5
+		if _, ok := m[uint64(keyCoderate)]; ok {
+			pkt.LoRaCR = lora.Coderate(d.uint(keyCoderate))
+		}
+		pkt.LoRaSNR = float32(d.int(keySNR)) / 10
+		pkt.FreqOffset = int32(d.int(keyFreqOffset))
+	case moduFSK:
+		pkt.Modulation = lora.ModulationFSK
+		pkt.Bitrate = uint32(d.uint(keyDatarate))
+	case moduLRFHSS:
+		pkt.Modulation = lora.ModulationLRFHSS
+		var err error
+		if pkt.LRFHSS, err = lora.ParseLRFHSSDatarate(d.text(keyLRFHSS)); err != nil {
+			return nil, err
+		}
+		if pkt.LRFHSSCR, err = lora.ParseLRFHSSCoderate(d.text(keyLRFHSSCR)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown modulation %d", d.int(keyModulation))
+	}
+	pkt.RSSI = float32(d.int(keyRSSI))
+	pkt.ChainIF = uint8(d.uint(keyChan))
+	pkt.ChainRF = uint8(d.uint(keyRFCh))
+	pkt.StatCRC = 1
+	if _, ok := m[uint64(keyStat)]; ok {
+		pkt.StatCRC = int8(d.int(keyStat))
+	}
+	data, ok := m[uint64(keyData)].([]byte)
+	if !ok {
+		return nil, errors.New("no payload")
+	}
+	pkt.Data = data
+	if v, ok := m[uint64(keyMeta)]; ok {
+		meta, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return nil, errors.New("meta is not a map")
+		}
+		pkt.Meta = make(map[string]string, len(meta))
+		for k, v := range meta {
+			ks, ok1 := k.(string)
+			vs, ok2 := v.(string)
+			if !ok1 || !ok2 {
+				return nil, errors.New("meta is not a map of text")
+			}
+			pkt.Meta[ks] = vs
+		}
+	}
+	if _, ok := m[uint64(keyBoard)]; ok {
+		brd := d.ints(keyBoard)
+		if d.err == nil && len(brd) != 2 && len(brd) != 3 {
+			return nil, errors.New("board metadata is not 2 or 3 integers")
+		}
+		if d.err == nil {
+			pkt.Board = &lora.BoardInfo{Board: uint8(brd[0]), AESKey: uint8(brd[1])}
+			if len(brd) == 3 {
+				ftime := uint32(brd[2])
+				pkt.Board.FineTime = &ftime
+			}
+		}
+	}
+	if _, ok := m[uint64(keyLocation)]; ok {
+		loc := d.ints(keyLocation)
+		if d.err == nil && len(loc) != 3 {
+			return nil, errors.New("location is not 3 integers")
+		}
+		if d.err == nil {
+			pkt.Location = &lora.Location{
+				Latitude:  float64(loc[0]) / 1e5,
+				Longitude: float64(loc[1]) / 1e5,
+				Altitude:  int32(loc[2]),
+			}
+		}
+	}
+	return pkt, d.err
+}
@@ -0,0 +1,166 @@
+package compact
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// testBatch returns a batch with uplinks of all kinds: with and without times, with times and
+// tmst that go back, replayed, and in all modulations.
+func testBatch(t *testing.T) *Batch {
+	t.Helper()
+	t0 := time.Date(2021, 3, 31, 16, 21, 17, 528002000, time.UTC)
+	t1 := t0.Add(1500 * time.Millisecond)
+	t2 := t0.Add(-time.Hour) // replayed from the spool, so older
+	ftime := uint32(123456789)
+	lrfhss, err := lora.ParseLRFHSSDatarate("M0CW137")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Batch{
+		GatewayID: 0xAA555A0000000001,
+		Packets: []*lora.RxPacket{
+			{
+				Time: &t0, CountUs: 3512348611, Freq: 868100000, StatCRC: 1,
+				Modulation: lora.ModulationLoRa, LoRaBW: lora.BW125K, LoRaCR: lora.CR4_5, Datarate: lora.SF7,
+				RSSI: -35, LoRaSNR: 5.5,
+				Board:    &lora.BoardInfo{Board: 1, AESKey: 2, FineTime: &ftime},
+				Location: &lora.Location{Latitude: 46.24123, Longitude: -6.01234, Altitude: 432},
+				Meta:     map[string]string{"site": "roof"},
+				Data:     []byte{0x40, 0x03, 0x02, 0x01, 0x26, 0x00, 0x01, 0x00},
+			},
+			{
+				// the tmst wraps around
+				Time: &t1, CountUs: 1000, Freq: 867500000, StatCRC: -1, ChainIF: 3, ChainRF: 1,
+				Modulation: lora.ModulationLoRa, LoRaBW: lora.BW250K, LoRaCR: lora.CR4_8, Datarate: lora.SF12,
+				RSSI: -137, LoRaSNR: -19.5, FreqOffset: -1200,
+				Board: &lora.BoardInfo{Board: 1},
+				Data:  nil, // an empty payload
+			},
+			{
+				Time: &t2, Replayed: true, Freq: 868300000, StatCRC: 1,
+				Modulation: lora.ModulationLoRa, LoRaBW: lora.BW125K, LoRaCR: lora.CR4_5, Datarate: lora.SF9,
+				RSSI: -120, LoRaSNR: -7,
+				Data: []byte{0x80},
+			},
+			{
+				CountUs: 2000, Freq: 868800000, StatCRC: 0,
+				Modulation: lora.ModulationFSK, Bitrate: 50000,
+				RSSI: -90,
+				Data: []byte{0x01, 0x02},
+			},
+			{
+				CountUs: 500, Freq: 868100000, StatCRC: 1,
+				Modulation: lora.ModulationLRFHSS, LRFHSS: lrfhss, LRFHSSCR: "2/3",
+				RSSI: -128,
+				Data: []byte{0x03},
+			},
+		},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	b := testBatch(t)
+	data := Marshal(b)
+	// a second batch without times follows, as in a stream
+	next := &Batch{GatewayID: 1, Packets: b.Packets[3:]}
+	got, rest, err := Unmarshal(append(data, Marshal(next)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, b) {
+		for i, pkt := range got.Packets {
+			if i < len(b.Packets) && !reflect.DeepEqual(pkt, b.Packets[i]) {
+				t.Errorf("uplink %d read as\n%#v, want\n%#v", i, *pkt, *b.Packets[i])
+			}
+		}
+		t.Fatalf("batch read as %+v, want %+v", got, b)
+	}
+	got, rest, err = Unmarshal(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, next) || len(rest) != 0 {
+		t.Errorf("next batch read as %+v and %d bytes, want %+v", got, len(rest), next)
+	}
+}
+
+func TestDeltas(t *testing.T) {
+	v, _, err := decode(Marshal(testBatch(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkts := v.(map[interface{}]interface{})[uint64(keyPackets)].([]interface{})
+	for _, test := range []struct {
+		key  uint64
+		want interface{}
+	}{
+		{keyPktTime, uint64(0)},
+		{keyTmst, int64(3512348611 - 1<<32)}, // from 0, modulo 2^32
+		{keyFreq, uint64(868100000)},
+	} {
+		if got := pkts[0].(map[interface{}]interface{})[test.key]; got != test.want {
+			t.Errorf("uplink 0, key %d: %#v, want %#v", test.key, got, test.want)
+		}
+	}
+	second := pkts[1].(map[interface{}]interface{})
+	for _, test := range []struct {
+		key  uint64
+		want interface{}
+	}{
+		{keyPktTime, uint64(1500000)},
+		{keyTmst, uint64(1000 + 1<<32 - 3512348611)},
+		{keyFreq, int64(-600000)},
+		{keyRSSI, int64(-137)},
+		{keySNR, int64(-195)},
+	} {
+		if got := second[test.key]; got != test.want {
+			t.Errorf("uplink 1, key %d: %#v, want %#v", test.key, got, test.want)
+		}
+	}
+	replayed := pkts[2].(map[interface{}]interface{})
+	if got := replayed[uint64(keyPktTime)]; got != int64(-time.Hour/time.Microsecond-1500000) {
+		t.Errorf("replayed uplink, time %#v, want the delta to the uplink before", got)
+	}
+	if _, ok := replayed[uint64(keyTmst)]; ok || replayed[uint64(keyReplayed)] != true {
+		t.Errorf("replayed uplink with tmst: %v", replayed)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	data := Marshal(testBatch(t))
+	for i := 0; i < len(data); i++ {
+		if _, _, err := Unmarshal(data[:i]); err == nil {
+			t.Errorf("batch truncated to %d of %d bytes read", i, len(data))
+		}
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	ff := bytes.Repeat([]byte{0xff}, 8)
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"bytes of 2^64-1", append([]byte{majorBytes<<5 | 27}, ff...)},
+		{"text of 2^64-1", append([]byte{majorText<<5 | 27}, ff...)},
+		{"array of 2^64-1", append([]byte{majorArray<<5 | 27}, ff...)},
+		{"map of 2^64-1", append([]byte{majorMap<<5 | 27}, ff...)},
+		{"map of 2^63+1 with 2 bytes", []byte{majorMap<<5 | 27, 0x80, 0, 0, 0, 0, 0, 0, 1, 1, 1}},
+		{"map of 2^32 with 2 bytes", []byte{majorMap<<5 | 26, 0xff, 0xff, 0xff, 0xff, 0, 0}},
+		{"negative integer out of range", append([]byte{majorNegint<<5 | 27}, ff...)},
+		{"indefinite length", []byte{majorArray<<5 | 31, 0xff}},
+		{"deeply nested", bytes.Repeat([]byte{majorArray<<5 | 1}, maxDepth+2)},
+		{"not a map", []byte{majorArray<<5 | 0}},
+		{"no uplinks", []byte{majorMap<<5 | 1, keyGatewayID, 1}},
+		{"uplink without payload", []byte{majorMap<<5 | 1, keyPackets, majorArray<<5 | 1, majorMap<<5 | 0}},
+	} {
+		if _, _, err := Unmarshal(test.data); err == nil {
+			t.Errorf("%s: read", test.name)
+		}
+	}
+}
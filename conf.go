@@ -1,11 +1,115 @@
 package main
 
-import "github.com/Waziup/single_chan_pkt_fwd/lora"
+import (
+	"github.com/Waziup/single_chan_pkt_fwd/api"
+	"github.com/Waziup/single_chan_pkt_fwd/audit"
+	"github.com/Waziup/single_chan_pkt_fwd/bridge"
+	"github.com/Waziup/single_chan_pkt_fwd/coverage"
+	"github.com/Waziup/single_chan_pkt_fwd/display"
+	"github.com/Waziup/single_chan_pkt_fwd/eventbus"
+	"github.com/Waziup/single_chan_pkt_fwd/heartbeat"
+	"github.com/Waziup/single_chan_pkt_fwd/led"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+	"github.com/Waziup/single_chan_pkt_fwd/mdns"
+	"github.com/Waziup/single_chan_pkt_fwd/metrics"
+	"github.com/Waziup/single_chan_pkt_fwd/middleware"
+	"github.com/Waziup/single_chan_pkt_fwd/ntp"
+	"github.com/Waziup/single_chan_pkt_fwd/proxy"
+	"github.com/Waziup/single_chan_pkt_fwd/remoteconf"
+	"github.com/Waziup/single_chan_pkt_fwd/secrets"
+	"github.com/Waziup/single_chan_pkt_fwd/spool"
+	"github.com/Waziup/single_chan_pkt_fwd/standalone"
+	"github.com/Waziup/single_chan_pkt_fwd/store"
+	"github.com/Waziup/single_chan_pkt_fwd/tracing"
+	"github.com/Waziup/single_chan_pkt_fwd/usage"
+	"github.com/Waziup/single_chan_pkt_fwd/webhook"
+)
 
 // GlobalConfig represents a "global_config.json" file.
 type GlobalConfig struct {
 	SX127XConf    *lora.Config   `json:"SX127X_conf"`
+	// Radios are more radios of the gateway, each on its own channel, which are optional.
+	Radios        []*lora.Config `json:"radios"`
 	GatewayConfig *GatewayConfig `json:"gateway_conf"`
+	// Devices are the session keys of devices known to the gateway, which are optional.
+	Devices []lorawan.Session `json:"devices"`
+	// StandaloneConf enables decrypting the uplinks of "devices" at the gateway, which is optional.
+	StandaloneConf *standalone.Config `json:"standalone_conf"`
+	// WebhookConf posts all uplinks to an HTTP endpoint, which is optional.
+	WebhookConf *webhook.Config `json:"webhook_conf"`
+	// UsageConf keeps the bytes of the backends across restarts and sets the billing month, which is optional.
+	UsageConf *usage.Config `json:"usage_conf"`
+	// EventBusConf publishes packet and stat events on a Unix domain socket, which is optional.
+	EventBusConf *eventbus.Config `json:"event_bus_conf"`
+	// MetricsConf pushes packet metadata and stats to InfluxDB or statsd, which is optional.
+	MetricsConf *metrics.Config `json:"metrics_conf"`
+	// StoreConf keeps packet metadata in a local file, which is optional.
+	StoreConf *store.Config `json:"store_conf"`
+	// APIConf enables the local HTTP API, which is optional.
+	APIConf *api.Config `json:"api_conf"`
+	// AuditConf records the control actions of the API and config changes in a file, which is optional.
+	AuditConf *audit.Config `json:"audit_conf"`
+	// CoverageConf writes a GeoJSON coverage map from the uplinks of "devices", which is optional.
+	CoverageConf *coverage.Config `json:"coverage_conf"`
+	// PrivacyConf keeps device identifiers out of the local logs, API and store, which is optional.
+	PrivacyConf *PrivacyConfig `json:"privacy_conf"`
+	// FrameLogConf logs forwarded frames on short, rate limited lines, which is optional.
+	FrameLogConf *FrameLogConfig `json:"frame_log_conf"`
+	// ADRAdviceConf reports the devices that could use a faster datarate, which is optional.
+	ADRAdviceConf *ADRAdviceConfig `json:"adr_advice_conf"`
+	// SpoolConf keeps uplinks on disk while no server acknowledges them, which is optional.
+	SpoolConf *spool.Config `json:"spool_conf"`
+	// BackhaulWindowsConf holds the uplinks in the spool outside the backhaul windows, which is optional.
+	BackhaulWindowsConf *BackhaulWindowsConfig `json:"backhaul_windows_conf"`
+	// NTPConf checks the system clock against an NTP server, which is optional.
+	NTPConf *ntp.Config `json:"ntp_conf"`
+	// SecretsConf is the encrypted file for "${secret:NAME}" values, which is optional.
+	SecretsConf *secrets.Config `json:"secrets_conf"`
+	// DisplayConf shows the gateway status on the SSD1306 OLED of the board, which is optional.
+	DisplayConf *display.Config `json:"display_conf"`
+	// LEDConf drives the status LEDs of the enclosure, which is optional.
+	LEDConf *led.Config `json:"led_conf"`
+	// TracingConf exports spans of the packet lifecycle to an OpenTelemetry collector, which is optional.
+	TracingConf *tracing.Config `json:"tracing_conf"`
+	// HostConf watches the temperature and the power supply of the host, which is optional.
+	HostConf *HostConfig `json:"host_conf"`
+	// RxScheduleConf puts the radios to sleep between listen windows, which is optional.
+	RxScheduleConf *RxScheduleConfig `json:"rx_schedule_conf"`
+	// HeartbeatConf reports the health of the gateway to a fleet endpoint, which is optional.
+	HeartbeatConf *heartbeat.Config `json:"heartbeat_conf"`
+	// RemoteConf fetches the config from a management URL, which is optional.
+	// It is only read from the local config.
+	RemoteConf *remoteconf.Config `json:"remote_conf"`
+	// MDNSConf advertises the gateway on the local network and discovers servers, which is optional.
+	MDNSConf *mdns.Config `json:"mdns_conf"`
+	// BridgeConf accepts the uplinks of other forwarders on the Semtech UDP protocol, which is optional.
+	BridgeConf *bridge.Config `json:"bridge_conf"`
+	// Middleware is the chain of stages that uplinks and downlinks run through, which is optional.
+	Middleware []middleware.Stage `json:"middleware"`
+	// Proxy is the HTTP or SOCKS5 proxy URL of the webhook, metrics, tracing and heartbeat backends
+	// that do not set their own "proxy", which is optional.
+	Proxy string `json:"proxy"`
+}
+
+// applyProxy sets the global proxy on the backends that do not set their own.
+func (cfg *GlobalConfig) applyProxy() {
+	if cfg.Proxy == "" {
+		return
+	}
+	log(LogLevelVerbose, "using proxy %s", proxy.Redact(cfg.Proxy))
+	if cfg.WebhookConf != nil && cfg.WebhookConf.Proxy == "" {
+		cfg.WebhookConf.Proxy = cfg.Proxy
+	}
+	if cfg.MetricsConf != nil && cfg.MetricsConf.Proxy == "" {
+		cfg.MetricsConf.Proxy = cfg.Proxy
+	}
+	if cfg.TracingConf != nil && cfg.TracingConf.Proxy == "" {
+		cfg.TracingConf.Proxy = cfg.Proxy
+	}
+	if cfg.HeartbeatConf != nil && cfg.HeartbeatConf.Proxy == "" {
+		cfg.HeartbeatConf.Proxy = cfg.Proxy
+	}
 }
 
 // GatewayConfig ha sht egateway ID and lists servers that we connect to.
@@ -18,10 +122,54 @@ type GatewayConfig struct {
 	Altitude int64 `json:"alti"`
 	Description string `json:"desc"`
 	Mail string `json:"mail"`
+	// VerifyMIC drops uplinks of known "devices" that have an invalid MIC.
+	VerifyMIC bool `json:"verify_mic"`
+	// DropUnknownDevices drops data uplinks of devices not in "devices" when VerifyMIC is set.
+	DropUnknownDevices bool `json:"drop_unknown_devices"`
+	// DownlinkQueueFile keeps scheduled downlinks across restarts, which is optional.
+	DownlinkQueueFile string `json:"downlink_queue_file"`
+	// ImmediateRx is "abort" (the default) to abort a frame being received for an immediate downlink,
+	// or "wait" to wait until it is received.
+	ImmediateRx string `json:"immediate_rx"`
+	// BoardMetadata adds the board metadata and fine timestamps of uplinks for geolocation.
+	BoardMetadata bool `json:"board_metadata"`
+	// Meta is static metadata, as the site name or the antenna type, added to the "meta" object of
+	// each uplink for the backends to route and attribute the packets, which is optional.
+	Meta map[string]string `json:"meta"`
+	// Interface binds the socket for the servers to a network interface, e.g. the VPN "wg0".
+	Interface string `json:"interface"`
+	// HMACSecret signs uplinks and verifies downlinks with an HMAC, which the servers must support.
+	HMACSecret string `json:"hmac_secret"`
+	// RunAs is the user, as "lora" or "lora:gpio", that the forwarder switches to once the radios are open.
+	RunAs string `json:"run_as"`
+	// RadioWatchdog resets a radio that received packets but none for this many seconds,
+	// or that does not answer on the SPI bus. The radios are not watched if 0.
+	RadioWatchdog int `json:"radio_watchdog"`
+	// DegradedLatency marks a server as degraded if the p95 of its ACK round trips exceeds
+	// this many milliseconds, 1000 if 0.
+	DegradedLatency int `json:"degraded_latency"`
+	// DegradedLoss marks a server as degraded if it did not acknowledge more than this
+	// percentage of the last packets, 20 if 0.
+	DegradedLoss float64 `json:"degraded_loss"`
+	// Failover registers with a primary server and switches to a backup server while it is down,
+	// instead of sending to all servers, which is optional.
+	Failover *FailoverConfig `json:"failover"`
 	Servers   []struct {
 		Address  string `json:"server_address"`
 		PortUp   int    `json:"serv_port_up"`
 		PortDown int    `json:"serv_port_down"`
 		Enabled  bool   `json:"serv_enabled"`
+		// Version is the protocol version 1 or 2, detected if 0.
+		Version  int    `json:"serv_version"`
+		// Backup marks a backup server of the failover mode.
+		Backup bool `json:"serv_backup"`
+		// Routes limit the uplinks sent to the server to those of DevAddr prefixes, as in
+		// "26000000/7", or NetIDs, as in "netid:000013", and with "default" those that no route
+		// of any server matches. The server gets all uplinks if not set.
+		Routes []string `json:"serv_routes"`
+		// Priority of the downlinks of the server over those of other servers: a downlink takes
+		// the place of the downlinks of servers with a lower priority that it overlaps.
+		// Among servers of the same priority, the first downlink queued wins.
+		Priority int `json:"serv_priority"`
 	} `json:"servers"`
 }
@@ -0,0 +1,268 @@
+// Package coverage bins the uplinks of GPS trackers by device and location and writes
+// the bins as a GeoJSON file, so users can draw coverage maps of a single gateway.
+package coverage
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+)
+
+// Config is the "coverage_conf" section of the gateway config.
+type Config struct {
+	// Path of the GeoJSON file, which is rewritten every Interval.
+	Path string `json:"path"`
+	// Interval between writes in seconds, 60 if not set.
+	Interval int `json:"interval"`
+	// CellSize is the size of the bins in degrees, 0.001 (about 100 m) if not set.
+	CellSize float64 `json:"cell_size"`
+	// Decoder reads the location from the payload, one of Decoders. "cayenne" if not set.
+	Decoder string `json:"decoder"`
+	// FPort limits the decoder to uplinks on this FPort, all FPorts if not set.
+	FPort uint8 `json:"fport"`
+}
+
+// Map aggregates uplinks with a location into cells and writes them in the background.
+type Map struct {
+	Logger *log.Logger
+
+	path     string
+	cellSize float64
+	decode   LocationDecoder
+	fPort    uint8
+	verifier *lorawan.MICVerifier
+	sessions map[lorawan.DevAddr]*lorawan.Session
+
+	mu    sync.Mutex
+	cells map[cellKey]*cell
+	done  chan struct{}
+}
+
+type cellKey struct {
+	devAddr  lorawan.DevAddr
+	lat, lon int64 // cell index, the location divided by the cell size
+}
+
+type cell struct {
+	packets  int
+	rssiSum  float64
+	snrSum   float64
+	rssiMin  float32
+	rssiMax  float32
+	lastSeen time.Time
+}
+
+// New returns a Map for the devices with the given sessions and starts writing the GeoJSON file.
+// The payloads are decrypted with the AppSKey of the devices.
+func New(cfg *Config, sessions []lorawan.Session) (*Map, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("coverage: no path")
+	}
+	name := cfg.Decoder
+	if name == "" {
+		name = "cayenne"
+	}
+	decode, ok := Decoders[name]
+	if !ok {
+		return nil, fmt.Errorf("coverage: unknown decoder %q", cfg.Decoder)
+	}
+	interval := 60 * time.Second
+	if cfg.Interval != 0 {
+		interval = time.Duration(cfg.Interval) * time.Second
+	}
+	m := &Map{
+		Logger:   log.New(os.Stdout, "[COVER] ", 0),
+		path:     cfg.Path,
+		cellSize: cfg.CellSize,
+		decode:   decode,
+		fPort:    cfg.FPort,
+		verifier: lorawan.NewMICVerifier(sessions),
+		sessions: make(map[lorawan.DevAddr]*lorawan.Session),
+		cells:    make(map[cellKey]*cell),
+		done:     make(chan struct{}),
+	}
+	if m.cellSize <= 0 {
+		m.cellSize = 0.001
+	}
+	for i := range sessions {
+		m.sessions[sessions[i].DevAddr] = &sessions[i]
+	}
+	go m.run(interval)
+	return m, nil
+}
+
+// Add decrypts the packet and adds it to the cell of the location in its payload.
+// Packets that are no data uplinks or carry no location are ignored.
+func (m *Map) Add(pkt *lora.RxPacket) error {
+	f, fCnt, err := m.verifier.VerifyFrame(pkt.Data)
+	if err != nil {
+		return err
+	}
+	if !f.IsData() || !f.IsUplink() || f.FPort == nil || *f.FPort == 0 {
+		return nil
+	}
+	if m.fPort != 0 && *f.FPort != m.fPort {
+		return nil
+	}
+	key := m.sessions[f.DevAddr].AppSKey
+	if key == nil {
+		return fmt.Errorf("coverage: no AppSKey for device %s", f.DevAddr)
+	}
+	data := lorawan.EncryptFRMPayload(key, true, f.DevAddr, fCnt, f.FRMPayload)
+	loc, ok := m.decode(*f.FPort, data)
+	if !ok || !loc.Valid() {
+		return nil
+	}
+
+	t := time.Now()
+	if pkt.Time != nil {
+		t = *pkt.Time
+	}
+	k := cellKey{
+		devAddr: f.DevAddr,
+		lat:     int64(math.Floor(loc.Lat / m.cellSize)),
+		lon:     int64(math.Floor(loc.Lon / m.cellSize)),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.cells[k]
+	if c == nil {
+		c = &cell{rssiMin: pkt.RSSI, rssiMax: pkt.RSSI}
+		m.cells[k] = c
+	}
+	c.packets++
+	c.rssiSum += float64(pkt.RSSI)
+	c.snrSum += float64(pkt.LoRaSNR)
+	c.rssiMin = float32(math.Min(float64(c.rssiMin), float64(pkt.RSSI)))
+	c.rssiMax = float32(math.Max(float64(c.rssiMax), float64(pkt.RSSI)))
+	if t.After(c.lastSeen) {
+		c.lastSeen = t
+	}
+	return nil
+}
+
+// FeatureCollection is a GeoJSON feature collection.
+type FeatureCollection struct {
+	Type     string     `json:"type"` // "FeatureCollection"
+	Features []*Feature `json:"features"`
+}
+
+// Feature is a GeoJSON point at the center of a cell.
+type Feature struct {
+	Type     string `json:"type"` // "Feature"
+	Geometry struct {
+		Type        string     `json:"type"`        // "Point"
+		Coordinates [2]float64 `json:"coordinates"` // longitude, latitude
+	} `json:"geometry"`
+	Properties Properties `json:"properties"`
+}
+
+// Properties are the packet stats of a cell.
+type Properties struct {
+	DevAddr  lorawan.DevAddr `json:"dev_addr"`
+	Packets  int             `json:"packets"`
+	RSSI     float64         `json:"rssi"` // average
+	RSSIMin  float32         `json:"rssi_min"`
+	RSSIMax  float32         `json:"rssi_max"`
+	SNR      float64         `json:"lsnr"` // average
+	LastSeen time.Time       `json:"last_seen"`
+}
+
+// FeatureCollection returns the cells, ordered by device and location.
+func (m *Map) FeatureCollection() *FeatureCollection {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]cellKey, 0, len(m.cells))
+	for k := range m.cells {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.devAddr != b.devAddr {
+			return a.devAddr < b.devAddr
+		}
+		if a.lat != b.lat {
+			return a.lat < b.lat
+		}
+		return a.lon < b.lon
+	})
+
+	fc := &FeatureCollection{Type: "FeatureCollection", Features: make([]*Feature, len(keys))}
+	for i, k := range keys {
+		c := m.cells[k]
+		f := &Feature{Type: "Feature"}
+		f.Geometry.Type = "Point"
+		f.Geometry.Coordinates = [2]float64{
+			round((float64(k.lon) + 0.5) * m.cellSize),
+			round((float64(k.lat) + 0.5) * m.cellSize),
+		}
+		f.Properties = Properties{
+			DevAddr:  k.devAddr,
+			Packets:  c.packets,
+			RSSI:     math.Round(c.rssiSum/float64(c.packets)*10) / 10,
+			RSSIMin:  c.rssiMin,
+			RSSIMax:  c.rssiMax,
+			SNR:      math.Round(c.snrSum/float64(c.packets)*10) / 10,
+			LastSeen: c.lastSeen,
+		}
+		fc.Features[i] = f
+	}
+	return fc
+}
+
+// round drops the float noise of the cell centers, 1e-7 degrees are about 1 cm.
+func round(deg float64) float64 {
+	return math.Round(deg*1e7) / 1e7
+}
+
+// Close stops the background writes and writes the file a last time.
+func (m *Map) Close() error {
+	close(m.done)
+	return m.write()
+}
+
+func (m *Map) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.write(); err != nil {
+				m.Logger.Printf("can not write coverage map: %v", err)
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// write replaces the GeoJSON file, so readers never see a partial file.
+func (m *Map) write() error {
+	data, err := json.Marshal(m.FeatureCollection())
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
@@ -0,0 +1,54 @@
+package coverage
+
+import (
+	"encoding/binary"
+
+	"github.com/Waziup/single_chan_pkt_fwd/decoder"
+)
+
+// Location is a position in degrees.
+type Location struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// Valid reports whether the location is on the globe and not the 0,0 that trackers send without a fix.
+func (l Location) Valid() bool {
+	return l.Lat >= -90 && l.Lat <= 90 && l.Lon >= -180 && l.Lon <= 180 && (l.Lat != 0 || l.Lon != 0)
+}
+
+// LocationDecoder returns the location of the device from a decrypted uplink payload.
+// Payloads without a location return ok == false.
+type LocationDecoder func(fPort uint8, data []byte) (loc Location, ok bool)
+
+// Decoders are the location decoders by their "decoder" config name.
+var Decoders = map[string]LocationDecoder{
+	"cayenne": DecodeCayenneGPS,
+	"latlon":  DecodeLatLon,
+}
+
+// DecodeCayenneGPS returns the first GPS value of a Cayenne LPP payload.
+func DecodeCayenneGPS(fPort uint8, data []byte) (Location, bool) {
+	values, err := decoder.DecodeCayenneLPP(data)
+	if err != nil {
+		return Location{}, false
+	}
+	for _, v := range values {
+		if gps, ok := v.Value.(map[string]float64); ok && v.Name == "gps" {
+			return Location{Lat: gps["latitude"], Lon: gps["longitude"]}, true
+		}
+	}
+	return Location{}, false
+}
+
+// DecodeLatLon reads the latitude and longitude as signed 32 bit big endian integers
+// of 1e-7 degrees at the start of the payload, as many GPS trackers send them.
+func DecodeLatLon(fPort uint8, data []byte) (Location, bool) {
+	if len(data) < 8 {
+		return Location{}, false
+	}
+	return Location{
+		Lat: float64(int32(binary.BigEndian.Uint32(data))) / 1e7,
+		Lon: float64(int32(binary.BigEndian.Uint32(data[4:]))) / 1e7,
+	}, true
+}
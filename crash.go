@@ -0,0 +1,33 @@
+package main
+
+import (
+	logger "log"
+	"os"
+
+	"github.com/Waziup/single_chan_pkt_fwd/supervisor"
+)
+
+// newWorker returns a worker that restarts the goroutine it runs after a panic, which it counts
+// in the metrics and the API, so one malformed packet can not take the whole gateway down.
+func (gw *Gateway) newWorker(name string) *supervisor.Worker {
+	w := supervisor.New(name)
+	w.Logger = logger.New(os.Stdout, "", 0)
+	w.Clock = gw.clock
+	w.OnPanic = func(v interface{}, crashes int) {
+		log(LogLevelError, "%s: crashed %d times, last with %v", name, crashes, v)
+		gw.crashes.Lock()
+		gw.crashes.workers[name] = crashes
+		snapshot := make(map[string]int, len(gw.crashes.workers))
+		for worker, n := range gw.crashes.workers {
+			snapshot[worker] = n
+		}
+		gw.crashes.Unlock()
+		if gw.exporter != nil {
+			gw.exporter.AddCrash(name, crashes)
+		}
+		if gw.apiServer != nil {
+			gw.apiServer.Publish("crashes", snapshot)
+		}
+	}
+	return w
+}
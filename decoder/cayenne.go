@@ -0,0 +1,102 @@
+package decoder
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// CayenneLPP decodes Cayenne Low Power Payload, see
+// https://docs.mydevices.com/docs/lorawan/cayenne-lpp.
+// The fields are named by type and channel, as in "temperature_1".
+type CayenneLPP struct{}
+
+func (CayenneLPP) Decode(fPort uint8, data []byte) (map[string]interface{}, error) {
+	values, err := DecodeCayenneLPP(data)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{}, len(values))
+	for _, v := range values {
+		fields[v.Name+"_"+strconv.Itoa(int(v.Channel))] = v.Value
+	}
+	return fields, nil
+}
+
+// CayenneValue is a value of a Cayenne LPP payload.
+type CayenneValue struct {
+	Channel uint8
+	Type    uint8
+	Name    string      // type name, as in "temperature"
+	Value   interface{} // float64, or map[string]float64 for accelerometer, gyrometer and gps
+}
+
+// cayenneType describes the values of a type. Types with more than one value have
+// names for them and are decoded to maps.
+type cayenneType struct {
+	name   string
+	size   int // bytes per value
+	signed bool
+	divs   []float64 // resolutions, as in 10 for 0.1 °C
+	names  []string
+}
+
+var cayenneTypes = map[uint8]*cayenneType{
+	0:   {name: "digital_input", size: 1, divs: []float64{1}},
+	1:   {name: "digital_output", size: 1, divs: []float64{1}},
+	2:   {name: "analog_input", size: 2, signed: true, divs: []float64{100}},
+	3:   {name: "analog_output", size: 2, signed: true, divs: []float64{100}},
+	101: {name: "illuminance", size: 2, divs: []float64{1}},
+	102: {name: "presence", size: 1, divs: []float64{1}},
+	103: {name: "temperature", size: 2, signed: true, divs: []float64{10}},
+	104: {name: "humidity", size: 1, divs: []float64{2}},
+	113: {name: "accelerometer", size: 2, signed: true, divs: []float64{1000, 1000, 1000}, names: []string{"x", "y", "z"}},
+	115: {name: "barometer", size: 2, divs: []float64{10}},
+	134: {name: "gyrometer", size: 2, signed: true, divs: []float64{100, 100, 100}, names: []string{"x", "y", "z"}},
+	136: {name: "gps", size: 3, signed: true, divs: []float64{10000, 10000, 100}, names: []string{"latitude", "longitude", "altitude"}},
+}
+
+// DecodeCayenneLPP returns the values of a Cayenne LPP payload in order.
+func DecodeCayenneLPP(data []byte) ([]CayenneValue, error) {
+	var values []CayenneValue
+	for len(data) != 0 {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("cayenne lpp: truncated value header")
+		}
+		ch, typ := data[0], data[1]
+		t := cayenneTypes[typ]
+		if t == nil {
+			return nil, fmt.Errorf("cayenne lpp: unknown type %d on channel %d", typ, ch)
+		}
+		n := t.size * len(t.divs)
+		if len(data) < 2+n {
+			return nil, fmt.Errorf("cayenne lpp: truncated %s on channel %d", t.name, ch)
+		}
+		data = data[2:]
+		v := CayenneValue{Channel: ch, Type: typ, Name: t.name}
+		if t.names == nil {
+			v.Value = t.value(data, 0)
+		} else {
+			m := make(map[string]float64, len(t.names))
+			for i, name := range t.names {
+				m[name] = t.value(data, i)
+			}
+			v.Value = m
+		}
+		values = append(values, v)
+		data = data[n:]
+	}
+	return values, nil
+}
+
+// value returns the i-th value of the type from data.
+func (t *cayenneType) value(data []byte, i int) float64 {
+	var u uint64
+	for _, b := range data[i*t.size : (i+1)*t.size] {
+		u = u<<8 | uint64(b)
+	}
+	if t.signed {
+		shift := uint(64 - 8*t.size)
+		return float64(int64(u<<shift)>>shift) / t.divs[i]
+	}
+	return float64(u) / t.divs[i]
+}
@@ -0,0 +1,50 @@
+// Package decoder turns the application payloads of uplinks into named sensor fields.
+package decoder
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Decoder decodes the decrypted application payload of an uplink on fPort.
+type Decoder interface {
+	Decode(fPort uint8, data []byte) (map[string]interface{}, error)
+}
+
+// Func is a function used as a Decoder.
+type Func func(fPort uint8, data []byte) (map[string]interface{}, error)
+
+func (f Func) Decode(fPort uint8, data []byte) (map[string]interface{}, error) {
+	return f(fPort, data)
+}
+
+var (
+	mu       sync.Mutex
+	decoders = map[string]Decoder{
+		"cayenne": CayenneLPP{},
+	}
+)
+
+// Register makes a decoder available by name, e.g. for Get.
+// Registering a name twice replaces the decoder.
+func Register(name string, d Decoder) {
+	mu.Lock()
+	defer mu.Unlock()
+	decoders[name] = d
+}
+
+// Get returns the decoder of a "decoder" config value, which is either the name of
+// a registered decoder, like "cayenne", or the path of a Go plugin ending in ".so", see Load.
+func Get(name string) (Decoder, error) {
+	if strings.HasSuffix(name, ".so") {
+		return Load(name)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	d, ok := decoders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown decoder %q", name)
+	}
+	return d, nil
+}
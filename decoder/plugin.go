@@ -0,0 +1,44 @@
+// +build linux,cgo darwin,cgo freebsd,cgo
+
+package decoder
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// Load opens a Go plugin, built with "go build -buildmode=plugin", that exports either
+//
+//	var Decoder decoder.Decoder
+//
+// or
+//
+//	func Decode(fPort uint8, data []byte) (map[string]interface{}, error)
+//
+// The plugin must be built with the same Go version and module versions as the forwarder.
+func Load(path string) (Decoder, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if sym, err := p.Lookup("Decoder"); err == nil {
+		// variables are looked up as pointers
+		if d, ok := sym.(*Decoder); ok && *d != nil {
+			return *d, nil
+		}
+		// a variable of a type that implements Decoder
+		if d, ok := sym.(Decoder); ok {
+			return d, nil
+		}
+		return nil, fmt.Errorf("decoder plugin %s: Decoder is a %T, not a decoder.Decoder", path, sym)
+	}
+	sym, err := p.Lookup("Decode")
+	if err != nil {
+		return nil, fmt.Errorf("decoder plugin %s: neither Decoder nor Decode exported", path)
+	}
+	f, ok := sym.(func(uint8, []byte) (map[string]interface{}, error))
+	if !ok {
+		return nil, fmt.Errorf("decoder plugin %s: Decode is a %T", path, sym)
+	}
+	return Func(f), nil
+}
@@ -0,0 +1,10 @@
+// +build !cgo !linux,!darwin,!freebsd
+
+package decoder
+
+import "errors"
+
+// Load is not supported on this platform or without cgo.
+func Load(path string) (Decoder, error) {
+	return nil, errors.New("decoder plugins need cgo on linux, darwin or freebsd")
+}
@@ -0,0 +1,128 @@
+// Package display drives the SSD1306 OLED of gateway boards, as the Adafruit LoRa Radio Bonnet,
+// which shows the gateway status on a few lines of text.
+package display
+
+import (
+	"fmt"
+
+	"periph.io/x/conn/v3/i2c"
+	"periph.io/x/conn/v3/i2c/i2creg"
+)
+
+// Width of the display in pixels.
+const Width = 128
+
+// CharsPerLine is the number of characters on a line, 6 pixels wide each.
+const CharsPerLine = Width / 6
+
+// Config is the "display_conf" section of the gateway config.
+type Config struct {
+	// Bus is the I2C bus, as "/dev/i2c-1", the first one if not set.
+	Bus string `json:"i2c_bus"`
+	// Address is the I2C address of the display, 0x3C (60) if not set.
+	Address uint16 `json:"address"`
+	// Height of the display in pixels, 32 or 64, 32 if not set.
+	Height int `json:"height"`
+	// Interval between updates in seconds, 2 if not set.
+	Interval int `json:"interval"`
+}
+
+// SSD1306 is an SSD1306 OLED display on an I2C bus.
+type SSD1306 struct {
+	bus    i2c.BusCloser
+	dev    *i2c.Dev
+	height int
+	buf    []byte // the pixels, one byte per column of 8 pixels, a page after the other
+}
+
+// Open opens and switches on the display of the config.
+func Open(cfg *Config) (*SSD1306, error) {
+	d := &SSD1306{height: cfg.Height}
+	if d.height == 0 {
+		d.height = 32
+	}
+	if d.height != 32 && d.height != 64 {
+		return nil, fmt.Errorf("display: invalid height %d, must be 32 or 64", d.height)
+	}
+	addr := cfg.Address
+	if addr == 0 {
+		addr = 0x3C
+	}
+	bus, err := i2creg.Open(cfg.Bus)
+	if err != nil {
+		return nil, err
+	}
+	d.bus = bus
+	d.dev = &i2c.Dev{Bus: bus, Addr: addr}
+	d.buf = make([]byte, Width*d.height/8)
+	if err := d.init(); err != nil {
+		bus.Close()
+		return nil, fmt.Errorf("display: %v", err)
+	}
+	return d, nil
+}
+
+// Lines returns the number of text lines of the display.
+func (d *SSD1306) Lines() int {
+	return d.height / 8
+}
+
+func (d *SSD1306) init() error {
+	comPins := byte(0x02)
+	if d.height == 64 {
+		comPins = 0x12
+	}
+	return d.command(
+		0xAE,       // display off
+		0xD5, 0x80, // clock divide ratio
+		0xA8, byte(d.height-1), // multiplex ratio
+		0xD3, 0x00, // display offset
+		0x40,       // start line 0
+		0x8D, 0x14, // charge pump on
+		0x20, 0x00, // horizontal addressing
+		0xA1,          // segment remap
+		0xC8,          // COM scan from the bottom
+		0xDA, comPins, // COM pins
+		0x81, 0x8F, // contrast
+		0xD9, 0xF1, // precharge period
+		0xDB, 0x40, // VCOMH deselect level
+		0xA4, // show the RAM
+		0xA6, // not inverted
+		0xAF, // display on
+	)
+}
+
+func (d *SSD1306) command(cmds ...byte) error {
+	_, err := d.dev.Write(append([]byte{0x00}, cmds...))
+	return err
+}
+
+// Show shows the lines of text, cut to CharsPerLine characters. Lines beyond the display are left out.
+func (d *SSD1306) Show(lines []string) error {
+	for i := range d.buf {
+		d.buf[i] = 0
+	}
+	for page, line := range lines {
+		if page >= d.Lines() {
+			break
+		}
+		for i := 0; i < len(line) && i < CharsPerLine; i++ {
+			g := glyph(line[i])
+			copy(d.buf[page*Width+i*6:], g[:])
+		}
+	}
+	if err := d.command(0x21, 0, Width-1, 0x22, 0, byte(d.Lines()-1)); err != nil {
+		return err
+	}
+	_, err := d.dev.Write(append([]byte{0x40}, d.buf...))
+	return err
+}
+
+// Close switches off the display.
+func (d *SSD1306) Close() error {
+	err := d.command(0xAE)
+	if cerr := d.bus.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
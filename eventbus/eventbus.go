@@ -0,0 +1,256 @@
+// Package eventbus publishes the packets and the stats of the forwarder on a Unix domain socket,
+// for local processes, as a display daemon or a home automation bridge, that would otherwise
+// poll the API.
+//
+// Each client that connects to the socket gets the events as JSON lines, or as the Event
+// messages of gwproto with the "protobuf" encoding, each prefixed with its length as a varint.
+// A client can write a line with the types of the events it wants, separated by spaces or
+// commas, as "rx stat", and gets all events until it does.
+package eventbus
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/gwproto"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// Config is the "event_bus_conf" section of the gateway config.
+type Config struct {
+	// Socket is the path of the Unix domain socket, as "/run/single_chan_pkt_fwd/events.sock".
+	Socket string `json:"socket"`
+	// Mode of the socket file in octal, as "0660", so the members of its group can connect,
+	// 0660 if not set.
+	Mode string `json:"mode"`
+	// Buffer is the number of events queued for each client, 64 if not set. Events are dropped
+	// for the clients that do not read them fast enough.
+	Buffer int `json:"buffer"`
+	// MaxClients is the number of clients connected at once, 16 if not set.
+	MaxClients int `json:"max_clients"`
+	// Encoding of the events, "json" if not set, or "protobuf".
+	Encoding string `json:"encoding"`
+}
+
+// The types of the events.
+const (
+	TypeRx   = "rx"   // a frame received and forwarded
+	TypeTx   = "tx"   // a downlink sent, or not with Error
+	TypeStat = "stat" // the stats of a status report
+)
+
+// Event is an event of the bus.
+type Event struct {
+	Type  string         `json:"type"`
+	Time  time.Time      `json:"time"`
+	Radio *int           `json:"radio,omitempty"`
+	Rx    *lora.RxPacket `json:"rxpk,omitempty"`
+	Tx    *lora.TxPacket `json:"txpk,omitempty"`
+	Error string         `json:"error,omitempty"`
+	Stat  *fwd.Statistic `json:"stat,omitempty"`
+}
+
+// Bus accepts the clients of the socket and sends them the events.
+type Bus struct {
+	Logger *log.Logger
+
+	ln         *net.UnixListener
+	buffer     int
+	maxClients int
+	gatewayID  uint64
+	protobuf   bool
+
+	mu      sync.Mutex
+	clients map[*client]bool
+}
+
+type client struct {
+	conn  net.Conn
+	queue chan []byte
+
+	mu      sync.Mutex
+	types   map[string]bool // or nil for all
+	dropped int
+}
+
+// Listen creates the socket of the gateway, replacing a socket file left by a previous run, and
+// starts accepting clients.
+func Listen(cfg *Config, gatewayID uint64) (*Bus, error) {
+	if cfg.Socket == "" {
+		return nil, errors.New("eventbus: no socket")
+	}
+	switch cfg.Encoding {
+	case "", "json", "protobuf":
+	default:
+		return nil, fmt.Errorf("eventbus: unknown encoding %q, must be json or protobuf", cfg.Encoding)
+	}
+	mode := uint64(0660)
+	if cfg.Mode != "" {
+		var err error
+		if mode, err = strconv.ParseUint(cfg.Mode, 8, 32); err != nil {
+			return nil, fmt.Errorf("eventbus: invalid mode %q", cfg.Mode)
+		}
+	}
+	if info, err := os.Lstat(cfg.Socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", cfg.Socket); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("eventbus: %s is in use", cfg.Socket)
+		}
+		os.Remove(cfg.Socket)
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: cfg.Socket, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("eventbus: %v", err)
+	}
+	if err := os.Chmod(cfg.Socket, os.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("eventbus: %v", err)
+	}
+	b := &Bus{
+		Logger:     log.New(os.Stdout, "[EVENT] ", 0),
+		ln:         ln,
+		buffer:     64,
+		maxClients: 16,
+		gatewayID:  gatewayID,
+		protobuf:   cfg.Encoding == "protobuf",
+		clients:    make(map[*client]bool),
+	}
+	if cfg.Buffer > 0 {
+		b.buffer = cfg.Buffer
+	}
+	if cfg.MaxClients > 0 {
+		b.maxClients = cfg.MaxClients
+	}
+	go b.accept()
+	return b, nil
+}
+
+func (b *Bus) accept() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		full := len(b.clients) >= b.maxClients
+		c := &client{conn: conn, queue: make(chan []byte, b.buffer)}
+		if !full {
+			b.clients[c] = true
+		}
+		b.mu.Unlock()
+		if full {
+			b.Logger.Printf("refusing client: %d clients connected", b.maxClients)
+			conn.Close()
+			continue
+		}
+		go b.write(c)
+		go b.read(c)
+	}
+}
+
+// write sends the events to a client until it disconnects.
+func (b *Bus) write(c *client) {
+	defer b.remove(c)
+	for line := range c.queue {
+		if _, err := c.conn.Write(line); err != nil {
+			return
+		}
+	}
+}
+
+// read reads the event types a client subscribes to.
+func (b *Bus) read(c *client) {
+	defer b.remove(c)
+	scanner := bufio.NewScanner(c.conn)
+	for scanner.Scan() {
+		types := make(map[string]bool)
+		for _, t := range strings.FieldsFunc(scanner.Text(), func(r rune) bool { return r == ' ' || r == ',' }) {
+			types[t] = true
+		}
+		c.mu.Lock()
+		c.types = types
+		c.mu.Unlock()
+	}
+}
+
+// remove disconnects a client, once.
+func (b *Bus) remove(c *client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.clients[c] {
+		return
+	}
+	delete(b.clients, c)
+	close(c.queue)
+	c.conn.Close()
+	if c.dropped != 0 {
+		b.Logger.Printf("client disconnected, %d events dropped", c.dropped)
+	}
+}
+
+// Publish sends an event, at the current time if it has none, to the clients that subscribe to
+// its type. The event is not referenced after Publish returns.
+func (b *Bus) Publish(e *Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	line, err := b.marshal(e)
+	if err != nil {
+		b.Logger.Printf("can not marshal %s event: %v", e.Type, err)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		c.mu.Lock()
+		if c.types == nil || c.types[e.Type] {
+			select {
+			case c.queue <- line:
+			default:
+				c.dropped++
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// marshal returns an event in the encoding of the bus.
+func (b *Bus) marshal(e *Event) ([]byte, error) {
+	if b.protobuf {
+		pe := &gwproto.Event{Type: e.Type, Time: e.Time, Rx: e.Rx, Tx: e.Tx, Stat: e.Stat, Error: e.Error}
+		if e.Radio != nil {
+			pe.Radio = *e.Radio
+		}
+		return gwproto.MarshalEvent(b.gatewayID, pe), nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Close stops accepting clients, disconnects them and removes the socket.
+func (b *Bus) Close() error {
+	err := b.ln.Close()
+	b.mu.Lock()
+	clients := make([]*client, 0, len(b.clients))
+	for c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.mu.Unlock()
+	for _, c := range clients {
+		b.remove(c)
+	}
+	return err
+}
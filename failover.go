@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+)
+
+// FailoverConfig is the "failover" section of the gateway config. Instead of sending to all
+// servers, the forwarder registers for downlinks with the primary server only, the first server
+// without "serv_backup", and with the first healthy backup server while the primary is down.
+type FailoverConfig struct {
+	// Uplinks is "active" (the default) to send uplinks to the active server only,
+	// or "all" to send them to all servers.
+	Uplinks string `json:"uplinks"`
+	// StableTime is how many seconds the primary must be healthy before switching back to it, 300 if 0.
+	StableTime int `json:"stable_time"`
+}
+
+type failoverState struct {
+	gw         *Gateway
+	primary    *upstreamServer
+	backups    []*upstreamServer
+	mu         sync.Mutex // guards active, which upstream reads on all goroutines; check writes it
+	active     *upstreamServer
+	allUplinks bool
+	stable     time.Duration
+	since      time.Time // when the active server became active
+	recovered  time.Time // since when the primary is healthy while a backup is active, or zero
+}
+
+// newFailover returns the failover state of the servers of the gateway, with the primary active.
+func newFailover(gw *Gateway, cfg *FailoverConfig, servers []*upstreamServer) *failoverState {
+	f := &failoverState{gw: gw, stable: 300 * time.Second, since: gw.clock.Now()}
+	switch cfg.Uplinks {
+	case "", "active":
+	case "all":
+		f.allUplinks = true
+	default:
+		fatal("failover: unknown uplinks %q, must be \"active\" or \"all\"", cfg.Uplinks)
+	}
+	if cfg.StableTime != 0 {
+		f.stable = time.Duration(cfg.StableTime) * time.Second
+	}
+	for _, s := range servers {
+		switch {
+		case s.backup:
+			f.backups = append(f.backups, s)
+		case f.primary == nil:
+			f.primary = s
+		default:
+			fatal("failover: more than one server without serv_backup")
+		}
+	}
+	if f.primary == nil || len(f.backups) == 0 {
+		fatal("failover: needs a server without serv_backup and at least one with it")
+	}
+	f.active = f.primary
+	return f
+}
+
+// sendsTo tells if the packet goes to the server. PULL_DATA, which registers the gateway for
+// downlinks, goes to the active server only, and so do uplinks unless "uplinks" is "all".
+// Stats go to all servers, so the ACKs tell when an inactive server is back.
+func (f *failoverState) sendsTo(s *upstreamServer, pkt *fwd.Packet) bool {
+	if f == nil {
+		return true
+	}
+	switch {
+	case f.isActive(s):
+		return true
+	case pkt.Ident == fwd.PullData:
+		return false
+	case pkt.Ident == fwd.PushData && pkt.RxPackets != nil:
+		return f.allUplinks
+	}
+	return true
+}
+
+// healthy tells if the server is not degraded and acknowledged a packet recently. Inactive servers
+// get the stats only, so they are given two status report intervals instead of three keepalives.
+func (f *failoverState) healthy(s *upstreamServer, now time.Time) bool {
+	window := 3 * f.gw.keepalive
+	if s != f.active {
+		window = 2 * f.gw.statusReport
+	}
+	return !s.Degraded() && now.Sub(s.lastAcked()) < window
+}
+
+// check, called on the main loop only, switches to the first healthy backup if the active server is not healthy,
+// and back to the primary once it has been healthy for the stable time.
+// The new active server gets a PULL_DATA right away, so downlinks do not wait for the next keepalive.
+func (f *failoverState) check(ctx context.Context, now time.Time) {
+	if f.active != f.primary {
+		if !f.healthy(f.primary, now) {
+			f.recovered = time.Time{}
+		} else if f.recovered.IsZero() {
+			f.recovered = now
+		}
+		if !f.recovered.IsZero() && now.Sub(f.recovered) >= f.stable {
+			f.activate(ctx, f.primary, now)
+			return
+		}
+	}
+	if f.healthy(f.active, now) {
+		return
+	}
+	for _, s := range f.backups {
+		if s != f.active && f.healthy(s, now) {
+			f.activate(ctx, s, now)
+			return
+		}
+	}
+	if f.active == f.primary {
+		// no backup is known to be healthy, the first one might be
+		f.activate(ctx, f.backups[0], now)
+	}
+}
+
+func (f *failoverState) activate(ctx context.Context, s *upstreamServer, now time.Time) {
+	log(LogLevelWarning, "failover: switching from %s to %s, active for %s", f.active.addr, s.addr, now.Sub(f.since).Truncate(time.Second))
+	f.mu.Lock()
+	f.active = s
+	f.mu.Unlock()
+	f.since = now
+	f.recovered = time.Time{}
+	f.gw.upstream(ctx, &fwd.Packet{
+		Ident: fwd.PullData,
+		Token: fwd.RndToken(),
+	})
+}
+
+// isActive tells if s is the active server.
+func (f *failoverState) isActive(s *upstreamServer) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active == s
+}
@@ -0,0 +1,70 @@
+package forwarder
+
+import (
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// An Event is an *RxEvent, *TxEvent, *StatEvent or *CrashEvent.
+type Event interface {
+	event()
+}
+
+// RxEvent is a packet received by a radio. The packet is not released to the payload pool,
+// so subscribers may keep it.
+type RxEvent struct {
+	Radio  int
+	Packet *lora.RxPacket
+}
+
+// TxEvent is a downlink sent by a radio, with Err set if it could not be sent.
+type TxEvent struct {
+	Radio  int
+	Packet *lora.TxPacket
+	Err    error
+}
+
+// StatEvent are the stats since the last StatEvent, as sent to the servers.
+type StatEvent struct {
+	Stat *fwd.Statistic
+}
+
+// CrashEvent is a panic of a worker of the forwarder, "radio" or "network", which is restarted
+// after a backoff, see supervisor.Worker.
+type CrashEvent struct {
+	Worker  string
+	Panic   interface{}
+	Crashes int // of the worker since the start
+}
+
+func (*RxEvent) event()    {}
+func (*TxEvent) event()    {}
+func (*StatEvent) event()  {}
+func (*CrashEvent) event() {}
+
+// Subscribe makes the forwarder send the events to ch. Events are dropped while ch is full,
+// as the forwarder does not wait for subscribers.
+func (f *Forwarder) Subscribe(ch chan<- Event) {
+	f.mu.Lock()
+	f.subscribers[ch] = true
+	f.mu.Unlock()
+}
+
+// Unsubscribe stops sending events to ch.
+func (f *Forwarder) Unsubscribe(ch chan<- Event) {
+	f.mu.Lock()
+	delete(f.subscribers, ch)
+	f.mu.Unlock()
+}
+
+func (f *Forwarder) publish(e Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subscribers {
+		select {
+		case ch <- e:
+		default:
+			f.Logger.Printf("dropping %T for a slow subscriber", e)
+		}
+	}
+}
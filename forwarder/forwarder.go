@@ -0,0 +1,455 @@
+// Package forwarder is the packet forwarder as a library, for Go programs that build their own
+// gateway on top of it: it receives with the radios, forwards the uplinks to the servers with the
+// Semtech UDP protocol, and sends the downlinks of the servers and those passed to Enqueue.
+// Subscribers get the received and sent packets and the stats as events.
+//
+// The radios are opened with lora.OpenRadio, so the program registers the backends it uses,
+// see lora.RegisterBackend. Features of the single_chan_pkt_fwd command that are configured
+// in its global_conf.json, as the spool, the API or channel hopping, are not part of the library.
+// The command has its own loop for them, built on the pieces of the library: the Scheduler of
+// the downlinks and TxAckOf.
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/clock"
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/supervisor"
+	"github.com/Waziup/single_chan_pkt_fwd/txqueue"
+)
+
+// Config is the configuration of a Forwarder.
+type Config struct {
+	// GatewayID is the EUI of the gateway.
+	GatewayID uint64
+	// Radios are the receive configs of the radios, the first one being RF chain 0.
+	// Downlinks go out on the radio that listens on their frequency, or the first one.
+	Radios []*lora.Config
+	// Servers are the "host:port" addresses of the servers. Without servers the
+	// forwarder receives and sends for its subscribers only.
+	Servers []string
+	// Keepalive is the interval of the PULL_DATA packets, 60s if not set.
+	Keepalive time.Duration
+	// StatInterval is the interval of the stats, 240s if not set.
+	StatInterval time.Duration
+	// Clock times the polls, the keepalives, the stats and the downlinks, the system clock if
+	// not set. Tests set a clock.Fake.
+	Clock clock.Clock
+	// MaxQueue is the most downlinks queued, 64 if not set. Enqueue returns
+	// txqueue.ErrQueueFull for more.
+	MaxQueue int
+}
+
+// PollInterval is the interval at which the radios are polled for packets.
+const PollInterval = 100 * time.Millisecond
+
+// ErrStopped is returned by Enqueue once the forwarder stopped.
+var ErrStopped = errors.New("forwarder stopped")
+
+// ErrServerUnreachable is returned by Reachable if no server answered lately.
+var ErrServerUnreachable = errors.New("server unreachable")
+
+// Forwarder is a packet forwarder, see New.
+type Forwarder struct {
+	Logger *log.Logger
+
+	cfg    Config
+	clock  clock.Clock
+	region *lora.Region
+
+	radios    []lora.Radio
+	receiving []bool // false after sending or receiving a packet, which ends the receive mode
+	conn      *net.UDPConn
+	servers   []*net.UDPAddr
+	sched     *Scheduler
+	stat      fwd.Statistic
+
+	enqueue   chan *request
+	pullResps chan *request
+	syncs     chan struct{}
+	done      chan struct{} // closed once the forwarder stopped
+
+	mu          sync.Mutex
+	subscribers map[chan<- Event]bool
+	lastAck     time.Time // when a server last sent a PUSH_ACK or PULL_ACK
+}
+
+// request is a downlink for the loop, from Enqueue or a PULL_RESP.
+type request struct {
+	pkt   *lora.TxPacket
+	err   chan error   // Enqueue waits for the result, nil for PULL_RESPs
+	token fwd.Token    // of the PULL_RESP
+	addr  *net.UDPAddr // that sent the PULL_RESP
+}
+
+// New returns a forwarder with the config. It does not open the radios before Start.
+func New(cfg *Config) *Forwarder {
+	f := &Forwarder{
+		Logger:      log.New(os.Stdout, "[FWD  ] ", 0),
+		cfg:         *cfg,
+		clock:       clock.OrReal(cfg.Clock),
+		enqueue:     make(chan *request),
+		pullResps:   make(chan *request, 8),
+		syncs:       make(chan struct{}),
+		done:        make(chan struct{}),
+		subscribers: make(map[chan<- Event]bool),
+	}
+	if f.cfg.Keepalive <= 0 {
+		f.cfg.Keepalive = 60 * time.Second
+	}
+	if f.cfg.StatInterval <= 0 {
+		f.cfg.StatInterval = 240 * time.Second
+	}
+	if f.cfg.MaxQueue <= 0 {
+		f.cfg.MaxQueue = 64
+	}
+	if len(cfg.Radios) != 0 {
+		f.region = lora.Regions[cfg.Radios[0].Region]
+	}
+	return f
+}
+
+// Start opens the radios and the socket for the servers, and forwards in the background
+// until ctx is done.
+func (f *Forwarder) Start(ctx context.Context) error {
+	if len(f.cfg.Radios) == 0 {
+		return errors.New("forwarder: no radios")
+	}
+	for _, s := range f.cfg.Servers {
+		addr, err := net.ResolveUDPAddr("udp", s)
+		if err != nil {
+			return fmt.Errorf("forwarder: server %s: %w", s, err)
+		}
+		f.servers = append(f.servers, addr)
+	}
+	for i, cfg := range f.cfg.Radios {
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("forwarder: radio %d: %w", i, err)
+		}
+		r, err := lora.OpenRadio(cfg)
+		if err != nil {
+			return fmt.Errorf("forwarder: radio %d: %w", i, err)
+		}
+		f.radios = append(f.radios, r)
+	}
+	f.receiving = make([]bool, len(f.radios))
+
+	var err error
+	if f.conn, err = net.ListenUDP("udp", nil); err != nil {
+		return fmt.Errorf("forwarder: %w", err)
+	}
+	queue := txqueue.New("")
+	queue.MaxLen = f.cfg.MaxQueue
+	f.sched = NewScheduler(f.clock, queue)
+	go f.worker("network").Run(ctx, f.downstream)
+	go f.run(ctx)
+	return nil
+}
+
+// Done returns a channel that is closed once the forwarder stopped.
+func (f *Forwarder) Done() <-chan struct{} {
+	return f.done
+}
+
+// Enqueue queues a downlink. Immediate downlinks go out as soon as the radio is free, the others
+// at their CountUs, in µs of the concentrator counter that timestamps the received packets.
+// It returns an error if the downlink is invalid, collides with another one or does not fit in
+// the queue, as lora.ErrFrequency, txqueue.ErrCollision or txqueue.ErrQueueFull wrapped, or
+// fwd.ErrTooLate, and blocks until the forwarder is started. If ctx is done first, it returns ctx.Err(),
+// though the downlink may have been queued already: queued downlinks are sent with the
+// context of Start.
+func (f *Forwarder) Enqueue(ctx context.Context, pkt *lora.TxPacket) error {
+	req := &request{pkt: pkt, err: make(chan error, 1)}
+	select {
+	case f.enqueue <- req:
+	case <-f.done:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-req.err:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reachable returns nil if a server answered within the last three keepalives, or an error
+// wrapping ErrServerUnreachable, as until the first answer.
+func (f *Forwarder) Reachable() error {
+	if len(f.cfg.Servers) == 0 {
+		return fmt.Errorf("%w: no servers", ErrServerUnreachable)
+	}
+	f.mu.Lock()
+	last := f.lastAck
+	f.mu.Unlock()
+	if last.IsZero() {
+		return fmt.Errorf("%w: no answer yet", ErrServerUnreachable)
+	}
+	if d := f.clock.Now().Sub(last); d >= 3*f.cfg.Keepalive {
+		return fmt.Errorf("%w: no answer for %s", ErrServerUnreachable, d)
+	}
+	return nil
+}
+
+// Sync returns once the forwarder handled the ticks of its clock that it received, or ctx.Err()
+// if ctx is done first. Tests with a clock.Fake call it after Advance, see Fake.Waiting.
+func (f *Forwarder) Sync(ctx context.Context) error {
+	select {
+	case f.syncs <- struct{}{}:
+		return nil
+	case <-f.done:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// worker returns a worker that restarts the goroutine it runs after a panic, and publishes a
+// CrashEvent for each.
+func (f *Forwarder) worker(name string) *supervisor.Worker {
+	w := supervisor.New(name)
+	w.Logger = f.Logger
+	w.Clock = f.clock
+	w.OnPanic = func(v interface{}, crashes int) {
+		f.publish(&CrashEvent{Worker: name, Panic: v, Crashes: crashes})
+	}
+	return w
+}
+
+func (f *Forwarder) run(ctx context.Context) {
+	defer close(f.done)
+	defer f.conn.Close()
+
+	f.upstream(&fwd.Packet{Ident: fwd.PullData, Token: fwd.RndToken()}, nil)
+	f.worker("radio").Run(ctx, f.loop)
+}
+
+// loop receives with the radios, sends the downlinks and the stats. After a panic it starts
+// over, with the radios set up to receive again.
+func (f *Forwarder) loop(ctx context.Context) {
+	for i := range f.receiving {
+		f.receiving[i] = false
+	}
+	poll := f.clock.NewTicker(PollInterval)
+	defer poll.Stop()
+	keepalive := f.clock.NewTicker(f.cfg.Keepalive)
+	defer keepalive.Stop()
+	stats := f.clock.NewTicker(f.cfg.StatInterval)
+	defer stats.Stop()
+	timerSend := f.clock.NewTimer(time.Hour)
+	f.sched.Reset(timerSend)
+
+	for {
+		f.receive(ctx)
+		select {
+		case <-ctx.Done():
+			return
+
+		case req := <-f.enqueue:
+			req.err <- f.queueDownlink(req.pkt)
+			f.sched.Reset(timerSend)
+
+		case req := <-f.pullResps:
+			ack := &fwd.Packet{Token: req.token, Ident: fwd.TxAck}
+			if err := f.queueDownlink(req.pkt); err != nil {
+				f.Logger.Printf("(<- %s) can not queue downlink: %v", req.addr, err)
+				ack.TxAck, ack.TxAckInfo = TxAckOf(err), err.Error()
+			}
+			f.upstream(ack, req.addr)
+			f.sched.Reset(timerSend)
+
+		case <-poll.C():
+			f.poll(ctx)
+
+		case <-timerSend.C():
+			f.send(ctx)
+			f.sched.Reset(timerSend)
+
+		case <-f.syncs:
+			// the loop handles one case at a time, so it is done with the previous ones
+
+		case <-keepalive.C():
+			f.upstream(&fwd.Packet{Ident: fwd.PullData, Token: fwd.RndToken()}, nil)
+
+		case <-stats.C():
+			f.stat.TimeStamp = f.clock.Now().UTC()
+			stat := f.stat
+			f.publish(&StatEvent{Stat: &stat})
+			f.upstream(&fwd.Packet{Ident: fwd.PushData, Token: fwd.RndToken(), Stat: &stat}, nil)
+			f.stat.Rxnb, f.stat.Rxok, f.stat.Rxfw, f.stat.Dwnb, f.stat.Txnb = 0, 0, 0, 0, 0
+			f.stat.Channels = nil
+		}
+	}
+}
+
+// receive puts the radios that left the receive mode back into it.
+func (f *Forwarder) receive(ctx context.Context) {
+	for i, r := range f.radios {
+		if f.receiving[i] {
+			continue
+		}
+		if err := r.Receive(ctx, f.cfg.Radios[i]); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			f.Logger.Printf("radio %d: can not receive: %v", i, err)
+			continue
+		}
+		f.receiving[i] = true
+	}
+}
+
+// poll reads the received packets of the radios, publishes them and pushes them to the servers.
+func (f *Forwarder) poll(ctx context.Context) {
+	var pkts []*lora.RxPacket
+	for i, r := range f.radios {
+		radioPkts, err := r.GetPacket(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			f.Logger.Printf("radio %d: can not receive packets: %v", i, err)
+			continue
+		}
+		if radioPkts == nil {
+			continue
+		}
+		f.receiving[i] = false
+		countUs := f.sched.CountUs(f.clock.Now())
+		for _, pkt := range radioPkts {
+			pkt.ChainRF = uint8(i)
+			pkt.RSSI += f.cfg.Radios[i].RSSIOffset
+			pkt.CountUs = countUs
+			f.stat.CountRx(pkt)
+			f.publish(&RxEvent{Radio: i, Packet: pkt})
+		}
+		pkts = append(pkts, radioPkts...)
+	}
+	if pkts == nil || len(f.servers) == 0 {
+		return
+	}
+	f.stat.Rxfw += int64(len(pkts))
+	f.upstream(&fwd.Packet{Ident: fwd.PushData, Token: fwd.RndToken(), RxPackets: pkts}, nil)
+}
+
+// queueDownlink validates a downlink, lowers its power to the limits of the radio and the region, and queues it.
+func (f *Forwarder) queueDownlink(pkt *lora.TxPacket) error {
+	if err := pkt.Validate(f.region); err != nil {
+		return err
+	}
+	pkt.ClampPower(f.region)
+	dropped, err := f.sched.Push(&txqueue.Item{Pkt: pkt, Priority: txqueue.PriorityOf(pkt)})
+	for _, d := range dropped {
+		f.Logger.Printf("tx queue: dropping downlink of %s for a beacon", d.At.Format(time.RFC3339Nano))
+	}
+	return err
+}
+
+// send sends the downlink that is due, on the radio that listens on its frequency.
+func (f *Forwarder) send(ctx context.Context) {
+	next := f.sched.Due()
+	if next == nil {
+		return
+	}
+	f.sched.Queue.Pop()
+	radio := 0
+	for i, cfg := range f.cfg.Radios {
+		if cfg.Freq == next.Pkt.Freq {
+			radio = i
+			break
+		}
+	}
+	f.receiving[radio] = false
+	err := f.radios[radio].Send(ctx, next.Pkt)
+	if err != nil {
+		f.Logger.Printf("radio %d: can not send packet: %v", radio, err)
+	} else if next.Priority == txqueue.PriorityImmediate {
+		f.stat.Dwnb++
+	} else {
+		f.stat.Txnb++
+	}
+	f.publish(&TxEvent{Radio: radio, Packet: next.Pkt, Err: err})
+}
+
+// upstream sends the packet to the server at addr, or to all servers if addr is nil.
+func (f *Forwarder) upstream(pkt *fwd.Packet, addr *net.UDPAddr) {
+	if len(f.servers) == 0 {
+		return
+	}
+	pkt.GatewayID = f.cfg.GatewayID
+	pkt.Version = fwd.ProtocolV2
+	data, err := pkt.MarshalBinary()
+	if err != nil {
+		f.Logger.Printf("can not marshal packet: %v", err)
+		return
+	}
+	servers := f.servers
+	if addr != nil {
+		servers = []*net.UDPAddr{addr}
+	}
+	for _, server := range servers {
+		if _, err := f.conn.WriteToUDP(data, server); err != nil {
+			f.Logger.Printf("(-> %s) can not write upstream: %v", server, err)
+		}
+	}
+}
+
+// downstream reads the packets from the servers and passes their downlinks to the loop.
+func (f *Forwarder) downstream(ctx context.Context) {
+	var buffer [2048]byte
+	for {
+		n, addr, err := f.conn.ReadFromUDP(buffer[:])
+		if err != nil {
+			if ctx.Err() == nil {
+				f.Logger.Printf("can not read downstream: %v", err)
+			}
+			return
+		}
+		pkt := &fwd.Packet{}
+		if err := pkt.UnmarshalBinary(buffer[:n]); err != nil {
+			f.Logger.Printf("(<- %s) can not unmarshal downstream packet: %v", addr, err)
+			continue
+		}
+		if pkt.Ident == fwd.PushAck || pkt.Ident == fwd.PullAck {
+			f.mu.Lock()
+			f.lastAck = f.clock.Now()
+			f.mu.Unlock()
+		}
+		for _, tx := range pkt.TxPackets {
+			select {
+			case f.pullResps <- &request{pkt: tx, token: pkt.Token, addr: addr}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// TxAckOf returns the TX_ACK error of an error of a downlink, as its validation or queueing.
+// The protocol has no error for most, as lora.ErrBadDatarate or txqueue.ErrQueueFull, which get
+// ErrCollisionPacket, so the server may try another window; their text goes in the TxAckInfo.
+func TxAckOf(err error) fwd.TxAckError {
+	var ack fwd.TxAckError
+	switch {
+	case errors.As(err, &ack):
+		return ack
+	case errors.Is(err, lora.ErrFrequency):
+		return fwd.ErrTxFreq
+	case errors.Is(err, lora.ErrPower):
+		return fwd.ErrTxPower
+	case errors.Is(err, txqueue.ErrCollisionBeacon):
+		return fwd.ErrCollisionBeacon
+	}
+	return fwd.ErrCollisionPacket
+}
@@ -0,0 +1,86 @@
+package forwarder
+
+import (
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/clock"
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/txqueue"
+)
+
+// Scheduler times the packets of a forwarder with the concentrator counter, the µs since the
+// start of the scheduler, which is the tmst of the uplinks and the CountUs the servers schedule
+// the downlinks at. The counter wraps around after 2^32 µs, about 71 minutes.
+//
+// The Forwarder and the single_chan_pkt_fwd command both queue and send their downlinks with
+// a Scheduler. It is not safe for concurrent use.
+type Scheduler struct {
+	// Queue holds the downlinks until they are due.
+	Queue *txqueue.Queue
+
+	clock clock.Clock
+	start time.Time
+}
+
+// NewScheduler returns a scheduler whose counter starts now by the clock, the system clock if nil,
+// with the queue, which it sets the clock of.
+func NewScheduler(c clock.Clock, queue *txqueue.Queue) *Scheduler {
+	c = clock.OrReal(c)
+	queue.Clock = c
+	return &Scheduler{Queue: queue, clock: c, start: c.Now()}
+}
+
+// Now returns the time by the clock of the scheduler.
+func (s *Scheduler) Now() time.Time {
+	return s.clock.Now()
+}
+
+// CountUs returns the counter at t.
+func (s *Scheduler) CountUs(t time.Time) uint32 {
+	return uint32(t.Sub(s.start) / time.Microsecond)
+}
+
+// At returns the time the counter is countUs, the nearest one to now, so within about
+// 35 minutes before or after now, as the counter wraps around.
+func (s *Scheduler) At(countUs uint32) time.Time {
+	now := s.clock.Now()
+	return now.Add(time.Duration(int32(countUs-s.CountUs(now))) * time.Microsecond)
+}
+
+// Push queues a downlink, see txqueue.Queue.Push. Scheduled downlinks and beacons are due at the
+// CountUs of their packet, and rejected with fwd.ErrTooLate if that is past.
+func (s *Scheduler) Push(it *txqueue.Item) (dropped []*txqueue.Item, err error) {
+	if it.Priority != txqueue.PriorityImmediate {
+		it.At = s.At(it.Pkt.CountUs)
+		if it.At.Before(s.clock.Now()) {
+			return nil, fwd.ErrTooLate
+		}
+	}
+	return s.Queue.Push(it)
+}
+
+// Reset sets the timer to the downlink that is due first and returns it, or stops the timer
+// and returns nil if there is none.
+func (s *Scheduler) Reset(timer clock.Timer) *txqueue.Item {
+	if !timer.Stop() {
+		select {
+		case <-timer.C():
+		default:
+		}
+	}
+	next := s.Queue.Next()
+	if next != nil {
+		timer.Reset(next.At.Sub(s.clock.Now()))
+	}
+	return next
+}
+
+// Due returns the downlink that is due first if it is due within a millisecond, or nil, as
+// when the timer fired before another downlink was queued. It stays in the queue until Pop.
+func (s *Scheduler) Due() *txqueue.Item {
+	next := s.Queue.Next()
+	if next == nil || next.At.Sub(s.clock.Now()) > time.Millisecond {
+		return nil
+	}
+	return next
+}
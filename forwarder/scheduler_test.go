@@ -0,0 +1,55 @@
+package forwarder
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/clock"
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/txqueue"
+)
+
+func TestScheduler(t *testing.T) {
+	c := clock.NewFake(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := NewScheduler(c, txqueue.New(""))
+	tx := func(countUs uint32) *txqueue.Item {
+		pkt := &lora.TxPacket{CountUs: countUs, Modulation: lora.ModulationLoRa, Datarate: lora.SF7, LoRaBW: lora.BW125K, LoRaCR: lora.CR4_5, InvertPolar: true, Data: []byte{0x60}}
+		return &txqueue.Item{Pkt: pkt, Priority: txqueue.PriorityOf(pkt)}
+	}
+
+	// past the wrap of the counter, a downlink one second after an uplink is due in one second
+	c.Advance(1<<32*time.Microsecond + time.Hour)
+	rx := s.CountUs(c.Now())
+	if want := uint32(time.Hour / time.Microsecond); rx != want {
+		t.Fatalf("CountUs = %d, want %d", rx, want)
+	}
+	if _, err := s.Push(tx(rx + 1000000)); err != nil {
+		t.Fatal(err)
+	}
+	timer := c.NewTimer(time.Hour)
+	next := s.Reset(timer)
+	if want := c.Now().Add(time.Second); next == nil || !next.At.Equal(want) {
+		t.Fatalf("Reset = %v, want a downlink at %s", next, want)
+	}
+	if s.Due() != nil {
+		t.Error("downlink due at once")
+	}
+	c.Advance(time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Fatal("timer did not fire")
+	}
+	if s.Due() != next {
+		t.Error("downlink not due after one second")
+	}
+
+	if _, err := s.Push(tx(rx)); !errors.Is(err, fwd.ErrTooLate) {
+		t.Errorf("Push of a past downlink = %v, want %v", err, fwd.ErrTooLate)
+	}
+	if ack := TxAckOf(fwd.ErrTooLate); ack != fwd.ErrTooLate {
+		t.Errorf("TxAckOf(ErrTooLate) = %v", ack)
+	}
+}
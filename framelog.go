@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+	"github.com/Waziup/single_chan_pkt_fwd/ratelimit"
+)
+
+// FrameLogConfig is the "frame_log_conf" section of the gateway config.
+// It logs each forwarded frame on a short line instead of the full packet.
+type FrameLogConfig struct {
+	// Level of the frame lines, as for the -l flag, "debug" if not set.
+	Level string `json:"level"`
+	// Rate is the number of frames per second that are logged on average, 1 if not set.
+	Rate float64 `json:"rate"`
+	// Burst is the number of frames that are logged at once, 10 if not set.
+	Burst int `json:"burst"`
+	// PayloadBytes is the number of leading payload bytes logged in hex, none if not set.
+	PayloadBytes int `json:"payload_bytes"`
+	// RedactDevAddr logs the first byte of device addresses only.
+	RedactDevAddr bool `json:"redact_dev_addr"`
+}
+
+type frameLogger struct {
+	level        int
+	payloadBytes int
+	redact       bool
+	bucket       *ratelimit.Bucket
+
+	mu      sync.Mutex
+	dropped int // frames not logged since the last line
+}
+
+func newFrameLogger(cfg *FrameLogConfig) (*frameLogger, error) {
+	level := LogLevelDebug
+	if cfg.Level != "" {
+		var err error
+		if level, err = parseLogLevel(cfg.Level); err != nil {
+			return nil, err
+		}
+	}
+	rate := cfg.Rate
+	if rate <= 0 {
+		rate = 1
+	}
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = 10
+	}
+	return &frameLogger{
+		level:        level,
+		payloadBytes: cfg.PayloadBytes,
+		redact:       cfg.RedactDevAddr,
+		bucket:       ratelimit.New(rate, burst),
+	}, nil
+}
+
+// logRx logs a received packet, through the frame logger if enabled.
+// In privacy mode it is logged as by the frame logger, but in full.
+func (gw *Gateway) logRx(pkt *lora.RxPacket) {
+	if gw.frameLog == nil && gw.privacy == nil {
+		log(LogLevelNormal, "rx: %s", pkt)
+		return
+	}
+	gw.frameLog.log(gw.privacy, "rx", pkt.Data, fmt.Sprintf("%s %s, RSSI %.0f dBm, SNR %.1f dB",
+		pkt.Freq, lora.Datarate{SpreadingFactor: pkt.Datarate, Bandwidth: pkt.LoRaBW}, pkt.RSSI, pkt.LoRaSNR))
+}
+
+// logTx logs a packet that is about to be sent, through the frame logger if enabled.
+func (gw *Gateway) logTx(pkt *lora.TxPacket) {
+	if gw.frameLog == nil && gw.privacy == nil {
+		log(LogLevelNormal, "tx: %s", pkt)
+		return
+	}
+	gw.frameLog.log(gw.privacy, "tx", pkt.Data, fmt.Sprintf("%s %s, %d dBm",
+		pkt.Freq, lora.Datarate{SpreadingFactor: pkt.Datarate, Bandwidth: pkt.LoRaBW}, pkt.Power))
+}
+
+// log logs a frame, with its device identifiers hidden by p, which may be nil.
+func (l *frameLogger) log(p *privacyFilter, dir string, data []byte, meta string) {
+	if l == nil {
+		log(LogLevelNormal, "%s: %s, %s", dir, (&frameLogger{}).frame(p, data), meta)
+		return
+	}
+	if l.level > currentLogLevel() {
+		// don't use up the rate for lines that are not printed anyway
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.bucket.Allow() {
+		l.dropped++
+		return
+	}
+	if l.dropped != 0 {
+		log(l.level, "%s: %d frames not logged (rate limit)", dir, l.dropped)
+		l.dropped = 0
+	}
+	log(l.level, "%s: %s, %s", dir, l.frame(p, data), meta)
+}
+
+// frame describes a frame as in "Unconfirmed Data Up DevAddr 26011BDA FCnt 2, 17 bytes, payload 954378...".
+// The payload of data frames is the FRMPayload, which is encrypted.
+// Other frames, like join requests, show the PHYPayload unless device addresses are redacted
+// or hidden in privacy mode, as it holds the device EUIs.
+func (l *frameLogger) frame(p *privacyFilter, data []byte) string {
+	var buf strings.Builder
+	payload := data
+	if f, err := lorawan.Decode(data); err != nil {
+		buf.WriteString("unknown frame")
+	} else {
+		buf.WriteString(f.MType().String())
+		if f.IsData() {
+			addr := p.id(f.DevAddr.String())
+			if l.redact && addr != "" {
+				addr = addr[:2] + "******"
+			}
+			if addr != "" {
+				fmt.Fprintf(&buf, " DevAddr %s", addr)
+			}
+			fmt.Fprintf(&buf, " FCnt %d", f.FCnt)
+			payload = f.FRMPayload
+		} else if l.redact || p != nil {
+			payload = nil
+		}
+	}
+	fmt.Fprintf(&buf, ", %d bytes", len(data))
+	if l.payloadBytes > 0 && len(payload) != 0 {
+		n := len(payload)
+		if n > l.payloadBytes {
+			n = l.payloadBytes
+		}
+		fmt.Fprintf(&buf, ", payload %X", payload[:n])
+		if n < len(payload) {
+			buf.WriteString("...")
+		}
+	}
+	return buf.String()
+}
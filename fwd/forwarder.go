@@ -5,7 +5,9 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"time"
 
 	"github.com/Waziup/single_chan_pkt_fwd/lora"
@@ -35,13 +37,50 @@ type Statistic struct {
 	Altitude int64 `json:"alti"`
 	Rxnb int64	    `json:"rxnb"`
 	Rxok int64	`json:"rxok"`
-	Rxfw int64 `json:"rxok"`
+	Rxfw int64 `json:"rxfw"`
 	Ackr int64 `json:"ackr"`
 	Dwnb int64 `json:"dwnb"`
 	Txnb int64 `json:"txnb"`
 	Pfrm string `json:"pfrm"`
 	Mail string `json:"mail"`
 	Desc string `json:"desc"`
+	// Hops report the channels of hopping radios, see lora.Config.Hops.
+	Hops []*HopStat `json:"hops,omitempty"`
+	// Noise reports the noise floor of the channels of the radios. It is not part of the Semtech protocol.
+	Noise []*NoiseStat `json:"noise,omitempty"`
+	// Power reports the estimated power consumption of the radios. It is not part of the Semtech protocol.
+	Power []*PowerStat `json:"power,omitempty"`
+	// Channels break rxnb and rxok down by frequency and datarate, sorted by both, see CountRx.
+	// It is not part of the Semtech protocol.
+	Channels []*ChannelStat `json:"rxch,omitempty"`
+}
+
+// HopStat is the time a hopping radio spent on a channel since the last status report.
+type HopStat struct {
+	Radio int            `json:"radio"`
+	Freq  lora.Frequency `json:"freq"`
+	Datr  lora.Datarate  `json:"datr"`
+	Hops  int64          `json:"hops"`  // number of hops to the channel
+	Dwell int64          `json:"dwell"` // time on the channel in milliseconds
+	Rxnb  int64          `json:"rxnb"`  // packets received on the channel
+}
+
+// NoiseStat is the noise floor of a radio on a channel since the last status report,
+// from the RSSI sampled while no frame was received, in dBm.
+type NoiseStat struct {
+	Radio int            `json:"radio"`
+	Freq  lora.Frequency `json:"freq"`
+	Min   float32        `json:"min"`
+	Avg   float32        `json:"avg"`
+	Max   float32        `json:"max"`
+	N     int64          `json:"n"` // number of samples
+}
+
+// PowerStat is the time a radio spent in each power mode and its estimated energy consumption
+// since it was opened, see lora.PowerManager.
+type PowerStat struct {
+	Radio int `json:"radio"`
+	lora.PowerUsage
 }
 
 type TxAckError int
@@ -57,19 +96,36 @@ const (
 	ErrGPSUnloacked                          // Rejected because GPS is unlocked, so GPS timestamp cannot be used
 )
 
+var txAckErrStr = []string{
+	"",
+	"NONE",
+	"TOO_LATE",
+	"TOO_EARLY",
+	"COLLISION_PACKET",
+	"COLLISION_BEACON",
+	"TX_FREQ",
+	"TX_POWER",
+	"GPS_UNLOCKED",
+}
+
 func (err TxAckError) MarshalJSON() ([]byte, error) {
-	var errStr = []string{
-		"",
-		"NONE",
-		"TOO_LATE",
-		"TOO_EARLY",
-		"COLLISION_PACKET",
-		"COLLISION_BEACON",
-		"TX_FREQ",
-		"TX_POWER",
-		"GPS_UNLOCKED",
+	return []byte(fmt.Sprintf("{\"error\":\"%s\"}", txAckErrStr[err])), nil
+}
+
+func (err *TxAckError) UnmarshalJSON(data []byte) error {
+	var msg struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	for e, str := range txAckErrStr {
+		if e != 0 && str == msg.Error {
+			*err = TxAckError(e)
+			return nil
+		}
 	}
-	return []byte(fmt.Sprintf("{\"error\":\"%s\"}", errStr[err])), nil
+	return fmt.Errorf("unknown tx ack error: %q", msg.Error)
 }
 
 func (err TxAckError) Error() string {
@@ -99,14 +155,27 @@ func (t Token) String() string {
 	return fmt.Sprintf("%X", int(t[1])<<8+int(t[0]))
 }
 
+// Protocol versions of the Semtech UDP protocol. Version 1 has no TX_ACK.
+const (
+	ProtocolV1 byte = 1
+	ProtocolV2 byte = 2
+)
+
 type Packet struct {
+	// Version is the protocol version, ProtocolV2 if 0.
+	Version   byte             `json:"-"`
 	Token     Token            `json:"-"`
 	Ident     Ident            `json:"-"`
 	GatewayID uint64           `json:"-"`
 	Stat      *Statistic            `json:"stat,omitempty"`
 	RxPackets []*lora.RxPacket `json:"rxpk,omitempty"`
 	TxPacket  *lora.TxPacket   `json:"txpk,omitempty"`
+	// TxPackets are all downlinks of a PULL_RESP, which may hold a "txpk" array
+	// or several JSON objects. TxPacket is the first of them.
+	TxPackets []*lora.TxPacket `json:"-"`
 	TxAck     TxAckError       `json:"txpk_ack,omitempty"`
+	// TxAckInfo is sent in the TX_ACK next to the error, which is not part of the Semtech protocol.
+	TxAckInfo string `json:"-"`
 }
 
 func (pkt *Packet) String() string {
@@ -120,7 +189,7 @@ func (pkt *Packet) String() string {
 	case PushAck:
 		return fmt.Sprintf("%s: Token: %s", pkt.Ident, pkt.Token)
 	case PullResp:
-		return fmt.Sprintf("%s: Token: %s, 1 tx packet", pkt.Ident, pkt.Token)
+		return fmt.Sprintf("%s: Token: %s, %d tx packets", pkt.Ident, pkt.Token, len(pkt.TxPackets))
 	case TxAck:
 		return fmt.Sprintf("%s: Token: %s, Gateway ID: %X", pkt.Ident, pkt.Token, pkt.GatewayID)
 	}
@@ -160,8 +229,15 @@ func RndToken() [2]byte {
 func (p *Packet) MarshalBinary() ([]byte, error) {
 
 	var buf bytes.Buffer
-	buf.WriteByte(0x02)   // protocol version = 2
-	buf.Write(p.Token[:]) // random token
+	version := p.Version
+	if version == 0 {
+		version = ProtocolV2
+	}
+	if version == ProtocolV1 && p.Ident == TxAck {
+		return nil, errors.New("no TX_ACK in protocol version 1")
+	}
+	buf.WriteByte(version) // protocol version
+	buf.Write(p.Token[:])  // random token
 
 	switch p.Ident {
 	case PushData:
@@ -178,7 +254,32 @@ func (p *Packet) MarshalBinary() ([]byte, error) {
 	case TxAck:
 		buf.WriteByte(byte(TxAck))                        // TX_ACK identifier 0x05
 		binary.Write(&buf, binary.BigEndian, p.GatewayID) // Gateway unique identifier (MAC address)
+		if p.TxAck != 0 && p.TxAckInfo != "" {
+			var ack struct {
+				TxAck struct {
+					Error string `json:"error"`
+					Info  string `json:"info"`
+				} `json:"txpk_ack"`
+			}
+			ack.TxAck.Error = txAckErrStr[p.TxAck]
+			ack.TxAck.Info = p.TxAckInfo
+			err := json.NewEncoder(&buf).Encode(ack)
+			return buf.Bytes(), err
+		}
+		if p.TxAck != 0 {
+			err := json.NewEncoder(&buf).Encode(p)
+			return buf.Bytes(), err
+		}
+		return buf.Bytes(), nil
+
+	// server side
+	case PushAck, PullAck:
+		buf.WriteByte(byte(p.Ident))
 		return buf.Bytes(), nil
+	case PullResp:
+		buf.WriteByte(byte(PullResp)) // PULL_RESP identifier 0x03
+		err := json.NewEncoder(&buf).Encode(p)
+		return buf.Bytes(), err
 
 	default:
 		return nil, fmt.Errorf("unknown packet type: %d", p.Ident)
@@ -190,21 +291,81 @@ func (p *Packet) UnmarshalBinary(buf []byte) error {
 	if len(buf) < 4 {
 		return fmt.Errorf("buffer to short")
 	}
-	if buf[0] != 0x02 {
+	if buf[0] != ProtocolV1 && buf[0] != ProtocolV2 {
 		return fmt.Errorf("can not handle version: 0x%x", buf[0])
 	}
+	p.Version = buf[0]
 	copy(p.Token[:], buf[1:3])
 	p.Ident = Ident(buf[3])
 	switch p.Ident {
 	case PushAck, PullAck:
 		return nil
 	case PullResp:
-		err := json.Unmarshal(buf[4:], p)
+		txpks, err := unmarshalTxPackets(buf[4:])
 		if err != nil {
 			return fmt.Errorf("can not unmarshal PULL_RESP packet: %q", err)
 		}
+		p.TxPackets = txpks
+		if len(txpks) != 0 {
+			p.TxPacket = txpks[0]
+		}
+		return nil
+
+	// server side
+	case PushData, PullData, TxAck:
+		if len(buf) < 12 {
+			return fmt.Errorf("buffer to short")
+		}
+		p.GatewayID = binary.BigEndian.Uint64(buf[4:12])
+		if len(bytes.TrimSpace(buf[12:])) == 0 {
+			if p.Ident == PushData {
+				return fmt.Errorf("PUSH_DATA packet without payload")
+			}
+			return nil
+		}
+		if err := json.Unmarshal(buf[12:], p); err != nil {
+			return fmt.Errorf("can not unmarshal %s packet: %q", p.Ident, err)
+		}
 		return nil
 	default:
 		return fmt.Errorf("can not unmarshal downstream packet type 0x%x", buf[3])
 	}
 }
+
+// unmarshalTxPackets returns the downlinks of a PULL_RESP payload, which is one or more
+// concatenated JSON objects, each with a single "txpk" object or an array of them.
+func unmarshalTxPackets(data []byte) ([]*lora.TxPacket, error) {
+	var txpks []*lora.TxPacket
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var msg struct {
+			TxPacket json.RawMessage `json:"txpk"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return txpks, nil
+		} else if err != nil {
+			return nil, err
+		}
+		raw := bytes.TrimSpace(msg.TxPacket)
+		switch {
+		case len(raw) == 0 || bytes.Equal(raw, []byte("null")):
+			continue
+		case raw[0] == '[':
+			var arr []*lora.TxPacket
+			if err := json.Unmarshal(raw, &arr); err != nil {
+				return nil, err
+			}
+			for _, tx := range arr {
+				if tx != nil {
+					txpks = append(txpks, tx)
+				}
+			}
+		default:
+			tx := &lora.TxPacket{}
+			if err := json.Unmarshal(raw, tx); err != nil {
+				return nil, err
+			}
+			txpks = append(txpks, tx)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package fwd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/clock"
+)
+
+// Packets can be signed with an HMAC-SHA256, which is not part of the Semtech protocol.
+// The "hmac_time" field, the time of signing in µs since the Unix epoch, and the "hmac" field
+// are the last fields of the JSON object, and the HMAC is over the whole datagram, header and
+// time included, without the "hmac" field, as in:
+//
+//	<header>{"rxpk":[...],"hmac_time":1690000000000000,"hmac":"<64 hex digits>"}
+//
+// The times of the datagrams of a sender increase, so replayed datagrams are detected.
+
+// ErrSignature is returned by Verify if a packet has no valid HMAC.
+var ErrSignature = errors.New("invalid or missing hmac")
+
+// ErrReplay is returned by Verify if a packet was signed before the last verified packet of
+// its sender, or too long ago, as if it was replayed.
+var ErrReplay = errors.New("replayed or stale hmac")
+
+// DefaultMaxAge is how far the time of a signed packet may be from the clock, if HMAC.MaxAge is not set.
+const DefaultMaxAge = 30 * time.Second
+
+const (
+	hmacField     = `,"hmac":"`
+	hmacTimeField = `,"hmac_time":`
+)
+
+// HMAC signs and verifies the datagrams of the forwarder with a secret.
+type HMAC struct {
+	Secret []byte
+	// MaxAge is how far the time of a verified datagram may be from the clock,
+	// as the clocks of the server and the gateway differ, DefaultMaxAge if 0.
+	MaxAge time.Duration
+	// Clock is the clock the times are taken from, the system clock if nil.
+	Clock clock.Clock
+
+	mu       sync.Mutex
+	signed   int64            // the time of the last signed datagram
+	verified map[string]int64 // the time of the last verified datagram by sender
+}
+
+// Sign adds the time and the HMAC to the datagram data, as returned by MarshalBinary.
+// Datagrams without JSON object are returned unchanged.
+func (h *HMAC) Sign(data []byte) []byte {
+	data = bytes.TrimRight(data, " \r\n\t")
+	if len(data) == 0 || data[len(data)-1] != '}' {
+		return data
+	}
+	h.mu.Lock()
+	t := clock.OrReal(h.Clock).Now().UnixNano() / int64(time.Microsecond)
+	if t <= h.signed {
+		t = h.signed + 1
+	}
+	h.signed = t
+	h.mu.Unlock()
+
+	timed := make([]byte, 0, len(data)+len(hmacTimeField)+20)
+	timed = append(timed, data[:len(data)-1]...)
+	if len(timed) != 0 && timed[len(timed)-1] == '{' {
+		// an empty object gets no comma
+		timed = append(timed, hmacTimeField[1:]...)
+	} else {
+		timed = append(timed, hmacTimeField...)
+	}
+	timed = strconv.AppendInt(timed, t, 10)
+	timed = append(timed, '}')
+
+	sum := hex.EncodeToString(h.sum(timed))
+	signed := make([]byte, 0, len(timed)+len(hmacField)+len(sum)+1)
+	signed = append(signed, timed[:len(timed)-1]...)
+	signed = append(signed, hmacField...)
+	signed = append(signed, sum...)
+	return append(signed, '"', '}')
+}
+
+// Verify checks the HMAC and the time of the datagram data of the sender, as its address,
+// and returns the datagram without both. The time must be later than that of the last datagram
+// verified of the sender, and not further than MaxAge from the clock.
+func (h *HMAC) Verify(data []byte, sender string) ([]byte, error) {
+	data = bytes.TrimRight(data, " \r\n\t")
+	n := len(data) - len(hmacField) - 2*sha256.Size - 2
+	if n < 0 || !bytes.Equal(data[n:n+len(hmacField)], []byte(hmacField)) || !bytes.HasSuffix(data, []byte(`"}`)) {
+		return nil, ErrSignature
+	}
+	sum, err := hex.DecodeString(string(data[n+len(hmacField) : len(data)-2]))
+	if err != nil {
+		return nil, ErrSignature
+	}
+	timed := make([]byte, 0, n+1)
+	timed = append(timed, data[:n]...)
+	timed = append(timed, '}')
+	if !hmac.Equal(sum, h.sum(timed)) {
+		return nil, ErrSignature
+	}
+
+	i := bytes.LastIndex(timed, []byte(hmacTimeField[1:]))
+	if i < 0 {
+		return nil, fmt.Errorf("%w: no hmac_time", ErrSignature)
+	}
+	t, err := strconv.ParseInt(string(timed[i+len(hmacTimeField)-1:len(timed)-1]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: hmac_time: %v", ErrSignature, err)
+	}
+	maxAge := h.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultMaxAge
+	}
+	now := clock.OrReal(h.Clock).Now()
+	if age := now.Sub(time.Unix(0, t*int64(time.Microsecond))); age > maxAge || age < -maxAge {
+		return nil, fmt.Errorf("%w: signed %s ago", ErrReplay, age)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if t <= h.verified[sender] {
+		return nil, fmt.Errorf("%w: hmac_time %d not after %d", ErrReplay, t, h.verified[sender])
+	}
+	if h.verified == nil {
+		h.verified = make(map[string]int64)
+	}
+	h.verified[sender] = t
+
+	unsigned := timed[:i]
+	if j := len(unsigned) - 1; j >= 0 && unsigned[j] == ',' {
+		unsigned = unsigned[:j]
+	}
+	return append(unsigned, '}'), nil
+}
+
+func (h *HMAC) sum(data []byte) []byte {
+	mac := hmac.New(sha256.New, h.Secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
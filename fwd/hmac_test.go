@@ -0,0 +1,49 @@
+package fwd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/clock"
+)
+
+func TestHMAC(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1690000000, 0))
+	server := &HMAC{Secret: []byte("secret"), Clock: clk}
+	gateway := &HMAC{Secret: []byte("secret"), Clock: clk}
+	resp := []byte("\x02\x12\x34\x03" + `{"txpk":{"imme":true}}`)
+
+	first := server.Sign(resp)
+	second := server.Sign(resp) // in the same µs
+	data, err := gateway.Verify(first, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(resp) {
+		t.Errorf("Verify = %q, want %q", data, resp)
+	}
+	if _, err := gateway.Verify(second, "server"); err != nil {
+		t.Errorf("second datagram: %v", err)
+	}
+	if _, err := gateway.Verify(first, "server"); !errors.Is(err, ErrReplay) {
+		t.Errorf("replayed datagram: %v, want %v", err, ErrReplay)
+	}
+	if _, err := gateway.Verify(first, "other"); err != nil {
+		t.Errorf("datagram of another server: %v", err)
+	}
+
+	stale := server.Sign(resp)
+	clk.Advance(DefaultMaxAge + time.Second)
+	if _, err := gateway.Verify(stale, "server"); !errors.Is(err, ErrReplay) {
+		t.Errorf("stale datagram: %v, want %v", err, ErrReplay)
+	}
+
+	wrong := &HMAC{Secret: []byte("wrong"), Clock: clk}
+	if _, err := gateway.Verify(wrong.Sign(resp), "server"); !errors.Is(err, ErrSignature) {
+		t.Errorf("datagram of another secret: %v, want %v", err, ErrSignature)
+	}
+	if _, err := gateway.Verify(resp, "server"); !errors.Is(err, ErrSignature) {
+		t.Errorf("unsigned datagram: %v, want %v", err, ErrSignature)
+	}
+}
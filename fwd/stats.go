@@ -0,0 +1,53 @@
+package fwd
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// ChannelStat is the number of packets received on a frequency with a datarate since the
+// last status report.
+type ChannelStat struct {
+	Freq lora.Frequency `json:"freq"`
+	// Datr is the datarate as in the "rxpk" objects, e.g. "SF7BW125", or the FSK bitrate.
+	Datr string `json:"datr"`
+	Rxnb int64  `json:"rxnb"`
+	Rxok int64  `json:"rxok"`
+}
+
+// datr returns the datarate of the packet as in the "rxpk" objects.
+func datr(pkt *lora.RxPacket) string {
+	switch pkt.Modulation {
+	case lora.ModulationLoRa:
+		return lora.Datarate{SpreadingFactor: pkt.Datarate, Bandwidth: pkt.LoRaBW}.String()
+	case lora.ModulationLRFHSS:
+		return pkt.LRFHSS.String()
+	}
+	return strconv.FormatUint(uint64(pkt.Bitrate), 10)
+}
+
+// CountRx counts a received packet in Rxnb, in Rxok if its CRC is valid, and in the
+// breakdown by frequency and datarate.
+func (s *Statistic) CountRx(pkt *lora.RxPacket) {
+	ok := int64(0)
+	if pkt.StatCRC == 1 {
+		ok = 1
+	}
+	s.Rxnb++
+	s.Rxok += ok
+
+	dr := datr(pkt)
+	i := sort.Search(len(s.Channels), func(i int) bool {
+		c := s.Channels[i]
+		return c.Freq > pkt.Freq || (c.Freq == pkt.Freq && c.Datr >= dr)
+	})
+	if i == len(s.Channels) || s.Channels[i].Freq != pkt.Freq || s.Channels[i].Datr != dr {
+		s.Channels = append(s.Channels, nil)
+		copy(s.Channels[i+1:], s.Channels[i:])
+		s.Channels[i] = &ChannelStat{Freq: pkt.Freq, Datr: dr}
+	}
+	s.Channels[i].Rxnb++
+	s.Channels[i].Rxok += ok
+}
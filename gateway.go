@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/api"
+	"github.com/Waziup/single_chan_pkt_fwd/audit"
+	"github.com/Waziup/single_chan_pkt_fwd/bridge"
+	"github.com/Waziup/single_chan_pkt_fwd/clock"
+	"github.com/Waziup/single_chan_pkt_fwd/coverage"
+	"github.com/Waziup/single_chan_pkt_fwd/display"
+	"github.com/Waziup/single_chan_pkt_fwd/eventbus"
+	"github.com/Waziup/single_chan_pkt_fwd/forwarder"
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/heartbeat"
+	"github.com/Waziup/single_chan_pkt_fwd/led"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+	"github.com/Waziup/single_chan_pkt_fwd/mdns"
+	"github.com/Waziup/single_chan_pkt_fwd/metrics"
+	"github.com/Waziup/single_chan_pkt_fwd/middleware"
+	"github.com/Waziup/single_chan_pkt_fwd/ntp"
+	"github.com/Waziup/single_chan_pkt_fwd/remoteconf"
+	"github.com/Waziup/single_chan_pkt_fwd/spool"
+	"github.com/Waziup/single_chan_pkt_fwd/standalone"
+	"github.com/Waziup/single_chan_pkt_fwd/store"
+	"github.com/Waziup/single_chan_pkt_fwd/tracing"
+	"github.com/Waziup/single_chan_pkt_fwd/usage"
+	"github.com/Waziup/single_chan_pkt_fwd/webhook"
+)
+
+// Gateway is a packet forwarder with its radios, servers and backends, as configured by a
+// global_conf.json. It holds all the state of the forwarder, so several gateways can run in one
+// process. The log and its level are shared by the process, as is middleware.PrivateID.
+type Gateway struct {
+	// gwid is the EUI of the gateway, the "gateway_ID" of "gateway_conf".
+	gwid uint64
+	// region is the frequency plan that downlinks are checked against, or nil.
+	region *lora.Region
+
+	// clock times the main loop, its tickers and timers and the downlinks, the system clock
+	// unless a test sets a clock.Fake before serve.
+	clock clock.Clock
+	// settle is how long the radios settle once opened before the main loop receives with them.
+	settle time.Duration
+	// syncs passes the Sync calls to the main loop, and done is closed once serve returned.
+	syncs chan struct{}
+	done  chan struct{}
+
+	keepalive          time.Duration
+	tickerKeepalive    clock.Ticker
+	statusReport       time.Duration
+	tickerStatusReport clock.Ticker
+
+	// micVerifier checks uplink MICs if "verify_mic" is enabled, or is nil.
+	micVerifier        *lorawan.MICVerifier
+	dropUnknownDevices bool
+	// hmac signs PUSH_DATA and verifies PULL_RESP packets if "hmac_secret" is set, or is nil.
+	hmac *fwd.HMAC
+	// boardMetadata adds the "brd", "aesk" and "ftime" fields to uplinks if "board_metadata" is set.
+	boardMetadata bool
+	// staticMeta is added to the "meta" object of uplinks if "meta" is set in "gateway_conf", or is nil.
+	staticMeta map[string]string
+	// radioWatchdog is how long a radio that received packets may stay silent before it is reset,
+	// or zero to not watch the radios, see GatewayConfig.RadioWatchdog.
+	radioWatchdog time.Duration
+	// crashes counts the panics of the workers, by name, see newWorker.
+	crashes struct {
+		sync.Mutex
+		workers map[string]int
+	}
+
+	// servers are the enabled servers, which the socket sends to from laddr.
+	servers []*upstreamServer
+	laddr   *net.UDPAddr
+	socket  *net.UDPConn
+	// Servers are degraded if the p95 of their ACK round trips exceeds degradedLatency, or if
+	// more than degradedLoss percent of their last requests were not acknowledged within ackTimeout.
+	// See GatewayConfig.DegradedLatency and GatewayConfig.DegradedLoss.
+	degradedLatency time.Duration
+	degradedLoss    float64
+	// failover switches between the primary and the backup servers if "failover" is set, or is nil.
+	failover *failoverState
+	// allRoutes are the routes of all servers, to tell which uplinks take the default route.
+	allRoutes []lorawan.DevAddrPrefix
+	// pending are the unacknowledged uplink pushes, by token.
+	// The servers are reachable if a PUSH_ACK or PULL_ACK came after the last push expired.
+	pending struct {
+		sync.Mutex
+		pushes     map[fwd.Token]*pendingPush
+		lastAck    time.Time
+		lastExpiry time.Time
+	}
+
+	// stat are the counters of the next status report.
+	stat *fwd.Statistic
+	// noise is the noise floor of the channels of the radios.
+	noise *noiseFloor
+	// chanTx passes the downlinks of the PULL_RESP packets to the main loop, which queues them
+	// and sends the TX_ACK.
+	chanTx chan *downlink
+	// sched holds the downlinks until they are due, see nextSend, and keeps the concentrator
+	// counter, which the tmst of the packets counts. It is set by serve, with the clock.
+	sched *forwarder.Scheduler
+	// txTiming counts how late downlinks start compared to their tmst.
+	txTiming *metrics.Histogram
+	// immeWaitRx makes immediate downlinks wait for a frame being received instead of aborting it,
+	// see GatewayConfig.ImmediateRx.
+	immeWaitRx bool
+	// immeAcks are the queued immediate downlinks, with the tokens of their PULL_RESPs.
+	// Their TX_ACK is sent once the radio has been taken, see arbitrate.
+	immeAcks map[*lora.TxPacket]*downlink
+	// immeWaiting is since when the next immediate downlink waits for a frame being received, or zero.
+	immeWaiting time.Time
+	// txAirtime sums the airtime of the sent downlinks by the server that sent them and by the
+	// DevAddr they are for, since the forwarder started, so the tenants of a shared gateway can
+	// be told apart. Downlinks that are not data frames, as join accepts, have no DevAddr.
+	txAirtime struct {
+		sync.Mutex
+		servers map[string]*airtimeUsage
+		devices map[string]*airtimeUsage
+	}
+	// rxWindows correlates the Class A downlinks with the uplinks they answer by their tmst, which
+	// is the tmst of the uplink plus the receive delay, to report by device if they are sent in RX1
+	// or RX2 and the margin they leave. Devices are DevAddrs, or DevEUIs for join requests.
+	// RX1 is 1 s after the uplink, the default RECEIVE_DELAY1, or 5 s for join accepts, and RX2 is
+	// one second later. It is only used by the main loop.
+	rxWindows struct {
+		uplinks   [rxWindowUplinks]rxWindowUplink
+		next      int
+		devices   map[string]*rxWindowStats
+		unmatched int
+	}
+	// joins tracks the join requests by DevEUI and the join accepts that answer them, to debug OTAA
+	// failures at the gateway. Join accepts are encrypted, so they are matched to the requests by
+	// their tmst, see correlateRxWindow. It is only used by the main loop.
+	joins map[string]*joinDevice
+	// uplinkLoss holds the uplink loss by DevAddr. It is only used by the main loop.
+	uplinkLoss map[lorawan.DevAddr]*deviceLoss
+
+	// chain runs uplinks and downlinks through the stages of "middleware", or is nil.
+	chain *middleware.Chain
+	// privacy hides the device identifiers if "privacy_conf" is set, or is nil.
+	privacy *privacyFilter
+	// frameLog logs frames if "frame_log_conf" is set, or is nil.
+	frameLog *frameLogger
+	// adrAdvisor advises datarates if "adr_advice_conf" is set, or is nil. It is only used by the main loop.
+	adrAdvisor *adrAdvice
+	// app decrypts uplinks and posts them to a webhook if "standalone_conf" is set, or is nil.
+	app *standalone.App
+	// multicastDownlinks are the downlinks of the multicast groups of the app, or nil.
+	multicastDownlinks <-chan *lora.TxPacket
+	// hook posts uplinks to a HTTP endpoint if "webhook_conf" is set, or is nil.
+	hook *webhook.Backend
+	// backhaul counts the bytes the backends send and receive, kept in a file if "usage_conf" is set.
+	backhaul *usage.Meter
+	// eventBus publishes events to local processes if "event_bus_conf" is set, or is nil.
+	eventBus *eventbus.Bus
+	// exporter pushes metrics if "metrics_conf" is set, or is nil.
+	exporter *metrics.Exporter
+	// reporter posts the health of the gateway to a fleet endpoint if "heartbeat_conf" is set, or is nil.
+	reporter *heartbeat.Reporter
+	// pktStore keeps packet metadata if "store_conf" is set, or is nil.
+	pktStore *store.Store
+	// coverageMap aggregates tracker uplinks if "coverage_conf" is set, or is nil.
+	coverageMap *coverage.Map
+	// clockMonitor checks the system clock against NTP if "ntp_conf" is set, or is nil.
+	clockMonitor *ntp.Monitor
+	// auditLog records the control actions if "audit_conf" is set, or is nil.
+	auditLog *audit.Log
+	// remoteConfig fetches the config from the management URL if "remote_conf" is set, or is nil.
+	remoteConfig *remoteconf.Client
+	// hostMonitor watches the host if "host_conf" is set, or is nil.
+	hostMonitor *hostState
+	// rxGate puts the radios to sleep between listen windows if "rx_schedule_conf" is set, or is nil.
+	rxGate *rxSchedule
+	// responder advertises the gateway with mDNS if "mdns_conf" is set, or is nil.
+	responder *mdns.Responder
+
+	// uplinkSpool keeps the uplinks that no server acknowledged if "spool_conf" is set, or is nil.
+	uplinkSpool *spool.Spool
+	// backhaulWindows holds the uplinks outside the windows if "backhaul_windows_conf" is set, or is nil.
+	backhaulWindows *backhaulSchedule
+
+	// gwBridge serves other forwarders if "bridge_conf" is set, or is nil.
+	gwBridge *bridge.Bridge
+	// bridged tracks the uplinks of other forwarders in the aggregate mode of the bridge, so the
+	// Class A downlinks that answer them go to the forwarder that received them, with its tmst.
+	// Downlinks are matched by the whole number of seconds between their tmst and the uplink, as in
+	// correlateRxWindow. It is only used by the main loop.
+	bridged struct {
+		pending map[*lora.RxPacket]*bridge.Uplink // drained, without a local tmst yet
+		uplinks [bridgeUplinks]bridgeUplink
+		next    int
+		acks    map[bridgeAckKey]*bridgeAck
+	}
+	// bridgeTxAcks is the TX_ACK channel of the bridge, or nil, which the main loop never receives from.
+	bridgeTxAcks <-chan *bridge.TxAck
+
+	// tracer exports spans of the packet lifecycle if "tracing_conf" is set, or is nil.
+	// A nil tracer starts no spans, so the packet path calls it either way.
+	//
+	// An uplink trace has a span "uplink" with the stages "rx" (one per frame), "process",
+	// "encode", "send" and "ack" (one per server). A downlink trace has a span "downlink"
+	// with the stages "schedule", from the PULL_RESP until the radio is free, and "tx".
+	tracer *tracing.Tracer
+	// ackSpans are the "ack" spans of the traced packets that wait for the ACK of a server.
+	ackSpans struct {
+		sync.Mutex
+		spans map[ackKey]*tracing.Span
+	}
+	// txTraces are the traces of the queued downlinks, accessed by the main loop only.
+	txTraces map[*lora.TxPacket]*downlinkTrace
+
+	// apiServer is the local HTTP API if "api_conf" is set, or nil.
+	apiServer *api.Server
+	// statsHistory keeps the last status reports for the API if "api_conf" is set, or nil.
+	statsHistory *api.History
+	// stream pushes the packets to the WebSocket clients of the API if "api_conf" is set, out of
+	// privacy mode, or is nil.
+	stream *api.Stream
+	// adminRequests passes the admin actions to the main loop if "admin" is set in "api_conf", or is nil.
+	adminRequests chan *adminRequest
+	// recentPackets are the metadata of the last uplinks, oldest first, if "admin" is set in
+	// "api_conf". It is only used by the main loop.
+	recentPackets []*store.Record
+	// injected are the uplinks of the "inject" admin action, as of cmd/inject, until the main
+	// loop takes them with the received ones. It is only used by the main loop.
+	injected []*lora.RxPacket
+
+	// statusLEDs are the status LEDs if "led_conf" is set, or nil.
+	statusLEDs *led.LEDs
+	// statusDisplay shows the gateway status if "display_conf" is set, or is nil.
+	statusDisplay *display.SSD1306
+	// shown is what the display shows besides the gateway EUI and the server status.
+	shown struct {
+		sync.Mutex
+		rx, tx int
+		lastRx string
+	}
+}
+
+// newGateway returns a gateway with the defaults of the config, which serve changes.
+func newGateway() *Gateway {
+	gw := &Gateway{
+		keepalive:       60 * time.Second,
+		statusReport:    240 * time.Second,
+		laddr:           &net.UDPAddr{IP: net.IPv4zero},
+		degradedLatency: time.Second,
+		degradedLoss:    20,
+		stat:            new(fwd.Statistic),
+		noise:           newNoiseFloor(),
+		chanTx:          make(chan *downlink),
+		clock:           clock.Real,
+		settle:          500 * time.Millisecond,
+		syncs:           make(chan struct{}),
+		done:            make(chan struct{}),
+		txTiming: metrics.NewHistogram(
+			-10*time.Millisecond, -5*time.Millisecond, -2*time.Millisecond, -1*time.Millisecond, 0,
+			1*time.Millisecond, 2*time.Millisecond, 5*time.Millisecond, 10*time.Millisecond,
+			20*time.Millisecond, 50*time.Millisecond, 100*time.Millisecond,
+		),
+		immeAcks:   make(map[*lora.TxPacket]*downlink),
+		joins:      make(map[string]*joinDevice),
+		uplinkLoss: make(map[lorawan.DevAddr]*deviceLoss),
+		txTraces:   make(map[*lora.TxPacket]*downlinkTrace),
+	}
+	gw.pending.pushes = make(map[fwd.Token]*pendingPush)
+	gw.txAirtime.servers = make(map[string]*airtimeUsage)
+	gw.txAirtime.devices = make(map[string]*airtimeUsage)
+	gw.rxWindows.devices = make(map[string]*rxWindowStats)
+	gw.bridged.pending = make(map[*lora.RxPacket]*bridge.Uplink)
+	gw.bridged.acks = make(map[bridgeAckKey]*bridgeAck)
+	gw.ackSpans.spans = make(map[ackKey]*tracing.Span)
+	gw.crashes.workers = make(map[string]int)
+	gw.shown.lastRx = "LAST -"
+	return gw
+}
+
+// errStopped is returned by Sync once the gateway stopped.
+var errStopped = errors.New("gateway stopped")
+
+// Sync returns once the main loop handled the ticks of its clock that it received, or ctx.Err()
+// if ctx is done first, for the tests that time the gateway with a clock.Fake, as
+// forwarder.Forwarder.Sync.
+func (gw *Gateway) Sync(ctx context.Context) error {
+	select {
+	case gw.syncs <- struct{}{}:
+		return nil
+	case <-gw.done:
+		return errStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done is closed once serve returned, after its context is done.
+func (gw *Gateway) Done() <-chan struct{} {
+	return gw.done
+}
@@ -0,0 +1,168 @@
+// Package gps reads the position of the gateway from a GPS receiver that sends NMEA 0183
+// sentences over a serial port.
+package gps
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/serial"
+)
+
+// Fix is a position of the receiver.
+type Fix struct {
+	Latitude   float64 // in degrees, north positive
+	Longitude  float64 // in degrees, east positive
+	Altitude   float64 // in m above mean sea level
+	Satellites int
+	Time       time.Time // when the fix was read
+}
+
+// Receiver keeps the last fix of a GPS receiver. It is safe for concurrent use.
+type Receiver struct {
+	port io.ReadCloser
+
+	mu  sync.Mutex
+	fix *Fix
+	err error // the read error, once the port failed
+}
+
+// Open opens the receiver on the serial device with the baud rate, 9600 if 0,
+// and reads its sentences in the background.
+func Open(device string, baud int) (*Receiver, error) {
+	if baud == 0 {
+		baud = 9600
+	}
+	port, err := serial.Open(device, baud)
+	if err != nil {
+		return nil, fmt.Errorf("gps: %v", err)
+	}
+	return New(port), nil
+}
+
+// New returns a Receiver that reads the sentences of port until it is closed.
+func New(port io.ReadCloser) *Receiver {
+	r := &Receiver{port: port}
+	go r.read()
+	return r
+}
+
+func (r *Receiver) read() {
+	s := bufio.NewScanner(r.port)
+	for s.Scan() {
+		fix, err := ParseGGA(strings.TrimSpace(s.Text()))
+		if err != nil {
+			continue
+		}
+		fix.Time = time.Now()
+		r.mu.Lock()
+		r.fix = &fix
+		r.mu.Unlock()
+	}
+	r.mu.Lock()
+	r.err = s.Err()
+	if r.err == nil {
+		r.err = io.EOF
+	}
+	r.mu.Unlock()
+}
+
+// Fix returns the last fix, or false if the receiver had none yet.
+func (r *Receiver) Fix() (Fix, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fix == nil {
+		return Fix{}, false
+	}
+	return *r.fix, true
+}
+
+// Err returns the error that ended the reading of the port, or nil while it is read.
+func (r *Receiver) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Receiver) Close() error {
+	return r.port.Close()
+}
+
+var (
+	errNotGGA = errors.New("not a GGA sentence")
+	errNoFix  = errors.New("no fix")
+)
+
+// ParseGGA parses a GGA sentence of any talker, as in "$GPGGA,..." or "$GNGGA,...",
+// and returns the fix it reports. The checksum is checked if there is one.
+func ParseGGA(sentence string) (Fix, error) {
+	if len(sentence) < 7 || sentence[0] != '$' || sentence[3:6] != "GGA" {
+		return Fix{}, errNotGGA
+	}
+	body := sentence[1:]
+	if i := strings.IndexByte(body, '*'); i >= 0 {
+		want, err := strconv.ParseUint(body[i+1:], 16, 8)
+		if err != nil {
+			return Fix{}, fmt.Errorf("bad checksum %q", body[i+1:])
+		}
+		var sum byte
+		for j := 0; j < i; j++ {
+			sum ^= body[j]
+		}
+		if sum != byte(want) {
+			return Fix{}, fmt.Errorf("checksum %02X, want %02X", sum, want)
+		}
+		body = body[:i]
+	}
+	f := strings.Split(body, ",")
+	// GPGGA,time,lat,N,lon,E,quality,satellites,hdop,altitude,M,...
+	if len(f) < 10 {
+		return Fix{}, errors.New("short GGA sentence")
+	}
+	if f[6] == "" || f[6] == "0" {
+		return Fix{}, errNoFix
+	}
+	lat, err := parseCoord(f[2], f[3], 2)
+	if err != nil {
+		return Fix{}, err
+	}
+	lon, err := parseCoord(f[4], f[5], 3)
+	if err != nil {
+		return Fix{}, err
+	}
+	fix := Fix{Latitude: lat, Longitude: lon}
+	fix.Satellites, _ = strconv.Atoi(f[7])
+	fix.Altitude, _ = strconv.ParseFloat(f[9], 64)
+	return fix, nil
+}
+
+// parseCoord parses a coordinate of degrees and minutes, as in "4807.038" with the hemisphere,
+// with the number of digits of the degrees.
+func parseCoord(v, hemisphere string, digits int) (float64, error) {
+	if len(v) < digits {
+		return 0, fmt.Errorf("bad coordinate %q", v)
+	}
+	deg, err := strconv.ParseFloat(v[:digits], 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad coordinate %q", v)
+	}
+	min, err := strconv.ParseFloat(v[digits:], 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad coordinate %q", v)
+	}
+	deg += min / 60
+	switch hemisphere {
+	case "S", "W":
+		deg = -deg
+	case "N", "E":
+	default:
+		return 0, fmt.Errorf("bad hemisphere %q", hemisphere)
+	}
+	return deg, nil
+}
@@ -0,0 +1,242 @@
+// Package gwproto encodes the packets and the stats of the forwarder as Protocol Buffers, as an
+// option to JSON for backhauls with little bandwidth, as cellular or satellite links.
+//
+// The messages are defined in gw.proto. They follow the gw.proto of ChirpStack v4 where the
+// forwarder has the same fields, so the consumers can decode them with its generated code. The
+// package encodes them by hand, without a protobuf library.
+package gwproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// ContentType is the media type of protobuf bodies.
+const ContentType = "application/x-protobuf"
+
+// The values of the CodeRate and CRCStatus enums.
+const (
+	codeRate4_5 = 1
+	crcNone     = 0
+	crcBad      = 1
+	crcOK       = 2
+)
+
+// gatewayID returns the gateway ID as 16 hex digits, as ChirpStack v4 has it.
+func gatewayID(id uint64) string {
+	return fmt.Sprintf("%016x", id)
+}
+
+// counterContext returns the counter of a packet as the context of ChirpStack, 4 bytes big endian.
+func counterContext(countUs uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], countUs)
+	return b[:]
+}
+
+// lrfhssOCW are the occupied channel widths of LR-FHSS in Hz, by the truncated kHz of lora.
+var lrfhssOCW = map[uint16]uint64{137: 136719, 336: 335938, 1523: 1523438}
+
+// loraModulation returns a Modulation with LoraModulationInfo.
+func loraModulation(bw lora.Bandwidth, sf lora.SpreadingFactor, cr lora.Coderate, invertPolar bool, preamble uint16, noCRC bool) message {
+	var params message
+	params.uint(1, uint64(bw.Hz()))
+	params.uint(2, uint64(sf))
+	if cr.Valid() {
+		params.string(3, cr.String())
+		params.uint(5, uint64(cr-lora.CR4_5+codeRate4_5))
+	}
+	params.bool(4, invertPolar)
+	params.uint(6, uint64(preamble))
+	params.bool(7, noCRC)
+	var mod message
+	mod.embed(3, params)
+	return mod
+}
+
+// fskModulation returns a Modulation with FskModulationInfo.
+func fskModulation(freqDev uint8, datarate uint32) message {
+	var params message
+	params.uint(1, uint64(freqDev))
+	params.uint(2, uint64(datarate))
+	var mod message
+	mod.embed(4, params)
+	return mod
+}
+
+// lrfhssModulation returns a Modulation with LrFhssModulationInfo.
+func lrfhssModulation(dr lora.LRFHSSDatarate, cr lora.LRFHSSCoderate) message {
+	var params message
+	params.uint(1, lrfhssOCW[dr.OCW])
+	params.string(2, string(cr))
+	var mod message
+	mod.embed(5, params)
+	return mod
+}
+
+// location returns a Location.
+func location(lat, long, alt float64) message {
+	var loc message
+	loc.double(1, lat)
+	loc.double(2, long)
+	loc.double(3, alt)
+	return loc
+}
+
+// uplink returns an UplinkFrame.
+func uplink(gwID uint64, pkt *lora.RxPacket) message {
+	var txInfo message
+	txInfo.uint(1, uint64(pkt.Freq))
+	switch pkt.Modulation {
+	case lora.ModulationLoRa:
+		txInfo.embed(2, loraModulation(pkt.LoRaBW, pkt.Datarate, pkt.LoRaCR, false, 0, false))
+	case lora.ModulationLRFHSS:
+		txInfo.embed(2, lrfhssModulation(pkt.LRFHSS, pkt.LRFHSSCR))
+	default:
+		txInfo.embed(2, fskModulation(0, pkt.Bitrate))
+	}
+
+	var rxInfo message
+	rxInfo.string(1, gatewayID(gwID))
+	if pkt.Time != nil {
+		rxInfo.timestamp(3, *pkt.Time)
+	}
+	rxInfo.int(6, int64(pkt.RSSI))
+	rxInfo.float(7, pkt.LoRaSNR)
+	rxInfo.uint(8, uint64(pkt.ChainIF))
+	rxInfo.uint(9, uint64(pkt.ChainRF))
+	if pkt.Board != nil {
+		rxInfo.uint(10, uint64(pkt.Board.Board))
+	}
+	if loc := pkt.Location; loc != nil {
+		rxInfo.embed(12, location(loc.Latitude, loc.Longitude, float64(loc.Altitude)))
+	}
+	if !pkt.Replayed {
+		// the counter of replayed packets is stale
+		rxInfo.bytes(13, counterContext(pkt.CountUs))
+	}
+	rxInfo.stringMap(15, pkt.Meta)
+	switch pkt.StatCRC {
+	case 1:
+		rxInfo.uint(16, crcOK)
+	case -1:
+		rxInfo.uint(16, crcBad)
+	default:
+		rxInfo.uint(16, crcNone)
+	}
+
+	var frame message
+	frame.bytes(1, pkt.Data)
+	frame.embed(4, txInfo)
+	frame.embed(5, rxInfo)
+	return frame
+}
+
+// MarshalUplink returns the UplinkFrame of a packet received by the gateway.
+func MarshalUplink(gwID uint64, pkt *lora.RxPacket) []byte {
+	return uplink(gwID, pkt)
+}
+
+// MarshalUplinks returns the UplinkFrames of packets received by the gateway, from the
+// UplinkFrames of MarshalUplink.
+func MarshalUplinks(gwID uint64, frames [][]byte) []byte {
+	var m message
+	m.string(1, gatewayID(gwID))
+	for _, f := range frames {
+		m.embed(2, f)
+	}
+	return m
+}
+
+// downlink returns a DownlinkFrameItem.
+func downlink(radio int, pkt *lora.TxPacket) message {
+	var txInfo message
+	txInfo.uint(1, uint64(pkt.Freq))
+	txInfo.uint(2, uint64(pkt.Power))
+	switch pkt.Modulation {
+	case lora.ModulationLoRa:
+		txInfo.embed(3, loraModulation(pkt.LoRaBW, pkt.Datarate, pkt.LoRaCR, pkt.InvertPolar, pkt.PreambleLength, pkt.NoCRC))
+	case lora.ModulationLRFHSS:
+		txInfo.embed(3, lrfhssModulation(pkt.LRFHSS, pkt.LRFHSSCR))
+	default:
+		txInfo.embed(3, fskModulation(pkt.FreqDev, pkt.Bitrate))
+	}
+	txInfo.uint(4, uint64(radio))
+	var timing message
+	if pkt.Immediate {
+		timing.embed(1, nil)
+	} else {
+		timing.embed(2, nil)
+		txInfo.bytes(7, counterContext(pkt.CountUs))
+	}
+	txInfo.embed(6, timing)
+
+	var item message
+	item.bytes(1, pkt.Data)
+	item.embed(3, txInfo)
+	return item
+}
+
+// stats returns a GatewayStats.
+func stats(gwID uint64, stat *fwd.Statistic) message {
+	var m message
+	m.timestamp(2, stat.TimeStamp)
+	if stat.Latitude != 0 || stat.Longitude != 0 {
+		m.embed(3, location(stat.Latitude, stat.Longitude, float64(stat.Altitude)))
+	}
+	m.uint(5, uint64(stat.Rxnb))
+	m.uint(6, uint64(stat.Rxok))
+	m.uint(7, uint64(stat.Dwnb))
+	m.uint(8, uint64(stat.Txnb))
+	meta := make(map[string]string)
+	for k, v := range map[string]string{"pfrm": stat.Pfrm, "mail": stat.Mail, "desc": stat.Desc} {
+		if v != "" {
+			meta[k] = v
+		}
+	}
+	m.stringMap(10, meta)
+	m.string(17, gatewayID(gwID))
+	return m
+}
+
+// MarshalStats returns the GatewayStats of a status report.
+func MarshalStats(gwID uint64, stat *fwd.Statistic) []byte {
+	return stats(gwID, stat)
+}
+
+// Event is an event of the event bus, with one of Rx, Tx or Stat.
+type Event struct {
+	Type  string
+	Time  time.Time
+	Rx    *lora.RxPacket
+	Tx    *lora.TxPacket
+	Stat  *fwd.Statistic
+	Radio int // of Tx
+	Error string
+}
+
+// MarshalEvent returns the Event of the event bus, prefixed with its length as a varint, so the
+// events can be read from a stream.
+func MarshalEvent(gwID uint64, e *Event) []byte {
+	var m message
+	m.string(1, e.Type)
+	m.timestamp(2, e.Time)
+	if e.Rx != nil {
+		m.embed(3, uplink(gwID, e.Rx))
+	}
+	if e.Tx != nil {
+		m.embed(4, downlink(e.Radio, e.Tx))
+	}
+	if e.Stat != nil {
+		m.embed(5, stats(gwID, e.Stat))
+	}
+	m.uint(6, uint64(e.Radio))
+	m.string(7, e.Error)
+	var framed message
+	framed.varint(uint64(len(m)))
+	return append(framed, m...)
+}
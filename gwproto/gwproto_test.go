@@ -0,0 +1,94 @@
+package gwproto
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+const testGatewayID = 0xAA555A0000000001
+
+var testTime = time.Date(2021, 3, 31, 16, 21, 17, 528002000, time.UTC)
+
+// golden returns the bytes of the hex fields, which may have spaces.
+func golden(t *testing.T, fields ...string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Replace(strings.Join(fields, ""), " ", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestMarshalUplink(t *testing.T) {
+	pkt := &lora.RxPacket{
+		Time:       &testTime,
+		CountUs:    3512348611,
+		Freq:       868100000,
+		StatCRC:    1,
+		Modulation: lora.ModulationLoRa,
+		LoRaBW:     lora.BW125K,
+		LoRaCR:     lora.CR4_5,
+		Datarate:   lora.SF7,
+		RSSI:       -35,
+		LoRaSNR:    5.5,
+		Meta:       map[string]string{"site": "roof"},
+		Data:       []byte{0x40, 0x01, 0x02},
+	}
+	want := golden(t,
+		"0a 03 400102",     // phy_payload
+		"22 17",            // tx_info
+		"  08 a0cff89d03",  // frequency 868100000
+		"  12 0f 1a 0d",    // modulation, lora
+		"    08 c8d007",    // bandwidth 125000
+		"    10 07",        // spreading_factor 7
+		"    1a 03 342f35", // code_rate_legacy "4/5"
+		"    28 01",        // code_rate CR_4_5
+		"2a 47",            // rx_info
+		"  0a 10 61613535356130303030303030303031", // gateway_id "aa555a0000000001"
+		"  1a 0c 08 fdc2928306 10 d0d7e2fb01",      // gw_time 1617207677.528002000
+		"  30 ddffffffffffffffff01",                // rssi -35, sign extended
+		"  3d 0000b040",                            // snr 5.5
+		"  6a 04 d15a2fc3",                         // context, the counter
+		"  7a 0c 0a 04 73697465 12 04 726f6f66",    // metadata site=roof
+		"  8001 02",                                // crc_status CRC_OK
+	)
+	if got := MarshalUplink(testGatewayID, pkt); string(got) != string(want) {
+		t.Errorf("uplink\n%x, want\n%x", got, want)
+	}
+}
+
+func TestMarshalStats(t *testing.T) {
+	stat := &fwd.Statistic{
+		TimeStamp: testTime,
+		Latitude:  46.24,
+		Longitude: 6.01,
+		Altitude:  432,
+		Rxnb:      12,
+		Rxok:      11,
+		Rxfw:      10, // not in GatewayStats
+		Dwnb:      3,
+		Txnb:      2,
+		Pfrm:      "SX1276",
+	}
+	want := golden(t,
+		"12 0c 08 fdc2928306 10 d0d7e2fb01", // time
+		"1a 1b",                             // location
+		"  09 1f85eb51b81e4740",             // latitude 46.24
+		"  11 0ad7a3703d0a1840",             // longitude 6.01
+		"  19 0000000000007b40",             // altitude 432
+		"28 0c",                             // rx_packets_received 12
+		"30 0b",                             // rx_packets_received_ok 11
+		"38 03",                             // tx_packets_received 3
+		"40 02",                             // tx_packets_emitted 2
+		"52 0e 0a 04 7066726d 12 06 535831323736",  // metadata pfrm=SX1276
+		"8a01 10 61613535356130303030303030303031", // gateway_id "aa555a0000000001"
+	)
+	if got := MarshalStats(testGatewayID, stat); string(got) != string(want) {
+		t.Errorf("stats\n%x, want\n%x", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+package gwproto
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"time"
+)
+
+// The wire types of the protobuf encoding.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// message is a protobuf message being encoded. As in proto3, fields with the zero value are
+// left out, except for messages.
+type message []byte
+
+func (m *message) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	*m = append(*m, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func (m *message) tag(field, wire int) {
+	m.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (m *message) uint(field int, v uint64) {
+	if v != 0 {
+		m.tag(field, wireVarint)
+		m.varint(v)
+	}
+}
+
+// int encodes an int32 or int64, which protobuf sign extends to 64 bits.
+func (m *message) int(field int, v int64) {
+	m.uint(field, uint64(v))
+}
+
+func (m *message) bool(field int, v bool) {
+	if v {
+		m.uint(field, 1)
+	}
+}
+
+func (m *message) float(field int, v float32) {
+	if v != 0 {
+		m.tag(field, wireFixed32)
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], math.Float32bits(v))
+		*m = append(*m, buf[:]...)
+	}
+}
+
+func (m *message) double(field int, v float64) {
+	if v != 0 {
+		m.tag(field, wireFixed64)
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+		*m = append(*m, buf[:]...)
+	}
+}
+
+func (m *message) bytes(field int, v []byte) {
+	if len(v) != 0 {
+		m.embed(field, v)
+	}
+}
+
+func (m *message) string(field int, v string) {
+	m.bytes(field, []byte(v))
+}
+
+// embed adds a message, even if it is empty, as the cases of a oneof.
+func (m *message) embed(field int, v []byte) {
+	m.tag(field, wireBytes)
+	m.varint(uint64(len(v)))
+	*m = append(*m, v...)
+}
+
+// stringMap adds a map<string, string>, in the order of the keys so the encoding is stable.
+func (m *message) stringMap(field int, v map[string]string) {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry message
+		entry.string(1, k)
+		entry.string(2, v[k])
+		m.embed(field, entry)
+	}
+}
+
+// timestamp adds a google.protobuf.Timestamp.
+func (m *message) timestamp(field int, t time.Time) {
+	var ts message
+	ts.int(1, t.Unix())
+	ts.int(2, int64(t.Nanosecond()))
+	m.embed(field, ts)
+}
@@ -0,0 +1,365 @@
+// Package harness runs the forwarder library with mock radios and a test network server in
+// virtual time, to script scenarios as "uplink at t=0, PULL_RESP for t=1s, TX at t=1s±1ms" that
+// run at once and the same way each time, for the tests of the forwarder and of the programs
+// built on it. Programs with their own loop, as the single_chan_pkt_fwd command, run it in the
+// harness with Config.StartTarget.
+//
+// The forwarder is timed by a clock.Fake, which only moves with Advance. The radios and the
+// server are real enough: the packets go through the Semtech UDP protocol on the loopback
+// interface, so the waits for the server are in real time, bounded by Config.Timeout.
+package harness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/clock"
+	"github.com/Waziup/single_chan_pkt_fwd/forwarder"
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/internal/testserver"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/mock"
+)
+
+// Backend is the radio backend of the harness, which it sets in the configs of the radios, with
+// a SpiDevice that names the radio, so the configs can go through the JSON of a global_conf.json.
+const Backend = "harness"
+
+// Config is the configuration of a Harness.
+type Config struct {
+	// GatewayID is the EUI of the gateway, 0xAA555A0000000000 if not set.
+	GatewayID uint64
+	// Radios are the receive configs of the radios, one on 868.1 MHz with SF7BW125 if not set.
+	Radios []*lora.Config
+	// Start is the virtual time of the start, 2020-01-01 UTC if not set.
+	Start time.Time
+	// Keepalive and StatInterval of the forwarder, see forwarder.Config.
+	Keepalive    time.Duration
+	StatInterval time.Duration
+	// Timeout is the real time the harness waits for the forwarder and the server, 5s if not set.
+	Timeout time.Duration
+
+	// StartTarget starts the forwarder under test with the environment of the harness, a
+	// forwarder.Forwarder if nil. It returns once the forwarder is started, and the forwarder
+	// stops once ctx is done.
+	StartTarget func(ctx context.Context, env *Env) (Target, error)
+	// PollInterval is the interval at which the target polls its radios, which Uplink advances
+	// by, forwarder.PollInterval if not set.
+	PollInterval time.Duration
+	// Echo is the Echo of the server, which answers the uplinks with downlinks, or nil.
+	Echo func(up *testserver.Uplink) *lora.TxPacket
+}
+
+// Env is the environment a Config.StartTarget configures its forwarder with.
+type Env struct {
+	GatewayID uint64
+	// Radios are the configs of the mock radios, with the backend of the harness.
+	Radios []*lora.Config
+	// Server is the address of the test server.
+	Server *net.UDPAddr
+	// Clock is the virtual time, which the forwarder must be timed by.
+	Clock        *clock.Fake
+	Keepalive    time.Duration
+	StatInterval time.Duration
+}
+
+// Target is a forwarder run by the harness, as forwarder.Forwarder.
+type Target interface {
+	// Sync returns once the forwarder handled the ticks of its clock that it received,
+	// see forwarder.Forwarder.Sync.
+	Sync(ctx context.Context) error
+	// Done is closed once the forwarder stopped.
+	Done() <-chan struct{}
+}
+
+// Tx is a downlink sent by a radio.
+type Tx struct {
+	Radio  int
+	At     time.Duration // the virtual time it was sent, since the start
+	Packet *lora.TxPacket
+}
+
+func (tx *Tx) String() string {
+	return fmt.Sprintf("radio %d at %s: %s", tx.Radio, tx.At, tx.Packet)
+}
+
+// Harness is a forwarder with mock radios and a test server in virtual time, see Start.
+type Harness struct {
+	Clock *clock.Fake
+	// Forwarder is the forwarder under test, or nil if Config.StartTarget started another one.
+	Forwarder *forwarder.Forwarder
+	Server    *testserver.Server
+
+	cfg    Config
+	radios []*radio
+	target Target
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	sent []*Tx
+}
+
+// radio is a mock radio that records its downlinks with their virtual time.
+type radio struct {
+	*mock.Radio
+	h     *Harness
+	index int
+}
+
+func (r *radio) Send(ctx context.Context, pkt *lora.TxPacket) error {
+	if err := r.Radio.Send(ctx, pkt); err != nil {
+		return err
+	}
+	sent := *pkt
+	sent.Data = append([]byte(nil), pkt.Data...)
+	r.h.mu.Lock()
+	r.h.sent = append(r.h.sent, &Tx{Radio: r.index, At: r.h.Now(), Packet: &sent})
+	r.h.mu.Unlock()
+	return nil
+}
+
+// radios are the radios of the harnesses, by the SpiDevice of their config, for the backend.
+var radios = struct {
+	sync.Mutex
+	m    map[string]*radio
+	next int
+}{m: make(map[string]*radio)}
+
+func init() {
+	lora.RegisterBackend(Backend, func(cfg *lora.Config) (lora.Radio, error) {
+		radios.Lock()
+		defer radios.Unlock()
+		r := radios.m[cfg.SpiDevice]
+		if r == nil {
+			return nil, fmt.Errorf("harness: %q is not a radio of a harness", cfg.SpiDevice)
+		}
+		return r, nil
+	})
+}
+
+// Start starts the server and the forwarder, which sends its first PULL_DATA, at the virtual
+// time 0.
+func Start(cfg *Config) (*Harness, error) {
+	h := &Harness{cfg: *cfg}
+	if h.cfg.GatewayID == 0 {
+		h.cfg.GatewayID = 0xAA555A0000000000
+	}
+	if len(h.cfg.Radios) == 0 {
+		h.cfg.Radios = []*lora.Config{{Freq: 868100000, Modulation: lora.ModulationLoRa, Datarate: lora.SF7, LoRaBW: lora.BW125K, LoRaCR: lora.CR4_5}}
+	}
+	if h.cfg.Start.IsZero() {
+		h.cfg.Start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if h.cfg.Timeout <= 0 {
+		h.cfg.Timeout = 5 * time.Second
+	}
+	if h.cfg.PollInterval <= 0 {
+		h.cfg.PollInterval = forwarder.PollInterval
+	}
+	h.Clock = clock.NewFake(h.cfg.Start)
+
+	h.Server = testserver.New()
+	h.Server.Echo = h.cfg.Echo
+	if err := h.Server.Listen("127.0.0.1:0"); err != nil {
+		return nil, fmt.Errorf("harness: %w", err)
+	}
+	configs := make([]*lora.Config, len(h.cfg.Radios))
+	radios.Lock()
+	for i, c := range h.cfg.Radios {
+		rc := *c
+		rc.Backend = Backend
+		rc.SpiDevice = fmt.Sprintf("harness:%d", radios.next)
+		radios.next++
+		configs[i] = &rc
+		r := &radio{Radio: mock.NewRadio(), h: h, index: i}
+		h.radios = append(h.radios, r)
+		radios.m[rc.SpiDevice] = r
+	}
+	radios.Unlock()
+	h.cfg.Radios = configs
+
+	var ctx context.Context
+	ctx, h.cancel = context.WithCancel(context.Background())
+	start := h.cfg.StartTarget
+	if start == nil {
+		start = h.startForwarder
+	}
+	var err error
+	h.target, err = start(ctx, &Env{
+		GatewayID:    h.cfg.GatewayID,
+		Radios:       configs,
+		Server:       h.Server.Addr(),
+		Clock:        h.Clock,
+		Keepalive:    h.cfg.Keepalive,
+		StatInterval: h.cfg.StatInterval,
+	})
+	if err != nil {
+		h.cancel()
+		h.unregister()
+		h.Server.Close()
+		return nil, err
+	}
+	// the forwarder makes its timers in its loop
+	if err := h.settle(); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// startForwarder starts a forwarder.Forwarder, the target if Config.StartTarget is nil.
+func (h *Harness) startForwarder(ctx context.Context, env *Env) (Target, error) {
+	h.Forwarder = forwarder.New(&forwarder.Config{
+		GatewayID:    env.GatewayID,
+		Radios:       env.Radios,
+		Servers:      []string{env.Server.String()},
+		Keepalive:    env.Keepalive,
+		StatInterval: env.StatInterval,
+		Clock:        env.Clock,
+	})
+	if err := h.Forwarder.Start(ctx); err != nil {
+		return nil, err
+	}
+	return h.Forwarder, nil
+}
+
+func (h *Harness) unregister() {
+	radios.Lock()
+	for _, c := range h.cfg.Radios {
+		delete(radios.m, c.SpiDevice)
+	}
+	radios.Unlock()
+}
+
+// Close stops the forwarder and the server.
+func (h *Harness) Close() error {
+	h.cancel()
+	select {
+	case <-h.target.Done():
+	case <-time.After(h.cfg.Timeout):
+	}
+	h.unregister()
+	return h.Server.Close()
+}
+
+// Now returns the virtual time since the start.
+func (h *Harness) Now() time.Duration {
+	return h.Clock.Now().Sub(h.cfg.Start)
+}
+
+// Advance moves the virtual time by d, stopping at each deadline of the forwarder for it to
+// handle it, so its polls, downlinks, keepalives and stats happen at their time.
+func (h *Harness) Advance(d time.Duration) error {
+	end := h.Clock.Now().Add(d)
+	for {
+		next, ok := h.Clock.Next()
+		if !ok || next.After(end) {
+			break
+		}
+		h.Clock.Advance(next.Sub(h.Clock.Now()))
+		if err := h.settle(); err != nil {
+			return err
+		}
+	}
+	h.Clock.Advance(end.Sub(h.Clock.Now()))
+	return h.settle()
+}
+
+// AdvanceTo moves the virtual time to t since the start, see Advance.
+func (h *Harness) AdvanceTo(t time.Duration) error {
+	if t < h.Now() {
+		return fmt.Errorf("harness: can not go back from %s to %s", h.Now(), t)
+	}
+	return h.Advance(t - h.Now())
+}
+
+// settle waits for the forwarder to handle the ticks of the clock.
+func (h *Harness) settle() error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.Timeout)
+	defer cancel()
+	for h.Clock.Waiting() != 0 {
+		select {
+		case <-time.After(100 * time.Microsecond):
+		case <-ctx.Done():
+			return fmt.Errorf("harness: the forwarder did not take the ticks at %s", h.Now())
+		}
+	}
+	if err := h.target.Sync(ctx); err != nil {
+		return fmt.Errorf("harness: %w", err)
+	}
+	return nil
+}
+
+// Uplink injects an uplink into a radio and advances by the PollInterval of the config, to the
+// next poll of the forwarder, which receives it, as its CountUs tells. It returns the uplink as
+// the server got it.
+func (h *Harness) Uplink(radio int, pkt *lora.RxPacket) (*lora.RxPacket, error) {
+	if radio < 0 || radio >= len(h.radios) {
+		return nil, fmt.Errorf("harness: no radio %d", radio)
+	}
+	h.radios[radio].Inject(pkt)
+	if err := h.Advance(h.cfg.PollInterval); err != nil {
+		return nil, err
+	}
+	select {
+	case up := <-h.Server.Uplinks:
+		return up.RxPacket, nil
+	case <-time.After(h.cfg.Timeout):
+		return nil, fmt.Errorf("harness: no uplink at the server at %s", h.Now())
+	}
+}
+
+// Downlink sends a downlink from the server in a PULL_RESP, and returns the error of the TX_ACK
+// of the forwarder, which acknowledges it once the downlink is queued. It returns once the
+// forwarder set its timers for the downlink.
+func (h *Harness) Downlink(tx *lora.TxPacket) (fwd.TxAckError, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.Timeout)
+	defer cancel()
+	for {
+		token, err := h.Server.Send(h.cfg.GatewayID, tx)
+		if err == nil {
+			ack, err := h.Server.WaitTxAck(ctx, h.cfg.GatewayID, token)
+			if err != nil {
+				return 0, fmt.Errorf("harness: no TX_ACK: %w", err)
+			}
+			return ack.Error, h.settle()
+		}
+		if !errors.Is(err, testserver.ErrUnknownGateway) {
+			return 0, fmt.Errorf("harness: %w", err)
+		}
+		// the first PULL_DATA is on its way
+		select {
+		case <-time.After(time.Millisecond):
+		case <-ctx.Done():
+			return 0, fmt.Errorf("harness: %w", err)
+		}
+	}
+}
+
+// Sent returns the downlinks sent by the radios so far.
+func (h *Harness) Sent() []*Tx {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]*Tx(nil), h.sent...)
+}
+
+// ExpectTx returns the first downlink sent at at ± tolerance, or an error with the downlinks
+// that were sent.
+func (h *Harness) ExpectTx(at, tolerance time.Duration) (*Tx, error) {
+	sent := h.Sent()
+	for _, tx := range sent {
+		if tx.At >= at-tolerance && tx.At <= at+tolerance {
+			return tx, nil
+		}
+	}
+	lines := make([]string, len(sent))
+	for i, tx := range sent {
+		lines[i] = tx.String()
+	}
+	return nil, fmt.Errorf("harness: no downlink at %s±%s, sent: [%s]", at, tolerance, strings.Join(lines, "; "))
+}
@@ -0,0 +1,155 @@
+package harness_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/harness"
+	"github.com/Waziup/single_chan_pkt_fwd/internal/testserver"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// uplink is an unconfirmed data up of 26:01:02:03.
+var uplink = []byte{0x40, 0x03, 0x02, 0x01, 0x26, 0x00, 0x01, 0x00, 0x01, 0xAB, 0x11, 0x22, 0x33, 0x44}
+
+// rx1 returns a downlink in the RX1 window of the uplink, one second after it.
+func rx1(up *lora.RxPacket) *lora.TxPacket {
+	return &lora.TxPacket{
+		CountUs:     up.CountUs + 1000000,
+		Freq:        868100000,
+		Power:       14,
+		Modulation:  lora.ModulationLoRa,
+		LoRaBW:      lora.BW125K,
+		LoRaCR:      lora.CR4_5,
+		Datarate:    lora.SF7,
+		InvertPolar: true,
+		Data:        []byte{0x60, 0x04, 0x03, 0x02, 0x01, 0x00, 0x01, 0x00, 0xAA, 0xBB, 0xCC, 0xDD},
+	}
+}
+
+// start starts a harness of the forwarder library, whose TX_ACK has no error if the downlink is
+// queued. The test closes it.
+func start(t *testing.T, cfg *harness.Config) *harness.Harness {
+	t.Helper()
+	h, err := harness.Start(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestRX1(t *testing.T) {
+	h := start(t, &harness.Config{})
+	defer h.Close()
+
+	up, err := h.Uplink(0, &lora.RxPacket{Data: uplink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := h.Now()
+	if ack, err := h.Downlink(rx1(up)); err != nil {
+		t.Fatal(err)
+	} else if ack != 0 {
+		t.Fatalf("TX_ACK %v, want none", ack)
+	}
+	if err := h.Advance(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.ExpectTx(received+time.Second, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(h.Sent()); n != 1 {
+		t.Errorf("%d downlinks sent, want 1", n)
+	}
+}
+
+func TestTooLate(t *testing.T) {
+	h := start(t, &harness.Config{})
+	defer h.Close()
+
+	up, err := h.Uplink(0, &lora.RxPacket{Data: uplink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the PULL_RESP comes after the RX1 window
+	if err := h.Advance(1500 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := h.Downlink(rx1(up)); err != nil {
+		t.Fatal(err)
+	} else if ack != fwd.ErrTooLate {
+		t.Fatalf("TX_ACK %v, want %v", ack, fwd.ErrTooLate)
+	}
+	if err := h.Advance(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if sent := h.Sent(); len(sent) != 0 {
+		t.Errorf("sent %v, want nothing", sent)
+	}
+}
+
+func TestCollision(t *testing.T) {
+	h := start(t, &harness.Config{})
+	defer h.Close()
+
+	up, err := h.Uplink(0, &lora.RxPacket{Data: uplink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := h.Now()
+	if ack, err := h.Downlink(rx1(up)); err != nil {
+		t.Fatal(err)
+	} else if ack != 0 {
+		t.Fatalf("TX_ACK %v, want none", ack)
+	}
+	// 10ms later, while the first one is on air
+	overlapping := rx1(up)
+	overlapping.CountUs += 10000
+	if ack, err := h.Downlink(overlapping); err != nil {
+		t.Fatal(err)
+	} else if ack != fwd.ErrCollisionPacket {
+		t.Fatalf("TX_ACK %v, want %v", ack, fwd.ErrCollisionPacket)
+	}
+	if err := h.Advance(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.ExpectTx(received+time.Second, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if sent := h.Sent(); len(sent) != 1 {
+		t.Errorf("sent %v, want the first downlink only", sent)
+	}
+}
+
+// TestEcho runs the forwarder against the echo of the test server: the uplink of the mock radio
+// comes back in a PULL_RESP for RX1, which the radio sends and the forwarder acknowledges with
+// a TX_ACK.
+func TestEcho(t *testing.T) {
+	h := start(t, &harness.Config{Echo: testserver.EchoDownlink(time.Second, 14)})
+	defer h.Close()
+
+	if _, err := h.Uplink(0, &lora.RxPacket{Data: uplink}); err != nil {
+		t.Fatal(err)
+	}
+	received := h.Now()
+	select {
+	case ack := <-h.Server.TxAcks:
+		if ack.Error != 0 {
+			t.Fatalf("TX_ACK %v, want none", ack.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no TX_ACK")
+	}
+	if err := h.Advance(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := h.ExpectTx(received+time.Second, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tx.Packet.Data, uplink) {
+		t.Errorf("sent %X, want the uplink %X", tx.Packet.Data, uplink)
+	}
+}
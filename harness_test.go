@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/harness"
+	"github.com/Waziup/single_chan_pkt_fwd/internal/testserver"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// startGateway serves a Gateway in the environment of a harness, configured by a global_conf.json
+// as the command is.
+func startGateway(ctx context.Context, env *harness.Env) (harness.Target, error) {
+	radios, err := json.Marshal(env.Radios)
+	if err != nil {
+		return nil, err
+	}
+	data := fmt.Sprintf(`{
+	"radios": %s,
+	"gateway_conf": {
+		"gateway_ID": "%016X",
+		"keepalive_interval": %d,
+		"statusReport_interval": %d,
+		"servers": [{"server_address": %q, "serv_port_up": %d, "serv_port_down": %d, "serv_enabled": true}]
+	}
+}`, radios, env.GatewayID, env.Keepalive/time.Second, env.StatInterval/time.Second,
+		env.Server.IP.String(), env.Server.Port, env.Server.Port)
+
+	gw := newGateway()
+	gw.clock = env.Clock
+	// the mock radios need no time to settle
+	gw.settle = 0
+	go gw.serve(ctx, []byte(data), false)
+	return gw, nil
+}
+
+// startHarness runs a Gateway in a harness, started by cfg.StartTarget if set. The test closes it.
+func startHarness(t *testing.T, cfg *harness.Config) *harness.Harness {
+	t.Helper()
+	if cfg.StartTarget == nil {
+		cfg.StartTarget = startGateway
+	}
+	cfg.PollInterval = checkReceived
+	h, err := harness.Start(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// rx1 returns a downlink in the RX1 window of the uplink, one second after it.
+func rx1(up *lora.RxPacket) *lora.TxPacket {
+	return &lora.TxPacket{
+		CountUs:     up.CountUs + 1000000,
+		Freq:        868100000,
+		Power:       14,
+		Modulation:  lora.ModulationLoRa,
+		LoRaBW:      lora.BW125K,
+		LoRaCR:      lora.CR4_5,
+		Datarate:    lora.SF7,
+		InvertPolar: true,
+		Data:        []byte{0x60, 0x04, 0x03, 0x02, 0x01, 0x00, 0x01, 0x00, 0xAA, 0xBB, 0xCC, 0xDD},
+	}
+}
+
+// uplink is an unconfirmed data up of 26:01:02:03.
+var uplink = []byte{0x40, 0x03, 0x02, 0x01, 0x26, 0x00, 0x01, 0x00, 0x01, 0xAB, 0x11, 0x22, 0x33, 0x44}
+
+func TestGatewayRX1(t *testing.T) {
+	h := startHarness(t, &harness.Config{})
+	defer h.Close()
+
+	up, err := h.Uplink(0, &lora.RxPacket{Data: uplink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := h.Now()
+	if ack, err := h.Downlink(rx1(up)); err != nil {
+		t.Fatal(err)
+	} else if ack != fwd.NoError {
+		t.Fatalf("TX_ACK %v, want none", ack)
+	}
+	if err := h.Advance(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.ExpectTx(received+time.Second, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(h.Sent()); n != 1 {
+		t.Errorf("%d downlinks sent, want 1", n)
+	}
+}
+
+func TestGatewayTooLate(t *testing.T) {
+	h := startHarness(t, &harness.Config{})
+	defer h.Close()
+
+	up, err := h.Uplink(0, &lora.RxPacket{Data: uplink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the PULL_RESP comes after the RX1 window
+	if err := h.Advance(1500 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := h.Downlink(rx1(up)); err != nil {
+		t.Fatal(err)
+	} else if ack != fwd.ErrTooLate {
+		t.Fatalf("TX_ACK %v, want %v", ack, fwd.ErrTooLate)
+	}
+	if err := h.Advance(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if sent := h.Sent(); len(sent) != 0 {
+		t.Errorf("sent %v, want nothing", sent)
+	}
+}
+
+func TestGatewayCollision(t *testing.T) {
+	h := startHarness(t, &harness.Config{})
+	defer h.Close()
+
+	up, err := h.Uplink(0, &lora.RxPacket{Data: uplink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := h.Now()
+	if ack, err := h.Downlink(rx1(up)); err != nil {
+		t.Fatal(err)
+	} else if ack != fwd.NoError {
+		t.Fatalf("TX_ACK %v, want none", ack)
+	}
+	// 10ms later, while the first one is on air
+	overlapping := rx1(up)
+	overlapping.CountUs += 10000
+	if ack, err := h.Downlink(overlapping); err != nil {
+		t.Fatal(err)
+	} else if ack != fwd.ErrCollisionPacket {
+		t.Fatalf("TX_ACK %v, want %v", ack, fwd.ErrCollisionPacket)
+	}
+	if err := h.Advance(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.ExpectTx(received+time.Second, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if sent := h.Sent(); len(sent) != 1 {
+		t.Errorf("sent %v, want the first downlink only", sent)
+	}
+}
+
+// barrier returns once the server got the packets the gateway sent so far, as it gets them in
+// order, by passing an uplink after them. The uplink advances the time to the next poll.
+func barrier(t *testing.T, h *harness.Harness) {
+	t.Helper()
+	if _, err := h.Uplink(0, &lora.RxPacket{Data: uplink}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGatewayKeepalive(t *testing.T) {
+	h := startHarness(t, &harness.Config{Keepalive: 10 * time.Second})
+	defer h.Close()
+	select {
+	case <-h.Server.Pulls:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no PULL_DATA at the start")
+	}
+
+	for _, step := range []struct {
+		at    time.Duration
+		pulls int
+	}{
+		{9 * time.Second, 0},  // checked at 9.5s
+		{10 * time.Second, 1}, // at 10s, checked at 10.5s
+		{19 * time.Second, 0},
+		{39 * time.Second, 2}, // at 20s and 30s
+	} {
+		if err := h.AdvanceTo(step.at); err != nil {
+			t.Fatal(err)
+		}
+		barrier(t, h)
+		if n := len(h.Server.Pulls); n != step.pulls {
+			t.Errorf("%d PULL_DATA by %s, want %d", n, h.Now(), step.pulls)
+		}
+		for len(h.Server.Pulls) != 0 {
+			<-h.Server.Pulls
+		}
+	}
+}
+
+func TestGatewayStatInterval(t *testing.T) {
+	h := startHarness(t, &harness.Config{StatInterval: 30 * time.Second})
+	defer h.Close()
+	stats := func(rxnb int64) {
+		t.Helper()
+		select {
+		case stat := <-h.Server.Stats:
+			if stat.Rxnb != rxnb {
+				t.Errorf("stats of %d uplinks by %s, want %d", stat.Rxnb, h.Now(), rxnb)
+			}
+		default:
+			t.Fatalf("no stats by %s", h.Now())
+		}
+	}
+
+	// the polls at 30s and 60s, which are due with the stats, receive nothing
+	if err := h.AdvanceTo(29 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	barrier(t, h) // at 29.5s
+	if n := len(h.Server.Stats); n != 0 {
+		t.Fatalf("%d stats by %s, want none", n, h.Now())
+	}
+	if err := h.AdvanceTo(30200 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	barrier(t, h) // at 30.5s
+	stats(1)
+
+	barrier(t, h) // at 31s
+	if err := h.AdvanceTo(60200 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	barrier(t, h)
+	stats(2)
+}
+
+// TestGatewaysConcurrent runs two gateways at once in the process, each with its own radios,
+// server and clock, which must not share state, as go test -race checks.
+func TestGatewaysConcurrent(t *testing.T) {
+	for i, id := range []uint64{0xAA555A0000000001, 0xAA555A0000000002} {
+		i, id := i, id
+		t.Run(fmt.Sprintf("%016X", id), func(t *testing.T) {
+			t.Parallel()
+			h := startHarness(t, &harness.Config{GatewayID: id, Keepalive: 10 * time.Second, StatInterval: 5 * time.Second})
+			defer h.Close()
+			for n := 0; n < 3; n++ {
+				up, err := h.Uplink(0, &lora.RxPacket{Data: uplink})
+				if err != nil {
+					t.Fatal(err)
+				}
+				received := h.Now()
+				tx := rx1(up)
+				tx.Data = append([]byte(nil), tx.Data...)
+				tx.Data[len(tx.Data)-1] = byte(i<<4 | n)
+				if ack, err := h.Downlink(tx); err != nil {
+					t.Fatal(err)
+				} else if ack != fwd.NoError {
+					t.Fatalf("TX_ACK %v, want none", ack)
+				}
+				if err := h.Advance(4 * time.Second); err != nil {
+					t.Fatal(err)
+				}
+				sent, err := h.ExpectTx(received+time.Second, time.Millisecond)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(sent.Packet.Data, tx.Data) {
+					t.Errorf("sent %X, want %X", sent.Packet.Data, tx.Data)
+				}
+			}
+			if n := len(h.Sent()); n != 3 {
+				t.Errorf("%d downlinks sent, want 3", n)
+			}
+		})
+	}
+}
+
+// TestGatewayEcho runs the gateway against the echo of the test server: the uplink of the mock
+// radio gets a PUSH_ACK and comes back in a PULL_RESP for RX1, which the radio sends and the
+// gateway acknowledges with a TX_ACK.
+func TestGatewayEcho(t *testing.T) {
+	var gw *Gateway
+	h := startHarness(t, &harness.Config{
+		Echo: testserver.EchoDownlink(time.Second, 14),
+		StartTarget: func(ctx context.Context, env *harness.Env) (harness.Target, error) {
+			target, err := startGateway(ctx, env)
+			gw, _ = target.(*Gateway)
+			return target, err
+		},
+	})
+	defer h.Close()
+
+	if _, err := h.Uplink(0, &lora.RxPacket{Data: uplink}); err != nil {
+		t.Fatal(err)
+	}
+	received := h.Now()
+	select {
+	case ack := <-h.Server.TxAcks:
+		if ack.Error != fwd.NoError {
+			t.Fatalf("TX_ACK %v, want none", ack.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no TX_ACK")
+	}
+	// the server sent the PUSH_ACK before the PULL_RESP, so the gateway got it
+	server := gw.servers[0]
+	server.mu.Lock()
+	unacked, acked := len(server.sent), len(server.answered)
+	server.mu.Unlock()
+	if unacked != 0 || acked != 2 {
+		t.Errorf("%d requests not acknowledged and %d acknowledged, want the PULL_DATA and the PUSH_DATA acknowledged", unacked, acked)
+	}
+
+	if err := h.Advance(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := h.ExpectTx(received+time.Second, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tx.Packet.Data, uplink) {
+		t.Errorf("sent %X, want the uplink %X", tx.Packet.Data, uplink)
+	}
+}
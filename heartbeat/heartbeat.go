@@ -0,0 +1,188 @@
+// Package heartbeat reports the health of the gateway to a fleet endpoint, independent of the
+// LoRaWAN servers, so operators of many gateways see which are up, hot or failing.
+package heartbeat
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/proxy"
+	"github.com/Waziup/single_chan_pkt_fwd/sysinfo"
+)
+
+// Config is the "heartbeat_conf" section of the gateway config.
+type Config struct {
+	// URL the reports are posted to, as "https://fleet.example.com/heartbeat".
+	URL string `json:"url"`
+	// Interval in seconds between reports, 300 if not set.
+	Interval int `json:"interval"`
+	// Headers are sent with each report, e.g. the token of the fleet endpoint.
+	Headers map[string]string `json:"headers"`
+	// Timeout for each request in seconds, 10 if not set.
+	Timeout int `json:"timeout"`
+	// Proxy is the HTTP or SOCKS5 proxy URL, see proxy.Transport.
+	Proxy string `json:"proxy"`
+}
+
+// Report is the JSON body posted to the URL.
+type Report struct {
+	GatewayID string    `json:"gateway_id"`
+	Time      time.Time `json:"time"`
+	// Uptime is the time since the forwarder started, and SystemUptime since the host booted, in seconds.
+	Uptime       int64 `json:"uptime"`
+	SystemUptime int64 `json:"system_uptime,omitempty"`
+	// CPUTemp is the temperature of the CPU in degrees Celsius, if the host has a sensor.
+	CPUTemp *float64 `json:"cpu_temp,omitempty"`
+	// Memory of the host, and HeapBytes of the forwarder.
+	Memory    *sysinfo.Memory `json:"memory,omitempty"`
+	HeapBytes uint64          `json:"heap_bytes"`
+	// Packets are the packet counters since the forwarder started.
+	Packets Counters `json:"packets"`
+	// LastError is the last error logged, if any.
+	LastError *Error `json:"last_error,omitempty"`
+}
+
+// Counters are the totals of the fields of the same names of the status reports.
+type Counters struct {
+	Rxnb int64 `json:"rxnb"` // received
+	Rxok int64 `json:"rxok"` // received with a valid CRC
+	Rxfw int64 `json:"rxfw"` // forwarded
+	Dwnb int64 `json:"dwnb"` // downlinks received from the servers
+	Txnb int64 `json:"txnb"` // downlinks sent
+}
+
+// Error is an error and when it happened.
+type Error struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Reporter posts a report at each interval in the background.
+type Reporter struct {
+	Logger *log.Logger
+
+	url       string
+	headers   map[string]string
+	interval  time.Duration
+	client    *http.Client
+	gatewayID string
+	started   time.Time
+
+	mu        sync.Mutex
+	packets   Counters
+	lastError *Error
+}
+
+// New returns a Reporter for the gateway and starts reporting.
+func New(cfg *Config, gatewayID uint64) (*Reporter, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("heartbeat: no url")
+	}
+	transport, err := proxy.Transport(cfg.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("heartbeat: %v", err)
+	}
+	r := &Reporter{
+		Logger:    log.New(os.Stdout, "[BEAT ] ", 0),
+		url:       cfg.URL,
+		headers:   cfg.Headers,
+		interval:  300 * time.Second,
+		client:    &http.Client{Timeout: 10 * time.Second, Transport: transport},
+		gatewayID: fmt.Sprintf("%016X", gatewayID),
+		started:   time.Now(),
+	}
+	if cfg.Interval > 0 {
+		r.interval = time.Duration(cfg.Interval) * time.Second
+	}
+	if cfg.Timeout > 0 {
+		r.client.Timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	go r.run()
+	return r, nil
+}
+
+// AddStats adds the counters of a status report, which are reset after each report.
+func (r *Reporter) AddStats(stat *fwd.Statistic) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packets.Rxnb += stat.Rxnb
+	r.packets.Rxok += stat.Rxok
+	r.packets.Rxfw += stat.Rxfw
+	r.packets.Dwnb += stat.Dwnb
+	r.packets.Txnb += stat.Txnb
+}
+
+// SetError sets the last error.
+func (r *Reporter) SetError(msg string) {
+	r.mu.Lock()
+	r.lastError = &Error{Time: time.Now().UTC(), Message: msg}
+	r.mu.Unlock()
+}
+
+// Report returns the current report.
+func (r *Reporter) Report() *Report {
+	now := time.Now()
+	rep := &Report{
+		GatewayID: r.gatewayID,
+		Time:      now.UTC(),
+		Uptime:    int64(now.Sub(r.started) / time.Second),
+	}
+	if up, err := sysinfo.Uptime(); err == nil {
+		rep.SystemUptime = int64(up / time.Second)
+	}
+	if temp, err := sysinfo.CPUTemp(); err == nil {
+		rep.CPUTemp = &temp
+	}
+	rep.Memory, _ = sysinfo.ReadMemory()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	rep.HeapBytes = mem.HeapAlloc
+
+	r.mu.Lock()
+	rep.Packets = r.packets
+	rep.LastError = r.lastError
+	r.mu.Unlock()
+	return rep
+}
+
+func (r *Reporter) run() {
+	for {
+		if err := r.post(r.Report()); err != nil {
+			r.Logger.Printf("can not report: %v", err)
+		}
+		time.Sleep(r.interval)
+	}
+}
+
+func (r *Reporter) post(rep *Report) error {
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range r.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// hopper rotates a radio through the channels of its config, see lora.Config.Hops.
+type hopper struct {
+	cfgs  []*lora.Config // receive config of each hop
+	stats []*fwd.HopStat // of each hop, since the last status report
+	dwell time.Duration
+	i     int       // current hop
+	since time.Time // when the radio hopped to the current hop
+}
+
+func newHopper(index int, cfg *lora.Config, now time.Time) *hopper {
+	h := &hopper{
+		cfgs:  make([]*lora.Config, len(cfg.Hops)),
+		stats: make([]*fwd.HopStat, len(cfg.Hops)),
+		dwell: time.Duration(cfg.DwellTime) * time.Millisecond,
+		since: now,
+	}
+	for i := range cfg.Hops {
+		hop := cfg.Hop(i)
+		h.cfgs[i] = hop
+		h.stats[i] = &fwd.HopStat{
+			Radio: index,
+			Freq:  hop.Freq,
+			Datr:  lora.Datarate{SpreadingFactor: hop.Datarate, Bandwidth: hop.LoRaBW},
+		}
+	}
+	h.stats[0].Hops = 1
+	return h
+}
+
+// cfg returns the receive config of the current hop.
+func (h *hopper) cfg() *lora.Config {
+	return h.cfgs[h.i]
+}
+
+// hop moves to the next hop if the dwell time is over and reports if it did.
+func (h *hopper) hop(now time.Time) bool {
+	if now.Sub(h.since) < h.dwell {
+		return false
+	}
+	h.stats[h.i].Dwell += int64(now.Sub(h.since) / time.Millisecond)
+	h.i = (h.i + 1) % len(h.cfgs)
+	h.since = now
+	h.stats[h.i].Hops++
+	return true
+}
+
+// received counts packets received on the current hop.
+func (h *hopper) received(n int) {
+	h.stats[h.i].Rxnb += int64(n)
+}
+
+// report returns the stats since the last report and resets them.
+func (h *hopper) report(now time.Time) []*fwd.HopStat {
+	h.stats[h.i].Dwell += int64(now.Sub(h.since) / time.Millisecond)
+	h.since = now
+	stats := h.stats
+	h.stats = make([]*fwd.HopStat, len(stats))
+	for i, s := range stats {
+		h.stats[i] = &fwd.HopStat{Radio: s.Radio, Freq: s.Freq, Datr: s.Datr}
+	}
+	return stats
+}
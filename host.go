@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/sysinfo"
+)
+
+// HostConfig is the "host_conf" section of the gateway config. It watches the temperature of
+// the host and, on a Raspberry Pi, the undervoltage and throttling flags of the firmware.
+type HostConfig struct {
+	// Interval in seconds between checks, 30 if not set.
+	Interval int `json:"interval"`
+	// MaxTemp is the CPU temperature in degrees Celsius above which downlinks are limited to
+	// MaxDuty. They are not limited if 0.
+	MaxTemp float64 `json:"max_temp"`
+	// MaxDuty is the percentage of the last hour the radios may send while the host is too hot, 1 if 0.
+	MaxDuty float64 `json:"max_duty"`
+}
+
+// errOverheated ends the traces of downlinks dropped while the host is too hot.
+var errOverheated = errors.New("host overheated, tx duty limited")
+
+// hostStatus is the "host" section of the API.
+type hostStatus struct {
+	CPUTemp *float64       `json:"cpu_temp,omitempty"`
+	Zones   []sysinfo.Zone `json:"thermal_zones,omitempty"`
+	// Throttled are the flags of the firmware in hex, as by "vcgencmd get_throttled", if it has them.
+	Throttled            string `json:"throttled,omitempty"`
+	UnderVoltage         bool   `json:"under_voltage"`
+	UnderVoltageOccurred bool   `json:"under_voltage_occurred"`
+	Throttling           bool   `json:"throttling"`
+	// Overheated is set while the temperature exceeds max_temp and downlinks are limited.
+	Overheated bool `json:"overheated"`
+}
+
+type hostState struct {
+	gw       *Gateway // the status is published to
+	interval time.Duration
+	maxTemp  float64
+	maxDuty  time.Duration // airtime per hour while overheated
+
+	mu         sync.Mutex
+	status     *hostStatus
+	overheated bool
+	txLog      []txRecord // the downlinks of the last hour, oldest first
+}
+
+type txRecord struct {
+	at      time.Time
+	airtime time.Duration
+}
+
+func newHostMonitor(gw *Gateway, cfg *HostConfig) *hostState {
+	h := &hostState{
+		gw:       gw,
+		interval: 30 * time.Second,
+		maxTemp:  cfg.MaxTemp,
+		maxDuty:  36 * time.Second,
+	}
+	if cfg.Interval > 0 {
+		h.interval = time.Duration(cfg.Interval) * time.Second
+	}
+	if cfg.MaxDuty > 0 {
+		h.maxDuty = time.Duration(cfg.MaxDuty / 100 * float64(time.Hour))
+	}
+	return h
+}
+
+// run checks the host at the interval.
+func (h *hostState) run() {
+	var last hostStatus
+	for {
+		s := h.check()
+		if s.UnderVoltage && !last.UnderVoltage {
+			log(LogLevelWarning, "host: undervoltage detected, check the power supply")
+		}
+		if s.Throttling && !last.Throttling {
+			log(LogLevelWarning, "host: CPU throttled")
+		}
+		if s.Overheated != last.Overheated {
+			if s.Overheated {
+				log(LogLevelWarning, "host: CPU at %.1f°C above %.1f°C, limiting downlinks to %s per hour", *s.CPUTemp, h.maxTemp, h.maxDuty)
+			} else {
+				log(LogLevelWarning, "host: CPU cooled down, downlinks no longer limited")
+			}
+		}
+		last = *s
+		if h.gw.apiServer != nil {
+			h.gw.apiServer.Publish("host", s)
+		}
+		if h.gw.exporter != nil {
+			h.gw.exporter.AddHost(s.CPUTemp, s.UnderVoltage, s.Throttling)
+		}
+		time.Sleep(h.interval)
+	}
+}
+
+// check reads the temperatures and the throttling flags.
+func (h *hostState) check() *hostStatus {
+	s := &hostStatus{}
+	if temp, err := sysinfo.CPUTemp(); err == nil {
+		s.CPUTemp = &temp
+	}
+	s.Zones, _ = sysinfo.ThermalZones()
+	if flags, err := sysinfo.ReadThrottled(); err == nil {
+		s.Throttled = fmt.Sprintf("0x%x", uint32(flags))
+		s.UnderVoltage = flags&sysinfo.UnderVoltage != 0
+		s.UnderVoltageOccurred = flags&sysinfo.UnderVoltageOccurred != 0
+		s.Throttling = flags&sysinfo.Throttling != 0
+	}
+	s.Overheated = h.maxTemp != 0 && s.CPUTemp != nil && *s.CPUTemp > h.maxTemp
+
+	h.mu.Lock()
+	h.status = s
+	h.overheated = s.Overheated
+	h.mu.Unlock()
+	return s
+}
+
+// allowTx tells if a downlink may be queued. While the host is too hot, downlinks are
+// allowed until the radios sent for maxDuty in the last hour.
+func (h *hostState) allowTx(pkt *lora.TxPacket, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire(now)
+	if !h.overheated {
+		return true
+	}
+	var used time.Duration
+	for _, r := range h.txLog {
+		used += r.airtime
+	}
+	return used+pkt.Airtime() <= h.maxDuty
+}
+
+// sent records the airtime of a sent downlink.
+func (h *hostState) sent(pkt *lora.TxPacket, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire(now)
+	h.txLog = append(h.txLog, txRecord{at: now, airtime: pkt.Airtime()})
+}
+
+// expire drops the downlinks sent more than an hour ago.
+func (h *hostState) expire(now time.Time) {
+	i := 0
+	for i < len(h.txLog) && now.Sub(h.txLog[i].at) > time.Hour {
+		i++
+	}
+	h.txLog = h.txLog[i:]
+}
@@ -0,0 +1,14 @@
+// +build !nohw
+
+package main
+
+import (
+	"periph.io/x/host/v3"
+	_ "periph.io/x/periph/host/rpi"
+)
+
+// initHost loads the periph.io drivers for the SPI, GPIO and I2C of the host.
+func initHost() error {
+	_, err := host.Init()
+	return err
+}
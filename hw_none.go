@@ -0,0 +1,10 @@
+// +build nohw
+
+package main
+
+import "errors"
+
+// initHost returns an error, as the hardware support is left out with the "nohw" build tag.
+func initHost() error {
+	return errors.New("built without hardware support (nohw)")
+}
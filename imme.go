@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// How an immediate downlink got the radio, logged and sent as "info" in its TX_ACK.
+const (
+	immeIdle        = "RX_IDLE"         // the radio was not receiving a frame
+	immeRxAborted   = "RX_ABORTED"      // the frame being received was dropped
+	immeRxDone      = "RX_DONE"         // the downlink waited until the frame was received
+	immeWaitTimeout = "RX_WAIT_TIMEOUT" // the frame took too long, so it was dropped
+)
+
+// immePoll is the interval at which a waiting immediate downlink checks the radio again.
+const immePoll = 10 * time.Millisecond
+
+// arbitrate decides how the immediate downlink pkt gets the radio, which might be receiving a frame.
+// With wait, the radio is busy and the downlink must be tried again after immePoll.
+// A frame takes at most the time on air of a frame of the max size, which is how long it waits.
+func (gw *Gateway) arbitrate(radio *gatewayRadio, pkt *lora.TxPacket) (decision string, wait bool) {
+	busy := false
+	if r, ok := radio.Radio.(interface{ Receiving() (bool, error) }); ok && radio.receiving {
+		var err error
+		busy, err = r.Receiving()
+		if err != nil {
+			log(LogLevelWarning, "radio %d: can not read modem status: %v", radio.index, err)
+		}
+	}
+	switch {
+	case !busy && gw.immeWaiting.IsZero():
+		return immeIdle, false
+	case !busy:
+		log(LogLevelNormal, "tx: immediate downlink waited %s for the frame being received", gw.clock.Now().Sub(gw.immeWaiting))
+		gw.immeWaiting = time.Time{}
+		return immeRxDone, false
+	case !gw.immeWaitRx:
+		log(LogLevelWarning, "radio %d: aborting the frame being received for an immediate downlink", radio.index)
+		return immeRxAborted, false
+	}
+	cfg := radio.cfg
+	maxWait := lora.Airtime(cfg.Datarate, cfg.LoRaBW, cfg.LoRaCR, lora.MaxPayloadSize, cfg.PreambleLength, true)
+	if gw.immeWaiting.IsZero() {
+		gw.immeWaiting = gw.clock.Now()
+		log(LogLevelVerbose, "radio %d: receiving a frame, immediate downlink waits up to %s", radio.index, maxWait)
+	}
+	if gw.clock.Now().Sub(gw.immeWaiting) < maxWait {
+		return "", true
+	}
+	log(LogLevelWarning, "radio %d: aborting the frame being received after %s for an immediate downlink", radio.index, gw.clock.Now().Sub(gw.immeWaiting))
+	gw.immeWaiting = time.Time{}
+	return immeWaitTimeout, false
+}
+
+// ackImmediate sends the TX_ACK of an immediate downlink with the decision of arbitrate,
+// in the trace of ctx.
+func (gw *Gateway) ackImmediate(ctx context.Context, pkt *lora.TxPacket, decision string) {
+	dl, ok := gw.immeAcks[pkt]
+	if !ok {
+		// restored from the queue file, the server is not waiting for this
+		return
+	}
+	delete(gw.immeAcks, pkt)
+	gw.upstreamTo(ctx, &fwd.Packet{
+		Token:     dl.token,
+		Ident:     fwd.TxAck,
+		TxAck:     fwd.NoError,
+		TxAckInfo: decision,
+	}, dl.server)
+}
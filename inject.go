@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/Waziup/single_chan_pkt_fwd/api"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// injectQueue is the number of injected uplinks that may wait for the receive check of the main loop.
+const injectQueue = 64
+
+var errInjectQueueFull = fmt.Errorf("%w: too many injected uplinks waiting", api.ErrBusy)
+
+// adminInject queues the uplinks of the "rxpk" parameters, each the JSON of an rxpk, as if the
+// radios received them. They go through the whole uplink path, with a tmst of when the main loop
+// takes them, so shell scripts can play test scenarios against a running forwarder.
+func (gw *Gateway) adminInject(params url.Values) (interface{}, error) {
+	rxpks := params["rxpk"]
+	if len(rxpks) == 0 {
+		return nil, fmt.Errorf("%w: no rxpk", api.ErrInvalidParam)
+	}
+	pkts := make([]*lora.RxPacket, len(rxpks))
+	for i, rxpk := range rxpks {
+		pkt := &lora.RxPacket{}
+		if err := json.Unmarshal([]byte(rxpk), pkt); err != nil {
+			return nil, fmt.Errorf("%w: rxpk %d: %v", api.ErrInvalidParam, i, err)
+		}
+		if len(pkt.Data) == 0 {
+			return nil, fmt.Errorf("%w: rxpk %d: no data", api.ErrInvalidParam, i)
+		}
+		pkts[i] = pkt
+	}
+	return gw.inMainLoop(func(radios []*gatewayRadio) (interface{}, error) {
+		if len(gw.injected)+len(pkts) > injectQueue {
+			return nil, errInjectQueueFull
+		}
+		gw.injected = append(gw.injected, pkts...)
+		return map[string]int{"injected": len(pkts)}, nil
+	})
+}
+
+// drainInjected returns the uplinks injected since the last call.
+func (gw *Gateway) drainInjected() []*lora.RxPacket {
+	pkts := gw.injected
+	gw.injected = nil
+	if len(pkts) != 0 {
+		log(LogLevelVerbose, "admin: %d injected uplinks", len(pkts))
+	}
+	return pkts
+}
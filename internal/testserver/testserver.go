@@ -0,0 +1,242 @@
+// Package testserver is the network server side of the packet forwarder UDP protocol,
+// for integration tests and bring-up. It acknowledges all packets and sends downlinks
+// (PULL_RESP) on request, at a scheduled time or as echo of the uplinks.
+package testserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// ErrUnknownGateway is returned if a downlink is sent to a gateway that has not sent a PULL_DATA yet.
+var ErrUnknownGateway = errors.New("gateway has not pulled yet")
+
+// Uplink is a packet received from a gateway.
+type Uplink struct {
+	GatewayID uint64
+	RxPacket  *lora.RxPacket
+	Time      time.Time // when the server received the packet
+}
+
+// Pull is a PULL_DATA received from a gateway, as its keepalive.
+type Pull struct {
+	GatewayID uint64
+	Time      time.Time // when the server received the packet
+}
+
+// TxAck is a TX_ACK received from a gateway.
+type TxAck struct {
+	GatewayID uint64
+	Token     fwd.Token
+	Error     fwd.TxAckError // zero if the gateway sent no error field
+}
+
+// Server is a UDP packet forwarder server. Set the fields before calling Listen.
+// The channels are filled without blocking, so messages are dropped if nobody reads them.
+type Server struct {
+	Uplinks chan *Uplink
+	Pulls   chan *Pull
+	Stats   chan *fwd.Statistic
+	TxAcks  chan *TxAck
+
+	// Echo, if not nil, is called for each uplink and may return a downlink for the gateway.
+	Echo func(up *Uplink) *lora.TxPacket
+
+	// Logger logs all messages, if not nil.
+	Logger *log.Logger
+
+	conn     *net.UDPConn
+	mu       sync.Mutex
+	pullAddr map[uint64]*net.UDPAddr
+	closed   bool
+}
+
+// New returns a server with buffered channels.
+func New() *Server {
+	return &Server{
+		Uplinks:  make(chan *Uplink, 64),
+		Pulls:    make(chan *Pull, 64),
+		Stats:    make(chan *fwd.Statistic, 8),
+		TxAcks:   make(chan *TxAck, 64),
+		pullAddr: make(map[uint64]*net.UDPAddr),
+	}
+}
+
+// Listen listens on the UDP address, as in "127.0.0.1:0", and serves in the background.
+func (s *Server) Listen(addr string) error {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	s.conn, err = net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+	go s.serve()
+	return nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	return s.conn.Close()
+}
+
+// Send sends a downlink to the gateway, which must have sent a PULL_DATA before.
+// It returns the token of the PULL_RESP, which the TX_ACK of the gateway refers to.
+func (s *Server) Send(gatewayID uint64, tx *lora.TxPacket) (fwd.Token, error) {
+	s.mu.Lock()
+	addr := s.pullAddr[gatewayID]
+	s.mu.Unlock()
+	if addr == nil {
+		return fwd.Token{}, fmt.Errorf("%w: %016X", ErrUnknownGateway, gatewayID)
+	}
+	pkt := &fwd.Packet{
+		Token:    fwd.RndToken(),
+		Ident:    fwd.PullResp,
+		TxPacket: tx,
+	}
+	return pkt.Token, s.write(pkt, addr)
+}
+
+// WaitTxAck reads TxAcks until the TX_ACK of the gateway for token arrives, as returned by Send,
+// or returns ctx.Err() once ctx is done. The other TX_ACKs it reads are dropped.
+func (s *Server) WaitTxAck(ctx context.Context, gatewayID uint64, token fwd.Token) (*TxAck, error) {
+	for {
+		select {
+		case ack := <-s.TxAcks:
+			if ack.GatewayID == gatewayID && ack.Token == token {
+				return ack, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Schedule sends a downlink to the gateway at the given time.
+func (s *Server) Schedule(gatewayID uint64, tx *lora.TxPacket, at time.Time) {
+	time.AfterFunc(time.Until(at), func() {
+		if _, err := s.Send(gatewayID, tx); err != nil {
+			s.logf("can not send scheduled downlink: %v", err)
+		}
+	})
+}
+
+func (s *Server) serve() {
+	var buf [65536]byte
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf[:])
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if !closed {
+				s.logf("%v", err)
+			}
+			return
+		}
+		now := time.Now()
+		var pkt fwd.Packet
+		if err := pkt.UnmarshalBinary(buf[:n]); err != nil {
+			s.logf("(<- %s) %v", addr, err)
+			continue
+		}
+		s.logf("(<- %s) %s", addr, &pkt)
+
+		switch pkt.Ident {
+		case fwd.PullData:
+			s.mu.Lock()
+			s.pullAddr[pkt.GatewayID] = addr
+			s.mu.Unlock()
+			s.write(&fwd.Packet{Token: pkt.Token, Ident: fwd.PullAck}, addr)
+			select {
+			case s.Pulls <- &Pull{GatewayID: pkt.GatewayID, Time: now}:
+			default:
+			}
+		case fwd.PushData:
+			s.write(&fwd.Packet{Token: pkt.Token, Ident: fwd.PushAck}, addr)
+			if pkt.Stat != nil {
+				select {
+				case s.Stats <- pkt.Stat:
+				default:
+				}
+			}
+			for _, rx := range pkt.RxPackets {
+				s.uplink(&Uplink{GatewayID: pkt.GatewayID, RxPacket: rx, Time: now})
+			}
+		case fwd.TxAck:
+			select {
+			case s.TxAcks <- &TxAck{GatewayID: pkt.GatewayID, Token: pkt.Token, Error: pkt.TxAck}:
+			default:
+			}
+		}
+	}
+}
+
+func (s *Server) uplink(up *Uplink) {
+	if s.Echo != nil {
+		if tx := s.Echo(up); tx != nil {
+			if _, err := s.Send(up.GatewayID, tx); err != nil {
+				s.logf("can not send echo: %v", err)
+			}
+		}
+	}
+	select {
+	case s.Uplinks <- up:
+	default:
+	}
+}
+
+func (s *Server) write(pkt *fwd.Packet, addr *net.UDPAddr) error {
+	data, err := pkt.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteToUDP(data, addr)
+	if err == nil {
+		s.logf("(-> %s) %s", addr, pkt)
+	}
+	return err
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+// EchoDownlink returns an Echo function that sends each uplink payload back
+// on the same channel, delay after the uplink as a class A receive window does.
+func EchoDownlink(delay time.Duration, power uint8) func(up *Uplink) *lora.TxPacket {
+	return func(up *Uplink) *lora.TxPacket {
+		rx := up.RxPacket
+		return &lora.TxPacket{
+			CountUs:     rx.CountUs + uint32(delay/time.Microsecond),
+			Freq:        rx.Freq,
+			Power:       power,
+			Modulation:  rx.Modulation,
+			LoRaBW:      rx.LoRaBW,
+			LoRaCR:      rx.LoRaCR,
+			Datarate:    rx.Datarate,
+			Bitrate:     rx.Bitrate,
+			InvertPolar: true,
+			Data:        rx.Data,
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+)
+
+// maxJoinAttempts is the number of last join requests kept for each device.
+const maxJoinAttempts = 10
+
+// joinAttempt is a join request of a device and the join accept that answered it, if any.
+type joinAttempt struct {
+	Time     time.Time      `json:"time"`
+	DevNonce uint16         `json:"dev_nonce"`
+	Freq     lora.Frequency `json:"freq"`
+	Datr     lora.Datarate  `json:"datr"`
+	RSSI     float32        `json:"rssi"`
+	SNR      float32        `json:"snr"`
+	// NonceReused is set if the device sent the DevNonce before, which servers reject.
+	NonceReused bool `json:"nonce_reused,omitempty"`
+	// Accepted is the receive window of the join accept, as in "RX1", or empty if none was sent.
+	Accepted string `json:"accepted,omitempty"`
+}
+
+// joinDevice is the join history of a device.
+type joinDevice struct {
+	JoinEUI  lorawan.EUI64 `json:"join_eui"`
+	Requests int           `json:"requests"`
+	Accepts  int           `json:"accepts"`
+	// Attempts are the last join requests, oldest first.
+	Attempts []joinAttempt `json:"attempts"`
+}
+
+// recordJoinRequest adds a join request to the history of its device.
+func (gw *Gateway) recordJoinRequest(pkt *lora.RxPacket, rxTime time.Time) {
+	f, err := lorawan.Decode(pkt.Data)
+	if err != nil || f.MType() != lorawan.JoinRequest || len(f.MACPayload) < 18 {
+		return
+	}
+	var joinEUI, devEUI lorawan.EUI64
+	binary.BigEndian.PutUint64(joinEUI[:], binary.LittleEndian.Uint64(f.MACPayload[0:8]))
+	binary.BigEndian.PutUint64(devEUI[:], binary.LittleEndian.Uint64(f.MACPayload[8:16]))
+	a := joinAttempt{
+		Time:     rxTime.UTC(),
+		DevNonce: binary.LittleEndian.Uint16(f.MACPayload[16:18]),
+		Freq:     pkt.Freq,
+		Datr:     lora.Datarate{SpreadingFactor: pkt.Datarate, Bandwidth: pkt.LoRaBW},
+		RSSI:     pkt.RSSI,
+		SNR:      pkt.LoRaSNR,
+	}
+
+	d := gw.joins[devEUI.String()]
+	if d == nil {
+		if len(gw.joins) >= maxAirtimeDevices {
+			return
+		}
+		d = new(joinDevice)
+		gw.joins[devEUI.String()] = d
+	}
+	d.JoinEUI = joinEUI
+	for _, prev := range d.Attempts {
+		if prev.DevNonce == a.DevNonce {
+			a.NonceReused = true
+			log(LogLevelWarning, "join: %s sent DevNonce %d again, the server will reject it", gw.privacy.id(devEUI.String()), a.DevNonce)
+			break
+		}
+	}
+	d.Requests++
+	if len(d.Attempts) == maxJoinAttempts {
+		d.Attempts = append(d.Attempts[:0], d.Attempts[1:]...)
+	}
+	d.Attempts = append(d.Attempts, a)
+	log(LogLevelVerbose, "join: request of %s for %s, DevNonce %d", gw.privacy.id(devEUI.String()), joinEUI, a.DevNonce)
+	gw.publishJoins()
+}
+
+// recordJoinAccept marks the last join request of a device as accepted in the window.
+// device and window are as returned by correlateRxWindow.
+func (gw *Gateway) recordJoinAccept(device, window string) {
+	d := gw.joins[device]
+	if d == nil || len(d.Attempts) == 0 {
+		return
+	}
+	d.Accepts++
+	d.Attempts[len(d.Attempts)-1].Accepted = window
+	log(LogLevelVerbose, "join: accept for %s in %s", gw.privacy.id(device), window)
+	gw.publishJoins()
+}
+
+// isJoinAccept reports whether a downlink is a join accept.
+func isJoinAccept(pkt *lora.TxPacket) bool {
+	return len(pkt.Data) != 0 && lora.MType(pkt.Data[0]>>5) == lorawan.JoinAccept
+}
+
+// publishJoins sets the "joins" section of the API to a copy of the join histories.
+func (gw *Gateway) publishJoins() {
+	if gw.apiServer == nil {
+		return
+	}
+	s := make(map[string]joinDevice, len(gw.joins))
+	for k, d := range gw.joins {
+		if k = gw.privacy.id(k); k == "" {
+			continue
+		}
+		c := *d
+		c.Attempts = append([]joinAttempt(nil), d.Attempts...)
+		s[k] = c
+	}
+	gw.apiServer.Publish("joins", s)
+}
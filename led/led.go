@@ -0,0 +1,132 @@
+// Package led drives the status LEDs of a gateway enclosure: they blink on received
+// and sent packets, and show whether the network server is reachable.
+package led
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+)
+
+// Config is the "led_conf" section of the gateway config. LEDs without pin are left out.
+type Config struct {
+	// RX is the pin of the LED that blinks on received packets, as "GPIO17".
+	RX string `json:"rx"`
+	// TX is the pin of the LED that blinks on sent packets.
+	TX string `json:"tx"`
+	// Network is the pin of the LED that is on while the network server is reachable.
+	Network string `json:"network"`
+	// Blink is how long the LEDs are on for a packet, in milliseconds, 50 if not set.
+	Blink int `json:"blink"`
+	// ActiveLow is set if the LEDs are on with the pin low.
+	ActiveLow bool `json:"active_low"`
+}
+
+// LEDs are the status LEDs. The methods do nothing for LEDs without pin.
+type LEDs struct {
+	rx, tx, network *led
+}
+
+// Open sets the pins of the config to output, with the LEDs off.
+func Open(cfg *Config) (*LEDs, error) {
+	blink := time.Duration(cfg.Blink) * time.Millisecond
+	if blink <= 0 {
+		blink = 50 * time.Millisecond
+	}
+	l := &LEDs{}
+	var err error
+	if l.rx, err = newLED(cfg.RX, blink, cfg.ActiveLow); err != nil {
+		return nil, err
+	}
+	if l.tx, err = newLED(cfg.TX, blink, cfg.ActiveLow); err != nil {
+		return nil, err
+	}
+	if l.network, err = newLED(cfg.Network, blink, cfg.ActiveLow); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// RX blinks the RX LED.
+func (l *LEDs) RX() {
+	l.rx.blink()
+}
+
+// TX blinks the TX LED.
+func (l *LEDs) TX() {
+	l.tx.blink()
+}
+
+// Network switches the network LED on if the network server is reachable, else off.
+func (l *LEDs) Network(up bool) {
+	l.network.set(up)
+}
+
+// Close switches all LEDs off.
+func (l *LEDs) Close() {
+	for _, led := range []*led{l.rx, l.tx, l.network} {
+		led.set(false)
+	}
+}
+
+type led struct {
+	pin      gpio.PinIO
+	on       gpio.Level // the level that switches the LED on
+	duration time.Duration
+
+	mu    sync.Mutex
+	timer *time.Timer // switches the LED off after a blink
+}
+
+func newLED(name string, blink time.Duration, activeLow bool) (*led, error) {
+	if name == "" {
+		return nil, nil
+	}
+	pin := gpioreg.ByName(name)
+	if pin == nil {
+		return nil, fmt.Errorf("led: unknown pin %q", name)
+	}
+	l := &led{pin: pin, on: gpio.Level(!activeLow), duration: blink}
+	if err := pin.Out(!l.on); err != nil {
+		return nil, fmt.Errorf("led: %s: %v", name, err)
+	}
+	return l, nil
+}
+
+// blink switches the LED on and off again after its duration. Blinks while the LED is on
+// make it stay on, so the LED is on for the whole of a burst of packets.
+func (l *led) blink() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pin.Out(l.on)
+	if l.timer == nil {
+		l.timer = time.AfterFunc(l.duration, l.off)
+	} else {
+		l.timer.Reset(l.duration)
+	}
+}
+
+func (l *led) off() {
+	l.mu.Lock()
+	l.pin.Out(!l.on)
+	l.mu.Unlock()
+}
+
+func (l *led) set(on bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if on {
+		l.pin.Out(l.on)
+	} else {
+		l.pin.Out(!l.on)
+	}
+	l.mu.Unlock()
+}
@@ -0,0 +1,24 @@
+package main
+
+import "time"
+
+// blinkRx blinks the RX LED for a received packet.
+func (gw *Gateway) blinkRx() {
+	if gw.statusLEDs != nil {
+		gw.statusLEDs.RX()
+	}
+}
+
+// blinkTx blinks the TX LED for a sent packet.
+func (gw *Gateway) blinkTx() {
+	if gw.statusLEDs != nil {
+		gw.statusLEDs.TX()
+	}
+}
+
+// runLEDs shows every second whether a server is reachable. It does not return.
+func (gw *Gateway) runLEDs() {
+	for ; ; time.Sleep(time.Second) {
+		gw.statusLEDs.Network(gw.serverReachable())
+	}
+}
@@ -0,0 +1,40 @@
+package lora
+
+import (
+	"math"
+	"time"
+)
+
+// Airtime returns the time on air of a LoRa packet with n payload bytes and an explicit header,
+// as in the Semtech LoRa modem designer's guide (AN1200.13).
+// The preamble is in symbols, 8 if 0. Unknown bandwidths return 0.
+func Airtime(sf SpreadingFactor, bw Bandwidth, cr Coderate, n int, preamble uint16, crc bool) time.Duration {
+	hz := bw.Hz()
+	if hz == 0 {
+		return 0
+	}
+	if preamble == 0 {
+		preamble = 8
+	}
+	tSym := float64(uint32(1)<<uint(sf)) / float64(hz) // seconds
+	de := 0.0
+	if tSym > 0.016 {
+		de = 1 // low data rate optimization
+	}
+	c := 0.0
+	if crc {
+		c = 1
+	}
+	num := float64(8*n) - 4*float64(sf) + 28 + 16*c
+	symbols := 8 + math.Max(math.Ceil(num/(4*(float64(sf)-2*de)))*float64(cr), 0)
+	t := (float64(preamble)+4.25)*tSym + symbols*tSym
+	return time.Duration(t * float64(time.Second))
+}
+
+// Airtime returns the time on air of a LoRa packet, or 0 for FSK.
+func (tx *TxPacket) Airtime() time.Duration {
+	if tx.Modulation != ModulationLoRa {
+		return 0
+	}
+	return Airtime(tx.Datarate, tx.LoRaBW, tx.LoRaCR, len(tx.Data), tx.PreambleLength, !tx.NoCRC)
+}
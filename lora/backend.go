@@ -0,0 +1,43 @@
+package lora
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Backend opens the radio of a config.
+type Backend func(cfg *Config) (Radio, error)
+
+var backends = make(map[string]Backend)
+
+// DefaultBackend is the backend of configs without backend.
+const DefaultBackend = "sx127x"
+
+// RegisterBackend makes a radio backend available by name, see Config.Backend.
+// Backends register in the init function of their file, which may depend on build tags.
+func RegisterBackend(name string, open Backend) {
+	backends[name] = open
+}
+
+// Backends returns the names of the registered backends.
+func Backends() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OpenRadio opens the radio of the config with its backend.
+func OpenRadio(cfg *Config) (Radio, error) {
+	name := cfg.Backend
+	if name == "" {
+		name = DefaultBackend
+	}
+	open, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown radio backend %q, not one of %v", name, Backends())
+	}
+	return open(cfg)
+}
@@ -0,0 +1,50 @@
+package lora
+
+import "fmt"
+
+// Board is a hardware profile of a radio on a board: its wiring, with the periph.io names
+// of the SPI device and reset pin, its RSSI offset and the frequency range of its front end.
+type Board struct {
+	SpiDevice string
+	PinRst    string
+	PinDio0   string
+	// RSSIOffset in dB is added to the RSSI the chip reports, for the losses or gains
+	// of the front end of the board.
+	RSSIOffset float32
+	// MinFreq and MaxFreq are the frequencies the front end and antenna match is made for.
+	MinFreq, MaxFreq Frequency
+}
+
+// Boards are the known boards, by name, see Config.Board.
+var Boards = map[string]Board{
+	// Adafruit LoRa Radio Bonnet with the RFM95W, NSS on CE1
+	"adafruit-bonnet": {SpiDevice: "/dev/spidev0.1", PinRst: "GPIO25", PinDio0: "GPIO22", MinFreq: 862000000, MaxFreq: 1020000000},
+	// Adafruit LoRa Radio Bonnet with the RFM96W, NSS on CE1
+	"adafruit-bonnet-433": {SpiDevice: "/dev/spidev0.1", PinRst: "GPIO25", PinDio0: "GPIO22", MinFreq: 410000000, MaxFreq: 525000000},
+}
+
+// ApplyBoard sets the SPI device, reset and DIO0 pins and RSSI offset of the board of the config,
+// unless they are set already, and limits the frequencies to those of the board, see Validate.
+func (cfg *Config) ApplyBoard() error {
+	if cfg.Board == "" {
+		return nil
+	}
+	b, ok := Boards[cfg.Board]
+	if !ok {
+		return fmt.Errorf("unknown board %q", cfg.Board)
+	}
+	if cfg.SpiDevice == "" {
+		cfg.SpiDevice = b.SpiDevice
+	}
+	if cfg.PinRst == "" {
+		cfg.PinRst = b.PinRst
+	}
+	if cfg.PinDio0 == "" {
+		cfg.PinDio0 = b.PinDio0
+	}
+	if cfg.RSSIOffset == 0 {
+		cfg.RSSIOffset = b.RSSIOffset
+	}
+	cfg.board = &b
+	return nil
+}
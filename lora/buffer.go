@@ -0,0 +1,49 @@
+package lora
+
+import "sync"
+
+// MaxPayloadSize is the size of the radio FIFO, so no received payload can be larger.
+const MaxPayloadSize = 256
+
+type payloadBuffer [MaxPayloadSize]byte
+
+var payloadPool = sync.Pool{
+	New: func() interface{} {
+		return new(payloadBuffer)
+	},
+}
+
+// NewRxPacket returns a packet with a Data slice of length n (at most MaxPayloadSize)
+// that is backed by a pooled buffer. Call Release to return the buffer to the pool.
+func NewRxPacket(n int) *RxPacket {
+	buf := payloadPool.Get().(*payloadBuffer)
+	return &RxPacket{
+		Data: buf[:n],
+		buf:  buf,
+	}
+}
+
+// Release returns the payload buffer of the packet to the pool.
+// The packet Data must not be used afterwards.
+// It is safe to call Release on packets that have not been created with NewRxPacket.
+func (rx *RxPacket) Release() {
+	if rx.buf != nil {
+		payloadPool.Put(rx.buf)
+		rx.buf = nil
+	}
+	rx.Data = nil
+}
+
+// Clone returns a copy of the packet with its Data in a pooled buffer, see NewRxPacket.
+func (rx *RxPacket) Clone() *RxPacket {
+	n := len(rx.Data)
+	if n > MaxPayloadSize {
+		n = MaxPayloadSize
+	}
+	pkt := NewRxPacket(n)
+	data, buf := pkt.Data, pkt.buf
+	*pkt = *rx
+	pkt.Data, pkt.buf = data, buf
+	copy(pkt.Data, rx.Data)
+	return pkt
+}
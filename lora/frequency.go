@@ -0,0 +1,85 @@
+package lora
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Frequency is a radio frequency in Hz.
+type Frequency uint32
+
+// FromMHz returns the frequency of mhz, rounded to the nearest Hz.
+func FromMHz(mhz float64) Frequency {
+	return Frequency(math.Round(mhz * 1e6))
+}
+
+// FromKHz returns the frequency of khz, rounded to the nearest Hz.
+func FromKHz(khz float64) Frequency {
+	return Frequency(math.Round(khz * 1e3))
+}
+
+// MHz returns the frequency in MHz.
+func (f Frequency) MHz() float64 {
+	return float64(f) / 1e6
+}
+
+// KHz returns the frequency in kHz.
+func (f Frequency) KHz() float64 {
+	return float64(f) / 1e3
+}
+
+// String returns the frequency as in "868.1 MHz".
+func (f Frequency) String() string {
+	return f.decimalMHz() + " MHz"
+}
+
+// decimalMHz formats the frequency in MHz without going through a float,
+// so 868100000 Hz is always "868.1" and never "868.099999".
+func (f Frequency) decimalMHz() string {
+	str := fmt.Sprintf("%d.%06d", f/1000000, f%1000000)
+	return strings.TrimSuffix(strings.TrimRight(str, "0"), ".")
+}
+
+// ParseFrequency parses a frequency in MHz as in "868.1".
+// Integers of one million and above are taken as Hz, as in "868100000".
+func ParseFrequency(s string) (Frequency, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil && n >= 1000000 {
+		return Frequency(n), nil
+	}
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i != -1 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	mhz, err := strconv.ParseUint(intPart, 10, 32)
+	var n uint64
+	if err == nil && len(fracPart) <= 9 {
+		// Hz are the first six decimals, the rest is rounded
+		n, err = strconv.ParseUint((fracPart + "000000000")[:9], 10, 32)
+	}
+	if err != nil || len(fracPart) > 9 {
+		// exponents and the like
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f < 0 || f*1e6 > math.MaxUint32 {
+			return 0, fmt.Errorf("can not parse frequency: %q", s)
+		}
+		return FromMHz(f), nil
+	}
+	hz := mhz*1000000 + (n+500)/1000
+	if hz > math.MaxUint32 {
+		return 0, fmt.Errorf("frequency out of range: %q", s)
+	}
+	return Frequency(hz), nil
+}
+
+// MarshalJSON writes the frequency in MHz, as used by the packet forwarder protocol.
+func (f Frequency) MarshalJSON() ([]byte, error) {
+	return []byte(f.decimalMHz()), nil
+}
+
+// UnmarshalJSON reads the frequency in MHz (868.1) or Hz (868100000), see ParseFrequency.
+func (f *Frequency) UnmarshalJSON(data []byte) (err error) {
+	*f, err = ParseFrequency(strings.Trim(string(data), "\""))
+	return
+}
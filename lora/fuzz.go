@@ -0,0 +1,48 @@
+//go:build gofuzz
+// +build gofuzz
+
+package lora
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Fuzz is the go-fuzz target of the txpk parser. Its corpus is in testdata/fuzz:
+//
+//	go-fuzz-build -tags gofuzz github.com/Waziup/single_chan_pkt_fwd/lora
+//	go-fuzz -bin lora-fuzz.zip -workdir lora/testdata/fuzz
+//
+// It parses data as PULL_RESP body, as a network server may send anything, and checks that a
+// valid downlink survives a round trip through JSON. It panics if not, and returns 1 for valid
+// downlinks and 0 else, as go-fuzz wants.
+func Fuzz(data []byte) int {
+	var body struct {
+		TxPacket *TxPacket `json:"txpk"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil || body.TxPacket == nil {
+		return 0
+	}
+	tx := body.TxPacket
+	_ = tx.String()
+	_ = tx.Airtime()
+	for _, region := range Regions {
+		_ = tx.Validate(region)
+	}
+	if tx.Validate(nil) != nil {
+		return 0
+	}
+	txpk, err := tx.MarshalJSON()
+	if err != nil {
+		panic(fmt.Sprintf("valid downlink %s: %v", data, err))
+	}
+	var again TxPacket
+	if err := again.UnmarshalJSON(txpk); err != nil {
+		panic(fmt.Sprintf("valid downlink %s: %s: %v", data, txpk, err))
+	}
+	if txpk2, _ := again.MarshalJSON(); !bytes.Equal(txpk, txpk2) {
+		panic(fmt.Sprintf("valid downlink %s: %s changed to %s", data, txpk, txpk2))
+	}
+	return 1
+}
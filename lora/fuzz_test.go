@@ -0,0 +1,45 @@
+//go:build gofuzz
+// +build gofuzz
+
+package lora
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestTxPacketCorpus runs the fuzz target over its corpus, which holds PULL_RESP bodies that
+// made the forwarder panic before, as a txpk with a payload shorter than a LoRaWAN header.
+func TestTxPacketCorpus(t *testing.T) {
+	valid := map[string]bool{
+		"valid":         true,
+		"empty-payload": true,
+		"short-payload": true,
+		"fsk":           true,
+		"lrfhss":        true,
+	}
+	files, err := filepath.Glob("testdata/fuzz/corpus/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no corpus")
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Base(file)
+		t.Run(name, func(t *testing.T) {
+			want := 0
+			if valid[name] {
+				want = 1
+			}
+			if got := Fuzz(data); got != want {
+				t.Errorf("Fuzz(%s) = %d, want %d", data, got, want)
+			}
+		})
+	}
+}
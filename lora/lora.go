@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -15,31 +16,35 @@ type TxPacket struct {
 	CountUs uint32    // internal concentrator counter for timestamping, 1 microsecond resolution - Send packet on a certain timestamp value (will ignore time)
 	TimeGPS time.Time // Send packet at a certain GPS time (GPS synchronization required)
 
-	Freq uint32 // TX central frequency in Hz
+	Freq Frequency // TX central frequency
 
 	Power uint8 // TX output power in dBm
 
 	ChainRF uint8 // Concentrator "RF chain" used for TX
 
-	Modulation string // Modulation identifier "LORA" or "FSK"
+	Modulation Modulation // Modulation identifier "LORA" or "FSK"
 
 	// LoRa only
 
-	LoRaBW uint8 // LoRa bandwith: BW7K8 (0x01), BW10K4 (0x02), BW15K6 (0x03), BW20K8 (0x04), BW31K2 (0x05), BW41K7 (0x06), BW62K5 (0x07), BW125K (0x08), BW250K (0x09), BW500K (0x0a)
-	LoRaCR uint8 // LoRa ECC coding rate: 4/5 (0x05), 4/6 (0x06), 4/7 (0x07), 4/8 (0x08)
+	LoRaBW Bandwidth // LoRa bandwith: BW7K8 (0x01), BW10K4 (0x02), BW15K6 (0x03), BW20K8 (0x04), BW31K2 (0x05), BW41K7 (0x06), BW62K5 (0x07), BW125K (0x08), BW250K (0x09), BW500K (0x0a), 2.4 GHz: BW203K (0x0b), BW406K (0x0c), BW812K (0x0d), BW1625K (0x0e)
+	LoRaCR Coderate  // LoRa ECC coding rate: 4/5 (0x05), 4/6 (0x06), 4/7 (0x07), 4/8 (0x08)
 
 	// LoRa only
 
 	InvertPolar bool // Lora modulation polarization inversion
 
-	// LoRa: LoRa spreading factor: SF7 (0x07) to SF12 (0x0c)
-	// FSK: Datarate (bits per second)
-	Datarate uint32
+	Datarate SpreadingFactor // LoRa spreading factor: SF7 (0x07) to SF12 (0x0c), LoRa only
+
+	Bitrate uint32 // FSK datarate in bits per second, FSK only
 
 	PreambleLength uint16 // RF preamble size
 
 	NoCRC bool // No CRC
 
+	// LR-FHSS only
+	LRFHSS   LRFHSSDatarate // LR-FHSS datarate
+	LRFHSSCR LRFHSSCoderate // LR-FHSS coding rate
+
 	// FSK only
 	FreqDev uint8 // FSK frequency deviation, in Hz
 
@@ -53,7 +58,7 @@ func (tx *TxPacket) UnmarshalJSON(data []byte) error {
 		CountUs    uint32      `json:"tmst"` // TX procedure: send on timestamp value -> Class A
 		TimeGPS    uint64      `json:"tmms"` // GPS timestamp is given -> Class B
 		NoCRC      bool        `json:"ncrc"` // "No CRC" flag (optional field)
-		Freq       float64     `json:"freq"` // target frequency (mandatory)
+		Freq       Frequency   `json:"freq"` // target frequency (mandatory)
 		ChainRF    uint8       `json:"rfch"` // RF chain used for TX (mandatory)
 		Power      uint8       `json:"powe"` // TX power (optional field)
 		Modulation string      `json:"modu"` // modulation (mandatory)
@@ -74,73 +79,58 @@ func (tx *TxPacket) UnmarshalJSON(data []byte) error {
 	tx.Immediate = txpk.Immediate
 	tx.CountUs = txpk.CountUs
 	tx.NoCRC = txpk.NoCRC
-	tx.Freq = uint32(txpk.Freq * 1.0e6)
+	tx.Freq = txpk.Freq
 	tx.ChainRF = txpk.ChainRF
 	tx.Power = txpk.Power
 	switch txpk.Modulation {
 	case "LORA":
-		tx.Modulation = "LORA"
-		var bw int
+		tx.Modulation = ModulationLoRa
 
 		datr, ok := txpk.Datarate.(string)
 		if !ok {
-			return fmt.Errorf("can not parse lora datarate (not a string): %+v", txpk.Datarate)
+			return fmt.Errorf("%w: can not parse lora datarate (not a string): %+v", ErrBadDatarate, txpk.Datarate)
 		}
 
-		_, err := fmt.Sscanf(datr, "SF%dBW%d", &tx.Datarate, &bw)
+		dr, err := ParseDatarate(datr)
 		if err != nil {
-			return fmt.Errorf("can not parse lora datarate %q: %v", datr, err)
-		}
-		switch bw {
-		case 7:
-			tx.LoRaBW = 1
-		case 10:
-			tx.LoRaBW = 2
-		case 15:
-			tx.LoRaBW = 3
-		case 20:
-			tx.LoRaBW = 4
-		case 31:
-			tx.LoRaBW = 5
-		case 41:
-			tx.LoRaBW = 6
-		case 62:
-			tx.LoRaBW = 7
-		case 125:
-			tx.LoRaBW = 8
-		case 250:
-			tx.LoRaBW = 9
-		case 500:
-			tx.LoRaBW = 10
-		default:
-			return fmt.Errorf("can not parse lora datarate %v: unknown bandwidth %d", datr, bw)
+			return err
 		}
-		switch txpk.Coderate {
-		case "4/5":
-			tx.LoRaCR = 5
-		case "4/6", "2/3":
-			tx.LoRaCR = 6
-		case "4/7":
-			tx.LoRaCR = 7
-		case "4/8", "2/4", "1/2":
-			tx.LoRaCR = 8
-		default:
-			return fmt.Errorf("can not parse lora coderate: %q", txpk.Coderate)
+		tx.Datarate = dr.SpreadingFactor
+		tx.LoRaBW = dr.Bandwidth
+		tx.LoRaCR, err = ParseCoderate(txpk.Coderate)
+		if err != nil {
+			return fmt.Errorf("can not parse lora coderate: %v", err)
 		}
 		tx.InvertPolar = txpk.InvertPolar
 		tx.PreambleLength = txpk.PreambleLength
 	case "FSK":
-		tx.Modulation = "FSK"
+		tx.Modulation = ModulationFSK
 
 		datr, ok := txpk.Datarate.(float64)
 		if !ok {
-			return fmt.Errorf("can not parse lora datarate (not a number): %+v", txpk.Datarate)
+			return fmt.Errorf("%w: can not parse lora datarate (not a number): %+v", ErrBadDatarate, txpk.Datarate)
 		}
-		tx.Datarate = uint32(datr)
+		tx.Bitrate = uint32(datr)
 
 		tx.FreqDev = uint8(txpk.FreqDev / 1000.0)
 		tx.PreambleLength = txpk.PreambleLength
 
+	case "LR-FHSS":
+		tx.Modulation = ModulationLRFHSS
+
+		datr, ok := txpk.Datarate.(string)
+		if !ok {
+			return fmt.Errorf("%w: can not parse lr-fhss datarate (not a string): %+v", ErrBadDatarate, txpk.Datarate)
+		}
+		var err error
+		if tx.LRFHSS, err = ParseLRFHSSDatarate(datr); err != nil {
+			return err
+		}
+		if tx.LRFHSSCR, err = ParseLRFHSSCoderate(txpk.Coderate); err != nil {
+			return err
+		}
+		tx.InvertPolar = txpk.InvertPolar
+
 	default:
 		return fmt.Errorf("unknown modulation: %q", txpk.Modulation)
 	}
@@ -153,38 +143,70 @@ func (tx *TxPacket) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// MarshalJSON writes the packet as a "txpk" object, as sent by network servers.
+func (tx *TxPacket) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	if tx.Immediate {
+		fmt.Fprint(&buf, "{\"imme\":true")
+	} else {
+		fmt.Fprintf(&buf, "{\"tmst\":%d", tx.CountUs)
+	}
+	fmt.Fprintf(&buf, ",\"freq\":%s", tx.Freq.decimalMHz())
+	fmt.Fprintf(&buf, ",\"rfch\":%d", tx.ChainRF)
+	fmt.Fprintf(&buf, ",\"powe\":%d", tx.Power)
+	switch tx.Modulation {
+	case ModulationLoRa:
+		fmt.Fprint(&buf, ",\"modu\":\"LORA\"")
+		fmt.Fprintf(&buf, ",\"datr\":\"%s\"", Datarate{tx.Datarate, tx.LoRaBW})
+		fmt.Fprintf(&buf, ",\"codr\":\"%s\"", tx.LoRaCR)
+		fmt.Fprintf(&buf, ",\"ipol\":%t", tx.InvertPolar)
+	case ModulationFSK:
+		fmt.Fprint(&buf, ",\"modu\":\"FSK\"")
+		fmt.Fprintf(&buf, ",\"datr\":%d", tx.Bitrate)
+		fmt.Fprintf(&buf, ",\"fdev\":%d", uint32(tx.FreqDev)*1000)
+	case ModulationLRFHSS:
+		fmt.Fprint(&buf, ",\"modu\":\"LR-FHSS\"")
+		fmt.Fprintf(&buf, ",\"datr\":\"%s\"", tx.LRFHSS)
+		fmt.Fprintf(&buf, ",\"codr\":\"%s\"", tx.LRFHSSCR)
+		fmt.Fprintf(&buf, ",\"ipol\":%t", tx.InvertPolar)
+	default:
+		return nil, fmt.Errorf("unknown modulation: %q", tx.Modulation)
+	}
+	if tx.PreambleLength != 0 {
+		fmt.Fprintf(&buf, ",\"prea\":%d", tx.PreambleLength)
+	}
+	if tx.NoCRC {
+		fmt.Fprint(&buf, ",\"ncrc\":true")
+	}
+	fmt.Fprintf(&buf, ",\"size\":%d", len(tx.Data))
+	fmt.Fprintf(&buf, ",\"data\":\"%s\"}", base64.StdEncoding.EncodeToString(tx.Data))
+	return buf.Bytes(), nil
+}
+
 func (tx *TxPacket) String() string {
 	data := base64.StdEncoding.EncodeToString(tx.Data)
-	if tx.Modulation == "LORA" {
-		versionMajor := tx.Data[0] & 0b11
-		if versionMajor == LoRaWANR1 {
-			mtype := MType(tx.Data[0] >> 5)
-			devAddr := uint32(tx.Data[1])<<24 + uint32(tx.Data[2])<<16 + uint32(tx.Data[3])<<8 + uint32(tx.Data[4])
-			fCnt := uint16(tx.Data[6])<<8 + uint16(tx.Data[7])
-			return fmt.Sprintf("LoRaWAN %s: %.2f MHz, SF%d %s CR4/%d, Mote %08X, FCnt %d, Data: %s", mtype, float64(tx.Freq)/1e6, tx.Datarate, bwStr[tx.LoRaBW], tx.LoRaCR, devAddr, fCnt, data)
+	if tx.Modulation == ModulationLoRa {
+		// the payload comes from the network server, so it might be anything
+		if len(tx.Data) > 8 {
+			versionMajor := tx.Data[0] & 0b11
+			if versionMajor == LoRaWANR1 {
+				mtype := MType(tx.Data[0] >> 5)
+				devAddr := uint32(tx.Data[1])<<24 + uint32(tx.Data[2])<<16 + uint32(tx.Data[3])<<8 + uint32(tx.Data[4])
+				fCnt := uint16(tx.Data[6])<<8 + uint16(tx.Data[7])
+				return fmt.Sprintf("LoRaWAN %s: %.2f MHz, SF%d %s CR4/%d, Mote %08X, FCnt %d, Data: %s", mtype, tx.Freq.MHz(), tx.Datarate, tx.LoRaBW, tx.LoRaCR, devAddr, fCnt, data)
+			}
 		}
-		return fmt.Sprintf("LoRa: %.2f MHz, SF%d %s CR4/%d, Data: %s", float64(tx.Freq)/1e6, tx.Datarate, bwStr[tx.LoRaBW], tx.LoRaCR, data)
+		return fmt.Sprintf("LoRa: %.2f MHz, SF%d %s CR4/%d, Data: %s", tx.Freq.MHz(), tx.Datarate, tx.LoRaBW, tx.LoRaCR, data)
+	}
+	if tx.Modulation == ModulationFSK {
+		return fmt.Sprintf("FSK: %.2f MHz, Bitrate %d, Data: %s", tx.Freq.MHz(), tx.Bitrate, data)
 	}
-	if tx.Modulation == "FSK" {
-		return fmt.Sprintf("FSK: %.2f MHz, Bitrate %d, Data: %s", float64(tx.Freq)/1e6, tx.Datarate, data)
+	if tx.Modulation == ModulationLRFHSS {
+		return fmt.Sprintf("LR-FHSS: %.2f MHz, %s CR%s, Data: %s", tx.Freq.MHz(), tx.LRFHSS, tx.LRFHSSCR, data)
 	}
 	return "<unknown modulation>"
 }
 
-var bwStr = []string{
-	"",
-	"BW7.8",
-	"BW10.4",
-	"BW15.6",
-	"BW20.8",
-	"BW31.2",
-	"BW41.7",
-	"BW62.5",
-	"BW125",
-	"BW250",
-	"BW500",
-}
-
 // RxPacket
 type RxPacket struct {
 	Time *time.Time // UTC time of pkt RX
@@ -193,57 +215,230 @@ type RxPacket struct {
 
 	CountUs uint32 // internal concentrator counter for timestamping, 1 microsecond resolution
 
-	Freq uint32 // RX central frequency in Hz
+	Freq Frequency // RX central frequency
 
 	ChainIF uint8 // Concentrator "IF" channel used for RX
 	ChainRF uint8 // Concentrator "RF chain" used for RX or TX
 
 	StatCRC int8 // CRC status: 1 = OK, -1 = fail, 0 = no CRC
 
-	Modulation string // Modulation identifier "LORA" or "FSK"
+	Modulation Modulation // Modulation identifier "LORA" or "FSK"
 
 	// LoRa only
-	LoRaBW uint8 // LoRa bandwith: BW7K8 (0x01), BW10K4 (0x02), BW15K6 (0x03), BW20K8 (0x04), BW31K2 (0x05), BW41K7 (0x06), BW62K5 (0x07), BW125K (0x08), BW250K (0x09), BW500K (0x0a)
-	LoRaCR uint8 // LoRa ECC coding rate: 4/5 (0x05), 4/6 (0x06), 4/7 (0x07), 4/8 (0x08)
+	LoRaBW Bandwidth // LoRa bandwith: BW7K8 (0x01), BW10K4 (0x02), BW15K6 (0x03), BW20K8 (0x04), BW31K2 (0x05), BW41K7 (0x06), BW62K5 (0x07), BW125K (0x08), BW250K (0x09), BW500K (0x0a), 2.4 GHz: BW203K (0x0b), BW406K (0x0c), BW812K (0x0d), BW1625K (0x0e)
+	LoRaCR Coderate  // LoRa ECC coding rate: 4/5 (0x05), 4/6 (0x06), 4/7 (0x07), 4/8 (0x08)
 
-	// LoRa: LoRa spreading factor: SF7 (0x07) to SF12 (0x0c)
-	// FSK: Datarate (bits per second)
-	Datarate uint32
+	Datarate SpreadingFactor // LoRa spreading factor: SF7 (0x07) to SF12 (0x0c), LoRa only
+
+	Bitrate uint32 // FSK datarate in bits per second, FSK only
 
 	RSSI float32 // average packet RSSI in dB
 
 	LoRaSNR float32 // average packet SNR, in dB
 
+	FreqOffset int32 // LoRa frequency error in Hz, the frequency of the packet minus Freq
+
+	// LR-FHSS only
+	LRFHSS   LRFHSSDatarate // LR-FHSS datarate
+	LRFHSSCR LRFHSSCoderate // LR-FHSS coding rate
+
+	Replayed bool // sent late, after the network server was unreachable
+
+	Board *BoardInfo // board metadata for geolocation, sent only if set
+
+	Location *Location // location of the gateway, sent as "lati", "long" and "alti" only if set
+
+	Meta map[string]string // custom metadata, as an installation label, sent as "meta" only if set
+
 	Data []byte // packet payload
+
+	buf *payloadBuffer // pooled buffer backing Data, see NewRxPacket
 }
 
+// BoardInfo is the board metadata of a received packet, as sent by concentrators with
+// fine timestamping to geolocation-capable servers.
+type BoardInfo struct {
+	Board    uint8   // "brd", the board that received the packet
+	AESKey   uint8   // "aesk", the index of the AES key that encrypts the fine timestamp
+	FineTime *uint32 // "ftime", fine timestamp in ns since the last PPS, nil if not available
+}
+
+// Location is the position of the gateway that received a packet.
+type Location struct {
+	Latitude  float64 // "lati", in degrees, north positive
+	Longitude float64 // "long", in degrees, east positive
+	Altitude  int32   // "alti", in m
+}
+
+// rxTimeFormat is the ISO 8601 format of "time" with microseconds, as in "2013-03-31T16:21:17.528002Z".
+const rxTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
 func (rx *RxPacket) MarshalJSON() ([]byte, error) {
+	if err := rx.Validate(); err != nil {
+		return nil, err
+	}
 	var buf bytes.Buffer
 	fmt.Fprintf(&buf, "{")
 	if rx.Time != nil {
-		fmt.Fprintf(&buf, "\"time\":\"%s\"", rx.Time.Format(time.RFC3339)) /* ISO 8601 format */
+		fmt.Fprintf(&buf, "\"time\":\"%s\"", rx.Time.UTC().Format(rxTimeFormat))
+		// the counter of replayed packets is stale
+		if !rx.Replayed {
+			fmt.Fprintf(&buf, ",\"tmst\":%d", rx.CountUs)
+		}
 	} else {
 		fmt.Fprintf(&buf, "\"tmst\":%d", rx.CountUs)
 	}
 	fmt.Fprintf(&buf, ",\"chan\":%d", rx.ChainIF)
 	fmt.Fprintf(&buf, ",\"rfch\":%d", rx.ChainRF)
-	fmt.Fprintf(&buf, ",\"freq\":%.3f", float64(rx.Freq)/1e6)
+	if rx.Board != nil {
+		fmt.Fprintf(&buf, ",\"brd\":%d", rx.Board.Board)
+		fmt.Fprintf(&buf, ",\"aesk\":%d", rx.Board.AESKey)
+		if rx.Board.FineTime != nil {
+			fmt.Fprintf(&buf, ",\"ftime\":%d", *rx.Board.FineTime)
+		}
+	}
+	fmt.Fprintf(&buf, ",\"freq\":%s", rx.Freq.decimalMHz())
 	fmt.Fprintf(&buf, ",\"stat\":%d", rx.StatCRC)
-	if rx.Modulation == "LORA" {
+	if rx.Modulation == ModulationLoRa {
 		fmt.Fprint(&buf, ",\"modu\":\"LORA\"")
-		fmt.Fprintf(&buf, ",\"datr\":\"SF%d%s\"", rx.Datarate, bwStr[rx.LoRaBW])
-		fmt.Fprintf(&buf, ",\"codr\":\"4/%d\"", rx.LoRaCR)
+		fmt.Fprintf(&buf, ",\"datr\":\"%s\"", Datarate{rx.Datarate, rx.LoRaBW})
+		fmt.Fprintf(&buf, ",\"codr\":\"%s\"", rx.LoRaCR)
 		fmt.Fprintf(&buf, ",\"lsnr\":%.1f", rx.LoRaSNR)
+		if rx.FreqOffset != 0 {
+			// not in the Semtech protocol, but accepted by some servers
+			fmt.Fprintf(&buf, ",\"foff\":%d", rx.FreqOffset)
+		}
+	} else if rx.Modulation == ModulationLRFHSS {
+		fmt.Fprint(&buf, ",\"modu\":\"LR-FHSS\"")
+		fmt.Fprintf(&buf, ",\"datr\":\"%s\"", rx.LRFHSS)
+		fmt.Fprintf(&buf, ",\"codr\":\"%s\"", rx.LRFHSSCR)
 	} else {
 		fmt.Fprint(&buf, ",\"modu\":\"FSK\"")
-		fmt.Fprintf(&buf, ",\"datr\":%d", rx.Datarate)
+		fmt.Fprintf(&buf, ",\"datr\":%d", rx.Bitrate)
 	}
 	fmt.Fprintf(&buf, ",\"rssi\":%.0f", rx.RSSI)
+	if rx.Replayed {
+		// not in the Semtech protocol, so servers can tell late packets
+		fmt.Fprint(&buf, ",\"replay\":true")
+	}
+	if rx.Location != nil {
+		// as in the "stat" objects
+		fmt.Fprintf(&buf, ",\"lati\":%.5f", rx.Location.Latitude)
+		fmt.Fprintf(&buf, ",\"long\":%.5f", rx.Location.Longitude)
+		fmt.Fprintf(&buf, ",\"alti\":%d", rx.Location.Altitude)
+	}
+	if len(rx.Meta) != 0 {
+		meta, err := json.Marshal(rx.Meta)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, ",\"meta\":%s", meta)
+	}
 	fmt.Fprintf(&buf, ",\"size\":%d", len(rx.Data))
 	fmt.Fprintf(&buf, ",\"data\":\"%s\"}", base64.StdEncoding.EncodeToString(rx.Data))
 	return buf.Bytes(), nil
 }
 
+// UnmarshalJSON reads a "rxpk" object, as received by network servers.
+func (rx *RxPacket) UnmarshalJSON(data []byte) error {
+
+	var rxpk = struct {
+		Time       *time.Time        `json:"time"`
+		CountUs    uint32            `json:"tmst"`
+		Freq       Frequency         `json:"freq"`
+		ChainIF    uint8             `json:"chan"`
+		ChainRF    uint8             `json:"rfch"`
+		StatCRC    int8              `json:"stat"`
+		Modulation string            `json:"modu"`
+		Datarate   interface{}       `json:"datr"`
+		Coderate   string            `json:"codr"`
+		RSSI       float32           `json:"rssi"`
+		LoRaSNR    float32           `json:"lsnr"`
+		FreqOffset int32             `json:"foff"`
+		Replayed   bool              `json:"replay"`
+		Board      *uint8            `json:"brd"`
+		AESKey     uint8             `json:"aesk"`
+		FineTime   *uint32           `json:"ftime"`
+		Latitude   *float64          `json:"lati"`
+		Longitude  *float64          `json:"long"`
+		Altitude   int32             `json:"alti"`
+		Meta       map[string]string `json:"meta"`
+		Data       string            `json:"data"`
+	}{}
+
+	if err := json.Unmarshal(data, &rxpk); err != nil {
+		return err
+	}
+
+	rx.Time = rxpk.Time
+	rx.CountUs = rxpk.CountUs
+	rx.Freq = rxpk.Freq
+	rx.ChainIF = rxpk.ChainIF
+	rx.ChainRF = rxpk.ChainRF
+	rx.StatCRC = rxpk.StatCRC
+	rx.RSSI = rxpk.RSSI
+	rx.Replayed = rxpk.Replayed
+	if rxpk.Board != nil {
+		rx.Board = &BoardInfo{Board: *rxpk.Board, AESKey: rxpk.AESKey, FineTime: rxpk.FineTime}
+	}
+	if rxpk.Latitude != nil && rxpk.Longitude != nil {
+		rx.Location = &Location{Latitude: *rxpk.Latitude, Longitude: *rxpk.Longitude, Altitude: rxpk.Altitude}
+	}
+	rx.Meta = rxpk.Meta
+	switch rxpk.Modulation {
+	case "LORA":
+		rx.Modulation = ModulationLoRa
+
+		datr, ok := rxpk.Datarate.(string)
+		if !ok {
+			return fmt.Errorf("%w: can not parse lora datarate (not a string): %+v", ErrBadDatarate, rxpk.Datarate)
+		}
+		dr, err := ParseDatarate(datr)
+		if err != nil {
+			return err
+		}
+		rx.Datarate = dr.SpreadingFactor
+		rx.LoRaBW = dr.Bandwidth
+		rx.LoRaCR, err = ParseCoderate(rxpk.Coderate)
+		if err != nil {
+			return fmt.Errorf("can not parse lora coderate: %v", err)
+		}
+		rx.LoRaSNR = rxpk.LoRaSNR
+		rx.FreqOffset = rxpk.FreqOffset
+	case "FSK":
+		rx.Modulation = ModulationFSK
+
+		datr, ok := rxpk.Datarate.(float64)
+		if !ok {
+			return fmt.Errorf("%w: can not parse fsk datarate (not a number): %+v", ErrBadDatarate, rxpk.Datarate)
+		}
+		rx.Bitrate = uint32(datr)
+	case "LR-FHSS":
+		rx.Modulation = ModulationLRFHSS
+
+		datr, ok := rxpk.Datarate.(string)
+		if !ok {
+			return fmt.Errorf("%w: can not parse lr-fhss datarate (not a string): %+v", ErrBadDatarate, rxpk.Datarate)
+		}
+		var err error
+		if rx.LRFHSS, err = ParseLRFHSSDatarate(datr); err != nil {
+			return err
+		}
+		if rx.LRFHSSCR, err = ParseLRFHSSCoderate(rxpk.Coderate); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown modulation: %q", rxpk.Modulation)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(rxpk.Data)
+	if err != nil {
+		return fmt.Errorf("can not decode data: %v", err)
+	}
+	rx.Data = data
+	return nil
+}
+
 const LoRaWANR1 = 0x00
 
 type MType byte
@@ -265,20 +460,23 @@ func (t MType) String() string {
 
 func (rx *RxPacket) String() string {
 	data := base64.StdEncoding.EncodeToString(rx.Data)
-	if rx.Modulation == "LORA" {
+	if rx.Modulation == ModulationLoRa {
 		if len(rx.Data) > 8 {
 			versionMajor := rx.Data[0] & 0b11
 			if versionMajor == LoRaWANR1 {
 				mtype := MType(rx.Data[0] >> 5)
 				devAddr := uint32(rx.Data[4])<<24 + uint32(rx.Data[3])<<16 + uint32(rx.Data[2])<<8 + uint32(rx.Data[1])
 				fCnt := uint16(rx.Data[7])<<8 + uint16(rx.Data[6])
-				return fmt.Sprintf("LoRaWAN %s: %.2f MHz, SF%d %s CR4/%d, Mote %08X, FCnt %d, Data: %s", mtype, float64(rx.Freq)/1e6, rx.Datarate, bwStr[rx.LoRaBW], rx.LoRaCR, devAddr, fCnt, data)
+				return fmt.Sprintf("LoRaWAN %s: %.2f MHz, SF%d %s CR4/%d, Mote %08X, FCnt %d, Data: %s", mtype, rx.Freq.MHz(), rx.Datarate, rx.LoRaBW, rx.LoRaCR, devAddr, fCnt, data)
 			}
 		}
-		return fmt.Sprintf("LoRa: %.2f MHz, SF%d %s CR4/%d, Data: %s", float64(rx.Freq)/1e6, rx.Datarate, bwStr[rx.LoRaBW], rx.LoRaCR, data)
+		return fmt.Sprintf("LoRa: %.2f MHz, SF%d %s CR4/%d, Data: %s", rx.Freq.MHz(), rx.Datarate, rx.LoRaBW, rx.LoRaCR, data)
+	}
+	if rx.Modulation == ModulationFSK {
+		return fmt.Sprintf("FSK: %.2f MHz, Bitrate %d, Data: %s", rx.Freq.MHz(), rx.Bitrate, data)
 	}
-	if rx.Modulation == "FSK" {
-		return fmt.Sprintf("FSK: %.2f MHz, Bitrate %d, Data: %s", float64(rx.Freq)/1e6, rx.Datarate, data)
+	if rx.Modulation == ModulationLRFHSS {
+		return fmt.Sprintf("LR-FHSS: %.2f MHz, %s CR%s, Data: %s", rx.Freq.MHz(), rx.LRFHSS, rx.LRFHSSCR, data)
 	}
 	return ""
 }
@@ -287,25 +485,139 @@ type Config struct {
 
 	Lorawan_public bool `json:"lorawan_public"`
 
-	Freq uint32 `json:"freq"` // RX central frequency in Hz
+	Region string `json:"region"` // regional frequency plan, e.g. "EU868", see Regions
 
-	Modulation string `json:"modulation"` // Modulation identifier "LORA" or "FSK"
+	Freq Frequency `json:"freq"` // RX central frequency
 
-	// LoRa: Bandwidth 7800 .. 125000, 250000, 500000
-	LoRaBW uint32 `json:"bandwidth"` // LoRa bandwidth
+	Modulation Modulation `json:"modulation"` // Modulation identifier "LORA" or "FSK"
+
+	// LoRa: Bandwidth 7800 .. 125000, 250000, 500000, and 203125 .. 1625000 at 2.4 GHz
+	LoRaBW Bandwidth `json:"bandwidth"` // LoRa bandwidth
 	// LoRa: Coderate 4/5 (0x05), 4/6 (0x06), 4/7 (0x07), 4/8 (0x08)
-	LoRaCR string `json:"coderate"` // LoRa coderate
+	LoRaCR Coderate `json:"coderate"` // LoRa coderate
 
 	// LoRa: LoRa spreading factor: SF7 (0x07) to SF12 (0x0c)
-	// FSK: Datarate (bits per second)
-	Datarate uint32 `json:"spread_factor"`
+	Datarate SpreadingFactor `json:"spread_factor"`
+
+	// Backend is the name of the radio backend, "sx127x" if not set, see RegisterBackend.
+	Backend string `json:"backend"`
+
+	// Board sets SpiDevice, PinRst, PinDio0 and RSSIOffset for a known board, see Boards.
+	Board string `json:"board"`
+	board *Board // set by ApplyBoard
+
+	// RSSIOffset in dB is added to the RSSI of the received packets.
+	RSSIOffset float32 `json:"rssi_offset"`
 
 	PinRst string `json:"pinRst"` 
 
+	// PinDio0 is the pin wired to DIO0 of the radio. The forwarder polls the radio instead,
+	// so it is only used by the self-test.
+	PinDio0 string `json:"pinDio0"`
+
 	SpiDevice string `json:"spiDevice"`
 
+	// PinBusy is the pin wired to BUSY of the radio, which only the SX1280 has.
+	PinBusy string `json:"pinBusy"`
+
+	// SerialDevice is the serial port of the RN2483 and RN2903 modules, e.g. "/dev/ttyUSB0",
+	// or of the picoGW USB sticks, e.g. "/dev/ttyACM0".
+	SerialDevice string `json:"serialDevice"`
+
 	PinLed1 string `json:"pinLed1"`
 
 	PreambleLength uint16 // RF preamble size
+
+	// RxGain is the receiver front end setting, with the highest sensitivity if not set.
+	RxGain RxGain `json:"rx_gain"`
+
+	// Hops are channels the radio rotates through, staying DwellTime milliseconds on each.
+	// Hop fields that are not set are taken from this config.
+	Hops      []Channel `json:"hops"`
+	DwellTime int       `json:"dwell_time"`
+
+	// Adaptive moves the radio to the quietest of a list of frequencies during quiet hours,
+	// which is optional. It can not be used with Hops.
+	Adaptive *AdaptiveChannel `json:"adaptive"`
+
+	// FreqCorrection shifts the programmed frequencies by this many ppm to make up for
+	// the crystal offset, so it is the negative of the measured crystal error.
+	// With AutoFreqCorrection the radio tracks the drift of the crystal, e.g. with
+	// temperature, from the frequency error of the received frames, starting at FreqCorrection.
+	FreqCorrection     float64 `json:"freq_correction"`
+	AutoFreqCorrection bool    `json:"auto_freq_correction"`
+}
+
+// RxGain is the receiver front end setting. Lower the gain on sites with strong
+// transmitters nearby, which otherwise overload the receiver.
+type RxGain struct {
+	AGC     *bool `json:"agc"`      // automatic gain control, on if not set
+	LNAGain uint8 `json:"lna_gain"` // 1 (highest) to 6 (lowest), used if the AGC is off, 1 if not set
+	Boost   *bool `json:"boost"`    // LNA current boost, on if not set
+}
+
+// AGCOn reports whether the automatic gain control is on.
+func (g RxGain) AGCOn() bool {
+	return g.AGC == nil || *g.AGC
+}
+
+// BoostOn reports whether the LNA boost is on.
+func (g RxGain) BoostOn() bool {
+	return g.Boost == nil || *g.Boost
+}
+
+// Channel is a receive channel of a hopping radio, see Config.Hops.
+type Channel struct {
+	Freq     Frequency       `json:"freq"`
+	Datarate SpreadingFactor `json:"spread_factor"`
+	LoRaBW   Bandwidth       `json:"bandwidth"`
+}
+
+// AdaptiveChannel moves a radio to the quietest of the candidate frequencies, once in each
+// period of quiet hours, when the traffic is low. See Config.Adaptive.
+type AdaptiveChannel struct {
+	// Candidates are the frequencies the radio may move to, besides its own.
+	Candidates []Frequency `json:"candidates"`
+	// Hours are the quiet hours in local time, as "01:00-05:00", which may span midnight.
+	Hours string `json:"hours"`
+	// Margin in dB a candidate must be quieter than the current frequency to move, 3 if 0.
+	Margin float32 `json:"margin"`
+}
+
+// QuietHours returns the start and end of the quiet hours as times of day.
+func (a *AdaptiveChannel) QuietHours() (start, end time.Duration, err error) {
+	parts := strings.Split(a.Hours, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid hours %q, must be as \"01:00-05:00\"", a.Hours)
+	}
+	var tod [2]time.Duration
+	for i, p := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(p))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid hours %q, must be as \"01:00-05:00\"", a.Hours)
+		}
+		tod[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if tod[0] == tod[1] {
+		return 0, 0, fmt.Errorf("invalid hours %q: empty", a.Hours)
+	}
+	return tod[0], tod[1], nil
+}
+
+// Hop returns the config for hop i, which is cfg with the fields of the channel.
+func (cfg *Config) Hop(i int) *Config {
+	hop := *cfg
+	hop.Hops = nil
+	ch := cfg.Hops[i]
+	if ch.Freq != 0 {
+		hop.Freq = ch.Freq
+	}
+	if ch.Datarate != 0 {
+		hop.Datarate = ch.Datarate
+	}
+	if ch.LoRaBW != 0 {
+		hop.LoRaBW = ch.LoRaBW
+	}
+	return &hop
 }
 
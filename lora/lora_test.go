@@ -0,0 +1,124 @@
+package lora
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPowerUsageJSON(t *testing.T) {
+	for _, mode := range []PowerMode{PowerSleep, PowerStandby, PowerRx, PowerTx} {
+		data, err := json.Marshal(&PowerUsage{Mode: mode, Rx: 1.5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var u PowerUsage
+		if err := json.Unmarshal(data, &u); err != nil {
+			t.Fatalf("%s: %v", data, err)
+		}
+		if u.Mode != mode || u.Rx != 1.5 {
+			t.Errorf("%s read as %+v", data, u)
+		}
+	}
+	var m PowerMode
+	if err := m.UnmarshalText([]byte("PowerMode(7)")); err == nil {
+		t.Error("unknown mode read")
+	}
+}
+
+func TestClampPower(t *testing.T) {
+	eu868 := Regions["EU868"]
+	for _, test := range []struct {
+		region *Region
+		freq   Frequency
+		power  uint8
+		want   uint8
+	}{
+		{nil, 868100000, 14, 14},
+		{nil, 868100000, 27, MaxPower},
+		{eu868, 868100000, 14, 14},
+		{eu868, 868100000, 27, 16},
+		{eu868, 869525000, 27, MaxPower}, // the RX2 window of TTN and ChirpStack, in the 27 dBm sub-band
+		{Regions["KR920"], 922100000, 20, 14},
+	} {
+		tx := &TxPacket{Freq: test.freq, Power: test.power}
+		if lowered := tx.ClampPower(test.region); tx.Power != test.want || lowered != (test.want != test.power) {
+			t.Errorf("%d dBm at %s lowered to %d dBm (%t), want %d dBm", test.power, test.freq, tx.Power, lowered, test.want)
+		}
+	}
+	tx := &TxPacket{Freq: 869525000, Power: 27, Modulation: ModulationLoRa, LoRaBW: BW125K, LoRaCR: CR4_5, Datarate: SF9}
+	if err := tx.Validate(eu868); err != nil {
+		t.Errorf("RX2 downlink of 27 dBm: %v", err)
+	}
+}
+
+func TestRxPacketDatarateJSON(t *testing.T) {
+	for _, test := range []struct {
+		rxpk     string
+		datarate SpreadingFactor
+		bitrate  uint32
+		datr     string
+	}{
+		{`{"tmst":1,"freq":868.1,"stat":1,"modu":"LORA","datr":"SF9BW125","codr":"4/5","rssi":-80,"lsnr":5,"size":1,"data":"AQ=="}`, SF9, 0, `"datr":"SF9BW125"`},
+		{`{"tmst":1,"freq":868.8,"stat":1,"modu":"FSK","datr":50000,"rssi":-80,"size":1,"data":"AQ=="}`, 0, 50000, `"datr":50000`},
+	} {
+		var rx RxPacket
+		if err := json.Unmarshal([]byte(test.rxpk), &rx); err != nil {
+			t.Fatalf("%s: %v", test.rxpk, err)
+		}
+		if rx.Datarate != test.datarate || rx.Bitrate != test.bitrate {
+			t.Errorf("%s read as datarate %d and bitrate %d", test.rxpk, rx.Datarate, rx.Bitrate)
+		}
+		data, err := json.Marshal(&rx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), test.datr) {
+			t.Errorf("%s written as %s", test.rxpk, data)
+		}
+	}
+}
+
+func TestTxPacketStringShortPayload(t *testing.T) {
+	// a LoRaWAN header is 8 bytes, which the downlinks of the network server may not have
+	for n := 0; n <= 9; n++ {
+		tx := &TxPacket{Modulation: ModulationLoRa, Datarate: SF9, LoRaBW: BW125K, LoRaCR: CR4_5, Data: make([]byte, n)}
+		if s := tx.String(); s == "" {
+			t.Errorf("%d bytes: empty string", n)
+		}
+	}
+}
+
+func BenchmarkRxPacketMarshalJSON(b *testing.B) {
+	now := time.Date(2021, 3, 31, 16, 21, 17, 528002000, time.UTC)
+	rx := &RxPacket{
+		CountUs:    3512348611,
+		Time:       &now,
+		Freq:       868100000,
+		Modulation: ModulationLoRa,
+		Datarate:   SF7,
+		LoRaBW:     BW125K,
+		LoRaCR:     CR4_5,
+		RSSI:       -35,
+		LoRaSNR:    5.1,
+		Data:       []byte{0x40, 0xda, 0x1b, 0x01, 0x26, 0x80, 0x01, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(rx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTxPacketUnmarshalJSON(b *testing.B) {
+	txpk := []byte(`{"imme":false,"tmst":3513348611,"freq":869.525,"rfch":0,"powe":14,"modu":"LORA","datr":"SF9BW125","codr":"4/5","ipol":true,"size":16,"data":"YNobASaAAQABAgMEBQYHCA=="}`)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var tx TxPacket
+		if err := json.Unmarshal(txpk, &tx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package lora
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PowerMode is the operating mode of a radio, from the least to the most current it draws.
+type PowerMode int
+
+const (
+	PowerSleep PowerMode = iota
+	PowerStandby
+	PowerRx
+	PowerTx
+)
+
+var powerModes = [...]string{"sleep", "standby", "rx", "tx"}
+
+func (m PowerMode) String() string {
+	if m < 0 || int(m) >= len(powerModes) {
+		return fmt.Sprintf("PowerMode(%d)", int(m))
+	}
+	return powerModes[m]
+}
+
+// MarshalText writes the name of the mode, as "rx".
+func (m PowerMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText reads the name of a mode, as written by MarshalText, so the power of the
+// status reports can be read back.
+func (m *PowerMode) UnmarshalText(text []byte) error {
+	for i, name := range powerModes {
+		if string(text) == name {
+			*m = PowerMode(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown power mode: %q", text)
+}
+
+// PowerUsage is the time a radio spent in each power mode and its estimated energy consumption.
+type PowerUsage struct {
+	Mode PowerMode `json:"mode"`
+	// Seconds in each mode.
+	Sleep   float64 `json:"sleep"`
+	Standby float64 `json:"standby"`
+	Rx      float64 `json:"rx"`
+	Tx      float64 `json:"tx"`
+	// Energy is the estimated energy consumed, in mWh.
+	Energy float64 `json:"energy_mwh"`
+	// Power is the estimated average power, in mW.
+	Power float64 `json:"power_mw"`
+}
+
+// PowerMeter estimates the energy consumption of a radio from the time it spends in each mode
+// and the typical power of the chip in the mode. It is safe for concurrent use.
+type PowerMeter struct {
+	mu     sync.Mutex
+	mode   PowerMode
+	mw     float64 // power of the current mode
+	since  time.Time
+	start  time.Time
+	time   [len(powerModes)]time.Duration // before since
+	energy float64                        // mJ before since
+}
+
+// NewPowerMeter returns a PowerMeter for a radio in the mode, drawing mw milliwatts.
+func NewPowerMeter(mode PowerMode, mw float64) *PowerMeter {
+	now := time.Now()
+	return &PowerMeter{mode: mode, mw: mw, since: now, start: now}
+}
+
+// Set records that the radio entered the mode, drawing mw milliwatts.
+func (m *PowerMeter) Set(mode PowerMode, mw float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.add(now)
+	m.mode = mode
+	m.mw = mw
+	m.since = now
+}
+
+func (m *PowerMeter) add(now time.Time) {
+	d := now.Sub(m.since)
+	m.time[m.mode] += d
+	m.energy += m.mw * d.Seconds()
+}
+
+// Mode returns the current mode of the radio.
+func (m *PowerMeter) Mode() PowerMode {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mode
+}
+
+// Usage returns the time in each mode and the estimated energy since the meter was created.
+func (m *PowerMeter) Usage() PowerUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.add(now)
+	m.since = now
+	u := PowerUsage{
+		Mode:    m.mode,
+		Sleep:   m.time[PowerSleep].Seconds(),
+		Standby: m.time[PowerStandby].Seconds(),
+		Rx:      m.time[PowerRx].Seconds(),
+		Tx:      m.time[PowerTx].Seconds(),
+		Energy:  m.energy / 3600,
+	}
+	if total := now.Sub(m.start).Seconds(); total > 0 {
+		u.Power = m.energy / total
+	}
+	return u
+}
@@ -0,0 +1,60 @@
+package lora
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrRadioTimeout is returned by the radios if the chip does not answer or finish in time, as a
+// send that never gets its TX done. It is a fault of the radio or its wiring, not of the packet.
+var ErrRadioTimeout = errors.New("radio timeout")
+
+// Radio is a LoRa transceiver that the forwarder receives from and sends with.
+// The context of the calls may cancel them and carries values as trace IDs down to the driver.
+type Radio interface {
+	// Name returns the name of the chip, e.g. "SX1276".
+	Name() string
+
+	// Receive configures the radio and puts it in receive mode.
+	Receive(ctx context.Context, cfg *Config) error
+
+	// GetPacket returns the packets received since the last call, or nil if there are none.
+	// The packet payloads are pooled buffers: the caller owns the returned packets
+	// and must call Release on each of them once it is done with them.
+	GetPacket(ctx context.Context) ([]*RxPacket, error)
+
+	// Send transmits the packet, blocking until it has been sent or ctx is done.
+	// If ctx is done while sending, the transmission is aborted and ctx.Err() returned.
+	Send(ctx context.Context, pkt *TxPacket) error
+}
+
+// RSSIReader is a Radio that reads the RSSI of the channel while no frame is received,
+// the noise floor of the channel.
+type RSSIReader interface {
+	// CurrentRSSI returns the current RSSI of the channel in dBm, without the RSSI offset of the board.
+	CurrentRSSI() (rssi float32, err error)
+}
+
+// FineTimestamper is a Radio that timestamps packets precisely enough for geolocation.
+// Radios without fine timestamps, as the SX127X, do not implement it.
+type FineTimestamper interface {
+	// FineTime returns the fine timestamp of a packet returned by GetPacket,
+	// in ns since the last PPS, or false if there is none.
+	FineTime(pkt *RxPacket) (ns uint32, ok bool)
+}
+
+// PowerManager is a Radio whose power mode can be set, with an estimate of its power consumption.
+// Receive puts it in PowerRx, and Send in PowerTx until the packet is sent. Sleep and standby
+// last until the next Receive or Send call.
+type PowerManager interface {
+	// SetPowerMode puts the radio to sleep, in standby, or back to receive with the config of
+	// the last Receive call. Only Send puts it in PowerTx.
+	SetPowerMode(ctx context.Context, mode PowerMode) error
+
+	// PowerMode returns the current mode of the radio.
+	PowerMode() PowerMode
+
+	// PowerUsage returns the time the radio spent in each mode and its estimated energy
+	// consumption since it was opened.
+	PowerUsage() PowerUsage
+}
@@ -0,0 +1,44 @@
+package lora
+
+// Region is a regional frequency plan, limiting the frequencies and power the gateway may use.
+type Region struct {
+	Name     string
+	MinFreq  Frequency // lowest frequency
+	MaxFreq  Frequency // highest frequency
+	MaxPower uint8     // max TX output power in dBm, but in the sub-bands
+	SubBands []SubBand // sub-bands with a power limit of their own
+}
+
+// SubBand is a part of a region with a power limit of its own.
+type SubBand struct {
+	MinFreq  Frequency // lowest frequency
+	MaxFreq  Frequency // highest frequency
+	MaxPower uint8     // max TX output power in dBm
+}
+
+// MaxPowerAt returns the max TX output power in dBm at the frequency.
+func (r *Region) MaxPowerAt(freq Frequency) uint8 {
+	for _, b := range r.SubBands {
+		if freq >= b.MinFreq && freq <= b.MaxFreq {
+			return b.MaxPower
+		}
+	}
+	return r.MaxPower
+}
+
+// Regions are the LoRaWAN regional frequency plans, by name.
+var Regions = map[string]*Region{
+	// 27 dBm in the g3 sub-band of the RX2 window at 869.525 MHz, see ETSI EN 300 220
+	"EU868": {Name: "EU868", MinFreq: 863000000, MaxFreq: 870000000, MaxPower: 16,
+		SubBands: []SubBand{{MinFreq: 869400000, MaxFreq: 869650000, MaxPower: 27}}},
+	"EU433": {Name: "EU433", MinFreq: 433050000, MaxFreq: 434790000, MaxPower: 12},
+	"US915": {Name: "US915", MinFreq: 902000000, MaxFreq: 928000000, MaxPower: 30},
+	"AU915": {Name: "AU915", MinFreq: 915000000, MaxFreq: 928000000, MaxPower: 30},
+	"AS923": {Name: "AS923", MinFreq: 915000000, MaxFreq: 928000000, MaxPower: 16},
+	"KR920": {Name: "KR920", MinFreq: 920900000, MaxFreq: 923300000, MaxPower: 14},
+	"IN865": {Name: "IN865", MinFreq: 865000000, MaxFreq: 867000000, MaxPower: 30},
+	"RU864": {Name: "RU864", MinFreq: 864000000, MaxFreq: 870000000, MaxPower: 16},
+	"CN470": {Name: "CN470", MinFreq: 470000000, MaxFreq: 510000000, MaxPower: 19},
+	// the worldwide 2.4 GHz ISM band, see the SX1280 backend
+	"ISM2400": {Name: "ISM2400", MinFreq: 2400000000, MaxFreq: 2500000000, MaxPower: 10},
+}
@@ -0,0 +1,397 @@
+package lora
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Bandwidth is a LoRa bandwidth, using the concentrator codes 0x01 to 0x0a,
+// and 0x0b to 0x0e for the bandwidths of the 2.4 GHz band.
+type Bandwidth uint8
+
+const (
+	BW7K8 Bandwidth = iota + 1
+	BW10K4
+	BW15K6
+	BW20K8
+	BW31K2
+	BW41K7
+	BW62K5
+	BW125K
+	BW250K
+	BW500K
+	BW203K // 203.125 kHz
+	BW406K // 406.25 kHz
+	BW812K // 812.5 kHz
+	BW1625K
+)
+
+var bwStr = []string{
+	"",
+	"BW7.8",
+	"BW10.4",
+	"BW15.6",
+	"BW20.8",
+	"BW31.2",
+	"BW41.7",
+	"BW62.5",
+	"BW125",
+	"BW250",
+	"BW500",
+	"BW203",
+	"BW406",
+	"BW812",
+	"BW1625",
+}
+
+var bwHz = []uint32{
+	0,
+	7800,
+	10400,
+	15600,
+	20800,
+	31250,
+	41700,
+	62500,
+	125000,
+	250000,
+	500000,
+	203125,
+	406250,
+	812500,
+	1625000,
+}
+
+// Valid reports whether bw is a known bandwidth.
+func (bw Bandwidth) Valid() bool {
+	return bw != 0 && int(bw) < len(bwStr)
+}
+
+// String returns the bandwidth as in "BW125", or "BW?" if it's unknown.
+func (bw Bandwidth) String() string {
+	if !bw.Valid() {
+		return "BW?"
+	}
+	return bwStr[bw]
+}
+
+// Band2G4 reports whether bw is a bandwidth of the 2.4 GHz band, as of the SX1280.
+// The other bandwidths are those of the sub-GHz bands.
+func (bw Bandwidth) Band2G4() bool {
+	return bw >= BW203K && bw <= BW1625K
+}
+
+// Hz returns the bandwidth in Hz, or 0 if it's unknown.
+func (bw Bandwidth) Hz() uint32 {
+	if !bw.Valid() {
+		return 0
+	}
+	return bwHz[bw]
+}
+
+// BandwidthFromHz returns the bandwidth of hz, e.g. BW125K for 125000.
+func BandwidthFromHz(hz uint32) (Bandwidth, error) {
+	for i, h := range bwHz {
+		if i != 0 && h == hz {
+			return Bandwidth(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown bandwidth: %d Hz", hz)
+}
+
+// ParseBandwidth parses a bandwidth in kHz as in "BW125" or as Hz value as in "125000".
+// Fractional bandwidths may be written with or without the fraction, so "BW62.5" and "BW62" are both BW62K5.
+func ParseBandwidth(s string) (Bandwidth, error) {
+	if strings.HasPrefix(s, "BW") {
+		khz, err := strconv.ParseFloat(s[2:], 64)
+		if err == nil {
+			hz := khz * 1000
+			for i, h := range bwHz {
+				// truncated values are less than 1 kHz off
+				if i != 0 && hz > float64(h)-1000 && hz <= float64(h) {
+					return Bandwidth(i), nil
+				}
+			}
+		}
+		return 0, fmt.Errorf("unknown bandwidth: %q", s)
+	}
+	hz, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unknown bandwidth: %q", s)
+	}
+	return BandwidthFromHz(uint32(hz))
+}
+
+// MarshalJSON writes the bandwidth in Hz.
+func (bw Bandwidth) MarshalJSON() ([]byte, error) {
+	if !bw.Valid() {
+		return nil, fmt.Errorf("invalid lora bandwidth: 0x%02x", uint8(bw))
+	}
+	return []byte(strconv.FormatUint(uint64(bw.Hz()), 10)), nil
+}
+
+// UnmarshalJSON reads the bandwidth in Hz (125000) or as string ("BW125").
+func (bw *Bandwidth) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*bw, err = ParseBandwidth(s)
+		return
+	}
+	var hz uint32
+	if err = json.Unmarshal(data, &hz); err != nil {
+		return err
+	}
+	*bw, err = BandwidthFromHz(hz)
+	return
+}
+
+// Coderate is a LoRa ECC coding rate, using the codes 0x05 (4/5) to 0x08 (4/8).
+type Coderate uint8
+
+const (
+	CR4_5 Coderate = iota + 5
+	CR4_6
+	CR4_7
+	CR4_8
+)
+
+// Valid reports whether cr is a known coderate.
+func (cr Coderate) Valid() bool {
+	return cr >= CR4_5 && cr <= CR4_8
+}
+
+// String returns the coderate as in "4/5", or "4/?" if it's unknown.
+func (cr Coderate) String() string {
+	if !cr.Valid() {
+		return "4/?"
+	}
+	return fmt.Sprintf("4/%d", uint8(cr))
+}
+
+// ParseCoderate parses a coderate as in "4/5". The aliases "2/3", "2/4" and "1/2" are accepted, too.
+func ParseCoderate(s string) (Coderate, error) {
+	switch s {
+	case "4/5":
+		return CR4_5, nil
+	case "4/6", "2/3":
+		return CR4_6, nil
+	case "4/7":
+		return CR4_7, nil
+	case "4/8", "2/4", "1/2":
+		return CR4_8, nil
+	}
+	return 0, fmt.Errorf("unknown coderate: %q", s)
+}
+
+// MarshalText writes the coderate as in "4/5".
+func (cr Coderate) MarshalText() ([]byte, error) {
+	if !cr.Valid() {
+		return nil, fmt.Errorf("invalid lora coderate: 0x%02x", uint8(cr))
+	}
+	return []byte(cr.String()), nil
+}
+
+// UnmarshalText reads the coderate as in "4/5", see ParseCoderate.
+func (cr *Coderate) UnmarshalText(text []byte) (err error) {
+	*cr, err = ParseCoderate(string(text))
+	return
+}
+
+// SpreadingFactor is a LoRa spreading factor, SF7 to SF12.
+// SF6 needs the implicit header mode, which the forwarder does not use, so it is not valid.
+type SpreadingFactor uint8
+
+const (
+	SF6 SpreadingFactor = iota + 6
+	SF7
+	SF8
+	SF9
+	SF10
+	SF11
+	SF12
+)
+
+// Valid reports whether sf is SF7 to SF12.
+func (sf SpreadingFactor) Valid() bool {
+	return sf >= SF7 && sf <= SF12
+}
+
+// String returns the spreading factor as in "SF7".
+func (sf SpreadingFactor) String() string {
+	return fmt.Sprintf("SF%d", uint8(sf))
+}
+
+// ParseSpreadingFactor parses a spreading factor as in "SF7" or "7".
+func ParseSpreadingFactor(s string) (SpreadingFactor, error) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "SF"), 10, 8)
+	if err != nil || !SpreadingFactor(n).Valid() {
+		return 0, fmt.Errorf("%w: unknown spreading factor %q", ErrBadDatarate, s)
+	}
+	return SpreadingFactor(n), nil
+}
+
+// MarshalJSON writes the spreading factor as number.
+func (sf SpreadingFactor) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Itoa(int(sf))), nil
+}
+
+// UnmarshalJSON reads the spreading factor as number (7) or as string ("SF7").
+func (sf *SpreadingFactor) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	if json.Unmarshal(data, &s) != nil {
+		s = string(data)
+	}
+	*sf, err = ParseSpreadingFactor(s)
+	return
+}
+
+// Datarate is a LoRa datarate, the combination of spreading factor and bandwidth.
+type Datarate struct {
+	SpreadingFactor SpreadingFactor
+	Bandwidth       Bandwidth
+}
+
+// ParseDatarate parses a LoRa datarate as in "SF7BW125" or "SF9BW62.5".
+func ParseDatarate(s string) (dr Datarate, err error) {
+	i := strings.Index(s, "BW")
+	if i == -1 {
+		return dr, fmt.Errorf("%w: can not parse lora datarate %q: no bandwidth", ErrBadDatarate, s)
+	}
+	if dr.SpreadingFactor, err = ParseSpreadingFactor(s[:i]); err != nil {
+		return dr, fmt.Errorf("can not parse lora datarate %q: %w", s, err)
+	}
+	if dr.Bandwidth, err = ParseBandwidth(s[i:]); err != nil {
+		return dr, fmt.Errorf("%w: can not parse lora datarate %q: %v", ErrBadDatarate, s, err)
+	}
+	return dr, nil
+}
+
+// String returns the datarate as in "SF7BW125".
+func (dr Datarate) String() string {
+	return dr.SpreadingFactor.String() + dr.Bandwidth.String()
+}
+
+// MarshalText writes the datarate as in "SF7BW125".
+func (dr Datarate) MarshalText() ([]byte, error) {
+	if !dr.SpreadingFactor.Valid() || !dr.Bandwidth.Valid() {
+		return nil, fmt.Errorf("%w: lora datarate %s", ErrBadDatarate, dr)
+	}
+	return []byte(dr.String()), nil
+}
+
+// UnmarshalText reads the datarate as in "SF7BW125", see ParseDatarate.
+func (dr *Datarate) UnmarshalText(text []byte) (err error) {
+	*dr, err = ParseDatarate(string(text))
+	return
+}
+
+// LRFHSSDatarate is an LR-FHSS datarate, the modulation type and the occupied channel width,
+// as in "M0CW137". The radios can not send or receive LR-FHSS, but network servers may ask to.
+type LRFHSSDatarate struct {
+	Modulation uint8  // modulation type, 0 for GMSK
+	OCW        uint16 // occupied channel width in kHz, truncated, as 137 for 136.719 kHz
+}
+
+// lrfhssOCW are the occupied channel widths of LR-FHSS in kHz.
+var lrfhssOCW = []uint16{137, 336, 1523}
+
+// Valid reports whether dr is a known LR-FHSS datarate.
+func (dr LRFHSSDatarate) Valid() bool {
+	for _, ocw := range lrfhssOCW {
+		if dr.OCW == ocw {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the datarate as in "M0CW137".
+func (dr LRFHSSDatarate) String() string {
+	return fmt.Sprintf("M%dCW%d", dr.Modulation, dr.OCW)
+}
+
+// ParseLRFHSSDatarate parses an LR-FHSS datarate as in "M0CW137".
+func ParseLRFHSSDatarate(s string) (dr LRFHSSDatarate, err error) {
+	i := strings.Index(s, "CW")
+	if !strings.HasPrefix(s, "M") || i == -1 {
+		return dr, fmt.Errorf("%w: can not parse lr-fhss datarate %q", ErrBadDatarate, s)
+	}
+	m, err := strconv.ParseUint(s[1:i], 10, 8)
+	if err != nil {
+		return dr, fmt.Errorf("%w: can not parse lr-fhss datarate %q: invalid modulation type", ErrBadDatarate, s)
+	}
+	ocw, err := strconv.ParseUint(s[i+2:], 10, 16)
+	if err != nil {
+		return dr, fmt.Errorf("%w: can not parse lr-fhss datarate %q: invalid channel width", ErrBadDatarate, s)
+	}
+	dr = LRFHSSDatarate{Modulation: uint8(m), OCW: uint16(ocw)}
+	if !dr.Valid() {
+		return dr, fmt.Errorf("%w: unknown lr-fhss channel width %d kHz", ErrBadDatarate, ocw)
+	}
+	return dr, nil
+}
+
+// MarshalText writes the datarate as in "M0CW137".
+func (dr LRFHSSDatarate) MarshalText() ([]byte, error) {
+	if !dr.Valid() {
+		return nil, fmt.Errorf("%w: lr-fhss datarate %s", ErrBadDatarate, dr)
+	}
+	return []byte(dr.String()), nil
+}
+
+// UnmarshalText reads the datarate as in "M0CW137", see ParseLRFHSSDatarate.
+func (dr *LRFHSSDatarate) UnmarshalText(text []byte) (err error) {
+	*dr, err = ParseLRFHSSDatarate(string(text))
+	return
+}
+
+// LRFHSSCoderate is an LR-FHSS coding rate, "1/3", "2/3", "1/2" or "5/6".
+type LRFHSSCoderate string
+
+// Valid reports whether cr is a known LR-FHSS coding rate.
+func (cr LRFHSSCoderate) Valid() bool {
+	switch cr {
+	case "1/3", "2/3", "1/2", "5/6":
+		return true
+	}
+	return false
+}
+
+// ParseLRFHSSCoderate parses an LR-FHSS coding rate as in "2/3".
+func ParseLRFHSSCoderate(s string) (LRFHSSCoderate, error) {
+	if cr := LRFHSSCoderate(s); cr.Valid() {
+		return cr, nil
+	}
+	return "", fmt.Errorf("unknown lr-fhss coderate: %q", s)
+}
+
+// Modulation is the modulation identifier "LORA", "FSK" or "LR-FHSS".
+type Modulation string
+
+const (
+	ModulationLoRa   Modulation = "LORA"
+	ModulationFSK    Modulation = "FSK"
+	ModulationLRFHSS Modulation = "LR-FHSS"
+)
+
+// String returns the modulation identifier.
+func (m Modulation) String() string {
+	return string(m)
+}
+
+// ParseModulation parses the modulation identifier, ignoring the case.
+func ParseModulation(s string) (Modulation, error) {
+	switch m := Modulation(strings.ToUpper(s)); m {
+	case ModulationLoRa, ModulationFSK, ModulationLRFHSS:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown modulation: %q", s)
+}
+
+// UnmarshalText reads the modulation identifier, see ParseModulation.
+func (m *Modulation) UnmarshalText(text []byte) (err error) {
+	*m, err = ParseModulation(string(text))
+	return
+}
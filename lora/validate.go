@@ -0,0 +1,204 @@
+package lora
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	MaxPower          = 20  // highest TX output power in dBm that the radio supports
+	MaxPayloadLength  = 255 // largest LoRa payload in bytes
+	MinPreambleLength = 6   // shortest LoRa preamble in symbols
+	MinDwellTime      = 500 // shortest time on a hop in milliseconds, see Config.Hops
+	MaxFreqCorrection = 100 // largest frequency correction in ppm, see Config.FreqCorrection
+
+	// MinFreq2G4 is the lowest frequency of the 2.4 GHz band, which has its own bandwidths, see Bandwidth.Band2G4.
+	MinFreq2G4 Frequency = 2400000000
+)
+
+var (
+	ErrFrequency = errors.New("frequency out of range")
+	ErrPower     = errors.New("power out of range")
+	// ErrBadDatarate is returned for a spreading factor or LR-FHSS datarate the radios do not have.
+	ErrBadDatarate = errors.New("invalid datarate")
+	// ErrQueueFull is wrapped by the errors of the packet queues that are full, as
+	// txqueue.ErrQueueFull and webhook.ErrQueueFull, so callers may check for any of them.
+	ErrQueueFull = errors.New("queue full")
+)
+
+// Errors is a list of validation errors.
+type Errors []error
+
+func (errs Errors) Error() string {
+	str := make([]string, len(errs))
+	for i, err := range errs {
+		str[i] = err.Error()
+	}
+	return strings.Join(str, "; ")
+}
+
+// Is reports whether any of the errors matches target.
+func (errs Errors) Is(target error) bool {
+	for _, err := range errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (errs Errors) errorOrNil() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Validate checks that the packet parameters are in range,
+// so that the packet can be marshaled and logged.
+func (rx *RxPacket) Validate() error {
+	var errs Errors
+	if rx.Modulation == ModulationLoRa {
+		errs = validateLoRa(errs, rx.LoRaBW, rx.LoRaCR, rx.Datarate)
+	}
+	if rx.Modulation == ModulationLRFHSS {
+		errs = validateLRFHSS(errs, rx.LRFHSS, rx.LRFHSSCR)
+	}
+	if len(rx.Data) > MaxPayloadLength {
+		errs = append(errs, fmt.Errorf("payload too large: %d bytes", len(rx.Data)))
+	}
+	return errs.errorOrNil()
+}
+
+// Validate checks that the packet parameters are in range, so that the packet can be sent by the radio.
+// If region is not nil the frequency is checked against the region, too.
+// The power is not checked, see ClampPower.
+func (tx *TxPacket) Validate(region *Region) error {
+	var errs Errors
+	if tx.Modulation == ModulationLoRa {
+		errs = validateLoRa(errs, tx.LoRaBW, tx.LoRaCR, tx.Datarate)
+		errs = validateBand(errs, tx.Freq, tx.LoRaBW)
+	}
+	if tx.Modulation == ModulationLRFHSS {
+		errs = validateLRFHSS(errs, tx.LRFHSS, tx.LRFHSSCR)
+	}
+	if region != nil && (tx.Freq < region.MinFreq || tx.Freq > region.MaxFreq) {
+		errs = append(errs, fmt.Errorf("%w: %s not in %s", ErrFrequency, tx.Freq, region.Name))
+	}
+	if tx.PreambleLength != 0 && tx.PreambleLength < MinPreambleLength {
+		errs = append(errs, fmt.Errorf("preamble too short: %d symbols", tx.PreambleLength))
+	}
+	if len(tx.Data) > MaxPayloadLength {
+		errs = append(errs, fmt.Errorf("payload too large: %d bytes", len(tx.Data)))
+	}
+	return errs.errorOrNil()
+}
+
+// ClampPower lowers the power to the max of the radio and, if region is not nil, to the max of the
+// region at the frequency, as servers ask for the max power of the region and leave it to the gateway.
+// It returns whether the power was lowered.
+func (tx *TxPacket) ClampPower(region *Region) bool {
+	maxPower := uint8(MaxPower)
+	if region != nil {
+		if p := region.MaxPowerAt(tx.Freq); p < maxPower {
+			maxPower = p
+		}
+	}
+	if tx.Power <= maxPower {
+		return false
+	}
+	tx.Power = maxPower
+	return true
+}
+
+// Validate checks the receive configuration, including the frequency against the configured region.
+func (cfg *Config) Validate() error {
+	var errs Errors
+	if cfg.Region != "" {
+		region, ok := Regions[cfg.Region]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown region: %q", cfg.Region))
+		} else if cfg.Freq < region.MinFreq || cfg.Freq > region.MaxFreq {
+			errs = append(errs, fmt.Errorf("%w: %s not in %s", ErrFrequency, cfg.Freq, region.Name))
+		}
+	} else if cfg.Freq == 0 {
+		errs = append(errs, fmt.Errorf("%w: no frequency", ErrFrequency))
+	}
+	if b := cfg.board; b != nil && (cfg.Freq < b.MinFreq || cfg.Freq > b.MaxFreq) {
+		errs = append(errs, fmt.Errorf("%w: %s not supported by board %s, %s to %s", ErrFrequency, cfg.Freq, cfg.Board, b.MinFreq, b.MaxFreq))
+	}
+	errs = validateLoRa(errs, cfg.LoRaBW, cfg.LoRaCR, cfg.Datarate)
+	if cfg.Freq != 0 {
+		errs = validateBand(errs, cfg.Freq, cfg.LoRaBW)
+	}
+	if cfg.PreambleLength != 0 && cfg.PreambleLength < MinPreambleLength {
+		errs = append(errs, fmt.Errorf("preamble too short: %d symbols", cfg.PreambleLength))
+	}
+	if cfg.RxGain.LNAGain > 6 {
+		errs = append(errs, fmt.Errorf("invalid lna gain: %d, must be 1 to 6", cfg.RxGain.LNAGain))
+	}
+	if cfg.FreqCorrection < -MaxFreqCorrection || cfg.FreqCorrection > MaxFreqCorrection {
+		errs = append(errs, fmt.Errorf("frequency correction out of range: %g ppm, max %d ppm", cfg.FreqCorrection, MaxFreqCorrection))
+	}
+	if len(cfg.Hops) != 0 && cfg.DwellTime < MinDwellTime {
+		errs = append(errs, fmt.Errorf("dwell time too short: %d ms, min %d ms", cfg.DwellTime, MinDwellTime))
+	}
+	for i := range cfg.Hops {
+		if err := cfg.Hop(i).Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("hop %d: %w", i, err))
+		}
+	}
+	if a := cfg.Adaptive; a != nil {
+		if len(cfg.Hops) != 0 {
+			errs = append(errs, errors.New("adaptive: can not be used with hops"))
+		}
+		if len(a.Candidates) == 0 {
+			errs = append(errs, errors.New("adaptive: no candidates"))
+		}
+		if _, _, err := a.QuietHours(); err != nil {
+			errs = append(errs, fmt.Errorf("adaptive: %w", err))
+		}
+		for _, freq := range a.Candidates {
+			candidate := *cfg
+			candidate.Freq = freq
+			candidate.Adaptive = nil
+			if err := candidate.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("adaptive: candidate %s: %w", freq, err))
+			}
+		}
+	}
+	return errs.errorOrNil()
+}
+
+func validateLoRa(errs Errors, bw Bandwidth, cr Coderate, sf SpreadingFactor) Errors {
+	if !bw.Valid() {
+		errs = append(errs, fmt.Errorf("invalid lora bandwidth: 0x%02x", uint8(bw)))
+	}
+	if !cr.Valid() {
+		errs = append(errs, fmt.Errorf("invalid lora coderate: 0x%02x", uint8(cr)))
+	}
+	if !sf.Valid() {
+		errs = append(errs, fmt.Errorf("%w: lora spreading factor SF%d", ErrBadDatarate, sf))
+	}
+	return errs
+}
+
+func validateLRFHSS(errs Errors, dr LRFHSSDatarate, cr LRFHSSCoderate) Errors {
+	if !dr.Valid() {
+		errs = append(errs, fmt.Errorf("%w: lr-fhss datarate %s", ErrBadDatarate, dr))
+	}
+	if !cr.Valid() {
+		errs = append(errs, fmt.Errorf("invalid lr-fhss coderate: %q", string(cr)))
+	}
+	return errs
+}
+
+// validateBand checks that the bandwidth is one of the band of the frequency, as the
+// 2.4 GHz band and the sub-GHz bands have different bandwidths.
+func validateBand(errs Errors, freq Frequency, bw Bandwidth) Errors {
+	if bw.Valid() && bw.Band2G4() != (freq >= MinFreq2G4) {
+		errs = append(errs, fmt.Errorf("%w: bandwidth %s not available at %s", ErrFrequency, bw, freq))
+	}
+	return errs
+}
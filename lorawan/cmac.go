@@ -0,0 +1,57 @@
+package lorawan
+
+import "crypto/aes"
+
+// cmac computes the AES-CMAC of msg as in RFC 4493.
+func cmac(key *AES128Key, msg []byte) (mac [16]byte) {
+	block, _ := aes.NewCipher(key[:]) // never fails for 16 byte keys
+
+	var l, k1, k2 [16]byte
+	block.Encrypt(l[:], l[:])
+	subkey(&k1, &l)
+	subkey(&k2, &k1)
+
+	n := (len(msg) + 15) / 16
+	complete := n != 0 && len(msg)%16 == 0
+	if n == 0 {
+		n = 1
+	}
+
+	var last [16]byte
+	if complete {
+		copy(last[:], msg[(n-1)*16:])
+		xor(&last, &k1)
+	} else {
+		rest := copy(last[:], msg[(n-1)*16:])
+		last[rest] = 0x80
+		xor(&last, &k2)
+	}
+
+	for i := 0; i < n-1; i++ {
+		for j := 0; j < 16; j++ {
+			mac[j] ^= msg[i*16+j]
+		}
+		block.Encrypt(mac[:], mac[:])
+	}
+	xor(&mac, &last)
+	block.Encrypt(mac[:], mac[:])
+	return
+}
+
+func subkey(dst, src *[16]byte) {
+	var carry byte
+	for i := 15; i >= 0; i-- {
+		b := src[i]
+		dst[i] = b<<1 | carry
+		carry = b >> 7
+	}
+	if src[0]&0x80 != 0 {
+		dst[15] ^= 0x87
+	}
+}
+
+func xor(dst, src *[16]byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
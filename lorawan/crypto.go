@@ -0,0 +1,31 @@
+package lorawan
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+)
+
+// EncryptFRMPayload encrypts the FRMPayload of a data frame with the 32 bit frame counter fCnt.
+// As the encryption is a XOR with a key stream, the same function decrypts, too.
+// Use the AppSKey for FPort > 0 and the NwkSKey for FPort 0.
+func EncryptFRMPayload(key *AES128Key, uplink bool, addr DevAddr, fCnt uint32, payload []byte) []byte {
+	block, _ := aes.NewCipher(key[:]) // never fails for 16 byte keys
+
+	var a, s [16]byte
+	a[0] = 0x01
+	if !uplink {
+		a[5] = 1
+	}
+	binary.LittleEndian.PutUint32(a[6:], uint32(addr))
+	binary.LittleEndian.PutUint32(a[10:], fCnt)
+
+	out := make([]byte, len(payload))
+	for i := 0; i < len(payload); i += 16 {
+		a[15] = byte(i/16 + 1)
+		block.Encrypt(s[:], a[:])
+		for j := 0; j < 16 && i+j < len(payload); j++ {
+			out[i+j] = payload[i+j] ^ s[j]
+		}
+	}
+	return out
+}
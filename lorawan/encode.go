@@ -0,0 +1,93 @@
+package lorawan
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// EUI64 is a DevEUI or AppEUI/JoinEUI, written as 16 hex digits in big endian as in "70B3D57ED0000001".
+type EUI64 [8]byte
+
+func (eui EUI64) String() string {
+	return fmt.Sprintf("%X", eui[:])
+}
+
+func (eui EUI64) MarshalText() ([]byte, error) {
+	return []byte(eui.String()), nil
+}
+
+func (eui *EUI64) UnmarshalText(text []byte) error {
+	n, err := strconv.ParseUint(string(text), 16, 64)
+	if err != nil || len(text) != 16 {
+		return fmt.Errorf("can not parse EUI %q: need 16 hex digits", text)
+	}
+	binary.BigEndian.PutUint64(eui[:], n)
+	return nil
+}
+
+// ErrPayloadTooLarge is returned for frames that do not fit a radio packet.
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// EncodeJoinRequest returns the PHYPayload of a join request, signed with the AppKey.
+func EncodeJoinRequest(appKey *AES128Key, appEUI, devEUI EUI64, devNonce uint16) []byte {
+	b := make([]byte, 19, 23)
+	b[0] = byte(JoinRequest)<<5 | lora.LoRaWANR1
+	// EUIs are little endian on air
+	for i := 0; i < 8; i++ {
+		b[1+i] = appEUI[7-i]
+		b[9+i] = devEUI[7-i]
+	}
+	binary.LittleEndian.PutUint16(b[17:], devNonce)
+	mac := cmac(appKey, b)
+	return append(b, mac[:4]...)
+}
+
+// DataFrame is an uplink or downlink data frame to encode, see EncodeData.
+type DataFrame struct {
+	MType   lora.MType // UnconfirmedDataUp, ConfirmedDataUp, ...
+	DevAddr DevAddr
+	FCtrl   byte   // ADR, ACK, ... The FOptsLen bits are set by EncodeData.
+	FCnt    uint32 // the full frame counter, the frame holds the lower 16 bits
+	FOpts   []byte
+	FPort   *uint8 // nil for frames without FRMPayload
+	// FRMPayload is the plain payload, encrypted by EncodeData.
+	FRMPayload []byte
+}
+
+// EncodeData returns the PHYPayload of the data frame, with the FRMPayload encrypted
+// with the AppSKey (or NwkSKey for FPort 0) and signed with the NwkSKey.
+func EncodeData(s *Session, f *DataFrame) ([]byte, error) {
+	if len(f.FOpts) > 15 {
+		return nil, fmt.Errorf("too many FOpts: %d bytes", len(f.FOpts))
+	}
+	if s.NwkSKey == nil {
+		return nil, fmt.Errorf("no NwkSKey for device %s", s.DevAddr)
+	}
+	uplink := f.MType == UnconfirmedDataUp || f.MType == ConfirmedDataUp
+	b := make([]byte, 8, 8+len(f.FOpts)+1+len(f.FRMPayload)+4)
+	b[0] = byte(f.MType)<<5 | lora.LoRaWANR1
+	binary.LittleEndian.PutUint32(b[1:], uint32(f.DevAddr))
+	b[5] = f.FCtrl&0xf0 | byte(len(f.FOpts))
+	binary.LittleEndian.PutUint16(b[6:], uint16(f.FCnt))
+	b = append(b, f.FOpts...)
+	if f.FPort != nil {
+		key := s.AppSKey
+		if *f.FPort == 0 {
+			key = s.NwkSKey
+		}
+		if key == nil {
+			return nil, fmt.Errorf("no AppSKey for device %s", s.DevAddr)
+		}
+		b = append(b, *f.FPort)
+		b = append(b, EncryptFRMPayload(key, uplink, f.DevAddr, f.FCnt, f.FRMPayload)...)
+	}
+	if len(b)+4 > lora.MaxPayloadLength {
+		return nil, ErrPayloadTooLarge
+	}
+	mic := ComputeMIC(s.NwkSKey, uplink, f.DevAddr, f.FCnt, b)
+	return append(b, mic[:]...), nil
+}
@@ -0,0 +1,145 @@
+// Package lorawan decodes LoRaWAN 1.0 frames and verifies and decrypts them with device session keys.
+package lorawan
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+const (
+	JoinRequest         = lora.MType(0)
+	JoinAccept          = lora.MType(1)
+	UnconfirmedDataUp   = lora.MType(2)
+	UnconfirmedDataDown = lora.MType(3)
+	ConfirmedDataUp     = lora.MType(4)
+	ConfirmedDataDown   = lora.MType(5)
+	RFU                 = lora.MType(6)
+	Proprietary         = lora.MType(7)
+)
+
+var ErrFrameTooShort = errors.New("frame too short")
+
+// DevAddr is a device address, written as 8 hex digits as in "26011BDA".
+type DevAddr uint32
+
+func (addr DevAddr) String() string {
+	return fmt.Sprintf("%08X", uint32(addr))
+}
+
+func (addr DevAddr) MarshalText() ([]byte, error) {
+	return []byte(addr.String()), nil
+}
+
+func (addr *DevAddr) UnmarshalText(text []byte) error {
+	n, err := strconv.ParseUint(string(text), 16, 32)
+	if err != nil {
+		return fmt.Errorf("can not parse DevAddr %q: %v", text, err)
+	}
+	*addr = DevAddr(n)
+	return nil
+}
+
+// AES128Key is a session or root key, written as 32 hex digits.
+type AES128Key [16]byte
+
+func (key AES128Key) String() string {
+	return fmt.Sprintf("%X", key[:])
+}
+
+func (key AES128Key) MarshalText() ([]byte, error) {
+	return []byte(key.String()), nil
+}
+
+func (key *AES128Key) UnmarshalText(text []byte) error {
+	if len(text) != 32 {
+		return fmt.Errorf("can not parse key: need 32 hex digits, got %d", len(text))
+	}
+	_, err := hex.Decode(key[:], text)
+	return err
+}
+
+// Session holds the ABP/OTAA session keys of a device.
+type Session struct {
+	DevAddr DevAddr    `json:"dev_addr"`
+	NwkSKey *AES128Key `json:"nwk_s_key"`
+	AppSKey *AES128Key `json:"app_s_key"`
+}
+
+// Frame is a decoded LoRaWAN PHYPayload.
+// For data frames all fields are set, other frames only have MHDR, MACPayload and MIC.
+type Frame struct {
+	MHDR       byte
+	MACPayload []byte
+	MIC        [4]byte
+
+	DevAddr    DevAddr
+	FCtrl      byte
+	FCnt       uint16
+	FOpts      []byte
+	FPort      *uint8 // nil if the frame has no FPort (and no FRMPayload)
+	FRMPayload []byte
+}
+
+// MType returns the message type of the frame.
+func (f *Frame) MType() lora.MType {
+	return lora.MType(f.MHDR >> 5)
+}
+
+// IsData reports whether the frame is a data up- or downlink.
+func (f *Frame) IsData() bool {
+	switch f.MType() {
+	case UnconfirmedDataUp, UnconfirmedDataDown, ConfirmedDataUp, ConfirmedDataDown:
+		return true
+	}
+	return false
+}
+
+// IsUplink reports whether the frame is sent by a device.
+func (f *Frame) IsUplink() bool {
+	switch f.MType() {
+	case JoinRequest, UnconfirmedDataUp, ConfirmedDataUp:
+		return true
+	}
+	return false
+}
+
+// Decode decodes a PHYPayload. The returned frame references data.
+func Decode(data []byte) (*Frame, error) {
+	if len(data) < 5 {
+		return nil, ErrFrameTooShort
+	}
+	if data[0]&0b11 != lora.LoRaWANR1 {
+		return nil, fmt.Errorf("unknown LoRaWAN major version %d", data[0]&0b11)
+	}
+	f := &Frame{
+		MHDR:       data[0],
+		MACPayload: data[1 : len(data)-4],
+	}
+	copy(f.MIC[:], data[len(data)-4:])
+	if !f.IsData() {
+		return f, nil
+	}
+
+	p := f.MACPayload
+	if len(p) < 7 {
+		return nil, ErrFrameTooShort
+	}
+	f.DevAddr = DevAddr(uint32(p[0]) | uint32(p[1])<<8 | uint32(p[2])<<16 | uint32(p[3])<<24)
+	f.FCtrl = p[4]
+	f.FCnt = uint16(p[5]) | uint16(p[6])<<8
+	n := 7 + int(f.FCtrl&0x0f)
+	if len(p) < n {
+		return nil, ErrFrameTooShort
+	}
+	f.FOpts = p[7:n]
+	if len(p) > n {
+		fPort := p[n]
+		f.FPort = &fPort
+		f.FRMPayload = p[n+1:]
+	}
+	return f, nil
+}
@@ -0,0 +1,92 @@
+package lorawan
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrInvalidMIC    = errors.New("invalid MIC")
+	ErrUnknownDevice = errors.New("unknown device")
+)
+
+// ComputeMIC returns the MIC of a data frame msg (MHDR | MACPayload) with the 32 bit frame counter fCnt.
+func ComputeMIC(key *AES128Key, uplink bool, addr DevAddr, fCnt uint32, msg []byte) (mic [4]byte) {
+	b := make([]byte, 16+len(msg))
+	b[0] = 0x49
+	if !uplink {
+		b[5] = 1
+	}
+	binary.LittleEndian.PutUint32(b[6:], uint32(addr))
+	binary.LittleEndian.PutUint32(b[10:], fCnt)
+	b[15] = byte(len(msg))
+	copy(b[16:], msg)
+	mac := cmac(key, b)
+	copy(mic[:], mac[:4])
+	return
+}
+
+// MICVerifier checks the MIC of uplinks from devices with known network session keys.
+type MICVerifier struct {
+	mu      sync.Mutex
+	devices map[DevAddr]*micDevice
+}
+
+type micDevice struct {
+	key  *AES128Key
+	fCnt uint32 // last valid 32 bit frame counter
+}
+
+// NewMICVerifier returns a verifier for all sessions that have a NwkSKey.
+func NewMICVerifier(sessions []Session) *MICVerifier {
+	v := &MICVerifier{devices: make(map[DevAddr]*micDevice)}
+	for _, s := range sessions {
+		if s.NwkSKey != nil {
+			v.devices[s.DevAddr] = &micDevice{key: s.NwkSKey}
+		}
+	}
+	return v
+}
+
+// Verify checks the MIC of a data uplink PHYPayload.
+// Other frames, like join requests, can not be checked and return nil.
+// Data uplinks of devices without session return an error wrapping ErrUnknownDevice.
+func (v *MICVerifier) Verify(data []byte) error {
+	_, _, err := v.VerifyFrame(data)
+	return err
+}
+
+// VerifyFrame is like Verify, but returns the decoded frame and its full 32 bit frame counter, too.
+func (v *MICVerifier) VerifyFrame(data []byte) (*Frame, uint32, error) {
+	f, err := Decode(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !f.IsData() || !f.IsUplink() {
+		return f, 0, nil
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	dev := v.devices[f.DevAddr]
+	if dev == nil {
+		return f, 0, fmt.Errorf("%w: %s", ErrUnknownDevice, f.DevAddr)
+	}
+	// the frame holds the lower 16 bits of the frame counter only
+	fCnt := dev.fCnt&^0xffff | uint32(f.FCnt)
+	if fCnt < dev.fCnt {
+		fCnt += 0x10000
+	}
+	msg := data[:len(data)-4]
+	// the device might have been reset, so try the plain 16 bit counter, too
+	for _, c := range []uint32{fCnt, uint32(f.FCnt)} {
+		if ComputeMIC(dev.key, true, f.DevAddr, c, msg) == f.MIC {
+			dev.fCnt = c
+			return f, c, nil
+		}
+	}
+	return f, 0, fmt.Errorf("%w: device %s, FCnt %d", ErrInvalidMIC, f.DevAddr, f.FCnt)
+}
@@ -0,0 +1,66 @@
+package lorawan
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DevAddrPrefix is a range of device addresses, written as an address and the number of
+// leading bits that are fixed, as in "26000000/7".
+type DevAddrPrefix struct {
+	Addr DevAddr
+	Len  int
+}
+
+func (p DevAddrPrefix) String() string {
+	return fmt.Sprintf("%s/%d", p.Addr, p.Len)
+}
+
+// Contains reports whether the address is in the range.
+func (p DevAddrPrefix) Contains(addr DevAddr) bool {
+	if p.Len == 0 {
+		return true
+	}
+	mask := ^DevAddr(0) << (32 - p.Len)
+	return addr&mask == p.Addr&mask
+}
+
+// ParseDevAddrPrefix parses a prefix as in "26000000/7".
+func ParseDevAddrPrefix(s string) (p DevAddrPrefix, err error) {
+	i := strings.IndexByte(s, '/')
+	if i == -1 {
+		return p, fmt.Errorf("can not parse DevAddr prefix %q: no length", s)
+	}
+	if err = p.Addr.UnmarshalText([]byte(s[:i])); err != nil {
+		return p, fmt.Errorf("can not parse DevAddr prefix %q: %v", s, err)
+	}
+	if p.Len, err = strconv.Atoi(s[i+1:]); err != nil || p.Len < 0 || p.Len > 32 {
+		return p, fmt.Errorf("can not parse DevAddr prefix %q: length must be 0 to 32", s)
+	}
+	return p, nil
+}
+
+// nwkIDBits is the length of the NwkID in the device addresses of each NetID type,
+// see the LoRaWAN Backend Interfaces.
+var nwkIDBits = [8]int{6, 6, 9, 11, 12, 13, 15, 17}
+
+// NetIDPrefix returns the range of the device addresses of a NetID, written as 6 hex digits
+// as in "000013". The addresses start with the NetID type as that many 1 bits and a 0,
+// followed by the NwkID, the low bits of the NetID.
+func NetIDPrefix(netID string) (p DevAddrPrefix, err error) {
+	n, err := strconv.ParseUint(netID, 16, 24)
+	if err != nil || len(netID) != 6 {
+		return p, fmt.Errorf("can not parse NetID %q: need 6 hex digits", netID)
+	}
+	typ := int(n >> 21)
+	bits := nwkIDBits[typ]
+	nwkID := DevAddr(n) & (1<<bits - 1)
+	typePrefix := ^DevAddr(0) << (32 - typ) // typ 1 bits, then the 0 bit
+	if typ == 0 {
+		typePrefix = 0
+	}
+	p.Len = typ + 1 + bits
+	p.Addr = typePrefix | nwkID<<(32-p.Len)
+	return p, nil
+}
@@ -0,0 +1,35 @@
+package lorawan
+
+// RelayFPort is the FPort of the uplinks of a relay that forward the uplink of an end device,
+// as in LoRaWAN TS011.
+const RelayFPort = 226
+
+// RelayType is the role of a frame in the relay protocol of LoRaWAN TS011.
+type RelayType uint8
+
+const (
+	NotRelay    RelayType = iota
+	RelayWOR              // wake on radio frame of an end device, to wake the relay up
+	RelayWORAck           // answer of the relay to a WOR
+	RelayUplink           // uplink of a relay that holds the uplink of an end device
+)
+
+var relayTypeNames = [...]string{"", "wor", "wor_ack", "relay_uplink"}
+
+func (t RelayType) String() string {
+	return relayTypeNames[t]
+}
+
+// Relay returns the role of the frame in the relay protocol. WOR frames are proprietary frames
+// that start with their WOR type, 0 for a WOR and 1 for a WOR ACK, and the DevAddr of the device.
+func (f *Frame) Relay() RelayType {
+	switch {
+	case f.MType() == Proprietary && len(f.MACPayload) >= 5 && f.MACPayload[0] == 0:
+		return RelayWOR
+	case f.MType() == Proprietary && len(f.MACPayload) >= 5 && f.MACPayload[0] == 1:
+		return RelayWORAck
+	case f.IsData() && f.IsUplink() && f.FPort != nil && *f.FPort == RelayFPort:
+		return RelayUplink
+	}
+	return NotRelay
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+)
+
+// maxFCntGap is the largest FCnt step that counts the skipped frames as lost. A smaller FCnt
+// than the last, which is a step beyond it, is taken as a reset of the device counters.
+const maxFCntGap = 16384
+
+// deviceLoss is the uplink loss of a device as seen by this gateway, from the gaps in its FCnt,
+// since the forwarder started.
+type deviceLoss struct {
+	Received int `json:"received"`
+	Lost     int `json:"lost"`
+	// Loss is the percentage of the frames the gateway did not receive.
+	Loss float64 `json:"loss"`
+	// Resets counts how often the FCnt went back, as when the device joined again or restarted.
+	Resets   int    `json:"resets"`
+	LastFCnt uint16 `json:"last_fcnt"`
+}
+
+// countLoss accounts a data uplink with a valid CRC in the loss of its device. Retransmissions,
+// which have the FCnt of the last frame, are not counted.
+func (gw *Gateway) countLoss(pkt *lora.RxPacket) {
+	if pkt.StatCRC != 1 {
+		return
+	}
+	f, err := lorawan.Decode(pkt.Data)
+	if err != nil || !f.IsData() || !f.IsUplink() {
+		return
+	}
+	d := gw.uplinkLoss[f.DevAddr]
+	if d == nil {
+		if len(gw.uplinkLoss) >= maxAirtimeDevices {
+			return
+		}
+		gw.uplinkLoss[f.DevAddr] = &deviceLoss{Received: 1, LastFCnt: f.FCnt}
+		return
+	}
+	// the 16 bit difference holds across the wrap of the frame counter
+	switch gap := f.FCnt - d.LastFCnt; {
+	case gap == 0:
+		return
+	case gap <= maxFCntGap:
+		d.Lost += int(gap) - 1
+	default:
+		d.Resets++
+		log(LogLevelVerbose, "loss: FCnt of %s went back from %d to %d", gw.privacy.id(f.DevAddr.String()), d.LastFCnt, f.FCnt)
+	}
+	d.Received++
+	d.LastFCnt = f.FCnt
+	d.Loss = 100 * float64(d.Lost) / float64(d.Received+d.Lost)
+}
+
+// lossSnapshot returns a copy of the uplink loss by DevAddr.
+func (gw *Gateway) lossSnapshot() map[string]deviceLoss {
+	s := make(map[string]deviceLoss, len(gw.uplinkLoss))
+	for addr, d := range gw.uplinkLoss {
+		if k := gw.privacy.id(addr.String()); k != "" {
+			s[k] = *d
+		}
+	}
+	return s
+}
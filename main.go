@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -10,36 +12,63 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/Waziup/single_chan_pkt_fwd/SX127X"
+	"github.com/Waziup/single_chan_pkt_fwd/api"
+	"github.com/Waziup/single_chan_pkt_fwd/clock"
+	"github.com/Waziup/single_chan_pkt_fwd/coverage"
+	"github.com/Waziup/single_chan_pkt_fwd/display"
+	"github.com/Waziup/single_chan_pkt_fwd/eventbus"
 	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/forwarder"
+	"github.com/Waziup/single_chan_pkt_fwd/heartbeat"
+	"github.com/Waziup/single_chan_pkt_fwd/led"
 	"github.com/Waziup/single_chan_pkt_fwd/lora"
-
-	"periph.io/x/host/v3"
-	_ "periph.io/x/periph/host/rpi"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+	"github.com/Waziup/single_chan_pkt_fwd/metrics"
+	"github.com/Waziup/single_chan_pkt_fwd/middleware"
+	"github.com/Waziup/single_chan_pkt_fwd/ntp"
+	"github.com/Waziup/single_chan_pkt_fwd/secrets"
+	"github.com/Waziup/single_chan_pkt_fwd/spool"
+	"github.com/Waziup/single_chan_pkt_fwd/standalone"
+	"github.com/Waziup/single_chan_pkt_fwd/store"
+	"github.com/Waziup/single_chan_pkt_fwd/tracing"
+	"github.com/Waziup/single_chan_pkt_fwd/txqueue"
+	"github.com/Waziup/single_chan_pkt_fwd/usage"
+	"github.com/Waziup/single_chan_pkt_fwd/webhook"
 )
 
-var gwid uint64
-
-var tx = make(chan *lora.TxPacket)
-var stat = new(fwd.Statistic)
-
-var servers []*net.UDPAddr
-
-var laddr = &net.UDPAddr{
-	Port: 0,
-	IP:   net.ParseIP("0.0.0.0"),
-}
-
 var never = time.Duration(math.MaxInt64)
 
 var checkReceived = time.Millisecond * 500
 
-var tickerKeepalive = time.NewTicker(time.Second * 60)
-var tickerStatusReport = time.NewTicker(time.Second * 240)
+// addStaticMeta adds the keys of staticMeta that the uplink has no value for, so the tags of
+// bridged forwarders are kept.
+func (gw *Gateway) addStaticMeta(pkt *lora.RxPacket) {
+	if len(gw.staticMeta) == 0 {
+		return
+	}
+	// the map may be shared with clones of the packet
+	meta := make(map[string]string, len(pkt.Meta)+len(gw.staticMeta))
+	for k, v := range gw.staticMeta {
+		meta[k] = v
+	}
+	for k, v := range pkt.Meta {
+		meta[k] = v
+	}
+	pkt.Meta = meta
+}
 
-var socket *net.UDPConn
+// wallTime returns the system time t, corrected by the NTP offset if enabled.
+func (gw *Gateway) wallTime(t time.Time) time.Time {
+	if gw.clockMonitor == nil {
+		return t
+	}
+	return gw.clockMonitor.Time(t)
+}
 
 const LogLevelNone = 0
 const LogLevelDebug = 5
@@ -48,7 +77,22 @@ const LogLevelNormal = 3
 const LogLevelWarning = 2
 const LogLevelError = 1
 
-var logLevel int = LogLevelNormal
+// logLevel is the level of the log, set by -l and the "log_level" admin action, accessed atomically.
+// The log is that of the process, so the level is shared by all its gateways: the admin action of
+// one gateway sets the level of the others too.
+var logLevel int32 = LogLevelNormal
+
+// currentLogLevel returns the level of the log.
+func currentLogLevel() int {
+	return int(atomic.LoadInt32(&logLevel))
+}
+
+// errorReporters are the heartbeat reporters the errors of the log are set in, of the gateways
+// that have one.
+var errorReporters = struct {
+	sync.Mutex
+	m map[*heartbeat.Reporter]bool
+}{m: make(map[*heartbeat.Reporter]bool)}
 
 var logLevelStr = []string{
 	"[     ] ",
@@ -63,36 +107,54 @@ func fatal(format string, v ...interface{}) {
 	logger.Fatalf("[FATAL] "+format, v...)
 }
 
+// parseLogLevel parses a log level name as for the -l flag, like "warn" or "w".
+func parseLogLevel(s string) (int, error) {
+	switch s {
+	case "normal":
+		return LogLevelNormal, nil
+	case "error", "e":
+		return LogLevelError, nil
+	case "warn", "w":
+		return LogLevelWarning, nil
+	case "verbose", "v":
+		return LogLevelVerbose, nil
+	case "debug", "d":
+		return LogLevelDebug, nil
+	case "none", "n":
+		return LogLevelNone, nil
+	}
+	return 0, fmt.Errorf("unknown log level: %q", s)
+}
+
 func log(level int, format string, v ...interface{}) {
 	timestamp := time.Now().UTC().Format(time.RFC822)
-	if level <= logLevel && level >= -1 && level < 6 {
+	if level <= currentLogLevel() && level >= -1 && level < 6 {
 		logger.Printf(logLevelStr[level]+ "||" + timestamp + "|| "+format, v...)
 	}
+	if level == LogLevelError {
+		errorReporters.Lock()
+		for r := range errorReporters.m {
+			r.SetError(fmt.Sprintf(format, v...))
+		}
+		errorReporters.Unlock()
+	}
 }
 
 func main() {
-	host.Init()
+	closeInheritedFiles()
 
 	logger.SetFlags(0)
 
 	ll := flag.String("l", "", "log level: error, warn, verbose, debug, none")
+	selftest := flag.Bool("selftest", false, "check the SPI bus, reset and DIO0 wiring of the radios and exit")
 	flag.Parse()
 
-	switch *ll {
-	case "", "normal":
-		// logLevel = LogLevelNormal
-	case "error", "e":
-		logLevel = LogLevelError
-	case "warn", "w":
-		logLevel = LogLevelWarning
-	case "verbose", "v":
-		logLevel = LogLevelVerbose
-	case "debug", "d":
-		logLevel = LogLevelDebug
-	case "none", "n":
-		logLevel = LogLevelNone
-	default:
-		fatal("unknown log level (-l): %q", *ll)
+	if *ll != "" {
+		level, err := parseLogLevel(*ll)
+		if err != nil {
+			fatal("%v (-l)", err)
+		}
+		atomic.StoreInt32(&logLevel, int32(level))
 	}
 
 	data, err := ioutil.ReadFile("global_conf.json")
@@ -101,44 +163,238 @@ func main() {
 		fatal("open %s/global_conf.json: %v", dir, err)
 	}
 
+	newGateway().serve(context.Background(), data, *selftest)
+}
+
+// serve configures the gateway with the data of global_conf.json and forwards until ctx is done
+// or it fails. With selftest, it checks the wiring of the radios and exits instead.
+func (gw *Gateway) serve(ctx context.Context, data []byte, selftest bool) {
+	defer close(gw.done)
+	data, remoteData, err := gw.loadRemoteConfig(data)
+	if err != nil {
+		fatal("can not load remote config: %v", err)
+	}
+	// the config as written, for the audit, without the secrets
+	unresolvedData := data
+
+	if data, err = resolveSecrets(data); err != nil {
+		fatal("can not resolve secrets of 'global_conf.json': %v", err)
+	}
+
 	var globalConfig GlobalConfig
 	err = json.Unmarshal(data, &globalConfig)
 	if err != nil {
 		fatal("can not parse 'global_conf.json': %v", err)
 	}
 
-	if globalConfig.SX127XConf == nil {
-		fatal("no SX127X_conf in config")
+	radioConfs := globalConfig.Radios
+	if globalConfig.SX127XConf != nil {
+		radioConfs = append([]*lora.Config{globalConfig.SX127XConf}, radioConfs...)
+	}
+	if len(radioConfs) == 0 {
+		fatal("no SX127X_conf or radios in config")
 	}
 
 	if globalConfig.GatewayConfig == nil {
 		fatal("no gateway_conf in config")
 	}
 
-	if globalConfig.SX127XConf.LoRaBW == 0 {
-		globalConfig.SX127XConf.LoRaBW = 125000 // BW 125
+	spiDevices := make(map[string]bool)
+	for i, cfg := range radioConfs {
+		if cfg.LoRaBW == 0 {
+			cfg.LoRaBW = lora.BW125K
+		}
+		if cfg.LoRaCR == 0 {
+			cfg.LoRaCR = lora.CR4_5
+		}
+		if err := cfg.ApplyBoard(); err != nil {
+			fatal("invalid config of radio %d: %v", i, err)
+		}
+		if err := cfg.Validate(); err != nil {
+			fatal("invalid config of radio %d: %v", i, err)
+		}
+		if cfg.SpiDevice != "" && spiDevices[cfg.SpiDevice] {
+			fatal("invalid config of radio %d: spiDevice %s used twice", i, cfg.SpiDevice)
+		}
+		spiDevices[cfg.SpiDevice] = true
+	}
+	if selftest {
+		selfTest(radioConfs)
 	}
-	if globalConfig.SX127XConf.LoRaCR == "" {
-		globalConfig.SX127XConf.LoRaCR = "4/5" //CR 4/5
+	gw.region = lora.Regions[radioConfs[0].Region]
+	if gw.region != nil {
+		log(LogLevelVerbose, "using region %s", gw.region.Name)
 	}
+
 	if globalConfig.GatewayConfig.KeepaliveInterval != 0 {
-		tickerKeepalive = time.NewTicker(time.Second * time.Duration(globalConfig.GatewayConfig.KeepaliveInterval))
+		gw.keepalive = time.Second * time.Duration(globalConfig.GatewayConfig.KeepaliveInterval)
+		gw.tickerKeepalive = gw.clock.NewTicker(gw.keepalive)
 		log(LogLevelVerbose, "using %d seconds gateway keepaliveInterval", globalConfig.GatewayConfig.KeepaliveInterval)
 	}else{
 		log(LogLevelVerbose, "using %d seconds gateway keepaliveInterval", 60)
-		tickerKeepalive = time.NewTicker(time.Second * time.Duration(60))
+		gw.tickerKeepalive = gw.clock.NewTicker(time.Second * time.Duration(60))
 	}
 	if globalConfig.GatewayConfig.StatusReportInterval != 0 {
 		log(LogLevelVerbose, "using %d seconds gateway StatusReportInterval", globalConfig.GatewayConfig.StatusReportInterval)
-		tickerStatusReport = time.NewTicker(time.Second * time.Duration(globalConfig.GatewayConfig.StatusReportInterval))
+		gw.statusReport = time.Second * time.Duration(globalConfig.GatewayConfig.StatusReportInterval)
+		gw.tickerStatusReport = gw.clock.NewTicker(gw.statusReport)
 	}else{
 		log(LogLevelVerbose, "using %d seconds gateway StatusReportInterval", 240)
-		tickerStatusReport = time.NewTicker(time.Second * time.Duration(240))
+		gw.tickerStatusReport = gw.clock.NewTicker(time.Second * time.Duration(240))
+	}
+
+	if globalConfig.GatewayConfig.VerifyMIC {
+		gw.micVerifier = lorawan.NewMICVerifier(globalConfig.Devices)
+		gw.dropUnknownDevices = globalConfig.GatewayConfig.DropUnknownDevices
+		log(LogLevelVerbose, "verifying uplink MICs of %d devices", len(globalConfig.Devices))
+	}
+
+	if latency := globalConfig.GatewayConfig.DegradedLatency; latency != 0 {
+		gw.degradedLatency = time.Duration(latency) * time.Millisecond
+	}
+	if loss := globalConfig.GatewayConfig.DegradedLoss; loss != 0 {
+		gw.degradedLoss = loss
+	}
+
+	gw.boardMetadata = globalConfig.GatewayConfig.BoardMetadata
+	for k := range globalConfig.GatewayConfig.Meta {
+		if k == "" {
+			fatal("invalid gateway_conf: empty key in meta")
+		}
+	}
+	if gw.staticMeta = globalConfig.GatewayConfig.Meta; len(gw.staticMeta) != 0 {
+		log(LogLevelVerbose, "adding %d keys to the meta of uplinks", len(gw.staticMeta))
+	}
+	gw.radioWatchdog = time.Duration(globalConfig.GatewayConfig.RadioWatchdog) * time.Second
+	if secret := globalConfig.GatewayConfig.HMACSecret; secret != "" {
+		gw.hmac = &fwd.HMAC{Secret: []byte(secret), Clock: gw.clock}
+		log(LogLevelVerbose, "signing PUSH_DATA and verifying PULL_RESP packets")
+	}
+
+	if globalConfig.StandaloneConf != nil {
+		gw.app, err = standalone.New(globalConfig.StandaloneConf, globalConfig.Devices)
+		if err != nil {
+			fatal("invalid standalone_conf: %v", err)
+		}
+		gw.app.Logger = logger.New(os.Stdout, "", 0)
+		log(LogLevelVerbose, "decrypting uplinks of %d devices to %s", len(globalConfig.Devices), globalConfig.StandaloneConf.WebhookURL)
+		if len(globalConfig.StandaloneConf.Multicast) != 0 {
+			gw.multicastDownlinks = gw.app.Downlinks
+			log(LogLevelVerbose, "sending downlinks to %d multicast groups", len(globalConfig.StandaloneConf.Multicast))
+		}
+	}
+
+	if globalConfig.StoreConf != nil {
+		gw.pktStore, err = store.Open(globalConfig.StoreConf)
+		if err != nil {
+			fatal("can not open packet store: %v", err)
+		}
+		log(LogLevelVerbose, "storing packets in %s", globalConfig.StoreConf.Path)
+	}
+
+	if globalConfig.AuditConf != nil {
+		if err := gw.openAudit(globalConfig.AuditConf, unresolvedData); err != nil {
+			fatal("can not open audit log: %v", err)
+		}
+		log(LogLevelVerbose, "recording control actions in %s", globalConfig.AuditConf.Path)
+	}
+
+	if globalConfig.NTPConf != nil {
+		gw.clockMonitor = ntp.NewMonitor(globalConfig.NTPConf)
+		gw.clockMonitor.Logger = logger.New(os.Stdout, "", 0)
+		if err := gw.clockMonitor.Check(); err != nil {
+			log(LogLevelWarning, "ntp: %v", err)
+		} else {
+			log(LogLevelVerbose, "ntp: system clock offset %s", gw.clockMonitor.Offset())
+		}
+		go gw.clockMonitor.Run()
+	}
+
+	switch globalConfig.GatewayConfig.ImmediateRx {
+	case "", "abort":
+	case "wait":
+		gw.immeWaitRx = true
+	default:
+		fatal("unknown immediate_rx %q, must be \"abort\" or \"wait\"", globalConfig.GatewayConfig.ImmediateRx)
+	}
+
+	gw.sched = forwarder.NewScheduler(gw.clock, txqueue.New(globalConfig.GatewayConfig.DownlinkQueueFile))
+	if path := globalConfig.GatewayConfig.DownlinkQueueFile; path != "" {
+		gw.restoreTxQueue(path)
+	}
+
+	if globalConfig.SpoolConf != nil {
+		gw.uplinkSpool, err = spool.Open(globalConfig.SpoolConf)
+		if err != nil {
+			fatal("can not open uplink spool: %v", err)
+		}
+		ackTimeout := 5 * time.Second
+		if globalConfig.SpoolConf.AckTimeout != 0 {
+			ackTimeout = time.Duration(globalConfig.SpoolConf.AckTimeout) * time.Second
+		}
+		batch := globalConfig.SpoolConf.ReplayBatch
+		if batch <= 0 {
+			batch = 8
+		}
+		go gw.runSpool(ackTimeout, batch)
+		log(LogLevelVerbose, "spooling unacknowledged uplinks in %s, %d spooled", globalConfig.SpoolConf.Path, gw.uplinkSpool.Len())
+		if len(globalConfig.SpoolConf.Classes) != 0 {
+			log(LogLevelVerbose, "spooled uplinks by class: %v", gw.uplinkSpool.Lens())
+		}
+	}
+
+	if globalConfig.BackhaulWindowsConf != nil {
+		if gw.uplinkSpool == nil {
+			fatal("invalid backhaul_windows_conf: the uplinks are held in the spool, set spool_conf")
+		}
+		gw.backhaulWindows, err = newBackhaulSchedule(globalConfig.BackhaulWindowsConf, gw.uplinkSpool)
+		if err != nil {
+			fatal("invalid backhaul_windows_conf: %v", err)
+		}
+		log(LogLevelVerbose, "backhaul open in %s", strings.Join(globalConfig.BackhaulWindowsConf.Windows, ", "))
+	}
+
+	if len(globalConfig.Middleware) != 0 {
+		gw.chain, err = middleware.New(globalConfig.Middleware)
+		if err != nil {
+			fatal("invalid middleware: %v", err)
+		}
+		gw.chain.Clock = gw.clock
+		log(LogLevelVerbose, "middleware: %s", strings.Join(gw.chain.Names(), ", "))
+	}
+
+	if globalConfig.PrivacyConf != nil {
+		gw.privacy, err = newPrivacyFilter(globalConfig.PrivacyConf)
+		if err != nil {
+			fatal("invalid privacy_conf: %v", err)
+		}
+		middleware.PrivateID = gw.privacy.id
+		log(LogLevelVerbose, "privacy: %s device identifiers", globalConfig.PrivacyConf.Mode)
+	}
+
+	if globalConfig.FrameLogConf != nil {
+		gw.frameLog, err = newFrameLogger(globalConfig.FrameLogConf)
+		if err != nil {
+			fatal("invalid frame_log_conf: %v", err)
+		}
+	}
+
+	if globalConfig.ADRAdviceConf != nil {
+		gw.adrAdvisor = newADRAdvice(globalConfig.ADRAdviceConf, gw.privacy)
+	}
+
+	if globalConfig.CoverageConf != nil {
+		gw.coverageMap, err = coverage.New(globalConfig.CoverageConf, globalConfig.Devices)
+		if err != nil {
+			fatal("invalid coverage_conf: %v", err)
+		}
+		gw.coverageMap.Logger = logger.New(os.Stdout, "", 0)
+		log(LogLevelVerbose, "writing coverage map to %s", globalConfig.CoverageConf.Path)
 	}
 
 	log(LogLevelVerbose, "using %d servers for upstream", len(globalConfig.GatewayConfig.Servers))
 
-	servers = make([]*net.UDPAddr, 0, len(globalConfig.GatewayConfig.Servers))
+	gw.servers = make([]*upstreamServer, 0, len(globalConfig.GatewayConfig.Servers))
 	i := 0
 	for _, server := range globalConfig.GatewayConfig.Servers {
 		if server.Enabled {
@@ -156,54 +412,381 @@ func main() {
 			} else {
 				log(LogLevelVerbose, " server %d: %s:%d", i, server.Address, server.PortUp)
 			}
-			servers = append(servers, &net.UDPAddr{
+			if server.Version < 0 || server.Version > int(fwd.ProtocolV2) {
+				fatal("server %d: unknown serv_version %d", i, server.Version)
+			}
+			s := newUpstreamServer(&net.UDPAddr{
 				Port: server.PortUp,
 				IP:   ip,
-			})
+			}, server.Version, gw.clock)
+			s.backup = server.Backup
+			s.priority = server.Priority
+			if server.Routes != nil {
+				if s.routes, err = gw.parseRoutes(server.Routes); err != nil {
+					fatal("server %d: invalid serv_routes: %v", i, err)
+				}
+				log(LogLevelVerbose, " server %d: routes %s", i, s.routes)
+			}
+			gw.servers = append(gw.servers, s)
+		}
+	}
+
+	if len(gw.servers) == 0 && globalConfig.MDNSConf != nil && globalConfig.MDNSConf.Discover != "" {
+		gw.discoverServer(globalConfig.MDNSConf)
+	}
+
+	if globalConfig.GatewayConfig.Failover != nil {
+		gw.failover = newFailover(gw, globalConfig.GatewayConfig.Failover, gw.servers)
+		log(LogLevelVerbose, "failover: primary server %s, %d backup servers", gw.failover.primary.addr, len(gw.failover.backups))
+	}
+
+	if globalConfig.BridgeConf != nil {
+		if err := gw.startBridge(globalConfig.BridgeConf); err != nil {
+			fatal("invalid bridge_conf: %v", err)
 		}
+		log(LogLevelVerbose, "bridge: serving other forwarders in the %s mode", gw.gwBridge.Mode())
 	}
 
-	gwid, err = strconv.ParseUint(globalConfig.GatewayConfig.GatewayID, 16, 64)
+	gw.gwid, err = strconv.ParseUint(globalConfig.GatewayConfig.GatewayID, 16, 64)
 	if err != nil {
 		fatal("can not parse gateway_ID: %v", err)
 	}
 
-	log(LogLevelVerbose, "center frequency: %.2f Mhz", float64(globalConfig.SX127XConf.Freq)/1e6)
-	log(LogLevelVerbose, "spreading factor: SF%d", globalConfig.SX127XConf.Datarate)
+	globalConfig.applyProxy()
+
+	usageConf := globalConfig.UsageConf
+	if usageConf == nil {
+		usageConf = &usage.Config{}
+	}
+	gw.backhaul, err = usage.Open(usageConf)
+	if err != nil {
+		fatal("invalid usage_conf: %v", err)
+	}
+	gw.backhaul.Logger = logger.New(os.Stdout, "", 0)
+	if usageConf.Path != "" {
+		log(LogLevelVerbose, "keeping the backhaul usage in %s", usageConf.Path)
+	}
+
+	if globalConfig.WebhookConf != nil {
+		gw.hook, err = webhook.New(globalConfig.WebhookConf, gw.gwid)
+		if err != nil {
+			fatal("invalid webhook_conf: %v", err)
+		}
+		gw.hook.Logger = logger.New(os.Stdout, "", 0)
+		gw.hook.Traffic = func(sent, received int) {
+			gw.backhaul.Add(usage.BackendWebhook, sent, received)
+		}
+		log(LogLevelVerbose, "posting uplinks to %s", globalConfig.WebhookConf.URL)
+	}
+
+	if globalConfig.EventBusConf != nil {
+		gw.eventBus, err = eventbus.Listen(globalConfig.EventBusConf, gw.gwid)
+		if err != nil {
+			fatal("invalid event_bus_conf: %v", err)
+		}
+		gw.eventBus.Logger = logger.New(os.Stdout, "", 0)
+		log(LogLevelVerbose, "publishing events on %s", globalConfig.EventBusConf.Socket)
+	}
+
+	if globalConfig.MetricsConf != nil {
+		gw.exporter, err = metrics.New(globalConfig.MetricsConf, gw.gwid)
+		if err != nil {
+			fatal("invalid metrics_conf: %v", err)
+		}
+		gw.exporter.Logger = logger.New(os.Stdout, "", 0)
+		log(LogLevelVerbose, "pushing metrics to %s", globalConfig.MetricsConf.Target)
+	}
+
+	if globalConfig.HostConf != nil {
+		gw.hostMonitor = newHostMonitor(gw, globalConfig.HostConf)
+		log(LogLevelVerbose, "watching the host every %s", gw.hostMonitor.interval)
+	}
+
+	if globalConfig.RxScheduleConf != nil {
+		if err := globalConfig.RxScheduleConf.validate(); err != nil {
+			fatal("invalid rx_schedule_conf: %v", err)
+		}
+		gw.rxGate = newRxSchedule(gw, globalConfig.RxScheduleConf, gw.clock.Now())
+		if gw.rxGate.period != 0 {
+			log(LogLevelVerbose, "listening for %s every %s", gw.rxGate.listen, gw.rxGate.period)
+		}
+		if gw.rxGate.offline {
+			log(LogLevelVerbose, "sleeping while no backend is connected")
+		}
+	}
+
+	if globalConfig.HeartbeatConf != nil {
+		gw.reporter, err = heartbeat.New(globalConfig.HeartbeatConf, gw.gwid)
+		if err != nil {
+			fatal("invalid heartbeat_conf: %v", err)
+		}
+		gw.reporter.Logger = logger.New(os.Stdout, "", 0)
+		errorReporters.Lock()
+		errorReporters.m[gw.reporter] = true
+		errorReporters.Unlock()
+		log(LogLevelVerbose, "reporting the gateway health to %s", globalConfig.HeartbeatConf.URL)
+	}
+
+	if globalConfig.TracingConf != nil {
+		gw.tracer, err = tracing.New(globalConfig.TracingConf, gw.gwid)
+		if err != nil {
+			fatal("invalid tracing_conf: %v", err)
+		}
+		gw.tracer.Logger = logger.New(os.Stdout, "", 0)
+		log(LogLevelVerbose, "exporting traces to %s", globalConfig.TracingConf.Endpoint)
+	}
 
-	log(LogLevelVerbose, "this is gateway id %X", gwid)
+	if globalConfig.LEDConf != nil {
+		if err := initHost(); err != nil {
+			fatal("can not open leds: %v", err)
+		}
+		gw.statusLEDs, err = led.Open(globalConfig.LEDConf)
+		if err != nil {
+			fatal("can not open leds: %v", err)
+		}
+		go gw.runLEDs()
+	}
 
-	socket, err = net.ListenUDP("udp", laddr)
+	if globalConfig.DisplayConf != nil {
+		if err := initHost(); err != nil {
+			fatal("can not open display: %v", err)
+		}
+		gw.statusDisplay, err = display.Open(globalConfig.DisplayConf)
+		if err != nil {
+			fatal("can not open display: %v", err)
+		}
+		interval := 2 * time.Second
+		if globalConfig.DisplayConf.Interval > 0 {
+			interval = time.Duration(globalConfig.DisplayConf.Interval) * time.Second
+		}
+		go gw.runDisplay(interval)
+	}
+
+	if globalConfig.APIConf != nil {
+		gw.apiServer = api.New()
+		gw.apiServer.Publish("gateway", &gatewayStatus{
+			GatewayID: fmt.Sprintf("%016X", gw.gwid),
+			Started:   gw.clock.Now().UTC(),
+		})
+		if gw.auditLog != nil {
+			gw.apiServer.SetAudit(gw.auditLog)
+		}
+		gw.statsHistory = api.NewHistory(globalConfig.APIConf.History)
+		gw.apiServer.Handle("/api/stats/history", gw.statsHistory)
+		gw.apiServer.Handle("/api/stats/history.csv", gw.statsHistory)
+		if gw.privacy == nil {
+			gw.stream = api.NewStream()
+			gw.stream.Logger = logger.New(os.Stdout, "", 0)
+			gw.apiServer.Handle("/api/stream", gw.stream)
+		} else {
+			log(LogLevelVerbose, "not streaming the packets on /api/stream in privacy mode")
+		}
+		if gw.multicastDownlinks != nil {
+			gw.apiServer.Handle("/api/multicast/", gw.app)
+			gw.apiServer.Handle("/api/fuota", gw.app.FragHandler())
+			gw.apiServer.Handle("/api/fuota/", gw.app.FragHandler())
+		}
+		if globalConfig.APIConf.Admin != nil {
+			if err := gw.startAdmin(globalConfig.APIConf.Admin); err != nil {
+				fatal("invalid admin in api_conf: %v", err)
+			}
+			log(LogLevelVerbose, "serving admin actions to %d API tokens", len(globalConfig.APIConf.Admin.Tokens))
+		}
+		go func() {
+			fatal("api: %v", gw.apiServer.Serve(globalConfig.APIConf))
+		}()
+		scheme := "http"
+		if globalConfig.APIConf.TLS != nil {
+			scheme = "https"
+		}
+		log(LogLevelVerbose, "serving the API on %s://%s", scheme, globalConfig.APIConf.Address)
+		if globalConfig.APIConf.Auth == nil && !loopbackAddress(globalConfig.APIConf.Address) {
+			log(LogLevelWarning, "the API is served beyond localhost without auth in api_conf")
+		}
+	}
+
+	if gw.remoteConfig != nil {
+		go gw.watchRemoteConfig(remoteData)
+	}
+
+	if gw.hostMonitor != nil {
+		go gw.hostMonitor.run()
+	}
+
+	if globalConfig.MDNSConf != nil {
+		gw.advertise(globalConfig.MDNSConf, gw.gwid, globalConfig.APIConf)
+	}
+
+	for i, cfg := range radioConfs {
+		log(LogLevelVerbose, "radio %d: center frequency: %s", i, cfg.Freq)
+		log(LogLevelVerbose, "radio %d: spreading factor: %s", i, cfg.Datarate)
+	}
+
+	log(LogLevelVerbose, "this is gateway id %X", gw.gwid)
+
+	gw.socket, err = listenUDP(gw.laddr, globalConfig.GatewayConfig.Interface)
 	if err != nil {
 		fatal("%v", err)
 	}
-	laddr = socket.LocalAddr().(*net.UDPAddr)
-	log(LogLevelNormal, "listening on %s", laddr)
+	// closing the socket ends downstream
+	defer gw.socket.Close()
+	gw.laddr = gw.socket.LocalAddr().(*net.UDPAddr)
+	log(LogLevelNormal, "listening on %s", gw.laddr)
 
-	upstream(&fwd.Packet{
+	// the context carries values down to the radios
+	gw.upstream(ctx, &fwd.Packet{
 		Ident: fwd.PullData,
 		Token: fwd.RndToken(),
 	})
 
-	go downstream()
-	run(globalConfig.SX127XConf, globalConfig.GatewayConfig)
+	go gw.newWorker("network").Run(ctx, gw.downstream)
+	gw.run(ctx, radioConfs, globalConfig.GatewayConfig)
+}
+
+// gatewayRadio is a radio of the gateway with its receive configuration.
+type gatewayRadio struct {
+	lora.Radio
+	cfg       *lora.Config     // receive config, of the current hop if hopping
+	index     int              // index in the config, reported as RF chain of the uplinks
+	receiving bool             // false after sending or receiving a packet, which ends the receive mode
+	hop       *hopper          // nil if the radio does not hop
+	adaptive  *channelSelector // nil if the radio does not select its channel
+	asleep    bool             // put to sleep by the rx schedule
+	statusCfg *lora.Config     // cfg of the last published status
+	lastRx    time.Time        // when the radio last received packets, for the watchdog
+	checked   time.Time        // when the watchdog last checked the radio
 }
 
-var baseTime = time.Now()
+// gatewayStatus is the "gateway" section of the API status.
+type gatewayStatus struct {
+	GatewayID string    `json:"gateway_id"`
+	Started   time.Time `json:"started"`
+}
 
-func run(cfg *lora.Config, g_cfg *GatewayConfig) {
-	radio, err := SX127X.Discover(cfg)
+// loopbackAddress tells whether the address of the API listens on localhost only.
+func loopbackAddress(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		fatal("can not activate radio: %v", err)
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// radioStatus is an item of the "radios" section of the API status, with the applied settings.
+type radioStatus struct {
+	Index    int            `json:"index"`
+	Name     string         `json:"name"`
+	Freq     lora.Frequency `json:"freq"`
+	Datarate lora.Datarate  `json:"datr"`
+	Coderate lora.Coderate  `json:"codr"`
+	Hopping  bool           `json:"hopping"`
+	RxGain   lora.RxGain    `json:"rx_gain"`
+}
+
+// publishRadios publishes the current radio settings to the API.
+func (gw *Gateway) publishRadios(radios []*gatewayRadio) {
+	status := make([]*radioStatus, len(radios))
+	for i, radio := range radios {
+		radio.statusCfg = radio.cfg
+		status[i] = &radioStatus{
+			Index:    radio.index,
+			Name:     radio.Name(),
+			Freq:     radio.cfg.Freq,
+			Datarate: lora.Datarate{SpreadingFactor: radio.cfg.Datarate, Bandwidth: radio.cfg.LoRaBW},
+			Coderate: radio.cfg.LoRaCR,
+			Hopping:  radio.hop != nil,
+		}
+		if r, ok := radio.Radio.(interface{ GetRxGain() (lora.RxGain, error) }); ok {
+			gain, err := r.GetRxGain()
+			if err != nil {
+				log(LogLevelWarning, "radio %d: can not read rx gain: %v", radio.index, err)
+			}
+			status[i].RxGain = gain
+		}
+	}
+	gw.apiServer.Publish("radios", status)
+}
+
+// resolveSecrets replaces the references to environment variables and secrets in the config data.
+func resolveSecrets(data []byte) ([]byte, error) {
+	var cfg struct {
+		SecretsConf *secrets.Config `json:"secrets_conf"`
 	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	var store *secrets.Store
+	if cfg.SecretsConf != nil {
+		var err error
+		if store, err = secrets.Open(cfg.SecretsConf); err != nil {
+			return nil, err
+		}
+	}
+	return secrets.Resolve(data, store)
+}
 
-	log(LogLevelNormal, "radio %s activated.", radio.Name())
+// boardInfo returns the board metadata of a packet received by the radio.
+// The board is the index of the radio; the fine timestamp is only set by radios that have one.
+func boardInfo(radio *gatewayRadio, pkt *lora.RxPacket) *lora.BoardInfo {
+	info := &lora.BoardInfo{Board: uint8(radio.index)}
+	if ft, ok := radio.Radio.(lora.FineTimestamper); ok {
+		if ns, ok := ft.FineTime(pkt); ok {
+			info.FineTime = &ns
+		}
+	}
+	return info
+}
 
-	radio.Logger = logger.New(os.Stdout, "", 0)
-	radio.LogLevel = logLevel
+// radioFor returns the radio that listens on freq, so downlinks go out on the radio of their channel.
+// If no radio listens on freq, the first radio is tuned to it for the downlink.
+func radioFor(radios []*gatewayRadio, freq lora.Frequency) *gatewayRadio {
+	for _, radio := range radios {
+		if radio.cfg.Freq == freq {
+			return radio
+		}
+	}
+	return radios[0]
+}
 
-	var timeReceive = time.Now()
-	time.Sleep(time.Millisecond * 500)
+func (gw *Gateway) run(ctx context.Context, cfgs []*lora.Config, g_cfg *GatewayConfig) {
+	radios := make([]*gatewayRadio, len(cfgs))
+	for i, cfg := range cfgs {
+		r, err := lora.OpenRadio(cfg)
+		if err != nil {
+			fatal("can not activate radio %d: %v", i, err)
+		}
+		log(LogLevelNormal, "radio %d: %s activated.", i, r.Name())
+		radios[i] = &gatewayRadio{Radio: r, cfg: cfg, index: i}
+		if len(cfg.Hops) != 0 {
+			radios[i].hop = newHopper(i, cfg, gw.clock.Now())
+			radios[i].cfg = radios[i].hop.cfg()
+			log(LogLevelVerbose, "radio %d: hopping over %d channels every %d ms", i, len(cfg.Hops), cfg.DwellTime)
+		}
+		if cfg.Adaptive != nil {
+			radios[i].adaptive = newChannelSelector(cfg)
+			log(LogLevelVerbose, "radio %d: moving to the quietest of %d channels at %s", i, len(radios[i].adaptive.candidates), cfg.Adaptive.Hours)
+		}
+		if _, ok := r.(lora.PowerManager); gw.rxGate != nil && !ok {
+			log(LogLevelWarning, "radio %d: the radio can not sleep, it keeps receiving", i)
+		}
+	}
+
+	if g_cfg.RunAs != "" {
+		// the radios and the socket are open
+		if err := dropPrivileges(g_cfg.RunAs); err != nil {
+			fatal("can not run as %q: %v", g_cfg.RunAs, err)
+		}
+		log(LogLevelNormal, "running as %s", g_cfg.RunAs)
+	}
+
+	if gw.settle != 0 {
+		settle := gw.clock.NewTimer(gw.settle)
+		<-settle.C()
+	}
 
 	// for true {
 	// 	pkt := &lora.TxPacket{
@@ -223,230 +806,770 @@ func run(cfg *lora.Config, g_cfg *GatewayConfig) {
 	// 	time.Sleep(time.Second * 40)
 	// }
 
-	doReceive := false
-	timerSend := time.NewTimer(never)
-	stat.Desc =  g_cfg.Description
-	stat.Mail = g_cfg.Mail
-	stat.Latitude = g_cfg.Latitude
-	stat.Longitude = g_cfg.Longitude
-	stat.Altitude = g_cfg.Altitude
+	gw.stat.Desc =  g_cfg.Description
+	gw.stat.Mail = g_cfg.Mail
+	gw.stat.Latitude = g_cfg.Latitude
+	gw.stat.Longitude = g_cfg.Longitude
+	gw.stat.Altitude = g_cfg.Altitude
+
+	gw.newWorker("radio").Run(ctx, func(ctx context.Context) {
+		gw.loop(ctx, radios)
+	})
+}
+
+// loop is the main loop, which receives with the radios and queues and sends the downlinks.
+// After a panic it starts over, with the radios set up to receive again.
+func (gw *Gateway) loop(ctx context.Context, radios []*gatewayRadio) {
+	var err error
+	var timeReceive = gw.clock.Now()
+	for _, radio := range radios {
+		radio.receiving = false
+	}
+	timerSend := gw.clock.NewTimer(never)
+	defer timerSend.Stop()
+	if gw.sched.Queue.Len() != 0 {
+		gw.nextSend(timerSend)
+	}
+	timerReceive := gw.clock.NewTimer(checkReceived)
+	defer timerReceive.Stop()
 
 	for true {
 
-		if !doReceive {
-			err := radio.Receive(cfg)
-			if err != nil {
-				fatal("can not receive: %v", err)
+		if gw.rxGate != nil {
+			gw.rxGate.update(ctx, radios, gw.clock.Now())
+		}
+		for _, radio := range radios {
+			if radio.asleep {
+				continue
+			}
+			if radio.adaptive != nil && radio.adaptive.due(gw.clock.Now(), gw.sched.Queue.Len()) {
+				selectChannel(ctx, radio, gw.clock.Now())
+				if gw.apiServer != nil {
+					gw.publishChannels(radios)
+				}
+			}
+			if radio.hop != nil && radio.hop.hop(gw.clock.Now()) {
+				radio.cfg = radio.hop.cfg()
+				radio.receiving = false
+				log(LogLevelDebug, "radio %d: hop to %s, %s", radio.index, radio.cfg.Freq, radio.cfg.Datarate)
+			}
+			if !radio.receiving {
+				err := radio.Receive(ctx, radio.cfg)
+				if err != nil {
+					fatal("radio %d: can not receive: %v", radio.index, err)
+				}
+				if radio.hop == nil {
+					log(LogLevelNormal, "radio %d: waiting for packets ...", radio.index)
+				}
+				radio.receiving = true
+			}
+		}
+		if gw.apiServer != nil {
+			for _, radio := range radios {
+				if radio.statusCfg != radio.cfg {
+					gw.publishRadios(radios)
+					break
+				}
 			}
-			log(LogLevelNormal, "waiting for packets ...")
-			doReceive = true
 		}
 
-		timerReceive := time.NewTimer(checkReceived)
-		
-
-		
 		select {
-			case pkt := <-chanTx:
+			case <-ctx.Done():
+				return
+
+			case <-gw.syncs:
+
+			case dl := <-gw.chanTx:
 
 				log(LogLevelNormal, "received packet from upstream")
+				if gw.bridgeDownlink(dl) {
+					break
+				}
 
-				if pkt.Immediate {
+				_, schedule := gw.traceStage(dl.ctx, "schedule")
+				if schedule != nil {
+					gw.txTraces[dl.tx] = &downlinkTrace{ctx: dl.ctx, schedule: schedule}
+				}
+				it := &txqueue.Item{Pkt: dl.tx, Priority: txqueue.PriorityOf(dl.tx), Server: dl.server, Token: dl.token}
+				if s := gw.serverByAddr(dl.server); s != nil {
+					it.ServerPriority = s.priority
+				}
+				if it.Priority == txqueue.PriorityImmediate {
 					log(LogLevelNormal, "sending immediate packet ...")
-					doReceive = false
-					if err = radio.Send(pkt); err != nil {
-						log(LogLevelError, "can not send packet: %v", err)
+				} else {
+					dl.tx.Power = 14
+					dl.tx.ClampPower(gw.region)
+					it.At = gw.sched.At(dl.tx.CountUs)
+					if device, window, ok := gw.correlateRxWindow(dl.tx, it.At); ok && isJoinAccept(dl.tx) {
+						gw.recordJoinAccept(device, window)
 					}
-					stat.Dwnb += 1
-					continue
+					log(LogLevelNormal, "sending packet in %s, %s since last received", it.At.Sub(gw.clock.Now()), it.At.Sub(timeReceive))
 				}
-
-				pkt.Power = 14
-				doReceive = false
-
-				timeSend := baseTime.Add(time.Duration(pkt.CountUs) * time.Microsecond)
-				timeSend.Add(time.Second)
-				diff := timeSend.Sub(time.Now())
-				log(LogLevelNormal, "sending packet in %s, %s since last received", diff, timeSend.Sub(timeReceive))
-				// diff -= 200 * time.Microsecond
-				// time.Sleep(diff)
-				// tools.Nanosleep(int32(diff / time.Nanosecond))
-				log(LogLevelNormal, "tx: %s", pkt)
-				if err = radio.Send(pkt); err != nil {
-					log(LogLevelError, "can not send packet: %v", err)
+				ack := gw.queueDownlink(it)
+				if ack != fwd.NoError {
+					gw.endDownlinkTrace(dl.tx, ack)
 				}
-				log(LogLevelNormal, "tx: ok")
-
-				// enqueue packet
-				// if queue == nil {
-				// 	queue = &Queue{pkt: pkt}
-				// } else {
-				// 	if queue.pkt.CountUs > pkt.CountUs {
-				// 		queue = &Queue{
-				// 			next: queue,
-				// 			pkt:  pkt,
-				// 		}
-				// 	} else {
-				// 		for q := queue; ; q = q.next {
-				// 			if q.next == nil {
-				// 				q.next = &Queue{pkt: pkt}
-				// 				break
-				// 			}
-				// 			if q.next.pkt.CountUs > pkt.CountUs {
-				// 				q.next = &Queue{
-				// 					next: q.next,
-				// 					pkt:  pkt,
-				// 				}
-				// 				break
-				// 			}
-				// 		}
-				// 	}
-				// }
-				// queueSize++
-
-				// diff = 0 * time.Millisecond
-				// log(LogLevelNormal, "tx queue: %d packets, next packet in %s", queueSize, diff)
-				// timerSend.Reset(diff)
-
-			case <-timerReceive.C:
-				pkts, err := radio.GetPacket()
-				if err != nil {
-					fatal("can not receive packets: %v", err)
+				if ack == fwd.NoError && it.Priority == txqueue.PriorityImmediate {
+					// acknowledged once the radio is taken, with how it was taken
+					gw.immeAcks[dl.tx] = dl
+				} else {
+					gw.upstreamTo(dl.ctx, &fwd.Packet{
+						Token: dl.token,
+						Ident: fwd.TxAck,
+						TxAck: ack,
+					}, dl.server)
 				}
-				timeReceive = time.Now()
+				gw.nextSend(timerSend)
+
+			case ack := <-gw.bridgeTxAcks:
+				gw.forwardBridgeAck(ack)
+
+			case req := <-gw.adminRequests:
+				runAdmin(req, radios)
+
+			case pkt := <-gw.multicastDownlinks:
+				pkt.ClampPower(gw.region)
+				// multicast downlinks are acknowledged to nobody
+				gw.queueDownlink(&txqueue.Item{Pkt: pkt, Priority: txqueue.PriorityImmediate, Server: "multicast"})
+				gw.nextSend(timerSend)
+
+			case <-timerReceive.C():
+				rxStart := gw.clock.Now()
+				var pkts []*lora.RxPacket
+				for _, radio := range radios {
+					if radio.asleep {
+						continue
+					}
+					radioPkts, err := radio.GetPacket(ctx)
+					if err != nil {
+						if gw.radioWatchdog == 0 {
+							fatal("radio %d: can not receive packets: %v", radio.index, err)
+						}
+						log(LogLevelError, "radio %d: can not receive packets: %v", radio.index, err)
+						if !resetRadio(radio) {
+							fatal("radio %d: can not reset the radio", radio.index)
+						}
+						continue
+					}
+					if gw.radioWatchdog != 0 {
+						gw.watchRadio(radio, radioPkts != nil)
+					}
+					if radioPkts == nil {
+						gw.noise.sample(radio, gw.clock.Now())
+					}
+					if radioPkts != nil {
+						radio.receiving = false
+						if radio.hop != nil {
+							radio.hop.received(len(radioPkts))
+						}
+						for _, pkt := range radioPkts {
+							pkt.ChainRF = uint8(radio.index)
+							pkt.RSSI += radio.cfg.RSSIOffset
+							if gw.boardMetadata {
+								pkt.Board = boardInfo(radio, pkt)
+							}
+						}
+						pkts = append(pkts, radioPkts...)
+					}
+				}
+				pkts = append(pkts, gw.drainBridge()...)
+				pkts = append(pkts, gw.drainInjected()...)
+				timeReceive = gw.clock.Now()
 				if pkts != nil {
-					doReceive = false
+					rxTime := gw.wallTime(timeReceive)
+					upCtx, upSpan := gw.tracer.StartAt(ctx, "uplink", rxStart)
+					upSpan.SetAttr("lora.frames", len(pkts))
+					for _, pkt := range pkts {
+						gw.traceRx(upCtx, pkt, rxStart, timeReceive)
+					}
+					_, process := gw.tracer.Start(upCtx, "process")
 					for _, pkt := range pkts {
+						if gw.clockMonitor != nil {
+							pkt.Time = &rxTime
+						}
 						// pkt.StatCRC = 1
-						pkt.CountUs = uint32(time.Now().Sub(baseTime) / time.Microsecond)
-						log(LogLevelNormal, "rx: %s", pkt)
-						stat.Rxnb +=1 
+						pkt.CountUs = gw.sched.CountUs(gw.clock.Now())
+						gw.recordBridgeUplink(pkt)
+						gw.addStaticMeta(pkt)
+						middleware.TagRelay(pkt)
+						gw.logRx(pkt)
+						gw.showRx(pkt)
+						gw.blinkRx()
+						gw.stat.CountRx(pkt)
+						gw.recordRxWindowUplink(pkt)
+						gw.recordJoinRequest(pkt, rxTime)
+						gw.countLoss(pkt)
+						gw.recordRecent(pkt, rxTime)
+						if gw.adrAdvisor != nil {
+							gw.adrAdvisor.add(pkt)
+						}
+						if gw.exporter != nil {
+							gw.exporter.AddPacket(pkt)
+						}
+						if gw.pktStore != nil {
+							r := store.NewRecord(pkt, rxTime)
+							gw.privacy.record(r)
+							if err := gw.pktStore.Add(r); err != nil {
+								log(LogLevelError, "can not store packet: %v", err)
+							}
+						}
 					}
-					log(LogLevelNormal, "received %d packets, pushing to upstream ...", len(pkts))
-					upstream(&fwd.Packet{
-						Token:     fwd.RndToken(),
-						Ident:     fwd.PushData,
-						RxPackets: pkts,
-					})
+					pkts = gw.verifyMIC(pkts)
+					pkts = gw.runMiddleware(upCtx, pkts)
+					gw.handleUplinks(pkts)
+					if gw.hook != nil && len(pkts) != 0 {
+						if err := gw.hook.Send(pkts); err != nil {
+							log(LogLevelWarning, "webhook: %v", err)
+						}
+					}
+					if gw.eventBus != nil || gw.stream != nil {
+						for _, pkt := range pkts {
+							gw.publishEvent(&eventbus.Event{Type: eventbus.TypeRx, Rx: pkt})
+						}
+					}
+					process.SetAttr("lora.frames", len(pkts))
+					process.End()
+					if len(pkts) != 0 {
+						log(LogLevelNormal, "received %d packets, pushing to upstream ...", len(pkts))
+						gw.pushUplinks(upCtx, pkts, rxTime)
+						for _, pkt := range pkts {
+							pkt.Release()
+						}
+					}
+					upSpan.End()
 				}
 				timerReceive.Reset(checkReceived)
 
-			case <-timerSend.C:
-				if queue == nil {
+			case <-timerSend.C():
+				next := gw.sched.Due()
+				if next == nil {
+					// the timer fired before a new downlink was queued
+					gw.nextSend(timerSend)
 					break
 				}
-				pkt := queue.pkt
-				queue = queue.next
-				queueSize--
+				pkt := next.Pkt
+				radio := radioFor(radios, pkt.Freq)
+				if next.Priority == txqueue.PriorityImmediate {
+					decision, wait := gw.arbitrate(radio, pkt)
+					if wait {
+						timerSend.Reset(immePoll)
+						break
+					}
+					log(LogLevelNormal, "tx: immediate downlink, %s", decision)
+					gw.ackImmediate(gw.downlinkContext(ctx, pkt), pkt, decision)
+				}
+				if _, err := gw.sched.Queue.Pop(); err != nil {
+					log(LogLevelError, "tx queue: can not save queue: %v", err)
+				}
 
-				log(LogLevelNormal, "tx: %s", pkt)
+				gw.logTx(pkt)
 
-				doReceive = false
-				if err = radio.Send(pkt); err != nil {
+				txCtx, txSpan := gw.traceStage(gw.startDownlinkTx(ctx, pkt), "tx")
+				txSpan.SetAttr("lora.chain", radio.index)
+				txSpan.SetAttr("lora.airtime_ms", float64(pkt.Airtime())/float64(time.Millisecond))
+				radio.receiving = false
+				if err = radio.Send(txCtx, pkt); err != nil {
 					log(LogLevelError, "tx: can not send packet: %v", err)
+					if errors.Is(err, lora.ErrRadioTimeout) {
+						// the radio stalled, as the watchdog would find
+						resetRadio(radio)
+					}
+				} else {
+					gw.measureTxTiming(radio, pkt, next.At)
+					if gw.hostMonitor != nil {
+						gw.hostMonitor.sent(pkt, gw.clock.Now())
+					}
+					gw.accountAirtime(next.Server, pkt)
+					if gw.apiServer != nil {
+						gw.apiServer.Publish("airtime", gw.airtimeSnapshot())
+					}
 				}
-				stat.Rxfw +=1
-				log(LogLevelNormal, "tx: ok")
-
-				if queue == nil {
-					timerSend.Reset(never)
-					log(LogLevelNormal, "tx queue: 0 packets (no pending packets)")
+				if gw.eventBus != nil || gw.stream != nil {
+					e := &eventbus.Event{Type: eventbus.TypeTx, Radio: &radio.index, Tx: pkt}
+					if err != nil {
+						e.Error = err.Error()
+					}
+					gw.publishEvent(e)
+				}
+				txSpan.SetError(err)
+				txSpan.End()
+				gw.endDownlinkTrace(pkt, err)
+				gw.showTx()
+				gw.blinkTx()
+				if next.Priority == txqueue.PriorityImmediate {
+					gw.stat.Dwnb += 1
 				} else {
-					diff := baseTime.Add(time.Duration(queue.pkt.CountUs) * time.Microsecond).Sub(time.Now())
-					log(LogLevelNormal, "tx queue: %d packets, next packet in %s", queueSize, diff)
-					timerSend.Reset(diff)
+					gw.stat.Rxfw +=1
 				}
+				log(LogLevelNormal, "tx: ok")
+
+				gw.nextSend(timerSend)
 
-			case <-tickerKeepalive.C:
+			case <-gw.tickerKeepalive.C():
 
-				upstream(&fwd.Packet{
+				gw.checkVersions()
+				gw.checkServers()
+				if gw.failover != nil {
+					gw.failover.check(ctx, gw.clock.Now())
+				}
+				gw.expireAckSpans(gw.keepalive)
+				gw.upstream(ctx, &fwd.Packet{
 					Ident: fwd.PullData,
 					Token: fwd.RndToken(),
 				})
 
-			case <-tickerStatusReport.C:
-				stat.TimeStamp = time.Now().UTC()
-				fmt.Println("send statusReport", stat)
-				upstream(&fwd.Packet{
+			case <-gw.tickerStatusReport.C():
+				gw.stat.TimeStamp = gw.wallTime(gw.clock.Now()).UTC()
+				gw.stat.Hops = nil
+				for _, radio := range radios {
+					if radio.hop != nil {
+						gw.stat.Hops = append(gw.stat.Hops, radio.hop.report(gw.stat.TimeStamp)...)
+					}
+				}
+				gw.stat.Noise = gw.noise.report()
+				if len(gw.stat.Noise) == 0 {
+					gw.stat.Noise = nil
+				}
+				gw.stat.Power = powerReport(radios)
+				if gw.apiServer != nil {
+					gw.apiServer.Publish("power", gw.stat.Power)
+					if gw.adrAdvisor != nil {
+						gw.apiServer.Publish("adr", gw.adrAdvisor.report())
+					}
+					gw.apiServer.Publish("loss", gw.lossSnapshot())
+					gw.apiServer.Publish("usage", gw.backhaul.Report(gw.clock.Now()))
+					if gw.gwBridge != nil {
+						gw.apiServer.Publish("bridge", gw.gwBridge.Gateways())
+					}
+				}
+				fmt.Println("send statusReport", gw.stat)
+				if gw.exporter != nil {
+					gw.exporter.AddStats(gw.stat)
+					gw.exporter.AddTxQueue(gw.sched.Queue.Len(), gw.sched.Queue.Preempted, gw.sched.Queue.Collisions)
+					for _, h := range gw.checkServers() {
+						gw.exporter.AddServer(h.Address, h.p50, h.p95, h.p99, h.Loss, h.Degraded)
+					}
+					for server, u := range gw.airtimeSnapshot().Servers {
+						gw.exporter.AddAirtime(server, u.Downlinks, u.AirtimeMs)
+					}
+					for addr, d := range gw.lossSnapshot() {
+						gw.exporter.AddLoss(addr, d.Received, d.Lost, d.Loss, d.Resets)
+					}
+					report := gw.backhaul.Report(gw.clock.Now())
+					for backend, month := range report.Month {
+						day := report.Today[backend]
+						gw.exporter.AddUsage(backend, day.Sent, day.Received, month.Sent, month.Received)
+					}
+				}
+				if gw.reporter != nil {
+					gw.reporter.AddStats(gw.stat)
+				}
+				if gw.statsHistory != nil {
+					gw.statsHistory.Add(gw.stat)
+				}
+				if gw.eventBus != nil {
+					gw.eventBus.Publish(&eventbus.Event{Type: eventbus.TypeStat, Stat: gw.stat})
+				}
+				gw.upstream(ctx, &fwd.Packet{
 						Token: fwd.RndToken(),
 						Ident: fwd.PushData,
-						Stat: stat,
+						Stat: gw.stat,
 					})
-				stat.Rxnb = 0
-				stat.Rxfw = 0
-				stat.Dwnb = 0
+				gw.stat.Rxnb = 0
+				gw.stat.Rxok = 0
+				gw.stat.Rxfw = 0
+				gw.stat.Dwnb = 0
+				gw.stat.Channels = nil
 		}
 		
 	}
 }
 
-func upstream(pkt *fwd.Packet) {
-	pkt.GatewayID = gwid
-	data, err := pkt.MarshalBinary()
-	if err != nil {
-		log(LogLevelError, "can not upstream packet: %v", err)
-		log(LogLevelError, "packet: %+v", pkt)
-		return
+// verifyMIC drops the packets with an invalid MIC if "verify_mic" is enabled.
+func (gw *Gateway) verifyMIC(pkts []*lora.RxPacket) []*lora.RxPacket {
+	if gw.micVerifier == nil {
+		return pkts
 	}
+	valid := pkts[:0]
+	for _, pkt := range pkts {
+		err := gw.micVerifier.Verify(pkt.Data)
+		if err == nil || (errors.Is(err, lorawan.ErrUnknownDevice) && !gw.dropUnknownDevices) {
+			valid = append(valid, pkt)
+			continue
+		}
+		log(LogLevelWarning, "rx: dropping packet: %v", gw.privacy.err(err))
+		pkt.Release()
+	}
+	return valid
+}
 
-	log(LogLevelDebug, "(-> *) raw: %q", data)
+// runMiddleware runs the packets through the middleware chain, if any, and returns the
+// packets it passed on.
+func (gw *Gateway) runMiddleware(ctx context.Context, pkts []*lora.RxPacket) []*lora.RxPacket {
+	if gw.chain == nil {
+		return pkts
+	}
+	passed := pkts[:0]
+	for _, pkt := range pkts {
+		pkt, err := gw.chain.Rx(ctx, pkt)
+		if pkt == nil {
+			log(LogLevelVerbose, "rx: dropping packet: middleware %v", err)
+			continue
+		}
+		passed = append(passed, pkt)
+	}
+	return passed
+}
+
+// handleUplinks passes the packets to the standalone app and the coverage map, if any.
+func (gw *Gateway) handleUplinks(pkts []*lora.RxPacket) {
+	for _, pkt := range pkts {
+		if gw.app != nil {
+			if err := gw.app.HandleUplink(pkt); err != nil {
+				gw.logUplinkErr("app", err)
+			}
+		}
+		if gw.coverageMap != nil {
+			if err := gw.coverageMap.Add(pkt); err != nil {
+				gw.logUplinkErr("coverage", err)
+			}
+		}
+	}
+}
+
+// publishEvent publishes an event on the event bus and the stream of the API, those that are set.
+func (gw *Gateway) publishEvent(e *eventbus.Event) {
+	if gw.eventBus != nil {
+		gw.eventBus.Publish(e)
+	}
+	if gw.stream != nil {
+		gw.stream.Publish(e)
+	}
+}
+
+// logUplinkErr logs uplinks of unknown devices as verbose only, as they are common.
+func (gw *Gateway) logUplinkErr(prefix string, err error) {
+	err = gw.privacy.err(err)
+	if errors.Is(err, lorawan.ErrUnknownDevice) {
+		log(LogLevelVerbose, "%s: %v", prefix, err)
+	} else {
+		log(LogLevelWarning, "%s: %v", prefix, err)
+	}
+}
 
-	if logLevel >= LogLevelDebug {
+// upstream sends the packet to the servers. If ctx is traced, the encoding, the sending
+// and, for PUSH_DATA and PULL_DATA, the wait for the ACK are stages of its trace.
+func (gw *Gateway) upstream(ctx context.Context, pkt *fwd.Packet) {
+	gw.upstreamTo(ctx, pkt, "")
+}
+
+// upstreamTo sends the packet to the server of the address, as in upstreamServer.addr.String(),
+// or to the servers as upstream does if it is "" or not a server. TX_ACKs go to the server of
+// the downlink only, as its token means nothing to the others.
+func (gw *Gateway) upstreamTo(ctx context.Context, pkt *fwd.Packet, to string) {
+	pkt.GatewayID = gw.gwid
+	if gw.serverByAddr(to) == nil {
+		to = ""
+	}
+
+	if gw.privacy == nil && currentLogLevel() >= LogLevelDebug {
 		pktJSON, err := json.Marshal(pkt)
 		log(LogLevelDebug, "pkt json: %s (err:%v)", pktJSON, err)
 	}
 
-	for _, server := range servers {
-		if _, err = socket.WriteToUDP(data, server); err != nil {
-			log(LogLevelError, "(-> %s) can not write upstream: %v", server, err)
+	encode := func(pkt *fwd.Packet, version byte) []byte {
+		_, encode := gw.traceStage(ctx, "encode")
+		encode.SetAttr("protocol.version", version)
+		pkt.Version = version
+		b, err := pkt.MarshalBinary()
+		encode.SetError(err)
+		encode.End()
+		if err != nil {
+			log(LogLevelError, "can not upstream packet: %v", err)
+			if gw.privacy == nil {
+				log(LogLevelError, "packet: %+v", pkt)
+			}
+			return nil
+		}
+		if gw.hmac != nil && pkt.Ident == fwd.PushData {
+			b = gw.hmac.Sign(b)
+		}
+		if gw.privacy == nil {
+			log(LogLevelDebug, "(-> *) raw: %q", b)
+		}
+		return b
+	}
+
+	// the packet by protocol version, as servers may speak different ones
+	var data [fwd.ProtocolV2 + 1][]byte
+	for _, server := range gw.servers {
+		if to != "" && server.addr.String() != to {
+			continue
+		}
+		if to == "" && !gw.failover.sendsTo(server, pkt) {
+			continue
+		}
+		version := server.Version()
+		if version == fwd.ProtocolV1 && pkt.Ident == fwd.TxAck {
+			continue
+		}
+		routed := server.packetFor(pkt, gw.allRoutes)
+		var b []byte
+		switch {
+		case routed == nil:
+			continue
+		case routed != pkt:
+			// the uplinks of the routes of the server only
+			if b = encode(routed, version); b == nil {
+				return
+			}
+		default:
+			if data[version] == nil {
+				if data[version] = encode(pkt, version); data[version] == nil {
+					return
+				}
+			}
+			b = data[version]
+		}
+		_, send := gw.traceStage(ctx, "send")
+		send.SetAttr("server.address", server.addr.String())
+		_, err := gw.socket.WriteToUDP(b, server.addr)
+		send.SetError(err)
+		send.End()
+		if err != nil {
+			log(LogLevelError, "(-> %s) can not write upstream: %v", server.addr, err)
 		} else {
-			log(LogLevelNormal, "(-> %s) %s", server, pkt)
+			gw.backhaul.Add(usage.BackendUDP, usage.Datagram(server.addr, len(b)), 0)
+			log(LogLevelNormal, "(-> %s) %s", server.addr, routed)
+			if pkt.Ident == fwd.PushData || pkt.Ident == fwd.PullData {
+				server.requested(pkt.Token)
+				gw.traceAckWait(ctx, pkt.Token, server.addr)
+			}
 		}
 	}
 }
 
-func downstream() {
+// errNoLRFHSS rejects LR-FHSS downlinks, which the radios can not send, as TX_FREQ.
+var errNoLRFHSS = fmt.Errorf("%w: the radios can not send LR-FHSS", lora.ErrFrequency)
+
+// downstream reads the packets of the servers and passes the downlinks to the main loop
+// until ctx is done.
+func (gw *Gateway) downstream(ctx context.Context) {
 
 	var buffer [2048]byte
 
 	for true {
-		l, raddr, err := socket.ReadFromUDP(buffer[:])
+		l, raddr, err := gw.socket.ReadFromUDP(buffer[:])
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			fatal("%v", err)
 		}
+		gw.backhaul.Add(usage.BackendUDP, 0, usage.Datagram(raddr, l))
 
-		log(LogLevelDebug, "(<- %s) raw: %q", raddr, buffer[:l])
+		if gw.privacy == nil {
+			log(LogLevelDebug, "(<- %s) raw: %q", raddr, buffer[:l])
+		}
+
+		data := buffer[:l]
+		if gw.hmac != nil && l >= 4 && data[3] == fwd.PullResp {
+			if data, err = gw.hmac.Verify(data, raddr.String()); err != nil {
+				log(LogLevelError, "(<- %s) dropping PULL_RESP: %v", raddr, err)
+				continue
+			}
+		}
 
 		var pkt = &fwd.Packet{}
-		err = pkt.UnmarshalBinary(buffer[:l])
+		err = pkt.UnmarshalBinary(data)
 		if err != nil {
 			log(LogLevelError, "(<- %s) can not unmarshal downstream packet: %v", raddr, err)
-			log(LogLevelNormal, "data: %q", buffer[:l])
+			if gw.privacy == nil {
+				log(LogLevelNormal, "data: %q", buffer[:l])
+			}
 			continue
 		}
 
 		log(LogLevelNormal, "(<- %s) %s", raddr, pkt)
 
-		if pkt.TxPacket != nil {
+		if server := gw.serverFor(raddr); server != nil {
+			serverAnswered(server, pkt)
+			if pkt.Ident == fwd.PushAck || pkt.Ident == fwd.PullAck {
+				server.acknowledged(pkt.Token)
+			}
+		}
 
-			chanTx <- pkt.TxPacket
+		if pkt.Ident == fwd.PushAck || pkt.Ident == fwd.PullAck {
+			gw.acknowledged(pkt)
+			gw.traceAck(pkt, raddr)
+		}
 
-			upstream(&fwd.Packet{
-				Token: pkt.Token,
-				Ident: fwd.TxAck,
-				TxAck: fwd.NoError,
-			})
+		if len(pkt.TxPackets) > 1 {
+			log(LogLevelNormal, "(<- %s) %d downlinks in one PULL_RESP", raddr, len(pkt.TxPackets))
+		}
+		for _, tx := range pkt.TxPackets {
+
+			dlCtx, dlSpan := gw.tracer.Start(ctx, "downlink")
+			dlSpan.SetAttr("server.address", raddr.String())
+			dlSpan.SetAttr("token", pkt.Token.String())
+			dlSpan.SetAttr("lora.freq", tx.Freq.MHz())
+			dlSpan.SetAttr("lora.size", len(tx.Data))
+			dlSpan.SetAttr("immediate", tx.Immediate)
+
+			err := tx.Validate(gw.region)
+			if err == nil && tx.Modulation == lora.ModulationLRFHSS {
+				err = errNoLRFHSS
+			}
+			if err == nil && gw.chain != nil {
+				var next *lora.TxPacket
+				if next, err = gw.chain.Tx(dlCtx, tx); next != nil {
+					tx = next
+				} else {
+					err = fmt.Errorf("middleware %w", err)
+				}
+			}
+			if err != nil {
+				log(LogLevelError, "(<- %s) invalid downlink packet: %v", raddr, err)
+				dlSpan.SetError(err)
+				gw.upstreamTo(dlCtx, &fwd.Packet{
+					Token:     pkt.Token,
+					Ident:     fwd.TxAck,
+					TxAck:     forwarder.TxAckOf(err),
+					TxAckInfo: err.Error(),
+				}, raddr.String())
+				dlSpan.End()
+				continue
+			}
+			if power := tx.Power; tx.ClampPower(gw.region) {
+				log(LogLevelVerbose, "(<- %s) downlink power lowered from %d to %d dBm", raddr, power, tx.Power)
+			}
+
+			// each downlink is queued and acknowledged on its own, with the token of the PULL_RESP
+			select {
+			case gw.chanTx <- &downlink{ctx: dlCtx, token: pkt.Token, tx: tx, server: raddr.String()}:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}
 }
 
-var chanTx = make(chan *lora.TxPacket)
+// downlink is a downlink of a PULL_RESP, with the context of its trace.
+type downlink struct {
+	ctx    context.Context
+	token  fwd.Token
+	tx     *lora.TxPacket
+	server string // the address of the server that sent it
+}
 
-type Queue struct {
-	pkt  *lora.TxPacket
-	next *Queue
+// measureTxTiming records the offset of the transmission start of pkt from its due time at.
+// The start is the TX done time less the time on air, as the radio reports TX done only.
+func (gw *Gateway) measureTxTiming(radio *gatewayRadio, pkt *lora.TxPacket, at time.Time) {
+	r, ok := radio.Radio.(interface{ LastTx() (start, done time.Time) })
+	if !ok {
+		return
+	}
+	_, done := r.LastTx()
+	airtime := pkt.Airtime()
+	if done.IsZero() || airtime == 0 {
+		return
+	}
+	offset := done.Add(-airtime).Sub(at)
+	gw.txTiming.Observe(offset)
+	log(LogLevelVerbose, "tx: started %s after tmst (airtime %s)", offset, airtime)
+	if gw.exporter != nil {
+		gw.exporter.AddTxTiming(pkt, offset)
+	}
+	if gw.apiServer != nil {
+		gw.apiServer.Publish("tx_timing", gw.txTiming.Snapshot())
+	}
+}
+
+// nextSend sets the timer to the downlink that is due first.
+func (gw *Gateway) nextSend(timer clock.Timer) {
+	next := gw.sched.Reset(timer)
+	if next == nil {
+		log(LogLevelNormal, "tx queue: 0 packets (no pending packets)")
+		return
+	}
+	log(LogLevelNormal, "tx queue: %d packets, next packet in %s", gw.sched.Queue.Len(), next.At.Sub(gw.sched.Now()))
 }
 
-var queue *Queue
+// queueDownlink pushes a downlink to the queue and returns the TX_ACK error for it.
+// Scheduled downlinks are due at the CountUs of their packet, see forwarder.Scheduler.Push.
+func (gw *Gateway) queueDownlink(it *txqueue.Item) fwd.TxAckError {
+	if gw.hostMonitor != nil && !gw.hostMonitor.allowTx(it.Pkt, gw.clock.Now()) {
+		// the protocol has no error for this, and the server may try another window
+		log(LogLevelWarning, "tx queue: dropping downlink of %s: %v", it.At.Format(time.RFC3339Nano), errOverheated)
+		return fwd.ErrCollisionPacket
+	}
+	dropped, err := gw.sched.Push(it)
+	for _, d := range dropped {
+		if it.Priority == txqueue.PriorityBeacon {
+			log(LogLevelWarning, "tx queue: dropping downlink of %s for a beacon", d.At.Format(time.RFC3339Nano))
+			gw.endDownlinkTrace(d.Pkt, fwd.ErrCollisionBeacon)
+			continue
+		}
+		// the server of the dropped downlink got a TX_ACK without error, so it gets another one
+		log(LogLevelWarning, "tx queue: dropping downlink of %s of %s for one of %s, which has a higher priority", d.At.Format(time.RFC3339Nano), d.Server, it.Server)
+		gw.endDownlinkTrace(d.Pkt, fwd.ErrCollisionPacket)
+		if s := gw.serverByAddr(d.Server); s != nil {
+			s.collided()
+			gw.upstreamTo(context.Background(), &fwd.Packet{
+				Token: fwd.Token(d.Token),
+				Ident: fwd.TxAck,
+				TxAck: fwd.ErrCollisionPacket,
+			}, d.Server)
+		}
+	}
+	switch {
+	case errors.Is(err, fwd.ErrTooLate):
+		log(LogLevelWarning, "tx queue: dropping downlink of %s: %v", it.At.Format(time.RFC3339Nano), err)
+		return fwd.ErrTooLate
+	case errors.Is(err, txqueue.ErrCollisionBeacon):
+		log(LogLevelWarning, "tx queue: dropping downlink of %s: %v", it.At.Format(time.RFC3339Nano), err)
+		return fwd.ErrCollisionBeacon
+	case errors.Is(err, txqueue.ErrCollision):
+		log(LogLevelWarning, "tx queue: dropping downlink of %s of %s: %v", it.At.Format(time.RFC3339Nano), it.Server, err)
+		if s := gw.serverByAddr(it.Server); s != nil {
+			s.collided()
+		}
+		return fwd.ErrCollisionPacket
+	case errors.Is(err, txqueue.ErrQueueFull):
+		// the protocol has no error for this either, see forwarder.TxAckOf
+		log(LogLevelWarning, "tx queue: dropping downlink of %s of %s: %v, %d downlinks queued", it.At.Format(time.RFC3339Nano), it.Server, err, gw.sched.Queue.Len())
+		return fwd.ErrCollisionPacket
+	case err != nil:
+		log(LogLevelError, "tx queue: can not save queue: %v", err)
+	}
+	if gw.apiServer != nil {
+		gw.apiServer.Publish("tx_queue", map[string]int{
+			"depth":      gw.sched.Queue.Len(),
+			"preempted":  gw.sched.Queue.Preempted,
+			"collisions": gw.sched.Queue.Collisions,
+		})
+	}
+	return fwd.NoError
+}
 
-var queueSize int
+// restoreTxQueue queues the downlinks saved to path before a restart.
+// Downlinks that are due already are dropped, as a gateway would reject them as too late.
+func (gw *Gateway) restoreTxQueue(path string) {
+	items, err := txqueue.Load(path)
+	if err != nil {
+		log(LogLevelError, "tx queue: can not restore %s: %v", path, err)
+	}
+	now := gw.clock.Now()
+	for _, it := range items {
+		if it.Priority != txqueue.PriorityImmediate && !it.At.After(now) {
+			log(LogLevelWarning, "tx queue: dropping downlink of %s: %v", it.At.Format(time.RFC3339), fwd.ErrTooLate)
+			continue
+		}
+		// the concentrator counter starts anew with the process
+		it.Pkt.CountUs = gw.sched.CountUs(it.At)
+		gw.queueDownlink(it)
+	}
+	if len(items) != 0 {
+		log(LogLevelNormal, "tx queue: restored %d of %d downlinks", gw.sched.Queue.Len(), len(items))
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/clock"
+	"github.com/Waziup/single_chan_pkt_fwd/forwarder"
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/txqueue"
+)
+
+func TestQueueDownlinkFull(t *testing.T) {
+	gw := newGateway()
+	gw.clock = clock.NewFake(time.Date(2021, 3, 31, 16, 21, 17, 0, time.UTC))
+	gw.sched = forwarder.NewScheduler(gw.clock, txqueue.New(""))
+	gw.sched.Queue.MaxLen = 1
+
+	for i, want := range []fwd.TxAckError{fwd.NoError, fwd.ErrCollisionPacket} {
+		pkt := &lora.TxPacket{Immediate: true, Freq: 868100000, Power: 14, Modulation: lora.ModulationLoRa,
+			LoRaBW: lora.BW125K, LoRaCR: lora.CR4_5, Datarate: lora.SF7, Data: []byte{byte(i)}}
+		if ack := gw.queueDownlink(&txqueue.Item{Pkt: pkt, Priority: txqueue.PriorityImmediate}); ack != want {
+			t.Errorf("downlink %d: TX_ACK %v, want %v", i, ack, want)
+		}
+	}
+}
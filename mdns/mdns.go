@@ -0,0 +1,300 @@
+// Package mdns advertises the forwarder on the local network with multicast DNS and DNS-SD
+// (RFC 6762 and RFC 6763), and discovers network servers that advertise themselves,
+// so LAN-only private deployments need no addresses in the config.
+package mdns
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Service is the DNS-SD service type the forwarder is advertised as.
+const Service = "_lora-pktfwd._udp"
+
+// group is the mDNS multicast group.
+var group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// TTLs of the records, as recommended by RFC 6762: host records expire sooner.
+const (
+	hostTTL    = 120
+	serviceTTL = 4500
+)
+
+// Config is the "mdns_conf" section of the gateway config.
+type Config struct {
+	// Instance is the name the gateway is advertised with, "gateway-<gateway_ID>" if not set.
+	// It must not contain dots.
+	Instance string `json:"instance"`
+	// Discover is the service type of network servers to discover, as "_lora-ns._udp",
+	// if no server is enabled in the config. No servers are discovered if empty.
+	Discover string `json:"discover"`
+	// Timeout is how many seconds to wait for servers to answer, 3 if not set.
+	Timeout int `json:"timeout"`
+}
+
+// Responder answers mDNS queries for the service of the gateway.
+type Responder struct {
+	Logger *log.Logger
+
+	conn     *net.UDPConn
+	service  string // as "_lora-pktfwd._udp.local"
+	instance string // as "gateway-AA555A0000000000._lora-pktfwd._udp.local"
+	host     string // as "raspberrypi.local"
+	port     uint16
+	text     []string
+	done     chan struct{}
+}
+
+// Advertise starts answering queries for the gateway, with the API port in the SRV record
+// and in the TXT record, along with the gateway EUI. port is 0 if the API is not served.
+func Advertise(cfg *Config, gatewayID uint64, port int) (*Responder, error) {
+	eui := fmt.Sprintf("%016X", gatewayID)
+	name := cfg.Instance
+	if name == "" {
+		name = "gateway-" + eui
+	}
+	if strings.Contains(name, ".") {
+		return nil, fmt.Errorf("mdns: instance %q contains a dot", name)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("mdns: %v", err)
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, fmt.Errorf("mdns: %v", err)
+	}
+	r := &Responder{
+		Logger:   log.New(os.Stdout, "[MDNS ] ", 0),
+		conn:     conn,
+		service:  Service + ".local",
+		instance: name + "." + Service + ".local",
+		host:     strings.SplitN(hostname, ".", 2)[0] + ".local",
+		port:     uint16(port),
+		text:     []string{"eui=" + eui},
+		done:     make(chan struct{}),
+	}
+	if port != 0 {
+		r.text = append(r.text, fmt.Sprintf("api_port=%d", port))
+	}
+	go r.serve()
+	go r.announce()
+	return r, nil
+}
+
+// Close sends a goodbye, so caches drop the records, and stops answering.
+func (r *Responder) Close() error {
+	close(r.done)
+	m := &message{response: true, answers: r.records(typeANY, r.instance)}
+	for i := range m.answers {
+		m.answers[i].ttl = 0
+	}
+	r.conn.WriteToUDP(m.encode(), group)
+	return r.conn.Close()
+}
+
+// announce sends the records twice, one second apart, as RFC 6762 section 8.3 asks.
+func (r *Responder) announce() {
+	for i := 0; i < 2; i++ {
+		m := &message{response: true, answers: r.records(typePTR, r.service)}
+		m.extra = r.additional(m.answers)
+		if _, err := r.conn.WriteToUDP(m.encode(), group); err != nil {
+			r.Logger.Printf("can not announce: %v", err)
+		}
+		select {
+		case <-r.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (r *Responder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-r.done:
+			default:
+				r.Logger.Printf("can not receive: %v", err)
+			}
+			return
+		}
+		q, err := parseMessage(buf[:n])
+		if err != nil || q.response {
+			continue
+		}
+		m := &message{response: true}
+		for _, q := range q.questions {
+			m.answers = append(m.answers, r.records(q.typ, q.name)...)
+		}
+		if len(m.answers) == 0 {
+			continue
+		}
+		m.extra = r.additional(m.answers)
+		to := group
+		if src.Port != group.Port {
+			// a legacy unicast query, RFC 6762 section 6.7
+			m.id = q.id
+			m.questions = q.questions
+			to = src
+		}
+		if _, err := r.conn.WriteToUDP(m.encode(), to); err != nil {
+			r.Logger.Printf("can not answer %s: %v", src, err)
+		}
+	}
+}
+
+// records returns the records of the gateway that answer a question.
+func (r *Responder) records(typ uint16, name string) []record {
+	var rrs []record
+	is := func(t uint16) bool { return typ == t || typ == typeANY }
+	switch {
+	case strings.EqualFold(name, "_services._dns-sd._udp.local") && is(typePTR):
+		rrs = append(rrs, record{name: name, typ: typePTR, class: classIN, ttl: serviceTTL, target: r.service})
+	case strings.EqualFold(name, r.service) && is(typePTR):
+		rrs = append(rrs, record{name: r.service, typ: typePTR, class: classIN, ttl: serviceTTL, target: r.instance})
+	case strings.EqualFold(name, r.instance):
+		if is(typeSRV) {
+			rrs = append(rrs, record{name: r.instance, typ: typeSRV, class: classIN | classFlag, ttl: hostTTL, target: r.host, port: r.port})
+		}
+		if is(typeTXT) {
+			rrs = append(rrs, record{name: r.instance, typ: typeTXT, class: classIN | classFlag, ttl: serviceTTL, text: r.text})
+		}
+	case strings.EqualFold(name, r.host) && is(typeA):
+		rrs = append(rrs, r.addresses()...)
+	}
+	return rrs
+}
+
+// additional returns the records a resolver needs next for the answers, as RFC 6763 section 12 suggests.
+func (r *Responder) additional(answers []record) []record {
+	var rrs []record
+	for _, rr := range answers {
+		switch {
+		case rr.typ == typePTR && rr.target == r.instance:
+			rrs = append(rrs, r.records(typeANY, r.instance)...)
+			rrs = append(rrs, r.addresses()...)
+		case rr.typ == typeSRV:
+			rrs = append(rrs, r.addresses()...)
+		}
+	}
+	return rrs
+}
+
+// addresses returns the A records of the IPv4 addresses of the host, but loopback.
+func (r *Responder) addresses() []record {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		r.Logger.Printf("can not list addresses: %v", err)
+		return nil
+	}
+	var rrs []record
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
+			continue
+		}
+		rrs = append(rrs, record{name: r.host, typ: typeA, class: classIN | classFlag, ttl: hostTTL, ip: ipnet.IP})
+	}
+	return rrs
+}
+
+// Instance is a discovered instance of a service.
+type Instance struct {
+	// Name is the full name, as "chirpstack._lora-ns._udp.local".
+	Name string
+	Addr *net.UDPAddr
+	// Text are the strings of the TXT record, as "key=value".
+	Text []string
+}
+
+// ErrNotFound is returned by Discover if no instance answered.
+var ErrNotFound = errors.New("mdns: no instance found")
+
+// Discover queries the service type, as "_lora-ns._udp", and returns the instances
+// that answered within the timeout, in the order they answered.
+func Discover(service string, timeout time.Duration) ([]Instance, error) {
+	service = strings.TrimSuffix(service, ".local") + ".local"
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("mdns: %v", err)
+	}
+	defer conn.Close()
+
+	query := (&message{questions: []question{{name: service, typ: typePTR, class: classIN | classFlag}}}).encode()
+	deadline := time.Now().Add(timeout)
+	var rrs []record
+	buf := make([]byte, 9000)
+	// query twice, in case the first one is lost
+	for _, until := range []time.Time{time.Now().Add(timeout / 2), deadline} {
+		if _, err := conn.WriteToUDP(query, group); err != nil {
+			return nil, fmt.Errorf("mdns: %v", err)
+		}
+		conn.SetReadDeadline(until)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					break
+				}
+				return nil, fmt.Errorf("mdns: %v", err)
+			}
+			m, err := parseMessage(buf[:n])
+			if err != nil || !m.response {
+				continue
+			}
+			rrs = append(rrs, m.answers...)
+			rrs = append(rrs, m.extra...)
+		}
+	}
+
+	instances := resolve(service, rrs)
+	if len(instances) == 0 {
+		return nil, ErrNotFound
+	}
+	return instances, nil
+}
+
+// resolve follows the PTR records of the service to the SRV, TXT and A records of the instances.
+func resolve(service string, rrs []record) []Instance {
+	find := func(typ uint16, name string) *record {
+		for i := range rrs {
+			if rrs[i].typ == typ && strings.EqualFold(rrs[i].name, name) {
+				return &rrs[i]
+			}
+		}
+		return nil
+	}
+	var instances []Instance
+	seen := make(map[string]bool)
+	for _, ptr := range rrs {
+		if ptr.typ != typePTR || !strings.EqualFold(ptr.name, service) || seen[strings.ToLower(ptr.target)] {
+			continue
+		}
+		srv := find(typeSRV, ptr.target)
+		if srv == nil {
+			continue
+		}
+		a := find(typeA, srv.target)
+		if a == nil {
+			continue
+		}
+		seen[strings.ToLower(ptr.target)] = true
+		inst := Instance{
+			Name: ptr.target,
+			Addr: &net.UDPAddr{IP: a.ip, Port: int(srv.port)},
+		}
+		if txt := find(typeTXT, ptr.target); txt != nil {
+			inst.Text = txt.text
+		}
+		instances = append(instances, inst)
+	}
+	return instances
+}
@@ -0,0 +1,242 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// DNS record types and classes, RFC 1035 and RFC 2782.
+const (
+	typeA   = 1
+	typePTR = 12
+	typeTXT = 16
+	typeSRV = 33
+	typeANY = 255
+
+	classIN = 1
+	// classFlag is the cache-flush bit of records and the unicast-response bit of questions, RFC 6762.
+	classFlag = 0x8000
+)
+
+var errMalformed = errors.New("mdns: malformed message")
+
+// message is a DNS message with the parts mDNS uses.
+type message struct {
+	id        uint16
+	response  bool
+	questions []question
+	answers   []record
+	extra     []record // the authority and additional records
+}
+
+type question struct {
+	name  string // without the trailing dot, as "_lora-pktfwd._udp.local"
+	typ   uint16
+	class uint16
+}
+
+// record is a resource record. Its data is in the field of its type.
+type record struct {
+	name  string
+	typ   uint16
+	class uint16
+	ttl   uint32
+
+	ip     net.IP   // A
+	target string   // PTR, SRV
+	port   uint16   // SRV
+	text   []string // TXT
+}
+
+func (m *message) encode() []byte {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], m.id)
+	if m.response {
+		b[2] = 0x84 // QR, AA
+	}
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.answers)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.extra)))
+	for _, q := range m.questions {
+		b = appendName(b, q.name)
+		b = appendUint16(b, q.typ)
+		b = appendUint16(b, q.class)
+	}
+	for _, rr := range m.answers {
+		b = rr.append(b)
+	}
+	for _, rr := range m.extra {
+		b = rr.append(b)
+	}
+	return b
+}
+
+func (rr *record) append(b []byte) []byte {
+	b = appendName(b, rr.name)
+	b = appendUint16(b, rr.typ)
+	b = appendUint16(b, rr.class)
+	b = append(b, byte(rr.ttl>>24), byte(rr.ttl>>16), byte(rr.ttl>>8), byte(rr.ttl))
+	b = append(b, 0, 0) // the length, set below
+	start := len(b)
+	switch rr.typ {
+	case typeA:
+		b = append(b, rr.ip.To4()...)
+	case typePTR:
+		b = appendName(b, rr.target)
+	case typeSRV:
+		b = append(b, 0, 0, 0, 0) // priority and weight
+		b = appendUint16(b, rr.port)
+		b = appendName(b, rr.target)
+	case typeTXT:
+		for _, s := range rr.text {
+			b = append(b, byte(len(s)))
+			b = append(b, s...)
+		}
+		if len(rr.text) == 0 {
+			b = append(b, 0)
+		}
+	}
+	binary.BigEndian.PutUint16(b[start-2:], uint16(len(b)-start))
+	return b
+}
+
+// appendName appends the name without compression. The labels are separated by dots.
+func appendName(b []byte, name string) []byte {
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func parseMessage(b []byte) (*message, error) {
+	if len(b) < 12 {
+		return nil, errMalformed
+	}
+	m := &message{
+		id:       binary.BigEndian.Uint16(b[0:]),
+		response: b[2]&0x80 != 0,
+	}
+	qd := int(binary.BigEndian.Uint16(b[4:]))
+	rrs := int(binary.BigEndian.Uint16(b[6:]))
+	an := rrs
+	rrs += int(binary.BigEndian.Uint16(b[8:])) + int(binary.BigEndian.Uint16(b[10:]))
+	off := 12
+	for i := 0; i < qd; i++ {
+		var q question
+		var err error
+		q.name, off, err = readName(b, off)
+		if err != nil || off+4 > len(b) {
+			return nil, errMalformed
+		}
+		q.typ = binary.BigEndian.Uint16(b[off:])
+		q.class = binary.BigEndian.Uint16(b[off+2:])
+		off += 4
+		m.questions = append(m.questions, q)
+	}
+	for i := 0; i < rrs; i++ {
+		var rr record
+		var err error
+		rr, off, err = readRecord(b, off)
+		if err != nil {
+			return nil, err
+		}
+		if i < an {
+			m.answers = append(m.answers, rr)
+		} else {
+			m.extra = append(m.extra, rr)
+		}
+	}
+	return m, nil
+}
+
+func readRecord(b []byte, off int) (rr record, next int, err error) {
+	rr.name, off, err = readName(b, off)
+	if err != nil || off+10 > len(b) {
+		return rr, 0, errMalformed
+	}
+	rr.typ = binary.BigEndian.Uint16(b[off:])
+	rr.class = binary.BigEndian.Uint16(b[off+2:])
+	rr.ttl = binary.BigEndian.Uint32(b[off+4:])
+	n := int(binary.BigEndian.Uint16(b[off+8:]))
+	off += 10
+	if off+n > len(b) {
+		return rr, 0, errMalformed
+	}
+	data := b[off : off+n]
+	switch rr.typ {
+	case typeA:
+		if n != 4 {
+			return rr, 0, errMalformed
+		}
+		rr.ip = net.IPv4(data[0], data[1], data[2], data[3])
+	case typePTR:
+		rr.target, _, err = readName(b, off)
+	case typeSRV:
+		if n < 7 {
+			return rr, 0, errMalformed
+		}
+		rr.port = binary.BigEndian.Uint16(data[4:])
+		rr.target, _, err = readName(b, off+6)
+	case typeTXT:
+		for i := 0; i < len(data); {
+			l := int(data[i])
+			if i+1+l > len(data) {
+				return rr, 0, errMalformed
+			}
+			if l != 0 {
+				rr.text = append(rr.text, string(data[i+1:i+1+l]))
+			}
+			i += 1 + l
+		}
+	}
+	if err != nil {
+		return rr, 0, err
+	}
+	return rr, off + n, nil
+}
+
+// readName reads the name at off, following compression pointers,
+// and returns it with the offset after it.
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for hops := 0; hops < 128; hops++ {
+		if off >= len(b) {
+			return "", 0, errMalformed
+		}
+		n := int(b[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(b) {
+				return "", 0, errMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+		case n&0xC0 != 0:
+			return "", 0, errMalformed
+		default:
+			if off+1+n > len(b) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(b[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+	return "", 0, errMalformed
+}
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// Histogram counts durations in buckets.
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []time.Duration // upper bounds, ascending
+	counts []int64         // one more than bounds, for the values above the last bound
+	count  int64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+// NewHistogram returns a histogram with the given ascending bucket upper bounds.
+func NewHistogram(bounds ...time.Duration) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// Observe adds a value to the histogram.
+func (h *Histogram) Observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := 0
+	for i < len(h.bounds) && d > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if h.count == 0 || d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+// HistogramSnapshot is the state of a histogram, in microseconds.
+type HistogramSnapshot struct {
+	Count   int64    `json:"count"`
+	Mean    int64    `json:"mean_us"`
+	Min     int64    `json:"min_us"`
+	Max     int64    `json:"max_us"`
+	Buckets []Bucket `json:"buckets"`
+}
+
+// Bucket is the number of values up to an upper bound, counted cumulatively as in Prometheus.
+// The last bucket has no upper bound and counts all values.
+type Bucket struct {
+	Le    *int64 `json:"le_us,omitempty"`
+	Count int64  `json:"count"`
+}
+
+// Snapshot returns the current state of the histogram.
+func (h *Histogram) Snapshot() *HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := &HistogramSnapshot{
+		Count:   h.count,
+		Min:     h.min.Microseconds(),
+		Max:     h.max.Microseconds(),
+		Buckets: make([]Bucket, len(h.counts)),
+	}
+	if h.count != 0 {
+		s.Mean = (h.sum / time.Duration(h.count)).Microseconds()
+	}
+	var n int64
+	for i, c := range h.counts {
+		n += c
+		s.Buckets[i].Count = n
+		if i < len(h.bounds) {
+			le := h.bounds[i].Microseconds()
+			s.Buckets[i].Le = &le
+		}
+	}
+	return s
+}
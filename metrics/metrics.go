@@ -0,0 +1,587 @@
+// Package metrics pushes packet metadata and gateway stats to InfluxDB (line protocol) or statsd.
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+	"github.com/Waziup/single_chan_pkt_fwd/proxy"
+)
+
+// maxDatagram keeps UDP datagrams below the usual MTU.
+const maxDatagram = 1400
+
+// Config is the "metrics_conf" section of the gateway config.
+type Config struct {
+	// Target is where metrics are pushed to:
+	//  "udp://host:8089" for InfluxDB line protocol over UDP,
+	//  "http://host:8086/write?db=lora" for the InfluxDB HTTP API (https works, too),
+	//  "statsd://host:8125" for statsd with tags.
+	Target string `json:"target"`
+	// Interval in seconds between pushes, 10 if not set.
+	Interval int `json:"interval"`
+	// PacketMeasurement is the measurement (or statsd prefix) for received packets, "lora_packet" if not set.
+	PacketMeasurement string `json:"packet_measurement"`
+	// StatsMeasurement is the measurement (or statsd prefix) for gateway stats, "lora_gateway" if not set.
+	StatsMeasurement string `json:"stats_measurement"`
+	// TxMeasurement is the measurement (or statsd prefix) for sent downlinks, "lora_tx" if not set.
+	TxMeasurement string `json:"tx_measurement"`
+	// ServerMeasurement is the measurement (or statsd prefix) for the ACK round trips
+	// of the servers, "lora_server" if not set.
+	ServerMeasurement string `json:"server_measurement"`
+	// HostMeasurement is the measurement (or statsd prefix) for the temperature and throttling
+	// of the host, "lora_host" if not set.
+	HostMeasurement string `json:"host_measurement"`
+	// AirtimeMeasurement is the measurement (or statsd prefix) for the downlink airtime
+	// of the servers, "lora_airtime" if not set.
+	AirtimeMeasurement string `json:"airtime_measurement"`
+	// NoiseMeasurement is the measurement (or statsd prefix) for the noise floor
+	// of the channels, "lora_noise" if not set.
+	NoiseMeasurement string `json:"noise_measurement"`
+	// PowerMeasurement is the measurement (or statsd prefix) for the estimated power consumption
+	// of the radios and their transitions between listening and sleeping, "lora_power" if not set.
+	PowerMeasurement string `json:"power_measurement"`
+	// ChannelMeasurement is the measurement (or statsd prefix) for the received packets by
+	// frequency and datarate, "lora_channel" if not set.
+	ChannelMeasurement string `json:"channel_measurement"`
+	// LossMeasurement is the measurement (or statsd prefix) for the uplink loss of the devices,
+	// "lora_loss" if not set.
+	LossMeasurement string `json:"loss_measurement"`
+	// UsageMeasurement is the measurement (or statsd prefix) for the bytes sent and received by
+	// the backends, "lora_usage" if not set.
+	UsageMeasurement string `json:"usage_measurement"`
+	// CrashMeasurement is the measurement (or statsd prefix) for the panics of the workers,
+	// "lora_crash" if not set.
+	CrashMeasurement string `json:"crash_measurement"`
+	// Proxy is the HTTP or SOCKS5 proxy URL for http and https targets, see proxy.Transport.
+	Proxy string `json:"proxy"`
+}
+
+// Exporter collects metrics and pushes them in the background.
+type Exporter struct {
+	Logger *log.Logger
+
+	interval  time.Duration
+	format    func(m *metric) string
+	push      func(lines []string) error
+	gatewayID string
+	pktName   string
+	statsName string
+	txName    string
+	srvName   string
+	hostName  string
+	airName   string
+	noiseName string
+	powerName string
+	chanName  string
+	lossName  string
+	usageName string
+	crashName string
+
+	mu      sync.Mutex
+	metrics []*metric
+	queue   chan []string
+}
+
+// metric is a point in InfluxDB terms.
+type metric struct {
+	name   string
+	tags   [][2]string
+	fields [][2]string // values formatted in line protocol, integers with "i" suffix
+	time   time.Time
+	timing bool // the fields are durations in milliseconds, sent as statsd timers
+}
+
+// New returns an Exporter for the gateway and starts pushing to the target.
+func New(cfg *Config, gatewayID uint64) (*Exporter, error) {
+	u, err := url.Parse(cfg.Target)
+	if err != nil {
+		return nil, fmt.Errorf("metrics: invalid target: %v", err)
+	}
+	e := &Exporter{
+		Logger:    log.New(os.Stdout, "[METRC] ", 0),
+		interval:  10 * time.Second,
+		gatewayID: fmt.Sprintf("%016X", gatewayID),
+		pktName:   "lora_packet",
+		statsName: "lora_gateway",
+		txName:    "lora_tx",
+		srvName:   "lora_server",
+		hostName:  "lora_host",
+		airName:   "lora_airtime",
+		noiseName: "lora_noise",
+		powerName: "lora_power",
+		chanName:  "lora_channel",
+		lossName:  "lora_loss",
+		usageName: "lora_usage",
+		crashName: "lora_crash",
+		queue:     make(chan []string, 4),
+	}
+	if cfg.Interval > 0 {
+		e.interval = time.Duration(cfg.Interval) * time.Second
+	}
+	if cfg.PacketMeasurement != "" {
+		e.pktName = cfg.PacketMeasurement
+	}
+	if cfg.StatsMeasurement != "" {
+		e.statsName = cfg.StatsMeasurement
+	}
+	if cfg.TxMeasurement != "" {
+		e.txName = cfg.TxMeasurement
+	}
+	if cfg.ServerMeasurement != "" {
+		e.srvName = cfg.ServerMeasurement
+	}
+	if cfg.HostMeasurement != "" {
+		e.hostName = cfg.HostMeasurement
+	}
+	if cfg.AirtimeMeasurement != "" {
+		e.airName = cfg.AirtimeMeasurement
+	}
+	if cfg.NoiseMeasurement != "" {
+		e.noiseName = cfg.NoiseMeasurement
+	}
+	if cfg.PowerMeasurement != "" {
+		e.powerName = cfg.PowerMeasurement
+	}
+	if cfg.ChannelMeasurement != "" {
+		e.chanName = cfg.ChannelMeasurement
+	}
+	if cfg.LossMeasurement != "" {
+		e.lossName = cfg.LossMeasurement
+	}
+	if cfg.UsageMeasurement != "" {
+		e.usageName = cfg.UsageMeasurement
+	}
+	if cfg.CrashMeasurement != "" {
+		e.crashName = cfg.CrashMeasurement
+	}
+
+	switch u.Scheme {
+	case "udp":
+		e.format = lineProtocol
+		e.push, err = pushUDP(u.Host)
+	case "statsd":
+		e.format = statsd
+		e.push, err = pushUDP(u.Host)
+	case "http", "https":
+		e.format = lineProtocol
+		e.push, err = pushHTTP(cfg.Target, cfg.Proxy)
+	default:
+		err = fmt.Errorf("metrics: unknown target scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	go e.run()
+	return e, nil
+}
+
+// AddPacket records the metadata of a received packet.
+func (e *Exporter) AddPacket(pkt *lora.RxPacket) {
+	m := &metric{
+		name: e.pktName,
+		tags: [][2]string{
+			{"gateway", e.gatewayID},
+			{"freq", strconv.FormatFloat(pkt.Freq.MHz(), 'f', -1, 64)},
+			{"modu", string(pkt.Modulation)},
+		},
+		fields: [][2]string{
+			{"rssi", fmt.Sprint(pkt.RSSI)},
+			{"size", fmt.Sprintf("%di", len(pkt.Data))},
+		},
+		time: time.Now(),
+	}
+	if pkt.Time != nil {
+		m.time = *pkt.Time
+	}
+	if pkt.Modulation == lora.ModulationLoRa {
+		m.tags = append(m.tags, [2]string{"sf", pkt.Datarate.String()})
+		m.tags = append(m.tags, [2]string{"bw", pkt.LoRaBW.String()})
+		m.fields = append(m.fields, [2]string{"snr", fmt.Sprint(pkt.LoRaSNR)})
+	}
+	if pkt.Modulation == lora.ModulationLRFHSS {
+		m.tags = append(m.tags, [2]string{"datr", pkt.LRFHSS.String()})
+	}
+	if f, err := lorawan.Decode(pkt.Data); err == nil && f.IsData() {
+		m.tags = append(m.tags, [2]string{"dev_addr", f.DevAddr.String()})
+	}
+	e.add(m)
+}
+
+// AddStats records the gateway stats, as counted since the last status report.
+func (e *Exporter) AddStats(stat *fwd.Statistic) {
+	e.add(&metric{
+		name: e.statsName,
+		tags: [][2]string{{"gateway", e.gatewayID}},
+		fields: [][2]string{
+			{"rxnb", fmt.Sprintf("%di", stat.Rxnb)},
+			{"rxok", fmt.Sprintf("%di", stat.Rxok)},
+			{"rxfw", fmt.Sprintf("%di", stat.Rxfw)},
+			{"dwnb", fmt.Sprintf("%di", stat.Dwnb)},
+			{"txnb", fmt.Sprintf("%di", stat.Txnb)},
+		},
+		time: time.Now(),
+	})
+	for _, c := range stat.Channels {
+		e.add(&metric{
+			name: e.chanName,
+			tags: [][2]string{
+				{"gateway", e.gatewayID},
+				{"freq", strconv.FormatFloat(c.Freq.MHz(), 'f', -1, 64)},
+				{"datr", c.Datr},
+			},
+			fields: [][2]string{
+				{"rxnb", fmt.Sprintf("%di", c.Rxnb)},
+				{"rxok", fmt.Sprintf("%di", c.Rxok)},
+			},
+			time: time.Now(),
+		})
+	}
+	for _, n := range stat.Noise {
+		dbm := func(v float32) string {
+			return strconv.FormatFloat(float64(v), 'f', 1, 32)
+		}
+		e.add(&metric{
+			name: e.noiseName,
+			tags: [][2]string{
+				{"gateway", e.gatewayID},
+				{"radio", strconv.Itoa(n.Radio)},
+				{"freq", strconv.FormatFloat(n.Freq.MHz(), 'f', -1, 64)},
+			},
+			fields: [][2]string{
+				{"min", dbm(n.Min)},
+				{"avg", dbm(n.Avg)},
+				{"max", dbm(n.Max)},
+			},
+			time: time.Now(),
+		})
+	}
+	for _, p := range stat.Power {
+		e.add(&metric{
+			name: e.powerName,
+			tags: [][2]string{
+				{"gateway", e.gatewayID},
+				{"radio", strconv.Itoa(p.Radio)},
+			},
+			fields: [][2]string{
+				{"power", strconv.FormatFloat(p.Power, 'f', 2, 64)},
+				{"energy", strconv.FormatFloat(p.Energy, 'f', 3, 64)},
+			},
+			time: time.Now(),
+		})
+	}
+}
+
+// AddTxTiming records how late a downlink started compared to its requested time,
+// negative if it started early.
+func (e *Exporter) AddTxTiming(pkt *lora.TxPacket, offset time.Duration) {
+	e.add(&metric{
+		name: e.txName,
+		tags: [][2]string{
+			{"gateway", e.gatewayID},
+			{"freq", strconv.FormatFloat(pkt.Freq.MHz(), 'f', -1, 64)},
+		},
+		fields: [][2]string{
+			{"offset", strconv.FormatFloat(float64(offset)/float64(time.Millisecond), 'f', 3, 64)},
+		},
+		time:   time.Now(),
+		timing: true,
+	})
+}
+
+// AddTxQueue records the depth of the downlink queue and, counted since the start,
+// how many immediate downlinks were delayed and how many downlinks collided.
+func (e *Exporter) AddTxQueue(depth, preempted, collisions int) {
+	e.add(&metric{
+		name: e.txName,
+		tags: [][2]string{{"gateway", e.gatewayID}},
+		fields: [][2]string{
+			{"queue_depth", fmt.Sprintf("%di", depth)},
+			{"preempted", fmt.Sprintf("%di", preempted)},
+			{"collisions", fmt.Sprintf("%di", collisions)},
+		},
+		time: time.Now(),
+	})
+}
+
+// AddServer records the percentiles of the recent ACK round trips of a server, the percentage
+// of its recent packets that were not acknowledged, and if it is degraded.
+func (e *Exporter) AddServer(server string, p50, p95, p99 time.Duration, loss float64, degraded bool) {
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+	}
+	degradedField := "0i"
+	if degraded {
+		degradedField = "1i"
+	}
+	e.add(&metric{
+		name: e.srvName,
+		tags: [][2]string{
+			{"gateway", e.gatewayID},
+			{"server", server},
+		},
+		fields: [][2]string{
+			{"rtt_p50", ms(p50)},
+			{"rtt_p95", ms(p95)},
+			{"rtt_p99", ms(p99)},
+			{"loss", strconv.FormatFloat(loss, 'f', 1, 64)},
+			{"degraded", degradedField},
+		},
+		time: time.Now(),
+	})
+}
+
+// AddAirtime records the number of downlinks a server sent and their total airtime in
+// milliseconds, since the forwarder started.
+func (e *Exporter) AddAirtime(server string, downlinks int, airtimeMs float64) {
+	e.add(&metric{
+		name: e.airName,
+		tags: [][2]string{
+			{"gateway", e.gatewayID},
+			{"server", server},
+		},
+		fields: [][2]string{
+			{"downlinks", strconv.Itoa(downlinks) + "i"},
+			{"airtime", strconv.FormatFloat(airtimeMs, 'f', 3, 64)},
+		},
+		time: time.Now(),
+	})
+}
+
+// AddLoss records the number of uplinks of a device that were received and lost, from the gaps
+// in its FCnt, the loss in percent and the number of FCnt resets, since the forwarder started.
+func (e *Exporter) AddLoss(devAddr string, received, lost int, loss float64, resets int) {
+	e.add(&metric{
+		name: e.lossName,
+		tags: [][2]string{
+			{"gateway", e.gatewayID},
+			{"dev_addr", devAddr},
+		},
+		fields: [][2]string{
+			{"received", strconv.Itoa(received) + "i"},
+			{"lost", strconv.Itoa(lost) + "i"},
+			{"loss", strconv.FormatFloat(loss, 'f', 2, 64)},
+			{"resets", strconv.Itoa(resets) + "i"},
+		},
+		time: time.Now(),
+	})
+}
+
+// AddUsage records the bytes a backend sent and received today and in the current billing month.
+func (e *Exporter) AddUsage(backend string, daySent, dayReceived, monthSent, monthReceived uint64) {
+	e.add(&metric{
+		name: e.usageName,
+		tags: [][2]string{
+			{"gateway", e.gatewayID},
+			{"backend", backend},
+		},
+		fields: [][2]string{
+			{"day_sent", strconv.FormatUint(daySent, 10) + "i"},
+			{"day_received", strconv.FormatUint(dayReceived, 10) + "i"},
+			{"month_sent", strconv.FormatUint(monthSent, 10) + "i"},
+			{"month_received", strconv.FormatUint(monthReceived, 10) + "i"},
+		},
+		time: time.Now(),
+	})
+}
+
+// AddHost records the temperature of the CPU in degrees Celsius, and if the host is
+// undervolted or throttled now. temp is left out if the host has no sensor.
+func (e *Exporter) AddHost(temp *float64, underVoltage, throttled bool) {
+	flag := func(b bool) string {
+		if b {
+			return "1i"
+		}
+		return "0i"
+	}
+	m := &metric{
+		name: e.hostName,
+		tags: [][2]string{
+			{"gateway", e.gatewayID},
+		},
+		fields: [][2]string{
+			{"under_voltage", flag(underVoltage)},
+			{"throttled", flag(throttled)},
+		},
+		time: time.Now(),
+	}
+	if temp != nil {
+		m.fields = append(m.fields, [2]string{"cpu_temp", strconv.FormatFloat(*temp, 'f', 1, 64)})
+	}
+	e.add(m)
+}
+
+// AddRxGate records a transition of the radios to listening or sleeping, with the total time
+// they listened and slept and the number of transitions since the start.
+func (e *Exporter) AddRxGate(listening bool, listenTime, sleepTime time.Duration, transitions int) {
+	state := "0i"
+	if listening {
+		state = "1i"
+	}
+	e.add(&metric{
+		name: e.powerName,
+		tags: [][2]string{
+			{"gateway", e.gatewayID},
+		},
+		fields: [][2]string{
+			{"listening", state},
+			{"listen_time", strconv.FormatFloat(listenTime.Seconds(), 'f', 1, 64)},
+			{"sleep_time", strconv.FormatFloat(sleepTime.Seconds(), 'f', 1, 64)},
+			{"transitions", strconv.Itoa(transitions) + "i"},
+		},
+		time: time.Now(),
+	})
+}
+
+// AddCrash records a panic of a worker, with the number of its panics since the start.
+func (e *Exporter) AddCrash(worker string, crashes int) {
+	e.add(&metric{
+		name: e.crashName,
+		tags: [][2]string{
+			{"gateway", e.gatewayID},
+			{"worker", worker},
+		},
+		fields: [][2]string{
+			{"crashes", strconv.Itoa(crashes) + "i"},
+		},
+		time: time.Now(),
+	})
+}
+
+func (e *Exporter) add(m *metric) {
+	e.mu.Lock()
+	e.metrics = append(e.metrics, m)
+	e.mu.Unlock()
+}
+
+// flush queues all recorded metrics for pushing.
+func (e *Exporter) flush() {
+	e.mu.Lock()
+	metrics := e.metrics
+	e.metrics = nil
+	e.mu.Unlock()
+	if len(metrics) == 0 {
+		return
+	}
+	lines := make([]string, len(metrics))
+	for i, m := range metrics {
+		lines[i] = e.format(m)
+	}
+	select {
+	case e.queue <- lines:
+	default:
+		e.Logger.Printf("dropping %d metrics: target too slow", len(lines))
+	}
+}
+
+func (e *Exporter) run() {
+	go func() {
+		for range time.Tick(e.interval) {
+			e.flush()
+		}
+	}()
+	for lines := range e.queue {
+		if err := e.push(lines); err != nil {
+			e.Logger.Printf("can not push %d metrics: %v", len(lines), err)
+		}
+	}
+}
+
+var escapeTag = strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ")
+
+// lineProtocol formats m as in "lora_packet,gateway=DCA632FFFFFC8F11,sf=SF7 rssi=-57,snr=9.5 1614859200000000000".
+func lineProtocol(m *metric) string {
+	var b strings.Builder
+	b.WriteString(escapeTag.Replace(m.name))
+	for _, t := range m.tags {
+		fmt.Fprintf(&b, ",%s=%s", escapeTag.Replace(t[0]), escapeTag.Replace(t[1]))
+	}
+	for i, f := range m.fields {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%s", escapeTag.Replace(f[0]), f[1])
+	}
+	fmt.Fprintf(&b, " %d", m.time.UnixNano())
+	return b.String()
+}
+
+// statsd formats m as gauges (or timers) with DogStatsD tags, one line per field, as in
+// "lora_packet.rssi:-57|g|#gateway:DCA632FFFFFC8F11,sf:SF7".
+func statsd(m *metric) string {
+	typ := "g"
+	if m.timing {
+		typ = "ms"
+	}
+	var tags strings.Builder
+	for i, t := range m.tags {
+		if i != 0 {
+			tags.WriteByte(',')
+		}
+		fmt.Fprintf(&tags, "%s:%s", t[0], t[1])
+	}
+	lines := make([]string, len(m.fields))
+	for i, f := range m.fields {
+		lines[i] = fmt.Sprintf("%s.%s:%s|%s|#%s", m.name, f[0], strings.TrimSuffix(f[1], "i"), typ, tags.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func pushUDP(addr string) (func(lines []string) error, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("metrics: %v", err)
+	}
+	return func(lines []string) error {
+		var buf bytes.Buffer
+		for _, line := range lines {
+			if buf.Len() != 0 && buf.Len()+1+len(line) > maxDatagram {
+				if _, err := conn.Write(buf.Bytes()); err != nil {
+					return err
+				}
+				buf.Reset()
+			}
+			if buf.Len() != 0 {
+				buf.WriteByte('\n')
+			}
+			buf.WriteString(line)
+		}
+		_, err := conn.Write(buf.Bytes())
+		return err
+	}, nil
+}
+
+func pushHTTP(target, proxyURL string) (func(lines []string) error, error) {
+	transport, err := proxy.Transport(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("metrics: %v", err)
+	}
+	client := &http.Client{Timeout: 10 * time.Second, Transport: transport}
+	return func(lines []string) error {
+		body := strings.NewReader(strings.Join(lines, "\n"))
+		resp, err := client.Post(target, "text/plain; charset=utf-8", body)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return errors.New(resp.Status)
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Window keeps the last durations observed, for percentiles of the recent values.
+type Window struct {
+	mu     sync.Mutex
+	values []time.Duration // a ring of the last values
+	next   int
+	full   bool
+}
+
+// NewWindow returns a window of the last size values.
+func NewWindow(size int) *Window {
+	return &Window{values: make([]time.Duration, size)}
+}
+
+// Observe adds a value to the window, replacing the oldest one if it is full.
+func (w *Window) Observe(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.values[w.next] = d
+	w.next++
+	if w.next == len(w.values) {
+		w.next = 0
+		w.full = true
+	}
+}
+
+// Len returns the number of values in the window.
+func (w *Window) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.full {
+		return len(w.values)
+	}
+	return w.next
+}
+
+// Percentiles returns the percentiles ps, from 0 to 100, of the values in the window,
+// by the nearest rank. They are all zero if the window is empty.
+func (w *Window) Percentiles(ps ...float64) []time.Duration {
+	w.mu.Lock()
+	n := w.next
+	if w.full {
+		n = len(w.values)
+	}
+	sorted := append([]time.Duration(nil), w.values[:n]...)
+	w.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	out := make([]time.Duration, len(ps))
+	if n == 0 {
+		return out
+	}
+	for i, p := range ps {
+		rank := int(math.Ceil(p/100*float64(n))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		if rank >= n {
+			rank = n - 1
+		}
+		out[i] = sorted[rank]
+	}
+	return out
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+func init() {
+	Register("dedup", newDedup)
+}
+
+// DedupOptions are the options of the "dedup" stage, which drops uplinks with the payload of
+// an uplink passed on shortly before, as the same frame received by several radios.
+type DedupOptions struct {
+	// Window in milliseconds in which payloads are compared, 1000 if not set.
+	Window int `json:"window"`
+}
+
+type dedup struct {
+	mu     sync.Mutex
+	window time.Duration
+	seen   map[uint64]time.Time // payload hashes and when they were passed on
+}
+
+var errDuplicate = errors.New("duplicate")
+
+func newDedup(options json.RawMessage) (*Middleware, error) {
+	o := DedupOptions{Window: 1000}
+	if err := decode(options, &o); err != nil {
+		return nil, err
+	}
+	if o.Window <= 0 {
+		return nil, errors.New("window must be above 0")
+	}
+	d := &dedup{
+		window: time.Duration(o.Window) * time.Millisecond,
+		seen:   make(map[uint64]time.Time),
+	}
+	return &Middleware{Rx: d.rx}, nil
+}
+
+func (d *dedup) rx(ctx context.Context, pkt *lora.RxPacket) (*lora.RxPacket, error) {
+	h := fnv.New64a()
+	h.Write(pkt.Data)
+	sum := h.Sum64()
+	now := Now(ctx)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for k, t := range d.seen {
+		if now.Sub(t) > d.window {
+			delete(d.seen, k)
+		}
+	}
+	if _, ok := d.seen[sum]; ok {
+		return nil, errDuplicate
+	}
+	d.seen[sum] = now
+	return pkt, nil
+}
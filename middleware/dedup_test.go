@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/clock"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+func TestDedupWindow(t *testing.T) {
+	c, err := New([]Stage{{Name: "dedup", Options: json.RawMessage(`{"window":500}`)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := clock.NewFake(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	c.Clock = fake
+	rx := func() error {
+		_, err := c.Rx(context.Background(), &lora.RxPacket{Data: []byte{0x40, 0x01, 0x02, 0x03, 0x04}})
+		return err
+	}
+
+	if err := rx(); err != nil {
+		t.Fatalf("first uplink: %v", err)
+	}
+	fake.Advance(500 * time.Millisecond)
+	if err := rx(); !errors.Is(err, errDuplicate) {
+		t.Errorf("uplink at the end of the window: %v, want %v", err, errDuplicate)
+	}
+	// the window counts from the uplink that was passed on, not from the duplicate
+	fake.Advance(time.Millisecond)
+	if err := rx(); err != nil {
+		t.Errorf("uplink after the window: %v", err)
+	}
+	if err := rx(); !errors.Is(err, errDuplicate) {
+		t.Errorf("uplink right after: %v, want %v", err, errDuplicate)
+	}
+}
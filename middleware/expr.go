@@ -0,0 +1,404 @@
+package middleware
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+)
+
+// The rule expressions are comparisons of packet fields with literals, joined by "&&", "||"
+// and "!", as in `sf == 12 && rssi < -135` or `devaddr startsWith "26" || port == 2`.
+// Expressions are type checked when they are compiled, so that a rule can not fail on a packet.
+
+type exprType int
+
+const (
+	typeNumber exprType = iota
+	typeString
+	typeBool
+)
+
+var typeNames = [...]string{"number", "string", "bool"}
+
+func (t exprType) String() string {
+	return typeNames[t]
+}
+
+// env is a packet that an expression is evaluated on, with its LoRaWAN frame decoded once.
+type env struct {
+	pkt     *lora.RxPacket
+	frame   *lorawan.Frame
+	decoded bool
+}
+
+func (e *env) dataFrame() *lorawan.Frame {
+	if !e.decoded {
+		e.decoded = true
+		if f, err := lorawan.Decode(e.pkt.Data); err == nil {
+			e.frame = f
+		}
+	}
+	return e.frame
+}
+
+// node is a compiled expression, of which only the eval func of its type is set.
+type node struct {
+	typ exprType
+	num func(*env) float64
+	str func(*env) string
+	bl  func(*env) bool
+}
+
+// fields are the packet fields of the expressions.
+var fields = map[string]*node{
+	"sf": numField(func(e *env) float64 {
+		if e.pkt.Modulation != lora.ModulationLoRa {
+			return 0
+		}
+		return float64(e.pkt.Datarate)
+	}),
+	"bw":    numField(func(e *env) float64 { return float64(e.pkt.LoRaBW.Hz()) / 1000 }),
+	"cr":    strField(func(e *env) string { return e.pkt.LoRaCR.String() }),
+	"freq":  numField(func(e *env) float64 { return e.pkt.Freq.MHz() }),
+	"modu":  strField(func(e *env) string { return string(e.pkt.Modulation) }),
+	"rssi":  numField(func(e *env) float64 { return float64(e.pkt.RSSI) }),
+	"snr":   numField(func(e *env) float64 { return float64(e.pkt.LoRaSNR) }),
+	"size":  numField(func(e *env) float64 { return float64(len(e.pkt.Data)) }),
+	"crc":   numField(func(e *env) float64 { return float64(e.pkt.StatCRC) }),
+	"radio": numField(func(e *env) float64 { return float64(e.pkt.ChainRF) }),
+	"mtype": strField(func(e *env) string {
+		if len(e.pkt.Data) == 0 {
+			return ""
+		}
+		return lora.MType(e.pkt.Data[0] >> 5).String()
+	}),
+	"devaddr": strField(func(e *env) string {
+		if f := e.dataFrame(); f != nil && f.IsData() {
+			return f.DevAddr.String()
+		}
+		return ""
+	}),
+	"port": numField(func(e *env) float64 {
+		if f := e.dataFrame(); f != nil && f.FPort != nil {
+			return float64(*f.FPort)
+		}
+		return -1
+	}),
+	"fcnt": numField(func(e *env) float64 {
+		if f := e.dataFrame(); f != nil && f.IsData() {
+			return float64(f.FCnt)
+		}
+		return -1
+	}),
+}
+
+func numField(f func(*env) float64) *node { return &node{typ: typeNumber, num: f} }
+func strField(f func(*env) string) *node  { return &node{typ: typeString, str: f} }
+
+// fieldNames returns the names of the fields, for error messages.
+func fieldNames() string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+type token struct {
+	kind byte // 'n' number, 's' string, 'i' identifier, 'o' operator, 0 end
+	text string
+	pos  int
+}
+
+func tokenize(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			s, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad string at %d: %v", i, err)
+			}
+			toks = append(toks, token{'s', s, i})
+			i = j + 1
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				j++
+			}
+			toks = append(toks, token{'n', src[i:j], i})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_' || src[j] == '.') {
+				j++
+			}
+			toks = append(toks, token{'i', src[i:j], i})
+			i = j
+		default:
+			op := ""
+			for _, o := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "-"} {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			toks = append(toks, token{'o', op, i})
+			i += len(op)
+		}
+	}
+	return append(toks, token{0, "", len(src)}), nil
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != 0 {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); (t.kind == 'o' || t.kind == 'i') && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// compileExpr compiles a bool expression.
+func compileExpr(src string) (func(*env) bool, error) {
+	toks, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != 0 {
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+	if n.typ != typeBool {
+		return nil, fmt.Errorf("expression is a %s, not a bool", n.typ)
+	}
+	return n.bl, nil
+}
+
+func (p *parser) or() (*node, error) {
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		if l.typ != typeBool || r.typ != typeBool {
+			return nil, fmt.Errorf("|| of a %s and a %s", l.typ, r.typ)
+		}
+		a, b := l.bl, r.bl
+		l = &node{typ: typeBool, bl: func(e *env) bool { return a(e) || b(e) }}
+	}
+	return l, nil
+}
+
+func (p *parser) and() (*node, error) {
+	l, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		r, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		if l.typ != typeBool || r.typ != typeBool {
+			return nil, fmt.Errorf("&& of a %s and a %s", l.typ, r.typ)
+		}
+		a, b := l.bl, r.bl
+		l = &node{typ: typeBool, bl: func(e *env) bool { return a(e) && b(e) }}
+	}
+	return l, nil
+}
+
+func (p *parser) not() (*node, error) {
+	if p.accept("!") {
+		n, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		if n.typ != typeBool {
+			return nil, fmt.Errorf("! of a %s", n.typ)
+		}
+		a := n.bl
+		return &node{typ: typeBool, bl: func(e *env) bool { return !a(e) }}, nil
+	}
+	return p.cmp()
+}
+
+// comparisons are the comparison operators, of which only "==" and "!=" compare bools,
+// and "startsWith" and "contains" only strings.
+var comparisons = []string{"==", "!=", "<=", ">=", "<", ">", "startsWith", "contains"}
+
+func (p *parser) cmp() (*node, error) {
+	l, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	op := ""
+	for _, c := range comparisons {
+		if t.text == c && (t.kind == 'o' || t.kind == 'i') {
+			op = c
+		}
+	}
+	if op == "" {
+		return l, nil
+	}
+	p.next()
+	r, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if l.typ != r.typ {
+		return nil, fmt.Errorf("%s %s %s at %d", l.typ, op, r.typ, t.pos)
+	}
+	switch l.typ {
+	case typeNumber:
+		a, b := l.num, r.num
+		var f func(x, y float64) bool
+		switch op {
+		case "==":
+			f = func(x, y float64) bool { return x == y }
+		case "!=":
+			f = func(x, y float64) bool { return x != y }
+		case "<":
+			f = func(x, y float64) bool { return x < y }
+		case "<=":
+			f = func(x, y float64) bool { return x <= y }
+		case ">":
+			f = func(x, y float64) bool { return x > y }
+		case ">=":
+			f = func(x, y float64) bool { return x >= y }
+		default:
+			return nil, fmt.Errorf("%s of numbers at %d", op, t.pos)
+		}
+		return &node{typ: typeBool, bl: func(e *env) bool { return f(a(e), b(e)) }}, nil
+	case typeString:
+		a, b := l.str, r.str
+		var f func(x, y string) bool
+		switch op {
+		case "==":
+			f = func(x, y string) bool { return x == y }
+		case "!=":
+			f = func(x, y string) bool { return x != y }
+		case "<":
+			f = func(x, y string) bool { return x < y }
+		case "<=":
+			f = func(x, y string) bool { return x <= y }
+		case ">":
+			f = func(x, y string) bool { return x > y }
+		case ">=":
+			f = func(x, y string) bool { return x >= y }
+		case "startsWith":
+			// DevAddr prefixes are compared without case
+			f = func(x, y string) bool { return strings.HasPrefix(strings.ToUpper(x), strings.ToUpper(y)) }
+		case "contains":
+			f = strings.Contains
+		}
+		return &node{typ: typeBool, bl: func(e *env) bool { return f(a(e), b(e)) }}, nil
+	}
+	a, b := l.bl, r.bl
+	switch op {
+	case "==":
+		return &node{typ: typeBool, bl: func(e *env) bool { return a(e) == b(e) }}, nil
+	case "!=":
+		return &node{typ: typeBool, bl: func(e *env) bool { return a(e) != b(e) }}, nil
+	}
+	return nil, fmt.Errorf("%s of bools at %d", op, t.pos)
+}
+
+func (p *parser) primary() (*node, error) {
+	t := p.next()
+	switch t.kind {
+	case 'n':
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q at %d", t.text, t.pos)
+		}
+		return &node{typ: typeNumber, num: func(*env) float64 { return v }}, nil
+	case 's':
+		s := t.text
+		return &node{typ: typeString, str: func(*env) string { return s }}, nil
+	case 'i':
+		switch {
+		case t.text == "true" || t.text == "false":
+			v := t.text == "true"
+			return &node{typ: typeBool, bl: func(*env) bool { return v }}, nil
+		case strings.HasPrefix(t.text, "meta."):
+			key := strings.TrimPrefix(t.text, "meta.")
+			return &node{typ: typeString, str: func(e *env) string { return e.pkt.Meta[key] }}, nil
+		}
+		if n, ok := fields[t.text]; ok {
+			return n, nil
+		}
+		return nil, fmt.Errorf("unknown field %q at %d, not one of %s or meta.<key>", t.text, t.pos, fieldNames())
+	case 'o':
+		switch t.text {
+		case "(":
+			n, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			if !p.accept(")") {
+				return nil, fmt.Errorf("missing ) at %d", p.peek().pos)
+			}
+			return n, nil
+		case "-":
+			n, err := p.primary()
+			if err != nil {
+				return nil, err
+			}
+			if n.typ != typeNumber {
+				return nil, fmt.Errorf("- of a %s at %d", n.typ, t.pos)
+			}
+			a := n.num
+			return &node{typ: typeNumber, num: func(e *env) float64 { return -a(e) }}, nil
+		}
+	case 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
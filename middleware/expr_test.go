@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// exprPacket is an unconfirmed data up of 26:01:02:03 on port 1, with SF7 and -120 dBm.
+var exprPacket = &lora.RxPacket{
+	Modulation: lora.ModulationLoRa,
+	LoRaBW:     lora.BW125K,
+	LoRaCR:     lora.CR4_5,
+	Datarate:   lora.SF7,
+	RSSI:       -120,
+	Meta:       map[string]string{"site": "roof"},
+	Data:       []byte{0x40, 0x03, 0x02, 0x01, 0x26, 0x00, 0x01, 0x00, 0x01, 0xAB, 0x11, 0x22, 0x33, 0x44},
+}
+
+func TestExpr(t *testing.T) {
+	for _, test := range []struct {
+		src  string
+		want bool
+		err  string // in the error, if any
+	}{
+		// && binds tighter than ||, and ! tighter than both
+		{src: `true || false && false`, want: true},
+		{src: `(true || false) && false`, want: false},
+		{src: `!false && false`, want: false},
+		{src: `!(false && false)`, want: true},
+		{src: `!true || true`, want: true},
+		{src: `!sf == 12`, want: true},
+		{src: `sf == 7 && rssi < -100 || port == 2`, want: true},
+		{src: `sf == 12 || rssi < -100 && port == 2`, want: false},
+
+		{src: `rssi == -120`, want: true},
+		{src: `-rssi > 100`, want: true},
+		{src: `--rssi == -120`, want: true},
+		{src: `-devaddr == "26"`, err: "- of a string"},
+
+		{src: `devaddr startsWith "26"`, want: true},
+		{src: `devaddr startsWith "2601"`, want: true},
+		{src: `devaddr startsWith "01"`, want: false},
+		{src: `cr contains "/5"`, want: true},
+		{src: `sf startsWith 7`, err: "startsWith of numbers"},
+		{src: `sf contains 7`, err: "contains of numbers"},
+		{src: `devaddr startsWith 26`, err: "string startsWith number"},
+		{src: `true contains false`, err: "contains of bools"},
+
+		{src: `meta.site == "roof"`, want: true},
+		{src: `meta.floor == ""`, want: true},
+		{src: `meta.site == 1`, err: "string == number"},
+
+		{src: `devaddr == "26`, err: "unterminated string"},
+		{src: `channel == 1`, err: `unknown field "channel"`},
+		{src: `sf`, err: "expression is a number, not a bool"},
+		{src: `devaddr`, err: "expression is a string, not a bool"},
+		{src: `sf == 7 &&`, err: "unexpected end of expression"},
+		{src: `(sf == 7`, err: "missing )"},
+		{src: `sf == 7 && 1`, err: "&& of a bool and a number"},
+	} {
+		match, err := compileExpr(test.src)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want %q", test.src, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+		if got := match(&env{pkt: exprPacket}); got != test.want {
+			t.Errorf("%s = %t, want %t", test.src, got, test.want)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	for _, test := range []struct {
+		src                string
+		action, key, value string
+		match              bool
+		err                string
+	}{
+		{src: `drop sf == 7 && rssi < -100`, action: "drop", match: true},
+		{src: `tag site=cellar devaddr startsWith "26"`, action: "tag", key: "site", value: "cellar", match: true},
+		{src: `tag late=1 port == 2`, action: "tag", key: "late", value: "1", match: false},
+		{src: `untag site true`, action: "untag", key: "site", match: true},
+		{src: `  drop   meta.site == "roof"  `, action: "drop", match: true},
+
+		{src: ``, err: "empty rule"},
+		{src: `keep true`, err: `unknown action "keep"`},
+		{src: `drop`, err: "no expression"},
+		{src: `tag`, err: "tag without key"},
+		{src: `tag site sf == 7`, err: "tag without key=value"},
+		{src: `tag =roof true`, err: "tag without key=value"},
+		{src: `untag site`, err: "no expression"},
+		{src: `drop sf`, err: "not a bool"},
+	} {
+		r, err := parseRule(test.src)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: error %v, want %q", test.src, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.src, err)
+			continue
+		}
+		if r.action != test.action || r.key != test.key || r.value != test.value {
+			t.Errorf("%q: %s %q=%q, want %s %q=%q", test.src, r.action, r.key, r.value, test.action, test.key, test.value)
+		}
+		if got := r.match(&env{pkt: exprPacket}); got != test.match {
+			t.Errorf("%q matches %t, want %t", test.src, got, test.match)
+		}
+	}
+}
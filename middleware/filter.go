@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+func init() {
+	Register("filter", newFilter)
+}
+
+// FilterOptions are the options of the "filter" stage, which drops uplinks that are below
+// the thresholds. Options that are not set do not filter.
+type FilterOptions struct {
+	MinRSSI *float32 `json:"min_rssi"` // in dBm
+	MinSNR  *float32 `json:"min_snr"`  // in dB
+	// CRCOK drops uplinks with CRC errors.
+	CRCOK bool `json:"crc_ok"`
+	// MaxSF drops uplinks with higher spreading factors.
+	MaxSF lora.SpreadingFactor `json:"max_sf"`
+}
+
+func newFilter(options json.RawMessage) (*Middleware, error) {
+	var o FilterOptions
+	if err := decode(options, &o); err != nil {
+		return nil, err
+	}
+	rx := func(ctx context.Context, pkt *lora.RxPacket) (*lora.RxPacket, error) {
+		switch {
+		case o.MinRSSI != nil && pkt.RSSI < *o.MinRSSI:
+			return nil, fmt.Errorf("rssi %.0f dBm below %.0f dBm", pkt.RSSI, *o.MinRSSI)
+		case o.MinSNR != nil && pkt.LoRaSNR < *o.MinSNR:
+			return nil, fmt.Errorf("snr %.1f dB below %.1f dB", pkt.LoRaSNR, *o.MinSNR)
+		case o.CRCOK && pkt.StatCRC != 1:
+			return nil, fmt.Errorf("crc status %d", pkt.StatCRC)
+		case o.MaxSF != 0 && pkt.Modulation == lora.ModulationLoRa && pkt.Datarate > o.MaxSF:
+			return nil, fmt.Errorf("SF%d above %s", pkt.Datarate, o.MaxSF)
+		}
+		return pkt, nil
+	}
+	return &Middleware{Rx: rx}, nil
+}
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/Waziup/single_chan_pkt_fwd/gps"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+func init() {
+	Register("location", newLocation)
+}
+
+// LocationOptions are the options of the "location" stage, which adds the location of the
+// gateway and the label of the installation to the uplinks, so that the servers and the
+// webhook get them with each uplink.
+type LocationOptions struct {
+	Latitude  *float64 `json:"lati"`
+	Longitude *float64 `json:"long"`
+	Altitude  int32    `json:"alti"`
+	// GPS is the serial device of an NMEA GPS receiver, whose fix is taken over the location
+	// above once it has one. GPSBaud is its baud rate, 9600 if not set.
+	GPS     string `json:"gps"`
+	GPSBaud int    `json:"gps_baud"`
+	// Label names the installation, in the "label" metadata.
+	Label string `json:"label"`
+	// Meta puts the location in the "lati", "long" and "alti" metadata instead of the fields
+	// of the uplinks.
+	Meta bool `json:"meta"`
+}
+
+type location struct {
+	opts     LocationOptions
+	fixed    *lora.Location // configured, or nil
+	receiver *gps.Receiver  // or nil
+}
+
+func newLocation(options json.RawMessage) (*Middleware, error) {
+	var o LocationOptions
+	if err := decode(options, &o); err != nil {
+		return nil, err
+	}
+	l := &location{opts: o}
+	if (o.Latitude == nil) != (o.Longitude == nil) {
+		return nil, errors.New("lati and long must be set together")
+	}
+	if o.Latitude != nil {
+		if math.Abs(*o.Latitude) > 90 || math.Abs(*o.Longitude) > 180 {
+			return nil, errors.New("lati or long out of range")
+		}
+		l.fixed = &lora.Location{Latitude: *o.Latitude, Longitude: *o.Longitude, Altitude: o.Altitude}
+	}
+	if o.GPS != "" {
+		r, err := gps.Open(o.GPS, o.GPSBaud)
+		if err != nil {
+			return nil, err
+		}
+		l.receiver = r
+	}
+	if l.fixed == nil && l.receiver == nil && o.Label == "" {
+		return nil, errors.New("no lati and long, gps or label")
+	}
+	return &Middleware{Rx: l.rx}, nil
+}
+
+// current returns the location of the GPS fix, or the configured one, or nil.
+func (l *location) current() *lora.Location {
+	if l.receiver != nil {
+		if fix, ok := l.receiver.Fix(); ok {
+			return &lora.Location{
+				Latitude:  fix.Latitude,
+				Longitude: fix.Longitude,
+				Altitude:  int32(math.Round(fix.Altitude)),
+			}
+		}
+	}
+	if l.fixed != nil {
+		loc := *l.fixed
+		return &loc
+	}
+	return nil
+}
+
+func (l *location) rx(ctx context.Context, pkt *lora.RxPacket) (*lora.RxPacket, error) {
+	loc := l.current()
+	if loc != nil && !l.opts.Meta {
+		pkt.Location = loc
+	}
+	if (loc != nil && l.opts.Meta) || l.opts.Label != "" {
+		// the map may be shared with clones of the packet
+		meta := make(map[string]string, len(pkt.Meta)+4)
+		for k, v := range pkt.Meta {
+			meta[k] = v
+		}
+		if loc != nil && l.opts.Meta {
+			meta["lati"] = strconv.FormatFloat(loc.Latitude, 'f', 5, 64)
+			meta["long"] = strconv.FormatFloat(loc.Longitude, 'f', 5, 64)
+			meta["alti"] = strconv.Itoa(int(loc.Altitude))
+		}
+		if l.opts.Label != "" {
+			meta["label"] = l.opts.Label
+		}
+		pkt.Meta = meta
+	}
+	return pkt, nil
+}
@@ -0,0 +1,213 @@
+// Package middleware runs uplinks and downlinks through an ordered chain of processing stages,
+// as filters, deduplication and enrichment, configured in the "middleware" list of the gateway
+// config. Stages are registered by name and built from their JSON options.
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/clock"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+)
+
+// Logger logs the events of the stages, as the replays of the "replay" stage.
+var Logger *log.Logger = log.New(os.Stdout, "[MIDDL] ", 0)
+
+// Clock times the windows of the stages, as those of "dedup" and "replay", of the chains
+// without a Clock of their own, see Now.
+var Clock clock.Clock = clock.Real
+
+// clockKey is the context key of the clock of the chain that runs a stage.
+type clockKey struct{}
+
+// Now returns the time by the clock of the chain that runs the stage with ctx, or by Clock.
+// Stages with windows take their time from it, so tests of a chain set a clock.Fake.
+func Now(ctx context.Context) time.Time {
+	if c, ok := ctx.Value(clockKey{}).(clock.Clock); ok {
+		return c.Now()
+	}
+	return Clock.Now()
+}
+
+// PrivateID returns a DevAddr in hex as stages may log it, "" if they must not.
+// It returns the DevAddr as it is if not set otherwise, see the "privacy_conf" of the gateway.
+var PrivateID = func(id string) string { return id }
+
+// RelayMeta is the metadata key of the frames of the LoRaWAN relay, as "wor", "wor_ack" or
+// "relay_uplink", see lorawan.Frame.Relay. The chain never drops them, as filters meant for end
+// devices would break the relay.
+const RelayMeta = "relay"
+
+// TagRelay sets the RelayMeta metadata of the frames of the relay.
+func TagRelay(pkt *lora.RxPacket) {
+	if f, err := lorawan.Decode(pkt.Data); err == nil {
+		if t := f.Relay(); t != lorawan.NotRelay {
+			setMeta(pkt, RelayMeta, t.String())
+		}
+	}
+}
+
+// RxFunc processes an uplink. It returns the packet to pass on to the next stage, or nil to drop
+// it, with an error that tells why or without. A stage that returns another packet than it got
+// releases the one it got, and a stage that drops a packet leaves it to the chain, which releases it.
+type RxFunc func(ctx context.Context, pkt *lora.RxPacket) (*lora.RxPacket, error)
+
+// TxFunc processes a downlink. It returns the packet to pass on to the next stage, or nil to
+// drop it, with an error that tells why or without. Errors wrapping lora.ErrFrequency or
+// lora.ErrPower are acknowledged to the server as TX_FREQ or TX_POWER.
+type TxFunc func(ctx context.Context, pkt *lora.TxPacket) (*lora.TxPacket, error)
+
+// Middleware is a stage of a Chain. A stage for uplinks or downlinks only leaves the other func nil.
+// Uplinks and downlinks are processed concurrently, so stages that handle both and share state
+// between Rx and Tx must lock it.
+type Middleware struct {
+	Rx RxFunc
+	Tx TxFunc
+}
+
+// Factory returns the middleware of a stage from the options of its config.
+// The options are nil if the config has none.
+type Factory func(options json.RawMessage) (*Middleware, error)
+
+var factories = make(map[string]Factory)
+
+// Register makes a stage available by name, see Stage. Stages register in the init function of their file.
+func Register(name string, f Factory) {
+	factories[name] = f
+}
+
+// Names returns the names of the registered stages.
+func Names() []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Stage is an entry of the "middleware" list of the gateway config.
+type Stage struct {
+	// Name of the stage, see Register.
+	Name string `json:"name"`
+	// Options of the stage, which depend on the stage.
+	Options json.RawMessage `json:"options"`
+}
+
+// ErrDropped is returned by the chain for packets that a stage dropped without an error.
+var ErrDropped = errors.New("dropped")
+
+type stage struct {
+	name string
+	*Middleware
+}
+
+// Chain runs packets through the stages in the order of the config.
+type Chain struct {
+	// Clock times the windows of the stages, see Now, or Clock if nil.
+	Clock clock.Clock
+
+	stages []stage
+}
+
+// New returns the chain of the stages.
+func New(stages []Stage) (*Chain, error) {
+	c := &Chain{}
+	for i, s := range stages {
+		f, ok := factories[s.Name]
+		if !ok {
+			return nil, fmt.Errorf("middleware: stage %d: unknown stage %q, not one of %v", i, s.Name, Names())
+		}
+		m, err := f(s.Options)
+		if err != nil {
+			return nil, fmt.Errorf("middleware: %s: %v", s.Name, err)
+		}
+		c.stages = append(c.stages, stage{name: s.Name, Middleware: m})
+	}
+	return c, nil
+}
+
+// Names returns the names of the stages in order.
+func (c *Chain) Names() []string {
+	names := make([]string, len(c.stages))
+	for i, s := range c.stages {
+		names[i] = s.name
+	}
+	return names
+}
+
+// Rx runs the uplink through the stages. If a stage drops it, Rx releases it and returns
+// nil with ErrDropped or the error of the stage, prefixed by the name of the stage.
+// Frames of the relay, see RelayMeta, are passed on to the next stage instead.
+func (c *Chain) Rx(ctx context.Context, pkt *lora.RxPacket) (*lora.RxPacket, error) {
+	ctx = c.withClock(ctx)
+	for _, s := range c.stages {
+		if s.Rx == nil {
+			continue
+		}
+		next, err := s.Rx(ctx, pkt)
+		if next == nil && pkt.Meta[RelayMeta] != "" {
+			if err == nil {
+				err = ErrDropped
+			}
+			Logger.Printf("relay: %s frame passed on by %s: %v", pkt.Meta[RelayMeta], s.name, err)
+			continue
+		}
+		if next == nil {
+			pkt.Release()
+			if err == nil {
+				err = ErrDropped
+			}
+			return nil, fmt.Errorf("%s: %w", s.name, err)
+		}
+		pkt = next
+	}
+	return pkt, nil
+}
+
+// Tx runs the downlink through the stages. If a stage drops it, Tx returns nil with ErrDropped
+// or the error of the stage, prefixed by the name of the stage.
+func (c *Chain) Tx(ctx context.Context, pkt *lora.TxPacket) (*lora.TxPacket, error) {
+	ctx = c.withClock(ctx)
+	for _, s := range c.stages {
+		if s.Tx == nil {
+			continue
+		}
+		next, err := s.Tx(ctx, pkt)
+		if next == nil {
+			if err == nil {
+				err = ErrDropped
+			}
+			return nil, fmt.Errorf("%s: %w", s.name, err)
+		}
+		pkt = next
+	}
+	return pkt, nil
+}
+
+// withClock returns ctx with the clock of the chain for Now, if it has one.
+func (c *Chain) withClock(ctx context.Context) context.Context {
+	if c.Clock == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, clockKey{}, c.Clock)
+}
+
+// decode unmarshals the options of a stage into v, which keeps its defaults without options.
+func decode(options json.RawMessage, v interface{}) error {
+	if len(options) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(options))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
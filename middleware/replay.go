@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+)
+
+func init() {
+	Register("replay", newReplay)
+}
+
+// ReplayOptions are the options of the "replay" stage, which detects data uplinks with the
+// DevAddr, FCnt and MIC of an uplink received before, as sent by a naive replay attack.
+// Confirmed uplinks are retransmitted unchanged, so repeats within MinAge are not replays.
+// As the same frame received by several radios repeats, too, the stage should follow "dedup".
+type ReplayOptions struct {
+	// Window in seconds in which uplinks are remembered, 3600 if not set.
+	Window int `json:"window"`
+	// MinAge in seconds of the first uplink for a repeat to be a replay, 60 if not set.
+	MinAge int `json:"min_age"`
+	// Action is "flag" to set the "replay" metadata of replays to "true" and pass them on,
+	// or "drop" to drop them, "flag" if not set. Replays are logged either way.
+	Action string `json:"action"`
+}
+
+type replayKey struct {
+	addr lorawan.DevAddr
+	fCnt uint16
+	mic  [4]byte
+}
+
+type replay struct {
+	window, minAge time.Duration
+	drop           bool
+
+	mu      sync.Mutex
+	seen    map[replayKey]time.Time // when the uplinks were first received
+	expired time.Time               // when seen was last cleaned
+}
+
+var errReplay = errors.New("replay")
+
+func newReplay(options json.RawMessage) (*Middleware, error) {
+	o := ReplayOptions{Window: 3600, MinAge: 60, Action: "flag"}
+	if err := decode(options, &o); err != nil {
+		return nil, err
+	}
+	if o.Window <= 0 {
+		return nil, errors.New("window must be above 0")
+	}
+	if o.MinAge < 0 || o.MinAge >= o.Window {
+		return nil, errors.New("min_age must be 0 or more and below window")
+	}
+	if o.Action != "flag" && o.Action != "drop" {
+		return nil, fmt.Errorf("unknown action %q, not flag or drop", o.Action)
+	}
+	r := &replay{
+		window: time.Duration(o.Window) * time.Second,
+		minAge: time.Duration(o.MinAge) * time.Second,
+		drop:   o.Action == "drop",
+		seen:   make(map[replayKey]time.Time),
+	}
+	return &Middleware{Rx: r.rx}, nil
+}
+
+func (r *replay) rx(ctx context.Context, pkt *lora.RxPacket) (*lora.RxPacket, error) {
+	f, err := lorawan.Decode(pkt.Data)
+	if err != nil || !f.IsData() || !f.IsUplink() {
+		return pkt, nil
+	}
+	key := replayKey{addr: f.DevAddr, fCnt: f.FCnt, mic: f.MIC}
+	now := Now(ctx)
+
+	r.mu.Lock()
+	// the window is long, so the expired uplinks are removed once a minute only
+	if now.Sub(r.expired) > time.Minute {
+		for k, t := range r.seen {
+			if now.Sub(t) > r.window {
+				delete(r.seen, k)
+			}
+		}
+		r.expired = now
+	}
+	first, ok := r.seen[key]
+	if !ok || now.Sub(first) > r.window {
+		r.seen[key] = now
+	}
+	r.mu.Unlock()
+
+	if !ok || now.Sub(first) > r.window || now.Sub(first) < r.minAge {
+		return pkt, nil
+	}
+	Logger.Printf("security: replay of DevAddr %s FCnt %d, first received %s ago (rssi %.0f, snr %.1f)",
+		PrivateID(f.DevAddr.String()), f.FCnt, now.Sub(first).Round(time.Second), pkt.RSSI, pkt.LoRaSNR)
+	if r.drop {
+		return nil, errReplay
+	}
+	setMeta(pkt, "replay", "true")
+	return pkt, nil
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+func init() {
+	Register("rules", newRules)
+}
+
+// RulesOptions are the options of the "rules" stage, which drops uplinks or sets their metadata
+// by rules as in "drop sf == 12 && rssi < -135". The rules are applied in order:
+//
+//	drop <expr>               drops the uplink, so the rules after it are not applied
+//	tag <key>=<value> <expr>  sets the metadata key to the value
+//	untag <key> <expr>        removes the metadata key
+//
+// The expressions compare the fields of the uplinks, see fields, with literals.
+type RulesOptions struct {
+	Rules []string `json:"rules"`
+}
+
+type rule struct {
+	src        string
+	action     string
+	key, value string
+	match      func(*env) bool
+}
+
+func newRules(options json.RawMessage) (*Middleware, error) {
+	var o RulesOptions
+	if err := decode(options, &o); err != nil {
+		return nil, err
+	}
+	if len(o.Rules) == 0 {
+		return nil, errors.New("no rules")
+	}
+	rules := make([]*rule, len(o.Rules))
+	for i, src := range o.Rules {
+		r, err := parseRule(src)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d %q: %v", i, src, err)
+		}
+		rules[i] = r
+	}
+	rx := func(ctx context.Context, pkt *lora.RxPacket) (*lora.RxPacket, error) {
+		e := &env{pkt: pkt}
+		for _, r := range rules {
+			if !r.match(e) {
+				continue
+			}
+			switch r.action {
+			case "drop":
+				return nil, fmt.Errorf("rule %q", r.src)
+			case "tag":
+				setMeta(pkt, r.key, r.value)
+			case "untag":
+				setMeta(pkt, r.key, "")
+			}
+		}
+		return pkt, nil
+	}
+	return &Middleware{Rx: rx}, nil
+}
+
+func parseRule(src string) (*rule, error) {
+	r := &rule{src: src}
+	action := strings.Fields(src)
+	if len(action) == 0 {
+		return nil, errors.New("empty rule")
+	}
+	r.action = action[0]
+	rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(src), r.action))
+	switch r.action {
+	case "drop":
+	case "tag", "untag":
+		arg := strings.Fields(rest)
+		if len(arg) == 0 {
+			return nil, fmt.Errorf("%s without key", r.action)
+		}
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, arg[0]))
+		r.key = arg[0]
+		if r.action == "tag" {
+			i := strings.IndexByte(arg[0], '=')
+			if i <= 0 {
+				return nil, errors.New("tag without key=value")
+			}
+			r.key, r.value = arg[0][:i], arg[0][i+1:]
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q, not drop, tag or untag", r.action)
+	}
+	if rest == "" {
+		return nil, errors.New("no expression, use true to match all uplinks")
+	}
+	var err error
+	if r.match, err = compileExpr(rest); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// setMeta sets the metadata key of the packet, or removes it if value is empty. The map is
+// copied, as it may be shared with clones of the packet.
+func setMeta(pkt *lora.RxPacket, key, value string) {
+	meta := make(map[string]string, len(pkt.Meta)+1)
+	for k, v := range pkt.Meta {
+		meta[k] = v
+	}
+	if value == "" {
+		delete(meta, key)
+	} else {
+		meta[key] = value
+	}
+	if len(meta) == 0 {
+		meta = nil
+	}
+	pkt.Meta = meta
+}
@@ -0,0 +1,155 @@
+// Package mock provides a radio without hardware, for tests, simulations and bring-up.
+package mock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// Radio is a lora.Radio that receives the packets passed to Inject
+// and hands the sent packets to the Sent channel.
+type Radio struct {
+	// Sent receives a copy of each packet passed to Send.
+	// If nobody reads it and the channel is full, sent packets are dropped.
+	Sent chan *lora.TxPacket
+
+	mu    sync.Mutex
+	cfg   *lora.Config // nil while not receiving
+	rxCfg *lora.Config // config of the last Receive call
+	rx    []*lora.RxPacket
+	mode  lora.PowerMode
+}
+
+var (
+	_ lora.Radio        = (*Radio)(nil)
+	_ lora.PowerManager = (*Radio)(nil)
+)
+
+// NewRadio returns a mock radio.
+func NewRadio() *Radio {
+	return &Radio{Sent: make(chan *lora.TxPacket, 64)}
+}
+
+func (r *Radio) Name() string {
+	return "mock"
+}
+
+func (r *Radio) Receive(ctx context.Context, cfg *lora.Config) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cfg = cfg
+	r.rxCfg = cfg
+	r.mode = lora.PowerRx
+	r.mu.Unlock()
+	return nil
+}
+
+// Inject queues a packet that is returned by the next GetPacket call.
+// As with a real radio, it is only received if its frequency, spreading factor and bandwidth
+// match the configuration of the last Receive call. Missing fields are taken from that configuration.
+func (r *Radio) Inject(pkt *lora.RxPacket) {
+	r.mu.Lock()
+	r.rx = append(r.rx, pkt)
+	r.mu.Unlock()
+}
+
+func (r *Radio) GetPacket(ctx context.Context) ([]*lora.RxPacket, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cfg == nil || len(r.rx) == 0 {
+		return nil, nil
+	}
+	var pkts []*lora.RxPacket
+	for _, in := range r.rx {
+		if in.Freq == 0 {
+			in.Freq = r.cfg.Freq
+		}
+		if in.Modulation == "" {
+			in.Modulation = lora.ModulationLoRa
+		}
+		if in.Datarate == 0 {
+			in.Datarate = r.cfg.Datarate
+		}
+		if in.LoRaBW == 0 {
+			in.LoRaBW = r.cfg.LoRaBW
+		}
+		if in.LoRaCR == 0 {
+			in.LoRaCR = r.cfg.LoRaCR
+		}
+		if in.Freq != r.cfg.Freq || in.Datarate != r.cfg.Datarate || in.LoRaBW != r.cfg.LoRaBW {
+			continue
+		}
+		// copy to a pooled packet, as the radio drivers do
+		pkt := in.Clone()
+		if pkt.StatCRC == 0 {
+			pkt.StatCRC = 1
+		}
+		pkts = append(pkts, pkt)
+	}
+	r.rx = nil
+	return pkts, nil
+}
+
+// SetPowerMode sets the mode returned by PowerMode. In sleep and standby, the packets not
+// received yet are dropped and none are received until the next Receive call.
+func (r *Radio) SetPowerMode(ctx context.Context, mode lora.PowerMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch mode {
+	case lora.PowerSleep, lora.PowerStandby:
+		r.cfg = nil
+		r.rx = nil
+	case lora.PowerRx:
+		if r.rxCfg == nil {
+			return errors.New("mock: can not receive before Receive is called")
+		}
+		r.cfg = r.rxCfg
+	default:
+		return fmt.Errorf("mock: can not set power mode %s", mode)
+	}
+	r.mode = mode
+	return nil
+}
+
+// PowerMode returns the mode set by Receive or SetPowerMode, as the mock radio sends instantly.
+func (r *Radio) PowerMode() lora.PowerMode {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mode
+}
+
+// PowerUsage returns no time and no energy, as the mock radio draws none.
+func (r *Radio) PowerUsage() lora.PowerUsage {
+	return lora.PowerUsage{Mode: r.PowerMode()}
+}
+
+func (r *Radio) Send(ctx context.Context, pkt *lora.TxPacket) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := pkt.Validate(nil); err != nil {
+		return err
+	}
+	sent := *pkt
+	sent.Data = append([]byte(nil), pkt.Data...)
+	select {
+	case r.Sent <- &sent:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// noiseInterval is the time between two RSSI samples of a radio.
+const noiseInterval = 5 * time.Second
+
+type noiseKey struct {
+	radio int
+	freq  lora.Frequency
+}
+
+// noiseFloor samples the RSSI of the radios while they receive no frame, for the noise
+// floor of their channels. It is used by the main loop only.
+type noiseFloor struct {
+	stats   map[noiseKey]*fwd.NoiseStat
+	sums    map[noiseKey]float64
+	sampled map[int]time.Time // when each radio was last sampled
+}
+
+func newNoiseFloor() *noiseFloor {
+	return &noiseFloor{
+		stats:   make(map[noiseKey]*fwd.NoiseStat),
+		sums:    make(map[noiseKey]float64),
+		sampled: make(map[int]time.Time),
+	}
+}
+
+// sample samples the RSSI of the radio if it is due and the radio can read it.
+// A radio that is receiving a frame is not sampled, as the RSSI is the frame's.
+func (n *noiseFloor) sample(radio *gatewayRadio, now time.Time) {
+	r, ok := radio.Radio.(lora.RSSIReader)
+	if !ok || !radio.receiving || now.Sub(n.sampled[radio.index]) < noiseInterval {
+		return
+	}
+	if rx, ok := radio.Radio.(interface{ Receiving() (bool, error) }); ok {
+		if busy, err := rx.Receiving(); err != nil || busy {
+			return
+		}
+	}
+	rssi, err := r.CurrentRSSI()
+	if err != nil {
+		log(LogLevelDebug, "radio %d: can not read RSSI: %v", radio.index, err)
+		return
+	}
+	n.sampled[radio.index] = now
+	rssi += radio.cfg.RSSIOffset
+
+	key := noiseKey{radio.index, radio.cfg.Freq}
+	s := n.stats[key]
+	if s == nil {
+		s = &fwd.NoiseStat{Radio: radio.index, Freq: radio.cfg.Freq, Min: rssi, Max: rssi}
+		n.stats[key] = s
+	}
+	if rssi < s.Min {
+		s.Min = rssi
+	}
+	if rssi > s.Max {
+		s.Max = rssi
+	}
+	s.N++
+	n.sums[key] += float64(rssi)
+	s.Avg = float32(n.sums[key] / float64(s.N))
+}
+
+// report returns the noise floor of each radio and channel since the last report, and starts anew.
+func (n *noiseFloor) report() []*fwd.NoiseStat {
+	stats := make([]*fwd.NoiseStat, 0, len(n.stats))
+	for key, s := range n.stats {
+		stats = append(stats, s)
+		delete(n.stats, key)
+		delete(n.sums, key)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Radio != stats[j].Radio {
+			return stats[i].Radio < stats[j].Radio
+		}
+		return stats[i].Freq < stats[j].Freq
+	})
+	return stats
+}
@@ -0,0 +1,167 @@
+// Package ntp measures the offset of the system clock with SNTP (RFC 4330), so the
+// forwarder can warn about and make up for a host clock that is off.
+package ntp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ntpEpoch is the NTP epoch, 1900-01-01, in seconds before the Unix epoch.
+const ntpEpoch = 2208988800
+
+// Query asks an NTP server ("pool.ntp.org" or "host:port") for the time.
+// It returns the offset of the system clock, which is to be added to the system time,
+// and the round trip time of the query.
+func Query(server string, timeout time.Duration) (offset, rtt time.Duration, err error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	var req [48]byte
+	req[0] = 0x1B // LI 0, version 3, mode 3 (client)
+	t1 := time.Now()
+	putTime(req[40:], t1)
+	if _, err := conn.Write(req[:]); err != nil {
+		return 0, 0, err
+	}
+
+	var resp [48]byte
+	for {
+		n, err := conn.Read(resp[:])
+		if err != nil {
+			return 0, 0, err
+		}
+		// ignore stray answers to earlier queries
+		if n == len(resp) && binary.BigEndian.Uint64(resp[24:]) == binary.BigEndian.Uint64(req[40:]) {
+			break
+		}
+	}
+	t4 := time.Now()
+
+	if mode := resp[0] & 0x07; mode != 4 {
+		return 0, 0, fmt.Errorf("ntp: %s: unexpected mode %d", server, mode)
+	}
+	if stratum := resp[1]; stratum == 0 {
+		return 0, 0, fmt.Errorf("ntp: %s: kiss of death %q", server, resp[12:16])
+	}
+	if resp[0]>>6 == 3 {
+		return 0, 0, fmt.Errorf("ntp: %s: server not synchronized", server)
+	}
+	t2 := getTime(resp[32:])
+	t3 := getTime(resp[40:])
+	offset = (t2.Sub(t1) + t3.Sub(t4)) / 2
+	rtt = t4.Sub(t1) - t3.Sub(t2)
+	return offset, rtt, nil
+}
+
+func putTime(b []byte, t time.Time) {
+	ns := t.UnixNano()
+	sec := uint64(ns/1e9) + ntpEpoch
+	frac := uint64(ns%1e9) << 32 / 1e9
+	binary.BigEndian.PutUint64(b, sec<<32|frac)
+}
+
+func getTime(b []byte) time.Time {
+	v := binary.BigEndian.Uint64(b)
+	sec := int64(v>>32) - ntpEpoch
+	nsec := int64((v & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(sec, nsec)
+}
+
+// Config is the "ntp_conf" section of the gateway config.
+type Config struct {
+	// Server is the NTP server, "pool.ntp.org" if not set.
+	Server string `json:"server"`
+	// Interval between checks in seconds, 600 if not set.
+	Interval int `json:"interval"`
+	// MaxSkew is the offset in milliseconds above which a warning is logged, 100 if not set.
+	MaxSkew int `json:"max_skew"`
+	// Correct adds the measured offset to the timestamps of the forwarder.
+	Correct bool `json:"correct"`
+}
+
+// Monitor checks the system clock against an NTP server from time to time.
+type Monitor struct {
+	Logger *log.Logger
+
+	server   string
+	interval time.Duration
+	maxSkew  time.Duration
+	correct  bool
+
+	offset int64 // last measured offset in ns, accessed atomically
+}
+
+// NewMonitor returns a monitor for the config. Call Check for a first measurement and Run for more.
+func NewMonitor(cfg *Config) *Monitor {
+	m := &Monitor{
+		Logger:   log.New(os.Stdout, "[NTP  ] ", 0),
+		server:   cfg.Server,
+		interval: time.Duration(cfg.Interval) * time.Second,
+		maxSkew:  time.Duration(cfg.MaxSkew) * time.Millisecond,
+		correct:  cfg.Correct,
+	}
+	if m.server == "" {
+		m.server = "pool.ntp.org"
+	}
+	if m.interval <= 0 {
+		m.interval = 10 * time.Minute
+	}
+	if m.maxSkew <= 0 {
+		m.maxSkew = 100 * time.Millisecond
+	}
+	return m
+}
+
+// ErrSkew is returned by Check if the clock is off by more than the max skew.
+var ErrSkew = errors.New("system clock skew")
+
+// Check measures the offset of the system clock.
+// If the offset is larger than the max skew, it returns an error wrapping ErrSkew.
+func (m *Monitor) Check() error {
+	offset, rtt, err := Query(m.server, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&m.offset, int64(offset))
+	if offset > m.maxSkew || offset < -m.maxSkew {
+		return fmt.Errorf("%w: %s off from %s (rtt %s)", ErrSkew, offset, m.server, rtt)
+	}
+	return nil
+}
+
+// Run checks the clock every interval and logs failures and skews. It does not return.
+func (m *Monitor) Run() {
+	for range time.Tick(m.interval) {
+		if err := m.Check(); err != nil {
+			m.Logger.Printf("%v", err)
+		}
+	}
+}
+
+// Offset returns the last measured offset of the system clock.
+func (m *Monitor) Offset() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.offset))
+}
+
+// Time returns the system time t with the offset added if correcting is enabled.
+// The result has no monotonic clock reading, so it is for timestamps, not for measuring time.
+func (m *Monitor) Time(t time.Time) time.Time {
+	if m.correct {
+		t = t.Add(m.Offset())
+	}
+	return t.Round(0)
+}
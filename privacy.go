@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+	"github.com/Waziup/single_chan_pkt_fwd/store"
+)
+
+// PrivacyConfig is the "privacy_conf" section of the gateway config. It keeps the DevAddrs and
+// DevEUIs out of the logs, the API, the packet store and the traces, for data minimization.
+// The frames are forwarded to the servers and the webhook intact.
+type PrivacyConfig struct {
+	// Mode is "strip" to leave the device identifiers out, or "hash" to replace them with a keyed
+	// hash of the same length, so that the frames of a device can still be told apart.
+	Mode string `json:"mode"`
+	// Key of the hash. If not set, a random key is drawn on each start,
+	// so the hashes do not match across restarts.
+	Key string `json:"key"`
+}
+
+type privacyFilter struct {
+	key []byte // nil to strip the identifiers
+}
+
+func newPrivacyFilter(cfg *PrivacyConfig) (*privacyFilter, error) {
+	switch cfg.Mode {
+	case "strip":
+		return &privacyFilter{}, nil
+	case "hash":
+		p := &privacyFilter{key: []byte(cfg.Key)}
+		if cfg.Key == "" {
+			p.key = make([]byte, 32)
+			if _, err := rand.Read(p.key); err != nil {
+				return nil, err
+			}
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown mode %q, not strip or hash", cfg.Mode)
+}
+
+// sum returns the keyed hash of a device identifier.
+func (p *privacyFilter) sum(id string) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)
+}
+
+// id returns a device identifier in hex, as a DevAddr or a DevEUI, as it may be shown:
+// as it is without privacy mode (p is nil), its hash in hex of the same length, or "" if it is
+// stripped.
+func (p *privacyFilter) id(id string) string {
+	if p == nil {
+		return id
+	}
+	if p.key == nil {
+		return ""
+	}
+	n := len(id) / 2
+	if n > sha256.Size {
+		n = sha256.Size
+	}
+	return fmt.Sprintf("%X", p.sum(id)[:n])
+}
+
+// devAddr returns a DevAddr as it may be shown, like id, or false if it is stripped.
+func (p *privacyFilter) devAddr(addr lorawan.DevAddr) (lorawan.DevAddr, bool) {
+	if p == nil {
+		return addr, true
+	}
+	if p.key == nil {
+		return 0, false
+	}
+	return lorawan.DevAddr(binary.BigEndian.Uint32(p.sum(addr.String()))), true
+}
+
+// record hides the DevAddr of a packet store record.
+func (p *privacyFilter) record(r *store.Record) {
+	if r.DevAddr == nil {
+		return
+	}
+	if addr, ok := p.devAddr(*r.DevAddr); ok {
+		r.DevAddr = &addr
+	} else {
+		r.DevAddr = nil
+	}
+}
+
+// err returns the errors of the MIC verification without the DevAddr they name.
+func (p *privacyFilter) err(err error) error {
+	if p == nil {
+		return err
+	}
+	for _, e := range []error{lorawan.ErrUnknownDevice, lorawan.ErrInvalidMIC} {
+		if errors.Is(err, e) {
+			return e
+		}
+	}
+	return err
+}
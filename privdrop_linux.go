@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// dropPrivileges switches to the user, as "lora" or "lora:gpio", once the radios and sockets are open.
+// Without group, the group of the user is taken. The supplementary groups of the user, as "spi"
+// and "gpio", are kept. As the user is not root, all capabilities are dropped.
+func dropPrivileges(runAs string) error {
+	name, group := runAs, ""
+	if i := strings.IndexByte(runAs, ':'); i >= 0 {
+		name, group = runAs[:i], runAs[i+1:]
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gidStr := u.Gid
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return err
+	}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return err
+	}
+	gids := []int{gid}
+	for _, s := range groupIDs {
+		if id, err := strconv.Atoi(s); err == nil && id != gid {
+			gids = append(gids, id)
+		}
+	}
+	if uid == 0 {
+		return errors.New("run_as is root")
+	}
+	if err := syscall.Setgroups(gids); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return err
+	}
+	if syscall.Setuid(0) == nil {
+		return errors.New("can still become root")
+	}
+	return nil
+}
+
+// closeInheritedFiles closes the files, as devices and regular files, that the forwarder inherited
+// from its parent, so they can not be used after the privileges are dropped.
+// Sockets, pipes and other descriptors are kept, as the Go runtime might use them.
+func closeInheritedFiles() {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return
+	}
+	for _, fi := range fds {
+		fd, err := strconv.Atoi(fi.Name())
+		if err != nil || fd <= 2 {
+			continue
+		}
+		target, err := os.Readlink("/proc/self/fd/" + fi.Name())
+		if err != nil || !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "/proc/") {
+			// not a file, or the directory being read
+			continue
+		}
+		log(LogLevelVerbose, "closing inherited file %d: %s", fd, target)
+		syscall.Close(fd)
+	}
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+// dropPrivileges returns an error, as switching the user is only supported on Linux.
+func dropPrivileges(runAs string) error {
+	return errors.New("run_as is only supported on Linux")
+}
+
+// closeInheritedFiles does nothing, as the files of a process are only listed on Linux.
+func closeInheritedFiles() {}
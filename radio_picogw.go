@@ -0,0 +1,26 @@
+// +build !nohw
+
+package main
+
+import (
+	logger "log"
+	"os"
+
+	"github.com/Waziup/single_chan_pkt_fwd/PicoGW"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// The picogw backend drives a USB concentrator stick of the picocell gateway design.
+func init() {
+	lora.RegisterBackend("picogw", openPicoGW)
+}
+
+func openPicoGW(cfg *lora.Config) (lora.Radio, error) {
+	c, err := PicoGW.Discover(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.Logger = logger.New(os.Stdout, "", 0)
+	c.LogLevel = currentLogLevel()
+	return c, nil
+}
@@ -0,0 +1,26 @@
+// +build !nohw
+
+package main
+
+import (
+	logger "log"
+	"os"
+
+	"github.com/Waziup/single_chan_pkt_fwd/RN2483"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// The RN2483 backend drives a Microchip RN2483 or RN2903 module over its UART.
+func init() {
+	lora.RegisterBackend("rn2483", openRN2483)
+}
+
+func openRN2483(cfg *lora.Config) (lora.Radio, error) {
+	modem, err := RN2483.Discover(cfg)
+	if err != nil {
+		return nil, err
+	}
+	modem.Logger = logger.New(os.Stdout, "", 0)
+	modem.LogLevel = currentLogLevel()
+	return modem, nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/mock"
+)
+
+// The simulation backend is a radio without hardware, which is always available.
+// It receives nothing and logs the sent downlinks.
+func init() {
+	lora.RegisterBackend("simulation", openSimulation)
+}
+
+func openSimulation(cfg *lora.Config) (lora.Radio, error) {
+	radio := mock.NewRadio()
+	go func() {
+		for pkt := range radio.Sent {
+			log(LogLevelVerbose, "simulation: sent %s", pkt)
+		}
+	}()
+	return radio, nil
+}
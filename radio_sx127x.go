@@ -0,0 +1,30 @@
+// +build !nohw
+
+package main
+
+import (
+	logger "log"
+	"os"
+
+	"github.com/Waziup/single_chan_pkt_fwd/SX127X"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// The SX127X backend drives the radio over SPI with periph.io, which is pure Go.
+// Build with the "nohw" tag to leave it out.
+func init() {
+	lora.RegisterBackend("sx127x", openSX127X)
+}
+
+func openSX127X(cfg *lora.Config) (lora.Radio, error) {
+	if err := initHost(); err != nil {
+		return nil, err
+	}
+	chip, err := SX127X.Discover(cfg)
+	if err != nil {
+		return nil, err
+	}
+	chip.Logger = logger.New(os.Stdout, "", 0)
+	chip.LogLevel = currentLogLevel()
+	return chip, nil
+}
@@ -0,0 +1,29 @@
+// +build !nohw
+
+package main
+
+import (
+	logger "log"
+	"os"
+
+	"github.com/Waziup/single_chan_pkt_fwd/SX1280"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// The SX1280 backend drives a 2.4 GHz radio over SPI with periph.io, as the SX127X backend.
+func init() {
+	lora.RegisterBackend("sx1280", openSX1280)
+}
+
+func openSX1280(cfg *lora.Config) (lora.Radio, error) {
+	if err := initHost(); err != nil {
+		return nil, err
+	}
+	chip, err := SX1280.Discover(cfg)
+	if err != nil {
+		return nil, err
+	}
+	chip.Logger = logger.New(os.Stdout, "", 0)
+	chip.LogLevel = currentLogLevel()
+	return chip, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	logger "log"
+	"os"
+
+	"github.com/Waziup/single_chan_pkt_fwd/remoteconf"
+)
+
+// exitConfigChanged is the exit status when the remote config changed, for the service manager
+// to restart the forwarder with it. The forwarder has no path to reload its config while running,
+// as the radios, the sockets and the privileges are set up once at startup, so it restarts instead.
+// A restart in place would not work either once run_as dropped the privileges to open the radios.
+const exitConfigChanged = 3
+
+// loadRemoteConfig returns the local config with the sections of the remote config, if
+// "remote_conf" is set in local. The top-level sections of the remote config replace those of
+// the local config, except for "remote_conf" and "version", so the local config can keep what only applies
+// to the board, as the radios. It also returns the remote config, for watchRemoteConfig.
+func (gw *Gateway) loadRemoteConfig(local []byte) (data, remote []byte, err error) {
+	var cfg struct {
+		RemoteConf *remoteconf.Config `json:"remote_conf"`
+	}
+	if err := json.Unmarshal(local, &cfg); err != nil || cfg.RemoteConf == nil {
+		return local, nil, err
+	}
+	if gw.remoteConfig, err = remoteconf.New(cfg.RemoteConf); err != nil {
+		return nil, nil, err
+	}
+	gw.remoteConfig.Logger = logger.New(os.Stdout, "", 0)
+	if remote, err = gw.remoteConfig.Load(); err != nil {
+		return nil, nil, err
+	}
+
+	var sections, remoteSections map[string]json.RawMessage
+	if err := json.Unmarshal(local, &sections); err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(remote, &remoteSections); err != nil {
+		return nil, nil, err
+	}
+	for name, section := range remoteSections {
+		if name != "remote_conf" && name != "version" {
+			sections[name] = section
+			log(LogLevelVerbose, "using %s of the remote config", name)
+		}
+	}
+	data, err = json.Marshal(sections)
+	return data, remote, err
+}
+
+// watchRemoteConfig fetches the remote config at its interval and exits with exitConfigChanged
+// once it differs from remote, the config the forwarder started with.
+func (gw *Gateway) watchRemoteConfig(remote []byte) {
+	gw.remoteConfig.Watch(remote, func(data []byte) {
+		log(LogLevelWarning, "remote config changed, exiting to restart with it")
+		gw.auditEvent("remote_config_changed", fmt.Sprintf("%d bytes", len(data)))
+		os.Exit(exitConfigChanged)
+	})
+}
@@ -0,0 +1,229 @@
+// Package remoteconf fetches the gateway config from a management URL, so a fleet of gateways
+// is configured in one place. The config must be signed with the Ed25519 key of the fleet:
+// a config that is not signed by it is never applied. Each config has a "version", which must
+// not go backwards, so an older signed config can not be replayed.
+package remoteconf
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/proxy"
+)
+
+// SignatureHeader holds the base64 Ed25519 signature of the response body.
+const SignatureHeader = "X-Signature"
+
+// ErrSignature is returned for a config that is not signed by the public key.
+var ErrSignature = errors.New("remoteconf: invalid signature")
+
+// ErrStale is returned for a config with a lower version than the current one, or a
+// different config with the same version, as if an older config was replayed.
+var ErrStale = errors.New("remoteconf: config is older than the current one")
+
+// Config is the "remote_conf" section of the local gateway config.
+type Config struct {
+	// URL the config is fetched from, as "https://fleet.example.com/gateways/AA555A0000000000.json".
+	URL string `json:"url"`
+	// PublicKey is the hex or base64 Ed25519 public key the config is signed with.
+	PublicKey string `json:"public_key"`
+	// Interval in seconds between fetches, 3600 if not set.
+	Interval int `json:"interval"`
+	// CacheFile keeps the last config fetched, with its signature in CacheFile+".sig",
+	// for starting offline. "remote_conf.json" if not set.
+	CacheFile string `json:"cache_file"`
+	// Timeout for each request in seconds, 30 if not set.
+	Timeout int `json:"timeout"`
+	// Proxy is the HTTP or SOCKS5 proxy URL, see proxy.Transport.
+	Proxy string `json:"proxy"`
+}
+
+// Client fetches and verifies the config.
+type Client struct {
+	Logger *log.Logger
+
+	url      string
+	key      ed25519.PublicKey
+	interval time.Duration
+	cache    string
+	client   *http.Client
+
+	// version and data are of the newest config fetched or cached, data is nil before
+	version int64
+	data    []byte
+}
+
+// New returns a client for the config.
+func New(cfg *Config) (*Client, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("remoteconf: no url")
+	}
+	key, err := decode(cfg.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("remoteconf: public_key is not an Ed25519 key")
+	}
+	transport, err := proxy.Transport(cfg.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("remoteconf: %v", err)
+	}
+	c := &Client{
+		Logger:   log.New(os.Stdout, "[RCONF] ", 0),
+		url:      cfg.URL,
+		key:      key,
+		interval: time.Hour,
+		cache:    "remote_conf.json",
+		client:   &http.Client{Timeout: 30 * time.Second, Transport: transport},
+	}
+	if cfg.Interval > 0 {
+		c.interval = time.Duration(cfg.Interval) * time.Second
+	}
+	if cfg.CacheFile != "" {
+		c.cache = cfg.CacheFile
+	}
+	if cfg.Timeout > 0 {
+		c.client.Timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	return c, nil
+}
+
+// Fetch fetches the config and verifies its signature. A valid config is written to the cache.
+func (c *Client) Fetch() ([]byte, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remoteconf: %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(resp.Header.Get(SignatureHeader))
+	if err != nil || !ed25519.Verify(c.key, data, sig) {
+		return nil, ErrSignature
+	}
+	version, err := Version(data)
+	if err != nil {
+		return nil, err
+	}
+	if c.data != nil && (version < c.version || version == c.version && !bytes.Equal(data, c.data)) {
+		return nil, fmt.Errorf("%w: version %d, current %d", ErrStale, version, c.version)
+	}
+	c.version, c.data = version, data
+	if err := c.writeCache(data, sig); err != nil {
+		c.Logger.Printf("can not write %s: %v", c.cache, err)
+	}
+	return data, nil
+}
+
+// Load fetches the config, or reads the cached copy if it can not be fetched.
+// The cached copy is the oldest config the fetched one may be.
+func (c *Client) Load() ([]byte, error) {
+	cached, cacheErr := c.readCache()
+	if cacheErr == nil {
+		c.version, _ = Version(cached)
+		c.data = cached
+	}
+	data, err := c.Fetch()
+	if err == nil {
+		return data, nil
+	}
+	c.Logger.Printf("can not fetch %s: %v, using the cached config", c.url, err)
+	if cacheErr != nil {
+		return nil, fmt.Errorf("%v, and no cached config: %v", err, cacheErr)
+	}
+	return cached, nil
+}
+
+// Watch fetches the config at the interval and calls changed with each config that
+// differs from current. Configs that can not be fetched are logged and skipped.
+func (c *Client) Watch(current []byte, changed func(data []byte)) {
+	for range time.Tick(c.interval) {
+		data, err := c.Fetch()
+		if err != nil {
+			c.Logger.Printf("can not fetch %s: %v", c.url, err)
+			continue
+		}
+		if !bytes.Equal(data, current) {
+			current = data
+			changed(data)
+		}
+	}
+}
+
+func (c *Client) writeCache(data, sig []byte) error {
+	if err := writeFile(c.cache+".sig", []byte(base64.StdEncoding.EncodeToString(sig)+"\n")); err != nil {
+		return err
+	}
+	return writeFile(c.cache, data)
+}
+
+// readCache reads the cached config and verifies it again, as the file might have been changed.
+func (c *Client) readCache() ([]byte, error) {
+	data, err := ioutil.ReadFile(c.cache)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ioutil.ReadFile(c.cache + ".sig")
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(s)))
+	if err != nil || !ed25519.Verify(c.key, data, sig) {
+		return nil, ErrSignature
+	}
+	if _, err := Version(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Version returns the "version" of a config, which must be an integer.
+func Version(data []byte) (int64, error) {
+	var cfg struct {
+		Version *int64 `json:"version"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return 0, fmt.Errorf("remoteconf: config is not JSON: %v", err)
+	}
+	if cfg.Version == nil {
+		return 0, errors.New("remoteconf: config has no version")
+	}
+	return *cfg.Version, nil
+}
+
+// writeFile replaces the file with a temporary file, so a crash does not leave half of it.
+func writeFile(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// decode decodes a hex or base64 key.
+func decode(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if b, err := hex.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// Sign returns the base64 signature of a config, for the SignatureHeader.
+func Sign(data []byte, key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+}
@@ -0,0 +1,68 @@
+package remoteconf
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchVersion(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(SignatureHeader, Sign([]byte(body), priv))
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "remoteconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := New(&Config{URL: srv.URL, PublicKey: hex.EncodeToString(pub), CacheFile: filepath.Join(dir, "remote_conf.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Logger = log.New(ioutil.Discard, "", 0)
+
+	v1, v2 := `{"version":1,"gateway_conf":{"a":1}}`, `{"version":2,"gateway_conf":{"a":2}}`
+	body = v2
+	if data, err := c.Load(); err != nil || string(data) != v2 {
+		t.Fatalf("Load = %s, %v, want %s", data, err, v2)
+	}
+	body = v1
+	if _, err := c.Fetch(); !errors.Is(err, ErrStale) {
+		t.Errorf("older config: %v, want %v", err, ErrStale)
+	}
+	body = `{"version":2,"gateway_conf":{"a":3}}`
+	if _, err := c.Fetch(); !errors.Is(err, ErrStale) {
+		t.Errorf("other config of the same version: %v, want %v", err, ErrStale)
+	}
+	body = v2
+	if _, err := c.Fetch(); err != nil {
+		t.Errorf("same config: %v", err)
+	}
+	body = `{"gateway_conf":{"a":4}}`
+	if _, err := c.Fetch(); err == nil {
+		t.Error("config without version: no error")
+	}
+
+	// a new client, as after a restart, starts from the cached config
+	c, _ = New(&Config{URL: srv.URL, PublicKey: hex.EncodeToString(pub), CacheFile: filepath.Join(dir, "remote_conf.json")})
+	c.Logger = log.New(ioutil.Discard, "", 0)
+	body = v1
+	if data, err := c.Load(); err != nil || string(data) != v2 {
+		t.Errorf("Load after restart = %s, %v, want the cached %s", data, err, v2)
+	}
+}
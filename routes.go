@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+)
+
+// serverRoutes are the DevAddr ranges of the uplinks a server gets, see "serv_routes".
+type serverRoutes struct {
+	prefixes []lorawan.DevAddrPrefix
+	names    []string // as in the config
+	deflt    bool     // the server gets the uplinks that no route of any server matches
+
+	mu      sync.Mutex
+	uplinks []int64 // by route, the default route last
+}
+
+// parseRoutes parses the routes of a server: "default", NetIDs as in "netid:000013",
+// or DevAddr prefixes as in "26000000/7".
+func (gw *Gateway) parseRoutes(routes []string) (*serverRoutes, error) {
+	r := &serverRoutes{}
+	for _, route := range routes {
+		switch {
+		case route == "default":
+			r.deflt = true
+			continue
+		case strings.HasPrefix(route, "netid:"):
+			p, err := lorawan.NetIDPrefix(strings.TrimPrefix(route, "netid:"))
+			if err != nil {
+				return nil, err
+			}
+			r.prefixes = append(r.prefixes, p)
+		default:
+			p, err := lorawan.ParseDevAddrPrefix(route)
+			if err != nil {
+				return nil, err
+			}
+			r.prefixes = append(r.prefixes, p)
+		}
+		r.names = append(r.names, route)
+	}
+	if r.deflt {
+		r.names = append(r.names, "default")
+	}
+	r.uplinks = make([]int64, len(r.names))
+	gw.allRoutes = append(gw.allRoutes, r.prefixes...)
+	return r, nil
+}
+
+// route returns the index of the route of the server an uplink takes, or false if the server
+// does not get it. Uplinks that a route of any server, in all, matches do not take the default
+// route. Frames without DevAddr, as join requests, take the default route.
+func (r *serverRoutes) route(data []byte, all []lorawan.DevAddrPrefix) (int, bool) {
+	f, err := lorawan.Decode(data)
+	if err == nil && f.IsData() {
+		for i, p := range r.prefixes {
+			if p.Contains(f.DevAddr) {
+				return i, true
+			}
+		}
+		for _, p := range all {
+			if p.Contains(f.DevAddr) {
+				return 0, false
+			}
+		}
+	}
+	return len(r.prefixes), r.deflt
+}
+
+// packetFor returns the packet with the uplinks that the server gets, which is pkt if the server
+// has no routes or gets all uplinks, or nil if it gets none. Other packets go to all servers.
+// The routes of all servers are in all.
+func (s *upstreamServer) packetFor(pkt *fwd.Packet, all []lorawan.DevAddrPrefix) *fwd.Packet {
+	r := s.routes
+	if r == nil || pkt.Ident != fwd.PushData || len(pkt.RxPackets) == 0 {
+		return pkt
+	}
+	var rxs []*lora.RxPacket
+	r.mu.Lock()
+	for _, rx := range pkt.RxPackets {
+		if i, ok := r.route(rx.Data, all); ok {
+			r.uplinks[i]++
+			rxs = append(rxs, rx)
+		}
+	}
+	r.mu.Unlock()
+	switch len(rxs) {
+	case 0:
+		return nil
+	case len(pkt.RxPackets):
+		return pkt
+	}
+	routed := *pkt
+	routed.RxPackets = rxs
+	return &routed
+}
+
+// routeStat is the number of uplinks that took a route of a server since the forwarder started.
+type routeStat struct {
+	Route   string `json:"route"`
+	Uplinks int64  `json:"uplinks"`
+}
+
+// stats returns the uplinks by route, or nil if the server has no routes.
+func (r *serverRoutes) stats() []routeStat {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := make([]routeStat, len(r.names))
+	for i, name := range r.names {
+		stats[i] = routeStat{Route: name, Uplinks: r.uplinks[i]}
+	}
+	return stats
+}
+
+func (r *serverRoutes) String() string {
+	return fmt.Sprint(r.names)
+}
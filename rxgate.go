@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// RxScheduleConfig is the "rx_schedule_conf" section of the gateway config. For gateways on
+// solar or battery power, the radios listen for a while and sleep for a while, in periods
+// aligned to the clock so that the listen windows match the uplink periods of the devices.
+type RxScheduleConfig struct {
+	// Listen is the time in seconds the radios receive in each period.
+	Listen int `json:"listen"`
+	// Sleep is the time in seconds the radios sleep after listening.
+	Sleep int `json:"sleep"`
+	// Offset in seconds of the listen windows from the start of the periods, which start at
+	// multiples of the period since 1970-01-01 UTC. With listen 10 and sleep 50, the radios
+	// listen from second 0 to 10 of each minute, or from second 5 to 15 with offset 5.
+	Offset int `json:"offset"`
+	// Offline puts the radios to sleep while no server answered within the last three keepalive
+	// intervals and no local backend takes the uplinks. Listen and sleep may be 0 with it.
+	Offline bool `json:"offline"`
+}
+
+func (cfg *RxScheduleConfig) validate() error {
+	if cfg.Offline && cfg.Listen == 0 && cfg.Sleep == 0 {
+		return nil
+	}
+	if cfg.Listen <= 0 {
+		return errors.New("listen must be above 0")
+	}
+	if cfg.Sleep <= 0 {
+		return errors.New("sleep must be above 0")
+	}
+	return nil
+}
+
+// rxGateStatus is the "rx_gate" section of the API.
+type rxGateStatus struct {
+	Listening bool      `json:"listening"`
+	Since     time.Time `json:"since"`
+	// ListenTime and SleepTime are the seconds the radios listened and slept since the start.
+	ListenTime  float64 `json:"listen_time"`
+	SleepTime   float64 `json:"sleep_time"`
+	Transitions int     `json:"transitions"`
+}
+
+// rxSchedule is the listen and sleep schedule of the radios. It is used by the main loop only.
+type rxSchedule struct {
+	gw                     *Gateway
+	listen, period, offset time.Duration // no listen windows if period is 0
+	offline                bool
+
+	asleep      bool
+	since       time.Time     // when the radios started to listen or sleep
+	listenTime  time.Duration // listened before since
+	sleepTime   time.Duration // slept before since
+	transitions int
+}
+
+func newRxSchedule(gw *Gateway, cfg *RxScheduleConfig, now time.Time) *rxSchedule {
+	return &rxSchedule{
+		gw:      gw,
+		listen:  time.Duration(cfg.Listen) * time.Second,
+		period:  time.Duration(cfg.Listen+cfg.Sleep) * time.Second,
+		offset:  time.Duration(cfg.Offset) * time.Second,
+		offline: cfg.Offline,
+		since:   now,
+	}
+}
+
+// listening tells if now is in a listen window.
+func (s *rxSchedule) listening(now time.Time) bool {
+	if s.period == 0 {
+		return true
+	}
+	phase := now.Sub(time.Unix(0, 0).Add(s.offset)) % s.period
+	if phase < 0 {
+		phase += s.period
+	}
+	return phase < s.listen
+}
+
+// update puts the radios to sleep at the end of a listen window, or when the backends are
+// offline, and wakes them up at the start of the next window, or when a backend is back.
+// While downlinks are queued, the radios stay awake to send them. Radios that can not sleep
+// keep receiving.
+func (s *rxSchedule) update(ctx context.Context, radios []*gatewayRadio, now time.Time) {
+	offline := s.offline && !s.gw.backendConnected()
+	sleep := (!s.listening(now) || offline) && s.gw.sched.Queue.Len() == 0
+	if sleep == s.asleep {
+		return
+	}
+	for _, radio := range radios {
+		r, ok := radio.Radio.(lora.PowerManager)
+		if !ok {
+			continue
+		}
+		if !sleep {
+			if !radio.asleep {
+				continue
+			}
+			radio.asleep = false
+			radio.receiving = false
+			// the watchdog does not count the time asleep as silence
+			if !radio.lastRx.IsZero() {
+				radio.lastRx = radio.lastRx.Add(now.Sub(s.since))
+			}
+			continue
+		}
+		if err := r.SetPowerMode(ctx, lora.PowerSleep); err != nil {
+			log(LogLevelError, "radio %d: can not sleep: %v", radio.index, err)
+			continue
+		}
+		radio.asleep = true
+		radio.receiving = false
+	}
+
+	if s.asleep {
+		s.sleepTime += now.Sub(s.since)
+		log(LogLevelVerbose, "rx gate: listening after %s asleep", now.Sub(s.since).Truncate(time.Second))
+	} else {
+		s.listenTime += now.Sub(s.since)
+		if offline {
+			log(LogLevelNormal, "rx gate: sleeping while no backend is connected")
+		} else {
+			log(LogLevelVerbose, "rx gate: sleeping after %s listening", now.Sub(s.since).Truncate(time.Second))
+		}
+	}
+	s.asleep = sleep
+	s.since = now
+	s.transitions++
+
+	if s.gw.exporter != nil {
+		s.gw.exporter.AddRxGate(!s.asleep, s.listenTime, s.sleepTime, s.transitions)
+	}
+	if s.gw.apiServer != nil {
+		s.gw.apiServer.Publish("rx_gate", s.status())
+	}
+}
+
+// backendConnected tells if the uplinks are taken: a server answered within the last three
+// keepalive intervals, or a local backend, as the standalone app or the uplink spool, takes them.
+func (gw *Gateway) backendConnected() bool {
+	return gw.serverReachable() || gw.app != nil || gw.hook != nil || gw.pktStore != nil || gw.uplinkSpool != nil || gw.coverageMap != nil
+}
+
+func (s *rxSchedule) status() *rxGateStatus {
+	return &rxGateStatus{
+		Listening:   !s.asleep,
+		Since:       s.since.UTC(),
+		ListenTime:  s.listenTime.Seconds(),
+		SleepTime:   s.sleepTime.Seconds(),
+		Transitions: s.transitions,
+	}
+}
+
+// powerReport returns the estimated power consumption of the radios that estimate it, or nil.
+func powerReport(radios []*gatewayRadio) []*fwd.PowerStat {
+	var stats []*fwd.PowerStat
+	for _, radio := range radios {
+		if r, ok := radio.Radio.(lora.PowerManager); ok {
+			stats = append(stats, &fwd.PowerStat{Radio: radio.index, PowerUsage: r.PowerUsage()})
+		}
+	}
+	return stats
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+)
+
+// rxWindowUplinks is the number of recent uplinks that downlinks are correlated with.
+const rxWindowUplinks = 64
+
+// rxWindowTolerance is how far the tmst of a downlink may be from a whole number of seconds
+// after the uplink it answers. Servers add exactly the receive delay.
+const rxWindowTolerance = time.Millisecond
+
+// rxWindowUplink is an uplink that a downlink may answer.
+type rxWindowUplink struct {
+	tmst   uint32
+	device string
+}
+
+// rxWindowStats tells which receive windows the downlinks of a device were sent in, and how
+// much time was left until they were due when they arrived from the server.
+type rxWindowStats struct {
+	RX1   int `json:"rx1"`
+	RX2   int `json:"rx2"`
+	Other int `json:"other"` // downlinks with another receive delay than RX1 or RX2
+	// Last is the window of the last downlink, as in "RX1", or its delay, as in "3s".
+	Last         string  `json:"last"`
+	MinMarginMs  float64 `json:"min_margin_ms"`
+	AvgMarginMs  float64 `json:"avg_margin_ms"`
+	LastMarginMs float64 `json:"last_margin_ms"`
+}
+
+// recordRxWindowUplink keeps the tmst of an uplink, for the downlinks that answer it.
+func (gw *Gateway) recordRxWindowUplink(pkt *lora.RxPacket) {
+	f, err := lorawan.Decode(pkt.Data)
+	if err != nil || !f.IsUplink() {
+		return
+	}
+	device := f.DevAddr.String()
+	if f.MType() == lorawan.JoinRequest {
+		if len(f.MACPayload) < 16 {
+			return
+		}
+		var eui lorawan.EUI64
+		binary.BigEndian.PutUint64(eui[:], binary.LittleEndian.Uint64(f.MACPayload[8:16]))
+		device = eui.String()
+	}
+	gw.rxWindows.uplinks[gw.rxWindows.next] = rxWindowUplink{tmst: pkt.CountUs, device: device}
+	gw.rxWindows.next = (gw.rxWindows.next + 1) % rxWindowUplinks
+}
+
+// correlateRxWindow finds the uplink that a downlink due at "at" answers and accounts its window.
+// It returns the device of the uplink and the window, as in rxWindowStats.Last, or false if it
+// answers none.
+func (gw *Gateway) correlateRxWindow(pkt *lora.TxPacket, at time.Time) (device, window string, ok bool) {
+	if pkt.Immediate {
+		return "", "", false
+	}
+	// the latest uplink is the one the downlink answers if there are several
+	var up *rxWindowUplink
+	var delay time.Duration
+	for i := 1; i <= rxWindowUplinks; i++ {
+		u := &gw.rxWindows.uplinks[(gw.rxWindows.next-i+rxWindowUplinks)%rxWindowUplinks]
+		if u.device == "" {
+			break
+		}
+		d := time.Duration(pkt.CountUs-u.tmst) * time.Microsecond
+		s := d.Round(time.Second)
+		if s >= time.Second && s <= 16*time.Second && d-s <= rxWindowTolerance && s-d <= rxWindowTolerance {
+			up, delay = u, s
+			break
+		}
+	}
+	if gw.apiServer != nil {
+		defer func() { gw.apiServer.Publish("rx_windows", gw.rxWindowsSnapshot()) }()
+	}
+	if up == nil {
+		gw.rxWindows.unmatched++
+		log(LogLevelVerbose, "rx window: downlink of tmst %d answers none of the last uplinks", pkt.CountUs)
+		return "", "", false
+	}
+
+	rx1 := time.Second
+	if isJoinAccept(pkt) {
+		rx1 = 5 * time.Second
+	}
+	key := up.device
+	s := gw.rxWindows.devices[key]
+	if s == nil {
+		if len(gw.rxWindows.devices) >= maxAirtimeDevices {
+			key = otherDevices
+			s = gw.rxWindows.devices[key]
+		}
+		if s == nil {
+			s = new(rxWindowStats)
+			gw.rxWindows.devices[key] = s
+		}
+	}
+	switch delay {
+	case rx1:
+		s.RX1++
+		s.Last = "RX1"
+	case rx1 + time.Second:
+		s.RX2++
+		s.Last = "RX2"
+	default:
+		s.Other++
+		s.Last = delay.String()
+	}
+	margin := float64(at.Sub(gw.clock.Now())) / float64(time.Millisecond)
+	n := float64(s.RX1 + s.RX2 + s.Other)
+	if n == 1 || margin < s.MinMarginMs {
+		s.MinMarginMs = margin
+	}
+	s.AvgMarginMs += (margin - s.AvgMarginMs) / n
+	s.LastMarginMs = margin
+	log(LogLevelVerbose, "rx window: downlink for %s in %s, %.1f ms before it is due", gw.privacy.id(up.device), s.Last, margin)
+	return up.device, s.Last, true
+}
+
+// rxWindowsStatus is the "rx_windows" section of the API.
+type rxWindowsStatus struct {
+	Devices map[string]rxWindowStats `json:"devices"`
+	// Unmatched counts the Class A downlinks that answer none of the recent uplinks.
+	Unmatched int `json:"unmatched"`
+}
+
+// rxWindowsSnapshot returns a copy of the receive window accounts.
+func (gw *Gateway) rxWindowsSnapshot() *rxWindowsStatus {
+	s := &rxWindowsStatus{
+		Devices:   make(map[string]rxWindowStats, len(gw.rxWindows.devices)),
+		Unmatched: gw.rxWindows.unmatched,
+	}
+	for k, d := range gw.rxWindows.devices {
+		if k != otherDevices {
+			if k = gw.privacy.id(k); k == "" {
+				continue
+			}
+		}
+		s.Devices[k] = *d
+	}
+	return s
+}
@@ -0,0 +1,182 @@
+// Package secrets keeps passwords and keys out of the plain config file.
+//
+// A string value of the config can reference an environment variable as "${NAME}"
+// or a secret of an encrypted secrets file as "${secret:NAME}". The secrets file holds
+// a JSON object of names and values, sealed with AES-256-GCM by a key file, see Seal.
+package secrets
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Config is the "secrets_conf" section of the gateway config.
+type Config struct {
+	// File is the encrypted secrets file.
+	File string `json:"file"`
+	// KeyFile holds the key of the secrets file, 32 bytes, raw or hex encoded.
+	KeyFile string `json:"key_file"`
+}
+
+// Store holds the decrypted secrets.
+type Store struct {
+	secrets map[string]string
+}
+
+// Open decrypts the secrets file of the config.
+func Open(cfg *Config) (*Store, error) {
+	key, err := ReadKey(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{}
+	if s.secrets, err = Unseal(data, key); err != nil {
+		return nil, fmt.Errorf("secrets: %s: %v", cfg.File, err)
+	}
+	return s, nil
+}
+
+// ReadKey reads a key file.
+func ReadKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("secrets: %s: not a key of 32 bytes, raw or hex encoded", path)
+	}
+	return key, nil
+}
+
+// NewKey returns a random key for a secrets file.
+func NewKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// Seal encrypts the secrets with the key, as base64 of the nonce and the sealed JSON object.
+func Seal(secrets map[string]string, key []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, nil)
+	return []byte(base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+// Unseal decrypts secrets sealed with Seal.
+func Unseal(data []byte, key []byte) (map[string]string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("too short")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("wrong key or corrupt file")
+	}
+	var secrets map[string]string
+	err = json.Unmarshal(plain, &secrets)
+	return secrets, err
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Resolve replaces the references in the string values of the JSON config data.
+// Without store, "${secret:NAME}" references are an error.
+func Resolve(data []byte, store *Store) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	changed := false
+	v, err := store.resolve(v, &changed)
+	if err != nil || !changed {
+		return data, err
+	}
+	return json.Marshal(v)
+}
+
+func (s *Store) resolve(v interface{}, changed *bool) (interface{}, error) {
+	var err error
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if v[k], err = s.resolve(e, changed); err != nil {
+				return nil, fmt.Errorf("%s: %v", k, err)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			if v[i], err = s.resolve(e, changed); err != nil {
+				return nil, fmt.Errorf("%d: %v", i, err)
+			}
+		}
+	case string:
+		if !strings.HasPrefix(v, "${") || !strings.HasSuffix(v, "}") {
+			return v, nil
+		}
+		*changed = true
+		return s.lookup(v[2 : len(v)-1])
+	}
+	return v, nil
+}
+
+func (s *Store) lookup(ref string) (string, error) {
+	if name := strings.TrimPrefix(ref, "secret:"); name != ref {
+		if s == nil {
+			return "", fmt.Errorf("secret %q without secrets_conf", name)
+		}
+		value, ok := s.secrets[name]
+		if !ok {
+			return "", fmt.Errorf("no secret %q", name)
+		}
+		return value, nil
+	}
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s not set", ref)
+	}
+	return value, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// selfTestPower is the power in dBm of the frames the self-test sends.
+const selfTestPower = 2
+
+// selfTest checks the radios for the -selftest flag, prints a report and exits,
+// with status 1 if a check failed. Checks the radios do not support are skipped.
+func selfTest(cfgs []*lora.Config) {
+	failed := false
+	report := func(i int, check string, err error, format string, v ...interface{}) {
+		result := "ok"
+		if err != nil {
+			result = "FAIL"
+			format, v = "%v", []interface{}{err}
+			failed = true
+		}
+		fmt.Printf("radio %d: %-9s %-4s %s\n", i, check, result, fmt.Sprintf(format, v...))
+	}
+	skip := func(i int, check string, reason string) {
+		fmt.Printf("radio %d: %-9s %-4s %s\n", i, check, "skip", reason)
+	}
+
+	radios := make([]lora.Radio, len(cfgs))
+	for i, cfg := range cfgs {
+		backend := cfg.Backend
+		if backend == "" {
+			backend = lora.DefaultBackend
+		}
+		r, err := lora.OpenRadio(cfg)
+		report(i, "open", err, "%s backend", backend)
+		if err != nil {
+			continue
+		}
+		radios[i] = r
+
+		if c, ok := r.(interface{ Check() error }); ok {
+			dev := cfg.SpiDevice
+			if cfg.SerialDevice != "" {
+				dev = cfg.SerialDevice
+			}
+			report(i, "spi", c.Check(), "%s answers on %s", r.Name(), dev)
+		} else {
+			skip(i, "spi", "not supported by the backend")
+		}
+
+		if c, ok := r.(interface{ TestReset() error }); ok {
+			report(i, "reset", c.TestReset(), "%s resets the radio", cfg.PinRst)
+		} else {
+			skip(i, "reset", "not supported by the backend")
+		}
+
+		c, ok := r.(interface {
+			TestDIO0(pin string, pkt *lora.TxPacket) error
+		})
+		switch {
+		case !ok:
+			skip(i, "dio0", "not supported by the backend")
+		case cfg.PinDio0 == "":
+			skip(i, "dio0", "no pinDio0 in the config")
+		default:
+			report(i, "dio0", c.TestDIO0(cfg.PinDio0, selfTestPacket(cfg)), "%s rises at TX done", cfg.PinDio0)
+		}
+	}
+
+	switch {
+	case len(radios) < 2:
+		skip(0, "loopback", "needs two radios")
+	case radios[0] == nil || radios[1] == nil:
+		skip(0, "loopback", "radio 0 or 1 did not open")
+	case !onAir(radios[0]) || !onAir(radios[1]):
+		skip(0, "loopback", "needs two radios with hardware")
+	default:
+		err := loopback(radios[0], radios[1], cfgs[0])
+		report(0, "loopback", err, "radio 1 received a frame sent by radio 0")
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// onAir tells if the radio is hardware, which other radios can hear, and not a simulation.
+func onAir(r lora.Radio) bool {
+	_, ok := r.(interface{ Check() error })
+	return ok
+}
+
+// selfTestPacket returns a short frame on the channel of the config.
+func selfTestPacket(cfg *lora.Config) *lora.TxPacket {
+	return &lora.TxPacket{
+		Freq:       cfg.Freq,
+		Power:      selfTestPower,
+		Modulation: lora.ModulationLoRa,
+		LoRaBW:     cfg.LoRaBW,
+		LoRaCR:     cfg.LoRaCR,
+		Datarate:   cfg.Datarate,
+		Data:       []byte("selftest"),
+	}
+}
+
+// loopback sends a frame with tx on the channel of cfg and waits until rx receives it.
+func loopback(tx, rx lora.Radio, cfg *lora.Config) error {
+	ctx := context.Background()
+	rxCfg := *cfg
+	rxCfg.Hops = nil
+	if err := rx.Receive(ctx, &rxCfg); err != nil {
+		return err
+	}
+	pkt := selfTestPacket(cfg)
+	if err := tx.Send(ctx, pkt); err != nil {
+		return err
+	}
+	wait, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	for ; wait.Err() == nil; time.Sleep(10 * time.Millisecond) {
+		pkts, err := rx.GetPacket(wait)
+		if err != nil {
+			if wait.Err() != nil {
+				break
+			}
+			return err
+		}
+		received := false
+		for _, p := range pkts {
+			received = received || bytes.Equal(p.Data, pkt.Data)
+			p.Release()
+		}
+		if received {
+			return nil
+		}
+	}
+	return fmt.Errorf("radio 1 did not receive the frame on %s", cfg.Freq)
+}
@@ -0,0 +1,3 @@
+// Package serial opens serial ports, as the UARTs of radio modules and USB CDC ACM devices,
+// without cgo.
+package serial
@@ -0,0 +1,56 @@
+// +build linux
+
+package serial
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var bauds = map[int]uint32{
+	9600:   unix.B9600,
+	19200:  unix.B19200,
+	38400:  unix.B38400,
+	57600:  unix.B57600,
+	115200: unix.B115200,
+	230400: unix.B230400,
+}
+
+// Open opens the serial port with the baud rate, 8N1, in raw mode.
+func Open(name string, baud int) (io.ReadWriteCloser, error) {
+	speed, ok := bauds[baud]
+	if !ok {
+		return nil, fmt.Errorf("serial: baud rate %d not supported", baud)
+	}
+	fd, err := unix.Open(name, unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("serial: open %s: %v", name, err)
+	}
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("serial: %s is not a serial port: %v", name, err)
+	}
+	// raw mode, reads return as soon as a byte is available
+	t.Iflag = 0
+	t.Oflag = 0
+	t.Lflag = 0
+	t.Cflag = speed | unix.CS8 | unix.CREAD | unix.CLOCAL
+	t.Ispeed = speed
+	t.Ospeed = speed
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, t); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("serial: %s: can not set %d baud: %v", name, baud, err)
+	}
+	// non-blocking, so that Close interrupts the reads
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("serial: %v", err)
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
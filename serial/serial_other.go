@@ -0,0 +1,13 @@
+// +build !linux
+
+package serial
+
+import (
+	"errors"
+	"io"
+)
+
+// Open is only supported on Linux.
+func Open(name string, baud int) (io.ReadWriteCloser, error) {
+	return nil, errors.New("serial: serial ports are only supported on Linux")
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/clock"
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/metrics"
+)
+
+// upstreamServer is an enabled server of "servers".
+type upstreamServer struct {
+	addr *net.UDPAddr
+	// backup is set for the backup servers of the failover mode, see FailoverConfig.
+	backup bool
+	// auto is set if the protocol version is detected, see serverAnswered and checkVersions.
+	auto bool
+	// routes are the uplinks the server gets, or nil if it gets all, see packetFor.
+	routes *serverRoutes
+	// priority of the downlinks of the server, see txqueue.Item.ServerPriority.
+	priority int
+
+	version    int32 // protocol version, accessed atomically
+	unanswered int32 // keepalives without answer since the last packet from the server, accessed atomically
+
+	rtt   *metrics.Window // ACK round trips of the last requests
+	clock clock.Clock     // of the gateway
+
+	mu       sync.Mutex
+	sent     map[fwd.Token]time.Time // PUSH_DATA and PULL_DATA waiting for their ACK
+	answered []bool                  // if the last requests were acknowledged, a ring
+	next     int                     // next index in answered
+	acked    time.Time               // when the server last sent an ACK, or was added
+	degraded bool
+	lost     int // downlinks that collided with others or were dropped for those of other servers
+}
+
+// maxUnanswered is the number of unanswered keepalives after which the other protocol version is tried.
+const maxUnanswered = 3
+
+const (
+	ackTimeout = 5 * time.Second
+	rttWindow  = 100 // requests the percentiles and the loss are computed over
+	minHealth  = 10  // requests needed before a server may be degraded
+)
+
+func newUpstreamServer(addr *net.UDPAddr, version int, c clock.Clock) *upstreamServer {
+	s := &upstreamServer{
+		addr:     addr,
+		version:  int32(version),
+		rtt:      metrics.NewWindow(rttWindow),
+		clock:    c,
+		sent:     make(map[fwd.Token]time.Time),
+		answered: make([]bool, 0, rttWindow),
+		acked:    c.Now(),
+	}
+	if version == 0 {
+		s.auto = true
+		s.version = int32(fwd.ProtocolV2)
+	}
+	return s
+}
+
+// Version returns the protocol version used with the server.
+func (s *upstreamServer) Version() byte {
+	return byte(atomic.LoadInt32(&s.version))
+}
+
+// serverByAddr returns the server of the address, as in upstreamServer.addr.String(), or nil.
+func (gw *Gateway) serverByAddr(addr string) *upstreamServer {
+	for _, s := range gw.servers {
+		if s.addr.String() == addr {
+			return s
+		}
+	}
+	return nil
+}
+
+// serverFor returns the server that sent from addr, or nil.
+func (gw *Gateway) serverFor(addr *net.UDPAddr) *upstreamServer {
+	for _, s := range gw.servers {
+		if s.addr.IP.Equal(addr.IP) && s.addr.Port == addr.Port {
+			return s
+		}
+	}
+	return nil
+}
+
+// serverAnswered handles a packet from a server, which uses the version it answers with.
+func serverAnswered(s *upstreamServer, pkt *fwd.Packet) {
+	atomic.StoreInt32(&s.unanswered, 0)
+	if s.auto && pkt.Version != s.Version() {
+		atomic.StoreInt32(&s.version, int32(pkt.Version))
+		log(LogLevelNormal, "(<- %s) server speaks protocol version %d", s.addr, pkt.Version)
+	}
+}
+
+// requested records a PUSH_DATA or PULL_DATA sent to the server, whose ACK is awaited.
+func (s *upstreamServer) requested(token fwd.Token) {
+	s.mu.Lock()
+	s.sent[token] = s.clock.Now()
+	s.mu.Unlock()
+}
+
+// acknowledged records the round trip of a PUSH_ACK or PULL_ACK of the server.
+func (s *upstreamServer) acknowledged(token fwd.Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acked = s.clock.Now()
+	sent, ok := s.sent[token]
+	if !ok {
+		// late, already counted as lost, or for a packet sent before a restart
+		return
+	}
+	delete(s.sent, token)
+	s.rtt.Observe(s.acked.Sub(sent))
+	s.record(true)
+}
+
+// record adds the outcome of a request, s.mu held.
+func (s *upstreamServer) record(answered bool) {
+	if len(s.answered) < cap(s.answered) {
+		s.answered = append(s.answered, answered)
+		return
+	}
+	s.answered[s.next] = answered
+	s.next = (s.next + 1) % len(s.answered)
+}
+
+// serverHealth is an item of the "servers" section of the API status.
+type serverHealth struct {
+	Address  string  `json:"address"`
+	Version  byte    `json:"version"`
+	Requests int     `json:"requests"` // the last requests, which the other values are computed over
+	P50      float64 `json:"rtt_p50_ms"`
+	P95      float64 `json:"rtt_p95_ms"`
+	P99      float64 `json:"rtt_p99_ms"`
+	Loss     float64 `json:"loss"` // percentage of the requests that were not acknowledged
+	Degraded bool    `json:"degraded"`
+	// Active is set for the server the gateway is registered with in the failover mode.
+	Active bool `json:"active,omitempty"`
+	// Routes are the uplinks that took each route of the server, see "serv_routes".
+	Routes []routeStat `json:"routes,omitempty"`
+	// Collisions counts the downlinks of the server that were rejected as they collided with
+	// other downlinks, or dropped for downlinks of servers with a higher priority.
+	Collisions int `json:"collisions"`
+
+	p50, p95, p99 time.Duration
+}
+
+// checkHealth counts the requests that were not acknowledged within ackTimeout as lost,
+// and marks the server as degraded or not, by the p95 of the round trips and the loss in percent.
+func (s *upstreamServer) checkHealth(now time.Time, maxLatency time.Duration, maxLoss float64) *serverHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, sent := range s.sent {
+		if now.Sub(sent) > ackTimeout {
+			delete(s.sent, token)
+			s.record(false)
+		}
+	}
+	lost := 0
+	for _, answered := range s.answered {
+		if !answered {
+			lost++
+		}
+	}
+	h := &serverHealth{Address: s.addr.String(), Version: s.Version(), Requests: len(s.answered), Collisions: s.lost}
+	if h.Requests != 0 {
+		h.Loss = 100 * float64(lost) / float64(h.Requests)
+	}
+	p := s.rtt.Percentiles(50, 95, 99)
+	h.p50, h.p95, h.p99 = p[0], p[1], p[2]
+	h.P50, h.P95, h.P99 = ms(h.p50), ms(h.p95), ms(h.p99)
+
+	degraded := h.Requests >= minHealth && (h.p95 > maxLatency || h.Loss > maxLoss)
+	switch {
+	case degraded && !s.degraded:
+		log(LogLevelWarning, "(-> %s) server degraded: ACK round trip p95 %s, %.0f%% lost", s.addr, h.p95.Round(time.Millisecond), h.Loss)
+	case !degraded && s.degraded:
+		log(LogLevelNormal, "(-> %s) server recovered: ACK round trip p95 %s, %.0f%% lost", s.addr, h.p95.Round(time.Millisecond), h.Loss)
+	}
+	s.degraded = degraded
+	h.Degraded = degraded
+	return h
+}
+
+// collided counts a downlink of the server that lost against another downlink.
+func (s *upstreamServer) collided() {
+	s.mu.Lock()
+	s.lost++
+	s.mu.Unlock()
+}
+
+// lastAcked returns when the server last sent an ACK, or when it was added if it did not yet.
+func (s *upstreamServer) lastAcked() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acked
+}
+
+// Degraded tells if the ACK latency or loss of the server crossed the thresholds at the last check.
+func (s *upstreamServer) Degraded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.degraded
+}
+
+// checkServers checks the health of the servers and publishes it to the API.
+func (gw *Gateway) checkServers() []*serverHealth {
+	now := gw.clock.Now()
+	health := make([]*serverHealth, len(gw.servers))
+	for i, s := range gw.servers {
+		health[i] = s.checkHealth(now, gw.degradedLatency, gw.degradedLoss)
+		health[i].Active = gw.failover != nil && gw.failover.isActive(s)
+		health[i].Routes = s.routes.stats()
+	}
+	if gw.apiServer != nil {
+		gw.apiServer.Publish("servers", health)
+	}
+	return health
+}
+
+// ms returns d in milliseconds.
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// checkVersions counts a keepalive and switches the servers with detected versions that
+// did not answer the last keepalives to the other protocol version.
+func (gw *Gateway) checkVersions() {
+	for _, s := range gw.servers {
+		if !s.auto || atomic.AddInt32(&s.unanswered, 1) <= maxUnanswered {
+			continue
+		}
+		atomic.StoreInt32(&s.unanswered, 0)
+		version := fwd.ProtocolV1
+		if s.Version() == fwd.ProtocolV1 {
+			version = fwd.ProtocolV2
+		}
+		atomic.StoreInt32(&s.version, int32(version))
+		log(LogLevelWarning, "(-> %s) no answer to %d keepalives, trying protocol version %d", s.addr, maxUnanswered, version)
+	}
+}
+
+// serverReachable tells if a server answered within the last three keepalive intervals.
+func (gw *Gateway) serverReachable() bool {
+	return gw.clock.Now().Sub(gw.lastAck()) < 3*gw.keepalive
+}
+
+// listenUDP opens the socket for the servers. With an interface, as "wg0", the socket is
+// bound to its address and, on Linux, to the interface itself, so traffic goes through a VPN only.
+func listenUDP(laddr *net.UDPAddr, iface string) (*net.UDPConn, error) {
+	if iface == "" {
+		return net.ListenUDP("udp", laddr)
+	}
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	if ifi.Flags&net.FlagUp == 0 {
+		log(LogLevelWarning, "interface %s is down", iface)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ip net.IP
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && (ip == nil || ip.To4() == nil && ipnet.IP.To4() != nil) {
+			ip = ipnet.IP
+		}
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("interface %s has no address", iface)
+	}
+	lc := net.ListenConfig{Control: bindToDevice(iface)}
+	conn, err := lc.ListenPacket(context.Background(), "udp", (&net.UDPAddr{IP: ip, Port: laddr.Port}).String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,118 @@
+// Package simulator provides virtual end nodes that send valid LoRaWAN uplinks through
+// the mock radio or a second radio, to test gateway and network server without sensors.
+package simulator
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+	"github.com/Waziup/single_chan_pkt_fwd/mock"
+)
+
+// Device is a virtual end node.
+// For ABP set Session; for OTAA set DevEUI, AppEUI and AppKey to send join requests.
+type Device struct {
+	Session lorawan.Session
+
+	DevEUI lorawan.EUI64
+	AppEUI lorawan.EUI64
+	AppKey *lorawan.AES128Key
+
+	mu   sync.Mutex
+	fCnt uint32 // next uplink frame counter
+}
+
+// FCnt returns the frame counter of the next uplink.
+func (d *Device) FCnt() uint32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.fCnt
+}
+
+// SetFCnt sets the frame counter of the next uplink, e.g. to test counter handling.
+func (d *Device) SetFCnt(fCnt uint32) {
+	d.mu.Lock()
+	d.fCnt = fCnt
+	d.mu.Unlock()
+}
+
+// JoinRequest returns a join request with a random DevNonce.
+func (d *Device) JoinRequest() []byte {
+	var nonce [2]byte
+	rand.Read(nonce[:])
+	return lorawan.EncodeJoinRequest(d.AppKey, d.AppEUI, d.DevEUI, binary.LittleEndian.Uint16(nonce[:]))
+}
+
+// Uplink returns a data uplink with the payload on fPort and increments the frame counter.
+func (d *Device) Uplink(fPort uint8, payload []byte, confirmed bool) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	mType := lorawan.UnconfirmedDataUp
+	if confirmed {
+		mType = lorawan.ConfirmedDataUp
+	}
+	data, err := lorawan.EncodeData(&d.Session, &lorawan.DataFrame{
+		MType:      mType,
+		DevAddr:    d.Session.DevAddr,
+		FCnt:       d.fCnt,
+		FPort:      &fPort,
+		FRMPayload: payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.fCnt++
+	return data, nil
+}
+
+// Air transmits PHYPayloads as a device does. Transmit returns once the payload is on air,
+// or with ctx.Err() if ctx is done first.
+type Air interface {
+	Transmit(ctx context.Context, data []byte) error
+}
+
+// MockAir transmits to a mock radio, as if received with the given signal quality.
+// Frequency and data rate are those the mock radio listens on.
+type MockAir struct {
+	Radio *mock.Radio
+	RSSI  float32
+	SNR   float32
+}
+
+func (air *MockAir) Transmit(ctx context.Context, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	air.Radio.Inject(&lora.RxPacket{
+		RSSI:    air.RSSI,
+		LoRaSNR: air.SNR,
+		Data:    data,
+	})
+	return nil
+}
+
+// RadioAir transmits with a real radio, like a second SX127x next to the gateway.
+type RadioAir struct {
+	Radio    lora.Radio
+	Freq     lora.Frequency
+	Datarate lora.Datarate
+	Coderate lora.Coderate
+	Power    uint8
+}
+
+func (air *RadioAir) Transmit(ctx context.Context, data []byte) error {
+	return air.Radio.Send(ctx, &lora.TxPacket{
+		Immediate:  true,
+		Modulation: lora.ModulationLoRa,
+		Freq:       air.Freq,
+		Datarate:   air.Datarate.SpreadingFactor,
+		LoRaBW:     air.Datarate.Bandwidth,
+		LoRaCR:     air.Coderate,
+		Power:      air.Power,
+		Data:       data,
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/spool"
+)
+
+// pendingPush is an uplink PUSH_DATA that no server acknowledged yet.
+type pendingPush struct {
+	sent    time.Time
+	records []*spool.Record
+}
+
+// pushUplinks sends the packets, received at t, upstream in the trace of ctx.
+// With a spool, the packets are kept until a server acknowledges them. With backhaul windows,
+// the packets that are not urgent are spooled while the backhaul is closed.
+func (gw *Gateway) pushUplinks(ctx context.Context, pkts []*lora.RxPacket, t time.Time) {
+	if gw.backhaulWindows != nil {
+		if pkts = gw.backhaulWindows.hold(pkts, t); len(pkts) == 0 {
+			return
+		}
+	}
+	pkt := &fwd.Packet{
+		Token:     fwd.RndToken(),
+		Ident:     fwd.PushData,
+		RxPackets: pkts,
+	}
+	if gw.uplinkSpool != nil {
+		records := make([]*spool.Record, 0, len(pkts))
+		for _, rx := range pkts {
+			r, err := spool.NewRecord(rx, t)
+			if err != nil {
+				log(LogLevelError, "spool: %v", err)
+				continue
+			}
+			gw.uplinkSpool.Classify(r, rx)
+			records = append(records, r)
+		}
+		gw.addPending(pkt.Token, records)
+	}
+	gw.upstream(ctx, pkt)
+}
+
+func (gw *Gateway) addPending(token fwd.Token, records []*spool.Record) {
+	gw.pending.Lock()
+	gw.pending.pushes[token] = &pendingPush{sent: gw.clock.Now(), records: records}
+	gw.pending.Unlock()
+}
+
+// acknowledged handles PUSH_ACKs and PULL_ACKs from the servers.
+func (gw *Gateway) acknowledged(pkt *fwd.Packet) {
+	gw.pending.Lock()
+	defer gw.pending.Unlock()
+	gw.pending.lastAck = gw.clock.Now()
+	if gw.uplinkSpool != nil && pkt.Ident == fwd.PushAck {
+		delete(gw.pending.pushes, pkt.Token)
+	}
+}
+
+// lastAck returns when a server last sent a PUSH_ACK or PULL_ACK.
+func (gw *Gateway) lastAck() time.Time {
+	gw.pending.Lock()
+	defer gw.pending.Unlock()
+	return gw.pending.lastAck
+}
+
+// runSpool spools the pushes that are not acknowledged within ackTimeout,
+// and replays the spool in batches once a server answers again, in the backhaul windows.
+func (gw *Gateway) runSpool(ackTimeout time.Duration, batch int) {
+	ticker := gw.clock.NewTicker(time.Second)
+	for now := range ticker.C() {
+		var expired []*spool.Record
+		gw.pending.Lock()
+		for token, p := range gw.pending.pushes {
+			if now.Sub(p.sent) >= ackTimeout {
+				expired = append(expired, p.records...)
+				delete(gw.pending.pushes, token)
+			}
+		}
+		if len(expired) != 0 {
+			gw.pending.lastExpiry = now
+		}
+		online := gw.pending.lastAck.After(gw.pending.lastExpiry)
+		gw.pending.Unlock()
+
+		if len(expired) != 0 {
+			dropped, err := gw.uplinkSpool.Push(expired...)
+			if err != nil {
+				log(LogLevelError, "spool: %v", err)
+			}
+			log(LogLevelWarning, "spool: %d uplinks not acknowledged, %d spooled", len(expired), gw.uplinkSpool.Len())
+			if dropped != 0 {
+				log(LogLevelWarning, "spool: full, dropped the %d oldest uplinks", dropped)
+			}
+		}
+		if expired, err := gw.uplinkSpool.Expire(now); err != nil {
+			log(LogLevelError, "spool: %v", err)
+		} else if expired != 0 {
+			log(LogLevelWarning, "spool: dropped %d uplinks older than the max age of their class", expired)
+		}
+		inWindow := gw.backhaulWindows == nil || gw.backhaulWindows.open(now)
+		if online && inWindow && gw.uplinkSpool.Len() != 0 {
+			gw.replay(batch)
+		}
+	}
+}
+
+// replay pushes the oldest spooled uplinks of the highest classes again, marked as replayed.
+func (gw *Gateway) replay(batch int) {
+	records, err := gw.uplinkSpool.Pop(batch)
+	if err != nil {
+		log(LogLevelError, "spool: %v", err)
+	}
+	pkts := make([]*lora.RxPacket, 0, len(records))
+	valid := records[:0]
+	for _, r := range records {
+		pkt, err := r.Packet()
+		if err != nil {
+			log(LogLevelError, "spool: dropping uplink: %v", err)
+			continue
+		}
+		pkts = append(pkts, pkt)
+		valid = append(valid, r)
+	}
+	if len(pkts) == 0 {
+		return
+	}
+	pkt := &fwd.Packet{
+		Token:     fwd.RndToken(),
+		Ident:     fwd.PushData,
+		RxPackets: pkts,
+	}
+	gw.addPending(pkt.Token, valid)
+	log(LogLevelNormal, "spool: replaying %d uplinks, %d left", len(pkts), gw.uplinkSpool.Len())
+	gw.upstream(context.Background(), pkt)
+}
@@ -0,0 +1,376 @@
+// Package spool keeps uplinks on disk while the network server is unreachable,
+// so they can be replayed once it is back, the uplinks of the higher priority classes first.
+package spool
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+)
+
+// Config is the "spool_conf" section of the gateway config.
+type Config struct {
+	// Path of the spool file, with one JSON record per line.
+	Path string `json:"path"`
+	// MaxPackets is the number of spooled uplinks of no class, the oldest are dropped beyond.
+	// 10000 if not set.
+	MaxPackets int `json:"max_packets"`
+	// MaxAge in seconds, after which the spooled uplinks of no class are dropped, never if not set.
+	MaxAge int `json:"max_age"`
+	// AckTimeout in seconds, after which uplinks that no server acknowledged are spooled. 5 if not set.
+	AckTimeout int `json:"ack_timeout"`
+	// ReplayBatch is the number of uplinks replayed per PUSH_DATA, 8 if not set.
+	ReplayBatch int `json:"replay_batch"`
+	// Classes are the priority classes of the uplinks, highest first, which are replayed before
+	// the uplinks of the next classes and of no class.
+	Classes []Class `json:"classes"`
+}
+
+// Class is a priority class of uplinks, of the data uplinks on its FPorts and of its devices.
+type Class struct {
+	// Name of the class, as "alarm".
+	Name string `json:"name"`
+	// FPorts of the uplinks of the class, all FPorts if not set.
+	FPorts []uint8 `json:"fports"`
+	// DevAddrs are the DevAddr prefixes of the devices of the class, as "26011BDA/32", all
+	// devices if not set.
+	DevAddrs []string `json:"dev_addrs"`
+	// MaxPackets is the number of spooled uplinks of the class, the oldest are dropped beyond.
+	// 10000 if not set.
+	MaxPackets int `json:"max_packets"`
+	// MaxAge in seconds, after which the spooled uplinks of the class are dropped, never if not set.
+	MaxAge int `json:"max_age"`
+}
+
+// DefaultClass is the class of the uplinks of no other class, replayed last.
+const DefaultClass = "default"
+
+// Record is a spooled uplink.
+type Record struct {
+	Time  time.Time       `json:"time"` // when the uplink was received
+	Class string          `json:"class,omitempty"`
+	RxPk  json.RawMessage `json:"rxpk"`
+}
+
+// NewRecord returns the record of an uplink received at t.
+func NewRecord(pkt *lora.RxPacket, t time.Time) (*Record, error) {
+	rxpk, err := json.Marshal(pkt)
+	if err != nil {
+		return nil, err
+	}
+	return &Record{Time: t.UTC(), RxPk: rxpk}, nil
+}
+
+// Packet returns the uplink of the record for replaying.
+// Its time is the time it was received and it is marked as replayed.
+func (r *Record) Packet() (*lora.RxPacket, error) {
+	pkt := new(lora.RxPacket)
+	if err := json.Unmarshal(r.RxPk, pkt); err != nil {
+		return nil, err
+	}
+	t := r.Time
+	pkt.Time = &t
+	pkt.Replayed = true
+	return pkt, nil
+}
+
+// class is a priority class and its spooled records, oldest first.
+type class struct {
+	name     string
+	fPorts   map[uint8]bool // or nil for all
+	prefixes []lorawan.DevAddrPrefix
+	max      int
+	maxAge   time.Duration
+	records  []*Record
+}
+
+func newClass(name string, max, maxAge int) *class {
+	c := &class{name: name, max: max, maxAge: time.Duration(maxAge) * time.Second}
+	if c.max <= 0 {
+		c.max = 10000
+	}
+	return c
+}
+
+// matches reports whether the uplink is of the class.
+func (c *class) matches(pkt *lora.RxPacket) bool {
+	f, err := lorawan.Decode(pkt.Data)
+	if err != nil || !f.IsData() {
+		return false
+	}
+	if c.fPorts != nil && (f.FPort == nil || !c.fPorts[*f.FPort]) {
+		return false
+	}
+	if c.prefixes == nil {
+		return true
+	}
+	for _, p := range c.prefixes {
+		if p.Contains(f.DevAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Spool is a bounded FIFO of uplinks for each priority class, kept in memory and in an
+// append-only file. The file is compacted from time to time, so removed records are only gone
+// from the file after the next compaction and might be replayed twice after a crash.
+type Spool struct {
+	path string
+	max  int // of all classes
+
+	mu        sync.Mutex
+	classes   []*class // by priority, the default class last
+	file      *os.File
+	fileLines int // lines in the file, including removed records
+}
+
+// Open opens the spool file and loads the records in it.
+// Lines that can not be read are dropped, and the records of classes that are not in the
+// config any more are of the default class.
+func Open(cfg *Config) (*Spool, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("spool: no path")
+	}
+	s := &Spool{path: cfg.Path}
+	names := map[string]bool{DefaultClass: true}
+	for _, cc := range cfg.Classes {
+		if cc.Name == "" || names[cc.Name] {
+			return nil, fmt.Errorf("spool: class name %q is empty or not unique", cc.Name)
+		}
+		names[cc.Name] = true
+		if len(cc.FPorts) == 0 && len(cc.DevAddrs) == 0 {
+			return nil, fmt.Errorf("spool: class %s has no fports or dev_addrs", cc.Name)
+		}
+		c := newClass(cc.Name, cc.MaxPackets, cc.MaxAge)
+		if len(cc.FPorts) != 0 {
+			c.fPorts = make(map[uint8]bool)
+			for _, port := range cc.FPorts {
+				c.fPorts[port] = true
+			}
+		}
+		for _, addr := range cc.DevAddrs {
+			p, err := lorawan.ParseDevAddrPrefix(addr)
+			if err != nil {
+				return nil, fmt.Errorf("spool: class %s: %v", cc.Name, err)
+			}
+			c.prefixes = append(c.prefixes, p)
+		}
+		s.classes = append(s.classes, c)
+	}
+	s.classes = append(s.classes, newClass(DefaultClass, cfg.MaxPackets, cfg.MaxAge))
+	for _, c := range s.classes {
+		s.max += c.max
+	}
+
+	f, err := os.Open(s.path)
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 4096), 1<<20)
+		for scanner.Scan() {
+			r := new(Record)
+			if json.Unmarshal(scanner.Bytes(), r) == nil {
+				c := s.class(r.Class)
+				c.records = append(c.records, r)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, c := range s.classes {
+		if len(c.records) > c.max {
+			c.records = c.records[len(c.records)-c.max:]
+		}
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// class returns the class of a name, or the default class.
+func (s *Spool) class(name string) *class {
+	for _, c := range s.classes {
+		if c.name == name {
+			return c
+		}
+	}
+	return s.classes[len(s.classes)-1]
+}
+
+// Classify sets the class of a record to the first class of its uplink.
+func (s *Spool) Classify(r *Record, pkt *lora.RxPacket) {
+	for _, c := range s.classes[:len(s.classes)-1] {
+		if c.matches(pkt) {
+			r.Class = c.name
+			return
+		}
+	}
+	r.Class = ""
+}
+
+// Len returns the number of spooled uplinks.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.len()
+}
+
+func (s *Spool) len() int {
+	n := 0
+	for _, c := range s.classes {
+		n += len(c.records)
+	}
+	return n
+}
+
+// Lens returns the number of spooled uplinks by class.
+func (s *Spool) Lens() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lens := make(map[string]int, len(s.classes))
+	for _, c := range s.classes {
+		lens[c.name] = len(c.records)
+	}
+	return lens
+}
+
+// Push appends records to the spool, dropping the oldest of their class beyond its max.
+// It returns the number of records dropped.
+func (s *Spool) Push(records ...*Record) (dropped int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := bufio.NewWriter(s.file)
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return dropped, err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+		s.fileLines++
+		c := s.class(r.Class)
+		c.records = append(c.records, r)
+	}
+	for _, c := range s.classes {
+		if len(c.records) > c.max {
+			n := len(c.records) - c.max
+			c.records = append(c.records[:0], c.records[n:]...)
+			dropped += n
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return dropped, err
+	}
+	if s.fileLines > 2*s.max {
+		return dropped, s.compact()
+	}
+	return dropped, nil
+}
+
+// Expire drops the records that are older than the max age of their class at now.
+// It returns the number of records dropped.
+func (s *Spool) Expire(now time.Time) (dropped int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.classes {
+		if c.maxAge == 0 {
+			continue
+		}
+		n := 0
+		for n < len(c.records) && now.Sub(c.records[n].Time) > c.maxAge {
+			n++
+		}
+		c.records = append(c.records[:0], c.records[n:]...)
+		dropped += n
+	}
+	if dropped != 0 && s.fileLines > 2*s.len() {
+		return dropped, s.compact()
+	}
+	return dropped, nil
+}
+
+// Pop removes and returns up to n records, the oldest of the highest classes first.
+func (s *Spool) Pop(n int) ([]*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []*Record
+	for _, c := range s.classes {
+		k := n - len(records)
+		if k > len(c.records) {
+			k = len(c.records)
+		}
+		records = append(records, c.records[:k]...)
+		c.records = append(c.records[:0], c.records[k:]...)
+	}
+	if s.len() == 0 && s.fileLines != 0 {
+		return records, s.compact()
+	}
+	return records, nil
+}
+
+// Compact rewrites the file with the records that are still spooled.
+func (s *Spool) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact()
+}
+
+func (s *Spool) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, c := range s.classes {
+		for _, r := range c.records {
+			line, err := json.Marshal(r)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			w.Write(line)
+			w.WriteByte('\n')
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		f.Close()
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = f
+	s.fileLines = s.len()
+	return nil
+}
+
+// Close closes the spool file. The records stay in the file for the next Open.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.compact(); err != nil {
+		return err
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,186 @@
+package spool
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+var t0 = time.Date(2021, 3, 31, 16, 21, 17, 0, time.UTC)
+
+// tempConfig returns a config with the class "alarm" of FPort 10, in a temporary directory
+// that the returned func removes.
+func tempConfig(t *testing.T) (*Config, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Config{
+		Path:       filepath.Join(dir, "spool.json"),
+		MaxPackets: 3,
+		Classes:    []Class{{Name: "alarm", FPorts: []uint8{10}, MaxPackets: 2, MaxAge: 60}},
+	}, func() { os.RemoveAll(dir) }
+}
+
+// record returns the classified record of a data uplink on the FPort, received at t0 plus
+// the seconds, which tell the records apart.
+func record(t *testing.T, s *Spool, fPort uint8, seconds int) *Record {
+	t.Helper()
+	pkt := &lora.RxPacket{
+		Modulation: lora.ModulationLoRa,
+		LoRaBW:     lora.BW125K,
+		LoRaCR:     lora.CR4_5,
+		Datarate:   lora.SF7,
+		Data:       []byte{0x40, 0x03, 0x02, 0x01, 0x26, 0x00, 0x01, 0x00, fPort, 0xAB, 0x11, 0x22, 0x33, 0x44},
+	}
+	r, err := NewRecord(pkt, t0.Add(time.Duration(seconds)*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Classify(r, pkt)
+	return r
+}
+
+// pop pops n records and checks them by their seconds.
+func pop(t *testing.T, s *Spool, n int, want ...int) {
+	t.Helper()
+	records, err := s.Pop(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]int, len(records))
+	for i, r := range records {
+		got[i] = int(r.Time.Sub(t0) / time.Second)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("popped %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("popped %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPopClasses(t *testing.T) {
+	cfg, remove := tempConfig(t)
+	defer remove()
+	s, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Push(record(t, s, 1, 1), record(t, s, 10, 2), record(t, s, 1, 3), record(t, s, 10, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if lens := s.Lens(); lens["alarm"] != 2 || lens[DefaultClass] != 2 {
+		t.Errorf("lens %v, want 2 alarms and 2 others", lens)
+	}
+	// the alarms first, then the others, each oldest first
+	pop(t, s, 3, 2, 4, 1)
+	pop(t, s, 3, 3)
+	pop(t, s, 3)
+}
+
+func TestPushMax(t *testing.T) {
+	cfg, remove := tempConfig(t)
+	defer remove()
+	s, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	dropped, err := s.Push(record(t, s, 10, 1), record(t, s, 10, 2), record(t, s, 10, 3), record(t, s, 1, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the max of the alarms is 2, not the 3 of the others
+	if dropped != 1 || s.Len() != 3 {
+		t.Errorf("%d dropped and %d spooled, want 1 and 3", dropped, s.Len())
+	}
+	if dropped, err := s.Push(record(t, s, 1, 5), record(t, s, 1, 6), record(t, s, 1, 7)); err != nil || dropped != 1 {
+		t.Errorf("%d dropped (%v), want 1", dropped, err)
+	}
+	pop(t, s, 10, 2, 3, 5, 6, 7)
+}
+
+func TestExpire(t *testing.T) {
+	cfg, remove := tempConfig(t)
+	defer remove()
+	s, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Push(record(t, s, 10, 0), record(t, s, 1, 0), record(t, s, 10, 30)); err != nil {
+		t.Fatal(err)
+	}
+	// the alarms expire after 60s, the others never
+	if dropped, err := s.Expire(t0.Add(60 * time.Second)); err != nil || dropped != 0 {
+		t.Errorf("%d dropped at 60s (%v), want none", dropped, err)
+	}
+	if dropped, err := s.Expire(t0.Add(61 * time.Second)); err != nil || dropped != 1 {
+		t.Errorf("%d dropped at 61s (%v), want 1", dropped, err)
+	}
+	if dropped, err := s.Expire(t0.Add(time.Hour)); err != nil || dropped != 1 {
+		t.Errorf("%d dropped after an hour (%v), want 1", dropped, err)
+	}
+	pop(t, s, 10, 0)
+}
+
+func TestOpenReload(t *testing.T) {
+	cfg, remove := tempConfig(t)
+	defer remove()
+	s, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := record(t, s, 1, 3)
+	unknown.Class = "removed" // of a class that is not in the config any more
+	if _, err := s.Push(record(t, s, 1, 1), record(t, s, 10, 2), unknown, record(t, s, 10, 4)); err != nil {
+		t.Fatal(err)
+	}
+	pop(t, s, 1, 2)
+	// the popped record stays in the file until the next compaction
+	f, err := os.OpenFile(cfg.Path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("not a record\n")
+	f.Close()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lens := s.Lens(); lens["alarm"] != 1 || lens[DefaultClass] != 2 {
+		t.Errorf("lens %v after reopening, want 1 alarm and 2 others", lens)
+	}
+	pop(t, s, 10, 4, 1, 3)
+
+	// a smaller max drops the oldest records of the file
+	if _, err := s.Push(record(t, s, 1, 5), record(t, s, 1, 6), record(t, s, 1, 7)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.MaxPackets = 2
+	s, err = Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	pop(t, s, 10, 6, 7)
+}
@@ -0,0 +1,297 @@
+package standalone
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+)
+
+// The fragmented data block transport of LoRaWAN TS004 sends a block, as a firmware image, in
+// DataFragment commands of FragSize bytes on FPort 201. The NbFrag uncoded fragments are followed
+// by coded ones, each the XOR of some of the uncoded fragments, so the devices can rebuild the
+// fragments they missed. The fragmentation session, with FragSize, NbFrag and Padding, is set up on
+// the devices beforehand with a FragSessionSetupReq, which is up to the application.
+
+// FragPort is the FPort of the fragmented data block transport.
+const FragPort = 201
+
+// dataFragmentCID is the command identifier of DataFragment.
+const dataFragmentCID = 0x08
+
+// maxFragments is the number of fragments that the 14 bits of the fragment index can count.
+const maxFragments = 1<<14 - 1
+
+// FragOptions are the options of a fragmentation session, see App.Fragment.
+type FragOptions struct {
+	// Index of the fragmentation session on the devices, 0 to 3.
+	Index uint8 `json:"frag_index"`
+	// FragSize is the size of the fragments in bytes, 48 if not set. The DataFragment commands are
+	// 3 bytes longer, and must fit the datarate of the group.
+	FragSize int `json:"frag_size"`
+	// Redundancy is the number of coded fragments sent after the uncoded ones,
+	// a tenth of them if not set, at least 1.
+	Redundancy int `json:"redundancy"`
+	// Spacing between the fragments in seconds, 2 if not set, to leave the time on air and
+	// the duty cycle of the frequency.
+	Spacing float64 `json:"spacing"`
+}
+
+// FragSession is the progress of a fragmentation session.
+type FragSession struct {
+	McAddr     lorawan.DevAddr `json:"mc_addr"`
+	Index      uint8           `json:"frag_index"`
+	Size       int             `json:"size"`
+	FragSize   int             `json:"frag_size"`
+	NbFrag     int             `json:"nb_frag"` // uncoded fragments
+	Padding    int             `json:"padding"` // bytes added to the last uncoded fragment
+	Redundancy int             `json:"redundancy"`
+	Sent       int             `json:"sent"`
+	Started    time.Time       `json:"started"`
+	// Ended is set once all fragments are sent, or the session failed with Error.
+	Ended *time.Time `json:"ended,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+// ErrFragSession is returned by Fragment while the group sends another block.
+var ErrFragSession = errors.New("standalone: the group sends another block")
+
+// fragSessions are the fragmentation sessions of the groups, the last one of each.
+type fragSessions struct {
+	mu       sync.Mutex
+	sessions map[lorawan.DevAddr]*FragSession
+}
+
+// Fragment sends a block to the multicast group of the McAddr in the background, in the
+// fragments of a fragmentation session, and returns the session.
+func (app *App) Fragment(mcAddr lorawan.DevAddr, o FragOptions, block []byte) (FragSession, error) {
+	g := app.multicast.groups[mcAddr]
+	if g == nil {
+		return FragSession{}, fmt.Errorf("%w: %s", ErrUnknownGroup, mcAddr)
+	}
+	if o.FragSize == 0 {
+		o.FragSize = 48
+	}
+	if o.Spacing == 0 {
+		o.Spacing = 2
+	}
+	switch {
+	case o.Index > 3:
+		return FragSession{}, fmt.Errorf("standalone: frag_index %d not in 0 to 3", o.Index)
+	case o.FragSize < 1 || o.FragSize > 250:
+		return FragSession{}, fmt.Errorf("standalone: frag_size %d not in 1 to 250", o.FragSize)
+	case o.Redundancy < 0 || o.Spacing < 0:
+		return FragSession{}, errors.New("standalone: negative redundancy or spacing")
+	case len(block) == 0:
+		return FragSession{}, errors.New("standalone: empty block")
+	}
+	frags := fragment(block, o.FragSize)
+	if o.Redundancy == 0 {
+		o.Redundancy = (len(frags) + 9) / 10
+	}
+	if len(frags)+o.Redundancy > maxFragments {
+		return FragSession{}, fmt.Errorf("standalone: %d fragments, more than %d", len(frags)+o.Redundancy, maxFragments)
+	}
+	s := &FragSession{
+		McAddr:     mcAddr,
+		Index:      o.Index,
+		Size:       len(block),
+		FragSize:   o.FragSize,
+		NbFrag:     len(frags),
+		Padding:    len(frags)*o.FragSize - len(block),
+		Redundancy: o.Redundancy,
+		Started:    time.Now().UTC(),
+	}
+
+	app.frag.mu.Lock()
+	defer app.frag.mu.Unlock()
+	if prev := app.frag.sessions[mcAddr]; prev != nil && prev.Ended == nil {
+		return FragSession{}, ErrFragSession
+	}
+	app.frag.sessions[mcAddr] = s
+	go app.sendFragments(g, s, frags, time.Duration(o.Spacing*float64(time.Second)))
+	return *s, nil
+}
+
+// FragSessions returns the last fragmentation session of each group, by McAddr.
+func (app *App) FragSessions() []FragSession {
+	app.frag.mu.Lock()
+	defer app.frag.mu.Unlock()
+	sessions := make([]FragSession, 0, len(app.frag.sessions))
+	for _, s := range app.frag.sessions {
+		sessions = append(sessions, *s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].McAddr < sessions[j].McAddr })
+	return sessions
+}
+
+// sendFragments sends the uncoded and then the coded fragments of a session. A fragment that
+// does not fit the queue is tried again after the spacing.
+func (app *App) sendFragments(g *multicastGroup, s *FragSession, frags [][]byte, spacing time.Duration) {
+	app.Logger.Printf("fuota: sending %d bytes to %s in %d+%d fragments", s.Size, s.McAddr, s.NbFrag, s.Redundancy)
+	var err error
+	for n := 1; n <= s.NbFrag+s.Redundancy; {
+		frag := frags[(n-1)%len(frags)]
+		if n > s.NbFrag {
+			frag = codedFragment(frags, n-s.NbFrag)
+		}
+		cmd := make([]byte, 3, 3+len(frag))
+		cmd[0] = dataFragmentCID
+		binary.LittleEndian.PutUint16(cmd[1:], uint16(s.Index)<<14|uint16(n))
+		err = app.multicastPort(g, FragPort, append(cmd, frag...))
+		if err == nil {
+			app.frag.mu.Lock()
+			s.Sent = n
+			app.frag.mu.Unlock()
+			n++
+		} else if !errors.Is(err, ErrDownlinkQueueFull) {
+			break
+		}
+		time.Sleep(spacing)
+	}
+
+	app.frag.mu.Lock()
+	now := time.Now().UTC()
+	s.Ended = &now
+	if err != nil {
+		s.Error = err.Error()
+	}
+	app.frag.mu.Unlock()
+	if err != nil {
+		app.Logger.Printf("fuota: %s: stopped after %d fragments: %v", s.McAddr, s.Sent, err)
+		return
+	}
+	app.Logger.Printf("fuota: %s: sent %d fragments in %s", s.McAddr, s.Sent, now.Sub(s.Started).Round(time.Second))
+}
+
+// fragment splits a block into fragments of the size, the last one padded with zeros.
+func fragment(block []byte, size int) [][]byte {
+	frags := make([][]byte, 0, (len(block)+size-1)/size)
+	for i := 0; i < len(block); i += size {
+		frag := make([]byte, size)
+		copy(frag, block[i:])
+		frags = append(frags, frag)
+	}
+	return frags
+}
+
+// codedFragment returns the coded fragment of the row n of the parity matrix, from 1, which is
+// the XOR of the uncoded fragments the row selects.
+func codedFragment(frags [][]byte, n int) []byte {
+	coded := make([]byte, len(frags[0]))
+	for i, set := range parityRow(n, len(frags)) {
+		if set {
+			for j := range coded {
+				coded[j] ^= frags[i][j]
+			}
+		}
+	}
+	return coded
+}
+
+// parityRow returns the row n of the parity matrix of m uncoded fragments, as in the reference
+// implementation of TS004.
+func parityRow(n, m int) []bool {
+	row := make([]bool, m)
+	mTemp := 0
+	if m&(m-1) == 0 {
+		mTemp = 1
+	}
+	x := 1 + 1001*n
+	for nbCoeff := 0; nbCoeff < m/2; nbCoeff++ {
+		r := 1 << 16
+		for r >= m {
+			x = prbs23(x)
+			r = x % (m + mTemp)
+		}
+		row[r] = true
+	}
+	return row
+}
+
+// prbs23 is the pseudo random binary sequence of the parity matrix.
+func prbs23(x int) int {
+	b0 := x & 1
+	b1 := (x & 0x20) >> 5
+	return x>>1 + (b0^b1)<<22
+}
+
+// FragHandler returns the handler of the fragmentation sessions of the API. A POST to a path that
+// ends with a McAddr, as in "/api/fuota/01020304", sends the body to the group, with the
+// FragOptions as query parameters, and answers 202 Accepted with the session. A GET returns the
+// sessions, see FragSessions.
+func (app *App) FragHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(app.FragSessions())
+			return
+		case http.MethodPost:
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var mcAddr lorawan.DevAddr
+		if err := mcAddr.UnmarshalText([]byte(path.Base(r.URL.Path))); err != nil {
+			http.Error(w, "invalid McAddr: "+err.Error(), http.StatusNotFound)
+			return
+		}
+		var o FragOptions
+		q := r.URL.Query()
+		// the range is checked before the conversion, which would wrap frag_index=256 to 0
+		for _, p := range []struct {
+			name string
+			max  float64
+			set  func(float64)
+		}{
+			{"frag_index", 3, func(v float64) { o.Index = uint8(v) }},
+			{"frag_size", 250, func(v float64) { o.FragSize = int(v) }},
+			{"redundancy", maxFragments, func(v float64) { o.Redundancy = int(v) }},
+			{"spacing", float64(math.MaxInt64 / time.Second), func(v float64) { o.Spacing = v }},
+		} {
+			if s := q.Get(p.name); s != "" {
+				v, err := strconv.ParseFloat(s, 64)
+				if err != nil {
+					http.Error(w, "invalid "+p.name+": "+err.Error(), http.StatusBadRequest)
+					return
+				}
+				if !(v >= 0 && v <= p.max) {
+					http.Error(w, fmt.Sprintf("invalid %s: %s not in 0 to %g", p.name, s, p.max), http.StatusBadRequest)
+					return
+				}
+				p.set(v)
+			}
+		}
+		block, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxFragments*250))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s, err := app.Fragment(mcAddr, o, block)
+		switch {
+		case errors.Is(err, ErrUnknownGroup):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, ErrFragSession):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(s)
+	})
+}
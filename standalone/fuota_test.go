@@ -0,0 +1,61 @@
+package standalone
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestParityRow checks rows of the parity matrix against those of the C reference code of TS004.
+func TestParityRow(t *testing.T) {
+	for _, test := range []struct {
+		n, m int
+		want string
+	}{
+		{1, 10, "0010010000"},
+		{2, 10, "1010110001"},
+		{3, 16, "1110000010101100"}, // m a power of 2
+		{1, 4, "1010"},
+	} {
+		var got []byte
+		for _, set := range parityRow(test.n, test.m) {
+			if set {
+				got = append(got, '1')
+			} else {
+				got = append(got, '0')
+			}
+		}
+		if string(got) != test.want {
+			t.Errorf("row %d of %d fragments: %s, want %s", test.n, test.m, got, test.want)
+		}
+	}
+}
+
+// TestCodedFragment checks coded fragments against those of the C reference code of TS004.
+func TestCodedFragment(t *testing.T) {
+	frags := [][]byte{{0x01, 0x02}, {0x10, 0x20}, {0x04, 0x08}, {0x40, 0x80}}
+	for _, test := range []struct {
+		n    int
+		want []byte
+	}{
+		{1, []byte{0x05, 0x0A}}, // fragments 1 and 3
+		{3, []byte{0x50, 0xA0}}, // fragments 2 and 4
+	} {
+		if got := codedFragment(frags, test.n); !bytes.Equal(got, test.want) {
+			t.Errorf("coded fragment %d: %X, want %X", test.n, got, test.want)
+		}
+	}
+}
+
+func TestFragHandlerRange(t *testing.T) {
+	h := (&App{}).FragHandler()
+	for _, query := range []string{"frag_index=256", "frag_index=-1", "frag_index=NaN", "frag_size=1e30", "redundancy=-1", "spacing=1e300"} {
+		r := httptest.NewRequest(http.MethodPost, "/api/fuota/01020304?"+query, bytes.NewReader([]byte{1}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d %s, want %d", query, w.Code, w.Body, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package standalone
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+)
+
+// MulticastGroup is a Class C multicast group of the "multicast" list of "standalone_conf", as set
+// up on the devices by the remote multicast setup of LoRaWAN TS005, or in their firmware.
+// Its downlinks are unconfirmed data downlinks to McAddr, sent right away as Class C downlinks.
+type MulticastGroup struct {
+	McAddr    lorawan.DevAddr    `json:"mc_addr"`
+	McNwkSKey *lorawan.AES128Key `json:"mc_nwk_s_key"`
+	McAppSKey *lorawan.AES128Key `json:"mc_app_s_key"`
+	// FCnt is the frame counter of the first downlink, as the devices drop the frames of counters
+	// they had before. The next counters are kept in the "multicast_fcnt_file", if set.
+	FCnt uint32 `json:"fcnt"`
+
+	// Freq and Datr are the frequency and datarate of the group, as the RX2 parameters of
+	// the multicast session.
+	Freq lora.Frequency `json:"freq"`
+	Datr lora.Datarate  `json:"datr"`
+	// Power in dBm, 14 if not set.
+	Power uint8 `json:"power"`
+	// FPort of the downlinks, 1 to 223.
+	FPort uint8 `json:"fport"`
+
+	// Payload is sent every Interval seconds, as in the periodic broadcasts of a private field
+	// network. Without, the group only sends what is posted to the API, see App.ServeHTTP.
+	Payload  []byte `json:"payload"` // base64
+	Interval int    `json:"interval"`
+	// Count is the number of times the payload is sent, forever if not set.
+	Count int `json:"count"`
+}
+
+// ErrUnknownGroup is returned by Multicast for McAddrs of no group.
+var ErrUnknownGroup = errors.New("standalone: unknown multicast group")
+
+type multicastGroup struct {
+	*MulticastGroup
+	session lorawan.Session
+}
+
+// multicast holds the multicast groups of an App.
+type multicast struct {
+	groups map[lorawan.DevAddr]*multicastGroup
+	path   string // of the FCnt file, or ""
+
+	mu   sync.Mutex
+	fCnt map[lorawan.DevAddr]uint32 // next frame counters
+}
+
+func newMulticast(groups []MulticastGroup, fCntFile string) (*multicast, error) {
+	m := &multicast{
+		groups: make(map[lorawan.DevAddr]*multicastGroup),
+		path:   fCntFile,
+		fCnt:   make(map[lorawan.DevAddr]uint32),
+	}
+	if fCntFile != "" {
+		data, err := ioutil.ReadFile(fCntFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(data) != 0 {
+			if err := json.Unmarshal(data, &m.fCnt); err != nil {
+				return nil, fmt.Errorf("%s: %v", fCntFile, err)
+			}
+		}
+	}
+	for i := range groups {
+		g := &groups[i]
+		switch {
+		case g.McNwkSKey == nil || g.McAppSKey == nil:
+			return nil, fmt.Errorf("multicast group %s: no mc_nwk_s_key or mc_app_s_key", g.McAddr)
+		case g.FPort == 0 || g.FPort > 223:
+			return nil, fmt.Errorf("multicast group %s: fport %d not in 1 to 223", g.McAddr, g.FPort)
+		case g.Freq == 0 || g.Datr.SpreadingFactor == 0:
+			return nil, fmt.Errorf("multicast group %s: no freq or datr", g.McAddr)
+		case g.Payload != nil && g.Interval <= 0:
+			return nil, fmt.Errorf("multicast group %s: payload without interval", g.McAddr)
+		}
+		if _, ok := m.groups[g.McAddr]; ok {
+			return nil, fmt.Errorf("multicast group %s: listed twice", g.McAddr)
+		}
+		m.groups[g.McAddr] = &multicastGroup{
+			MulticastGroup: g,
+			session:        lorawan.Session{DevAddr: g.McAddr, NwkSKey: g.McNwkSKey, AppSKey: g.McAppSKey},
+		}
+		if m.fCnt[g.McAddr] < g.FCnt {
+			m.fCnt[g.McAddr] = g.FCnt
+		}
+	}
+	return m, nil
+}
+
+// encode returns the downlink of a payload on the FPort for the group, with its next frame counter.
+func (m *multicast) encode(g *multicastGroup, fPort uint8, payload []byte) (*lora.TxPacket, uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fCnt := m.fCnt[g.McAddr]
+	data, err := lorawan.EncodeData(&g.session, &lorawan.DataFrame{
+		MType:      lorawan.UnconfirmedDataDown,
+		DevAddr:    g.McAddr,
+		FCnt:       fCnt,
+		FPort:      &fPort,
+		FRMPayload: payload,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	m.fCnt[g.McAddr] = fCnt + 1
+	if err := m.save(); err != nil {
+		return nil, 0, fmt.Errorf("can not save frame counters: %v", err)
+	}
+	power := g.Power
+	if power == 0 {
+		power = 14
+	}
+	return &lora.TxPacket{
+		Immediate:   true,
+		Freq:        g.Freq,
+		Power:       power,
+		Modulation:  lora.ModulationLoRa,
+		LoRaBW:      g.Datr.Bandwidth,
+		LoRaCR:      lora.CR4_5,
+		Datarate:    g.Datr.SpreadingFactor,
+		InvertPolar: true,
+		Data:        data,
+	}, fCnt, nil
+}
+
+// save replaces the FCnt file, so it never holds partial counters.
+func (m *multicast) save() error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(m.fCnt)
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+// Multicast queues a downlink with the payload for the multicast group of the McAddr, see Downlinks.
+func (app *App) Multicast(mcAddr lorawan.DevAddr, payload []byte) error {
+	g := app.multicast.groups[mcAddr]
+	if g == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownGroup, mcAddr)
+	}
+	return app.multicastPort(g, g.FPort, payload)
+}
+
+// multicastPort is Multicast on another FPort than that of the group.
+func (app *App) multicastPort(g *multicastGroup, fPort uint8, payload []byte) error {
+	mcAddr := g.McAddr
+	pkt, fCnt, err := app.multicast.encode(g, fPort, payload)
+	if err != nil {
+		return fmt.Errorf("standalone: multicast group %s: %w", mcAddr, err)
+	}
+	select {
+	case app.Downlinks <- pkt:
+		app.Logger.Printf("multicast: queued downlink to %s, FCnt %d, FPort %d, %d bytes", mcAddr, fCnt, fPort, len(payload))
+		return nil
+	default:
+		return ErrDownlinkQueueFull
+	}
+}
+
+// broadcast sends the payload of a group every interval.
+func (app *App) broadcast(g *multicastGroup) {
+	ticker := time.NewTicker(time.Duration(g.Interval) * time.Second)
+	defer ticker.Stop()
+	for n := 0; g.Count == 0 || n < g.Count; n++ {
+		if err := app.Multicast(g.McAddr, g.Payload); err != nil {
+			app.Logger.Printf("multicast: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// ServeHTTP queues the body of a POST to a path that ends with a McAddr, as in
+// "/api/multicast/01020304", as a downlink of the multicast group, as the fragments of a firmware
+// update. It answers 202 Accepted once the downlink is queued, or 503 while the queue is full.
+func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var mcAddr lorawan.DevAddr
+	if err := mcAddr.UnmarshalText([]byte(path.Base(r.URL.Path))); err != nil {
+		http.Error(w, "invalid McAddr: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, lora.MaxPayloadLength))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	switch err := app.Multicast(mcAddr, payload); {
+	case errors.Is(err, ErrUnknownGroup):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrDownlinkQueueFull):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, lorawan.ErrPayloadTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "%d bytes queued for %s\n", len(payload), mcAddr)
+	}
+}
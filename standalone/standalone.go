@@ -0,0 +1,188 @@
+// Package standalone decrypts uplinks of known devices at the gateway and posts the
+// application payloads to an HTTP webhook, so small private setups need no network server.
+package standalone
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/decoder"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+)
+
+// ErrQueueFull is returned by HandleUplink if the webhook can not keep up with the uplinks.
+var ErrQueueFull = fmt.Errorf("webhook %w", lora.ErrQueueFull)
+
+// ErrDownlinkQueueFull is returned by Multicast if the radios do not take the downlinks as fast.
+var ErrDownlinkQueueFull = fmt.Errorf("downlink %w", lora.ErrQueueFull)
+
+// Config is the "standalone_conf" section of the gateway config.
+type Config struct {
+	// WebhookURL receives a POST with an Uplink JSON body for each decrypted uplink.
+	WebhookURL string `json:"webhook_url"`
+	// Timeout for each webhook request in seconds, 10 if not set.
+	Timeout int `json:"timeout"`
+	// Decoder decodes the payloads into the fields of the Uplink, see decoder.Get.
+	// The payloads are not decoded if not set.
+	Decoder string `json:"decoder"`
+	// Multicast are the Class C multicast groups that the gateway sends downlinks to.
+	Multicast []MulticastGroup `json:"multicast"`
+	// MulticastFCntFile keeps the frame counters of the multicast groups across restarts.
+	// They start at the "fcnt" of the groups on each start if not set.
+	MulticastFCntFile string `json:"multicast_fcnt_file"`
+}
+
+// Uplink is the decrypted application payload of a data uplink, as posted to the webhook.
+type Uplink struct {
+	DevAddr   lorawan.DevAddr `json:"dev_addr"`
+	FCnt      uint32          `json:"fcnt"`
+	FPort     uint8           `json:"fport"`
+	Confirmed bool            `json:"confirmed"`
+	Data      []byte          `json:"data"`
+	// Fields are the decoded payload, if a decoder is set and the payload could be decoded.
+	Fields map[string]interface{} `json:"fields,omitempty"`
+
+	Time     *time.Time     `json:"time,omitempty"`
+	Freq     lora.Frequency `json:"freq"`
+	Datarate string         `json:"datr,omitempty"` // LoRa only, as in "SF7BW125"
+	RSSI     float32        `json:"rssi"`
+	SNR      float32        `json:"lsnr"`
+}
+
+// App verifies and decrypts uplinks and posts them to the webhook in the background.
+type App struct {
+	Logger *log.Logger
+	// Downlinks are the downlinks of the multicast groups, for the radios to send.
+	// Multicast fails with ErrDownlinkQueueFull if nobody reads them.
+	Downlinks chan *lora.TxPacket
+
+	url      string
+	client   *http.Client
+	verifier *lorawan.MICVerifier
+	decoder  decoder.Decoder
+	sessions map[lorawan.DevAddr]*lorawan.Session
+	queue    chan []byte
+
+	multicast *multicast
+	frag      fragSessions
+}
+
+// New returns an App for the devices with the given sessions and starts posting to the webhook.
+func New(cfg *Config, sessions []lorawan.Session) (*App, error) {
+	if cfg.WebhookURL == "" {
+		return nil, errors.New("standalone: no webhook_url")
+	}
+	timeout := 10 * time.Second
+	if cfg.Timeout != 0 {
+		timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	app := &App{
+		Logger:   log.New(os.Stdout, "[APP  ] ", 0),
+		url:      cfg.WebhookURL,
+		client:   &http.Client{Timeout: timeout},
+		verifier: lorawan.NewMICVerifier(sessions),
+		sessions: make(map[lorawan.DevAddr]*lorawan.Session),
+		queue:    make(chan []byte, 32),
+
+		Downlinks: make(chan *lora.TxPacket, 16),
+		frag:      fragSessions{sessions: make(map[lorawan.DevAddr]*FragSession)},
+	}
+	if cfg.Decoder != "" {
+		d, err := decoder.Get(cfg.Decoder)
+		if err != nil {
+			return nil, fmt.Errorf("standalone: %v", err)
+		}
+		app.decoder = d
+	}
+	for i := range sessions {
+		app.sessions[sessions[i].DevAddr] = &sessions[i]
+	}
+	var err error
+	if app.multicast, err = newMulticast(cfg.Multicast, cfg.MulticastFCntFile); err != nil {
+		return nil, fmt.Errorf("standalone: %v", err)
+	}
+	go app.post()
+	for _, g := range app.multicast.groups {
+		if g.Payload != nil {
+			go app.broadcast(g)
+		}
+	}
+	return app, nil
+}
+
+// HandleUplink verifies and decrypts the packet and queues it for the webhook.
+// Packets that are no data uplinks or have no FPort are ignored.
+// The packet is not referenced after HandleUplink returns.
+func (app *App) HandleUplink(pkt *lora.RxPacket) error {
+	f, fCnt, err := app.verifier.VerifyFrame(pkt.Data)
+	if err != nil {
+		return err
+	}
+	if !f.IsData() || !f.IsUplink() || f.FPort == nil {
+		return nil
+	}
+	s := app.sessions[f.DevAddr]
+	key := s.AppSKey
+	if *f.FPort == 0 {
+		key = s.NwkSKey
+	}
+	if key == nil {
+		return fmt.Errorf("standalone: no key for device %s, FPort %d", f.DevAddr, *f.FPort)
+	}
+
+	up := Uplink{
+		DevAddr:   f.DevAddr,
+		FCnt:      fCnt,
+		FPort:     *f.FPort,
+		Confirmed: f.MType() == lorawan.ConfirmedDataUp,
+		Data:      lorawan.EncryptFRMPayload(key, true, f.DevAddr, fCnt, f.FRMPayload),
+		Time:      pkt.Time,
+		Freq:      pkt.Freq,
+		RSSI:      pkt.RSSI,
+		SNR:       pkt.LoRaSNR,
+	}
+	if app.decoder != nil && up.FPort != 0 {
+		up.Fields, err = app.decoder.Decode(up.FPort, up.Data)
+		if err != nil {
+			// the raw data is still worth posting
+			app.Logger.Printf("can not decode uplink of %s: %v", up.DevAddr, err)
+		}
+	}
+	if pkt.Modulation == lora.ModulationLoRa {
+		up.Datarate = lora.Datarate{SpreadingFactor: pkt.Datarate, Bandwidth: pkt.LoRaBW}.String()
+	}
+	if pkt.Modulation == lora.ModulationLRFHSS {
+		up.Datarate = pkt.LRFHSS.String()
+	}
+	body, err := json.Marshal(&up)
+	if err != nil {
+		return err
+	}
+	select {
+	case app.queue <- body:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (app *App) post() {
+	for body := range app.queue {
+		resp, err := app.client.Post(app.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			app.Logger.Printf("can not post uplink: %v", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			app.Logger.Printf("can not post uplink: %s", resp.Status)
+		}
+	}
+}
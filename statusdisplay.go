@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// showRx counts a received packet for the display.
+func (gw *Gateway) showRx(pkt *lora.RxPacket) {
+	if gw.statusDisplay == nil {
+		return
+	}
+	gw.shown.Lock()
+	gw.shown.rx++
+	gw.shown.lastRx = fmt.Sprintf("LAST SF%d %.0fDBM", pkt.Datarate, pkt.RSSI)
+	gw.shown.Unlock()
+}
+
+// showTx counts a sent packet for the display.
+func (gw *Gateway) showTx() {
+	if gw.statusDisplay == nil {
+		return
+	}
+	gw.shown.Lock()
+	gw.shown.tx++
+	gw.shown.Unlock()
+}
+
+// runDisplay updates the display every interval. It does not return.
+func (gw *Gateway) runDisplay(interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		server := "SRV DOWN"
+		if gw.serverReachable() {
+			server = "SRV OK"
+		}
+		gw.shown.Lock()
+		lines := []string{
+			fmt.Sprintf("EUI %016X", gw.gwid),
+			server,
+			gw.shown.lastRx,
+			fmt.Sprintf("RX %d TX %d", gw.shown.rx, gw.shown.tx),
+		}
+		gw.shown.Unlock()
+		if err := gw.statusDisplay.Show(lines); err != nil {
+			log(LogLevelWarning, "display: %v", err)
+		}
+	}
+}
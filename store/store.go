@@ -0,0 +1,233 @@
+// Package store keeps the metadata of received packets in a local file, for coverage
+// debugging on gateways without a central server.
+//
+// The file holds one JSON record per line. New records are appended, and the file is
+// rewritten from time to time to drop records beyond the retention limits.
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+)
+
+// compactInterval is how often records older than MaxAge are dropped.
+const compactInterval = time.Hour
+
+// Config is the "store_conf" section of the gateway config.
+type Config struct {
+	Path string `json:"path"`
+	// MaxAge in hours after which records are dropped, none if not set.
+	MaxAge int `json:"max_age"`
+	// MaxRecords is the number of records to keep, unlimited if not set.
+	MaxRecords int `json:"max_records"`
+}
+
+// Record is the metadata of a received packet.
+type Record struct {
+	Time       time.Time            `json:"time"`
+	DevAddr    *lorawan.DevAddr     `json:"dev_addr,omitempty"` // data frames only
+	MType      *lora.MType          `json:"mtype,omitempty"`    // LoRaWAN frames only
+	FCnt       *uint16              `json:"fcnt,omitempty"`     // data frames only
+	Freq       lora.Frequency       `json:"freq"`
+	Modulation lora.Modulation      `json:"modu"`
+	SF         lora.SpreadingFactor `json:"sf,omitempty"` // LoRa only
+	BW         lora.Bandwidth       `json:"bw,omitempty"` // LoRa only
+	RSSI       float32              `json:"rssi"`
+	SNR        float32              `json:"lsnr"`
+	FreqOffset int32                `json:"foff,omitempty"` // LoRa only
+	Size       int                  `json:"size"`
+}
+
+// NewRecord returns the record of a packet received at t, or at pkt.Time if set.
+func NewRecord(pkt *lora.RxPacket, t time.Time) *Record {
+	r := &Record{
+		Time:       t,
+		Freq:       pkt.Freq,
+		Modulation: pkt.Modulation,
+		RSSI:       pkt.RSSI,
+		Size:       len(pkt.Data),
+	}
+	if pkt.Time != nil {
+		r.Time = *pkt.Time
+	}
+	if pkt.Modulation == lora.ModulationLoRa {
+		r.SF = pkt.Datarate
+		r.BW = pkt.LoRaBW
+		r.SNR = pkt.LoRaSNR
+		r.FreqOffset = pkt.FreqOffset
+	}
+	if f, err := lorawan.Decode(pkt.Data); err == nil {
+		mType := f.MType()
+		r.MType = &mType
+		if f.IsData() {
+			r.DevAddr = &f.DevAddr
+			r.FCnt = &f.FCnt
+		}
+	}
+	return r
+}
+
+// Store appends records to the file.
+type Store struct {
+	path       string
+	maxAge     time.Duration
+	maxRecords int
+
+	mu          sync.Mutex
+	file        *os.File
+	n           int // records in file
+	lastCompact time.Time
+}
+
+// Open opens or creates the store file and applies the retention limits.
+func Open(cfg *Config) (*Store, error) {
+	s := &Store{
+		path:       cfg.Path,
+		maxAge:     time.Duration(cfg.MaxAge) * time.Hour,
+		maxRecords: cfg.MaxRecords,
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add appends the record and drops old records if the retention limits are exceeded.
+func (s *Store) Add(r *Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.n++
+	// allow a quarter more records than needed, so the file is not rewritten on every Add
+	tooMany := s.maxRecords != 0 && s.n > s.maxRecords+s.maxRecords/4
+	tooOld := s.maxAge != 0 && time.Since(s.lastCompact) > compactInterval
+	if tooMany || tooOld {
+		return s.compactLocked()
+	}
+	return nil
+}
+
+// Close closes the store file.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+func (s *Store) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compactLocked()
+}
+
+// compactLocked rewrites the file with the records within the retention limits.
+func (s *Store) compactLocked() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	var records []*Record
+	since := time.Time{}
+	if s.maxAge != 0 {
+		since = time.Now().Add(-s.maxAge)
+	}
+	err := Scan(s.path, &Query{From: since}, func(r *Record) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if s.maxRecords != 0 && len(records) > s.maxRecords {
+		records = records[len(records)-s.maxRecords:]
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	s.n = len(records)
+	s.lastCompact = time.Now()
+	return err
+}
+
+// Query selects records. Zero fields match all records.
+type Query struct {
+	DevAddr *lorawan.DevAddr
+	From    time.Time // inclusive
+	To      time.Time // exclusive
+	SF      lora.SpreadingFactor
+}
+
+// Match reports whether r is selected by the query.
+func (q *Query) Match(r *Record) bool {
+	if q.DevAddr != nil && (r.DevAddr == nil || *r.DevAddr != *q.DevAddr) {
+		return false
+	}
+	if !q.From.IsZero() && r.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !r.Time.Before(q.To) {
+		return false
+	}
+	if q.SF != 0 && r.SF != q.SF {
+		return false
+	}
+	return true
+}
+
+// Scan calls fn for each record of the store file at path that matches q, oldest first.
+// Lines that are no valid record, like a partial line after a power loss, are skipped.
+func Scan(path string, q *Query, fn func(r *Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r := new(Record)
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			continue
+		}
+		if q.Match(r) {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
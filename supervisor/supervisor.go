@@ -0,0 +1,105 @@
+// Package supervisor runs the workers of the forwarder, as its radio and network loops, and
+// restarts them if they panic, so one malformed packet can not take the whole gateway down.
+//
+// A worker that keeps panicking, as on each packet of a device, is restarted with an exponential
+// backoff, so it does not spin and flood the logs.
+package supervisor
+
+import (
+	"context"
+	"log"
+	"os"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/clock"
+)
+
+// Worker is a goroutine that is restarted if it panics, see Run.
+type Worker struct {
+	// Name of the worker in the logs, as "radio".
+	Name string
+	// Logger logs the panics with their stack trace.
+	Logger *log.Logger
+	// OnPanic is called after each panic with the value of the panic and the number of panics
+	// so far, as for a crash metric, or is nil.
+	OnPanic func(v interface{}, crashes int)
+	// MinBackoff is the wait before the first restart, 1s if not set. It doubles with each
+	// panic up to MaxBackoff, 1min if not set, and is back to MinBackoff once the worker ran
+	// MaxBackoff without panicking.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Clock times the backoff, the system clock if nil.
+	Clock clock.Clock
+
+	crashes int64
+}
+
+// New returns a worker with the name.
+func New(name string) *Worker {
+	return &Worker{
+		Name:   name,
+		Logger: log.New(os.Stdout, "[SUPER] ", 0),
+	}
+}
+
+// Crashes returns the number of panics of the worker.
+func (w *Worker) Crashes() int {
+	return int(atomic.LoadInt64(&w.crashes))
+}
+
+// Run runs f, and runs it again after a backoff each time it panics, until it returns or ctx
+// is done.
+func (w *Worker) Run(ctx context.Context, f func(ctx context.Context)) {
+	c := clock.OrReal(w.Clock)
+	minBackoff, maxBackoff := w.MinBackoff, w.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = time.Second
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = time.Minute
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+	backoff := minBackoff
+	for {
+		started := c.Now()
+		if !w.run(ctx, f) {
+			return
+		}
+		if c.Now().Sub(started) >= maxBackoff {
+			backoff = minBackoff
+		}
+		w.Logger.Printf("%s: restarting in %s", w.Name, backoff)
+		timer := c.NewTimer(backoff)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// run runs f once, and reports whether it panicked.
+func (w *Worker) run(ctx context.Context, f func(ctx context.Context)) (panicked bool) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		panicked = true
+		crashes := int(atomic.AddInt64(&w.crashes, 1))
+		w.Logger.Printf("%s: panic: %v\n%s", w.Name, v, debug.Stack())
+		if w.OnPanic != nil {
+			w.OnPanic(v, crashes)
+		}
+	}()
+	f(ctx)
+	return false
+}
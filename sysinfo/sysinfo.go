@@ -0,0 +1,151 @@
+// Package sysinfo reads the health of the host from the files of the Linux kernel.
+// On other systems, and where the kernel does not provide a value, it returns an error.
+package sysinfo
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CPUTemp returns the temperature of the CPU in degrees Celsius, from the first thermal zone.
+func CPUTemp() (float64, error) {
+	data, err := ioutil.ReadFile("/sys/class/thermal/thermal_zone0/temp")
+	if err != nil {
+		return 0, err
+	}
+	milli, err := strconv.Atoi(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return 0, fmt.Errorf("sysinfo: temp: %v", err)
+	}
+	return float64(milli) / 1000, nil
+}
+
+// Memory is the memory of the host in bytes.
+type Memory struct {
+	Total     uint64 `json:"total"`
+	Available uint64 `json:"available"`
+}
+
+// ReadMemory returns the memory of the host, from /proc/meminfo.
+func ReadMemory() (*Memory, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var m Memory
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// as "MemAvailable:     312852 kB"
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			m.Total = kb * 1024
+		case "MemAvailable:":
+			m.Available = kb * 1024
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if m.Total == 0 {
+		return nil, fmt.Errorf("sysinfo: no MemTotal in /proc/meminfo")
+	}
+	return &m, nil
+}
+
+// Uptime returns the time since the host booted, from /proc/uptime.
+func Uptime() (time.Duration, error) {
+	data, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("sysinfo: empty /proc/uptime")
+	}
+	sec, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("sysinfo: uptime: %v", err)
+	}
+	return time.Duration(sec * float64(time.Second)), nil
+}
+
+// Zone is the temperature of a thermal zone in degrees Celsius.
+type Zone struct {
+	Name string  `json:"name"` // the type of the zone, as "cpu-thermal"
+	Temp float64 `json:"temp"`
+}
+
+// ThermalZones returns the temperatures of all thermal zones.
+func ThermalZones() ([]Zone, error) {
+	dirs, err := filepath.Glob("/sys/class/thermal/thermal_zone*")
+	if err != nil {
+		return nil, err
+	}
+	var zones []Zone
+	for _, dir := range dirs {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "temp"))
+		if err != nil {
+			continue
+		}
+		milli, err := strconv.Atoi(string(bytes.TrimSpace(data)))
+		if err != nil {
+			continue
+		}
+		name := filepath.Base(dir)
+		if typ, err := ioutil.ReadFile(filepath.Join(dir, "type")); err == nil {
+			name = string(bytes.TrimSpace(typ))
+		}
+		zones = append(zones, Zone{Name: name, Temp: float64(milli) / 1000})
+	}
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("sysinfo: no thermal zones")
+	}
+	return zones, nil
+}
+
+// Throttled are the throttling flags of the Raspberry Pi firmware, as by "vcgencmd get_throttled".
+type Throttled uint32
+
+// The flags: the low bits are the current state, the high bits tell if it occurred since boot.
+const (
+	UnderVoltage            Throttled = 1 << 0
+	FrequencyCapped         Throttled = 1 << 1
+	Throttling              Throttled = 1 << 2
+	SoftTempLimit           Throttled = 1 << 3
+	UnderVoltageOccurred    Throttled = 1 << 16
+	FrequencyCappedOccurred Throttled = 1 << 17
+	ThrottlingOccurred      Throttled = 1 << 18
+	SoftTempLimitOccurred   Throttled = 1 << 19
+)
+
+// throttledFile is provided by the firmware driver of Raspberry Pi kernels since 4.19.
+const throttledFile = "/sys/devices/platform/soc/soc:firmware/get_throttled"
+
+// ReadThrottled returns the throttling flags of a Raspberry Pi.
+func ReadThrottled() (Throttled, error) {
+	data, err := ioutil.ReadFile(throttledFile)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseUint(string(bytes.TrimSpace(data)), 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("sysinfo: get_throttled: %v", err)
+	}
+	return Throttled(v), nil
+}
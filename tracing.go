@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lorawan"
+	"github.com/Waziup/single_chan_pkt_fwd/tracing"
+)
+
+// errNoAck ends the "ack" spans of packets that no server acknowledged in time.
+var errNoAck = errors.New("no ACK")
+
+// traceStage starts a span of a stage in the trace of ctx. If ctx is not traced, as for
+// keepalives and stats, it returns no span, so those do not start traces of their own.
+func (gw *Gateway) traceStage(ctx context.Context, name string) (context.Context, *tracing.Span) {
+	if tracing.SpanFromContext(ctx) == nil {
+		return ctx, nil
+	}
+	return gw.tracer.Start(ctx, name)
+}
+
+// traceRx records the "rx" span of a frame received between start and end.
+func (gw *Gateway) traceRx(ctx context.Context, pkt *lora.RxPacket, start, end time.Time) {
+	_, span := gw.tracer.StartAt(ctx, "rx", start)
+	if span == nil {
+		return
+	}
+	span.SetAttr("lora.chain", pkt.ChainRF)
+	span.SetAttr("lora.freq", pkt.Freq.MHz())
+	span.SetAttr("lora.datr", lora.Datarate{SpreadingFactor: pkt.Datarate, Bandwidth: pkt.LoRaBW}.String())
+	span.SetAttr("lora.rssi", pkt.RSSI)
+	span.SetAttr("lora.snr", pkt.LoRaSNR)
+	span.SetAttr("lora.size", len(pkt.Data))
+	if f, err := lorawan.Decode(pkt.Data); err == nil && f.IsData() {
+		if addr := gw.privacy.id(f.DevAddr.String()); addr != "" {
+			span.SetAttr("lorawan.dev_addr", addr)
+		}
+	}
+	span.EndAt(end)
+}
+
+// ackKey identifies the ACK a server sends for a packet.
+type ackKey struct {
+	token fwd.Token
+	addr  string
+}
+
+// traceAckWait starts the "ack" span of a packet of ctx, sent to the server at addr.
+func (gw *Gateway) traceAckWait(ctx context.Context, token fwd.Token, addr *net.UDPAddr) {
+	_, span := gw.traceStage(ctx, "ack")
+	if span == nil {
+		return
+	}
+	span.SetAttr("server.address", addr.String())
+	gw.ackSpans.Lock()
+	gw.ackSpans.spans[ackKey{token, addr.String()}] = span
+	gw.ackSpans.Unlock()
+}
+
+// traceAck ends the "ack" span of the packet a server acknowledged with pkt.
+func (gw *Gateway) traceAck(pkt *fwd.Packet, addr *net.UDPAddr) {
+	key := ackKey{pkt.Token, addr.String()}
+	gw.ackSpans.Lock()
+	span := gw.ackSpans.spans[key]
+	delete(gw.ackSpans.spans, key)
+	gw.ackSpans.Unlock()
+	span.End()
+}
+
+// expireAckSpans ends the "ack" spans that waited for longer than timeout as failed.
+func (gw *Gateway) expireAckSpans(timeout time.Duration) {
+	now := time.Now()
+	gw.ackSpans.Lock()
+	defer gw.ackSpans.Unlock()
+	for key, span := range gw.ackSpans.spans {
+		if now.Sub(span.StartTime()) > timeout {
+			span.SetError(errNoAck)
+			span.End()
+			delete(gw.ackSpans.spans, key)
+		}
+	}
+}
+
+// downlinkTrace is the trace of a queued downlink.
+type downlinkTrace struct {
+	ctx      context.Context // holds the "downlink" span
+	schedule *tracing.Span
+}
+
+// downlinkContext returns the context of the trace of a queued downlink, or ctx if it is not traced.
+func (gw *Gateway) downlinkContext(ctx context.Context, pkt *lora.TxPacket) context.Context {
+	if t, ok := gw.txTraces[pkt]; ok {
+		return t.ctx
+	}
+	return ctx
+}
+
+// startDownlinkTx ends the "schedule" span of a downlink that is about to be sent,
+// and returns the context of its trace, or ctx if it is not traced.
+func (gw *Gateway) startDownlinkTx(ctx context.Context, pkt *lora.TxPacket) context.Context {
+	t, ok := gw.txTraces[pkt]
+	if !ok {
+		return ctx
+	}
+	t.schedule.End()
+	return t.ctx
+}
+
+// endDownlinkTrace ends the trace of a downlink that is sent or dropped, failed if err is not nil.
+func (gw *Gateway) endDownlinkTrace(pkt *lora.TxPacket, err error) {
+	t, ok := gw.txTraces[pkt]
+	if !ok {
+		return
+	}
+	delete(gw.txTraces, pkt)
+	if !t.schedule.Ended() {
+		t.schedule.SetError(err)
+		t.schedule.End()
+	}
+	span := tracing.SpanFromContext(t.ctx)
+	span.SetError(err)
+	span.End()
+}
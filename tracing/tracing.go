@@ -0,0 +1,415 @@
+// Package tracing records spans of the packet lifecycle and exports them to an OpenTelemetry
+// collector with OTLP over HTTP, in its JSON encoding, so no OpenTelemetry SDK is needed.
+//
+// Spans are carried in a context.Context: a span started from a context that holds a span
+// is its child, in the same trace. The methods of a nil *Tracer and a nil *Span do nothing,
+// so the packet path is instrumented the same whether tracing is enabled or not.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/proxy"
+)
+
+// Config is the "tracing_conf" section of the gateway config.
+type Config struct {
+	// Endpoint is the OTLP/HTTP traces URL of the collector, as "http://localhost:4318/v1/traces".
+	Endpoint string `json:"endpoint"`
+	// ServiceName is the "service.name" of the spans, "single_chan_pkt_fwd" if not set.
+	ServiceName string `json:"service_name"`
+	// Headers are sent with each export, e.g. the API key of a tracing backend.
+	Headers map[string]string `json:"headers"`
+	// Interval in seconds between exports, 5 if not set.
+	Interval int `json:"interval"`
+	// Proxy is the HTTP or SOCKS5 proxy URL, see proxy.Transport.
+	Proxy string `json:"proxy"`
+}
+
+// maxSpans is the number of ended spans kept between exports; more are dropped.
+const maxSpans = 4096
+
+// Tracer starts spans and exports them in the background.
+type Tracer struct {
+	Logger *log.Logger
+
+	endpoint string
+	headers  map[string]string
+	resource []attribute
+	interval time.Duration
+	client   *http.Client
+
+	mu      sync.Mutex
+	spans   []*Span
+	dropped int
+	queue   chan []*Span
+}
+
+// New returns a Tracer for the gateway and starts exporting to the endpoint.
+func New(cfg *Config, gatewayID uint64) (*Tracer, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: invalid endpoint: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("tracing: unknown endpoint scheme %q", u.Scheme)
+	}
+	transport, err := proxy.Transport(cfg.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %v", err)
+	}
+	service := cfg.ServiceName
+	if service == "" {
+		service = "single_chan_pkt_fwd"
+	}
+	t := &Tracer{
+		Logger:   log.New(os.Stdout, "[TRACE] ", 0),
+		endpoint: cfg.Endpoint,
+		headers:  cfg.Headers,
+		resource: []attribute{
+			newAttribute("service.name", service),
+			newAttribute("gateway.id", fmt.Sprintf("%016X", gatewayID)),
+		},
+		interval: 5 * time.Second,
+		client:   &http.Client{Timeout: 10 * time.Second, Transport: transport},
+		queue:    make(chan []*Span, 4),
+	}
+	if cfg.Interval > 0 {
+		t.interval = time.Duration(cfg.Interval) * time.Second
+	}
+	go t.run()
+	return t, nil
+}
+
+// Span is a stage of the packet lifecycle, from Start until End.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // zero for the root span of a trace
+	name     string
+	start    time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  []attribute
+	errMsg string
+	failed bool
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx that holds the span.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext returns the span of ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start starts a span now, see StartAt.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	return t.StartAt(ctx, name, time.Now())
+}
+
+// StartAt starts a span at the given time, as a child of the span of ctx if there is one,
+// and returns a copy of ctx that holds it.
+func (t *Tracer) StartAt(ctx context.Context, name string, start time.Time) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, name: name, start: start}
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return ContextWithSpan(ctx, s), s
+}
+
+// TraceID returns the hex ID of the trace of the span, for logs, or "" for a nil span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// StartTime returns when the span started, or the zero time for a nil span.
+func (s *Span) StartTime() time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	return s.start
+}
+
+// SetAttr sets an attribute of the span. Strings, bools, integers and floats keep their type,
+// other values are formatted with fmt.Sprint.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, newAttribute(key, value))
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed with the error, if err is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.failed = true
+	s.errMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// End ends the span now, see EndAt.
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt ends the span at the given time and queues it for export.
+// Only the first call ends the span, so it may be ended from several places.
+func (s *Span) EndAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = end
+	}
+	s.mu.Unlock()
+	if !ended {
+		s.tracer.add(s)
+	}
+}
+
+// Ended tells if the span has been ended.
+func (s *Span) Ended() bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.end.IsZero()
+}
+
+func (t *Tracer) add(s *Span) {
+	t.mu.Lock()
+	if len(t.spans) < maxSpans {
+		t.spans = append(t.spans, s)
+	} else {
+		t.dropped++
+	}
+	t.mu.Unlock()
+}
+
+// flush queues all ended spans for export.
+func (t *Tracer) flush() {
+	t.mu.Lock()
+	spans, dropped := t.spans, t.dropped
+	t.spans, t.dropped = nil, 0
+	t.mu.Unlock()
+	if dropped != 0 {
+		t.Logger.Printf("dropped %d spans: too many spans between exports", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+	select {
+	case t.queue <- spans:
+	default:
+		t.Logger.Printf("dropping %d spans: collector too slow", len(spans))
+	}
+}
+
+func (t *Tracer) run() {
+	go func() {
+		for range time.Tick(t.interval) {
+			t.flush()
+		}
+	}()
+	for spans := range t.queue {
+		if err := t.export(spans); err != nil {
+			t.Logger.Printf("can not export %d spans: %v", len(spans), err)
+		}
+	}
+}
+
+func (t *Tracer) export(spans []*Span) error {
+	var req exportRequest
+	req.ResourceSpans = []resourceSpans{{
+		Resource: resource{Attributes: t.resource},
+		ScopeSpans: []scopeSpans{{
+			Scope: scope{Name: "github.com/Waziup/single_chan_pkt_fwd"},
+			Spans: make([]span, len(spans)),
+		}},
+	}}
+	for i, s := range spans {
+		req.ResourceSpans[0].ScopeSpans[0].Spans[i] = s.otlp()
+	}
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		httpReq.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// The OTLP JSON encoding, see opentelemetry-proto. IDs are hex and 64 bit integers are strings.
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []attribute `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope  `json:"scope"`
+	Spans []span `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type span struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []attribute `json:"attributes,omitempty"`
+	Status            *status     `json:"status,omitempty"`
+}
+
+// spanKindInternal is SPAN_KIND_INTERNAL, as the forwarder neither serves nor calls RPCs.
+const spanKindInternal = 1
+
+// statusCodeError is STATUS_CODE_ERROR.
+const statusCodeError = 2
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type attribute struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func newAttribute(key string, value interface{}) attribute {
+	a := attribute{Key: key}
+	var i int64
+	switch v := value.(type) {
+	case string:
+		a.Value.StringValue = &v
+		return a
+	case bool:
+		a.Value.BoolValue = &v
+		return a
+	case float32:
+		f := float64(v)
+		a.Value.DoubleValue = &f
+		return a
+	case float64:
+		a.Value.DoubleValue = &v
+		return a
+	case int:
+		i = int64(v)
+	case int8:
+		i = int64(v)
+	case int16:
+		i = int64(v)
+	case int32:
+		i = int64(v)
+	case int64:
+		i = v
+	case uint8:
+		i = int64(v)
+	case uint16:
+		i = int64(v)
+	case uint32:
+		i = int64(v)
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+		return a
+	}
+	s := strconv.FormatInt(i, 10)
+	a.Value.IntValue = &s
+	return a
+}
+
+func (s *Span) otlp() span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := span{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	if s.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.failed {
+		out.Status = &status{Code: statusCodeError, Message: s.errMsg}
+	}
+	return out
+}
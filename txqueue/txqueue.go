@@ -0,0 +1,255 @@
+// Package txqueue orders downlinks by their send time and can keep them in a file,
+// so scheduled downlinks survive a restart of the forwarder.
+//
+// Downlinks have a priority. Scheduled downlinks (Class A and B) and beacons must go out
+// at their time, so two of them that overlap collide. Immediate downlinks (Class C) are
+// sent as soon as the radio is free, so they are delayed to the first gap between the others.
+package txqueue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/clock"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// Guard is the time kept free after each downlink for the radio to switch.
+const Guard = 10 * time.Millisecond
+
+var (
+	// ErrCollision is returned by Push if a downlink overlaps a scheduled downlink.
+	ErrCollision = errors.New("collides with a scheduled downlink")
+	// ErrCollisionBeacon is returned by Push if a downlink overlaps a beacon.
+	ErrCollisionBeacon = errors.New("collides with a beacon")
+	// ErrQueueFull is returned by Push if MaxLen downlinks are queued already.
+	ErrQueueFull = fmt.Errorf("tx %w", lora.ErrQueueFull)
+)
+
+// Priority orders downlinks that compete for the radio.
+type Priority int
+
+const (
+	PriorityImmediate Priority = iota // Class C, sent when the radio is free
+	PriorityScheduled                 // Class A and B, sent at their time
+	PriorityBeacon                    // Class B beacons, sent at their time before anything else
+)
+
+// PriorityOf returns the priority of a downlink. Beacons are sent without CRC and
+// with the IQ not inverted, which sets them apart from other downlinks.
+func PriorityOf(pkt *lora.TxPacket) Priority {
+	switch {
+	case pkt.Immediate:
+		return PriorityImmediate
+	case pkt.NoCRC && !pkt.InvertPolar:
+		return PriorityBeacon
+	}
+	return PriorityScheduled
+}
+
+// Item is a downlink that is due at At.
+type Item struct {
+	At       time.Time      `json:"at"`
+	Pkt      *lora.TxPacket `json:"txpk"`
+	Priority Priority       `json:"priority"`
+	// Queued is when an immediate downlink was queued, the earliest time it can go out.
+	Queued time.Time `json:"queued,omitempty"`
+	// Server is the address of the server that sent the downlink, if known.
+	Server string `json:"server,omitempty"`
+	// ServerPriority is the priority of the server over the other servers, see Push.
+	ServerPriority int `json:"server_priority,omitempty"`
+	// Token is the token of the PULL_RESP of the downlink, to tell the server if it is dropped.
+	Token [2]byte `json:"token"`
+
+	preempted bool
+}
+
+// end returns the time the radio is free again after the item.
+func (it *Item) end() time.Time {
+	return it.At.Add(it.Pkt.Airtime() + Guard)
+}
+
+func (it *Item) overlaps(at time.Time, other *Item) bool {
+	return at.Before(other.end()) && other.At.Before(at.Add(it.Pkt.Airtime()+Guard))
+}
+
+// Queue is a downlink queue, ordered by time. It is not safe for concurrent use.
+type Queue struct {
+	path  string
+	items []*Item
+
+	// Preempted counts the immediate downlinks that were delayed for others.
+	Preempted int
+	// Collisions counts the downlinks rejected by Push as they overlap others.
+	Collisions int
+	// Clock places the immediate downlinks, the system clock if nil.
+	Clock clock.Clock
+	// MaxLen is the most downlinks queued, beacons aside, or 0 for no limit.
+	MaxLen int
+}
+
+// New returns an empty queue. With a path, the queue is written to the file on every change, see Load.
+func New(path string) *Queue {
+	return &Queue{path: path}
+}
+
+// Load returns the items saved to the file at path, or none if there is no file.
+func Load(path string) ([]*Item, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var items []*Item
+	if len(data) == 0 {
+		return nil, nil
+	}
+	err = json.Unmarshal(data, &items)
+	return items, err
+}
+
+// Len returns the number of queued downlinks.
+func (q *Queue) Len() int {
+	return len(q.items)
+}
+
+// Next returns the downlink that is due first, or nil.
+func (q *Queue) Next() *Item {
+	if len(q.items) == 0 {
+		return nil
+	}
+	return q.items[0]
+}
+
+// Push queues a downlink. Immediate downlinks are placed in the first gap
+// after Queued (or now), the others at At.
+//
+// A scheduled downlink that overlaps another scheduled one or a beacon is not queued
+// and returns ErrCollision or ErrCollisionBeacon, so the first one queued wins. A beacon takes
+// the place of the scheduled downlinks it overlaps, and a scheduled downlink those of servers
+// with a lower ServerPriority, which are returned as dropped.
+//
+// Other than a beacon, a downlink is not queued either if MaxLen downlinks are, and returns
+// ErrQueueFull.
+func (q *Queue) Push(it *Item) (dropped []*Item, err error) {
+	if q.MaxLen > 0 && len(q.items) >= q.MaxLen && it.Priority != PriorityBeacon {
+		return nil, ErrQueueFull
+	}
+	if it.Priority == PriorityImmediate {
+		if it.Queued.IsZero() {
+			it.Queued = clock.OrReal(q.Clock).Now()
+		}
+		it.At = it.Queued
+	} else {
+		kept := q.items[:0]
+		for _, other := range q.items {
+			if other.Priority == PriorityImmediate || !it.overlaps(it.At, other) {
+				kept = append(kept, other)
+				continue
+			}
+			switch {
+			case other.Priority == PriorityBeacon:
+				err = ErrCollisionBeacon
+			case it.Priority == PriorityBeacon:
+				dropped = append(dropped, other)
+				continue
+			case it.ServerPriority > other.ServerPriority:
+				dropped = append(dropped, other)
+				continue
+			default:
+				err = ErrCollision
+			}
+			kept = append(kept, other)
+		}
+		if err != nil {
+			// nothing dropped, as the downlink is not queued
+			q.Collisions++
+			q.items = append(kept, dropped...)
+			q.sort()
+			return nil, err
+		}
+		q.items = kept
+	}
+	q.items = append(q.items, it)
+	q.place(clock.OrReal(q.Clock).Now())
+	return dropped, q.save()
+}
+
+// Pop removes and returns the downlink that is due first, or nil.
+func (q *Queue) Pop() (*Item, error) {
+	if len(q.items) == 0 {
+		return nil, nil
+	}
+	it := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	return it, q.save()
+}
+
+// place moves the immediate downlinks, in the order they were queued, to the first gap
+// after they were queued in which they overlap no other downlink.
+func (q *Queue) place(now time.Time) {
+	var placed, immediate []*Item
+	for _, it := range q.items {
+		if it.Priority == PriorityImmediate {
+			immediate = append(immediate, it)
+		} else {
+			placed = append(placed, it)
+		}
+	}
+	sort.SliceStable(immediate, func(i, j int) bool {
+		return immediate[i].Queued.Before(immediate[j].Queued)
+	})
+	for _, it := range immediate {
+		at := it.Queued
+		if at.Before(now) {
+			at = now
+		}
+		for moved := true; moved; {
+			moved = false
+			for _, other := range placed {
+				if it.overlaps(at, other) {
+					at = other.end()
+					moved = true
+				}
+			}
+		}
+		if !it.preempted && at.After(it.Queued) && at.After(now) {
+			it.preempted = true
+			q.Preempted++
+		}
+		it.At = at
+		placed = append(placed, it)
+	}
+	q.items = placed
+	q.sort()
+}
+
+func (q *Queue) sort() {
+	sort.SliceStable(q.items, func(i, j int) bool {
+		return q.items[i].At.Before(q.items[j].At)
+	})
+}
+
+// save replaces the file, so it never holds a partial queue.
+func (q *Queue) save() error {
+	if q.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(q.items)
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
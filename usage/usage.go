@@ -0,0 +1,226 @@
+// Package usage counts the bytes the backends send and receive by day and by billing month, so
+// users on metered cellular plans can see what the forwarder costs them.
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Config is the "usage_conf" section of the gateway config.
+type Config struct {
+	// Path of the JSON file the counts are kept in across restarts, which is rewritten every
+	// Interval. The counts start from zero at each start if not set.
+	Path string `json:"path"`
+	// Interval between writes in seconds, 60 if not set.
+	Interval int `json:"interval"`
+	// BillingDay is the day of the month, 1 to 28, the plan renews on, 1 if not set.
+	BillingDay int `json:"billing_day"`
+}
+
+// The backends that are counted.
+const (
+	BackendUDP     = "udp"     // the servers of the Semtech UDP protocol
+	BackendWebhook = "webhook" // the webhook
+)
+
+// dayFormat is the format of the days, in local time.
+const dayFormat = "2006-01-02"
+
+// Counter is the number of bytes sent and received.
+type Counter struct {
+	Sent     uint64 `json:"sent"`
+	Received uint64 `json:"received"`
+}
+
+func (c *Counter) add(o *Counter) {
+	c.Sent += o.Sent
+	c.Received += o.Received
+}
+
+// Report is the usage of the backends today and in the current billing month, by backend.
+type Report struct {
+	Day        string             `json:"day"`
+	Today      map[string]Counter `json:"today"`
+	MonthStart string             `json:"month_start"`
+	Month      map[string]Counter `json:"month"`
+	Total      Counter            `json:"month_total"`
+}
+
+// Meter counts the bytes of the backends and writes the counts in the background.
+type Meter struct {
+	Logger *log.Logger
+
+	path       string
+	billingDay int
+
+	mu   sync.Mutex
+	days map[string]map[string]*Counter // by day and backend
+	done chan struct{}
+}
+
+// Open returns a Meter with the counts of the file of the config, if it exists, and starts
+// writing it.
+func Open(cfg *Config) (*Meter, error) {
+	if cfg.BillingDay < 0 || cfg.BillingDay > 28 {
+		return nil, fmt.Errorf("usage: billing day %d not in 1 to 28", cfg.BillingDay)
+	}
+	m := &Meter{
+		Logger:     log.New(os.Stdout, "[USAGE] ", 0),
+		path:       cfg.Path,
+		billingDay: 1,
+		days:       make(map[string]map[string]*Counter),
+		done:       make(chan struct{}),
+	}
+	if cfg.BillingDay != 0 {
+		m.billingDay = cfg.BillingDay
+	}
+	if m.path == "" {
+		return m, nil
+	}
+	data, err := ioutil.ReadFile(m.path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("usage: %v", err)
+	default:
+		if err := json.Unmarshal(data, &m.days); err != nil {
+			return nil, fmt.Errorf("usage: %s: %v", m.path, err)
+		}
+	}
+	interval := 60 * time.Second
+	if cfg.Interval > 0 {
+		interval = time.Duration(cfg.Interval) * time.Second
+	}
+	go m.run(interval)
+	return m, nil
+}
+
+// Add counts the bytes a backend sent and received now.
+func (m *Meter) Add(backend string, sent, received int) {
+	day := time.Now().Format(dayFormat)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	backends := m.days[day]
+	if backends == nil {
+		backends = make(map[string]*Counter)
+		m.days[day] = backends
+	}
+	c := backends[backend]
+	if c == nil {
+		c = new(Counter)
+		backends[backend] = c
+	}
+	c.add(&Counter{Sent: uint64(sent), Received: uint64(received)})
+}
+
+// Datagram returns the bytes of a UDP datagram with n bytes of payload to or from addr, with the
+// IP and UDP headers, as the operators of cellular networks count them.
+func Datagram(addr *net.UDPAddr, n int) int {
+	if addr.IP.To4() != nil {
+		return n + 20 + 8
+	}
+	return n + 40 + 8
+}
+
+// monthStart returns the first day of the billing month of now.
+func (m *Meter) monthStart(now time.Time) time.Time {
+	start := time.Date(now.Year(), now.Month(), m.billingDay, 0, 0, 0, 0, now.Location())
+	if now.Day() < m.billingDay {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+// Report returns the usage at now.
+func (m *Meter) Report(now time.Time) *Report {
+	today := now.Format(dayFormat)
+	start := m.monthStart(now).Format(dayFormat)
+	r := &Report{
+		Day:        today,
+		Today:      make(map[string]Counter),
+		MonthStart: start,
+		Month:      make(map[string]Counter),
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for day, backends := range m.days {
+		// the days are in dayFormat, so they sort as strings
+		if day < start || day > today {
+			continue
+		}
+		for backend, c := range backends {
+			month := r.Month[backend]
+			month.add(c)
+			r.Month[backend] = month
+			r.Total.add(c)
+			if day == today {
+				r.Today[backend] = *c
+			}
+		}
+	}
+	return r
+}
+
+// Close stops the background writes and writes the file a last time.
+func (m *Meter) Close() error {
+	if m.path == "" {
+		return nil
+	}
+	close(m.done)
+	return m.write()
+}
+
+func (m *Meter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.write(); err != nil {
+				m.Logger.Printf("can not write usage: %v", err)
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// keepDays is the number of days kept in the file, more than a billing month.
+const keepDays = 62
+
+// write drops the days older than keepDays and replaces the file, so readers never see a
+// partial file.
+func (m *Meter) write() error {
+	oldest := time.Now().AddDate(0, 0, -keepDays).Format(dayFormat)
+	m.mu.Lock()
+	for day := range m.days {
+		if day < oldest {
+			delete(m.days, day)
+		}
+	}
+	data, err := json.MarshalIndent(m.days, "", "  ")
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+)
+
+// watchdogCheck is the interval at which the watchdog checks that the radios answer on the SPI bus.
+const watchdogCheck = 10 * time.Second
+
+// watchRadio checks the radio after it was polled for packets, and resets it if it stalled:
+// if it does not answer on the SPI bus, or if it received packets before but none for radioWatchdog.
+// A radio that never received packets is not expected to, so it is only checked on the SPI bus.
+func (gw *Gateway) watchRadio(radio *gatewayRadio, received bool) {
+	now := time.Now()
+	if received {
+		radio.lastRx = now
+		return
+	}
+	if !radio.lastRx.IsZero() && now.Sub(radio.lastRx) > gw.radioWatchdog {
+		log(LogLevelWarning, "radio %d: no packets for %s", radio.index, now.Sub(radio.lastRx).Truncate(time.Second))
+		resetRadio(radio)
+		return
+	}
+	if now.Sub(radio.checked) < watchdogCheck {
+		return
+	}
+	radio.checked = now
+	if r, ok := radio.Radio.(interface{ Check() error }); ok {
+		if err := r.Check(); err != nil {
+			log(LogLevelWarning, "radio %d: %v", radio.index, err)
+			resetRadio(radio)
+		}
+	}
+}
+
+// resetRadio resets the radio with its reset pin, and sets it to receive again on its channel.
+// It returns false for radios that can not be reset, as the simulation, which are left alone.
+func resetRadio(radio *gatewayRadio) bool {
+	r, ok := radio.Radio.(interface{ Reset() error })
+	if !ok {
+		return false
+	}
+	log(LogLevelWarning, "radio %d: resetting the radio", radio.index)
+	if err := r.Reset(); err != nil {
+		fatal("radio %d: can not reset: %v", radio.index, err)
+	}
+	radio.receiving = false
+	// give the radio another watchdog period to receive
+	if !radio.lastRx.IsZero() {
+		radio.lastRx = time.Now()
+	}
+	radio.checked = time.Now()
+	return true
+}
@@ -0,0 +1,295 @@
+// Package webhook posts received packets as JSON to an HTTP(S) endpoint,
+// for piping packets into a serverless function instead of running a LoRaWAN stack.
+package webhook
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/compact"
+	"github.com/Waziup/single_chan_pkt_fwd/gwproto"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/proxy"
+)
+
+// SignatureHeader holds the hex HMAC-SHA256 of the request body, as in "sha256=1f2e...",
+// if a secret is configured.
+const SignatureHeader = "X-Signature"
+
+// IdempotencyHeader holds a random key per batch, the same in the retries of the batch, so the
+// endpoint can drop the batches it already has.
+const IdempotencyHeader = "Idempotency-Key"
+
+// ErrQueueFull is returned by Send if the endpoint can not keep up with the packets.
+var ErrQueueFull = fmt.Errorf("webhook %w", lora.ErrQueueFull)
+
+// Config is the "webhook_conf" section of the gateway config.
+type Config struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"` // key for the SignatureHeader, no signature if empty
+	// BatchSize is the max number of packets per request, 10 if not set.
+	BatchSize int `json:"batch_size"`
+	// BatchInterval is the max time in seconds a packet waits for a batch to fill, 1 if not set.
+	BatchInterval int `json:"batch_interval"`
+	// Retries is the number of times a failed request is repeated, 3 if not set and none if negative.
+	Retries int `json:"retries"`
+	// Timeout for each request in seconds, 10 if not set.
+	Timeout int `json:"timeout"`
+	// Proxy is the HTTP or SOCKS5 proxy URL, see proxy.Transport.
+	Proxy string `json:"proxy"`
+	// Encoding of the body, "json" if not set, "protobuf" for the UplinkFrames of gwproto, or
+	// "cbor" for the batches of compact.
+	Encoding string `json:"encoding"`
+	// Gzip compresses the body, with the Content-Encoding gzip.
+	Gzip bool `json:"gzip"`
+}
+
+// Batch is the request body.
+type Batch struct {
+	GatewayID string            `json:"gateway_id"`
+	RxPackets []json.RawMessage `json:"rxpk"`
+}
+
+// Backend batches packets and posts them to the webhook in the background.
+type Backend struct {
+	Logger *log.Logger
+	// Traffic, if set, is called with the bytes written to and read from the connections to the
+	// endpoint, with the TLS and HTTP overhead, as they are.
+	Traffic func(sent, received int)
+
+	url       string
+	secret    []byte
+	gatewayID uint64
+	encoding  string
+	gzip      bool
+	batchSize int
+	interval  time.Duration
+	retries   int
+	client    *http.Client
+	queue     chan *lora.RxPacket
+}
+
+// New returns a Backend for the gateway and starts posting to the webhook.
+func New(cfg *Config, gatewayID uint64) (*Backend, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("webhook: no url")
+	}
+	transport, err := proxy.Transport(cfg.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: %v", err)
+	}
+	switch cfg.Encoding {
+	case "", "json", "protobuf", "cbor":
+	default:
+		return nil, fmt.Errorf("webhook: unknown encoding %q, must be json, protobuf or cbor", cfg.Encoding)
+	}
+	b := &Backend{
+		Logger:    log.New(os.Stdout, "[HOOK ] ", 0),
+		url:       cfg.URL,
+		secret:    []byte(cfg.Secret),
+		gatewayID: gatewayID,
+		encoding:  cfg.Encoding,
+		gzip:      cfg.Gzip,
+		batchSize: 10,
+		interval:  time.Second,
+		retries:   3,
+		client:    &http.Client{Timeout: 10 * time.Second, Transport: transport},
+	}
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: conn, b: b}, nil
+	}
+	if cfg.BatchSize > 0 {
+		b.batchSize = cfg.BatchSize
+	}
+	if cfg.BatchInterval > 0 {
+		b.interval = time.Duration(cfg.BatchInterval) * time.Second
+	}
+	if cfg.Retries != 0 {
+		b.retries = cfg.Retries
+	}
+	if cfg.Timeout > 0 {
+		b.client.Timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	b.queue = make(chan *lora.RxPacket, 4*b.batchSize)
+	go b.run()
+	return b, nil
+}
+
+// Send queues the packets for the webhook.
+// The packets are not referenced after Send returns.
+func (b *Backend) Send(pkts []*lora.RxPacket) error {
+	for _, pkt := range pkts {
+		if err := pkt.Validate(); err != nil {
+			return err
+		}
+		clone := pkt.Clone()
+		select {
+		case b.queue <- clone:
+		default:
+			clone.Release()
+			return ErrQueueFull
+		}
+	}
+	return nil
+}
+
+func (b *Backend) run() {
+	timer := time.NewTimer(b.interval)
+	timer.Stop()
+	var batch []*lora.RxPacket
+	for {
+		select {
+		case pkt := <-b.queue:
+			if len(batch) == 0 {
+				timer.Reset(b.interval)
+			}
+			batch = append(batch, pkt)
+			if len(batch) < b.batchSize {
+				continue
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+		}
+		if err := b.post(batch); err != nil {
+			b.Logger.Printf("can not post %d packets: %v", len(batch), err)
+		}
+		for _, pkt := range batch {
+			pkt.Release()
+		}
+		batch = nil
+	}
+}
+
+func (b *Backend) post(batch []*lora.RxPacket) error {
+	body, contentType, err := b.body(batch)
+	if err != nil {
+		return err
+	}
+	if b.gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	idempotencyKey := hex.EncodeToString(key[:])
+	var signature string
+	if len(b.secret) != 0 {
+		mac := hmac.New(sha256.New, b.secret)
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	backoff := time.Second
+	for try := 0; ; try++ {
+		err = b.do(body, contentType, signature, idempotencyKey)
+		if err == nil || errors.Is(err, errPermanent) || try >= b.retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// countingConn passes the bytes of a connection to the Traffic of the backend.
+type countingConn struct {
+	net.Conn
+	b *Backend
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n != 0 && c.b.Traffic != nil {
+		c.b.Traffic(0, n)
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n != 0 && c.b.Traffic != nil {
+		c.b.Traffic(n, 0)
+	}
+	return n, err
+}
+
+// errPermanent marks responses where a retry will not help.
+var errPermanent = errors.New("permanent")
+
+// body returns the request body of a batch in the encoding of the backend, and its content type.
+func (b *Backend) body(batch []*lora.RxPacket) ([]byte, string, error) {
+	switch b.encoding {
+	case "protobuf":
+		frames := make([][]byte, len(batch))
+		for i, pkt := range batch {
+			frames[i] = gwproto.MarshalUplink(b.gatewayID, pkt)
+		}
+		return gwproto.MarshalUplinks(b.gatewayID, frames), gwproto.ContentType, nil
+	case "cbor":
+		return compact.Marshal(&compact.Batch{GatewayID: b.gatewayID, Packets: batch}), compact.ContentType, nil
+	}
+	rxpk := make([]json.RawMessage, len(batch))
+	for i, pkt := range batch {
+		data, err := json.Marshal(pkt)
+		if err != nil {
+			return nil, "", err
+		}
+		rxpk[i] = data
+	}
+	body, err := json.Marshal(&Batch{GatewayID: fmt.Sprintf("%016X", b.gatewayID), RxPackets: rxpk})
+	return body, "application/json", err
+}
+
+func (b *Backend) do(body []byte, contentType, signature, idempotencyKey string) error {
+	req, err := http.NewRequest(http.MethodPost, b.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if b.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	req.Header.Set(IdempotencyHeader, idempotencyKey)
+	if signature != "" {
+		req.Header.Set(SignatureHeader, signature)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %s", errPermanent, resp.Status)
+	default:
+		return errors.New(resp.Status)
+	}
+}
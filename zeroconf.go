@@ -0,0 +1,50 @@
+package main
+
+import (
+	logger "log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/api"
+	"github.com/Waziup/single_chan_pkt_fwd/mdns"
+)
+
+// advertise starts advertising the gateway, with the port of the API if it is served.
+func (gw *Gateway) advertise(cfg *mdns.Config, gwid uint64, apiConf *api.Config) {
+	port := 0
+	if apiConf != nil {
+		if _, p, err := net.SplitHostPort(apiConf.Address); err == nil {
+			port, _ = strconv.Atoi(p)
+		}
+	}
+	var err error
+	gw.responder, err = mdns.Advertise(cfg, gwid, port)
+	if err != nil {
+		log(LogLevelError, "can not advertise the gateway: %v", err)
+		return
+	}
+	gw.responder.Logger = logger.New(os.Stdout, "", 0)
+	log(LogLevelVerbose, "advertising the gateway as %s", mdns.Service)
+}
+
+// discoverServer adds the first server of the service type cfg.Discover that answers on the
+// local network. It is used if no server is enabled, and stops the forwarder if none answers.
+func (gw *Gateway) discoverServer(cfg *mdns.Config) {
+	timeout := 3 * time.Second
+	if cfg.Timeout > 0 {
+		timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	log(LogLevelVerbose, "discovering servers of %s", cfg.Discover)
+	instances, err := mdns.Discover(cfg.Discover, timeout)
+	if err != nil {
+		fatal("no server enabled and none discovered: %v", err)
+	}
+	for _, inst := range instances[1:] {
+		log(LogLevelVerbose, " ignoring server %s (%s)", inst.Name, inst.Addr)
+	}
+	inst := instances[0]
+	log(LogLevelVerbose, " server %s (%s)", inst.Name, inst.Addr)
+	gw.servers = append(gw.servers, newUpstreamServer(inst.Addr, 0, gw.clock))
+}